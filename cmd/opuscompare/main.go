@@ -0,0 +1,80 @@
+// Command opuscompare compares a decoded file with the output of the
+// reference decoder, like opus_compare from the Opus reference
+// implementation. It is how the RFC 6716 and RFC 8251 test vectors are
+// checked.
+//
+//	opuscompare [flags] reference.dec decoded.sw
+//
+// Both files hold 16-bit little endian samples. The reference is at 48
+// kHz, and the decoded file at the rate given by -r. A file passes when
+// its quality is 0% or more.
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+
+	"github.com/pion/opus/pkg/opuscompare"
+	"github.com/pion/opus/pkg/testvector"
+)
+
+var errFails = errors.New("test vector FAILS")
+
+func main() {
+	stereo := flag.Bool("s", false, "the files are stereo")
+	rate := flag.Int("r", 48000, "sample rate of the decoded file: 8000, 12000, 16000, 24000 or 48000")
+	flag.Usage = func() {
+		fmt.Fprintf(flag.CommandLine.Output(), "usage: %s [flags] reference.dec decoded.sw\n", os.Args[0])
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+
+	if flag.NArg() != 2 {
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	channels := 1
+	if *stereo {
+		channels = 2
+	}
+
+	if err := run(flag.Arg(0), flag.Arg(1), channels, *rate); err != nil {
+		fmt.Fprintf(os.Stderr, "opuscompare: %v\n", err)
+		os.Exit(1)
+	}
+}
+
+func run(referenceFile, decodedFile string, channels, rate int) error {
+	reference, err := readPCM(referenceFile)
+	if err != nil {
+		return err
+	}
+
+	decoded, err := readPCM(decodedFile)
+	if err != nil {
+		return err
+	}
+
+	result, err := opuscompare.CompareInt16(reference, decoded, channels, rate)
+	if err != nil {
+		return err
+	} else if !result.Passed() {
+		return fmt.Errorf("%w: internal weighted error is %f", errFails, result.WeightedError)
+	}
+
+	fmt.Printf("Test vector PASSES\nOpus quality metric: %.1f %% (internal weighted error is %f)\n", result.Quality, result.WeightedError)
+	return nil
+}
+
+func readPCM(fileName string) ([]int16, error) {
+	file, err := os.Open(fileName) //nolint:gosec
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close() //nolint:errcheck
+
+	return testvector.ReadPCM(file)
+}
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"errors"
+	"math/rand"
+
+	"github.com/pion/opus"
+)
+
+var errCannotConceal = errors.New("decoder can't conceal lost packets")
+
+type decodeStats struct {
+	packets  int
+	dropped  int
+	rejected int
+}
+
+// streamDecoder decodes one Opus stream. Packets opus.Decoder rejects are
+// counted and concealed, like lost ones.
+type streamDecoder struct {
+	*opus.Decoder
+	stats *decodeStats
+}
+
+func (d *streamDecoder) DecodeFloat32(in []byte, out []float32) (int, error) {
+	samples, err := d.Decoder.DecodeFloat32(in, out)
+	if err == nil {
+		return samples, nil
+	}
+
+	d.stats.rejected++
+	if samples, err = opus.PacketSampleCount(in, decodeSampleRate); err != nil {
+		return 0, err
+	}
+	return d.Conceal(out, samples)
+}
+
+// lossDecoder drops a percentage of the packets before they reach the
+// decoder, which conceals them
+type lossDecoder struct {
+	decoder interface {
+		opus.PCMDecoder
+		opus.Concealer
+	}
+	percent float64
+	rand    *rand.Rand
+	stats   *decodeStats
+}
+
+func newLossDecoder(decoder opus.PCMDecoder, percent float64, random *rand.Rand, stats *decodeStats) (*lossDecoder, error) {
+	concealer, ok := decoder.(interface {
+		opus.PCMDecoder
+		opus.Concealer
+	})
+	if !ok {
+		return nil, errCannotConceal
+	}
+
+	return &lossDecoder{decoder: concealer, percent: percent, rand: random, stats: stats}, nil
+}
+
+func (d *lossDecoder) DecodeFloat32(in []byte, out []float32) (int, error) {
+	d.stats.packets++
+	if d.percent == 0 || d.rand.Float64()*100 >= d.percent {
+		return d.decoder.DecodeFloat32(in, out)
+	}
+
+	d.stats.dropped++
+	samples, err := opus.PacketSampleCount(in, decodeSampleRate)
+	if err != nil {
+		return 0, err
+	}
+	return d.decoder.Conceal(out, samples)
+}
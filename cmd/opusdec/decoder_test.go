@@ -0,0 +1,94 @@
+package main
+
+import (
+	"math/rand"
+	"testing"
+
+	"github.com/pion/opus"
+)
+
+// fakeDecoder fills decoded packets with ones and concealed ones with
+// twos
+type fakeDecoder struct{}
+
+func (fakeDecoder) DecodeFloat32(in []byte, out []float32) (int, error) {
+	samples, err := opus.PacketSampleCount(in, decodeSampleRate)
+	for i := range out[:samples] {
+		out[i] = 1
+	}
+	return samples, err
+}
+
+func (fakeDecoder) Conceal(out []float32, samples int) (int, error) {
+	for i := range out[:samples] {
+		out[i] = 2
+	}
+	return samples, nil
+}
+
+func TestLossDecoder(t *testing.T) {
+	// A 20 ms CELT packet
+	packet := []byte{0x98, 0x00}
+
+	for _, test := range []struct {
+		name    string
+		percent float64
+		dropped int
+	}{
+		{"No loss", 0, 0},
+		{"Every packet", 100, 50},
+		{"Some packets", 30, 19},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			stats := &decodeStats{}
+			decoder, err := newLossDecoder(fakeDecoder{}, test.percent, rand.New(rand.NewSource(1)), stats) //nolint:gosec
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			concealed := 0
+			out := make([]float32, maxPacketSamples)
+			for i := 0; i < 50; i++ {
+				samples, err := decoder.DecodeFloat32(packet, out)
+				if err != nil {
+					t.Fatal(err)
+				} else if samples != 960 {
+					t.Fatalf("expected 960 samples, got %d", samples)
+				}
+				if out[0] == 2 {
+					concealed++
+				}
+			}
+
+			if stats.packets != 50 || stats.dropped != test.dropped || concealed != test.dropped {
+				t.Fatalf("expected %d of 50 packets dropped, got %+v and %d concealed", test.dropped, stats, concealed)
+			}
+		})
+	}
+
+	if _, err := newLossDecoder(struct{ opus.PCMDecoder }{fakeDecoder{}}, 0, nil, &decodeStats{}); err == nil {
+		t.Fatal("expected an error for a decoder that can't conceal")
+	}
+}
+
+func TestStreamDecoderConcealsRejectedPackets(t *testing.T) {
+	stats := &decodeStats{}
+	decoder := &streamDecoder{Decoder: opus.NewStreamDecoder(1).(*opus.Decoder), stats: stats}
+	out := make([]float32, maxPacketSamples)
+
+	// A code 2 packet with a frame length longer than the packet
+	samples, err := decoder.DecodeFloat32([]byte{0x0A, 0xFF}, out)
+	if err != nil {
+		t.Fatal(err)
+	} else if samples != 1920 || stats.rejected != 1 {
+		t.Fatalf("expected 1920 concealed samples, got %d and %+v", samples, stats)
+	}
+
+	// A packet without a TOC byte can't be concealed, as its duration is
+	// unknown
+	if _, err = decoder.DecodeFloat32(nil, out); err == nil {
+		t.Fatal("expected an error for an empty packet")
+	} else if stats.rejected != 2 {
+		t.Fatalf("expected 2 rejected packets, got %+v", stats)
+	}
+}
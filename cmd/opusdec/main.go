@@ -0,0 +1,179 @@
+// Command opusdec decodes an Ogg Opus, WebM or MP4 file into a WAVE file,
+// in the manner of opusdec from opus-tools.
+//
+//	opusdec [flags] input.opus output.wav
+//
+// The container is picked from the extension of the input: .webm, .mkv
+// and .mka are read as Matroska, .mp4, .m4a and .mov as MP4 and anything
+// else as Ogg. Pre-skip, end trimming and the output gain are applied as
+// the container specifies.
+//
+// Packets dropped by the packet loss simulation, and packets the decoder
+// rejects, are concealed by the packet loss concealment of the decoder.
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"math"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/pion/opus"
+	"github.com/pion/opus/pkg/oggopusreader"
+	"github.com/pion/opus/pkg/oggreader"
+	"github.com/pion/opus/pkg/wav"
+)
+
+const decodeSampleRate = 48000
+
+var (
+	errBadRate             = errors.New("output sample rate must be 8000, 12000, 16000, 24000 or 48000")
+	errBadLoss             = errors.New("packet loss must be between 0 and 100 percent")
+	errChannelCountChanged = errors.New("channel count changed between chain links")
+)
+
+type config struct {
+	input, output string
+
+	rate       int
+	float      bool
+	forceMono  bool
+	gain       float64
+	packetLoss float64
+	seed       int64
+}
+
+func main() {
+	cfg := config{}
+	flag.IntVar(&cfg.rate, "rate", decodeSampleRate, "output sample rate: 8000, 12000, 16000, 24000 or 48000")
+	flag.BoolVar(&cfg.float, "float", false, "write 32-bit float samples instead of 16-bit")
+	flag.BoolVar(&cfg.forceMono, "force-mono", false, "downmix the output to mono")
+	flag.Float64Var(&cfg.gain, "gain", 0, "gain in dB, added to the output gain of the stream")
+	flag.Float64Var(&cfg.packetLoss, "packet-loss", 0, "percentage of packets to drop at random, to test concealment")
+	flag.Int64Var(&cfg.seed, "seed", 1, "seed of the packet loss simulation")
+	flag.Usage = func() {
+		fmt.Fprintf(flag.CommandLine.Output(), "usage: %s [flags] input output.wav\n", os.Args[0])
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+
+	if flag.NArg() != 2 {
+		flag.Usage()
+		os.Exit(2)
+	}
+	cfg.input, cfg.output = flag.Arg(0), flag.Arg(1)
+
+	if err := run(cfg); err != nil {
+		fmt.Fprintf(os.Stderr, "opusdec: %v\n", err)
+		os.Exit(1)
+	}
+}
+
+func run(cfg config) error {
+	switch cfg.rate {
+	case 8000, 12000, 16000, 24000, 48000:
+	default:
+		return errBadRate
+	}
+
+	if cfg.packetLoss < 0 || cfg.packetLoss > 100 {
+		return errBadLoss
+	}
+
+	in, err := os.Open(cfg.input)
+	if err != nil {
+		return err
+	}
+	defer in.Close() //nolint:errcheck
+
+	stats := &decodeStats{}
+	random := rand.New(rand.NewSource(cfg.seed)) //nolint:gosec
+	newDecoder := func(header *oggreader.OggHeader) (opus.PCMDecoder, error) {
+		decoder, err := oggopusreader.NewDecoder(header, func(channels int) opus.PCMDecoder {
+			return &streamDecoder{Decoder: opus.NewStreamDecoder(channels).(*opus.Decoder), stats: stats}
+		})
+		if err != nil {
+			return nil, err
+		}
+
+		return newLossDecoder(decoder, cfg.packetLoss, random, stats)
+	}
+
+	var src source
+	switch strings.ToLower(filepath.Ext(cfg.input)) {
+	case ".webm", ".mkv", ".mka":
+		src, err = newWebMSource(in, newDecoder)
+	case ".mp4", ".m4a", ".mov":
+		src, err = newMP4Source(in, newDecoder)
+	default:
+		src, err = newOggSource(in, newDecoder)
+	}
+	if err != nil {
+		return err
+	}
+
+	channels := src.Channels()
+	outChannels := channels
+	if cfg.forceMono {
+		outChannels = 1
+	}
+
+	var opts []wav.Option
+	if cfg.float {
+		opts = append(opts, wav.WithFloat32())
+	}
+
+	out, err := wav.New(cfg.output, cfg.rate, outChannels, opts...)
+	if err != nil {
+		return err
+	}
+
+	err = decode(src, out, cfg, channels)
+	if closeErr := out.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+
+	fmt.Fprintf(os.Stderr, "decoded %d packets, %d dropped by the loss simulation, %d rejected by the decoder\n",
+		stats.packets, stats.dropped, stats.rejected)
+	return nil
+}
+
+func decode(src source, out *wav.WAVWriter, cfg config, channels int) error {
+	scale := float32(math.Pow(10, cfg.gain/20))
+	resampler := newResampler(decodeSampleRate, cfg.rate, channels)
+	write := func(pcm []float32) error {
+		if cfg.forceMono {
+			pcm = downmix(pcm, channels)
+		}
+		return out.WriteFloat32(pcm)
+	}
+
+	for {
+		pcm, err := src.Read()
+		if errors.Is(err, io.EOF) {
+			return write(resampler.flush())
+		} else if err != nil {
+			return err
+		} else if src.Channels() != channels {
+			return errChannelCountChanged
+		}
+
+		if scale != 1 {
+			for i := range pcm {
+				pcm[i] *= scale
+			}
+		}
+
+		if err = write(resampler.process(pcm)); err != nil {
+			return err
+		}
+	}
+}
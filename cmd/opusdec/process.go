@@ -0,0 +1,128 @@
+package main
+
+import "github.com/pion/opus/internal/resample"
+
+// resampler lowers the sample rate of interleaved samples from 48 kHz
+// with a resample.Resampler per channel. Samples that don't fill a block of
+// the resamplers are carried over to the next call. The filter delay is
+// removed from the start of the output, and flush makes up for it at the
+// end, so the output lines up with the input.
+type resampler struct {
+	inputRate, outputRate int
+	channels              int
+	resamplers            []*resample.Resampler
+
+	// Input carried over to the next call, output samples of the filter
+	// delay still to drop, and the number of samples per channel in and
+	// out so far
+	pending             []float32
+	skip                int
+	inFrames, outFrames int
+}
+
+func newResampler(inputRate, outputRate, channels int) *resampler {
+	r := &resampler{
+		channels:   channels,
+		resamplers: make([]*resample.Resampler, channels),
+		inputRate:  inputRate,
+		outputRate: outputRate,
+	}
+	for c := range r.resamplers {
+		r.resamplers[c] = resample.New(inputRate, outputRate)
+	}
+	r.skip = r.resamplers[0].Delay()
+
+	return r
+}
+
+func (r *resampler) process(pcm []float32) []float32 {
+	if r.inputRate == r.outputRate {
+		return pcm
+	}
+
+	r.inFrames += len(pcm) / r.channels
+	r.pending = append(r.pending, pcm...)
+
+	blockSize := r.resamplers[0].BlockSize()
+	frames := len(r.pending) / r.channels / blockSize * blockSize
+	out := r.resample(r.pending[:frames*r.channels])
+	r.pending = append(r.pending[:0], r.pending[frames*r.channels:]...)
+
+	return out
+}
+
+// flush returns the output still held back by the carry-over and the
+// filter delay
+func (r *resampler) flush() []float32 {
+	if r.inputRate == r.outputRate {
+		return nil
+	}
+
+	blockSize := r.resamplers[0].BlockSize()
+	frames := len(r.pending)/r.channels + r.resamplers[0].Delay()*r.inputRate/r.outputRate + blockSize
+	frames = frames / blockSize * blockSize
+	r.pending = append(r.pending, make([]float32, frames*r.channels-len(r.pending))...)
+
+	out := r.resample(r.pending)
+	r.pending = r.pending[:0]
+
+	if expected := r.inFrames * r.outputRate / r.inputRate; r.outFrames > expected {
+		out = out[:len(out)-(r.outFrames-expected)*r.channels]
+		r.outFrames = expected
+	}
+	return out
+}
+
+// resample runs the resampler of each channel over a whole number of
+// blocks and drops the output of the filter delay
+func (r *resampler) resample(pcm []float32) []float32 {
+	frames := len(pcm) / r.channels
+	channel := make([]float32, frames)
+
+	var out []float32
+	for c, channelResampler := range r.resamplers {
+		for i := range channel {
+			channel[i] = pcm[i*r.channels+c]
+		}
+
+		resampled := channelResampler.Process(channel)
+		if out == nil {
+			out = make([]float32, len(resampled)*r.channels)
+		}
+		for i, sample := range resampled {
+			out[i*r.channels+c] = sample
+		}
+	}
+
+	skip := minInt(r.skip, len(out)/r.channels)
+	r.skip -= skip
+	out = out[skip*r.channels:]
+	r.outFrames += len(out) / r.channels
+
+	return out
+}
+
+// downmix averages the channels of interleaved samples
+func downmix(pcm []float32, channels int) []float32 {
+	if channels == 1 {
+		return pcm
+	}
+
+	out := make([]float32, len(pcm)/channels)
+	for i := range out {
+		var sum float32
+		for _, sample := range pcm[i*channels : (i+1)*channels] {
+			sum += sample
+		}
+		out[i] = sum / float32(channels)
+	}
+
+	return out
+}
+
+func minInt(a, b int) int {
+	if a < b {
+		return a
+	}
+	return b
+}
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"math"
+	"reflect"
+	"testing"
+)
+
+func sine(frequency float64, channels, frames int) []float32 {
+	pcm := make([]float32, frames*channels)
+	for i := range pcm {
+		pcm[i] = float32(0.5 * math.Sin(2*math.Pi*frequency*float64(i/channels)/decodeSampleRate))
+	}
+	return pcm
+}
+
+func TestResampler(t *testing.T) {
+	for _, test := range []struct {
+		name      string
+		rate      int
+		channels  int
+		frequency float64
+		gain      float64
+	}{
+		{"48 kHz passes through", 48000, 2, 1000, 1},
+		{"24 kHz keeps the passband", 24000, 2, 1000, 1},
+		{"16 kHz keeps the passband", 16000, 1, 1000, 1},
+		{"12 kHz keeps the passband", 12000, 2, 1000, 1},
+		{"8 kHz keeps the passband", 8000, 1, 1000, 1},
+		{"16 kHz removes what would alias", 16000, 2, 12000, 0},
+		{"8 kHz removes what would alias", 8000, 1, 7000, 0},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			r := newResampler(decodeSampleRate, test.rate, test.channels)
+
+			// Trimmed packets don't fill whole blocks of the resampler
+			const frames = 48000
+			in := sine(test.frequency, test.channels, frames)
+			var out []float32
+			for i, size := 0, 0; i < len(in); i += size {
+				size = minInt((313+i%7)*test.channels, len(in)-i)
+				out = append(out, r.process(in[i:i+size])...)
+			}
+			out = append(out, r.flush()...)
+
+			if expected := frames * test.rate / decodeSampleRate * test.channels; len(out) != expected {
+				t.Fatalf("expected %d samples, got %d", expected, len(out))
+			}
+
+			// Skip the first and last 20 ms, where the filter runs over
+			// silence
+			var peak float64
+			for _, sample := range out[test.rate/50*test.channels : len(out)-test.rate/50*test.channels] {
+				peak = math.Max(peak, math.Abs(float64(sample)))
+			}
+			if math.Abs(peak/0.5-test.gain) > 0.05 {
+				t.Fatalf("%.0f Hz tone has gain %f, expected %f", test.frequency, peak/0.5, test.gain)
+			}
+		})
+	}
+}
+
+func TestResamplerAlignment(t *testing.T) {
+	// The filter delay is removed, so an impulse stays where it was
+	for _, rate := range []int{8000, 12000, 16000, 24000} {
+		r := newResampler(decodeSampleRate, rate, 2)
+		in := make([]float32, 2*960)
+		in[2*480+1] = 1
+
+		out := append(r.process(in), r.flush()...)
+		peak := 0
+		for i := 1; i < len(out); i += 2 {
+			if out[i] > out[peak] {
+				peak = i
+			}
+		}
+		if expected := 2*480*rate/decodeSampleRate + 1; peak != expected {
+			t.Fatalf("%d Hz: impulse at %d, expected %d", rate, peak, expected)
+		}
+	}
+}
+
+func TestDownmix(t *testing.T) {
+	for _, test := range []struct {
+		name     string
+		pcm      []float32
+		channels int
+		expected []float32
+	}{
+		{"Mono", []float32{0.5, -0.25}, 1, []float32{0.5, -0.25}},
+		{"Stereo", []float32{0.5, 0.25, -1, 1}, 2, []float32{0.375, 0}},
+		{"Surround", []float32{0.5, 0.25, 0, 0, 0.25, 0.5}, 6, []float32{0.25}},
+		{"Empty", nil, 2, []float32{}},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			if out := downmix(test.pcm, test.channels); !reflect.DeepEqual(out, test.expected) {
+				t.Fatalf("expected %v, got %v", test.expected, out)
+			}
+		})
+	}
+}
@@ -0,0 +1,184 @@
+package main
+
+import (
+	"errors"
+	"io"
+	"math"
+	"time"
+
+	"github.com/pion/opus"
+	"github.com/pion/opus/pkg/mp4reader"
+	"github.com/pion/opus/pkg/oggopusreader"
+	"github.com/pion/opus/pkg/oggreader"
+	"github.com/pion/opus/pkg/webmreader"
+)
+
+// Opus packets are at most 120 ms long
+const maxPacketSamples = 120 * decodeSampleRate / 1000
+
+var errBadSampleCount = errors.New("decoder returned more samples than a packet can hold")
+
+type decoderFactory func(header *oggreader.OggHeader) (opus.PCMDecoder, error)
+
+// source returns the PCM to play, at 48 kHz with the container trimming
+// and output gain applied
+type source interface {
+	Channels() int
+	Read() ([]float32, error)
+}
+
+type oggSource struct {
+	reader *oggopusreader.OggOpusReader
+}
+
+func newOggSource(in io.Reader, newDecoder decoderFactory) (source, error) {
+	reader, err := oggopusreader.NewWith(in, oggopusreader.WithDecoder(newDecoder))
+	if err != nil {
+		return nil, err
+	}
+
+	return &oggSource{reader: reader}, nil
+}
+
+func (s *oggSource) Channels() int {
+	return int(s.reader.Header().Channels)
+}
+
+func (s *oggSource) Read() ([]float32, error) {
+	return s.reader.Read()
+}
+
+// packetSource decodes the packets of containers that give the samples to
+// discard per packet, instead of through granule positions
+type packetSource struct {
+	// readPacket returns the next packet and the number of samples to
+	// discard from the start and the end of its decoded audio
+	readPacket func() (packet []byte, discardStart, discardEnd int, err error)
+
+	decoder  opus.PCMDecoder
+	channels int
+	scale    float32
+	buffer   []float32
+}
+
+func newPacketSource(header *oggreader.OggHeader, newDecoder decoderFactory) (*packetSource, error) {
+	decoder, err := newDecoder(header)
+	if err != nil {
+		return nil, err
+	}
+
+	// The output gain is in Q7.8 dB
+	gain := float64(int16(header.OutputGain)) / 256
+	return &packetSource{
+		decoder:  decoder,
+		channels: int(header.Channels),
+		scale:    float32(math.Pow(10, gain/20)),
+		buffer:   make([]float32, maxPacketSamples*int(header.Channels)),
+	}, nil
+}
+
+func (s *packetSource) Channels() int {
+	return s.channels
+}
+
+func (s *packetSource) Read() ([]float32, error) {
+	for {
+		packet, discardStart, discardEnd, err := s.readPacket()
+		if err != nil {
+			return nil, err
+		}
+
+		samples, err := s.decoder.DecodeFloat32(packet, s.buffer)
+		if err != nil {
+			return nil, err
+		} else if samples < 0 || samples > maxPacketSamples {
+			return nil, errBadSampleCount
+		}
+
+		discardStart, discardEnd = clamp(discardStart, samples), clamp(discardEnd, samples)
+		end := samples - discardEnd
+		if discardStart >= end {
+			continue
+		}
+
+		pcm := make([]float32, (end-discardStart)*s.channels)
+		for i, sample := range s.buffer[discardStart*s.channels : end*s.channels] {
+			pcm[i] = sample * s.scale
+		}
+
+		return pcm, nil
+	}
+}
+
+// WebM gives the decoder delay once for the track, and the padding of the
+// last packet of a BlockGroup
+func newWebMSource(in io.Reader, newDecoder decoderFactory) (source, error) {
+	reader, track, err := webmreader.NewWith(in)
+	if err != nil {
+		return nil, err
+	}
+
+	s, err := newPacketSource(track.Header, newDecoder)
+	if err != nil {
+		return nil, err
+	}
+
+	delay := int(track.CodecDelay * decodeSampleRate / time.Second)
+	if track.CodecDelay == 0 {
+		delay = int(track.Header.PreSkip)
+	}
+
+	s.readPacket = func() ([]byte, int, int, error) {
+		packet, header, err := reader.ReadPacket()
+		if err != nil {
+			return nil, 0, 0, err
+		}
+
+		samples, err := opus.PacketSampleCount(packet, decodeSampleRate)
+		if err != nil {
+			return nil, 0, 0, err
+		}
+
+		discardStart := delay
+		if discardStart > samples {
+			discardStart = samples
+		}
+		delay -= discardStart
+
+		return packet, discardStart, int(header.DiscardPadding * decodeSampleRate / time.Second), nil
+	}
+
+	return s, nil
+}
+
+func newMP4Source(in io.ReadSeeker, newDecoder decoderFactory) (source, error) {
+	reader, track, err := mp4reader.NewWith(in)
+	if err != nil {
+		return nil, err
+	}
+
+	s, err := newPacketSource(track.Header, newDecoder)
+	if err != nil {
+		return nil, err
+	}
+
+	s.readPacket = func() ([]byte, int, int, error) {
+		packet, header, err := reader.ReadPacket()
+		if err != nil {
+			return nil, 0, 0, err
+		}
+
+		return packet, header.DiscardStart, header.DiscardEnd, nil
+	}
+
+	return s, nil
+}
+
+func clamp(samples, max int) int {
+	if samples < 0 {
+		return 0
+	} else if samples > max {
+		return max
+	}
+	return samples
+}
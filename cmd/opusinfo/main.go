@@ -0,0 +1,244 @@
+// Command opusinfo reports the headers, tags and packet statistics of Ogg
+// Opus files, in the manner of opusinfo from opus-tools. Nothing is
+// decoded: the statistics come from the TOC byte of every packet and from
+// the pages that carry them.
+//
+//	opusinfo file.opus...
+//
+// Every logical Opus stream is reported, both the chain links of chained
+// files and the streams multiplexed in one file.
+//
+// Problems found in the stream, like pages that fail their CRC check,
+// lost pages, granule positions that go backwards or skip samples and
+// invalid packets, are reported as warnings.
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"time"
+
+	"github.com/pion/opus/pkg/oggreader"
+)
+
+var errNoOpusStream = errors.New("no Opus stream found")
+
+func main() {
+	flag.Usage = func() {
+		fmt.Fprintf(flag.CommandLine.Output(), "usage: %s file.opus...\n", os.Args[0])
+	}
+	flag.Parse()
+
+	if flag.NArg() == 0 {
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	status := 0
+	for _, fileName := range flag.Args() {
+		if err := run(os.Stdout, fileName); err != nil {
+			fmt.Fprintf(os.Stderr, "opusinfo: %s: %v\n", fileName, err)
+			status = 1
+		}
+	}
+	os.Exit(status)
+}
+
+func run(out io.Writer, fileName string) error {
+	file, err := os.Open(fileName) //nolint:gosec
+	if err != nil {
+		return err
+	}
+	defer file.Close() //nolint:errcheck
+
+	fmt.Fprintf(out, "Processing file %q...\n", fileName)
+
+	streams, err := analyze(file)
+	for i, stream := range streams {
+		report(out, i+1, stream)
+	}
+
+	return err
+}
+
+// analyze reads every packet of the Opus streams of in, each of the
+// multiplexed ones in turn. Pages that fail their CRC check are skipped,
+// so reading carries on after them. The statistics gathered up to a read
+// error are returned along with it.
+func analyze(in io.ReadSeeker) ([]*streamStats, error) {
+	serials, err := opusSerials(in)
+	if err != nil {
+		return nil, err
+	}
+
+	var streams []*streamStats
+	for i, serial := range serials {
+		if _, err = in.Seek(0, io.SeekStart); err != nil {
+			return streams, err
+		}
+
+		// The chain links that follow are reported with the first stream
+		linkStreams, err := analyzeSerial(in, serial, i == 0)
+		streams = append(streams, linkStreams...)
+		if err != nil {
+			return streams, err
+		}
+	}
+
+	return streams, nil
+}
+
+// opusSerials returns the serial numbers of the Opus streams multiplexed
+// at the start of in, from their beginning of stream pages
+//
+// https://tools.ietf.org/html/rfc3533.html#section-4
+func opusSerials(in io.Reader) ([]uint32, error) {
+	ogg, _, err := oggreader.NewWith(in, oggreader.WithMidStreamStart())
+	if err != nil {
+		return nil, err
+	}
+
+	var serials []uint32
+	for {
+		payload, pageHeader, err := ogg.ParseNextPage()
+		if errors.Is(err, io.EOF) && len(serials) != 0 {
+			return serials, nil
+		} else if err != nil {
+			return nil, err
+		} else if !pageHeader.BeginningOfStream() {
+			break
+		}
+
+		if _, err = oggreader.ParseIDHeader(payload); err == nil {
+			serials = append(serials, pageHeader.Serial())
+		}
+	}
+
+	if len(serials) == 0 {
+		return nil, errNoOpusStream
+	}
+	return serials, nil
+}
+
+// analyzeSerial reads the packets of the Opus stream with the given serial
+// number and, with followChain, of the chain links after it
+func analyzeSerial(in io.Reader, serial uint32, followChain bool) ([]*streamStats, error) {
+	ogg, header, err := oggreader.NewWith(in, oggreader.WithRecovery(), oggreader.WithSerial(serial))
+	if err != nil {
+		return nil, err
+	}
+
+	packet, packetHeader, err := ogg.ReadPacket()
+	if err != nil {
+		return nil, err
+	}
+
+	tags, err := oggreader.ParseTags(packet)
+	if err != nil {
+		return nil, err
+	}
+
+	stream := newStreamStats(header, tags, packetHeader.PageHeader.Serial())
+	stream.addPage(packetHeader.PageHeader)
+	streams := []*streamStats{stream}
+
+	for {
+		packet, packetHeader, err = ogg.ReadPacket()
+		if errors.Is(err, io.EOF) {
+			return streams, nil
+		} else if err != nil {
+			return streams, err
+		}
+
+		// A new chain link starts with its comment header
+		if packetHeader.NewHeader != nil {
+			if !followChain {
+				return streams, nil
+			}
+			if tags, err = oggreader.ParseTags(packet); err != nil {
+				return streams, err
+			}
+
+			stream = newStreamStats(packetHeader.NewHeader, tags, packetHeader.PageHeader.Serial())
+			stream.addPage(packetHeader.PageHeader)
+			streams = append(streams, stream)
+			continue
+		}
+
+		stream.addPacket(packet, packetHeader)
+	}
+}
+
+func report(out io.Writer, index int, s *streamStats) {
+	fmt.Fprintf(out, "\nNew logical stream (#%d, serial: %08x): type opus\n", index, s.serial)
+	fmt.Fprintf(out, "Encoded with %s\n", s.tags.Vendor)
+	if len(s.tags.UserComments) != 0 {
+		fmt.Fprintln(out, "User comments section follows...")
+		for _, field := range sortedFields(s.tags.UserComments) {
+			for _, value := range s.tags.UserComments[field] {
+				fmt.Fprintf(out, "\t%s=%s\n", field, value)
+			}
+		}
+	}
+
+	h := s.header
+	fmt.Fprintf(out, "Opus stream %d:\n", index)
+	fmt.Fprintf(out, "\tVersion: %d\n", h.Version)
+	fmt.Fprintf(out, "\tChannels: %d\n", h.Channels)
+	fmt.Fprintf(out, "\tPre-skip: %d\n", h.PreSkip)
+	fmt.Fprintf(out, "\tPlayback gain: %g dB\n", float64(int16(h.OutputGain))/256)
+	fmt.Fprintf(out, "\tOriginal sample rate: %d Hz\n", h.SampleRate)
+	fmt.Fprintf(out, "\tChannel mapping family: %d\n", h.ChannelMap)
+	if h.ChannelMap != 0 {
+		fmt.Fprintf(out, "\tStreams: %d, coupled: %d\n", h.StreamCount, h.CoupledCount)
+	}
+
+	fmt.Fprintf(out, "\tPages: %d (%d lost, %d out of sequence, %d failed CRC)\n", s.pages, s.pagesLost, s.pagesSkipped, s.checksumMismatches)
+	fmt.Fprintf(out, "\tPackets: %d (%d invalid)\n", s.packets, s.invalidPackets)
+	if s.samples != 0 {
+		duration := time.Duration(s.samples) * time.Second / granuleSampleRate
+		fmt.Fprintf(out, "\tPacket duration: %v (max), %v (avg), %v (min)\n",
+			s.maxDuration, duration/time.Duration(s.packets-s.invalidPackets), s.minDuration)
+		fmt.Fprintf(out, "\tBitrate: %.1f kbit/s (max), %.1f kbit/s (avg), %.1f kbit/s (min)\n",
+			s.maxBitrate/1000, s.averageBitrate()/1000, s.minBitrate/1000)
+
+		printHistogram(out, "Packet durations", s.durations)
+		printHistogram(out, "Modes", s.modes)
+		printHistogram(out, "Bandwidths", s.bandwidths)
+		printHistogram(out, "Frames per packet", s.frameCounts)
+	}
+
+	fmt.Fprintf(out, "\tTotal data length: %d bytes\n", s.bytes)
+	if s.hasGranule {
+		if s.startGranule != 0 {
+			fmt.Fprintf(out, "\tStarts at granule position: %d\n", s.startGranule)
+		}
+		fmt.Fprintf(out, "\tPlayback length: %v (end trimmed by %d samples)\n",
+			time.Duration(s.playbackSamples())*time.Second/granuleSampleRate, s.endTrim())
+	}
+
+	for _, warning := range s.warnings {
+		fmt.Fprintf(out, "WARNING: %s\n", warning)
+	}
+}
+
+func printHistogram(out io.Writer, name string, h histogram) {
+	fmt.Fprintf(out, "\t%s:", name)
+	for _, key := range h.keys() {
+		fmt.Fprintf(out, " %s: %d", key, h[key])
+	}
+	fmt.Fprintln(out)
+}
+
+func sortedFields(userComments map[string][]string) []string {
+	fields := make([]string, 0, len(userComments))
+	for field := range userComments {
+		fields = append(fields, field)
+	}
+	sort.Strings(fields)
+	return fields
+}
@@ -0,0 +1,210 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/pion/opus"
+	"github.com/pion/opus/pkg/oggreader"
+)
+
+// Granule positions and packet durations are in 48 kHz samples
+const granuleSampleRate = 48000
+
+// histogram counts the packets of each kind
+type histogram map[string]int
+
+func (h histogram) keys() []string {
+	keys := make([]string, 0, len(h))
+	for key := range h {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// streamStats are gathered over the packets and pages of one logical
+// stream, which is a chain link in chained files
+type streamStats struct {
+	serial uint32
+	header *oggreader.OggHeader
+	tags   *oggreader.OggTags
+
+	packets        int
+	invalidPackets int
+	bytes          int
+	samples        uint64
+
+	minBitrate, maxBitrate   float64
+	minDuration, maxDuration time.Duration
+
+	durations   histogram
+	modes       histogram
+	bandwidths  histogram
+	frameCounts histogram
+
+	pages              int
+	lastPageHeader     *oggreader.OggPageHeader
+	pagesLost          int
+	pagesSkipped       int
+	checksumMismatches int
+
+	// The granule position the stream starts at, which RFC 7845 allows to
+	// be above zero, and the samples of the packets completed since the
+	// last granule position
+	startGranule     uint64
+	lastGranule      uint64
+	hasGranule       bool
+	samplesSince     uint64
+	granuleShortfall uint64
+
+	warnings []string
+}
+
+func newStreamStats(header *oggreader.OggHeader, tags *oggreader.OggTags, serial uint32) *streamStats {
+	return &streamStats{
+		serial:      serial,
+		header:      header,
+		tags:        tags,
+		durations:   histogram{},
+		modes:       histogram{},
+		bandwidths:  histogram{},
+		frameCounts: histogram{},
+	}
+}
+
+func (s *streamStats) warn(format string, args ...interface{}) {
+	s.warnings = append(s.warnings, fmt.Sprintf(format, args...))
+}
+
+// addPage counts the page a packet ended on, the first time it's seen.
+// Pages on which no packet ends aren't returned by the reader, but are
+// accounted for by the sequence numbers.
+func (s *streamStats) addPage(page *oggreader.OggPageHeader) {
+	if page == s.lastPageHeader {
+		return
+	}
+
+	if s.lastPageHeader == nil {
+		s.pages += int(page.SequenceNumber()) + 1
+	} else {
+		s.pages += int(page.SequenceNumber() - s.lastPageHeader.SequenceNumber())
+	}
+	s.pages -= int(page.PagesLost)
+	s.lastPageHeader = page
+
+	if page.PagesLost != 0 {
+		s.pagesLost += int(page.PagesLost)
+		s.warn("%d page(s) lost before page %d", page.PagesLost, page.SequenceNumber())
+	}
+	if page.PagesSkipped != 0 {
+		s.pagesSkipped += int(page.PagesSkipped)
+		s.warn("%d duplicate or out of order page(s) skipped before page %d", page.PagesSkipped, page.SequenceNumber())
+	}
+	if page.ChecksumMismatch {
+		s.checksumMismatches++
+		s.warn("a page before page %d failed its CRC check and was skipped", page.SequenceNumber())
+	}
+}
+
+// addPacket gathers the TOC statistics of an audio packet, and checks the
+// granule position of the page it ends
+func (s *streamStats) addPacket(packet []byte, packetHeader *oggreader.OggPacketHeader) {
+	s.addPage(packetHeader.PageHeader)
+	s.packets++
+	s.bytes += len(packet)
+
+	info, err := opus.ParsePacketInfo(packet)
+	if err != nil {
+		s.invalidPackets++
+		s.warn("invalid packet %d: %v", s.packets, err)
+	} else {
+		s.addPacketInfo(info, len(packet))
+	}
+
+	if packetHeader.HasGranulePosition {
+		s.checkGranule(packetHeader.GranulePosition, packetHeader.PageHeader.SequenceNumber())
+	}
+}
+
+func (s *streamStats) addPacketInfo(info opus.PacketInfo, size int) {
+	duration := time.Duration(info.FrameCount) * info.FrameDuration
+	samples := uint64(duration * granuleSampleRate / time.Second)
+	s.samples += samples
+	s.samplesSince += samples
+
+	first := s.minDuration == 0
+	bitrate := float64(8*size) / duration.Seconds()
+	if first || bitrate < s.minBitrate {
+		s.minBitrate = bitrate
+	}
+	if bitrate > s.maxBitrate {
+		s.maxBitrate = bitrate
+	}
+	if first || duration < s.minDuration {
+		s.minDuration = duration
+	}
+	if duration > s.maxDuration {
+		s.maxDuration = duration
+	}
+
+	s.durations[duration.String()]++
+	s.modes[info.Mode.String()]++
+	s.bandwidths[info.Bandwidth.String()]++
+	s.frameCounts[fmt.Sprint(info.FrameCount)]++
+}
+
+// The granule position of a page is the number of samples up to the end
+// of its last completed packet. Only the last page may end before its
+// packets, to trim the end of the stream.
+//
+// https://tools.ietf.org/html/rfc7845.html#section-4
+func (s *streamStats) checkGranule(granule uint64, sequenceNumber uint32) {
+	if s.granuleShortfall != 0 {
+		s.warn("granule position ends %d samples before its packets on a page that isn't the last", s.granuleShortfall)
+		s.granuleShortfall = 0
+	}
+
+	expected := s.lastGranule + s.samplesSince
+	switch {
+	case s.hasGranule && granule < s.lastGranule:
+		s.warn("granule position %d of page %d is below the previous one, %d", granule, sequenceNumber, s.lastGranule)
+	case granule < expected:
+		s.granuleShortfall = expected - granule
+	case granule > expected && s.hasGranule:
+		s.warn("granule position %d of page %d skips %d samples", granule, sequenceNumber, granule-expected)
+	case granule > expected:
+		s.startGranule = granule - expected
+	}
+
+	s.lastGranule = granule
+	s.hasGranule = true
+	s.samplesSince = 0
+}
+
+// averageBitrate returns the bitrate over the valid packets, in bit/s
+func (s *streamStats) averageBitrate() float64 {
+	if s.samples == 0 {
+		return 0
+	}
+	return float64(8*s.bytes) * granuleSampleRate / float64(s.samples)
+}
+
+// playbackSamples returns the number of samples played, from the start
+// of the stream to its last granule position less the pre-skip
+//
+// https://tools.ietf.org/html/rfc7845.html#section-4.5
+func (s *streamStats) playbackSamples() uint64 {
+	played := s.lastGranule - s.startGranule
+	if played < uint64(s.header.PreSkip) {
+		return 0
+	}
+	return played - uint64(s.header.PreSkip)
+}
+
+// endTrim returns the number of samples the last page trims from the end
+// of the stream
+func (s *streamStats) endTrim() uint64 {
+	return s.granuleShortfall
+}
@@ -0,0 +1,130 @@
+package main
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/pion/opus"
+	"github.com/pion/opus/pkg/oggreader"
+	"github.com/pion/opus/pkg/oggwriter"
+)
+
+func TestStreamStats_Granule(t *testing.T) {
+	for _, test := range []struct {
+		name     string
+		granules []uint64
+		start    uint64
+		played   uint64
+		endTrim  uint64
+		warnings int
+	}{
+		{"Starts at zero", []uint64{960, 1920, 2880}, 0, 2880 - 312, 0, 0},
+		{"Starts later", []uint64{48960, 49920, 50880}, 48000, 2880 - 312, 0, 0},
+		{"End trimmed", []uint64{960, 1920, 2500}, 0, 2500 - 312, 380, 0},
+		{"Starts later and end trimmed", []uint64{48960, 49920, 50500}, 48000, 2500 - 312, 380, 0},
+		{"Skips samples", []uint64{960, 1920, 3840}, 0, 3840 - 312, 0, 1},
+		{"Goes backwards", []uint64{960, 1920, 900}, 0, 900 - 312, 0, 1},
+		{"Trims before the last page", []uint64{960, 1800, 2760}, 0, 2760 - 312, 0, 1},
+		{"Shorter than the pre-skip", []uint64{200}, 0, 0, 760, 0},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			s := newStreamStats(&oggreader.OggHeader{PreSkip: 312}, &oggreader.OggTags{}, 0)
+			for i, granule := range test.granules {
+				s.addPacketInfo(opus.PacketInfo{FrameCount: 1, FrameDuration: 20e6}, 100)
+				s.checkGranule(granule, uint32(i+2))
+			}
+
+			switch {
+			case s.startGranule != test.start:
+				t.Fatalf("expected start %d, got %d", test.start, s.startGranule)
+			case s.playbackSamples() != test.played:
+				t.Fatalf("expected %d samples played, got %d", test.played, s.playbackSamples())
+			case s.endTrim() != test.endTrim:
+				t.Fatalf("expected end trim %d, got %d", test.endTrim, s.endTrim())
+			case len(s.warnings) != test.warnings:
+				t.Fatalf("expected %d warnings, got %v", test.warnings, s.warnings)
+			}
+		})
+	}
+}
+
+func TestStreamStats_Bitrate(t *testing.T) {
+	s := newStreamStats(&oggreader.OggHeader{}, &oggreader.OggTags{}, 0)
+
+	// 20 ms at 40 kbit/s, 10 ms at 80 kbit/s and 40 ms at 20 kbit/s
+	s.addPacketInfo(opus.PacketInfo{FrameCount: 1, FrameDuration: 20e6}, 100)
+	s.addPacketInfo(opus.PacketInfo{FrameCount: 1, FrameDuration: 10e6}, 100)
+	s.addPacketInfo(opus.PacketInfo{FrameCount: 2, FrameDuration: 20e6}, 100)
+	s.bytes = 300
+
+	switch {
+	case s.minBitrate != 20000 || s.maxBitrate != 80000:
+		t.Fatalf("expected 20 to 80 kbit/s, got %f to %f", s.minBitrate, s.maxBitrate)
+	case s.averageBitrate() != 8*300/0.07:
+		t.Fatalf("expected %f bit/s on average, got %f", 8*300/0.07, s.averageBitrate())
+	case s.minDuration != 10e6 || s.maxDuration != 40e6:
+		t.Fatalf("expected 10 to 40 ms packets, got %v to %v", s.minDuration, s.maxDuration)
+	case s.samples != 3360:
+		t.Fatalf("expected 3360 samples, got %d", s.samples)
+	}
+}
+
+// pageRecorder keeps every page the Ogg writer writes
+type pageRecorder struct {
+	pages [][]byte
+}
+
+func (r *pageRecorder) Write(page []byte) (int, error) {
+	r.pages = append(r.pages, append([]byte{}, page...))
+	return len(page), nil
+}
+
+func TestAnalyze_Multiplexed(t *testing.T) {
+	// Two streams with different packet counts, their pages interleaved
+	// after both beginning of stream pages
+	var recorders [2]pageRecorder
+	for i := range recorders {
+		writer, err := oggwriter.NewWith(&recorders[i], &oggreader.OggHeader{Version: 1, Channels: uint8(i + 1), PreSkip: 312, SampleRate: 48000},
+			nil, oggwriter.WithSerial(uint32(i+1)), oggwriter.WithMaxPageSize(1))
+		if err != nil {
+			t.Fatal(err)
+		}
+		for packet := 0; packet < 10*(i+1); packet++ {
+			if err = writer.WritePacket([]byte{0x08, byte(packet)}); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err = writer.Close(); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var ogg []byte
+	for page := 0; page < len(recorders[1].pages); page++ {
+		for i := range recorders {
+			if page < len(recorders[i].pages) {
+				ogg = append(ogg, recorders[i].pages[page]...)
+			}
+		}
+	}
+
+	streams, err := analyze(bytes.NewReader(ogg))
+	if err != nil {
+		t.Fatal(err)
+	} else if len(streams) != 2 {
+		t.Fatalf("expected 2 streams, got %d", len(streams))
+	}
+
+	for i, s := range streams {
+		switch {
+		case s.serial != uint32(i+1) || int(s.header.Channels) != i+1:
+			t.Fatalf("stream %d: serial %d with %d channels", i, s.serial, s.header.Channels)
+		case s.packets != 10*(i+1) || s.pagesLost != 0:
+			t.Fatalf("stream %d: %d packets, %d pages lost", i, s.packets, s.pagesLost)
+		case s.playbackSamples() != uint64(9600*(i+1)-312):
+			t.Fatalf("stream %d: %d samples played", i, s.playbackSamples())
+		case len(s.warnings) != 0:
+			t.Fatalf("stream %d: %v", i, s.warnings)
+		}
+	}
+}
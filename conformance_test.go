@@ -0,0 +1,185 @@
+package opus
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/pion/opus/pkg/opuscompare"
+	"github.com/pion/opus/pkg/testvector"
+)
+
+// The test vectors of RFC 6716 and RFC 8251 aren't distributed with the
+// repository, and are the reference decoder output the CELT and hybrid
+// layers are checked against, along with the libopus SILK frames of
+// internal/silk/testdata. TestConformance runs them when
+// OPUS_TESTVECTORS is set to the directory they were extracted to, like
+//
+//	OPUS_TESTVECTORS=opus_newvectors go test -run TestConformance -v
+//
+// https://opus-codec.org/testvectors/
+const testVectorsEnv = "OPUS_TESTVECTORS"
+
+// conformanceResult is how far the decoder is from decoding one test
+// vector like the reference decoder
+type conformanceResult struct {
+	packets     int
+	lost        int
+	rejected    int
+	rangeChecks int
+	rangeMisses int
+	quality     float64
+}
+
+func TestConformance(t *testing.T) {
+	dir := os.Getenv(testVectorsEnv)
+	if dir == "" {
+		t.Skipf("%s is not set", testVectorsEnv)
+	}
+
+	bitFiles, err := filepath.Glob(filepath.Join(dir, "testvector*.bit"))
+	if err != nil {
+		t.Fatal(err)
+	} else if len(bitFiles) == 0 {
+		t.Skipf("no testvector*.bit files in %s", dir)
+	}
+
+	for _, bitFile := range bitFiles {
+		bitFile := bitFile
+		t.Run(strings.TrimSuffix(filepath.Base(bitFile), ".bit"), func(t *testing.T) {
+			result, err := runTestVector(bitFile)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			t.Logf("%d packets (%d lost), %d rejected by the decoder, %d/%d final ranges match, quality %.1f%%",
+				result.packets, result.lost, result.rejected,
+				result.rangeChecks-result.rangeMisses, result.rangeChecks, result.quality)
+			if result.rejected != 0 || result.rangeMisses != 0 || result.quality < 0 {
+				t.Error("decoder output does not match the reference decoder")
+			}
+		})
+	}
+}
+
+// runTestVector decodes the packets of a testvector*.bit file like
+// opus_demo, checking the final range of each, and compares the output
+// with the reference decoder's. Lost packets are concealed for the
+// duration of the last packet, and packets the decoder rejects are
+// concealed for their own duration to keep the output aligned.
+func runTestVector(bitFile string) (*conformanceResult, error) {
+	file, err := os.Open(bitFile) //nolint:gosec
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close() //nolint:errcheck
+
+	reader, err := testvector.NewWith(file)
+	if err != nil {
+		return nil, err
+	}
+
+	// RFC 8251 allows matching either the stereo or the mono output of the
+	// reference decoder, so both are decoded
+	mono, err := NewDecoderWithChannels(1)
+	if err != nil {
+		return nil, err
+	}
+	decoders := []*Decoder{NewDecoder(), mono}
+	decoded := make([][]int16, len(decoders))
+
+	result := &conformanceResult{}
+	for {
+		packet, header, err := reader.ReadPacket()
+		if errors.Is(err, io.EOF) {
+			break
+		} else if err != nil {
+			return nil, err
+		}
+
+		result.packets++
+		if len(packet) == 0 {
+			result.lost++
+		}
+
+		for i, decoder := range decoders {
+			out := make([]float32, maxPacketSamples*decoder.Channels())
+			samples := 0
+			if len(packet) == 0 {
+				samples, err = decoder.Conceal(out, decoder.SamplesDecoded())
+			} else if samples, err = decoder.DecodeFloat32(packet, out); err != nil {
+				if i == 0 {
+					result.rejected++
+				}
+				if samples, err = PacketSampleCount(packet, 48000); err != nil {
+					return nil, err
+				}
+				samples, err = decoder.Conceal(out, samples)
+			}
+			// Losses before the first packet have no duration to conceal
+			if err != nil && decoder.SamplesDecoded() != 0 {
+				return nil, err
+			}
+			decoded[i] = append(decoded[i], toInt16(out[:samples*decoder.Channels()])...)
+		}
+
+		if len(packet) != 0 && header.FinalRange != 0 {
+			result.rangeChecks++
+			if decoders[0].FinalRange() != header.FinalRange {
+				result.rangeMisses++
+			}
+		}
+	}
+
+	compared := false
+	base := strings.TrimSuffix(bitFile, ".bit")
+	for i, fileName := range []string{base + ".dec", base + "m.dec"} {
+		quality, err := compareWithReference(fileName, decoded[i], decoders[i].Channels())
+		if errors.Is(err, os.ErrNotExist) {
+			continue
+		} else if err != nil {
+			return nil, err
+		}
+
+		if !compared || quality > result.quality {
+			result.quality = quality
+		}
+		compared = true
+	}
+
+	if !compared {
+		return nil, fmt.Errorf("%w: no .dec file for %s", os.ErrNotExist, bitFile)
+	}
+
+	return result, nil
+}
+
+// toInt16 converts samples to 16 bits like FLOAT2INT16 of libopus
+func toInt16(samples []float32) []int16 {
+	out := make([]int16, len(samples))
+	for i, sample := range samples {
+		out[i] = int16(math.Max(-32768, math.Min(32767, math.RoundToEven(float64(sample)*32768))))
+	}
+	return out
+}
+
+func compareWithReference(fileName string, decoded []int16, channels int) (float64, error) {
+	file, err := os.Open(fileName) //nolint:gosec
+	if err != nil {
+		return 0, err
+	}
+	defer file.Close() //nolint:errcheck
+
+	reference, err := testvector.ReadPCM(file)
+	if err != nil {
+		return 0, err
+	}
+
+	result, err := opuscompare.CompareInt16(reference, decoded, channels, 48000)
+	return result.Quality, err
+}
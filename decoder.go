@@ -1,50 +1,635 @@
 package opus
 
 import (
+	"encoding/binary"
+	"errors"
 	"fmt"
+	"math"
+	"time"
 
+	"github.com/pion/opus/internal/celt"
+	"github.com/pion/opus/internal/rangecoding"
 	"github.com/pion/opus/internal/silk"
 )
 
-// Decoder decodes the Opus bitstream into PCM
+const (
+	decodeSampleRate = 48000
+
+	// Frame sizes in samples at 48 kHz
+	samples2500us = 120
+	samples5ms    = 240
+	samples10ms   = 480
+	samples20ms   = 960
+
+	// The CELT layer of a hybrid frame starts at band 17, 8 kHz, above
+	// the wideband SILK layer
+	hybridStartBand = 17
+)
+
+// Decoder decodes the Opus bitstream into PCM at 48 kHz with one or two
+// channels, like opus_decoder. Mono streams are duplicated to stereo
+// output and stereo streams are downmixed to mono output. The zero value
+// decodes to stereo, like NewDecoder.
 type Decoder struct {
-	silkDecoder silk.Decoder
+	channels int
+
+	silkDecoder    silk.Decoder
+	silkResamplers [2]*upsampler
+	silkSampleRate int
+	celtDecoder    *celt.Decoder
+	rangeDecoder   rangecoding.Decoder
+
+	// The mode of the last frame decoded or concealed, and whether it
+	// ended with a redundant CELT frame, like prev_mode and
+	// prev_redundancy of libopus
+	previousMode       Mode
+	previousRedundancy bool
+
+	// What the last packet decoded was, like the decoder CTLs of libopus
+	mode           Mode
+	bandwidth      Bandwidth
+	isStereo       bool
+	frameDuration  time.Duration
+	samplesDecoded int
+	concealed      bool
+
+	// State of the range decoder after the last frame decoded
+	finalRange uint32
 }
 
-// NewDecoder creates a new Opus Decoder
+// NewDecoder creates a new Opus Decoder with stereo output
 func NewDecoder() *Decoder {
 	return &Decoder{}
 }
 
-// Decode decodes the Opus bitstream into PCM
+// NewDecoderWithChannels creates a new Opus Decoder with one or two
+// output channels, like opus_decoder_create at 48 kHz
+func NewDecoderWithChannels(channels int) (*Decoder, error) {
+	if channels != 1 && channels != 2 {
+		return nil, errInvalidDecoderChannelCount
+	}
+
+	d := &Decoder{channels: channels}
+	if err := d.init(); err != nil {
+		return nil, err
+	}
+	return d, nil
+}
+
+// NewStreamDecoder creates a Decoder for the newDecoder argument of
+// NewMultistreamDecoder and NewProjectionDecoder, which decodes stereo
+// when channels is 2 and mono otherwise.
+func NewStreamDecoder(channels int) PCMDecoder {
+	if channels != 2 {
+		return &Decoder{channels: 1}
+	}
+	return &Decoder{channels: 2}
+}
+
+func (d *Decoder) init() error {
+	if d.celtDecoder != nil {
+		return nil
+	}
+	if d.channels == 0 {
+		d.channels = 2
+	}
+
+	celtDecoder, err := celt.NewDecoder(d.channels)
+	if err != nil {
+		return err
+	}
+	d.celtDecoder = celtDecoder
+	return nil
+}
+
+// Reset discards all state carried between packets, as if the Decoder was
+// just created, like OPUS_RESET_STATE
+func (d *Decoder) Reset() {
+	*d = Decoder{channels: d.channels}
+}
+
+// Channels returns the number of channels of the decoded samples
+func (d *Decoder) Channels() int {
+	if d.channels == 0 {
+		return 2
+	}
+	return d.channels
+}
+
+// Decode decodes an Opus packet. frames holds the samples of each of its
+// frames at 48 kHz as little-endian float32, interleaved when the Decoder
+// has two channels. Use DecodeFrames to get the samples as float32.
 func (d *Decoder) Decode(in []byte) (bandwidth Bandwidth, isStereo bool, frames [][]byte, err error) {
-	if len(in) < 1 {
-		return 0, false, nil, errTooShortForTableOfContentsHeader
+	bandwidth, isStereo, decoded, err := d.DecodeFrames(in)
+	if err != nil {
+		return 0, false, nil, err
+	}
+
+	for _, frame := range decoded {
+		encoded := make([]byte, 4*len(frame))
+		for i, sample := range frame {
+			binary.LittleEndian.PutUint32(encoded[4*i:], math.Float32bits(sample))
+		}
+		frames = append(frames, encoded)
+	}
+	return bandwidth, isStereo, frames, nil
+}
+
+// DecodeFrames decodes an Opus packet. frames holds the samples of each of
+// its frames at 48 kHz, interleaved when the Decoder has two channels.
+// Frames of zero length, such as those of DTX packets, are concealed.
+func (d *Decoder) DecodeFrames(in []byte) (bandwidth Bandwidth, isStereo bool, frames [][]float32, err error) {
+	samples, err := PacketSampleCount(in, decodeSampleRate)
+	if err != nil {
+		return 0, false, nil, err
+	}
+
+	out := make([]float32, samples*d.Channels())
+	if _, err = d.DecodeFloat32(in, out); err != nil {
+		return 0, false, nil, err
+	}
+
+	frameSize := int(d.frameDuration/(time.Second/decodeSampleRate)) * d.Channels()
+	for len(out) > 0 {
+		frames = append(frames, out[:frameSize])
+		out = out[frameSize:]
+	}
+	return d.bandwidth, d.isStereo, frames, nil
+}
+
+// DecodeFloat32 decodes an Opus packet into out, interleaved when the
+// Decoder has two channels, like opus_decode_float. It returns the number
+// of samples per channel decoded, at 48 kHz.
+func (d *Decoder) DecodeFloat32(in []byte, out []float32) (int, error) {
+	encodedFrames, err := packetFrames(in)
+	if err != nil {
+		return 0, err
+	}
+	if err = d.init(); err != nil {
+		return 0, err
 	}
 
 	tocHeader := tableOfContentsHeader(in[0])
 	cfg := tocHeader.configuration()
+	frameSize := cfg.frameDuration().nanoseconds() / (int(time.Second) / decodeSampleRate)
+	if len(out) < len(encodedFrames)*frameSize*d.channels {
+		return 0, errOutputBufferTooShort
+	}
 
-	var encodedFrames [][]byte
-	switch tocHeader.frameCode() {
-	case frameCodeOneFrame:
-		encodedFrames = append(encodedFrames, in[1:])
-	default:
-		return 0, false, nil, fmt.Errorf("%w: %d", errUnsupportedFrameCode, tocHeader.frameCode())
+	concealed := false
+	for i, encodedFrame := range encodedFrames {
+		concealed = concealed || len(encodedFrame) <= 1
+		frameOut := out[i*frameSize*d.channels : (i+1)*frameSize*d.channels]
+		if err := d.decodePacketFrame(encodedFrame, frameOut, frameSize, cfg.mode(), cfg.bandwidth(), tocHeader.isStereo()); err != nil {
+			return 0, err
+		}
 	}
 
-	if cfg.mode() != configurationModeSilkOnly {
-		return 0, false, nil, fmt.Errorf("%w: %d", errUnsupportedConfigurationMode, cfg.mode())
+	d.mode = cfg.mode()
+	d.bandwidth = cfg.bandwidth()
+	d.isStereo = tocHeader.isStereo()
+	d.frameDuration = time.Duration(cfg.frameDuration().nanoseconds())
+	d.samplesDecoded = len(encodedFrames) * frameSize
+	d.concealed = concealed
+
+	return d.samplesDecoded, nil
+}
+
+// DecodeFEC recovers the samples lost before a packet from the low
+// bitrate redundancy (LBRR) it carries, like opus_decode_float with
+// decode_fec set. The LBRR frame covers the end of the samples lost, and
+// the rest is concealed. Packets without LBRR, such as CELT-only ones,
+// are concealed. samples must be a multiple of 2.5 ms.
+//
+// https://datatracker.ietf.org/doc/html/rfc6716#section-4.2.5
+func (d *Decoder) DecodeFEC(in []byte, out []float32, samples int) (int, error) {
+	encodedFrames, err := packetFrames(in)
+	if err != nil {
+		return 0, err
+	}
+
+	tocHeader := tableOfContentsHeader(in[0])
+	cfg := tocHeader.configuration()
+	frameSize := cfg.frameDuration().nanoseconds() / (int(time.Second) / decodeSampleRate)
+	if samples < frameSize || cfg.mode() == ModeCELTOnly || d.mode == ModeCELTOnly {
+		return d.Conceal(out, samples)
+	}
+	if err = d.validateConcealment(out, samples); err != nil {
+		return 0, err
+	}
+
+	if samples > frameSize {
+		if _, err = d.Conceal(out, samples-frameSize); err != nil {
+			return 0, err
+		}
 	}
 
-	for _, encodedFrame := range encodedFrames {
-		decoded, err := d.silkDecoder.Decode(encodedFrame, tocHeader.isStereo(), cfg.frameDuration().nanoseconds(), silk.Bandwidth(cfg.bandwidth()))
+	hasLBRR, err := PacketHasLBRR(in)
+	if err != nil {
+		return 0, err
+	}
+
+	d.mode = cfg.mode()
+	d.bandwidth = cfg.bandwidth()
+	d.isStereo = tocHeader.isStereo()
+	d.frameDuration = time.Duration(cfg.frameDuration().nanoseconds())
+	frameOut := out[(samples-frameSize)*d.channels : samples*d.channels]
+	if _, err = d.decodeFrame(encodedFrames[0], frameOut, frameSize, d.mode, d.bandwidth, d.isStereo, true); err != nil {
+		return 0, err
+	}
+
+	d.samplesDecoded = samples
+	d.concealed = samples > frameSize || !hasLBRR
+	return samples, nil
+}
+
+// Conceal stands in for samples lost, like opus_decode_float without a
+// packet. The last frames decoded are extrapolated by the packet loss
+// concealment of their mode. samples must be a multiple of 2.5 ms.
+//
+// https://datatracker.ietf.org/doc/html/rfc6716#section-4.4
+func (d *Decoder) Conceal(out []float32, samples int) (int, error) {
+	if err := d.validateConcealment(out, samples); err != nil {
+		return 0, err
+	}
+
+	frameSize := int(d.frameDuration / (time.Second / decodeSampleRate))
+	if frameSize == 0 {
+		frameSize = samples2500us
+	}
+
+	for concealed := 0; concealed < samples; {
+		n, err := d.decodeFrame(nil, out[concealed*d.channels:samples*d.channels], minInt(samples-concealed, frameSize), d.previousMode, d.bandwidth, d.isStereo, false)
 		if err != nil {
-			return 0, false, nil, err
+			return 0, err
 		}
+		concealed += n
+	}
 
-		frames = append(frames, decoded)
+	d.samplesDecoded = samples
+	d.concealed = true
+	d.finalRange = 0
+	return samples, nil
+}
+
+func (d *Decoder) validateConcealment(out []float32, samples int) error {
+	if err := d.init(); err != nil {
+		return err
+	}
+
+	switch {
+	case samples <= 0 || samples%samples2500us != 0:
+		return errInvalidConcealmentDuration
+	case len(out) < samples*d.channels:
+		return errOutputBufferTooShort
 	}
+	return nil
+}
+
+// decodePacketFrame decodes one frame of a packet into out. Lost frames
+// longer than 20 ms are concealed 20 ms at a time.
+func (d *Decoder) decodePacketFrame(data []byte, out []float32, frameSize int, mode Mode, bandwidth Bandwidth, isStereo bool) error {
+	for decoded := 0; decoded < frameSize; {
+		n, err := d.decodeFrame(data, out[decoded*d.channels:], frameSize-decoded, mode, bandwidth, isStereo, false)
+		if err != nil {
+			return err
+		}
+		decoded += n
+	}
+	return nil
+}
+
+// decodeFrame decodes, or conceals when data holds less than two bytes,
+// a frame of up to frameSize samples into out, like opus_decode_frame()
+// (opus_decoder.c). It returns the number of samples per channel written.
+//
+// Frames switching to or from CELT-only mode cross-fade with the
+// concealment of the previous mode, or with a redundant 5 ms CELT frame
+// at the end of the SILK or hybrid frame.
+//
+// https://datatracker.ietf.org/doc/html/rfc6716#section-4.5
+func (d *Decoder) decodeFrame(data []byte, out []float32, frameSize int, mode Mode, bandwidth Bandwidth, isStereo, fec bool) (int, error) {
+	channels := d.channels
+	lost := len(data) <= 1
+	if lost {
+		mode = d.previousMode
+		if mode == 0 {
+			for i := range out[:frameSize*channels] {
+				out[i] = 0
+			}
+			return frameSize, nil
+		}
+
+		// Concealment runs on frames of 2.5, 5, 10 or 20 ms
+		switch {
+		case frameSize > samples20ms:
+			return d.decodeFrame(nil, out, samples20ms, mode, bandwidth, isStereo, false)
+		case frameSize > samples10ms && frameSize < samples20ms:
+			frameSize = samples10ms
+		case mode != ModeSilkOnly && frameSize > samples5ms && frameSize < samples10ms:
+			frameSize = samples5ms
+		}
+	}
+	out = out[:frameSize*channels]
+
+	// A switch to CELT-only mode fades in from the concealment of the
+	// previous mode, unless it ended with a redundant CELT frame
+	transition := !lost && d.previousMode != 0 &&
+		((mode == ModeCELTOnly && d.previousMode != ModeCELTOnly && !d.previousRedundancy) ||
+			(mode != ModeCELTOnly && d.previousMode == ModeCELTOnly))
+	var transitionAudio []float32
+	if transition && mode == ModeCELTOnly {
+		var err error
+		if transitionAudio, err = d.concealTransition(frameSize, bandwidth, isStereo); err != nil {
+			return 0, err
+		}
+	}
+
+	rangeDecoder := &d.rangeDecoder
+	length := len(data)
+	if !lost {
+		rangeDecoder.Init(data)
+	}
+
+	var silkAudio []float32
+	if mode != ModeCELTOnly {
+		if d.previousMode == ModeCELTOnly {
+			d.silkDecoder.Reset()
+		}
+
+		var err error
+		if silkAudio, err = d.decodeSILK(rangeDecoder, frameSize, mode, bandwidth, isStereo, lost, fec); err != nil {
+			return 0, err
+		}
+	}
+
+	// The redundant CELT frame of a transition follows the SILK layer,
+	// at the end of the frame
+	//
+	// https://datatracker.ietf.org/doc/html/rfc6716#section-4.5.1
+	redundancy, celtToSilk, redundancyBytes := false, false, 0
+	hybridBits := 0
+	if mode == ModeHybrid {
+		hybridBits = 20
+	}
+	if !lost && !fec && mode != ModeCELTOnly && int(rangeDecoder.Tell())+17+hybridBits <= 8*length {
+		redundancy = mode != ModeHybrid || rangeDecoder.DecodeSymbolLogP(12) == 1
+		if redundancy {
+			celtToSilk = rangeDecoder.DecodeSymbolLogP(1) == 1
+			if mode == ModeHybrid {
+				redundancyBytes = int(rangeDecoder.DecodeUniform(256)) + 2
+			} else {
+				redundancyBytes = length - (int(rangeDecoder.Tell())+7)>>3
+			}
+
+			length -= redundancyBytes
+			if length*8 < int(rangeDecoder.Tell()) {
+				length, redundancyBytes, redundancy = 0, 0, false
+			}
+			rangeDecoder.Shrink(len(data) - redundancyBytes)
+		}
+	}
+
+	startBand, endBand := 0, celtEndBand(bandwidth)
+	if mode != ModeCELTOnly {
+		startBand = hybridStartBand
+	}
+
+	if redundancy {
+		transition = false
+	}
+	if transition && mode != ModeCELTOnly {
+		var err error
+		if transitionAudio, err = d.concealTransition(frameSize, bandwidth, isStereo); err != nil {
+			return 0, err
+		}
+	}
+
+	var redundantAudio []float32
+	var redundantRange uint32
+	if redundancy {
+		redundantAudio = make([]float32, samples5ms*channels)
+	}
+	if redundancy && celtToSilk {
+		if err := d.celtDecoder.Decode(data[length:length+redundancyBytes], redundantAudio, isStereo, samples5ms, endBand); err != nil {
+			return 0, corrupted(err)
+		}
+		redundantRange = d.celtDecoder.FinalRange()
+	}
+
+	if mode != ModeSilkOnly {
+		// Any previous CELT state is discarded on a mode switch
+		if mode != d.previousMode && d.previousMode != 0 && !d.previousRedundancy {
+			d.celtDecoder.Reset()
+		}
+
+		celtFrameSize := minInt(samples20ms, frameSize)
+		var err error
+		if lost || fec || length <= 1 {
+			err = d.celtDecoder.Conceal(out, celtFrameSize, startBand, endBand)
+		} else {
+			err = d.celtDecoder.DecodeWithRange(rangeDecoder, length, out, isStereo, celtFrameSize, startBand, endBand)
+		}
+		if err != nil {
+			return 0, corrupted(err)
+		}
+	} else {
+		for i := range out {
+			out[i] = 0
+		}
+
+		// On a switch from hybrid mode, the CELT layer fades out by
+		// decoding a silent frame
+		if d.previousMode == ModeHybrid && !(redundancy && celtToSilk && d.previousRedundancy) {
+			if err := d.celtDecoder.Decode([]byte{0xff, 0xff}, out, isStereo, samples2500us, endBand); err != nil {
+				return 0, err
+			}
+		}
+	}
+
+	for i := range silkAudio {
+		out[i] += silkAudio[i]
+	}
+
+	fade := samples2500us * channels
+	if redundancy && !celtToSilk {
+		d.celtDecoder.Reset()
+		if err := d.celtDecoder.Decode(data[length:length+redundancyBytes], redundantAudio, isStereo, samples5ms, endBand); err != nil {
+			return 0, corrupted(err)
+		}
+		redundantRange = d.celtDecoder.FinalRange()
+		celt.CrossFade(out[len(out)-fade:], redundantAudio[fade:], out[len(out)-fade:], channels)
+	}
+	if redundancy && celtToSilk {
+		copy(out, redundantAudio[:fade])
+		celt.CrossFade(redundantAudio[fade:], out[fade:], out[fade:], channels)
+	}
+	if transition {
+		if frameSize >= samples5ms {
+			copy(out, transitionAudio[:fade])
+			celt.CrossFade(transitionAudio[fade:], out[fade:], out[fade:], channels)
+		} else {
+			celt.CrossFade(transitionAudio, out, out, channels)
+		}
+	}
+
+	d.finalRange = 0
+	if !lost {
+		d.finalRange = rangeDecoder.FinalRange() ^ redundantRange
+	}
+	d.previousMode = mode
+	d.previousRedundancy = redundancy && !celtToSilk
+	return frameSize, nil
+}
+
+// concealTransition conceals up to 5 ms in the previous mode, to fade
+// from into a frame of another mode
+func (d *Decoder) concealTransition(frameSize int, bandwidth Bandwidth, isStereo bool) ([]float32, error) {
+	transitionAudio := make([]float32, samples5ms*d.channels)
+	_, err := d.decodeFrame(nil, transitionAudio, minInt(samples5ms, frameSize), d.previousMode, bandwidth, isStereo, false)
+	return transitionAudio, err
+}
+
+// decodeSILK decodes, recovers from LBRR or conceals the SILK layer of a
+// frame, and returns frameSize samples of it at 48 kHz with the channels
+// of the Decoder
+func (d *Decoder) decodeSILK(rangeDecoder *rangecoding.Decoder, frameSize int, mode Mode, bandwidth Bandwidth, isStereo, lost, fec bool) ([]float32, error) {
+	// The SILK concealment can't produce frames shorter than 10 ms
+	nanoseconds := frameSize * int(time.Second) / decodeSampleRate
+	if nanoseconds < int(10*time.Millisecond) {
+		nanoseconds = int(10 * time.Millisecond)
+	}
+
+	// Hybrid frames have a wideband SILK layer
+	silkBandwidth := bandwidth
+	if mode == ModeHybrid {
+		silkBandwidth = BandwidthWideband
+	}
+
+	sampleRate := silkBandwidth.SampleRate()
+	if lost {
+		sampleRate = d.silkSampleRate
+		isStereo = d.silkDecoder.WasStereo()
+	}
+	if sampleRate == 0 {
+		sampleRate = BandwidthNarrowband.SampleRate()
+	}
+
+	silkChannels := 1
+	if isStereo && d.channels == 2 {
+		silkChannels = 2
+	}
+	samples := sampleRate / 1000 * nanoseconds / int(time.Millisecond)
+	decoded := make([]float32, samples*silkChannels)
+
+	var err error
+	switch {
+	case lost:
+		err = d.silkDecoder.Conceal(decoded, d.channels, nanoseconds)
+	case fec:
+		err = d.silkDecoder.DecodeLowBitrateRedundancy(rangeDecoder, decoded, isStereo, d.channels, nanoseconds, silk.Bandwidth(silkBandwidth))
+	default:
+		err = d.silkDecoder.DecodeWithRange(rangeDecoder, decoded, isStereo, d.channels, nanoseconds, silk.Bandwidth(silkBandwidth))
+	}
+	if err != nil {
+		return nil, corrupted(err)
+	}
+
+	if sampleRate != d.silkSampleRate || d.silkResamplers[0] == nil {
+		for c := range d.silkResamplers {
+			d.silkResamplers[c] = newUpsampler(sampleRate)
+		}
+		d.silkSampleRate = sampleRate
+	}
+
+	// Mono is duplicated to both channels of stereo output
+	out := make([]float32, frameSize*d.channels)
+	channel := make([]float32, samples)
+	for c := 0; c < d.channels; c++ {
+		source := c % silkChannels
+		for i := range channel {
+			channel[i] = decoded[i*silkChannels+source]
+		}
+		for i, sample := range d.silkResamplers[c].process(channel)[:frameSize] {
+			out[i*d.channels+c] = sample
+		}
+	}
+	return out, nil
+}
+
+// celtEndBand returns the number of CELT bands coded at a bandwidth
+func celtEndBand(bandwidth Bandwidth) int {
+	switch bandwidth {
+	case BandwidthNarrowband:
+		return 13
+	case BandwidthMediumband, BandwidthWideband:
+		return 17
+	case BandwidthSuperwideband:
+		return 19
+	default:
+		return 21
+	}
+}
+
+func corrupted(err error) error {
+	if errors.Is(err, rangecoding.ErrBitBudgetExceeded) || errors.Is(err, rangecoding.ErrInvalidUniformValue) {
+		return fmt.Errorf("%w: %v", ErrCorruptedPacket, err)
+	}
+	return err
+}
+
+func minInt(a, b int) int {
+	if a < b {
+		return a
+	}
+	return b
+}
+
+// Mode returns the mode of the last packet decoded
+func (d *Decoder) Mode() Mode {
+	return d.mode
+}
+
+// Bandwidth returns the bandwidth of the last packet decoded, like
+// OPUS_GET_BANDWIDTH
+func (d *Decoder) Bandwidth() Bandwidth {
+	return d.bandwidth
+}
+
+// FrameDuration returns the duration of the frames of the last packet
+// decoded
+func (d *Decoder) FrameDuration() time.Duration {
+	return d.frameDuration
+}
+
+// SamplesDecoded returns the number of samples per channel at 48 kHz
+// that the last packet decoded or concealed, like
+// OPUS_GET_LAST_PACKET_DURATION
+func (d *Decoder) SamplesDecoded() int {
+	return d.samplesDecoded
+}
+
+// FinalRange returns the state of the range decoder after the last
+// frame decoded, like OPUS_GET_FINAL_RANGE. It matches the final range
+// of the encoder when the packet was decoded bit-exactly, and is zero
+// after concealment.
+func (d *Decoder) FinalRange() uint32 {
+	return d.finalRange
+}
+
+// Pitch returns the pitch period of the last frame decoded in samples at
+// 48 kHz, or zero when it isn't voiced, like OPUS_GET_PITCH. It is the
+// period of the CELT post-filter, or the pitch lag of SILK.
+func (d *Decoder) Pitch() int {
+	if d.previousMode == ModeCELTOnly {
+		return d.celtDecoder.Pitch()
+	}
+	return d.silkDecoder.PreviousPitchLag()
+}
 
-	return cfg.bandwidth(), tocHeader.isStereo(), frames, nil
+// Concealed returns whether the last output was, at least in part,
+// concealment of a lost packet or of a frame of zero length rather than
+// decoded audio
+func (d *Decoder) Concealed() bool {
+	return d.concealed
 }
@@ -0,0 +1,544 @@
+package opus
+
+import (
+	"encoding/binary"
+	"errors"
+	"math"
+	"testing"
+	"time"
+
+	"github.com/pion/opus/internal/celt"
+	"github.com/pion/opus/internal/silk"
+)
+
+func TestDecoder_State(t *testing.T) {
+	encoder, err := NewEncoder(16000, 1, ApplicationVoIP)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The input of the SILK layer is delayed, so the first packet starts
+	// with silence and the second one is voiced throughout
+	in := sine(440, 16000, 1, 2)
+	first := make([]byte, 1500)
+	firstSize, err := encoder.EncodeFloat32(in[:320], first)
+	if err != nil {
+		t.Fatal(err)
+	}
+	out := make([]byte, 1500)
+	size, err := encoder.EncodeFloat32(in[320:], out)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	decoder := NewDecoder()
+	if _, _, _, err = decoder.Decode(nil); !errors.Is(err, errTooShortForTableOfContentsHeader) {
+		t.Fatalf("expected %v, got %v", errTooShortForTableOfContentsHeader, err)
+	}
+	if _, err = decoder.Conceal(make([]float32, 2*100), 100); !errors.Is(err, errInvalidConcealmentDuration) {
+		t.Fatalf("expected %v, got %v", errInvalidConcealmentDuration, err)
+	}
+	if _, _, _, err = decoder.Decode(first[:firstSize]); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, test := range []struct {
+		name      string
+		packet    []byte
+		concealed bool
+	}{
+		{"packet", out[:size], false},
+		{"lost", nil, true},
+		{"DTX", out[:1], true},
+	} {
+		bandwidth, isStereo, frames, err := decoder.DecodeFrames(test.packet)
+		if test.packet == nil {
+			frames = [][]float32{make([]float32, 2*960)}
+			_, err = decoder.Conceal(frames[0], 960)
+			bandwidth, isStereo = decoder.Bandwidth(), false
+		}
+		switch {
+		case err != nil:
+			t.Fatalf("%s: %v", test.name, err)
+		case bandwidth != BandwidthWideband || isStereo || len(frames) != 1:
+			t.Fatalf("%s: decoded %s, stereo %t, %d frames", test.name, bandwidth, isStereo, len(frames))
+		case decoder.Mode() != ModeSilkOnly || decoder.Bandwidth() != BandwidthWideband:
+			t.Fatalf("%s: last mode %s at %s", test.name, decoder.Mode(), decoder.Bandwidth())
+		case decoder.FrameDuration() != 20*time.Millisecond || decoder.SamplesDecoded() != 960:
+			t.Fatalf("%s: %s frames, %d samples", test.name, decoder.FrameDuration(), decoder.SamplesDecoded())
+		case decoder.Concealed() != test.concealed:
+			t.Fatalf("%s: concealed %t, expected %t", test.name, decoder.Concealed(), test.concealed)
+		case test.concealed && decoder.FinalRange() != 0:
+			t.Fatalf("%s: final range %08x after concealment", test.name, decoder.FinalRange())
+		case !test.concealed && decoder.FinalRange() != encoder.FinalRange():
+			t.Fatalf("%s: final range %08x, expected %08x", test.name, decoder.FinalRange(), encoder.FinalRange())
+		case decoder.Pitch() <= 0:
+			t.Fatalf("%s: pitch %d of a sine", test.name, decoder.Pitch())
+		}
+	}
+
+	// A rejected packet leaves the state of the last one
+	if _, _, _, err = decoder.Decode([]byte{0xff, 0x00}); err == nil {
+		t.Fatal("packet without frames decoded")
+	} else if decoder.Mode() != ModeSilkOnly || !decoder.Concealed() {
+		t.Fatalf("state changed to %s, concealed %t", decoder.Mode(), decoder.Concealed())
+	}
+}
+
+// celtPackets encodes samples into CELT-only fullband 20 ms packets
+func celtPackets(t *testing.T, encoder *celt.Encoder, samples []float32, channels int) [][]byte {
+	t.Helper()
+
+	toc := byte(31 << 3)
+	if channels == 2 {
+		toc |= 0b100
+	}
+
+	var packets [][]byte
+	for i := 0; i < len(samples); i += 960 * channels {
+		frame, err := encoder.Encode(samples[i:i+960*channels], 1275)
+		if err != nil {
+			t.Fatal(err)
+		}
+		packets = append(packets, append([]byte{toc}, frame...))
+	}
+	return packets
+}
+
+// silkPackets encodes samples at 16 kHz into SILK-only wideband 20 ms
+// packets
+func silkPackets(t *testing.T, encoder *silk.Encoder, samples []float32) [][]byte {
+	t.Helper()
+
+	var packets [][]byte
+	for i := 0; i < len(samples); i += 320 {
+		frame, err := encoder.Encode(samples[i:i+320], false, int(20*time.Millisecond), silk.BandwidthWideband)
+		if err != nil {
+			t.Fatal(err)
+		}
+		packets = append(packets, append([]byte{9 << 3}, frame...))
+	}
+	return packets
+}
+
+// decodeAll decodes packets one after the other
+func decodeAll(t *testing.T, decoder *Decoder, packets [][]byte) []float32 {
+	t.Helper()
+
+	var out []float32
+	for _, packet := range packets {
+		_, _, frames, err := decoder.DecodeFrames(packet)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, frame := range frames {
+			out = append(out, frame...)
+		}
+	}
+	return out
+}
+
+// delayedSNR returns the signal to noise ratio of out against in, over
+// the second half of in and at the delay of out that matches best
+func delayedSNR(in, out []float32, channels int) float64 {
+	best := math.Inf(-1)
+	for delay := 0; delay <= 480; delay++ {
+		var signal, noise float64
+		for i := len(in) / 2; i+delay*channels < len(out) && i < len(in); i++ {
+			expected := float64(in[i])
+			difference := float64(out[i+delay*channels]) - expected
+			signal += expected * expected
+			noise += difference * difference
+		}
+		best = math.Max(best, 10*math.Log10(signal/noise))
+	}
+	return best
+}
+
+func TestDecoder_CELT(t *testing.T) {
+	for _, channels := range []int{1, 2} {
+		in := sine(440, 48000, channels, 10)
+		encoder, err := celt.NewEncoder(channels)
+		if err != nil {
+			t.Fatal(err)
+		}
+		encoder.SetBitrate(64000 * channels)
+
+		decoder, err := NewDecoderWithChannels(channels)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		var out []float32
+		for i, packet := range celtPackets(t, encoder, in, channels) {
+			frame := make([]float32, 960*channels)
+			if _, err = decoder.DecodeFloat32(packet, frame); err != nil {
+				t.Fatal(err)
+			}
+			out = append(out, frame...)
+
+			// Each packet was encoded after the previous one
+			if i == 9 && decoder.FinalRange() != encoder.FinalRange() {
+				t.Fatalf("%d channels: final range %08x, expected %08x", channels, decoder.FinalRange(), encoder.FinalRange())
+			}
+		}
+
+		if decoder.Mode() != ModeCELTOnly || decoder.Bandwidth() != BandwidthFullband || decoder.Concealed() {
+			t.Fatalf("%d channels: decoded %s at %s, concealed %t", channels, decoder.Mode(), decoder.Bandwidth(), decoder.Concealed())
+		}
+		if ratio := delayedSNR(in, out, channels); ratio < 15 {
+			t.Fatalf("%d channels: SNR of %.1f dB", channels, ratio)
+		}
+	}
+}
+
+func TestDecoder_SILK(t *testing.T) {
+	packets := silkPackets(t, silk.NewEncoder(), sine(440, 16000, 1, 10))
+
+	// Mono is duplicated to stereo output
+	mono, err := NewDecoderWithChannels(1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	out := decodeAll(t, mono, packets)
+	if ratio := delayedSNR(sine(440, 48000, 1, 10), out, 1); ratio < 5 {
+		t.Fatalf("SNR of %.1f dB", ratio)
+	}
+
+	stereo := decodeAll(t, NewDecoder(), packets)
+	for i, sample := range out {
+		if stereo[2*i] != sample || stereo[2*i+1] != sample {
+			t.Fatalf("sample %d: %f, %f, expected %f", i, stereo[2*i], stereo[2*i+1], sample)
+		}
+	}
+}
+
+func TestDecoder_TruncatedSILK(t *testing.T) {
+	packet := silkPackets(t, silk.NewEncoder(), sine(440, 16000, 1, 1))[0]
+
+	// Like libopus, the bytes missing from a SILK-only frame are taken for
+	// stripped zero bytes, so truncation isn't detected
+	truncated := packet[:len(packet)/2]
+	padded := append(append([]byte{}, truncated...), make([]byte, len(packet)-len(truncated))...)
+	outs := [2][]float32{}
+	for i, in := range [][]byte{truncated, padded} {
+		outs[i] = make([]float32, 960)
+		decoder, err := NewDecoderWithChannels(1)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err = decoder.DecodeFloat32(in, outs[i]); err != nil {
+			t.Fatalf("%d bytes: %v", len(in), err)
+		}
+	}
+
+	for i := range outs[0] {
+		if outs[0][i] != outs[1][i] {
+			t.Fatalf("sample %d: %f, expected %f", i, outs[0][i], outs[1][i])
+		}
+	}
+}
+
+func TestDecoder_Decode(t *testing.T) {
+	packets := silkPackets(t, silk.NewEncoder(), sine(440, 16000, 1, 2))
+
+	// Decode returns the samples of DecodeFrames as little-endian float32
+	bytesDecoder, framesDecoder := NewDecoder(), NewDecoder()
+	for i, packet := range packets {
+		_, _, encoded, err := bytesDecoder.Decode(packet)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, _, frames, err := framesDecoder.DecodeFrames(packet)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if len(encoded) != len(frames) {
+			t.Fatalf("packet %d: %d frames, expected %d", i, len(encoded), len(frames))
+		}
+		for j, frame := range frames {
+			if len(encoded[j]) != 4*len(frame) {
+				t.Fatalf("packet %d frame %d: %d bytes for %d samples", i, j, len(encoded[j]), len(frame))
+			}
+			for k, sample := range frame {
+				if decoded := math.Float32frombits(binary.LittleEndian.Uint32(encoded[j][4*k:])); decoded != sample {
+					t.Fatalf("packet %d sample %d: %f, expected %f", i, k, decoded, sample)
+				}
+			}
+		}
+	}
+}
+
+func TestUpsampler(t *testing.T) {
+	for _, inputRate := range []int{8000, 12000, 16000} {
+		u := newUpsampler(inputRate)
+		var out []float32
+		in := sine(1000, inputRate, 1, 10)
+		for i := 0; i < len(in); i += inputRate / 100 {
+			out = append(out, u.process(in[i:i+inputRate/100])...)
+		}
+		if len(out) != len(in)*decodeSampleRate/inputRate {
+			t.Fatalf("%d Hz: %d samples, expected %d", inputRate, len(out), len(in)*decodeSampleRate/inputRate)
+		}
+
+		// Skip the first frame, where the filters start from silence
+		var peak float64
+		for _, sample := range out[samples20ms:] {
+			peak = math.Max(peak, math.Abs(float64(sample)))
+		}
+		if math.Abs(peak/0.5-1) > 0.05 {
+			t.Fatalf("%d Hz: 1000 Hz tone has gain %f", inputRate, peak/0.5)
+		}
+	}
+}
+
+func TestDecoder_FrameCodes(t *testing.T) {
+	encoder, err := celt.NewEncoder(1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	encoder.SetBitrate(32000)
+	encoder.SetVBR(false)
+
+	// CELT-only fullband 10 ms frames of 40 bytes
+	var frames [][]byte
+	in := sine(440, 48000, 1, 5)
+	for i := 0; i < len(in); i += 480 {
+		frame, err := encoder.Encode(in[i:i+480], 1275)
+		if err != nil {
+			t.Fatal(err)
+		}
+		frames = append(frames, frame)
+	}
+
+	toc := byte(30 << 3)
+	packets := [][]byte{
+		append([]byte{toc}, frames[0]...),
+		append(append([]byte{toc | 1}, frames[1]...), frames[2]...),
+		append(append([]byte{toc | 2, byte(len(frames[3]))}, frames[3]...), frames[4]...),
+		append(append(append([]byte{toc | 3, 0b11000011, 2, byte(len(frames[5])), byte(len(frames[6]))}, frames[5]...), frames[6]...), append(frames[7], 0, 0)...),
+		append(append([]byte{toc | 3, 0b00000010}, frames[8]...), frames[9]...),
+	}
+
+	separately, err := NewDecoderWithChannels(1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var expected []float32
+	for _, frame := range frames {
+		_, _, decoded, err := separately.DecodeFrames(append([]byte{toc}, frame...))
+		if err != nil {
+			t.Fatal(err)
+		}
+		expected = append(expected, decoded[0]...)
+	}
+
+	decoder, err := NewDecoderWithChannels(1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	frameCounts := []int{1, 2, 2, 3, 2}
+	var out []float32
+	for i, packet := range packets {
+		_, _, decoded, err := decoder.DecodeFrames(packet)
+		switch {
+		case err != nil:
+			t.Fatalf("packet %d: %v", i, err)
+		case len(decoded) != frameCounts[i] || decoder.SamplesDecoded() != 480*frameCounts[i]:
+			t.Fatalf("packet %d: %d frames, %d samples", i, len(decoded), decoder.SamplesDecoded())
+		case decoder.FrameDuration() != 10*time.Millisecond:
+			t.Fatalf("packet %d: %s frames", i, decoder.FrameDuration())
+		}
+		for _, frame := range decoded {
+			out = append(out, frame...)
+		}
+	}
+
+	for i := range expected {
+		if out[i] != expected[i] {
+			t.Fatalf("sample %d: %f, expected %f", i, out[i], expected[i])
+		}
+	}
+	if decoder.FinalRange() != encoder.FinalRange() {
+		t.Fatalf("final range %08x, expected %08x", decoder.FinalRange(), encoder.FinalRange())
+	}
+}
+
+func TestDecoder_Transitions(t *testing.T) {
+	celtEncoder, err := celt.NewEncoder(1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	celtEncoder.SetBitrate(32000)
+	silkEncoder := silk.NewEncoder()
+
+	decoder, err := NewDecoderWithChannels(1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	out := make([]float32, 960)
+	for i := 0; i < 8; i++ {
+		var packet []byte
+		var finalRange uint32
+		if i%4 < 2 {
+			packet = silkPackets(t, silkEncoder, sine(440, 16000, 1, 1))[0]
+			finalRange = silkEncoder.FinalRange()
+		} else {
+			packet = celtPackets(t, celtEncoder, sine(440, 48000, 1, 1), 1)[0]
+			finalRange = celtEncoder.FinalRange()
+		}
+
+		if _, err = decoder.DecodeFloat32(packet, out); err != nil {
+			t.Fatalf("packet %d: %v", i, err)
+		} else if decoder.FinalRange() != finalRange {
+			t.Fatalf("packet %d: final range %08x, expected %08x", i, decoder.FinalRange(), finalRange)
+		}
+
+		// The switch fades from the concealment of the previous mode
+		for j, sample := range out {
+			if math.IsNaN(float64(sample)) || math.Abs(float64(sample)) > 1 {
+				t.Fatalf("packet %d, sample %d: %f", i, j, sample)
+			}
+		}
+	}
+}
+
+func TestDecoder_Conceal(t *testing.T) {
+	decoder, err := NewDecoderWithChannels(1)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Nothing to extrapolate from
+	out := make([]float32, 960)
+	out[0] = 1
+	if samples, err := decoder.Conceal(out, 960); err != nil || samples != 960 {
+		t.Fatalf("%d samples: %v", samples, err)
+	} else if out[0] != 0 {
+		t.Fatal("concealed without a packet decoded")
+	}
+
+	for _, test := range []struct {
+		name    string
+		packets func() [][]byte
+	}{
+		{"CELT", func() [][]byte {
+			encoder, err := celt.NewEncoder(1)
+			if err != nil {
+				t.Fatal(err)
+			}
+			encoder.SetBitrate(64000)
+			return celtPackets(t, encoder, sine(440, 48000, 1, 5), 1)
+		}},
+		{"SILK", func() [][]byte {
+			return silkPackets(t, silk.NewEncoder(), sine(440, 16000, 1, 5))
+		}},
+	} {
+		decoder.Reset()
+		decoded := decodeAll(t, decoder, test.packets())
+
+		// Frames of 2.5, 5 and 10 ms then one of 30 ms in a 20 ms mode
+		for _, samples := range []int{120, 240, 480, 1440} {
+			out := make([]float32, samples)
+			if n, err := decoder.Conceal(out, samples); err != nil || n != samples {
+				t.Fatalf("%s: %d samples: %v", test.name, n, err)
+			}
+			if !decoder.Concealed() || decoder.FinalRange() != 0 || decoder.SamplesDecoded() != samples {
+				t.Fatalf("%s: concealed %t, final range %08x, %d samples", test.name, decoder.Concealed(), decoder.FinalRange(), decoder.SamplesDecoded())
+			}
+			if samples == 120 && energy(out) < energy(decoded[len(decoded)-120:])/4 {
+				t.Fatalf("%s: energy %f after %f", test.name, energy(out), energy(decoded[len(decoded)-120:]))
+			}
+		}
+	}
+}
+
+func energy(samples []float32) float64 {
+	sum := 0.0
+	for _, sample := range samples {
+		sum += float64(sample) * float64(sample)
+	}
+	return sum / float64(len(samples))
+}
+
+func TestDecoder_DecodeFEC(t *testing.T) {
+	encoder := silk.NewEncoder()
+	encoder.SetLowBitrateRedundancy(true)
+	encoder.SetPacketLossPercentage(20)
+	in := sine(440, 16000, 1, 25)
+	packets := silkPackets(t, encoder, in)
+
+	for _, test := range []struct {
+		name      string
+		samples   int
+		concealed bool
+	}{
+		{"LBRR", 960, false},
+		{"LBRR after concealment", 1920, true},
+	} {
+		decoder, err := NewDecoderWithChannels(1)
+		if err != nil {
+			t.Fatal(err)
+		}
+		out := decodeAll(t, decoder, packets[:4])
+
+		// The packet after the loss carries its LBRR frame
+		recovered := make([]float32, test.samples)
+		if n, err := decoder.DecodeFEC(packets[4+test.samples/960], recovered, test.samples); err != nil || n != test.samples {
+			t.Fatalf("%s: %d samples: %v", test.name, n, err)
+		} else if decoder.Concealed() != test.concealed {
+			t.Fatalf("%s: concealed %t", test.name, decoder.Concealed())
+		}
+		out = append(out, recovered...)
+		out = append(out, decodeAll(t, decoder, packets[4+test.samples/960:])...)
+
+		if ratio := delayedSNR(sine(440, 48000, 1, 25), out, 1); ratio < 3 {
+			t.Fatalf("%s: SNR of %.1f dB", test.name, ratio)
+		}
+	}
+
+	// CELT-only packets have no LBRR
+	decoder := NewDecoder()
+	celtEncoder, err := celt.NewEncoder(1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	packet := celtPackets(t, celtEncoder, sine(440, 48000, 1, 1), 1)[0]
+	if _, err = decoder.DecodeFEC(packet, make([]float32, 2*960), 960); err != nil || !decoder.Concealed() {
+		t.Fatalf("concealed %t: %v", decoder.Concealed(), err)
+	}
+	if _, err = decoder.DecodeFEC(packet, make([]float32, 2*960), 100); !errors.Is(err, errInvalidConcealmentDuration) {
+		t.Fatalf("expected %v, got %v", errInvalidConcealmentDuration, err)
+	}
+}
+
+func TestNewStreamDecoder(t *testing.T) {
+	encoder, err := celt.NewEncoder(2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	encoder.SetBitrate(96000)
+	packets := celtPackets(t, encoder, sine(440, 48000, 2, 3), 2)
+	expected := decodeAll(t, NewDecoder(), packets)
+
+	// One coupled stream with its channels swapped
+	decoder, err := NewMultistreamDecoder(2, 1, 1, []uint8{1, 0}, NewStreamDecoder)
+	if err != nil {
+		t.Fatal(err)
+	}
+	out := make([]float32, 2*960)
+	for i, packet := range packets {
+		if _, err = decoder.DecodeFloat32(packet, out); err != nil {
+			t.Fatal(err)
+		}
+		for j := 0; j < 960; j++ {
+			if out[2*j] != expected[2*(960*i+j)+1] || out[2*j+1] != expected[2*(960*i+j)] {
+				t.Fatalf("packet %d, sample %d: channels not swapped", i, j)
+			}
+		}
+	}
+
+	if _, err = NewDecoderWithChannels(3); !errors.Is(err, errInvalidDecoderChannelCount) {
+		t.Fatalf("expected %v, got %v", errInvalidDecoderChannelCount, err)
+	}
+}
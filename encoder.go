@@ -0,0 +1,833 @@
+package opus
+
+import (
+	"time"
+
+	"github.com/pion/opus/internal/celt"
+	"github.com/pion/opus/internal/rangecoding"
+	"github.com/pion/opus/internal/resample"
+	"github.com/pion/opus/internal/silk"
+)
+
+// Application is the intended use of an Encoder, like the
+// OPUS_APPLICATION_* values of opus_encoder_create
+type Application byte
+
+// Signal is a hint of the kind of audio an Encoder is given, like the
+// OPUS_SIGNAL_* values of OPUS_SET_SIGNAL
+type Signal byte
+
+const (
+	// ApplicationVoIP favors speech intelligibility
+	ApplicationVoIP Application = iota + 1
+	// ApplicationAudio favors faithfulness to the input
+	ApplicationAudio
+	// ApplicationRestrictedLowDelay only uses the lowest delay modes
+	ApplicationRestrictedLowDelay
+)
+
+const (
+	SignalAuto Signal = iota
+	SignalVoice
+	SignalMusic
+)
+
+const (
+	// Bitrates are limited like OPUS_SET_BITRATE, and a frame to 1275
+	// bytes
+	minBitrate   = 500
+	maxBitrate   = 512000
+	maxFrameSize = 1275
+
+	// Frames get at least minFrameSize bytes, or the packet is sent
+	// without them for the decoder to conceal, like the PLC packets of
+	// opus_encode_native()
+	minFrameSize = 3
+
+	maxComplexity = 10
+
+	// With DTX, after dtxInactiveFrames frames without voice activity the
+	// encoder only sends TOC bytes, and a full frame every dtxMaxFrames
+	// packets so that the decoder's comfort noise follows the background
+	dtxInactiveFrames = 10
+	dtxMaxFrames      = 20
+
+	// How likely the input is voice, from 0 for music to 127, for each
+	// application when the signal isn't set, like the voice_est of
+	// opus_encode_native() (opus_encoder.c)
+	voipVoiceEstimate  = 115
+	audioVoiceEstimate = 48
+	maxVoiceEstimate   = 127
+
+	// The bitrate above which music is coded CELT-only, and the
+	// hysteresis of the mode and the VoIP bias against CELT-only
+	musicModeThreshold = 16000
+	modeHysteresis     = 4000
+	voipModeBias       = 8000
+
+	// Packets smaller than these bitrates allow, for frames of 20 ms and
+	// more and for shorter frames, are too small for the SILK layer, like
+	// the limits of opus_encode_native()
+	silkMinBitrate           = 6000
+	silkShortFrameMinBitrate = 9000
+
+	// The bitrates above which stereo voice and music are coded as
+	// stereo, and their hysteresis, like the stereo_voice_threshold and
+	// stereo_music_threshold of opus_encoder.c
+	stereoVoiceThreshold = 19000
+	stereoMusicThreshold = 17000
+	stereoHysteresis     = 1000
+
+	// A hybrid frame keeps 37 bits for the CELT layer and 20 for the
+	// redundancy flag the decoder reads when they fit
+	hybridCELTBits       = 37
+	hybridRedundancyBits = 20
+
+	// The decoder's CELT output lags its input by the 120 samples of its
+	// overlap at 48 kHz, and its wideband SILK output by 37, one sample of
+	// the SILK decoder and the rest of its upsampler
+	celtDelay         = 120
+	silkWidebandDelay = 37
+
+	// Samples as quiet as the lowest bit of 24-bit audio are digital
+	// silence
+	digitalSilence = 1.0 / (1 << 24)
+)
+
+var (
+	// The bitrates above which voice is coded CELT-only, for mono and
+	// stereo, like the mode_thresholds of opus_encoder.c
+	voiceModeThresholds = [2]int{64000, 36000}
+
+	// The bitrates and hysteresis above which voice and music are coded
+	// in MB, WB, SWB and FB, like the mono_voice_bandwidth_thresholds and
+	// mono_music_bandwidth_thresholds of opus_encoder.c
+	voiceBandwidthThresholds = [4][2]int{{9000, 700}, {9000, 700}, {13500, 1000}, {14000, 2000}}
+	musicBandwidthThresholds = [4][2]int{{9000, 700}, {9000, 700}, {11000, 1000}, {12000, 2000}}
+
+	// The bitrate of the SILK layer of hybrid frames per channel, for a
+	// total bitrate per channel, for 10 and 20 ms frames without and with
+	// FEC, like the rate_table of compute_silk_rate_for_hybrid()
+	// (opus_encoder.c)
+	hybridSILKBitrates = [][5]int{
+		{0, 0, 0, 0, 0},
+		{12000, 10000, 10000, 11000, 11000},
+		{16000, 13500, 13500, 15000, 15000},
+		{20000, 16000, 16000, 18000, 18000},
+		{24000, 18000, 18000, 21000, 21000},
+		{32000, 22000, 22000, 28000, 28000},
+		{64000, 38000, 38000, 50000, 50000},
+	}
+)
+
+// Encoder encodes PCM into Opus packets, like opus_encoder_create and
+// the CTLs that configure it.
+//
+// Each packet is SILK-only, hybrid or CELT-only, by the bitrate, the
+// signal and the application, like opus_encode_native() chooses, and its
+// bandwidth is the widest the bitrate, the maximum bandwidth and the
+// sample rate allow. Stereo input is coded as stereo, but below the
+// stereo threshold where it is coded as mono SILK-only packets. Hybrid and
+// CELT-only packets of 40 and 60 ms hold 20 ms frames. The encoder
+// doesn't code redundant CELT frames across mode switches.
+type Encoder struct {
+	sampleRate  int
+	channels    int
+	application Application
+
+	bitrate              int
+	complexity           int
+	vbr                  bool
+	vbrConstraint        bool
+	maxBandwidth         Bandwidth
+	signal               Signal
+	inbandFEC            bool
+	packetLossPercentage int
+	dtx                  bool
+	frameDuration        time.Duration
+
+	silkEncoder  *silk.Encoder
+	celtEncoder  *celt.Encoder
+	rangeEncoder rangecoding.Encoder
+
+	// Each channel is resampled to the sample rate of the SILK layer and
+	// to 48 kHz for the CELT layer, and the input of the SILK layer is
+	// delayed to line up with the CELT layer
+	silkResamplers [2]*resample.Resampler
+	celtResamplers [2]*resample.Resampler
+	silkSampleRate int
+	silkDelay      []float32
+
+	// The mode, bandwidth and channels of the last packet, and its final
+	// range
+	mode       Mode
+	bandwidth  Bandwidth
+	isStereo   bool
+	finalRange uint32
+
+	// Consecutive frames without voice activity, and packets sent as a
+	// TOC byte since the last full frame
+	inactiveFrames int
+	dtxFrames      int
+}
+
+// NewEncoder creates an Encoder for sampleRate, one of 8000, 12000,
+// 16000, 24000 or 48000, and one or two channels. Like
+// opus_encoder_create, it starts in VBR mode at a bitrate that depends
+// on the sample rate and channels.
+func NewEncoder(sampleRate, channels int, application Application) (*Encoder, error) {
+	switch sampleRate {
+	case 8000, 12000, 16000, 24000, 48000:
+	default:
+		return nil, errInvalidSampleRate
+	}
+
+	switch {
+	case channels != 1 && channels != 2:
+		return nil, errInvalidEncoderChannelCount
+	case application < ApplicationVoIP || application > ApplicationRestrictedLowDelay:
+		return nil, errInvalidApplication
+	}
+
+	celtEncoder, err := celt.NewEncoder(channels)
+	if err != nil {
+		return nil, err
+	}
+
+	e := &Encoder{
+		sampleRate:    sampleRate,
+		channels:      channels,
+		application:   application,
+		bitrate:       3000 + sampleRate*channels,
+		complexity:    maxComplexity,
+		vbr:           true,
+		vbrConstraint: true,
+		maxBandwidth:  BandwidthFullband,
+		frameDuration: 20 * time.Millisecond,
+		silkEncoder:   silk.NewEncoder(),
+		celtEncoder:   celtEncoder,
+	}
+	for c := 0; c < channels; c++ {
+		e.celtResamplers[c] = resample.New(sampleRate, 48000)
+	}
+
+	// The input of the SILK layer is held back by the difference of the
+	// delays of the two layers through the resamplers and the decoder, in
+	// samples at 48 kHz
+	delay := celtDelay + e.celtResamplers[0].Delay() -
+		silkWidebandDelay - resample.New(sampleRate, 16000).Delay()*3
+	if delay < 0 {
+		delay = 0
+	}
+	e.silkDelay = make([]float32, (delay*sampleRate+24000)/48000*channels)
+
+	return e, nil
+}
+
+// SetBitrate sets the target bitrate in bits per second, like
+// OPUS_SET_BITRATE
+func (e *Encoder) SetBitrate(bitrate int) error {
+	if bitrate < minBitrate || bitrate > maxBitrate {
+		return errInvalidBitrate
+	}
+	e.bitrate = bitrate
+	return nil
+}
+
+// SetComplexity sets the computational complexity from 0 to 10, like
+// OPUS_SET_COMPLEXITY. It limits the NLSF search of the SILK layer and
+// the analyses of the CELT layer.
+func (e *Encoder) SetComplexity(complexity int) error {
+	if complexity < 0 || complexity > maxComplexity {
+		return errInvalidComplexity
+	}
+	e.complexity = complexity
+	e.silkEncoder.SetComplexity(complexity)
+	e.celtEncoder.SetComplexity(complexity)
+	return nil
+}
+
+// SetVBR enables variable bitrate, like OPUS_SET_VBR. In constant
+// bitrate mode every packet is padded to the size of the bitrate.
+func (e *Encoder) SetVBR(vbr bool) {
+	e.vbr = vbr
+}
+
+// SetVBRConstraint constrains the variable bitrate to the bitrate over
+// about 100 ms, like OPUS_SET_VBR_CONSTRAINT. Like the reference
+// encoder, it applies to CELT-only frames.
+func (e *Encoder) SetVBRConstraint(constrained bool) {
+	e.vbrConstraint = constrained
+}
+
+// SetMaxBandwidth sets the widest bandwidth the encoder may choose, like
+// OPUS_SET_MAX_BANDWIDTH
+func (e *Encoder) SetMaxBandwidth(bandwidth Bandwidth) error {
+	if bandwidth < BandwidthNarrowband || bandwidth > BandwidthFullband {
+		return errInvalidBandwidth
+	}
+	e.maxBandwidth = bandwidth
+	return nil
+}
+
+// SetSignal hints whether the input is voice or music, like
+// OPUS_SET_SIGNAL. Voice favors the SILK layer.
+func (e *Encoder) SetSignal(signal Signal) error {
+	if signal > SignalMusic {
+		return errInvalidSignal
+	}
+	e.signal = signal
+	return nil
+}
+
+// SetInbandFEC enables in-band forward error correction, like
+// OPUS_SET_INBAND_FEC. With an expected packet loss, the SILK layer
+// codes a low bit-rate copy of each frame with voice activity into the
+// next packet, and the encoder keeps to the SILK layer when the loss is
+// high enough.
+func (e *Encoder) SetInbandFEC(fec bool) {
+	e.inbandFEC = fec
+	e.setLowBitrateRedundancy()
+}
+
+// SetPacketLossPercentage sets the expected packet loss from 0 to 100
+// percent, like OPUS_SET_PACKET_LOSS_PERC. Both layers depend less on
+// previous frames as it grows.
+func (e *Encoder) SetPacketLossPercentage(percentage int) error {
+	if percentage < 0 || percentage > 100 {
+		return errInvalidPacketLossPercentage
+	}
+	e.packetLossPercentage = percentage
+	e.silkEncoder.SetPacketLossPercentage(percentage)
+	e.celtEncoder.SetPacketLoss(percentage)
+	e.setLowBitrateRedundancy()
+	return nil
+}
+
+// setLowBitrateRedundancy enables the LBRR frames of the SILK layer when
+// FEC is enabled and packets are expected to be lost, like
+// silk_setup_LBRR() (control_codec.c)
+func (e *Encoder) setLowBitrateRedundancy() {
+	e.silkEncoder.SetLowBitrateRedundancy(e.inbandFEC && e.packetLossPercentage > 0)
+}
+
+// SetDTX enables discontinuous transmission, like OPUS_SET_DTX. Packets
+// without voice activity, or of digital silence for CELT-only packets,
+// shrink to their TOC byte.
+func (e *Encoder) SetDTX(dtx bool) {
+	e.dtx = dtx
+}
+
+// SetFrameDuration sets the duration of the frames passed to
+// EncodeFloat32, like OPUS_SET_EXPERT_FRAME_DURATION. Frames shorter than
+// 10 ms are coded CELT-only.
+func (e *Encoder) SetFrameDuration(duration time.Duration) error {
+	switch duration {
+	case 2500 * time.Microsecond, 5 * time.Millisecond, 10 * time.Millisecond,
+		20 * time.Millisecond, 40 * time.Millisecond, 60 * time.Millisecond:
+	default:
+		return errInvalidFrameDuration
+	}
+	e.frameDuration = duration
+	return nil
+}
+
+// FinalRange returns the state of the range encoder after the last
+// packet encoded, like OPUS_GET_FINAL_RANGE. It matches the final range
+// of a decoder that decodes the packet correctly.
+func (e *Encoder) FinalRange() uint32 {
+	return e.finalRange
+}
+
+// EncodeFloat32 encodes a frame of interleaved samples in the range
+// [-1, 1] into out, and returns the size of the packet
+func (e *Encoder) EncodeFloat32(in []float32, out []byte) (int, error) {
+	frameSize := int(e.frameDuration) * e.sampleRate / int(time.Second)
+	if len(in) != frameSize*e.channels {
+		return 0, errInvalidFrameSampleCount
+	} else if len(out) < 1 {
+		return 0, errPacketBufferTooShort
+	}
+
+	// The TOC byte, and the frame count byte and lengths of code 3
+	// packets, come out of the bitrate and the buffer
+	packetSize := len(out)
+	if !e.vbr {
+		packetSize = e.cbrPacketSize(len(out))
+	}
+
+	mode, bandwidth, isStereo := e.chooseMode(packetSize)
+	silkSampleRate := e.silkSampleRate
+	switch {
+	case mode == ModeSilkOnly:
+		silkSampleRate = bandwidth.SampleRate()
+	case mode == ModeHybrid || silkSampleRate == 0:
+		silkSampleRate = BandwidthWideband.SampleRate()
+	}
+	silkIn, celtIn := e.resample(in, silkSampleRate)
+	if e.channels == 2 && !isStereo {
+		silkIn = downmix(silkIn)
+	}
+
+	// The decoder starts the SILK layer over after CELT-only frames, and
+	// the CELT layer on other mode switches
+	if e.mode == ModeCELTOnly && mode != ModeCELTOnly {
+		e.silkEncoder.Reset()
+	}
+	if e.mode != 0 && mode != e.mode && mode != ModeSilkOnly {
+		e.celtEncoder.Reset()
+	}
+
+	// Hybrid and CELT-only frames are at most 20 ms
+	duration, frameCount := e.frameDuration, 1
+	if mode != ModeSilkOnly && duration > 20*time.Millisecond {
+		duration, frameCount = 20*time.Millisecond, int(e.frameDuration/(20*time.Millisecond))
+	}
+
+	overhead := 1
+	switch {
+	case frameCount > 1 && e.vbr:
+		overhead = 2 + 2*(frameCount-1)
+	case frameCount > 1:
+		overhead = 2
+	}
+	frameBytes := (packetSize - overhead) / frameCount
+	if frameBytes > maxFrameSize {
+		frameBytes = maxFrameSize
+	}
+	bitrate := e.bitrate - 8*overhead*int(time.Second/e.frameDuration)
+
+	frames := make([][]byte, frameCount)
+	active := false
+	if frameBytes >= minFrameSize {
+		var err error
+		if frames, active, err = e.encodeFrames(silkIn, celtIn, mode, bandwidth, isStereo, frameCount, frameBytes, bitrate); err != nil {
+			return 0, err
+		}
+	}
+	e.mode, e.bandwidth, e.isStereo = mode, bandwidth, isStereo
+
+	// Packets with too little room for a frame, or discontinued by DTX,
+	// are only their TOC byte, and the frame count byte if they hold more
+	// than one frame, which the decoder conceals
+	if frameBytes < minFrameSize || e.dtx && e.discontinue(active) {
+		frames = make([][]byte, frameCount)
+		e.finalRange = 0
+		packetSize = 0
+	}
+
+	toc := byte(frameConfiguration(mode, bandwidth, duration)) << 3
+	if isStereo {
+		toc |= 0b100
+	}
+	if e.vbr {
+		packetSize = 0
+	}
+	return packFrames(out, toc, frames, packetSize)
+}
+
+// encodeFrames encodes the frames of a packet in a mode, each in at most
+// frameBytes bytes, and returns them and whether any has voice activity
+func (e *Encoder) encodeFrames(
+	silkIn, celtIn []float32,
+	mode Mode,
+	bandwidth Bandwidth,
+	isStereo bool,
+	frameCount, frameBytes, bitrate int,
+) (frames [][]byte, active bool, err error) {
+	if mode == ModeSilkOnly {
+		frame, err := e.encodeSILK(silkIn, bandwidth, isStereo, frameBytes, bitrate)
+		return [][]byte{frame}, e.silkEncoder.VoiceActivityDetected(), err
+	}
+
+	e.celtEncoder.SetEndBand(celtEndBand(bandwidth))
+	e.celtEncoder.SetVBR(e.vbr)
+	frames = make([][]byte, frameCount)
+	for i := range frames {
+		silkFrame := silkIn[i*len(silkIn)/frameCount : (i+1)*len(silkIn)/frameCount]
+		celtFrame := celtIn[i*len(celtIn)/frameCount : (i+1)*len(celtIn)/frameCount]
+
+		if mode == ModeHybrid {
+			frames[i], err = e.encodeHybrid(silkFrame, celtFrame, bandwidth, frameBytes, bitrate)
+			active = active || e.silkEncoder.VoiceActivityDetected()
+		} else {
+			frames[i], err = e.encodeCELT(celtFrame, frameBytes, bitrate)
+			active = active || !isDigitalSilence(celtFrame)
+		}
+		if err != nil {
+			return nil, false, err
+		}
+	}
+	return frames, active, nil
+}
+
+// encodeSILK encodes a SILK-only frame, which is as long as the bits the
+// decoder reads. CBR frames are padded to the size of the bitrate.
+func (e *Encoder) encodeSILK(in []float32, bandwidth Bandwidth, isStereo bool, frameBytes, bitrate int) ([]byte, error) {
+	e.silkEncoder.SetBitrate(bitrate)
+	e.rangeEncoder.Init(make([]byte, frameBytes))
+	if err := e.silkEncoder.EncodeWithRange(&e.rangeEncoder, in, isStereo, int(e.frameDuration), silk.Bandwidth(bandwidth), 8*frameBytes); err != nil {
+		return nil, err
+	}
+
+	size := (e.rangeEncoder.Tell() + 7) / 8
+	frame, err := e.rangeEncoder.Done()
+	if err != nil || int(size) > len(frame) {
+		return nil, errPacketBufferTooShort
+	}
+	e.finalRange = e.rangeEncoder.FinalRange()
+	return frame[:size], nil
+}
+
+// encodeHybrid encodes a hybrid frame, whose wideband SILK layer takes
+// the bitrate of compute_silk_rate_for_hybrid() (opus_encoder.c) and
+// whose CELT layer codes the bands above it with the bits the SILK layer
+// left, in unconstrained VBR like the reference encoder
+//
+// https://datatracker.ietf.org/doc/html/rfc6716#section-3.2.1
+func (e *Encoder) encodeHybrid(silkIn, celtIn []float32, bandwidth Bandwidth, frameBytes, bitrate int) ([]byte, error) {
+	nanoseconds := int(e.frameDuration)
+	if nanoseconds > int(20*time.Millisecond) {
+		nanoseconds = int(20 * time.Millisecond)
+	}
+	silkBitrate := hybridSILKBitrate(bitrate, e.channels, bandwidth, nanoseconds == int(20*time.Millisecond), e.vbr, e.inbandFEC && e.packetLossPercentage > 0)
+
+	e.silkEncoder.SetBitrate(silkBitrate)
+	e.rangeEncoder.Init(make([]byte, frameBytes))
+	maxBits := 8*frameBytes - hybridCELTBits - hybridRedundancyBits
+	if err := e.silkEncoder.EncodeWithRange(&e.rangeEncoder, silkIn, e.channels == 2, nanoseconds, silk.BandwidthWideband, maxBits); err != nil {
+		return nil, err
+	}
+
+	// No redundant CELT frame follows
+	if int(e.rangeEncoder.Tell())+17+hybridRedundancyBits <= 8*frameBytes {
+		e.rangeEncoder.EncodeSymbolLogP(12, 0)
+	}
+
+	framesPerSecond := int(time.Second) / nanoseconds
+	celtBitrate := bitrate - int(e.rangeEncoder.Tell())*framesPerSecond
+	if celtBitrate < hybridCELTBits*framesPerSecond {
+		celtBitrate = hybridCELTBits * framesPerSecond
+	}
+	e.celtEncoder.SetBitrate(celtBitrate)
+	e.celtEncoder.SetVBRConstraint(false)
+	if err := e.celtEncoder.EncodeWithRange(&e.rangeEncoder, frameBytes, celtIn, hybridStartBand); err != nil {
+		return nil, err
+	}
+
+	frame, err := e.rangeEncoder.Done()
+	if err != nil {
+		return nil, errPacketBufferTooShort
+	}
+	e.finalRange = e.rangeEncoder.FinalRange()
+	return frame, nil
+}
+
+// encodeCELT encodes a CELT-only frame. CBR frames use all frameBytes
+// bytes.
+func (e *Encoder) encodeCELT(in []float32, frameBytes, bitrate int) ([]byte, error) {
+	if !e.vbr {
+		bitrate = 0
+	}
+	e.celtEncoder.SetBitrate(bitrate)
+	e.celtEncoder.SetVBRConstraint(e.vbrConstraint)
+
+	frame, err := e.celtEncoder.Encode(in, frameBytes)
+	if err != nil {
+		return nil, err
+	}
+	e.finalRange = e.celtEncoder.FinalRange()
+	return frame, nil
+}
+
+// resample returns the input of the SILK layer at silkSampleRate, held
+// back to line up with the CELT layer, and of the CELT layer at 48 kHz.
+// Both are resampled for every packet, so that either layer continues
+// from the last samples on a mode switch.
+func (e *Encoder) resample(in []float32, silkSampleRate int) (silkIn, celtIn []float32) {
+	if silkSampleRate != e.silkSampleRate {
+		for c := 0; c < e.channels; c++ {
+			e.silkResamplers[c] = resample.New(e.sampleRate, silkSampleRate)
+		}
+		e.silkSampleRate = silkSampleRate
+	}
+
+	delayed := append(append([]float32{}, e.silkDelay...), in...)
+	e.silkDelay = delayed[len(in):]
+
+	return e.resampleChannels(e.silkResamplers, delayed[:len(in)]), e.resampleChannels(e.celtResamplers, in)
+}
+
+// downmix returns the mean of the two channels of interleaved samples
+func downmix(in []float32) []float32 {
+	out := make([]float32, len(in)/2)
+	for i := range out {
+		out[i] = (in[2*i] + in[2*i+1]) / 2
+	}
+	return out
+}
+
+// resampleChannels resamples each channel of interleaved samples with
+// its resampler
+func (e *Encoder) resampleChannels(resamplers [2]*resample.Resampler, in []float32) []float32 {
+	if e.channels == 1 {
+		return resamplers[0].Process(in)
+	}
+
+	var out []float32
+	for c := 0; c < e.channels; c++ {
+		channel := make([]float32, len(in)/e.channels)
+		for i := range channel {
+			channel[i] = in[i*e.channels+c]
+		}
+
+		resampled := resamplers[c].Process(channel)
+		if out == nil {
+			out = make([]float32, len(resampled)*e.channels)
+		}
+		for i, sample := range resampled {
+			out[i*e.channels+c] = sample
+		}
+	}
+	return out
+}
+
+// voiceEstimate returns how likely the input is voice, from 0 to 127,
+// like the voice_est of opus_encode_native() (opus_encoder.c)
+func (e *Encoder) voiceEstimate() int {
+	switch {
+	case e.signal == SignalVoice:
+		return maxVoiceEstimate
+	case e.signal == SignalMusic:
+		return 0
+	case e.application == ApplicationVoIP:
+		return voipVoiceEstimate
+	default:
+		return audioVoiceEstimate
+	}
+}
+
+// equivalentBitrate returns the bitrate the mode and bandwidth are chosen
+// by, lowered for the overhead of short frames, CBR, lower complexities
+// and the loss the encoder plans for, like compute_equiv_rate()
+// (opus_encoder.c) before the mode is known
+func (e *Encoder) equivalentBitrate() int {
+	bitrate := e.bitrate
+	if framesPerSecond := int(time.Second / e.frameDuration); framesPerSecond > 50 {
+		bitrate -= (40*e.channels + 20) * (framesPerSecond - 50)
+	}
+	if !e.vbr {
+		bitrate -= bitrate / 12
+	}
+	bitrate = bitrate * (90 + e.complexity) / 100
+	return bitrate - bitrate*e.packetLossPercentage/(12*e.packetLossPercentage+20)
+}
+
+// chooseMode picks the mode, bandwidth and channels of the next packet,
+// like opus_encode_native() (opus_encoder.c). Voice is coded with the
+// SILK layer up to a bitrate that grows with how likely the input is
+// voice, and music in CELT-only mode, with hysteresis. Packets of
+// packetSize bytes too small for the SILK layer are CELT-only. SILK-only packets
+// wider than WB are hybrid, and hybrid ones up to WB SILK-only. Stereo
+// input below the stereo threshold is coded as mono SILK-only packets.
+func (e *Encoder) chooseMode(packetSize int) (Mode, Bandwidth, bool) {
+	voiceEstimate := e.voiceEstimate()
+	bitrate := e.equivalentBitrate()
+
+	minSILKBitrate := silkMinBitrate
+	if e.frameDuration < 20*time.Millisecond {
+		minSILKBitrate = silkShortFrameMinBitrate
+	}
+
+	mode := ModeCELTOnly
+	if e.application != ApplicationRestrictedLowDelay && e.frameDuration >= 10*time.Millisecond &&
+		8*packetSize*int(time.Second/e.frameDuration) >= minSILKBitrate {
+		threshold := interpolateVoice(musicModeThreshold, voiceModeThresholds[e.channels-1], voiceEstimate)
+		if e.application == ApplicationVoIP {
+			threshold += voipModeBias
+		}
+		switch e.mode {
+		case ModeCELTOnly:
+			threshold -= modeHysteresis
+		case ModeSilkOnly, ModeHybrid:
+			threshold += modeHysteresis
+		}
+
+		// FEC needs the SILK layer
+		fecThreshold := (maxVoiceEstimate + 1 - voiceEstimate) >> 4
+		if bitrate < threshold || e.inbandFEC && e.packetLossPercentage > fecThreshold {
+			mode = ModeSilkOnly
+		}
+	}
+
+	isStereo := e.channels == 2
+	if isStereo && mode != ModeCELTOnly {
+		threshold := interpolateVoice(stereoMusicThreshold, stereoVoiceThreshold, voiceEstimate)
+		if e.isStereo {
+			threshold -= stereoHysteresis
+		} else {
+			threshold += stereoHysteresis
+		}
+		isStereo = bitrate > threshold
+	}
+
+	bandwidth := e.chooseBandwidth(bitrate, voiceEstimate)
+	switch {
+	case mode == ModeSilkOnly && bandwidth > BandwidthWideband && isStereo != (e.channels == 2):
+		// The CELT layer of hybrid packets codes every channel
+		bandwidth = BandwidthWideband
+	case mode == ModeSilkOnly && bandwidth > BandwidthWideband:
+		mode = ModeHybrid
+	case mode == ModeCELTOnly && bandwidth == BandwidthMediumband:
+		// CELT has no MB
+		bandwidth = BandwidthWideband
+	}
+	return mode, bandwidth, isStereo
+}
+
+// chooseBandwidth picks the widest bandwidth whose threshold the bitrate
+// reaches, with hysteresis, and that the maximum bandwidth and the input
+// sample rate allow
+func (e *Encoder) chooseBandwidth(bitrate, voiceEstimate int) Bandwidth {
+	bandwidth := BandwidthFullband
+	for ; bandwidth > BandwidthNarrowband; bandwidth-- {
+		voice := voiceBandwidthThresholds[bandwidth-BandwidthMediumband]
+		music := musicBandwidthThresholds[bandwidth-BandwidthMediumband]
+		threshold := interpolateVoice(music[0], voice[0], voiceEstimate)
+		hysteresis := interpolateVoice(music[1], voice[1], voiceEstimate)
+		if e.bandwidth != 0 {
+			if e.bandwidth >= bandwidth {
+				threshold -= hysteresis
+			} else {
+				threshold += hysteresis
+			}
+		}
+		if bitrate >= threshold {
+			break
+		}
+	}
+
+	if e.maxBandwidth < bandwidth {
+		bandwidth = e.maxBandwidth
+	}
+	for bandwidth.SampleRate() > e.sampleRate {
+		bandwidth--
+	}
+	return bandwidth
+}
+
+// interpolateVoice weighs a threshold for music and one for voice by the
+// square of the voice estimate
+func interpolateVoice(music, voice, voiceEstimate int) int {
+	return music + (voiceEstimate*voiceEstimate*(voice-music))>>14
+}
+
+// hybridSILKBitrate returns the bitrate of the SILK layer of a hybrid
+// frame, like compute_silk_rate_for_hybrid() (opus_encoder.c)
+func hybridSILKBitrate(bitrate, channels int, bandwidth Bandwidth, is20ms, vbr, fec bool) int {
+	entry := 1
+	if is20ms {
+		entry++
+	}
+	if fec {
+		entry += 2
+	}
+
+	rate := bitrate / channels
+	var silkBitrate int
+	i := 1
+	for ; i < len(hybridSILKBitrates) && hybridSILKBitrates[i][0] <= rate; i++ {
+	}
+	if i == len(hybridSILKBitrates) {
+		last := hybridSILKBitrates[i-1]
+		silkBitrate = last[entry] + (rate-last[0])/2
+	} else {
+		low, high := hybridSILKBitrates[i-1], hybridSILKBitrates[i]
+		silkBitrate = (low[entry]*(high[0]-rate) + high[entry]*(rate-low[0])) / (high[0] - low[0])
+	}
+
+	// CBR and SWB need a little more, and stereo a little less
+	if !vbr {
+		silkBitrate += 100
+	}
+	if bandwidth == BandwidthSuperwideband {
+		silkBitrate += 300
+	}
+	silkBitrate *= channels
+	if channels == 2 && rate >= 12000 {
+		silkBitrate -= 1000
+	}
+	return silkBitrate
+}
+
+// frameConfiguration returns the configuration of the TOC byte of frames
+// of a mode, bandwidth and duration. SILK-only configurations come in
+// fours of 10, 20, 40 and 60 ms for NB, MB and WB, hybrid ones in twos of
+// 10 and 20 ms for SWB and FB, and CELT-only ones in fours of 2.5, 5, 10
+// and 20 ms for NB, WB, SWB and FB.
+//
+// https://datatracker.ietf.org/doc/html/rfc6716#section-3.1
+func frameConfiguration(mode Mode, bandwidth Bandwidth, duration time.Duration) Configuration {
+	switch mode {
+	case ModeSilkOnly:
+		return Configuration(4*int(bandwidth-BandwidthNarrowband) + durationIndex(duration, 10*time.Millisecond))
+	case ModeHybrid:
+		return Configuration(12 + 2*int(bandwidth-BandwidthSuperwideband) + durationIndex(duration, 10*time.Millisecond))
+	default:
+		index := int(bandwidth - BandwidthNarrowband)
+		if bandwidth > BandwidthMediumband {
+			index--
+		}
+		return Configuration(16 + 4*index + durationIndex(duration, 2500*time.Microsecond))
+	}
+}
+
+// durationIndex returns the index of a frame duration among those of a
+// mode, which double from the shortest but for 60 ms
+func durationIndex(duration, shortest time.Duration) int {
+	index := 0
+	for ; shortest < duration; shortest *= 2 {
+		index++
+	}
+	return index
+}
+
+// isDigitalSilence returns whether no sample is louder than the lowest
+// bit of 24-bit audio, like is_digital_silence() (opus_encoder.c)
+func isDigitalSilence(in []float32) bool {
+	for _, sample := range in {
+		if sample > digitalSilence || sample < -digitalSilence {
+			return false
+		}
+	}
+	return true
+}
+
+// discontinue returns whether DTX should replace the last packet encoded
+// with TOC bytes, from whether it was active
+func (e *Encoder) discontinue(active bool) bool {
+	if active {
+		e.inactiveFrames, e.dtxFrames = 0, 0
+		return false
+	}
+
+	if e.inactiveFrames++; e.inactiveFrames <= dtxInactiveFrames {
+		return false
+	}
+
+	if e.dtxFrames++; e.dtxFrames >= dtxMaxFrames {
+		e.dtxFrames = 0
+		return false
+	}
+	return true
+}
+
+// cbrPacketSize returns the size of a packet at the bitrate, limited by
+// the size of the output buffer
+func (e *Encoder) cbrPacketSize(maxSize int) int {
+	size := e.bitrate * int(e.frameDuration/time.Microsecond) / 8000000
+	if size > maxSize {
+		size = maxSize
+	}
+	return size
+}
@@ -0,0 +1,449 @@
+package opus
+
+import (
+	"errors"
+	"math"
+	"math/rand"
+	"testing"
+	"time"
+)
+
+// sine returns count 20 ms frames of interleaved samples of a tone
+func sine(frequency float64, sampleRate, channels, count int) []float32 {
+	samples := make([]float32, sampleRate/50*channels*count)
+	for i := range samples {
+		samples[i] = float32(0.5 * math.Sin(2*math.Pi*frequency*float64(i/channels)/float64(sampleRate)))
+	}
+	return samples
+}
+
+// encodeFrames encodes samples frameSize at a time and decodes every
+// packet, checking that the decoder ends in the encoder's range state. It
+// returns the packets and the decoded samples at 48 kHz.
+func encodeFrames(t *testing.T, encoder *Encoder, samples []float32, frameSize int) ([][]byte, []float32) {
+	t.Helper()
+
+	decoder, err := NewDecoderWithChannels(encoder.channels)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var packets [][]byte
+	var decoded []float32
+	for i := 0; i+frameSize <= len(samples); i += frameSize {
+		out := make([]byte, 1500)
+		size, err := encoder.EncodeFloat32(samples[i:i+frameSize], out)
+		if err != nil {
+			t.Fatal(err)
+		}
+		packet := out[:size]
+		packets = append(packets, packet)
+
+		frame := make([]float32, 2880*encoder.channels)
+		n, err := decoder.DecodeFloat32(packet, frame)
+		if err != nil {
+			t.Fatal(err)
+		}
+		decoded = append(decoded, frame[:n*encoder.channels]...)
+
+		// Packets of a TOC byte, or with a frame of a byte, are concealed
+		if len(packet) > 2 && decoder.FinalRange() != encoder.FinalRange() {
+			t.Fatalf("packet %d: final range %08x, expected %08x", len(packets)-1, decoder.FinalRange(), encoder.FinalRange())
+		}
+	}
+	return packets, decoded
+}
+
+// newTestEncoder creates an Encoder at 48 kHz with the bitrate, maximum
+// bandwidth and frame duration of a test
+func newTestEncoder(t *testing.T, channels int, application Application, bitrate int, maxBandwidth Bandwidth, duration time.Duration) *Encoder {
+	t.Helper()
+
+	encoder, err := NewEncoder(48000, channels, application)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = encoder.SetBitrate(bitrate); err != nil {
+		t.Fatal(err)
+	}
+	if err = encoder.SetMaxBandwidth(maxBandwidth); err != nil {
+		t.Fatal(err)
+	}
+	if err = encoder.SetFrameDuration(duration); err != nil {
+		t.Fatal(err)
+	}
+	return encoder
+}
+
+func TestEncoder_RoundTrip(t *testing.T) {
+	for _, test := range []struct {
+		name         string
+		channels     int
+		application  Application
+		bitrate      int
+		maxBandwidth Bandwidth
+		mode         Mode
+		bandwidth    Bandwidth
+		minSNR       float64
+	}{
+		{"SILK", 1, ApplicationVoIP, 20000, BandwidthWideband, ModeSilkOnly, BandwidthWideband, 45},
+		{"SILK stereo", 2, ApplicationVoIP, 24000, BandwidthWideband, ModeSilkOnly, BandwidthWideband, 45},
+		{"Hybrid", 1, ApplicationVoIP, 32000, BandwidthFullband, ModeHybrid, BandwidthFullband, 45},
+		{"Hybrid stereo", 2, ApplicationVoIP, 40000, BandwidthFullband, ModeHybrid, BandwidthFullband, 45},
+		{"CELT", 1, ApplicationAudio, 64000, BandwidthFullband, ModeCELTOnly, BandwidthFullband, 25},
+		{"CELT stereo", 2, ApplicationAudio, 96000, BandwidthFullband, ModeCELTOnly, BandwidthFullband, 25},
+		{"restricted low delay", 1, ApplicationRestrictedLowDelay, 32000, BandwidthFullband, ModeCELTOnly, BandwidthFullband, 20},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			encoder := newTestEncoder(t, test.channels, test.application, test.bitrate, test.maxBandwidth, 20*time.Millisecond)
+
+			in := sine(440, 48000, test.channels, 15)
+			packets, out := encodeFrames(t, encoder, in, 960*test.channels)
+			for i, packet := range packets {
+				info, err := ParsePacketInfo(packet)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if info.Mode != test.mode || info.Bandwidth != test.bandwidth || info.IsStereo != (test.channels == 2) {
+					t.Fatalf("packet %d: %s at %s, stereo %t", i, info.Mode, info.Bandwidth, info.IsStereo)
+				}
+			}
+
+			if snr := delayedSNR(in, out, test.channels); snr < test.minSNR {
+				t.Fatalf("SNR %.1f dB, expected at least %.1f dB", snr, test.minSNR)
+			}
+		})
+	}
+}
+
+func TestEncoder_SampleRates(t *testing.T) {
+	for _, test := range []struct {
+		sampleRate int
+		channels   int
+		bandwidth  Bandwidth
+	}{
+		{48000, 2, BandwidthWideband},
+		{48000, 1, BandwidthWideband},
+		{24000, 1, BandwidthWideband},
+		{16000, 2, BandwidthWideband},
+		{12000, 1, BandwidthMediumband},
+		{8000, 1, BandwidthNarrowband},
+	} {
+		encoder, err := NewEncoder(test.sampleRate, test.channels, ApplicationVoIP)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err = encoder.SetBitrate(24000); err != nil {
+			t.Fatal(err)
+		}
+		if err = encoder.SetMaxBandwidth(BandwidthWideband); err != nil {
+			t.Fatal(err)
+		}
+
+		frameSize := test.sampleRate / 50 * test.channels
+		packets, _ := encodeFrames(t, encoder, sine(440, test.sampleRate, test.channels, 10), frameSize)
+		for _, packet := range packets {
+			info, err := ParsePacketInfo(packet)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			expected := PacketInfo{4*Configuration(test.bandwidth-1) + 1, ModeSilkOnly, test.bandwidth, test.channels == 2, 20 * time.Millisecond, 1}
+			if info != expected {
+				t.Fatalf("%d Hz, %d channels: expected %+v, got %+v", test.sampleRate, test.channels, expected, info)
+			}
+		}
+	}
+}
+
+func TestEncoder_FrameDuration(t *testing.T) {
+	for _, test := range []struct {
+		name         string
+		application  Application
+		bitrates     [2]int
+		maxBandwidth Bandwidth
+		mode         Mode
+	}{
+		{"SILK", ApplicationVoIP, [2]int{20000, 24000}, BandwidthWideband, ModeSilkOnly},
+		{"Hybrid", ApplicationVoIP, [2]int{32000, 40000}, BandwidthFullband, ModeHybrid},
+		{"CELT", ApplicationAudio, [2]int{64000, 96000}, BandwidthFullband, ModeCELTOnly},
+	} {
+		for _, channels := range []int{1, 2} {
+			for _, duration := range []time.Duration{
+				2500 * time.Microsecond, 5 * time.Millisecond, 10 * time.Millisecond,
+				20 * time.Millisecond, 40 * time.Millisecond, 60 * time.Millisecond,
+			} {
+				encoder := newTestEncoder(t, channels, test.application, test.bitrates[channels-1], test.maxBandwidth, duration)
+
+				// SILK and Hybrid frames are at least 10 ms, and Hybrid and
+				// CELT frames at most 20 ms
+				mode, frameDuration, frameCount := test.mode, duration, 1
+				switch {
+				case duration < 10*time.Millisecond:
+					mode = ModeCELTOnly
+				case duration > 20*time.Millisecond && mode != ModeSilkOnly:
+					frameDuration, frameCount = 20*time.Millisecond, int(duration/(20*time.Millisecond))
+				}
+
+				in := sine(440, 48000, channels, 15)
+				frameSize := int(duration/(time.Second/48000)) * channels
+				packets, out := encodeFrames(t, encoder, in, frameSize)
+				for i, packet := range packets {
+					info, err := ParsePacketInfo(packet)
+					if err != nil {
+						t.Fatal(err)
+					}
+					if info.Mode != mode || info.FrameDuration != frameDuration || info.FrameCount != frameCount {
+						t.Fatalf("%s, %d channels, %s: packet %d is %s with %d frames of %s", test.name, channels, duration, i, info.Mode, info.FrameCount, info.FrameDuration)
+					}
+				}
+
+				// Frames under 10 ms of these bitrates are only a few bytes
+				if duration >= 10*time.Millisecond {
+					if snr := delayedSNR(in, out, channels); snr < 20 {
+						t.Fatalf("%s, %d channels, %s: SNR %.1f dB", test.name, channels, duration, snr)
+					}
+				}
+			}
+		}
+	}
+}
+
+func TestEncoder_Bandwidth(t *testing.T) {
+	for _, test := range []struct {
+		bitrate      int
+		maxBandwidth Bandwidth
+		bandwidth    Bandwidth
+	}{
+		{32000, BandwidthFullband, BandwidthFullband},
+		{8000, BandwidthFullband, BandwidthNarrowband},
+
+		// CELT has no mediumband, so it codes wideband
+		{32000, BandwidthMediumband, BandwidthWideband},
+		{8000, BandwidthMediumband, BandwidthNarrowband},
+	} {
+		encoder, err := NewEncoder(48000, 1, ApplicationAudio)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err = encoder.SetBitrate(test.bitrate); err != nil {
+			t.Fatal(err)
+		}
+		if err = encoder.SetMaxBandwidth(test.maxBandwidth); err != nil {
+			t.Fatal(err)
+		}
+
+		packets, _ := encodeFrames(t, encoder, sine(440, 48000, 1, 2), 960)
+		if bandwidth := tableOfContentsHeader(packets[1][0]).configuration().bandwidth(); bandwidth != test.bandwidth {
+			t.Fatalf("%d bps up to %s: expected %s, got %s", test.bitrate, test.maxBandwidth, test.bandwidth, bandwidth)
+		}
+	}
+}
+
+func TestEncoder_CBR(t *testing.T) {
+	for _, test := range []struct {
+		name         string
+		application  Application
+		bitrate      int
+		maxBandwidth Bandwidth
+	}{
+		{"SILK", ApplicationVoIP, 24000, BandwidthWideband},
+		{"Hybrid", ApplicationVoIP, 32000, BandwidthFullband},
+		{"CELT", ApplicationAudio, 64000, BandwidthFullband},
+	} {
+		for _, duration := range []time.Duration{10 * time.Millisecond, 20 * time.Millisecond, 60 * time.Millisecond} {
+			encoder := newTestEncoder(t, 1, test.application, test.bitrate, test.maxBandwidth, duration)
+			encoder.SetVBR(false)
+
+			size := test.bitrate / 8 * int(duration/time.Millisecond) / 1000
+			packets, _ := encodeFrames(t, encoder, sine(440, 48000, 1, 6), int(duration/(time.Second/48000)))
+			for i, packet := range packets {
+				if len(packet) != size {
+					t.Fatalf("%s, %s: packet %d is %d bytes, expected %d", test.name, duration, i, len(packet), size)
+				}
+			}
+		}
+	}
+}
+
+func TestEncoder_VBRConstraint(t *testing.T) {
+	// A tone, then noise that takes more bits
+	in := sine(440, 48000, 1, 25)
+	random := rand.New(rand.NewSource(1))
+	for i := 960 * 10; i < len(in); i++ {
+		in[i] = float32(0.2 * random.NormFloat64())
+	}
+
+	var noiseBytes [2]int
+	for i, constrained := range []bool{true, false} {
+		encoder := newTestEncoder(t, 1, ApplicationAudio, 64000, BandwidthFullband, 20*time.Millisecond)
+		encoder.SetVBRConstraint(constrained)
+
+		packets, _ := encodeFrames(t, encoder, in, 960)
+		for _, packet := range packets[15:] {
+			noiseBytes[i] += len(packet)
+		}
+	}
+
+	// The constrained bitrate settles on the target, 160 bytes per packet
+	if target := 160 * 10; noiseBytes[0] > target*21/20 || noiseBytes[1] <= noiseBytes[0] {
+		t.Fatalf("noise took %d bytes constrained and %d bytes unconstrained, expected about %d constrained", noiseBytes[0], noiseBytes[1], target)
+	}
+}
+
+func TestEncoder_Complexity(t *testing.T) {
+	for _, test := range []struct {
+		name         string
+		application  Application
+		bitrate      int
+		maxBandwidth Bandwidth
+		minSNR       float64
+	}{
+		{"SILK", ApplicationVoIP, 20000, BandwidthWideband, 45},
+		{"Hybrid", ApplicationVoIP, 32000, BandwidthFullband, 45},
+		{"CELT", ApplicationAudio, 64000, BandwidthFullband, 25},
+	} {
+		for complexity := 0; complexity <= maxComplexity; complexity += 5 {
+			encoder := newTestEncoder(t, 1, test.application, test.bitrate, test.maxBandwidth, 20*time.Millisecond)
+			if err := encoder.SetComplexity(complexity); err != nil {
+				t.Fatal(err)
+			}
+
+			in := sine(440, 48000, 1, 15)
+			_, out := encodeFrames(t, encoder, in, 960)
+			if snr := delayedSNR(in, out, 1); snr < test.minSNR {
+				t.Fatalf("%s at complexity %d: SNR %.1f dB, expected at least %.1f dB", test.name, complexity, snr, test.minSNR)
+			}
+		}
+	}
+}
+
+func TestEncoder_FEC(t *testing.T) {
+	for _, test := range []struct {
+		name         string
+		bitrate      int
+		maxBandwidth Bandwidth
+		loss         int
+		fec          bool
+	}{
+		{"SILK", 24000, BandwidthWideband, 20, true},
+		{"Hybrid", 32000, BandwidthFullband, 20, true},
+		{"no loss", 24000, BandwidthWideband, 0, true},
+		{"no FEC", 24000, BandwidthWideband, 20, false},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			encoder := newTestEncoder(t, 1, ApplicationVoIP, test.bitrate, test.maxBandwidth, 20*time.Millisecond)
+			encoder.SetInbandFEC(test.fec)
+			if err := encoder.SetPacketLossPercentage(test.loss); err != nil {
+				t.Fatal(err)
+			}
+
+			packets, _ := encodeFrames(t, encoder, sine(440, 48000, 1, 6), 960)
+
+			// LBRR is only coded with in-band FEC and expected loss, and
+			// the first packet has no frame before it
+			expectLBRR := test.fec && test.loss > 0
+			for i, packet := range packets[1:] {
+				hasLBRR, err := PacketHasLBRR(packet)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if hasLBRR != expectLBRR {
+					t.Fatalf("packet %d: LBRR %t, expected %t", i+1, hasLBRR, expectLBRR)
+				}
+			}
+
+			// The packet before the last is lost and recovered from it
+			decoder, err := NewDecoderWithChannels(1)
+			if err != nil {
+				t.Fatal(err)
+			}
+			out := make([]float32, 960)
+			for _, packet := range packets[:len(packets)-2] {
+				if _, err := decoder.DecodeFloat32(packet, out); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if _, err := decoder.DecodeFEC(packets[len(packets)-1], out, 960); err != nil {
+				t.Fatal(err)
+			}
+			if decoder.Concealed() == expectLBRR {
+				t.Fatalf("concealed %t, expected %t", decoder.Concealed(), !expectLBRR)
+			}
+		})
+	}
+}
+
+func TestEncoder_DTX(t *testing.T) {
+	encoder, err := NewEncoder(16000, 1, ApplicationVoIP)
+	if err != nil {
+		t.Fatal(err)
+	}
+	encoder.SetDTX(true)
+
+	// Voice activity, then silence: the first dtxInactiveFrames silent
+	// frames are sent, then TOC bytes with a full frame every dtxMaxFrames.
+	// The input of the SILK layer is delayed, so the first frame of silence
+	// still ends the tone.
+	samples := append(sine(440, 16000, 1, 2), make([]float32, 320*40)...)
+	packets, _ := encodeFrames(t, encoder, samples, 320)
+	for i, packet := range packets {
+		silent := i - 3
+		expectTOC := silent >= dtxInactiveFrames && (silent-dtxInactiveFrames+1)%dtxMaxFrames != 0
+		if (len(packet) == 1) != expectTOC {
+			t.Fatalf("packet %d is %d bytes", i, len(packet))
+		}
+	}
+}
+
+func TestEncoder_Errors(t *testing.T) {
+	for _, test := range []struct {
+		name        string
+		sampleRate  int
+		channels    int
+		application Application
+		expected    error
+	}{
+		{"sample rate", 44100, 1, ApplicationVoIP, errInvalidSampleRate},
+		{"channels", 48000, 3, ApplicationVoIP, errInvalidEncoderChannelCount},
+		{"application", 48000, 1, 0, errInvalidApplication},
+		{"restricted low delay", 48000, 1, ApplicationRestrictedLowDelay, nil},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			if _, err := NewEncoder(test.sampleRate, test.channels, test.application); !errors.Is(err, test.expected) {
+				t.Fatalf("expected %v, got %v", test.expected, err)
+			}
+		})
+	}
+
+	encoder, err := NewEncoder(48000, 2, ApplicationAudio)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, test := range []struct {
+		name     string
+		err      error
+		expected error
+	}{
+		{"bitrate", encoder.SetBitrate(100), errInvalidBitrate},
+		{"complexity", encoder.SetComplexity(11), errInvalidComplexity},
+		{"bandwidth", encoder.SetMaxBandwidth(0), errInvalidBandwidth},
+		{"signal", encoder.SetSignal(SignalMusic + 1), errInvalidSignal},
+		{"packet loss", encoder.SetPacketLossPercentage(101), errInvalidPacketLossPercentage},
+		{"frame duration", encoder.SetFrameDuration(30 * time.Millisecond), errInvalidFrameDuration},
+		{"10 ms frame duration", encoder.SetFrameDuration(10 * time.Millisecond), nil},
+	} {
+		if !errors.Is(test.err, test.expected) {
+			t.Fatalf("%s: expected %v, got %v", test.name, test.expected, test.err)
+		}
+	}
+
+	// The frame duration is 10 ms, of 480 samples per channel
+	if _, err := encoder.EncodeFloat32(make([]float32, 1920), make([]byte, 1500)); !errors.Is(err, errInvalidFrameSampleCount) {
+		t.Fatalf("expected %v, got %v", errInvalidFrameSampleCount, err)
+	}
+	if _, err := encoder.EncodeFloat32(make([]float32, 960), nil); !errors.Is(err, errPacketBufferTooShort) {
+		t.Fatalf("expected %v, got %v", errPacketBufferTooShort, err)
+	}
+}
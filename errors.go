@@ -3,12 +3,42 @@ package opus
 import "errors"
 
 var (
+	// ErrCorruptedPacket is returned when a packet is truncated or corrupted,
+	// for example when decoding a frame needs more bits than the frame contains.
+	// The packet should be discarded. The encoder strips the trailing zero
+	// bytes of SILK-only frames, which are decoded as if the missing bytes
+	// were zeros, so like in libopus a truncated SILK-only frame isn't
+	// detected.
+	ErrCorruptedPacket = errors.New("packet is truncated or corrupted")
+
 	errTooShortForTableOfContentsHeader = errors.New("Packet is too short to contain table of contents header")
 
-	errUnsupportedFrameCode                   = errors.New("unsupported frame code")
-	errTooShortForArbitraryLengthFrames       = errors.New("packet is too short to contain arbitrary length frames")
-	errArbitraryLengthFrameVBRUnsupported     = errors.New("arbitrary length frames with VBR is unsupported")
-	errArbitraryLengthFramePaddingUnsupported = errors.New("arbitrary length frames with padding is unsupported")
+	errTooShortForArbitraryLengthFrames = errors.New("packet is too short to contain arbitrary length frames")
+
+	errInvalidDecoderChannelCount = errors.New("decoder channel count must be 1 or 2")
+	errInvalidConcealmentDuration = errors.New("concealed duration must be a positive multiple of 2.5ms")
+	errConcealmentUnsupported     = errors.New("stream decoder can't conceal lost packets")
+
+	errInvalidFrameCount = errors.New("packet frame count must be between 1 and 48")
+	errPacketTooLong     = errors.New("packet duration exceeds 120ms")
+
+	errMalformedSelfDelimitedPacket = errors.New("self-delimited packet is truncated or malformed")
+
+	errInvalidChannelCount   = errors.New("channel count must be between 1 and 255")
+	errInvalidStreamCount    = errors.New("invalid number of streams and coupled streams")
+	errInvalidChannelMapping = errors.New("channel mapping must have an entry per channel, each below the decoded channel count or 255")
+	errOutputBufferTooShort  = errors.New("output buffer is too short for the decoded samples")
+	errInvalidDemixingMatrix = errors.New("demixing matrix must have a row per channel and a column per decoded channel")
 
-	errUnsupportedConfigurationMode = errors.New("unsupported configuration mode")
+	errInvalidSampleRate           = errors.New("sample rate must be 8000, 12000, 16000, 24000 or 48000")
+	errInvalidEncoderChannelCount  = errors.New("encoder channel count must be 1 or 2")
+	errInvalidApplication          = errors.New("invalid application")
+	errInvalidBitrate              = errors.New("bitrate must be between 500 and 512000 bits per second")
+	errInvalidComplexity           = errors.New("complexity must be between 0 and 10")
+	errInvalidBandwidth            = errors.New("invalid bandwidth")
+	errInvalidSignal               = errors.New("invalid signal")
+	errInvalidPacketLossPercentage = errors.New("packet loss percentage must be between 0 and 100")
+	errInvalidFrameDuration        = errors.New("frame duration must be 2.5, 5, 10, 20, 40 or 60 ms")
+	errInvalidFrameSampleCount     = errors.New("sample count does not match the frame duration and channels")
+	errPacketBufferTooShort        = errors.New("packet buffer is too short for the encoded frame")
 )
@@ -1,7 +1,6 @@
 package main
 
 import (
-	"bytes"
 	"errors"
 	"fmt"
 	"io"
@@ -29,19 +28,22 @@ func main() {
 		panic(err)
 	}
 
+	tags, err := ogg.ReadTags()
+	if err != nil {
+		panic(err)
+	}
+
+	fmt.Printf("vendor(%s) userComments(%v)\n", tags.Vendor, tags.UserComments)
+
 	for {
-		pageData, _, err := ogg.ParseNextPage()
+		packet, _, err := ogg.ReadPacket()
 		if errors.Is(err, io.EOF) {
 			break
-		} else if bytes.HasPrefix(pageData, []byte("OpusTags")) {
-			continue
-		}
-
-		if err != nil {
+		} else if err != nil {
 			panic(err)
 		}
 
-		bandwidth, isStereo, frames, err := decoder.Decode(pageData)
+		bandwidth, isStereo, frames, err := decoder.Decode(packet)
 		if err != nil {
 			panic(err)
 		}
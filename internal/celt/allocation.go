@@ -0,0 +1,497 @@
+package celt
+
+import "github.com/pion/opus/internal/rangecoding"
+
+const (
+	// Allocations are counted in 1/8 bits
+	bitResolution = 3
+
+	// The allocation interpolates between two quality levels in 1/64 steps
+	allocationSteps = 6
+
+	// The fine energy of a band takes this share of its bits, in 1/8 bits
+	// per MDCT bin below its log2 width
+	fineOffset  = 21
+	maxFineBits = 8
+
+	// bitsToPulses bisects the pulse cache with this many steps
+	logMaxPseudo = 6
+)
+
+// log2FractionTable is the cost in 1/8 bits of coding an intensity
+// stereo start band among up to 24 choices.
+var log2FractionTable = [25]int{
+	0,
+	8, 13,
+	16, 19, 21, 23,
+	24, 26, 27, 28, 29, 30, 31, 32,
+	32, 33, 34, 34, 35, 36, 36, 37, 37,
+}
+
+// allocationCoder codes the decisions the allocation makes along the
+// way, which the encoder writes and the decoder reads back.
+type allocationCoder interface {
+	codeBit(bit bool, logp uint) bool
+	codeUniform(value, total uint32) uint32
+}
+
+type allocationEncoder struct{ *rangecoding.Encoder }
+
+func (e allocationEncoder) codeBit(bit bool, logp uint) bool {
+	symbol := uint32(0)
+	if bit {
+		symbol = 1
+	}
+	e.EncodeSymbolLogP(logp, symbol)
+	return bit
+}
+
+func (e allocationEncoder) codeUniform(value, total uint32) uint32 {
+	e.EncodeUniform(value, total)
+	return value
+}
+
+type allocationDecoder struct{ *rangecoding.Decoder }
+
+func (d allocationDecoder) codeBit(_ bool, logp uint) bool {
+	return d.DecodeSymbolLogP(logp) == 1
+}
+
+func (d allocationDecoder) codeUniform(_, total uint32) uint32 {
+	return d.DecodeUniform(total)
+}
+
+// allocationParameters are the inputs of computeAllocation. Offsets,
+// caps and the total are in 1/8 bits.
+type allocationParameters struct {
+	start, end   int
+	channels, lm int
+	offsets      [bandCount]int
+	caps         [bandCount]int
+	trim         int
+	total        int
+
+	// What the encoder would like to code, ignored by the decoder
+	intensity          int
+	dualStereo         bool
+	previousCodedBands int
+	signalBandwidth    int
+}
+
+// allocation is how the bits of a frame are spread over its bands.
+// Pulses, the bits of the band shapes, and balance are in 1/8 bits.
+type allocation struct {
+	codedBands   int
+	intensity    int
+	dualStereo   bool
+	balance      int
+	pulses       [bandCount]int
+	fineBits     [bandCount]int
+	finePriority [bandCount]int
+}
+
+// getPulses returns the number of pulses of a pseudo pulse count. Past 8,
+// the counts grow exponentially with 8 steps per octave.
+func getPulses(i int) int {
+	if i < 8 {
+		return i
+	}
+	return (8 + (i & 7)) << ((i >> 3) - 1)
+}
+
+// bitsToPulses returns the pseudo pulse count whose cost, in 1/8 bits, is
+// closest to bits for a band, like bits2pulses() (rate.h).
+func bitsToPulses(band, lm, bits int) int {
+	cache := cacheBits[cacheIndex[(lm+1)*bandCount+band]:]
+
+	low, high := 0, cache[0]
+	bits--
+	for i := 0; i < logMaxPseudo; i++ {
+		mid := (low + high + 1) >> 1
+		if cache[mid] >= bits {
+			high = mid
+		} else {
+			low = mid
+		}
+	}
+
+	lowBits := -1
+	if low != 0 {
+		lowBits = cache[low]
+	}
+	if bits-lowBits <= cache[high]-bits {
+		return low
+	}
+	return high
+}
+
+// pulsesToBits returns the cost in 1/8 bits of a pseudo pulse count for a
+// band, like pulses2bits() (rate.h).
+func pulsesToBits(band, lm, pulses int) int {
+	if pulses == 0 {
+		return 0
+	}
+	return cacheBits[cacheIndex[(lm+1)*bandCount+band]+pulses] + 1
+}
+
+// initCaps returns the most bits each band can use, in 1/8 bits, like
+// init_caps() (celt.c).
+func initCaps(lm, channels int) [bandCount]int {
+	var caps [bandCount]int
+	for i := range caps {
+		n := (bandEdges[i+1] - bandEdges[i]) << lm
+		caps[i] = (cacheCaps[bandCount*(2*lm+channels-1)+i] + 64) * channels * n >> 2
+	}
+	return caps
+}
+
+// computeAllocation splits the bits of a frame between the fine energy
+// and the shapes of the bands, like compute_allocation() (rate.c). It
+// finds the two quality levels of the static allocation table that
+// bracket the budget, tilted by the trim and boosted by the dynamic
+// offsets, and interpolates between them. The bands at the top that
+// can't be given enough bits are skipped, which the encoder decides and
+// codes along with the intensity and dual stereo parameters.
+//
+// https://datatracker.ietf.org/doc/html/rfc6716#section-4.3.3
+func computeAllocation(coder allocationCoder, p *allocationParameters) *allocation {
+	start, end, channels, lm := p.start, p.end, p.channels, p.lm
+
+	total := p.total
+	if total < 0 {
+		total = 0
+	}
+
+	skipReserved := 0
+	if total >= 1<<bitResolution {
+		skipReserved = 1 << bitResolution
+	}
+	total -= skipReserved
+
+	intensityReserved, dualStereoReserved := 0, 0
+	if channels == 2 {
+		intensityReserved = log2FractionTable[end-start]
+		if intensityReserved > total {
+			intensityReserved = 0
+		} else {
+			total -= intensityReserved
+			if total >= 1<<bitResolution {
+				dualStereoReserved = 1 << bitResolution
+			}
+			total -= dualStereoReserved
+		}
+	}
+
+	var bits1, bits2, thresholds, trimOffsets [bandCount]int
+	for j := start; j < end; j++ {
+		width := bandEdges[j+1] - bandEdges[j]
+
+		// Bands below the threshold are only given the bits of their fine
+		// energy
+		thresholds[j] = imax(channels<<bitResolution, (3*width<<lm<<bitResolution)>>4)
+
+		// The trim tilts the allocation towards low or high bands
+		trimOffsets[j] = channels * width * (p.trim - 5 - lm) * (end - j - 1) * (1 << (lm + bitResolution)) >> 6
+		if width<<lm == 1 {
+			trimOffsets[j] -= channels << bitResolution
+		}
+	}
+
+	bandBits := func(level, j int) int {
+		bits := channels * (bandEdges[j+1] - bandEdges[j]) * bandAllocation[level][j] << lm >> 2
+		if bits > 0 {
+			bits = imax(0, bits+trimOffsets[j])
+		}
+		return bits
+	}
+
+	// Find the highest quality level that fits
+	low, high := 1, len(bandAllocation)-1
+	for low <= high {
+		mid := (low + high) >> 1
+		sum, done := 0, false
+		for j := end - 1; j >= start; j-- {
+			bits := bandBits(mid, j) + p.offsets[j]
+			if bits >= thresholds[j] || done {
+				done = true
+				sum += imin(bits, p.caps[j])
+			} else if bits >= channels<<bitResolution {
+				sum += channels << bitResolution
+			}
+		}
+
+		if sum > total {
+			high = mid - 1
+		} else {
+			low = mid + 1
+		}
+	}
+	high = low
+	low = high - 1
+
+	skipStart := start
+	for j := start; j < end; j++ {
+		bits1[j] = bandBits(low, j)
+		bits2[j] = p.caps[j]
+		if high < len(bandAllocation) {
+			bits2[j] = bandBits(high, j)
+		}
+		if low > 0 {
+			bits1[j] += p.offsets[j]
+		}
+		bits2[j] += p.offsets[j]
+		if p.offsets[j] > 0 {
+			skipStart = j
+		}
+		bits2[j] = imax(0, bits2[j]-bits1[j])
+	}
+
+	return interpolateAllocation(coder, p, skipStart, &bits1, &bits2, &thresholds, total, skipReserved, intensityReserved, dualStereoReserved)
+}
+
+// interpolateAllocation is interp_bits2pulses() (rate.c).
+func interpolateAllocation(
+	coder allocationCoder,
+	p *allocationParameters,
+	skipStart int,
+	bits1, bits2, thresholds *[bandCount]int,
+	total, skipReserved, intensityReserved, dualStereoReserved int,
+) *allocation {
+	start, end, channels, lm := p.start, p.end, p.channels, p.lm
+	a := &allocation{}
+	bits := &a.pulses
+
+	allocationFloor := channels << bitResolution
+	stereo := 0
+	if channels > 1 {
+		stereo = 1
+	}
+
+	// Bisect the 1/64 steps between the two quality levels
+	low, high := 0, 1<<allocationSteps
+	for i := 0; i < allocationSteps; i++ {
+		mid := (low + high) >> 1
+		sum, done := 0, false
+		for j := end - 1; j >= start; j-- {
+			tmp := bits1[j] + (mid * bits2[j] >> allocationSteps)
+			if tmp >= thresholds[j] || done {
+				done = true
+				sum += imin(tmp, p.caps[j])
+			} else if tmp >= allocationFloor {
+				sum += allocationFloor
+			}
+		}
+
+		if sum > total {
+			high = mid
+		} else {
+			low = mid
+		}
+	}
+
+	sum, done := 0, false
+	for j := end - 1; j >= start; j-- {
+		tmp := bits1[j] + (low * bits2[j] >> allocationSteps)
+		if tmp < thresholds[j] && !done {
+			if tmp >= allocationFloor {
+				tmp = allocationFloor
+			} else {
+				tmp = 0
+			}
+		} else {
+			done = true
+		}
+		tmp = imin(tmp, p.caps[j])
+		bits[j] = tmp
+		sum += tmp
+	}
+
+	// Skip bands from the top while the bits they'd be left with are
+	// better spent elsewhere
+	codedBands := end
+	for {
+		j := codedBands - 1
+		if j <= skipStart {
+			// The skip flag wasn't coded
+			total += skipReserved
+			break
+		}
+
+		left := total - sum
+		perCoefficient := left / (bandEdges[codedBands] - bandEdges[start])
+		left -= (bandEdges[codedBands] - bandEdges[start]) * perCoefficient
+		remainder := imax(left-(bandEdges[j]-bandEdges[start]), 0)
+		bandWidth := bandEdges[codedBands] - bandEdges[j]
+		bandBits := bits[j] + perCoefficient*bandWidth + remainder
+
+		if bandBits >= imax(thresholds[j], allocationFloor+(1<<bitResolution)) {
+			// The encoder keeps bands with enough bits per bin, with some
+			// hysteresis around the number of bands of the previous frame
+			depthThreshold := 9
+			if j < p.previousCodedBands {
+				depthThreshold = 7
+			}
+			keep := codedBands <= start+2 ||
+				(bandBits > (depthThreshold*bandWidth<<lm<<bitResolution)>>4 && j <= p.signalBandwidth)
+			if coder.codeBit(keep, 1) {
+				break
+			}
+
+			// The band is skipped, and its skip flag counted
+			sum += 1 << bitResolution
+			bandBits -= 1 << bitResolution
+		}
+
+		// The intensity reservation shrinks with the number of bands
+		sum -= bits[j] + intensityReserved
+		if intensityReserved > 0 {
+			intensityReserved = log2FractionTable[j-start]
+		}
+		sum += intensityReserved
+
+		// A skipped band keeps the bits of its fine energy if it can
+		if bandBits >= allocationFloor {
+			sum += allocationFloor
+			bits[j] = allocationFloor
+		} else {
+			bits[j] = 0
+		}
+		codedBands--
+	}
+
+	if intensityReserved > 0 {
+		intensity := imax(imin(p.intensity, codedBands), start)
+		a.intensity = start + int(coder.codeUniform(uint32(intensity-start), uint32(codedBands+1-start)))
+	}
+
+	if a.intensity <= start {
+		total += dualStereoReserved
+		dualStereoReserved = 0
+	}
+	if dualStereoReserved > 0 {
+		a.dualStereo = coder.codeBit(p.dualStereo, 1)
+	}
+
+	// Spread what is left evenly over the coded bins
+	left := total - sum
+	perCoefficient := left / (bandEdges[codedBands] - bandEdges[start])
+	left -= (bandEdges[codedBands] - bandEdges[start]) * perCoefficient
+	for j := start; j < codedBands; j++ {
+		bits[j] += perCoefficient * (bandEdges[j+1] - bandEdges[j])
+	}
+	for j := start; j < codedBands; j++ {
+		tmp := imin(left, bandEdges[j+1]-bandEdges[j])
+		bits[j] += tmp
+		left -= tmp
+	}
+
+	// Split the bits of each band between its fine energy and its shape
+	balance := 0
+	j := start
+	for ; j < codedBands; j++ {
+		n0 := bandEdges[j+1] - bandEdges[j]
+		n := n0 << lm
+		bit := bits[j] + balance
+
+		var excess int
+		if n > 1 {
+			excess = imax(bit-p.caps[j], 0)
+			bits[j] = bit - excess
+
+			// Intensity and dual stereo bands don't code the angle between
+			// the channels
+			den := channels * n
+			if channels == 2 && n > 2 && !a.dualStereo && j < a.intensity {
+				den++
+			}
+
+			nClogN := den * (logN400[j] + (lm << bitResolution))
+
+			// Offset for the number of fine bits by log2(N)/2 + fineOffset
+			// compared to their 1/8 bits
+			offset := (nClogN >> 1) - den*fineOffset
+
+			// N=2 is the only point that doesn't match the curve
+			if n == 2 {
+				offset += den << bitResolution >> 2
+			}
+
+			// Changing the offset for allocating the second and third fine
+			// energy bit
+			if bits[j]+offset < den*2<<bitResolution {
+				offset += nClogN >> 2
+			} else if bits[j]+offset < den*3<<bitResolution {
+				offset += nClogN >> 3
+			}
+
+			// Divide with rounding
+			a.fineBits[j] = imax(0, bits[j]+offset+(den<<(bitResolution-1)))
+			a.fineBits[j] = a.fineBits[j] / den >> bitResolution
+
+			// Make sure not to bust
+			if channels*a.fineBits[j] > bits[j]>>bitResolution {
+				a.fineBits[j] = bits[j] >> stereo >> bitResolution
+			}
+			a.fineBits[j] = imin(a.fineBits[j], maxFineBits)
+
+			// If we rounded down or capped this band, make it a candidate
+			// for the final fine energy pass
+			a.finePriority[j] = 0
+			if a.fineBits[j]*(den<<bitResolution) >= bits[j]+offset {
+				a.finePriority[j] = 1
+			}
+
+			// Remove the allocated fine bits, the rest go to PVQ
+			bits[j] -= channels * a.fineBits[j] << bitResolution
+		} else {
+			// For N=1, all bits go to fine energy except for a single sign
+			// bit
+			excess = imax(0, bit-(channels<<bitResolution))
+			bits[j] = bit - excess
+			a.fineBits[j] = 0
+			a.finePriority[j] = 1
+		}
+
+		// Bits beyond the cap go to fine energy, and the rest is carried
+		// to the next band
+		if excess > 0 {
+			extraFine := imin(excess>>(stereo+bitResolution), maxFineBits-a.fineBits[j])
+			a.fineBits[j] += extraFine
+			extraBits := extraFine * channels << bitResolution
+			a.finePriority[j] = 0
+			if extraBits >= excess-balance {
+				a.finePriority[j] = 1
+			}
+			excess -= extraBits
+		}
+		balance = excess
+	}
+	a.balance = balance
+
+	// Skipped bands use all their bits for fine energy
+	for ; j < end; j++ {
+		a.fineBits[j] = bits[j] >> stereo >> bitResolution
+		bits[j] = 0
+		a.finePriority[j] = 0
+		if a.fineBits[j] < 1 {
+			a.finePriority[j] = 1
+		}
+	}
+
+	a.codedBands = codedBands
+	return a
+}
+
+func imin(a, b int) int {
+	if a < b {
+		return a
+	}
+	return b
+}
+
+func imax(a, b int) int {
+	if a > b {
+		return a
+	}
+	return b
+}
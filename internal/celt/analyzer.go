@@ -0,0 +1,96 @@
+package celt
+
+import "math"
+
+// Analyzer maintains the state needed to analyze a stream of CELT frames
+type Analyzer struct {
+	channels int
+
+	// The last input sample of each channel, for the pre-emphasis, and
+	// the last overlap pre-emphasized samples, that the window of the
+	// next frame starts with
+	preemphasisMemory []float64
+	history           [][]float64
+}
+
+// Analysis is what the encoder derives from a frame before quantization
+type Analysis struct {
+	// LM is the base 2 logarithm of the number of short blocks in the frame
+	LM int
+
+	// ShortBlocks is set when the frame is transient and its MDCT is
+	// split into 2^LM short blocks. TFEstimate, from 0 to 1, is the
+	// strength of the transient.
+	ShortBlocks bool
+	TFEstimate  float64
+
+	// BandEnergies is the base 2 logarithm of the amplitude of each band,
+	// and Shapes the MDCT coefficients of each band divided by that
+	// amplitude, for each channel
+	BandEnergies [][]float64
+	Shapes       [][]float64
+}
+
+// NewAnalyzer creates a new CELT analyzer for one or two channels
+func NewAnalyzer(channels int) (*Analyzer, error) {
+	if channels != 1 && channels != 2 {
+		return nil, errInvalidChannelCount
+	}
+
+	a := &Analyzer{
+		channels:          channels,
+		preemphasisMemory: make([]float64, channels),
+		history:           make([][]float64, channels),
+	}
+	for c := range a.history {
+		a.history[c] = make([]float64, overlap)
+	}
+	return a, nil
+}
+
+// Analyze pre-emphasizes a frame of 2.5, 5, 10 or 20 ms of interleaved
+// samples at 48 kHz in the range [-1, 1], detects whether it is
+// transient, and computes the band energies and shapes of its MDCT.
+func (a *Analyzer) Analyze(in []float32) (*Analysis, error) {
+	frameSize := len(in) / a.channels
+	lm, err := frameSizeLM(frameSize)
+	if err != nil || frameSize*a.channels != len(in) {
+		return nil, errInvalidFrameSize
+	}
+
+	// The reference encoder works with samples in 16-bit range
+	windows := make([][]float64, a.channels)
+	for c := range windows {
+		windows[c] = append(make([]float64, 0, overlap+frameSize), a.history[c]...)
+		for i := 0; i < frameSize; i++ {
+			sample := float64(in[i*a.channels+c]) * 32768
+			windows[c] = append(windows[c], sample-preemphasisCoefficient*a.preemphasisMemory[c])
+			a.preemphasisMemory[c] = sample
+		}
+		copy(a.history[c], windows[c][frameSize:])
+	}
+
+	analysis := &Analysis{
+		LM:           lm,
+		BandEnergies: make([][]float64, a.channels),
+		Shapes:       make([][]float64, a.channels),
+	}
+
+	// A single short block can't be split
+	if lm > 0 {
+		analysis.ShortBlocks, analysis.TFEstimate = detectTransient(windows)
+	}
+
+	for c, samples := range windows {
+		coefficients := computeMDCT(samples, frameSize, analysis.ShortBlocks)
+		amplitudes := computeBandEnergies(coefficients, lm)
+		analysis.Shapes[c] = normalizeBands(coefficients, amplitudes, lm)
+
+		analysis.BandEnergies[c] = make([]float64, bandCount)
+		for band, amplitude := range amplitudes {
+			analysis.BandEnergies[c][band] = math.Log2(amplitude)
+		}
+	}
+
+	return analysis, nil
+}
@@ -0,0 +1,117 @@
+package celt
+
+import (
+	"errors"
+	"math"
+	"math/rand"
+	"testing"
+)
+
+func TestAnalyzer_Transient(t *testing.T) {
+	random := rand.New(rand.NewSource(1)) //nolint:gosec
+	const frameSize = 960
+
+	for _, test := range []struct {
+		name      string
+		sample    func(i int) float64
+		transient bool
+	}{
+		{"sine", func(i int) float64 { return 0.5 * math.Sin(2*math.Pi*440*float64(i)/sampleRate) }, false},
+		{"noise", func(int) float64 { return 0.1 * random.NormFloat64() }, false},
+		{"click", func(i int) float64 {
+			if i >= 2*frameSize+500 && i < 2*frameSize+520 {
+				return 0.9
+			}
+			return 0.001 * random.NormFloat64()
+		}, true},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			analyzer, err := NewAnalyzer(1)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			var analysis *Analysis
+			for frame := 0; frame < 3; frame++ {
+				in := make([]float32, frameSize)
+				for i := range in {
+					in[i] = float32(test.sample(frame*frameSize + i))
+				}
+				if analysis, err = analyzer.Analyze(in); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			if analysis.ShortBlocks != test.transient {
+				t.Fatalf("short blocks %t, expected %t", analysis.ShortBlocks, test.transient)
+			}
+			if test.transient && analysis.TFEstimate == 0 {
+				t.Fatal("transient without a time-frequency estimate")
+			}
+		})
+	}
+}
+
+func TestAnalyzer_Bands(t *testing.T) {
+	// The bins of a 20 ms frame are 25 Hz wide, so a 950 Hz sine is loudest
+	// in the band that holds bin 38
+	analyzer, err := NewAnalyzer(2)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	const frameSize = 960
+	var analysis *Analysis
+	for frame := 0; frame < 2; frame++ {
+		in := make([]float32, 2*frameSize)
+		for i := 0; i < frameSize; i++ {
+			in[2*i] = float32(0.5 * math.Sin(2*math.Pi*950*float64(frame*frameSize+i)/sampleRate))
+		}
+		if analysis, err = analyzer.Analyze(in); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	loudest := 0
+	for band, energy := range analysis.BandEnergies[0] {
+		if energy > analysis.BandEnergies[0][loudest] {
+			loudest = band
+		}
+	}
+	if bandEdges[loudest]<<3 > 38 || bandEdges[loudest+1]<<3 <= 38 {
+		t.Fatalf("loudest band %d doesn't hold bin 38", loudest)
+	}
+
+	for band := 0; band < bandCount; band++ {
+		norm := 0.0
+		for _, coefficient := range analysis.Shapes[0][bandEdges[band]<<3 : bandEdges[band+1]<<3] {
+			norm += coefficient * coefficient
+		}
+		if math.Abs(norm-1) > 1e-9 {
+			t.Fatalf("band %d has norm %f", band, norm)
+		}
+
+		// The silent right channel normalizes to zero
+		for _, coefficient := range analysis.Shapes[1][bandEdges[band]<<3 : bandEdges[band+1]<<3] {
+			if coefficient != 0 {
+				t.Fatalf("silent band %d has coefficient %f", band, coefficient)
+			}
+		}
+	}
+}
+
+func TestAnalyzer_Errors(t *testing.T) {
+	if _, err := NewAnalyzer(3); !errors.Is(err, errInvalidChannelCount) {
+		t.Fatalf("expected %v, got %v", errInvalidChannelCount, err)
+	}
+
+	analyzer, err := NewAnalyzer(2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, samples := range []int{0, 482, 961, 3840} {
+		if _, err := analyzer.Analyze(make([]float32, samples)); !errors.Is(err, errInvalidFrameSize) {
+			t.Fatalf("%d samples: expected %v, got %v", samples, errInvalidFrameSize, err)
+		}
+	}
+}
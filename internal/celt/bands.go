@@ -0,0 +1,1114 @@
+package celt
+
+import (
+	"math"
+	"math/bits"
+
+	"github.com/pion/opus/internal/rangecoding"
+)
+
+// Added to band energies so that silent bands normalize to zero
+const bandEnergyEpsilon = 1e-27
+
+// computeBandEnergies returns the amplitude, the square root of the
+// energy, of each band of the MDCT coefficients of a frame of 2^LM short
+// blocks, like compute_band_energies() (bands.c).
+//
+// https://datatracker.ietf.org/doc/html/rfc6716#section-4.3.2
+func computeBandEnergies(coefficients []float64, lm int) []float64 {
+	amplitudes := make([]float64, bandCount)
+	for band := range amplitudes {
+		sum := bandEnergyEpsilon
+		for _, coefficient := range coefficients[bandEdges[band]<<lm : bandEdges[band+1]<<lm] {
+			sum += coefficient * coefficient
+		}
+		amplitudes[band] = math.Sqrt(sum)
+	}
+	return amplitudes
+}
+
+// normalizeBands divides the coefficients of each band by its amplitude,
+// leaving the unit norm shapes that PVQ codes. Bins above the last band
+// are zero.
+//
+// https://datatracker.ietf.org/doc/html/rfc6716#section-4.3.4
+func normalizeBands(coefficients, amplitudes []float64, lm int) []float64 {
+	normalized := make([]float64, len(coefficients))
+	for band, amplitude := range amplitudes {
+		gain := 1 / (bandEnergyEpsilon + amplitude)
+		for i := bandEdges[band] << lm; i < bandEdges[band+1]<<lm; i++ {
+			normalized[i] = coefficients[i] * gain
+		}
+	}
+	return normalized
+}
+
+const (
+	// The resolution of the split angle is reduced by these offsets, in
+	// 1/8 bits, from half the bits of a pulse
+	thetaOffset         = 4
+	thetaOffsetTwoPhase = 16
+)
+
+var exp2Table8 = [8]int{16384, 17866, 19483, 21247, 23170, 25267, 27554, 30048}
+
+// bitInterleaveTable and bitDeinterleaveTable map the collapse masks of
+// a band between time and frequency resolutions.
+var (
+	bitInterleaveTable   = [16]int{0, 1, 1, 1, 2, 3, 3, 3, 2, 3, 3, 3, 2, 3, 3, 3}
+	bitDeinterleaveTable = [16]int{
+		0x00, 0x03, 0x0C, 0x0F, 0x30, 0x33, 0x3C, 0x3F,
+		0xC0, 0xC3, 0xCC, 0xCF, 0xF0, 0xF3, 0xFC, 0xFF,
+	}
+)
+
+// bandContext is the state shared by the quantization of all the bands
+// of a frame, like struct band_ctx (bands.c). Exactly one of encoder and
+// decoder is set. Only the decoder resynthesizes the bands it codes.
+type bandContext struct {
+	encoder *rangecoding.Encoder
+	decoder *rangecoding.Decoder
+
+	band            int
+	intensity       int
+	spread          int
+	tfChange        int
+	remainingBits   int
+	amplitudes      *[2][bandCount]float64
+	seed            uint32
+	avoidSplitNoise bool
+
+	err error
+}
+
+func (ctx *bandContext) tellFrac() int {
+	if ctx.encoder != nil {
+		return int(ctx.encoder.TellFrac())
+	}
+	return int(ctx.decoder.TellFrac())
+}
+
+func (ctx *bandContext) codeRawBit(bit int) int {
+	if ctx.encoder != nil {
+		ctx.encoder.EncodeRawBits(uint32(bit), 1)
+		return bit
+	}
+	return int(ctx.decoder.DecodeRawBits(1))
+}
+
+// split is the angle of a split of a band, like struct split_ctx
+// (bands.c). mid and side are its cosine and sine in Q15, and delta the
+// share of bits the side gets over the mid in 1/8 bits.
+type split struct {
+	inverted   bool
+	mid, side  int
+	delta      int
+	theta      int
+	allocation int
+}
+
+// lcgRandom is the linear congruential generator CELT fills bands with
+// noise with, like celt_lcg_rand() (bands.c).
+func lcgRandom(seed uint32) uint32 {
+	return 1664525*seed + 1013904223
+}
+
+func fracMul16(a, b int) int {
+	return (16384 + int(int32(int16(a))*int32(int16(b)))) >> 15
+}
+
+// bitexactCos returns 32768*cos(pi/2*x/16384) with integer arithmetic,
+// so that the encoder and decoder split bits identically, like
+// bitexact_cos() (bands.c).
+func bitexactCos(x int) int {
+	x2 := (4096 + x*x) >> 13
+	x2 = (32767 - x2) + fracMul16(x2, -7651+fracMul16(x2, 8277+fracMul16(-626, x2)))
+	return 1 + x2
+}
+
+// bitexactLog2Tan returns 2048*log2(sin/cos) with integer arithmetic,
+// like bitexact_log2tan() (bands.c).
+func bitexactLog2Tan(sin, cos int) int {
+	lc := bits.Len32(uint32(cos))
+	ls := bits.Len32(uint32(sin))
+	cos <<= 15 - lc
+	sin <<= 15 - ls
+	return (ls-lc)*(1<<11) +
+		fracMul16(sin, fracMul16(sin, -2597)+7932) -
+		fracMul16(cos, fracMul16(cos, -2597)+7932)
+}
+
+// isqrt returns the integer square root of x.
+func isqrt(x int) int {
+	root := 0
+	shift := (bits.Len32(uint32(x)) - 1) >> 1
+	for b := 1 << shift; shift >= 0; b, shift = b>>1, shift-1 {
+		if t := ((root << 1) + b) << shift; t <= x {
+			root += b
+			x -= t
+		}
+	}
+	return root
+}
+
+// hysteresisDecision returns the index of the first threshold above
+// value, staying at previous unless value moved past its hysteresis, like
+// hysteresis_decision() (bands.c).
+func hysteresisDecision(value float64, thresholds, hysteresis []float64, previous int) int {
+	i := 0
+	for i < len(thresholds) && value >= thresholds[i] {
+		i++
+	}
+
+	if i > previous && value < thresholds[previous]+hysteresis[previous] {
+		i = previous
+	}
+	if i < previous && value > thresholds[previous-1]-hysteresis[previous-1] {
+		i = previous
+	}
+	return i
+}
+
+// denormaliseBands scales the normalized shapes of each band by its
+// energy, like denormalise_bands() (bands.c). Bins outside of [start,
+// end) are zero.
+//
+// https://datatracker.ietf.org/doc/html/rfc6716#section-4.3.6
+func denormaliseBands(shapes []float64, energies *[bandCount]float64, start, end, lm int) []float64 {
+	frequencies := make([]float64, shortBlockSize<<lm)
+	for i := start; i < end; i++ {
+		gain := math.Exp2(math.Min(32, energies[i]+eMeans[i]))
+		for j := bandEdges[i] << lm; j < bandEdges[i+1]<<lm; j++ {
+			frequencies[j] = shapes[j] * gain
+		}
+	}
+	return frequencies
+}
+
+// antiCollapse fills the blocks of transient bands that received no
+// pulses with noise at the energy they had in the previous frames, so
+// that they don't collapse to silence, like anti_collapse() (bands.c).
+//
+// https://datatracker.ietf.org/doc/html/rfc6716#section-4.3.5
+func antiCollapse(
+	shapes [][]float64,
+	collapseMasks []int,
+	lm, channels, start, end int,
+	energies, previousEnergies, previousEnergies2 *[2][bandCount]float64,
+	pulses *[bandCount]int,
+	seed uint32,
+) {
+	for i := start; i < end; i++ {
+		n0 := bandEdges[i+1] - bandEdges[i]
+
+		// The depth in 1/8 bits
+		depth := (1 + pulses[i]) / n0 >> lm
+		threshold := 0.5 * math.Exp2(-0.125*float64(depth))
+		sqrt1 := 1 / math.Sqrt(float64(n0<<lm))
+
+		for c := 0; c < channels; c++ {
+			previous1, previous2 := previousEnergies[c][i], previousEnergies2[c][i]
+			if channels == 1 {
+				previous1 = math.Max(previous1, previousEnergies[1][i])
+				previous2 = math.Max(previous2, previousEnergies2[1][i])
+			}
+			energyDifference := math.Max(0, energies[c][i]-math.Min(previous1, previous2))
+
+			// r needs to be multiplied by 2 or 2*sqrt(2) depending on LM
+			// because short blocks don't have the same energy as long
+			r := 2 * math.Exp2(-energyDifference)
+			if lm == 3 {
+				r *= math.Sqrt2
+			}
+			r = math.Min(threshold, r) * sqrt1
+
+			x := shapes[c][bandEdges[i]<<lm : bandEdges[i+1]<<lm]
+			renormalize := false
+			for k := 0; k < 1<<lm; k++ {
+				if collapseMasks[i*channels+c]&(1<<k) != 0 {
+					continue
+				}
+
+				// Fill with noise
+				for j := 0; j < n0; j++ {
+					seed = lcgRandom(seed)
+					if seed&0x8000 != 0 {
+						x[(j<<lm)+k] = r
+					} else {
+						x[(j<<lm)+k] = -r
+					}
+				}
+				renormalize = true
+			}
+
+			// We just added some energy, so we need to renormalise
+			if renormalize {
+				renormaliseVector(x, 1)
+			}
+		}
+	}
+}
+
+// intensityStereo replaces the left channel of a band with the mix of
+// both channels that matches their energies, like intensity_stereo()
+// (bands.c).
+func intensityStereo(x, y []float64, left, right float64) {
+	norm := transientEpsilon + math.Sqrt(transientEpsilon+left*left+right*right)
+	a1, a2 := left/norm, right/norm
+	for j := range x {
+		x[j] = a1*x[j] + a2*y[j]
+	}
+}
+
+// stereoSplit turns left and right into mid and side, like
+// stereo_split() (bands.c).
+func stereoSplit(x, y []float64) {
+	for j := range x {
+		l, r := math.Sqrt2/2*x[j], math.Sqrt2/2*y[j]
+		x[j], y[j] = l+r, r-l
+	}
+}
+
+// stereoMerge turns the unit norm mid and side of a band, weighted by
+// mid, back into left and right with unit norm, like stereo_merge()
+// (bands.c).
+func stereoMerge(x, y []float64, mid float64) {
+	// Compute the norm of X+Y and X-Y as |X|^2 + |Y|^2 +/- sum(xy)
+	var xp, side float64
+	for j := range x {
+		xp += y[j] * x[j]
+		side += y[j] * y[j]
+	}
+
+	// Compensating for the mid normalization
+	xp *= mid
+	el := mid*mid + side - 2*xp
+	er := mid*mid + side + 2*xp
+	if er < 6e-4 || el < 6e-4 {
+		copy(y, x)
+		return
+	}
+
+	leftGain, rightGain := 1/math.Sqrt(el), 1/math.Sqrt(er)
+	for j := range x {
+		// Apply mid scaling (side is already scaled)
+		l, r := mid*x[j], y[j]
+		x[j], y[j] = leftGain*(l-r), rightGain*(l+r)
+	}
+}
+
+// deinterleaveHadamard reorders the bins of a band with stride blocks
+// from frequency order to time order, like deinterleave_hadamard()
+// (bands.c). With hadamard set, the blocks are in the order a Hadamard
+// transform leaves them in.
+func deinterleaveHadamard(x []float64, n0, stride int, hadamard bool) {
+	tmp := make([]float64, n0*stride)
+	for i := 0; i < stride; i++ {
+		block := i
+		if hadamard {
+			block = orderyTable[stride-2+i]
+		}
+		for j := 0; j < n0; j++ {
+			tmp[block*n0+j] = x[j*stride+i]
+		}
+	}
+	copy(x, tmp)
+}
+
+// interleaveHadamard is the inverse of deinterleaveHadamard.
+func interleaveHadamard(x []float64, n0, stride int, hadamard bool) {
+	tmp := make([]float64, n0*stride)
+	for i := 0; i < stride; i++ {
+		block := i
+		if hadamard {
+			block = orderyTable[stride-2+i]
+		}
+		for j := 0; j < n0; j++ {
+			tmp[j*stride+i] = x[block*n0+j]
+		}
+	}
+	copy(x, tmp)
+}
+
+// haar1 applies a Haar wavelet step to each pair of neighbouring blocks
+// of stride interleaved blocks, like haar1() (bands.c).
+func haar1(x []float64, n0, stride int) {
+	n0 >>= 1
+	for i := 0; i < stride; i++ {
+		for j := 0; j < n0; j++ {
+			index := i + stride*2*j
+			tmp1 := math.Sqrt2 / 2 * x[index]
+			tmp2 := math.Sqrt2 / 2 * x[index+stride]
+			x[index], x[index+stride] = tmp1+tmp2, tmp1-tmp2
+		}
+	}
+}
+
+// computeQN returns the number of steps the split angle of a band with
+// b bits is quantized to, like compute_qn() (bands.c).
+func computeQN(n, b, offset, pulseCap int, stereo bool) int {
+	n2 := 2*n - 1
+	if stereo && n == 2 {
+		n2--
+	}
+
+	// The upper limit ensures that in a stereo split with itheta==16384,
+	// we'll always have enough bits left over to code at least one pulse
+	// in the side; otherwise it would collapse, since it doesn't get
+	// folded.
+	qb := (b + n2*offset) / n2
+	qb = imin(b-pulseCap-(4<<bitResolution), qb)
+	qb = imin(8<<bitResolution, qb)
+
+	if qb < (1<<bitResolution)>>1 {
+		return 1
+	}
+	qn := exp2Table8[qb&0x7] >> (14 - (qb >> bitResolution))
+	return (qn + 1) >> 1 << 1
+}
+
+// computeTheta codes the angle that splits the bits of a band between
+// two halves, either the mid and side of a stereo band or two halves of
+// a band with too many bits for one codebook, like compute_theta()
+// (bands.c). It updates the bits b and the fill mask.
+//
+// https://datatracker.ietf.org/doc/html/rfc6716#section-4.3.4.4
+func (ctx *bandContext) computeTheta(x, y []float64, b *int, blocks, blocks0, lm int, stereo bool, fill *int) split {
+	n := len(x)
+	i := ctx.band
+
+	// Decide on the resolution to give to the split parameter theta
+	pulseCap := logN400[i] + lm*(1<<bitResolution)
+	offset := pulseCap >> 1
+	if stereo && n == 2 {
+		offset -= thetaOffsetTwoPhase
+	} else {
+		offset -= thetaOffset
+	}
+	qn := computeQN(n, *b, offset, pulseCap, stereo)
+	if stereo && i >= ctx.intensity {
+		qn = 1
+	}
+
+	theta := 0
+	if ctx.encoder != nil {
+		// theta is the atan() of the ratio between the (normalized) side
+		// and mid. With just that parameter, we can re-scale both mid and
+		// side because we know that 1) they have unit norm and 2) they
+		// are orthogonal.
+		theta = stereoTheta(x, y, stereo)
+	}
+
+	s := split{}
+	tell := ctx.tellFrac()
+	switch {
+	case qn != 1:
+		if ctx.encoder != nil {
+			theta = (theta*qn + 8192) >> 14
+
+			// Check if the selected value of theta will cause the bit
+			// allocation to inject noise on one side. If so, make sure the
+			// energy of that side is zero.
+			if !stereo && ctx.avoidSplitNoise && theta > 0 && theta < qn {
+				unquantized := theta * 16384 / qn
+				mid := bitexactCos(unquantized)
+				side := bitexactCos(16384 - unquantized)
+				delta := fracMul16((n-1)<<7, bitexactLog2Tan(side, mid))
+				if delta > *b {
+					theta = qn
+				} else if delta < -*b {
+					theta = 0
+				}
+			}
+		}
+
+		// Entropy coding of the angle. We use a uniform pdf for the time
+		// split, a step for stereo, and a triangular one for the rest.
+		switch {
+		case stereo && n > 2:
+			theta = ctx.codeStepTheta(theta, qn)
+		case blocks0 > 1 || stereo:
+			if ctx.encoder != nil {
+				ctx.encoder.EncodeUniform(uint32(theta), uint32(qn+1))
+			} else {
+				theta = int(ctx.decoder.DecodeUniform(uint32(qn + 1)))
+			}
+		default:
+			theta = ctx.codeTriangularTheta(theta, qn)
+		}
+		theta = theta * 16384 / qn
+
+		if ctx.encoder != nil && stereo {
+			if theta == 0 {
+				intensityStereo(x, y, ctx.amplitudes[0][i], ctx.amplitudes[1][i])
+			} else {
+				stereoSplit(x, y)
+			}
+		}
+	case stereo:
+		// Intensity stereo codes the phase inversion of the right channel
+		if ctx.encoder != nil {
+			s.inverted = theta > 8192
+			if s.inverted {
+				for j := range y {
+					y[j] = -y[j]
+				}
+			}
+			intensityStereo(x, y, ctx.amplitudes[0][i], ctx.amplitudes[1][i])
+		}
+
+		if *b > 2<<bitResolution && ctx.remainingBits > 2<<bitResolution {
+			if ctx.encoder != nil {
+				inverted := uint32(0)
+				if s.inverted {
+					inverted = 1
+				}
+				ctx.encoder.EncodeSymbolLogP(2, inverted)
+			} else {
+				s.inverted = ctx.decoder.DecodeSymbolLogP(2) == 1
+			}
+		} else {
+			s.inverted = false
+		}
+		theta = 0
+	}
+	s.allocation = ctx.tellFrac() - tell
+	*b -= s.allocation
+
+	switch theta {
+	case 0:
+		s.mid, s.side = 32767, 0
+		*fill &= (1 << blocks) - 1
+		s.delta = -16384
+	case 16384:
+		s.mid, s.side = 0, 32767
+		*fill &= ((1 << blocks) - 1) << blocks
+		s.delta = 16384
+	default:
+		s.mid = bitexactCos(theta)
+		s.side = bitexactCos(16384 - theta)
+
+		// This is the mid vs side allocation that minimizes squared error
+		// in that band
+		s.delta = fracMul16((n-1)<<7, bitexactLog2Tan(s.side, s.mid))
+	}
+	s.theta = theta
+	return s
+}
+
+// codeStepTheta codes a stereo angle with a probability of 3 up to
+// qn/2, and 1 after.
+func (ctx *bandContext) codeStepTheta(theta, qn int) int {
+	const p0 = 3
+	x0 := qn / 2
+	total := uint32(p0*(x0+1) + x0)
+
+	if ctx.decoder != nil {
+		fs := int(ctx.decoder.Decode(total))
+		if fs < (x0+1)*p0 {
+			theta = fs / p0
+		} else {
+			theta = x0 + 1 + (fs - (x0+1)*p0)
+		}
+	}
+
+	low, high := p0*theta, p0*(theta+1)
+	if theta > x0 {
+		low, high = (theta-1-x0)+(x0+1)*p0, (theta-x0)+(x0+1)*p0
+	}
+
+	if ctx.encoder != nil {
+		ctx.encoder.Encode(uint32(low), uint32(high), total)
+	} else {
+		ctx.decoder.Update(uint32(low), uint32(high), total)
+	}
+	return theta
+}
+
+// codeTriangularTheta codes the angle of a band split in frequency with
+// a triangular probability peaking at qn/2.
+func (ctx *bandContext) codeTriangularTheta(theta, qn int) int {
+	total := ((qn >> 1) + 1) * ((qn >> 1) + 1)
+
+	if ctx.decoder != nil {
+		fm := int(ctx.decoder.Decode(uint32(total)))
+		if fm < ((qn >> 1) * ((qn >> 1) + 1) >> 1) {
+			theta = (isqrt(8*fm+1) - 1) >> 1
+		} else {
+			theta = (2*(qn+1) - isqrt(8*(total-fm-1)+1)) >> 1
+		}
+	}
+
+	var low, size int
+	if theta <= qn>>1 {
+		size = theta + 1
+		low = theta * (theta + 1) >> 1
+	} else {
+		size = qn + 1 - theta
+		low = total - ((qn + 1 - theta) * (qn + 2 - theta) >> 1)
+	}
+
+	if ctx.encoder != nil {
+		ctx.encoder.Encode(uint32(low), uint32(low+size), uint32(total))
+	} else {
+		ctx.decoder.Update(uint32(low), uint32(low+size), uint32(total))
+	}
+	return theta
+}
+
+// quantizeBandN1 codes a band of a single bin, of one or two channels,
+// with just its sign, like quant_band_n1() (bands.c).
+func (ctx *bandContext) quantizeBandN1(x, y []float64, lowbandOut []float64) int {
+	for _, channel := range [][]float64{x, y} {
+		if channel == nil {
+			continue
+		}
+
+		sign := 0
+		if ctx.remainingBits >= 1<<bitResolution {
+			if channel[0] < 0 {
+				sign = 1
+			}
+			sign = ctx.codeRawBit(sign)
+			ctx.remainingBits -= 1 << bitResolution
+		}
+
+		if ctx.decoder != nil {
+			channel[0] = 1
+			if sign != 0 {
+				channel[0] = -1
+			}
+		}
+	}
+
+	if lowbandOut != nil {
+		lowbandOut[0] = x[0]
+	}
+	return 1
+}
+
+// quantizePartition codes the shape of a band, or recursively splits it
+// in two halves when it has more bits than a single codebook can use,
+// like quant_partition() (bands.c).
+//
+// https://datatracker.ietf.org/doc/html/rfc6716#section-4.3.4.4
+func (ctx *bandContext) quantizePartition(x []float64, b, blocks int, lowband []float64, lm int, gain float64, fill int) int {
+	n := len(x)
+	i := ctx.band
+	blocks0 := blocks
+
+	// If we need 1.5 more bits than we can produce, split the band in two
+	cache := cacheBits[cacheIndex[(lm+1)*bandCount+i]:]
+	if lm != -1 && b > cache[cache[0]]+12 && n > 2 {
+		n >>= 1
+		y := x[n:]
+		x = x[:n]
+		lm--
+		if blocks == 1 {
+			fill = (fill & 1) | (fill << 1)
+		}
+		blocks = (blocks + 1) >> 1
+
+		s := ctx.computeTheta(x, y, &b, blocks, blocks0, lm, false, &fill)
+		mid, side := float64(s.mid)/32768, float64(s.side)/32768
+		delta := s.delta
+
+		// Give more bits to low-energy MDCTs than they would otherwise
+		// deserve
+		if blocks0 > 1 && s.theta&0x3fff != 0 {
+			if s.theta > 8192 {
+				// Rough approximation for pre-echo masking
+				delta -= delta >> (4 - lm)
+			} else {
+				// Corresponds to a forward-masking slope of 1.5 dB per 10 ms
+				delta = imin(0, delta+(n<<bitResolution>>(5-lm)))
+			}
+		}
+		midBits := imax(0, imin(b, (b-delta)/2))
+		sideBits := b - midBits
+		ctx.remainingBits -= s.allocation
+
+		var nextLowband []float64
+		if lowband != nil {
+			nextLowband = lowband[n:]
+		}
+
+		// Code the half with more bits first, and give what it didn't use
+		// to the other
+		rebalance := ctx.remainingBits
+		if midBits >= sideBits {
+			cm := ctx.quantizePartition(x, midBits, blocks, lowband, lm, gain*mid, fill)
+			rebalance = midBits - (rebalance - ctx.remainingBits)
+			if rebalance > 3<<bitResolution && s.theta != 0 {
+				sideBits += rebalance - (3 << bitResolution)
+			}
+			return cm | ctx.quantizePartition(y, sideBits, blocks, nextLowband, lm, gain*side, fill>>blocks)<<(blocks0>>1)
+		}
+
+		cm := ctx.quantizePartition(y, sideBits, blocks, nextLowband, lm, gain*side, fill>>blocks) << (blocks0 >> 1)
+		rebalance = sideBits - (rebalance - ctx.remainingBits)
+		if rebalance > 3<<bitResolution && s.theta != 16384 {
+			midBits += rebalance - (3 << bitResolution)
+		}
+		return cm | ctx.quantizePartition(x, midBits, blocks, lowband, lm, gain*mid, fill)
+	}
+
+	// This is the basic no-split case
+	q := bitsToPulses(i, lm, b)
+	currentBits := pulsesToBits(i, lm, q)
+	ctx.remainingBits -= currentBits
+
+	// Ensures we can never bust the budget
+	for ctx.remainingBits < 0 && q > 0 {
+		ctx.remainingBits += currentBits
+		q--
+		currentBits = pulsesToBits(i, lm, q)
+		ctx.remainingBits -= currentBits
+	}
+
+	if q != 0 {
+		k := getPulses(q)
+
+		// Finally do the actual quantization
+		var cm int
+		var err error
+		if ctx.encoder != nil {
+			cm, err = algebraicQuantize(ctx.encoder, x, k, ctx.spread, blocks)
+		} else {
+			cm, err = algebraicUnquantize(ctx.decoder, x, k, ctx.spread, blocks, gain)
+		}
+		if err != nil && ctx.err == nil {
+			ctx.err = err
+		}
+		return cm
+	}
+
+	// If there's no pulse, fill the band anyway
+	if ctx.decoder == nil {
+		return 0
+	}
+
+	mask := (1 << blocks) - 1
+	fill &= mask
+	if fill == 0 {
+		for j := range x {
+			x[j] = 0
+		}
+		return 0
+	}
+
+	cm := fill
+	if lowband == nil {
+		// Noise
+		for j := range x {
+			ctx.seed = lcgRandom(ctx.seed)
+			x[j] = float64(int32(ctx.seed) >> 20)
+		}
+		cm = mask
+	} else {
+		// Folded spectrum, about 48 dB below the "normal" folding level
+		for j := range x {
+			ctx.seed = lcgRandom(ctx.seed)
+			tmp := 1.0 / 256
+			if ctx.seed&0x8000 == 0 {
+				tmp = -tmp
+			}
+			x[j] = lowband[j] + tmp
+		}
+	}
+	renormaliseVector(x, gain)
+	return cm
+}
+
+// quantizeBand codes a mono band, or one channel of a dual stereo band,
+// after adjusting its time-frequency resolution by tfChange, like
+// quant_band() (bands.c). The decoder leaves the band scaled by
+// sqrt(N) in lowbandOut, for the following bands to fold.
+func (ctx *bandContext) quantizeBand(x []float64, b, blocks int, lowband []float64, lm int, lowbandOut []float64, gain float64, lowbandScratch []float64, fill int) int {
+	n := len(x)
+	n0 := n
+	nB := n / blocks
+	blocks0 := blocks
+	longBlocks := blocks0 == 1
+	timeDivide := 0
+	tfChange := ctx.tfChange
+
+	// Special case for one sample
+	if n == 1 {
+		return ctx.quantizeBandN1(x, nil, lowbandOut)
+	}
+
+	recombine := 0
+	if tfChange > 0 {
+		recombine = tfChange
+	}
+
+	// Band recombining to increase frequency resolution
+	if lowbandScratch != nil && lowband != nil && (recombine != 0 || (nB&1 == 0 && tfChange < 0) || blocks0 > 1) {
+		copy(lowbandScratch[:n], lowband[:n])
+		lowband = lowbandScratch[:n]
+	}
+
+	encoding := ctx.encoder != nil
+	for k := 0; k < recombine; k++ {
+		if encoding {
+			haar1(x, n>>k, 1<<k)
+		}
+		if lowband != nil {
+			haar1(lowband, n>>k, 1<<k)
+		}
+		fill = bitInterleaveTable[fill&0xF] | bitInterleaveTable[fill>>4]<<2
+	}
+	blocks >>= recombine
+	nB <<= recombine
+
+	// Increasing the time resolution
+	for nB&1 == 0 && tfChange < 0 {
+		if encoding {
+			haar1(x, nB, blocks)
+		}
+		if lowband != nil {
+			haar1(lowband, nB, blocks)
+		}
+		fill |= fill << blocks
+		blocks <<= 1
+		nB >>= 1
+		timeDivide++
+		tfChange++
+	}
+	blocks0 = blocks
+	nB0 := nB
+
+	// Reorganize the samples in time order instead of frequency order
+	if blocks0 > 1 {
+		if encoding {
+			deinterleaveHadamard(x, nB>>recombine, blocks0<<recombine, longBlocks)
+		}
+		if lowband != nil {
+			deinterleaveHadamard(lowband, nB>>recombine, blocks0<<recombine, longBlocks)
+		}
+	}
+
+	cm := ctx.quantizePartition(x, b, blocks, lowband, lm, gain, fill)
+
+	if encoding {
+		return cm
+	}
+
+	// Undo the sample reorganization going from time order to frequency
+	// order
+	if blocks0 > 1 {
+		interleaveHadamard(x, nB>>recombine, blocks0<<recombine, longBlocks)
+	}
+
+	// Undo time-freq changes that we did earlier
+	nB = nB0
+	blocks = blocks0
+	for k := 0; k < timeDivide; k++ {
+		blocks >>= 1
+		nB <<= 1
+		cm |= cm >> blocks
+		haar1(x, nB, blocks)
+	}
+
+	for k := 0; k < recombine; k++ {
+		cm = bitDeinterleaveTable[cm]
+		haar1(x, n0>>k, 1<<k)
+	}
+	blocks <<= recombine
+
+	// Scale output for later folding
+	if lowbandOut != nil {
+		scale := math.Sqrt(float64(n0))
+		for j := range x {
+			lowbandOut[j] = scale * x[j]
+		}
+	}
+	return cm & ((1 << blocks) - 1)
+}
+
+// quantizeBandStereo codes a stereo band as its mid and side, split by
+// an angle, like quant_band_stereo() (bands.c).
+//
+// https://datatracker.ietf.org/doc/html/rfc6716#section-4.3.4.4
+func (ctx *bandContext) quantizeBandStereo(x, y []float64, b, blocks int, lowband []float64, lm int, lowbandOut, lowbandScratch []float64, fill int) int {
+	n := len(x)
+	originalFill := fill
+
+	// Special case for one sample
+	if n == 1 {
+		return ctx.quantizeBandN1(x, y, lowbandOut)
+	}
+
+	s := ctx.computeTheta(x, y, &b, blocks, blocks, lm, true, &fill)
+	mid, side := float64(s.mid)/32768, float64(s.side)/32768
+
+	var cm int
+	if n == 2 {
+		// This is a special case for N=2 that only works for stereo and
+		// takes advantage of the fact that mid and side are orthogonal to
+		// encode the side with just one bit
+		sideBits := 0
+		if s.theta != 0 && s.theta != 16384 {
+			sideBits = 1 << bitResolution
+		}
+		midBits := b - sideBits
+		ctx.remainingBits -= s.allocation + sideBits
+
+		x2, y2 := x, y
+		if s.theta > 8192 {
+			x2, y2 = y, x
+		}
+
+		sign := 0
+		if sideBits != 0 {
+			// Only need one bit for the side
+			if x2[0]*y2[1]-x2[1]*y2[0] < 0 {
+				sign = 1
+			}
+			sign = ctx.codeRawBit(sign)
+		}
+		sign = 1 - 2*sign
+
+		// We use orig_fill here because we want to fold the side, but if
+		// itheta==16384, we'll have cleared the low bits of fill
+		cm = ctx.quantizeBand(x2, midBits, blocks, lowband, lm, lowbandOut, 1, lowbandScratch, originalFill)
+
+		// We don't split N=2 bands, so cm is either 1 or 0 (for a fold-collapse),
+		// and there's no need to worry about mixing with the other channel
+		y2[0] = -float64(sign) * x2[1]
+		y2[1] = float64(sign) * x2[0]
+
+		if ctx.decoder != nil {
+			x[0], x[1] = mid*x[0], mid*x[1]
+			y[0], y[1] = side*y[0], side*y[1]
+			x[0], y[0] = x[0]-y[0], x[0]+y[0]
+			x[1], y[1] = x[1]-y[1], x[1]+y[1]
+		}
+	} else {
+		// "Normal" split code
+		midBits := imax(0, imin(b, (b-s.delta)/2))
+		sideBits := b - midBits
+		ctx.remainingBits -= s.allocation
+
+		rebalance := ctx.remainingBits
+		if midBits >= sideBits {
+			// In stereo mode, we do not apply a scaling to the mid because
+			// we need the normalized mid for folding later
+			cm = ctx.quantizeBand(x, midBits, blocks, lowband, lm, lowbandOut, 1, lowbandScratch, fill)
+			rebalance = midBits - (rebalance - ctx.remainingBits)
+			if rebalance > 3<<bitResolution && s.theta != 0 {
+				sideBits += rebalance - (3 << bitResolution)
+			}
+
+			// For a stereo split, the high bits of fill are always zero, so
+			// no folding will be done to the side
+			cm |= ctx.quantizeBand(y, sideBits, blocks, nil, lm, nil, side, nil, fill>>blocks)
+		} else {
+			cm = ctx.quantizeBand(y, sideBits, blocks, nil, lm, nil, side, nil, fill>>blocks)
+			rebalance = sideBits - (rebalance - ctx.remainingBits)
+			if rebalance > 3<<bitResolution && s.theta != 16384 {
+				midBits += rebalance - (3 << bitResolution)
+			}
+			cm |= ctx.quantizeBand(x, midBits, blocks, lowband, lm, lowbandOut, 1, lowbandScratch, fill)
+		}
+	}
+
+	if ctx.decoder != nil {
+		if n != 2 {
+			stereoMerge(x, y, mid)
+		}
+		if s.inverted {
+			for j := range y {
+				y[j] = -y[j]
+			}
+		}
+	}
+	return cm
+}
+
+// bandQuantization are the parameters of quantizeAllBands.
+type bandQuantization struct {
+	start, end   int
+	lm           int
+	shortBlocks  bool
+	spread       int
+	dualStereo   bool
+	intensity    int
+	tfChanges    *[bandCount]int
+	totalBits    int
+	balance      int
+	codedBands   int
+	pulses       *[bandCount]int
+	amplitudes   *[2][bandCount]float64
+	collapseMask []int
+}
+
+// quantizeAllBands codes the normalized shapes of the bands of one or
+// two channels, like quant_all_bands() (bands.c). The bits of each band
+// are its allocation adjusted by the balance of what the previous bands
+// used. Bands without pulses are filled by folding the shapes of lower
+// bands. collapseMask receives, for each band and channel, the blocks
+// that received energy.
+//
+// https://datatracker.ietf.org/doc/html/rfc6716#section-4.3.4
+func (ctx *bandContext) quantizeAllBands(x, y []float64, q *bandQuantization) {
+	lm := q.lm
+	m := 1 << lm
+	blocks := 1
+	if q.shortBlocks {
+		blocks = m
+	}
+	channels := 1
+	if y != nil {
+		channels = 2
+	}
+
+	normOffset := m * bandEdges[q.start]
+
+	// No need to allocate norm for the last band because we don't need an
+	// output in that band
+	normLength := m*bandEdges[bandCount-1] - normOffset
+	norm := make([]float64, channels*normLength)
+	norm2 := norm[normLength:]
+	if channels == 1 {
+		norm2 = nil
+	}
+	lowbandScratch := make([]float64, m*(bandEdges[bandCount]-bandEdges[bandCount-1]))
+
+	balance := q.balance
+	dualStereo := q.dualStereo
+	lowbandOffset := 0
+	updateLowband := true
+	ctx.intensity = q.intensity
+	ctx.spread = q.spread
+
+	for i := q.start; i < q.end; i++ {
+		ctx.band = i
+		last := i == q.end-1
+
+		xBand := x[m*bandEdges[i] : m*bandEdges[i+1]]
+		var yBand []float64
+		if y != nil {
+			yBand = y[m*bandEdges[i] : m*bandEdges[i+1]]
+		}
+		n := len(xBand)
+
+		tell := ctx.tellFrac()
+
+		// Compute how many bits we want to allocate to this band
+		if i != q.start {
+			balance -= tell
+		}
+		remainingBits := q.totalBits - tell - 1
+		ctx.remainingBits = remainingBits
+
+		b := 0
+		if i <= q.codedBands-1 {
+			currentBalance := balance / imin(3, q.codedBands-i)
+			b = imax(0, imin(16383, imin(remainingBits+1, q.pulses[i]+currentBalance)))
+		}
+
+		// Update the folding position only as long as we have 1 bit/sample
+		// depth
+		if ctx.decoder != nil && (m*bandEdges[i]-n >= m*bandEdges[q.start] || i == q.start+1) && (updateLowband || lowbandOffset == 0) {
+			lowbandOffset = i
+		}
+		if i == q.start+1 {
+			specialHybridFolding(norm, norm2, q.start, m, dualStereo)
+		}
+
+		ctx.tfChange = q.tfChanges[i]
+		ctx.avoidSplitNoise = blocks > 1
+
+		// Get rid of the lowband scratch for the last band
+		scratch := lowbandScratch
+		if last {
+			scratch = nil
+		}
+
+		effectiveLowband := -1
+		xMask, yMask := (1<<blocks)-1, (1<<blocks)-1
+		if lowbandOffset != 0 && (q.spread != spreadAggressive || blocks > 1 || ctx.tfChange < 0) {
+			// This ensures we never repeat spectral content within one band
+			effectiveLowband = imax(0, m*bandEdges[lowbandOffset]-normOffset-n)
+			foldStart := lowbandOffset - 1
+			for m*bandEdges[foldStart] > effectiveLowband+normOffset {
+				foldStart--
+			}
+			foldEnd := lowbandOffset
+			for foldEnd < i && m*bandEdges[foldEnd] < effectiveLowband+normOffset+n {
+				foldEnd++
+			}
+
+			xMask, yMask = 0, 0
+			for foldI := foldStart; foldI < foldEnd; foldI++ {
+				xMask |= q.collapseMask[foldI*channels]
+				yMask |= q.collapseMask[foldI*channels+channels-1]
+			}
+		}
+
+		if dualStereo && i == q.intensity {
+			// Switch off dual stereo to do intensity
+			dualStereo = false
+			if ctx.decoder != nil {
+				for j := 0; j < m*bandEdges[i]-normOffset; j++ {
+					norm[j] = 0.5 * (norm[j] + norm2[j])
+				}
+			}
+		}
+
+		var lowband, lowband2, lowbandOut, lowbandOut2 []float64
+		if effectiveLowband != -1 {
+			lowband = norm[effectiveLowband:]
+			if norm2 != nil {
+				lowband2 = norm2[effectiveLowband:]
+			}
+		}
+		if !last {
+			lowbandOut = norm[m*bandEdges[i]-normOffset:]
+			if norm2 != nil {
+				lowbandOut2 = norm2[m*bandEdges[i]-normOffset:]
+			}
+		}
+
+		switch {
+		case dualStereo:
+			xMask = ctx.quantizeBand(xBand, b/2, blocks, lowband, lm, lowbandOut, 1, scratch, xMask)
+			yMask = ctx.quantizeBand(yBand, b/2, blocks, lowband2, lm, lowbandOut2, 1, scratch, yMask)
+		case y != nil:
+			xMask = ctx.quantizeBandStereo(xBand, yBand, b, blocks, lowband, lm, lowbandOut, scratch, xMask|yMask)
+			yMask = xMask
+		default:
+			xMask = ctx.quantizeBand(xBand, b, blocks, lowband, lm, lowbandOut, 1, scratch, xMask|yMask)
+			yMask = xMask
+		}
+		q.collapseMask[i*channels] = xMask
+		q.collapseMask[i*channels+channels-1] = yMask
+		balance += q.pulses[i] + tell
+
+		// Update the folding position only as long as we have 1 bit/sample
+		// depth
+		updateLowband = b > n<<bitResolution
+	}
+}
+
+// specialHybridFolding duplicates enough of the first band to fold the
+// second, which can be wider in hybrid frames, like
+// special_hybrid_folding() (bands.c).
+func specialHybridFolding(norm, norm2 []float64, start, m int, dualStereo bool) {
+	if start+2 > bandCount {
+		return
+	}
+
+	n1 := m * (bandEdges[start+1] - bandEdges[start])
+	n2 := m * (bandEdges[start+2] - bandEdges[start+1])
+	if n2 <= n1 {
+		return
+	}
+
+	copy(norm[n1:n2], norm[2*n1-n2:n1])
+	if dualStereo {
+		copy(norm2[n1:n2], norm2[2*n1-n2:n1])
+	}
+}
@@ -0,0 +1,48 @@
+// Package celt implements the CELT layer of Opus: the pre-emphasis, the
+// low-overlap MDCT with transient detection, the band energies and their
+// coarse and fine quantization, the bit allocation, the pyramid vector
+// quantization of the band shapes, and the pitch pre- and post-filter.
+//
+// The Encoder and Decoder code complete CELT frames, or the upper bands
+// of a hybrid frame through a range coder shared with SILK. The Decoder
+// conceals lost frames by pitch extrapolation or noise.
+//
+// https://datatracker.ietf.org/doc/html/rfc6716#section-4.3
+package celt
+
+const (
+	sampleRate = 48000
+
+	// Consecutive MDCT windows overlap by 2.5 ms at 48 kHz
+	overlap = 120
+
+	// The shortest frame is 2.5 ms, and frames are 2^LM times as long,
+	// with LM from 0 to maxLM
+	shortBlockSize = 120
+	maxLM          = 3
+
+	// CELT frames are pre-emphasized by the filter 1 - 0.85*z^-1, and
+	// de-emphasized by the decoder
+	preemphasisCoefficient = 0.8500061035
+
+	bandCount = 21
+)
+
+// Edges of the 21 bands in MDCT bins of a 2.5 ms frame. Longer frames
+// scale them by 2^LM. Bins above the last band, 20 kHz, aren't coded.
+//
+// https://datatracker.ietf.org/doc/html/rfc6716#section-4.3 (Table 55)
+var bandEdges = [bandCount + 1]int{
+	0, 1, 2, 3, 4, 5, 6, 7, 8, 10, 12, 14, 16, 20, 24, 28, 34, 40, 48, 60, 78, 100,
+}
+
+// frameSizeLM returns LM, the base 2 logarithm of the number of short
+// blocks in a frame of frameSize samples at 48 kHz.
+func frameSizeLM(frameSize int) (int, error) {
+	for lm := 0; lm <= maxLM; lm++ {
+		if shortBlockSize<<lm == frameSize {
+			return lm, nil
+		}
+	}
+	return 0, errInvalidFrameSize
+}
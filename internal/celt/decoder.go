@@ -0,0 +1,493 @@
+package celt
+
+import (
+	"math"
+
+	"github.com/pion/opus/internal/rangecoding"
+)
+
+const (
+	// The decoder keeps decodeBufferSize samples of its output for the
+	// post-filter and concealment, followed by the overlap of the next
+	// frame
+	decodeBufferSize = 2048
+
+	// Concealment extrapolates the excitation of an lpcOrder predictor
+	// with a pitch period between minimumConcealmentPeriod and
+	// maximumConcealmentPeriod
+	lpcOrder                 = 24
+	minimumConcealmentPeriod = 100
+	maximumConcealmentPeriod = 720
+
+	// Past this many consecutive lost frames, concealment fades to the
+	// background noise
+	maxPitchConcealments = 5
+)
+
+var (
+	spreadICDF = []uint{32, 7, 9, 30, 32}
+	trimICDF   = []uint{128, 2, 4, 9, 19, 41, 87, 109, 119, 124, 126, 128}
+)
+
+// Decoder maintains the state needed to decode a stream of CELT frames
+type Decoder struct {
+	channels     int
+	rangeDecoder rangecoding.Decoder
+
+	// The output of each channel before de-emphasis, and the overlap of
+	// the next frame
+	history           [2][]float64
+	deemphasisMemory  [2]float64
+	postfilter        postfilter
+	previousFilter    postfilter
+	energies          [2][bandCount]float64
+	previousEnergies  [2][bandCount]float64
+	previousEnergies2 [2][bandCount]float64
+	backgroundEnergy  [2][bandCount]float64
+
+	// The final range of the previous frame seeds the folding and noise
+	seed       uint32
+	finalRange uint32
+
+	// Pitch based concealment needs two consecutive decoded frames
+	lossCount        int
+	skipConcealment  bool
+	concealmentPitch int
+	lpc              [2][]float64
+}
+
+// NewDecoder creates a new CELT decoder with one or two output channels
+func NewDecoder(channels int) (*Decoder, error) {
+	if channels != 1 && channels != 2 {
+		return nil, errInvalidChannelCount
+	}
+
+	d := &Decoder{channels: channels}
+	d.Reset()
+	return d, nil
+}
+
+// Reset discards all state carried between frames, as if the Decoder was
+// just created
+func (d *Decoder) Reset() {
+	*d = Decoder{channels: d.channels, skipConcealment: true}
+	for c := 0; c < d.channels; c++ {
+		d.history[c] = make([]float64, decodeBufferSize+overlap)
+	}
+	for c := range d.previousEnergies {
+		for i := range d.previousEnergies[c] {
+			d.previousEnergies[c][i] = minimumEnergy
+			d.previousEnergies2[c][i] = minimumEnergy
+		}
+	}
+}
+
+// FinalRange returns the state of the range decoder after the last frame
+// decoded. It matches the encoder's when the frame was decoded
+// bit-exactly.
+func (d *Decoder) FinalRange() uint32 {
+	return d.finalRange
+}
+
+// Pitch returns the period of the post-filter of the last frame decoded
+// in samples, or zero when it was off.
+func (d *Decoder) Pitch() int {
+	return d.postfilter.period
+}
+
+// CrossFade fades from one signal to another over 2.5 ms with the square
+// of the window, whose overlapping halves sum to one, like smooth_fade()
+// (opus_decoder.c). It is used on the transitions between the modes of
+// Opus. The samples are interleaved with channels.
+func CrossFade(from, to, out []float32, channels int) {
+	for i := 0; i < overlap; i++ {
+		w := float32(window[i] * window[i])
+		for c := 0; c < channels; c++ {
+			j := i*channels + c
+			out[j] = w*to[j] + (1-w)*from[j]
+		}
+	}
+}
+
+// Decode decodes a CELT-only frame of frameSize samples per channel at
+// 48 kHz into out, interleaved in the range [-1, 1]. isStereo tells
+// whether the frame codes two channels, which are downmixed or
+// duplicated to the channels of the Decoder. The bands from endBand up
+// aren't coded, per the bandwidth of the frame. A frame of one byte or
+// less is lost, and concealed.
+//
+// https://datatracker.ietf.org/doc/html/rfc6716#section-4.3
+func (d *Decoder) Decode(in []byte, out []float32, isStereo bool, frameSize, endBand int) error {
+	if len(in) <= 1 {
+		return d.Conceal(out, frameSize, 0, endBand)
+	}
+
+	rangeDecoder := &rangecoding.Decoder{}
+	rangeDecoder.Init(in)
+	return d.DecodeWithRange(rangeDecoder, len(in), out, isStereo, frameSize, 0, endBand)
+}
+
+// DecodeWithRange decodes a CELT frame from a range decoder shared with
+// the SILK layer, as hybrid frames require, from startBand. frameLength
+// is the size in bytes of the frame the range decoder reads.
+func (d *Decoder) DecodeWithRange(
+	rangeDecoder *rangecoding.Decoder,
+	frameLength int,
+	out []float32,
+	isStereo bool,
+	frameSize, startBand, endBand int,
+) error {
+	lm, err := d.validate(out, frameSize, startBand, endBand)
+	if err != nil {
+		return err
+	}
+	channels := 1
+	if isStereo {
+		channels = 2
+	}
+	start, end := startBand, endBand
+	totalBits := frameLength * 8
+
+	// A mono frame predicts its energy from the loudest channel
+	if channels == 1 {
+		for i := 0; i < bandCount; i++ {
+			d.energies[0][i] = math.Max(d.energies[0][i], d.energies[1][i])
+		}
+	}
+
+	tell := int(rangeDecoder.Tell())
+	silence := false
+	if tell >= totalBits {
+		silence = true
+	} else if tell == 1 {
+		silence = rangeDecoder.DecodeSymbolLogP(15) == 1
+	}
+	if silence {
+		// Pretend we've read all the remaining bits
+		rangeDecoder.SkipToEnd()
+		tell = totalBits
+	}
+
+	filter := postfilter{}
+	if start == 0 && tell+16 <= totalBits {
+		if rangeDecoder.DecodeSymbolLogP(1) == 1 {
+			filter = decodePostfilter(rangeDecoder, totalBits)
+		}
+		tell = int(rangeDecoder.Tell())
+	}
+
+	isTransient := false
+	if lm > 0 && tell+3 <= totalBits {
+		isTransient = rangeDecoder.DecodeSymbolLogP(3) == 1
+		tell = int(rangeDecoder.Tell())
+	}
+
+	intra := false
+	if tell+3 <= totalBits {
+		intra = rangeDecoder.DecodeSymbolLogP(3) == 1
+	}
+
+	// Get band energies
+	decodeCoarseEnergy(rangeDecoder, &d.energies, start, end, intra, channels, lm, totalBits)
+
+	var tfChanges [bandCount]int
+	decodeTimeFrequencyChanges(rangeDecoder, &tfChanges, start, end, isTransient, lm, totalBits)
+
+	spread := spreadNormal
+	if int(rangeDecoder.Tell())+4 <= totalBits {
+		spread = int(rangeDecoder.DecodeSymbolWithICDF(spreadICDF))
+	}
+
+	p := &allocationParameters{
+		start:    start,
+		end:      end,
+		channels: channels,
+		lm:       lm,
+		caps:     initCaps(lm, channels),
+	}
+	bitsLeft := decodeBandBoosts(rangeDecoder, &p.offsets, &p.caps, start, end, channels, lm, totalBits<<bitResolution)
+
+	p.trim = 5
+	if int(rangeDecoder.TellFrac())+(6<<bitResolution) <= bitsLeft {
+		p.trim = int(rangeDecoder.DecodeSymbolWithICDF(trimICDF))
+	}
+
+	bits := (totalBits << bitResolution) - int(rangeDecoder.TellFrac()) - 1
+	antiCollapseReserved := 0
+	if isTransient && lm >= 2 && bits >= (lm+2)<<bitResolution {
+		antiCollapseReserved = 1 << bitResolution
+	}
+	p.total = bits - antiCollapseReserved
+	a := computeAllocation(allocationDecoder{rangeDecoder}, p)
+
+	decodeFineEnergy(rangeDecoder, &d.energies, start, end, &a.fineBits, channels)
+
+	// Decode the shapes of the bands
+	n := frameSize
+	shapes := [][]float64{make([]float64, n), nil}
+	if channels == 2 {
+		shapes[1] = make([]float64, n)
+	}
+	collapseMasks := make([]int, channels*bandCount)
+	ctx := &bandContext{decoder: rangeDecoder, seed: d.seed}
+	ctx.quantizeAllBands(shapes[0], shapes[1], &bandQuantization{
+		start:        start,
+		end:          end,
+		lm:           lm,
+		shortBlocks:  isTransient,
+		spread:       spread,
+		dualStereo:   a.dualStereo,
+		intensity:    a.intensity,
+		tfChanges:    &tfChanges,
+		totalBits:    (totalBits << bitResolution) - antiCollapseReserved,
+		balance:      a.balance,
+		codedBands:   a.codedBands,
+		pulses:       &a.pulses,
+		collapseMask: collapseMasks,
+	})
+	if ctx.err != nil {
+		return ctx.err
+	}
+
+	antiCollapseOn := false
+	if antiCollapseReserved > 0 {
+		antiCollapseOn = rangeDecoder.DecodeRawBits(1) == 1
+	}
+
+	decodeEnergyFinalise(rangeDecoder, &d.energies, start, end, &a.fineBits, &a.finePriority, totalBits-int(rangeDecoder.Tell()), channels)
+
+	if antiCollapseOn {
+		antiCollapse(shapes[:channels], collapseMasks, lm, channels, start, end, &d.energies, &d.previousEnergies, &d.previousEnergies2, &a.pulses, ctx.seed)
+	}
+
+	if silence {
+		for c := range d.energies {
+			for i := range d.energies[c] {
+				d.energies[c][i] = minimumEnergy
+			}
+		}
+		for _, shape := range shapes {
+			for i := range shape {
+				shape[i] = 0
+			}
+		}
+	}
+
+	d.synthesize(shapes[:channels], start, end, lm, isTransient)
+
+	// Apply the post-filter, cross-fading from the previous frame's
+	for c := 0; c < d.channels; c++ {
+		d.postfilter.period = imax(d.postfilter.period, minimumPeriod)
+		d.previousFilter.period = imax(d.previousFilter.period, minimumPeriod)
+		offset := decodeBufferSize - n
+		combFilter(d.history[c], d.history[c], offset, shortBlockSize, d.previousFilter, d.postfilter, overlap)
+		if lm != 0 {
+			combFilter(d.history[c], d.history[c], offset+shortBlockSize, n-shortBlockSize, d.postfilter, filter, overlap)
+		}
+	}
+	d.previousFilter = d.postfilter
+	d.postfilter = filter
+	if lm != 0 {
+		d.previousFilter = d.postfilter
+	}
+
+	d.updateEnergies(channels, start, end, lm, isTransient)
+	d.seed = rangeDecoder.FinalRange()
+	d.finalRange = rangeDecoder.FinalRange()
+	d.deemphasize(out, n)
+	d.lossCount = 0
+	d.skipConcealment = false
+
+	return rangeDecoder.Err()
+}
+
+func (d *Decoder) validate(out []float32, frameSize, startBand, endBand int) (int, error) {
+	lm, err := frameSizeLM(frameSize)
+	if err != nil {
+		return 0, err
+	}
+	if startBand < 0 || startBand >= endBand || endBand > bandCount {
+		return 0, errInvalidBandRange
+	}
+	if len(out) < frameSize*d.channels {
+		return 0, errOutBufferTooSmall
+	}
+	return lm, nil
+}
+
+// decodeTimeFrequencyChanges decodes how much each band changes the
+// time-frequency resolution of its MDCT, like tf_decode() (celt.c).
+//
+// https://datatracker.ietf.org/doc/html/rfc6716#section-4.3.4.5
+func decodeTimeFrequencyChanges(decoder *rangecoding.Decoder, tfChanges *[bandCount]int, start, end int, isTransient bool, lm, totalBits int) {
+	transient := 0
+	logp := uint(4)
+	if isTransient {
+		transient = 1
+		logp = 2
+	}
+
+	budget := totalBits
+	tell := int(decoder.Tell())
+	selectReserved := lm > 0 && tell+int(logp)+1 <= budget
+	if selectReserved {
+		budget--
+	}
+
+	changed, current := 0, 0
+	for i := start; i < end; i++ {
+		if tell+int(logp) <= budget {
+			current ^= int(decoder.DecodeSymbolLogP(logp))
+			tell = int(decoder.Tell())
+			changed |= current
+		}
+		tfChanges[i] = current
+		logp = 5
+		if isTransient {
+			logp = 4
+		}
+	}
+
+	tfSelect := 0
+	if selectReserved && tfSelectTable[lm][4*transient+changed] != tfSelectTable[lm][4*transient+2+changed] {
+		tfSelect = int(decoder.DecodeSymbolLogP(1))
+	}
+	for i := start; i < end; i++ {
+		tfChanges[i] = tfSelectTable[lm][4*transient+2*tfSelect+tfChanges[i]]
+	}
+}
+
+// decodeBandBoosts decodes the dynamic allocation, the extra bits some
+// bands are given over the static allocation, and returns the total
+// left, in 1/8 bits.
+//
+// https://datatracker.ietf.org/doc/html/rfc6716#section-4.3.3
+func decodeBandBoosts(decoder *rangecoding.Decoder, offsets, caps *[bandCount]int, start, end, channels, lm, total int) int {
+	boostLogP := uint(6)
+	tell := int(decoder.TellFrac())
+	for i := start; i < end; i++ {
+		quanta := bandBoostQuanta(i, channels, lm)
+		loopLogP := boostLogP
+		boost := 0
+		for tell+int(loopLogP<<bitResolution) < total && boost < caps[i] {
+			flag := decoder.DecodeSymbolLogP(loopLogP) == 1
+			tell = int(decoder.TellFrac())
+			if !flag {
+				break
+			}
+			boost += quanta
+			total -= quanta
+			loopLogP = 1
+		}
+		offsets[i] = boost
+
+		// Making dynalloc more likely
+		if boost > 0 {
+			boostLogP = uint(imax(2, int(boostLogP)-1))
+		}
+	}
+	return total
+}
+
+// bandBoostQuanta returns the step of the boost of a band, one bit per
+// MDCT bin, but at least 6 bits and at most 1 bit per bin.
+func bandBoostQuanta(band, channels, lm int) int {
+	width := channels * (bandEdges[band+1] - bandEdges[band]) << lm
+	return imin(width<<bitResolution, imax(6<<bitResolution, width))
+}
+
+// synthesize denormalises the shapes of the bands of each coded channel
+// and overlap-adds their inverse MDCT to the history of the output
+// channels, like celt_synthesis() (celt_decoder.c).
+//
+// https://datatracker.ietf.org/doc/html/rfc6716#section-4.3.6
+func (d *Decoder) synthesize(shapes [][]float64, start, end, lm int, shortBlocks bool) {
+	n := shortBlockSize << lm
+	frequencies := make([][]float64, len(shapes))
+	for c, shape := range shapes {
+		frequencies[c] = denormaliseBands(shape, &d.energies[c], start, end, lm)
+	}
+
+	switch {
+	case len(frequencies) == 1 && d.channels == 2:
+		frequencies = append(frequencies, frequencies[0])
+	case len(frequencies) == 2 && d.channels == 1:
+		for i := range frequencies[0] {
+			frequencies[0][i] = 0.5 * (frequencies[0][i] + frequencies[1][i])
+		}
+		frequencies = frequencies[:1]
+	}
+
+	blocks, blockSize := 1, n
+	if shortBlocks {
+		blocks, blockSize = 1<<lm, shortBlockSize
+	}
+
+	coefficients := make([]float64, blockSize)
+	for c, history := range d.history[:d.channels] {
+		copy(history, history[n:])
+
+		offset := decodeBufferSize - n
+		for b := 0; b < blocks; b++ {
+			for k := range coefficients {
+				coefficients[k] = frequencies[c][b+k*blocks]
+			}
+			for t, sample := range imdct(coefficients) {
+				if t < overlap {
+					history[offset+t] += sample
+				} else {
+					history[offset+t] = sample
+				}
+			}
+			offset += blockSize
+		}
+	}
+}
+
+// updateEnergies keeps the energies of the last two frames for the
+// anti-collapse, and tracks the background noise for concealment.
+func (d *Decoder) updateEnergies(channels, start, end, lm int, isTransient bool) {
+	if channels == 1 {
+		d.energies[1] = d.energies[0]
+	}
+
+	if isTransient {
+		for c := range d.energies {
+			for i := range d.energies[c] {
+				d.previousEnergies[c][i] = math.Min(d.previousEnergies[c][i], d.energies[c][i])
+			}
+		}
+	} else {
+		d.previousEnergies2 = d.previousEnergies
+		d.previousEnergies = d.energies
+	}
+
+	// In normal circumstances, we only allow the noise floor to increase
+	// by up to 2.4 dB/second, but when we're in DTX, we allow up to 6 dB
+	// increase for each update
+	maxIncrease := float64(imin(160, d.lossCount+(1<<lm))) * 0.001
+	for c := range d.energies {
+		for i := range d.energies[c] {
+			d.backgroundEnergy[c][i] = math.Min(d.backgroundEnergy[c][i]+maxIncrease, d.energies[c][i])
+			if i < start || i >= end {
+				d.energies[c][i] = 0
+				d.previousEnergies[c][i] = minimumEnergy
+				d.previousEnergies2[c][i] = minimumEnergy
+			}
+		}
+	}
+}
+
+// deemphasize undoes the pre-emphasis of the last n samples of the
+// history into out, like deemphasis() (celt_decoder.c).
+func (d *Decoder) deemphasize(out []float32, n int) {
+	for c, history := range d.history[:d.channels] {
+		memory := d.deemphasisMemory[c]
+		for i, sample := range history[decodeBufferSize-n : decodeBufferSize] {
+			sample += memory
+			memory = preemphasisCoefficient * sample
+			out[i*d.channels+c] = float32(sample / 32768)
+		}
+		d.deemphasisMemory[c] = memory
+	}
+}
@@ -0,0 +1,116 @@
+package celt
+
+import (
+	"errors"
+	"math"
+	"testing"
+)
+
+func frameEnergy(samples []float32) float64 {
+	energy := 0.0
+	for _, sample := range samples {
+		if math.IsNaN(float64(sample)) || math.IsInf(float64(sample), 0) {
+			return math.NaN()
+		}
+		energy += float64(sample) * float64(sample)
+	}
+	return energy / float64(len(samples))
+}
+
+func TestDecoder_Conceal(t *testing.T) {
+	const frameSize = 960
+	in := harmonicSignal(1, 20*frameSize)
+
+	encoder, err := NewEncoder(1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	encoder.SetBitrate(64000)
+	decoder, err := NewDecoder(1)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	decode := func(i int, lost bool) []float32 {
+		frame, err := encoder.Encode(in[i*frameSize:(i+1)*frameSize], maxFrameBytes)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if lost {
+			frame = nil
+		}
+		out := make([]float32, frameSize)
+		if err := decoder.Decode(frame, out, false, frameSize, bandCount); err != nil {
+			t.Fatal(err)
+		}
+		return out
+	}
+
+	for i := 0; i < 5; i++ {
+		decode(i, false)
+	}
+	expected := frameEnergy(in[5*frameSize : 6*frameSize])
+
+	// The first loss extrapolates the pitch, close to the signal lost
+	concealed := decode(5, true)
+	if energy := frameEnergy(concealed); !(energy > 0.25*expected && energy < 2*expected) {
+		t.Fatalf("concealed frame energy %v, expected about %v", energy, expected)
+	}
+	if ratio := snr(in[5*frameSize:6*frameSize], concealed, 1, 0); ratio < 0 {
+		t.Errorf("concealed frame SNR of %.1f dB", ratio)
+	}
+
+	// Longer losses fade out
+	previous := frameEnergy(concealed)
+	for i := 6; i < 12; i++ {
+		energy := frameEnergy(decode(i, true))
+		if !(energy < previous) {
+			t.Fatalf("lost frame %d energy %v, after %v", i, energy, previous)
+		}
+		previous = energy
+	}
+
+	// Decoding picks up again
+	var out []float32
+	for i := 12; i < 20; i++ {
+		out = decode(i, false)
+	}
+	if ratio := snr(in[19*frameSize:20*frameSize], out, 1, 0); ratio < 15 {
+		t.Errorf("SNR of %.1f dB after the losses", ratio)
+	}
+}
+
+func TestDecoder_Errors(t *testing.T) {
+	if _, err := NewDecoder(3); !errors.Is(err, errInvalidChannelCount) {
+		t.Errorf("3 channels: %v, expected %v", err, errInvalidChannelCount)
+	}
+
+	decoder, err := NewDecoder(2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	frame := []byte{0x12, 0x34, 0x56}
+	for _, test := range []struct {
+		out       []float32
+		frameSize int
+		endBand   int
+		err       error
+	}{
+		{make([]float32, 2*480), 400, bandCount, errInvalidFrameSize},
+		{make([]float32, 2*480), 480, 0, errInvalidBandRange},
+		{make([]float32, 2*480), 480, bandCount + 1, errInvalidBandRange},
+		{make([]float32, 480), 480, bandCount, errOutBufferTooSmall},
+	} {
+		if err := decoder.Decode(frame, test.out, true, test.frameSize, test.endBand); !errors.Is(err, test.err) {
+			t.Errorf("frame size %d, end band %d: %v, expected %v", test.frameSize, test.endBand, err, test.err)
+		}
+	}
+
+	// Concealment takes an empty band range, but not a reversed one
+	if err := decoder.Conceal(make([]float32, 2*480), 480, 17, 17); err != nil {
+		t.Errorf("empty band range: %v", err)
+	}
+	if err := decoder.Conceal(make([]float32, 2*480), 480, 18, 17); !errors.Is(err, errInvalidBandRange) {
+		t.Errorf("reversed band range: %v, expected %v", err, errInvalidBandRange)
+	}
+}
@@ -0,0 +1,1007 @@
+package celt
+
+import (
+	"math"
+
+	"github.com/pion/opus/internal/rangecoding"
+)
+
+const (
+	// Frames are at most 1275 bytes, which for frames shorter than 20 ms
+	// the reference encoder lowers to keep under 510 kb/s
+	maxFrameBytes = 1275
+
+	// Samples of 24-bit depth, for the noise floor of the VBR
+	inputDepth = 24
+)
+
+// The intensity stereo start band is chosen by the bitrate per channel
+// in kb/s, with hysteresis.
+var (
+	intensityThresholds = []float64{1, 2, 3, 4, 5, 6, 7, 8, 16, 24, 36, 44, 50, 56, 62, 67, 72, 79, 88, 106, 134}
+	intensityHysteresis = []float64{1, 1, 1, 1, 1, 1, 1, 2, 2, 2, 2, 2, 2, 2, 3, 3, 4, 5, 6, 8, 8}
+)
+
+// Encoder maintains the state needed to encode a stream of CELT frames,
+// like the reference encoder (celt_encoder.c), without the dynamic
+// allocation and time-frequency resolution analyses.
+type Encoder struct {
+	channels       int
+	bitrate        int
+	vbr            bool
+	constrainedVBR bool
+	complexity     int
+	packetLoss     int
+	endBand        int
+
+	// The pre-emphasis memory, the pre-emphasized input the pitch
+	// pre-filter reads, and the filtered overlap the next MDCT starts with
+	preemphasisMemory [2]float64
+	prefilterMemory   [2][]float64
+	overlapMemory     [2][]float64
+	prefilter         postfilter
+
+	energies          [2][bandCount]float64
+	previousEnergies  [2][bandCount]float64
+	previousEnergies2 [2][bandCount]float64
+	delayedIntra      float64
+
+	spreadDecision        int
+	tapsetDecision        int
+	tonalAverage          int
+	highFrequencyAverage  int
+	spectralAverage       float64
+	stereoSaving          float64
+	intensity             int
+	lastCodedBands        int
+	consecutiveTransients int
+
+	vbrReservoir int
+	vbrDrift     float64
+	vbrOffset    int
+	vbrCount     int
+
+	finalRange uint32
+}
+
+// NewEncoder creates a new CELT encoder for one or two channels. It
+// codes all 21 bands at complexity 10, using whole frames of the size
+// Encode is given until SetBitrate is called, and constrains VBR.
+func NewEncoder(channels int) (*Encoder, error) {
+	if channels != 1 && channels != 2 {
+		return nil, errInvalidChannelCount
+	}
+
+	e := &Encoder{
+		channels:       channels,
+		constrainedVBR: true,
+		complexity:     10,
+		endBand:        bandCount,
+	}
+	e.Reset()
+	return e, nil
+}
+
+// Reset discards all state carried between frames, as if the Encoder was
+// just created. The settings are kept.
+func (e *Encoder) Reset() {
+	*e = Encoder{
+		channels:       e.channels,
+		bitrate:        e.bitrate,
+		vbr:            e.vbr,
+		constrainedVBR: e.constrainedVBR,
+		complexity:     e.complexity,
+		packetLoss:     e.packetLoss,
+		endBand:        e.endBand,
+		delayedIntra:   1,
+		spreadDecision: spreadNormal,
+		tonalAverage:   256,
+		intensity:      bandCount,
+	}
+	for c := 0; c < e.channels; c++ {
+		e.prefilterMemory[c] = make([]float64, maximumPeriod)
+		e.overlapMemory[c] = make([]float64, overlap)
+	}
+	for c := range e.previousEnergies {
+		for i := range e.previousEnergies[c] {
+			e.previousEnergies[c][i] = minimumEnergy
+			e.previousEnergies2[c][i] = minimumEnergy
+		}
+	}
+}
+
+// SetBitrate sets the target bitrate in bits per second. Zero uses all
+// the bytes each frame is given.
+func (e *Encoder) SetBitrate(bitrate int) {
+	e.bitrate = bitrate
+}
+
+// SetVBR sets whether frames vary in size with how hard they are to
+// code, keeping to the bitrate over about 100 ms. Otherwise all the
+// frames at a bitrate have the same size.
+func (e *Encoder) SetVBR(vbr bool) {
+	e.vbr = vbr
+}
+
+// SetVBRConstraint sets whether VBR frames are kept from using more bits
+// than the bitrate allows over about 100 ms, like
+// CELT_SET_VBR_CONSTRAINT. Unconstrained VBR only keeps to the bitrate
+// on average.
+func (e *Encoder) SetVBRConstraint(constrained bool) {
+	e.constrainedVBR = constrained
+}
+
+// SetComplexity sets the complexity, from 0 to 10. The pitch
+// pre-filter needs at least 5, the spread analysis 3 and the transient
+// detection 1.
+func (e *Encoder) SetComplexity(complexity int) {
+	e.complexity = complexity
+}
+
+// SetPacketLoss sets the expected packet loss in percent, which weakens
+// the pitch pre-filter, whose post-filter spreads the effect of a lost
+// frame.
+func (e *Encoder) SetPacketLoss(percent int) {
+	e.packetLoss = percent
+}
+
+// SetEndBand sets the number of bands coded, from 1 to 21, per the
+// bandwidth of the stream.
+func (e *Encoder) SetEndBand(endBand int) {
+	e.endBand = endBand
+}
+
+// FinalRange returns the state of the range encoder after the last
+// frame, which the decoder matches when it decodes the frame exactly.
+func (e *Encoder) FinalRange() uint32 {
+	return e.finalRange
+}
+
+// Encode encodes a CELT-only frame of 2.5, 5, 10 or 20 ms of interleaved
+// samples at 48 kHz in the range [-1, 1], in at most maxBytes bytes.
+//
+// https://datatracker.ietf.org/doc/html/rfc6716#section-5.3
+func (e *Encoder) Encode(in []float32, maxBytes int) ([]byte, error) {
+	frameSize := len(in) / e.channels
+	lm, err := frameSizeLM(frameSize)
+	if err != nil || frameSize*e.channels != len(in) {
+		return nil, errInvalidFrameSize
+	}
+	if maxBytes < 2 {
+		return nil, errFrameTooSmall
+	}
+
+	frameBytes := imin(maxBytes, maxFrameBytes)
+	vbrRate := e.vbrRate(frameSize)
+	if e.bitrate > 0 {
+		if e.vbr {
+			frameBytes = imin(frameBytes, maxFrameBytes>>(maxLM-lm))
+		} else {
+			frameBytes = imax(2, imin(frameBytes, (e.bitrate*frameSize+4*sampleRate)/(8*sampleRate)))
+		}
+	}
+
+	encoder := &rangecoding.Encoder{}
+	encoder.Init(make([]byte, frameBytes))
+	if err := e.encode(encoder, frameBytes, in, lm, 0, vbrRate); err != nil {
+		return nil, err
+	}
+	return encoder.Done()
+}
+
+// EncodeWithRange encodes the CELT layer of a hybrid frame, from
+// startBand, with a range encoder shared with the SILK layer.
+// frameLength is the size in bytes of the frame the range encoder
+// writes, which the caller finishes. With VBR, the bitrate is that of
+// the CELT layer, and the range encoder is shrunk to the size of the
+// frame.
+func (e *Encoder) EncodeWithRange(encoder *rangecoding.Encoder, frameLength int, in []float32, startBand int) error {
+	frameSize := len(in) / e.channels
+	lm, err := frameSizeLM(frameSize)
+	if err != nil || frameSize*e.channels != len(in) {
+		return errInvalidFrameSize
+	}
+	if startBand < 0 || startBand >= e.endBand {
+		return errInvalidBandRange
+	}
+	return e.encode(encoder, frameLength, in, lm, startBand, e.vbrRate(frameSize))
+}
+
+// vbrRate returns the target size of VBR frames of frameSize samples in
+// 1/8 bits, or zero without VBR
+func (e *Encoder) vbrRate(frameSize int) int {
+	if !e.vbr || e.bitrate <= 0 {
+		return 0
+	}
+	return (e.bitrate*frameSize + (sampleRate >> bitResolution >> 1)) / (sampleRate >> bitResolution)
+}
+
+// encode codes a frame in the order the decoder reads it, like
+// celt_encode_with_ec() (celt_encoder.c). vbrRate is the target size of
+// VBR frames in 1/8 bits, or zero for a frame of the size of the range
+// encoder.
+func (e *Encoder) encode(encoder *rangecoding.Encoder, frameBytes int, in []float32, lm, start, vbrRate int) error {
+	channels := e.channels
+	n := shortBlockSize << lm
+	end := imax(start+1, imin(bandCount, e.endBand))
+	tell, initialTellFrac := int(encoder.Tell()), int(encoder.TellFrac())
+	filledBytes := (tell + 4) >> 3
+	availableBytes := frameBytes - filledBytes
+
+	equivalentRate := (frameBytes*8*50)<<(maxLM-lm) - (40*channels+20)*((400>>lm)-50)
+	if e.bitrate > 0 {
+		equivalentRate = imin(equivalentRate, e.bitrate-(40*channels+20)*((400>>lm)-50))
+	}
+
+	// Computes the max bit-rate allowed in VBR mode to avoid violating the
+	// target rate over a 100 ms window
+	if vbrRate > 0 && e.constrainedVBR {
+		minimum := 0
+		if tell == 1 {
+			minimum = 2
+		}
+		if allowed := imin(imax(minimum, (2*vbrRate-e.vbrReservoir)>>(bitResolution+3)), availableBytes); allowed < availableBytes {
+			frameBytes = filledBytes + allowed
+			availableBytes = allowed
+			encoder.Shrink(frameBytes)
+		}
+	}
+	totalBits := frameBytes * 8
+
+	// Pre-emphasis, in 16-bit range
+	silence := true
+	windows := make([][]float64, channels)
+	for c := range windows {
+		windows[c] = make([]float64, overlap+n)
+		copy(windows[c], e.overlapMemory[c])
+		for i := 0; i < n; i++ {
+			sample := float64(in[i*channels+c]) * 32768
+			if sample != 0 {
+				silence = false
+			}
+			windows[c][overlap+i] = sample - preemphasisCoefficient*e.preemphasisMemory[c]
+			e.preemphasisMemory[c] = sample
+		}
+	}
+
+	if tell == 1 {
+		encoder.EncodeSymbolLogP(15, boolSymbol(silence))
+	} else {
+		silence = false
+	}
+	if silence {
+		// In VBR mode there is no need to send more than the minimum
+		if vbrRate > 0 {
+			frameBytes = imin(frameBytes, filledBytes+2)
+			totalBits = frameBytes * 8
+			availableBytes = 2
+			encoder.Shrink(frameBytes)
+		}
+
+		// Pretend we've filled all the remaining bits with zeros
+		encoder.SkipToEnd()
+	}
+
+	// Find pitch period and gain
+	enabled := availableBytes > 12*channels && start == 0 && !silence && e.complexity >= 5
+	filter, qg := e.runPrefilter(windows, n, enabled, availableBytes)
+	if start == 0 && int(encoder.Tell())+16 <= totalBits {
+		encoder.EncodeSymbolLogP(1, boolSymbol(filter.gain != 0))
+		if filter.gain != 0 {
+			encodePostfilter(encoder, filter, qg)
+		}
+	}
+
+	isTransient, tfEstimate := false, 0.0
+	if e.complexity >= 1 && lm > 0 {
+		isTransient, tfEstimate = detectTransient(windows)
+	}
+	transientDisabled := false
+	if lm > 0 && int(encoder.Tell())+3 <= totalBits {
+		encoder.EncodeSymbolLogP(3, boolSymbol(isTransient))
+	} else {
+		transientDisabled = isTransient
+		isTransient = false
+	}
+
+	// Band energies, in the scale of the reference MDCT
+	blockSize := n
+	if isTransient {
+		blockSize = shortBlockSize
+	}
+	shapes := make([][]float64, 2)
+	var amplitudes, logEnergies [2][bandCount]float64
+	for c, window := range windows {
+		coefficients := computeMDCT(window, n, isTransient)
+		for k := range coefficients {
+			coefficients[k] *= 2 / float64(blockSize)
+		}
+
+		bandAmplitudes := computeBandEnergies(coefficients, lm)
+		shapes[c] = normalizeBands(coefficients, bandAmplitudes, lm)
+		for i := 0; i < bandCount; i++ {
+			amplitudes[c][i] = bandAmplitudes[i]
+			logEnergies[c][i] = math.Log2(bandAmplitudes[i]) - eMeans[i]
+		}
+	}
+
+	// Coarse energy, intra when the prediction has drifted too far
+	intra := e.delayedIntra > float64(2*channels*(end-start)) && availableBytes > (end-start)*channels
+	if int(encoder.Tell())+3 > totalBits {
+		intra = false
+	}
+	maxDecay := 16.0
+	if end-start > 10 {
+		maxDecay = math.Min(maxDecay, float64(availableBytes)/8)
+	}
+	distortion := energyDistortion(&logEnergies, &e.energies, start, end, channels)
+	var residuals [2][bandCount]float64
+	encodeCoarseEnergy(encoder, &logEnergies, &e.energies, &residuals, start, end, intra, channels, lm, totalBits, maxDecay)
+	if intra {
+		e.delayedIntra = distortion
+	} else {
+		alpha := predictionCoefficients[lm]
+		e.delayedIntra = alpha*alpha*e.delayedIntra + distortion
+	}
+
+	var tfChanges [bandCount]int
+	for i := range tfChanges {
+		if isTransient {
+			tfChanges[i] = 1
+		}
+	}
+	encodeTimeFrequencyChanges(encoder, &tfChanges, start, end, isTransient, lm, totalBits)
+
+	if int(encoder.Tell())+4 <= totalBits {
+		switch {
+		case isTransient || e.complexity < 3 || availableBytes < 10*channels:
+			e.spreadDecision = spreadNormal
+			if e.complexity == 0 {
+				e.spreadDecision = spreadNone
+			}
+		default:
+			e.spreadDecision = e.spreadingDecision(shapes[:channels], end, lm, filter.gain != 0 && !isTransient)
+		}
+		encoder.EncodeSymbolWithICDF(spreadICDF, uint32(e.spreadDecision))
+	} else {
+		e.spreadDecision = spreadNormal
+	}
+
+	// No band is boosted over the static allocation
+	caps := initCaps(lm, channels)
+	boostLogP := uint(6)
+	for i := start; i < end; i++ {
+		if int(encoder.TellFrac())+int(boostLogP<<bitResolution) < totalBits<<bitResolution && caps[i] > 0 {
+			encoder.EncodeSymbolLogP(boostLogP, 0)
+		}
+	}
+
+	dualStereo := false
+	if channels == 2 {
+		// Always use MS for 2.5 ms frames until we can do a better analysis
+		if lm != 0 {
+			dualStereo = stereoAnalysis(shapes, lm)
+		}
+		e.intensity = hysteresisDecision(float64(equivalentRate/1000), intensityThresholds, intensityHysteresis, e.intensity)
+		e.intensity = imin(end, imax(start, e.intensity))
+	}
+
+	trim := 5
+	if int(encoder.TellFrac())+(6<<bitResolution) <= (totalBits << bitResolution) {
+		trim = allocationTrim(shapes, &logEnergies, end, lm, channels, tfEstimate, e.intensity, equivalentRate, &e.stereoSaving)
+		encoder.EncodeSymbolWithICDF(trimICDF, uint32(trim))
+	}
+
+	if vbrRate > 0 {
+		frameBytes = e.resizeFrame(encoder, &logEnergies, vbrRate, frameBytes, start, end, lm, initialTellFrac, isTransient, silence, tfEstimate)
+		totalBits = frameBytes * 8
+	}
+
+	// Bit allocation
+	bits := (totalBits << bitResolution) - int(encoder.TellFrac()) - 1
+	antiCollapseReserved := 0
+	if isTransient && lm >= 2 && bits >= (lm+2)<<bitResolution {
+		antiCollapseReserved = 1 << bitResolution
+	}
+	a := computeAllocation(allocationEncoder{encoder}, &allocationParameters{
+		start:              start,
+		end:                end,
+		channels:           channels,
+		lm:                 lm,
+		caps:               caps,
+		trim:               trim,
+		total:              bits - antiCollapseReserved,
+		intensity:          e.intensity,
+		dualStereo:         dualStereo,
+		previousCodedBands: e.lastCodedBands,
+		signalBandwidth:    end - 1,
+	})
+	if e.lastCodedBands != 0 {
+		e.lastCodedBands = imin(e.lastCodedBands+1, imax(e.lastCodedBands-1, a.codedBands))
+	} else {
+		e.lastCodedBands = a.codedBands
+	}
+
+	encodeFineEnergy(encoder, &e.energies, &residuals, start, end, &a.fineBits, channels)
+
+	// Residual quantisation
+	collapseMasks := make([]int, channels*bandCount)
+	ctx := &bandContext{encoder: encoder, amplitudes: &amplitudes}
+	ctx.quantizeAllBands(shapes[0], shapes[1], &bandQuantization{
+		start:        start,
+		end:          end,
+		lm:           lm,
+		shortBlocks:  isTransient,
+		spread:       e.spreadDecision,
+		dualStereo:   a.dualStereo,
+		intensity:    a.intensity,
+		tfChanges:    &tfChanges,
+		totalBits:    (totalBits << bitResolution) - antiCollapseReserved,
+		balance:      a.balance,
+		codedBands:   a.codedBands,
+		pulses:       &a.pulses,
+		collapseMask: collapseMasks,
+	})
+	if ctx.err != nil {
+		return ctx.err
+	}
+
+	if antiCollapseReserved > 0 {
+		antiCollapseOn := uint32(0)
+		if e.consecutiveTransients < 2 {
+			antiCollapseOn = 1
+		}
+		encoder.EncodeRawBits(antiCollapseOn, 1)
+	}
+
+	encodeEnergyFinalise(encoder, &e.energies, &residuals, start, end, &a.fineBits, &a.finePriority, totalBits-int(encoder.Tell()), channels)
+
+	if silence {
+		for c := range e.energies {
+			for i := range e.energies[c] {
+				e.energies[c][i] = minimumEnergy
+			}
+		}
+	}
+	e.updateEnergies(channels, start, end, isTransient)
+
+	if isTransient || transientDisabled {
+		e.consecutiveTransients++
+	} else {
+		e.consecutiveTransients = 0
+	}
+	e.finalRange = encoder.FinalRange()
+	return nil
+}
+
+// runPrefilter finds the pitch of the frame and applies the comb
+// pre-filter to it, that the decoder's post-filter inverts, like
+// run_prefilter() (celt_encoder.c). The filter attenuates the harmonics
+// of voiced signals, which the band quantization would otherwise spend
+// bits on, and the post-filter restores them with less noise between
+// them. It returns the filter and its quantized gain.
+func (e *Encoder) runPrefilter(windows [][]float64, n int, enabled bool, availableBytes int) (postfilter, int) {
+	channels := len(windows)
+
+	// The pre-emphasized input, after maximumPeriod samples of history
+	pre := make([][]float64, channels)
+	for c := range pre {
+		pre[c] = append(append(make([]float64, 0, maximumPeriod+n), e.prefilterMemory[c]...), windows[c][overlap:]...)
+	}
+
+	filter := postfilter{period: minimumPeriod, tapset: e.tapsetDecision}
+	if enabled {
+		downsampled := pitchDownsample(pre, 0, maximumPeriod+n)
+
+		// Don't search for periods shorter than 3 times the minimum, as
+		// removeDoubling checks their submultiples
+		filter.period = maximumPeriod - pitchSearch(downsampled[maximumPeriod>>1:], downsampled, n, maximumPeriod-3*minimumPeriod)
+		filter.period, filter.gain = removeDoubling(downsampled, maximumPeriod, minimumPeriod, n, filter.period, e.prefilter.period, e.prefilter.gain)
+		filter.period = imin(filter.period, maximumPeriod-2)
+		filter.gain *= 0.7
+
+		if e.packetLoss > 2 {
+			filter.gain *= 0.5
+		}
+		if e.packetLoss > 4 {
+			filter.gain *= 0.5
+		}
+		if e.packetLoss > 8 {
+			filter.gain = 0
+		}
+	}
+
+	// Gain threshold for enabling the prefilter/postfilter
+	threshold := 0.2
+
+	// Adjusting the threshold based on rate and continuity
+	if iabs(filter.period-e.prefilter.period)*10 > filter.period {
+		threshold += 0.2
+	}
+	if availableBytes < 25 {
+		threshold += 0.1
+	}
+	if availableBytes < 35 {
+		threshold += 0.1
+	}
+	if e.prefilter.gain > 0.4 {
+		threshold -= 0.1
+	}
+	if e.prefilter.gain > 0.55 {
+		threshold -= 0.1
+	}
+
+	// Hard threshold at 0.2
+	threshold = math.Max(threshold, 0.2)
+
+	qg := 0
+	if filter.gain < threshold {
+		filter.gain = 0
+	} else {
+		// This block is not gated by a total bits check only because of
+		// the nbAvailableBytes check above
+		if math.Abs(filter.gain-e.prefilter.gain) < 0.1 {
+			filter.gain = e.prefilter.gain
+		}
+		qg = imax(0, imin(7, int(math.Floor(0.5+filter.gain*32/3))-1))
+		filter.gain = 0.09375 * float64(qg+1)
+	}
+
+	// The pre-filter is the comb filter with negated gains, without
+	// feedback
+	e.prefilter.period = imax(e.prefilter.period, minimumPeriod)
+	from, to := e.prefilter, filter
+	from.gain, to.gain = -from.gain, -to.gain
+	filtered := make([]float64, maximumPeriod+n)
+	for c, window := range windows {
+		combFilter(filtered, pre[c], maximumPeriod, n, from, to, overlap)
+		copy(window[overlap:], filtered[maximumPeriod:])
+		copy(e.overlapMemory[c], window[n:])
+		copy(e.prefilterMemory[c], pre[c][n:])
+	}
+
+	e.prefilter = filter
+	return filter, qg
+}
+
+// encodeTimeFrequencyChanges is the encoder side of
+// decodeTimeFrequencyChanges, like tf_encode() (celt_encoder.c). The
+// changes are given as 0 or 1 per band, and replaced by the resolution
+// changes they code.
+func encodeTimeFrequencyChanges(encoder *rangecoding.Encoder, tfChanges *[bandCount]int, start, end int, isTransient bool, lm, totalBits int) {
+	transient := 0
+	logp := uint(4)
+	if isTransient {
+		transient = 1
+		logp = 2
+	}
+
+	budget := totalBits
+	tell := int(encoder.Tell())
+	selectReserved := lm > 0 && tell+int(logp)+1 <= budget
+	if selectReserved {
+		budget--
+	}
+
+	changed, current := 0, 0
+	for i := start; i < end; i++ {
+		if tell+int(logp) <= budget {
+			encoder.EncodeSymbolLogP(logp, uint32(tfChanges[i]^current))
+			tell = int(encoder.Tell())
+			current = tfChanges[i]
+			changed |= current
+		} else {
+			tfChanges[i] = current
+		}
+		logp = 5
+		if isTransient {
+			logp = 4
+		}
+	}
+
+	// Only code the selection if it would actually make a difference
+	if selectReserved && tfSelectTable[lm][4*transient+changed] != tfSelectTable[lm][4*transient+2+changed] {
+		encoder.EncodeSymbolLogP(1, 0)
+	}
+	for i := start; i < end; i++ {
+		tfChanges[i] = tfSelectTable[lm][4*transient+tfChanges[i]]
+	}
+}
+
+// spreadingDecision picks how much to spread the pulses of the bands
+// from how peaky their shapes are, and updates the tapset of the pitch
+// pre-filter from how peaky the high bands are, like
+// spreading_decision() (bands.c).
+func (e *Encoder) spreadingDecision(shapes [][]float64, end, lm int, updateTapset bool) int {
+	m := 1 << lm
+	if m*(bandEdges[end]-bandEdges[end-1]) <= 8 {
+		return spreadNone
+	}
+
+	sum, bandsCounted, highFrequencySum := 0, 0, 0
+	for _, shape := range shapes {
+		for i := 0; i < end; i++ {
+			x := shape[m*bandEdges[i] : m*bandEdges[i+1]]
+			n := len(x)
+			if n <= 8 {
+				continue
+			}
+
+			// Compute rough CDF of |x[j]|
+			var counts [3]int
+			for _, value := range x {
+				x2n := value * value * float64(n)
+				if x2n < 0.25 {
+					counts[0]++
+				}
+				if x2n < 0.0625 {
+					counts[1]++
+				}
+				if x2n < 0.015625 {
+					counts[2]++
+				}
+			}
+
+			// Only include four last bands (8 kHz and up)
+			if i > bandCount-4 {
+				highFrequencySum += 32 * (counts[1] + counts[0]) / n
+			}
+
+			for _, count := range counts {
+				if 2*count >= n {
+					sum++
+				}
+			}
+			bandsCounted++
+		}
+	}
+
+	if updateTapset {
+		if highFrequencySum != 0 {
+			highFrequencySum /= len(shapes) * (4 - bandCount + end)
+		}
+		e.highFrequencyAverage = (e.highFrequencyAverage + highFrequencySum) >> 1
+		highFrequencySum = e.highFrequencyAverage
+		switch e.tapsetDecision {
+		case 2:
+			highFrequencySum += 4
+		case 0:
+			highFrequencySum -= 4
+		}
+		switch {
+		case highFrequencySum > 22:
+			e.tapsetDecision = 2
+		case highFrequencySum > 18:
+			e.tapsetDecision = 1
+		default:
+			e.tapsetDecision = 0
+		}
+	}
+
+	// Recursive averaging
+	sum = ((sum<<8)/bandsCounted + e.tonalAverage) >> 1
+	e.tonalAverage = sum
+
+	// Hysteresis
+	sum = (3*sum + (((3 - e.spreadDecision) << 7) + 64) + 2) >> 2
+	switch {
+	case sum < 80:
+		return spreadAggressive
+	case sum < 256:
+		return spreadNormal
+	case sum < 384:
+		return spreadLight
+	default:
+		return spreadNone
+	}
+}
+
+// stereoAnalysis decides whether to code the channels of a frame
+// separately, when they take fewer bits than their mid and side, by the
+// L1 norm of the low bands, like stereo_analysis() (celt_encoder.c).
+func stereoAnalysis(shapes [][]float64, lm int) bool {
+	sumLR, sumMS := transientEpsilon, transientEpsilon
+	for j := 0; j < bandEdges[13]<<lm; j++ {
+		l, r := shapes[0][j], shapes[1][j]
+		sumLR += math.Abs(l) + math.Abs(r)
+		sumMS += math.Abs(l+r) + math.Abs(l-r)
+	}
+	sumMS *= math.Sqrt2 / 2
+
+	// We don't need thetas for lower bands with LM<=1
+	thetas := 13
+	if lm <= 1 {
+		thetas -= 8
+	}
+	return float64((bandEdges[13]<<(lm+1))+thetas)*sumMS > float64(bandEdges[13]<<(lm+1))*sumLR
+}
+
+// allocationTrim tilts the allocation towards the low bands for
+// signals whose energy falls with frequency and for transients, and
+// estimates how many bits intensity stereo saves, like
+// alloc_trim_analysis() (celt_encoder.c).
+func allocationTrim(
+	shapes [][]float64,
+	logEnergies *[2][bandCount]float64,
+	end, lm, channels int,
+	tfEstimate float64,
+	intensity, equivalentRate int,
+	stereoSaving *float64,
+) int {
+	// At low bitrate, reducing the trim seems to help
+	trim := 5.0
+	if equivalentRate < 64000 {
+		trim = 4
+	} else if equivalentRate < 80000 {
+		trim = 4 + float64((equivalentRate-64000)>>10)/16
+	}
+
+	if channels == 2 {
+		// Compute inter-channel correlation for low frequencies
+		correlation := func(i int) float64 {
+			x := shapes[0][bandEdges[i]<<lm : bandEdges[i+1]<<lm]
+			return innerProduct(x, shapes[1][bandEdges[i]<<lm:], len(x))
+		}
+		sum := 0.0
+		for i := 0; i < 8; i++ {
+			sum += correlation(i)
+		}
+		sum = math.Min(1, math.Abs(sum/8))
+		minimum := sum
+		for i := 8; i < intensity; i++ {
+			minimum = math.Min(minimum, math.Abs(correlation(i)))
+		}
+		minimum = math.Min(1, math.Abs(minimum))
+
+		// Mid-side savings estimations based on the LF average and the
+		// minimum correlation
+		logXC := math.Log2(1.001 - sum*sum)
+		logXC2 := math.Max(0.5*logXC, math.Log2(1.001-minimum*minimum))
+		trim += math.Max(-4, 0.75*logXC)
+		*stereoSaving = math.Min(*stereoSaving+0.25, -0.5*logXC2)
+	}
+
+	// Estimate spectral tilt
+	diff := 0.0
+	for c := 0; c < channels; c++ {
+		for i := 0; i < end-1; i++ {
+			diff += logEnergies[c][i] * float64(2+2*i-end)
+		}
+	}
+	diff /= float64(channels * (end - 1))
+	trim -= math.Max(-2, math.Min(2, (diff+1)/6))
+	trim -= 2 * tfEstimate
+
+	return imax(0, imin(10, int(math.Floor(0.5+trim))))
+}
+
+// resizeFrame sets the size of a VBR frame from its target rate,
+// adjusted by how hard the frame is to code, and by the bits earlier
+// frames used over theirs when VBR is constrained, like the VBR part of
+// celt_encode_with_ec() (celt_encoder.c). The CELT layer of hybrid
+// frames, from a start band above 0, only follows the transient
+// estimate. initialTellFrac is the size of the SILK layer of hybrid
+// frames, in 1/8 bits. It returns the new size in bytes.
+func (e *Encoder) resizeFrame(
+	encoder *rangecoding.Encoder,
+	logEnergies *[2][bandCount]float64,
+	vbrRate, frameBytes, start, end, lm, initialTellFrac int,
+	isTransient, silence bool,
+	tfEstimate float64,
+) int {
+	channels := e.channels
+	lmDiff := maxLM - lm
+	tell := int(encoder.TellFrac())
+	hybrid := start > 0
+
+	baseTarget := vbrRate - ((40*channels + 20) << bitResolution)
+	if hybrid {
+		baseTarget = imax(0, vbrRate-((9*channels+4)<<bitResolution))
+	}
+	if e.constrainedVBR {
+		baseTarget += e.vbrOffset >> lmDiff
+	}
+
+	var target int
+	if hybrid {
+		target = baseTarget + int((tfEstimate-0.25)*(50<<bitResolution))
+		if tfEstimate > 0.7 {
+			target = imax(target, 50<<bitResolution)
+		}
+	} else {
+		target = e.vbrTarget(logEnergies, baseTarget, start, end, lm, isTransient, tfEstimate)
+	}
+	target += tell
+
+	// In VBR mode the frame size must not be reduced so much that it would
+	// result in the encoder running out of bits. The margin of 2 bytes
+	// ensures that none of the bust-prevention logic in the decoder will
+	// have triggered so far. The CELT layer of a hybrid frame gets at
+	// least 37 bits past the whole bits the decoder tells before it, one
+	// more than its fractional tell, so that it reads the redundancy flag
+	// the encoder wrote.
+	minimumBytes := ((tell + (1 << (bitResolution + 3)) - 1) >> (bitResolution + 3)) + 2
+	if hybrid {
+		minimumBytes = imax(minimumBytes, (initialTellFrac+(38<<bitResolution)+(1<<(bitResolution+3))-1)>>(bitResolution+3))
+	}
+	availableBytes := (target + (1 << (bitResolution + 2))) >> (bitResolution + 3)
+	availableBytes = imin(frameBytes, imax(minimumBytes, availableBytes))
+
+	// By how much did we "miss" the target on that frame
+	delta := target - vbrRate
+	target = availableBytes << (bitResolution + 3)
+
+	// If the frame is silent we don't adjust our drift, otherwise the
+	// encoder will shoot to very high rates after hitting a span of
+	// silence, but we do allow the reservoir to refill
+	if silence {
+		availableBytes = 2
+		target = 2 * 8 << bitResolution
+		delta = 0
+	}
+
+	alpha := 0.001
+	if e.vbrCount < 970 {
+		e.vbrCount++
+		alpha = 1 / float64(e.vbrCount+20)
+	}
+
+	// Unconstrained VBR only keeps to the bitrate on average
+	if e.constrainedVBR {
+		// How many bits have we used in excess of what we're allowed
+		e.vbrReservoir += target - vbrRate
+
+		// Compute the offset we need to apply in order to reach the target
+		e.vbrDrift += alpha * (float64(delta*(1<<lmDiff)-e.vbrOffset) - e.vbrDrift)
+		e.vbrOffset = -int(e.vbrDrift)
+
+		if e.vbrReservoir < 0 {
+			// We're under the min value -- increase rate, unless we're just
+			// coding silence
+			if !silence {
+				availableBytes += -e.vbrReservoir / (8 << bitResolution)
+			}
+			e.vbrReservoir = 0
+		}
+	}
+
+	frameBytes = imin(frameBytes, availableBytes)
+
+	// This moves the raw bits to take into account the new compressed size
+	encoder.Shrink(frameBytes)
+	return frameBytes
+}
+
+// vbrTarget returns the size, in 1/8 bits, to code a frame with, like
+// compute_vbr() (celt_encoder.c). It takes bits from stereo frames
+// whose channels are correlated, and gives them to transients, and to
+// frames louder than the average.
+func (e *Encoder) vbrTarget(logEnergies *[2][bandCount]float64, baseTarget, start, end, lm int, isTransient bool, tfEstimate float64) int {
+	channels := e.channels
+	codedBands := e.lastCodedBands
+	if codedBands == 0 {
+		codedBands = bandCount
+	}
+	codedBins := bandEdges[codedBands] << lm
+	if channels == 2 {
+		codedBins += bandEdges[imin(e.intensity, codedBands)] << lm
+	}
+
+	target := baseTarget
+
+	// Stereo savings
+	if channels == 2 {
+		stereoBands := imin(e.intensity, codedBands)
+		stereoDOF := (bandEdges[stereoBands] << lm) - stereoBands
+
+		// Maximum fraction of the bits we can save if the signal is mono
+		maxFraction := 0.8 * float64(stereoDOF) / float64(codedBins)
+		stereoSaving := math.Min(e.stereoSaving, 1)
+		target -= int(math.Min(maxFraction*float64(target), (stereoSaving-0.1)*float64(stereoDOF<<bitResolution)))
+	}
+
+	// Boost the rate according to dynalloc (minus the dynalloc average for
+	// calibration)
+	target -= 19 << lm
+
+	// Apply transient boost, compensating for average boost
+	target += int(2 * (tfEstimate - 0.044) * float64(target))
+
+	// Limit the target to the depth of the signal over the noise floor
+	maxDepth := -31.9
+	for c := 0; c < channels; c++ {
+		for i := start; i < end; i++ {
+			noiseFloor := 0.0625*float64(logN400[i]) + 0.5 + float64(9-inputDepth) - eMeans[i] + 0.0062*float64((i+5)*(i+5))
+			maxDepth = math.Max(maxDepth, logEnergies[c][i]-noiseFloor)
+		}
+	}
+	floorDepth := int(float64(channels*bandEdges[bandCount-2]<<lm<<bitResolution) * maxDepth)
+	target = imin(target, imax(floorDepth, target>>2))
+
+	// Make VBR less aggressive for constrained VBR because we can't keep a
+	// higher bitrate for long
+	if e.constrainedVBR {
+		target = baseTarget + int(0.67*float64(target-baseTarget))
+	}
+
+	// Spend more bits on frames louder than the recent average
+	if tfEstimate < 0.2 {
+		amount := 0.0000031 * float64(imax(0, imin(32000, 96000-e.bitrate)))
+		target += int(amount * e.temporalVBR(logEnergies, start, end, lm, isTransient) * float64(target))
+	}
+
+	// Don't allow more than doubling the rate
+	return imin(2*baseTarget, target)
+}
+
+// temporalVBR returns how much louder than the recent average the frame
+// is, in the base 2 logarithm of the amplitude, from -1.5 to 3.
+func (e *Encoder) temporalVBR(logEnergies *[2][bandCount]float64, start, end, lm int, isTransient bool) float64 {
+	offset := 0.0
+	if isTransient {
+		offset = 0.5 * float64(lm)
+	}
+
+	follow, frameAverage := -10.0, 0.0
+	for i := start; i < end; i++ {
+		follow = math.Max(follow-1, logEnergies[0][i]-offset)
+		if e.channels == 2 {
+			follow = math.Max(follow, logEnergies[1][i]-offset)
+		}
+		frameAverage += follow
+	}
+	frameAverage /= float64(end - start)
+
+	temporal := math.Max(-1.5, math.Min(3, frameAverage-e.spectralAverage))
+	e.spectralAverage += 0.02 * temporal
+	return temporal
+}
+
+// energyDistortion returns how far the energies of a frame are from the
+// prediction of the previous frame, for the intra decision, like
+// loss_distortion() (quant_bands.c).
+func energyDistortion(energies, previous *[2][bandCount]float64, start, end, channels int) float64 {
+	distortion := 0.0
+	for c := 0; c < channels; c++ {
+		for i := start; i < end; i++ {
+			d := energies[c][i] - previous[c][i]
+			distortion += d * d
+		}
+	}
+	return math.Min(200, distortion)
+}
+
+func (e *Encoder) updateEnergies(channels, start, end int, isTransient bool) {
+	if channels == 1 {
+		e.energies[1] = e.energies[0]
+	}
+
+	if isTransient {
+		for c := range e.energies {
+			for i := range e.energies[c] {
+				e.previousEnergies[c][i] = math.Min(e.previousEnergies[c][i], e.energies[c][i])
+			}
+		}
+	} else {
+		e.previousEnergies2 = e.previousEnergies
+		e.previousEnergies = e.energies
+	}
+
+	// In case start or end were to change
+	for c := range e.energies {
+		for i := range e.energies[c] {
+			if i < start || i >= end {
+				e.energies[c][i] = 0
+				e.previousEnergies[c][i] = minimumEnergy
+				e.previousEnergies2[c][i] = minimumEnergy
+			}
+		}
+	}
+}
+
+func boolSymbol(b bool) uint32 {
+	if b {
+		return 1
+	}
+	return 0
+}
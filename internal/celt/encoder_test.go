@@ -0,0 +1,269 @@
+package celt
+
+import (
+	"errors"
+	"math"
+	"math/rand"
+	"testing"
+
+	"github.com/pion/opus/internal/rangecoding"
+)
+
+// The decoder's output lags the encoder's input by the overlap
+const codecDelay = overlap
+
+// testSignal returns a few harmonics with a little noise, interleaved
+func testSignal(channels, samples int) []float32 {
+	random := rand.New(rand.NewSource(1)) //nolint:gosec
+	out := make([]float32, channels*samples)
+	for i := 0; i < samples; i++ {
+		for c := 0; c < channels; c++ {
+			t := float64(i) / sampleRate
+			value := 0.3*math.Sin(2*math.Pi*220*t+float64(c)) +
+				0.15*math.Sin(2*math.Pi*660*t) +
+				0.05*math.Sin(2*math.Pi*3100*t*float64(c+1)) +
+				0.01*random.NormFloat64()
+			out[i*channels+c] = float32(value)
+		}
+	}
+	return out
+}
+
+// roundTrip encodes and decodes in with frames of frameSize, and returns
+// the decoded samples and the sizes of the frames
+func roundTrip(t *testing.T, encoder *Encoder, in []float32, channels, frameSize, maxBytes int) ([]float32, []int) {
+	t.Helper()
+
+	decoder, err := NewDecoder(channels)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	out := make([]float32, len(in))
+	var sizes []int
+	for offset := 0; offset+frameSize*channels <= len(in); offset += frameSize * channels {
+		frame, err := encoder.Encode(in[offset:offset+frameSize*channels], maxBytes)
+		if err != nil {
+			t.Fatal(err)
+		}
+		sizes = append(sizes, len(frame))
+
+		if err := decoder.Decode(frame, out[offset:offset+frameSize*channels], channels == 2, frameSize, bandCount); err != nil {
+			t.Fatalf("frame %d: %v", len(sizes)-1, err)
+		}
+		if decoder.FinalRange() != encoder.FinalRange() {
+			t.Fatalf("frame %d: final range %08x, expected %08x", len(sizes)-1, decoder.FinalRange(), encoder.FinalRange())
+		}
+	}
+	return out, sizes
+}
+
+// snr returns the signal to noise ratio in dB of out against in, skipping
+// the first frames while the codec converges
+func snr(in, out []float32, channels, skip int) float64 {
+	var signal, noise float64
+	for i := skip * channels; i+codecDelay*channels < len(out); i++ {
+		expected := float64(in[i])
+		difference := float64(out[i+codecDelay*channels]) - expected
+		signal += expected * expected
+		noise += difference * difference
+	}
+	return 10 * math.Log10(signal/noise)
+}
+
+func TestEncoder_RoundTrip(t *testing.T) {
+	for _, channels := range []int{1, 2} {
+		for lm := 0; lm <= maxLM; lm++ {
+			frameSize := shortBlockSize << lm
+			in := testSignal(channels, 9600)
+
+			encoder, err := NewEncoder(channels)
+			if err != nil {
+				t.Fatal(err)
+			}
+			encoder.SetBitrate(96000 * channels)
+
+			out, _ := roundTrip(t, encoder, in, channels, frameSize, maxFrameBytes)
+			if ratio := snr(in, out, channels, 1920); ratio < 15 {
+				t.Errorf("%d channels, LM=%d: SNR of %.1f dB", channels, lm, ratio)
+			}
+		}
+	}
+}
+
+// harmonicSignal returns a 220 Hz tone with its first harmonics, which
+// the pitch pre-filter should pick up, interleaved
+func harmonicSignal(channels, samples int) []float32 {
+	out := make([]float32, channels*samples)
+	for i := 0; i < samples; i++ {
+		t := float64(i) / sampleRate
+		value := 0.3*math.Sin(2*math.Pi*220*t) + 0.2*math.Sin(2*math.Pi*440*t) + 0.1*math.Sin(2*math.Pi*660*t)
+		for c := 0; c < channels; c++ {
+			out[i*channels+c] = float32(value)
+		}
+	}
+	return out
+}
+
+func TestEncoder_FrameSizes(t *testing.T) {
+	for _, channels := range []int{1, 2} {
+		for lm := 0; lm <= maxLM; lm++ {
+			frameSize := shortBlockSize << lm
+			in := testSignal(channels, 9600)
+			expected := 64000 * channels * frameSize / (8 * sampleRate)
+
+			encoder, err := NewEncoder(channels)
+			if err != nil {
+				t.Fatal(err)
+			}
+			encoder.SetBitrate(64000 * channels)
+			_, sizes := roundTrip(t, encoder, in, channels, frameSize, maxFrameBytes)
+			for i, size := range sizes {
+				if size != expected {
+					t.Fatalf("%d channels, LM=%d: CBR frame %d of %d bytes, expected %d", channels, lm, i, size, expected)
+				}
+			}
+
+			// Unconstrained VBR doesn't correct its drift from the bitrate
+			for constrained, tolerance := range map[bool]float64{true: 0.1, false: 0.15} {
+				encoder.Reset()
+				encoder.SetVBR(true)
+				encoder.SetVBRConstraint(constrained)
+				_, sizes = roundTrip(t, encoder, in, channels, frameSize, maxFrameBytes)
+				total, varies := 0, false
+				for _, size := range sizes {
+					total += size
+					varies = varies || size != sizes[0]
+				}
+				if !varies {
+					t.Errorf("%d channels, LM=%d, constrained %t: VBR frames all of %d bytes", channels, lm, constrained, sizes[0])
+				}
+				if average := float64(total) / float64(len(sizes)); math.Abs(average-float64(expected)) > tolerance*float64(expected) {
+					t.Errorf("%d channels, LM=%d, constrained %t: VBR frames of %.1f bytes on average, expected about %d",
+						channels, lm, constrained, average, expected)
+				}
+			}
+		}
+	}
+}
+
+func TestEncoder_Prefilter(t *testing.T) {
+	in := harmonicSignal(1, 9600)
+	encoder, err := NewEncoder(1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	encoder.SetBitrate(64000)
+
+	decoder, err := NewDecoder(1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	out := make([]float32, 960)
+	for offset := 0; offset+960 <= len(in); offset += 960 {
+		frame, err := encoder.Encode(in[offset:offset+960], maxFrameBytes)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := decoder.Decode(frame, out, false, 960, bandCount); err != nil {
+			t.Fatal(err)
+		}
+		if decoder.postfilter != encoder.prefilter {
+			t.Fatalf("post-filter %+v, expected %+v", decoder.postfilter, encoder.prefilter)
+		}
+	}
+
+	// 48000 / 220 = 218.2 samples
+	if encoder.prefilter.gain == 0 || iabs(encoder.prefilter.period-218) > 2 {
+		t.Errorf("pre-filter %+v, expected a period of about 218", encoder.prefilter)
+	}
+}
+
+func TestEncoder_Silence(t *testing.T) {
+	encoder, err := NewEncoder(2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	encoder.SetBitrate(64000)
+	encoder.SetVBR(true)
+
+	out, sizes := roundTrip(t, encoder, make([]float32, 2*4800), 2, 960, maxFrameBytes)
+	for i, size := range sizes {
+		if size > 2 {
+			t.Errorf("silent VBR frame %d of %d bytes", i, size)
+		}
+	}
+	for i, sample := range out {
+		if sample != 0 {
+			t.Fatalf("sample %d of silence decoded as %v", i, sample)
+		}
+	}
+}
+
+func TestEncoder_EncodeWithRange(t *testing.T) {
+	const (
+		channels    = 2
+		frameSize   = 960
+		frameLength = 100
+		startBand   = 17
+	)
+	in := testSignal(channels, 4*frameSize)
+
+	for _, vbr := range []bool{false, true} {
+		encoder, err := NewEncoder(channels)
+		if err != nil {
+			t.Fatal(err)
+		}
+		decoder, err := NewDecoder(channels)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		// The CELT layer of hybrid frames uses unconstrained VBR at the
+		// bitrate left over by the SILK layer
+		if vbr {
+			encoder.SetBitrate(16000)
+			encoder.SetVBR(true)
+			encoder.SetVBRConstraint(false)
+		}
+
+		out := make([]float32, channels*frameSize)
+		for offset := 0; offset < len(in); offset += channels * frameSize {
+			// The symbols of the SILK layer come first
+			rangeEncoder := &rangecoding.Encoder{}
+			rangeEncoder.Init(make([]byte, frameLength))
+			rangeEncoder.EncodeUniform(1234, 5000)
+			silkBits := int(rangeEncoder.Tell())
+			if err := encoder.EncodeWithRange(rangeEncoder, frameLength, in[offset:offset+channels*frameSize], startBand); err != nil {
+				t.Fatal(err)
+			}
+			frame, err := rangeEncoder.Done()
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			switch {
+			case !vbr && len(frame) != frameLength:
+				t.Fatalf("CBR frame of %d bytes, expected %d", len(frame), frameLength)
+			case vbr && (len(frame) >= frameLength || 8*len(frame) < silkBits+37):
+				t.Fatalf("VBR frame of %d bytes, expected less than %d and at least 37 bits of CELT", len(frame), frameLength)
+			}
+
+			rangeDecoder := &rangecoding.Decoder{}
+			rangeDecoder.Init(frame)
+			if value := rangeDecoder.DecodeUniform(5000); value != 1234 {
+				t.Fatalf("SILK symbol decoded as %d", value)
+			}
+			if err := decoder.DecodeWithRange(rangeDecoder, len(frame), out, true, frameSize, startBand, bandCount); err != nil {
+				t.Fatal(err)
+			}
+			if decoder.FinalRange() != encoder.FinalRange() {
+				t.Fatalf("final range %08x, expected %08x", decoder.FinalRange(), encoder.FinalRange())
+			}
+		}
+
+		if err := encoder.EncodeWithRange(&rangecoding.Encoder{}, frameLength, in[:channels*frameSize], bandCount); !errors.Is(err, errInvalidBandRange) {
+			t.Errorf("start band %d: %v, expected %v", bandCount, err, errInvalidBandRange)
+		}
+	}
+}
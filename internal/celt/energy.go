@@ -0,0 +1,262 @@
+package celt
+
+import (
+	"math"
+
+	"github.com/pion/opus/internal/rangecoding"
+)
+
+// The coarse energy is predicted from the previous frame with
+// predictionCoefficients and from the previous band with a filter whose
+// pole is 1 - betaCoefficients, for each LM. Intra frames only use the
+// previous band.
+//
+// https://datatracker.ietf.org/doc/html/rfc6716#section-4.3.2.1
+var (
+	predictionCoefficients = [maxLM + 1]float64{29440.0 / 32768, 26112.0 / 32768, 21248.0 / 32768, 16384.0 / 32768}
+	betaCoefficients       = [maxLM + 1]float64{30147.0 / 32768, 22282.0 / 32768, 12124.0 / 32768, 6554.0 / 32768}
+)
+
+const (
+	betaIntra = 4915.0 / 32768
+
+	// Energies are kept above minimumEnergy, about -170 dB, and predicted
+	// from at least minimumPredictionEnergy
+	minimumEnergy           = -28
+	minimumPredictionEnergy = -9
+)
+
+// smallEnergyICDF codes a coarse energy residual of 0, -1 or 1 when too
+// few bits are left for the Laplace distribution.
+var smallEnergyICDF = []uint{4, 2, 3, 4}
+
+// energyCoefficients returns the prediction coefficients of a frame.
+func energyCoefficients(lm int, intra bool) (alpha, beta float64) {
+	if intra {
+		return 0, betaIntra
+	}
+	return predictionCoefficients[lm], betaCoefficients[lm]
+}
+
+// decodeCoarseEnergy decodes the coarse energy of each band, in whole
+// units of the base 2 logarithm of its amplitude, as the residual of a
+// prediction from the previous frame and band, like
+// unquant_coarse_energy() (quant_bands.c).
+//
+// https://datatracker.ietf.org/doc/html/rfc6716#section-4.3.2.1
+func decodeCoarseEnergy(decoder *rangecoding.Decoder, energies *[2][bandCount]float64, start, end int, intra bool, channels, lm, budget int) {
+	intraIndex := 0
+	if intra {
+		intraIndex = 1
+	}
+	model := &energyProbabilityModel[lm][intraIndex]
+	alpha, beta := energyCoefficients(lm, intra)
+
+	var previous [2]float64
+	for i := start; i < end; i++ {
+		for c := 0; c < channels; c++ {
+			var qi int
+			switch remaining := budget - int(decoder.Tell()); {
+			case remaining >= 15:
+				pi := 2 * imin(i, 20)
+				qi = int(decoder.DecodeLaplace(model[pi]<<7, model[pi+1]<<6))
+			case remaining >= 2:
+				qi = int(decoder.DecodeSymbolWithICDF(smallEnergyICDF))
+				qi = (qi >> 1) ^ -(qi & 1)
+			case remaining >= 1:
+				qi = -int(decoder.DecodeSymbolLogP(1))
+			default:
+				qi = -1
+			}
+			q := float64(qi)
+
+			old := math.Max(minimumPredictionEnergy, energies[c][i])
+			energies[c][i] = math.Max(minimumEnergy, alpha*old+previous[c]+q)
+			previous[c] += q - beta*q
+		}
+	}
+}
+
+// encodeCoarseEnergy is the encoder side of decodeCoarseEnergy, like
+// quant_coarse_energy_impl() (quant_bands.c). It leaves the part of each
+// energy the fine energy has to code in residuals. The decay of the
+// energy from the previous frame is limited to maxDecay, which keeps
+// the prediction from costing too many bits at low rates.
+func encodeCoarseEnergy(
+	encoder *rangecoding.Encoder,
+	targets, energies, residuals *[2][bandCount]float64,
+	start, end int,
+	intra bool,
+	channels, lm, budget int,
+	maxDecay float64,
+) {
+	if int(encoder.Tell())+3 <= budget {
+		intraSymbol := uint32(0)
+		if intra {
+			intraSymbol = 1
+		}
+		encoder.EncodeSymbolLogP(3, intraSymbol)
+	}
+
+	intraIndex := 0
+	if intra {
+		intraIndex = 1
+	}
+	model := &energyProbabilityModel[lm][intraIndex]
+	alpha, beta := energyCoefficients(lm, intra)
+
+	var previous [2]float64
+	for i := start; i < end; i++ {
+		for c := 0; c < channels; c++ {
+			x := targets[c][i]
+			old := math.Max(minimumPredictionEnergy, energies[c][i])
+
+			// Prediction error
+			f := x - alpha*old - previous[c]
+			qi := int(math.Floor(f + 0.5))
+
+			// Don't let the energy drop faster than maxDecay
+			decayBound := math.Max(minimumEnergy, energies[c][i]-maxDecay)
+			if qi < 0 && x < decayBound {
+				qi = imin(0, qi+int(decayBound-x))
+			}
+
+			// Keep enough bits for the remaining bands
+			tell := int(encoder.Tell())
+			bitsLeft := budget - tell - 3*channels*(end-i)
+			if i != start && bitsLeft < 30 {
+				if bitsLeft < 24 {
+					qi = imin(1, qi)
+				}
+				if bitsLeft < 16 {
+					qi = imax(-1, qi)
+				}
+			}
+
+			switch remaining := budget - tell; {
+			case remaining >= 15:
+				pi := 2 * imin(i, 20)
+				qi = int(encoder.EncodeLaplace(int32(qi), model[pi]<<7, model[pi+1]<<6))
+			case remaining >= 2:
+				qi = imax(-1, imin(qi, 1))
+				symbol := 2 * qi
+				if qi < 0 {
+					symbol = -symbol - 1
+				}
+				encoder.EncodeSymbolWithICDF(smallEnergyICDF, uint32(symbol))
+			case remaining >= 1:
+				qi = imin(0, qi)
+				encoder.EncodeSymbolLogP(1, uint32(-qi))
+			default:
+				qi = -1
+			}
+			q := float64(qi)
+
+			residuals[c][i] = f - q
+			energies[c][i] = math.Max(minimumEnergy, alpha*old+previous[c]+q)
+			previous[c] += q - beta*q
+		}
+	}
+}
+
+// decodeFineEnergy refines the energy of each band by fineBits raw bits,
+// like unquant_fine_energy() (quant_bands.c).
+//
+// https://datatracker.ietf.org/doc/html/rfc6716#section-4.3.2.2
+func decodeFineEnergy(decoder *rangecoding.Decoder, energies *[2][bandCount]float64, start, end int, fineBits *[bandCount]int, channels int) {
+	for i := start; i < end; i++ {
+		if fineBits[i] <= 0 {
+			continue
+		}
+		for c := 0; c < channels; c++ {
+			q2 := decoder.DecodeRawBits(uint(fineBits[i]))
+			energies[c][i] += fineEnergyOffset(int(q2), fineBits[i])
+		}
+	}
+}
+
+// encodeFineEnergy is the encoder side of decodeFineEnergy, like
+// quant_fine_energy() (quant_bands.c).
+func encodeFineEnergy(encoder *rangecoding.Encoder, energies, residuals *[2][bandCount]float64, start, end int, fineBits *[bandCount]int, channels int) {
+	for i := start; i < end; i++ {
+		if fineBits[i] <= 0 {
+			continue
+		}
+		steps := 1 << fineBits[i]
+		for c := 0; c < channels; c++ {
+			q2 := imax(0, imin(steps-1, int(math.Floor((residuals[c][i]+0.5)*float64(steps)))))
+			encoder.EncodeRawBits(uint32(q2), uint(fineBits[i]))
+
+			offset := fineEnergyOffset(q2, fineBits[i])
+			energies[c][i] += offset
+			residuals[c][i] -= offset
+		}
+	}
+}
+
+// fineEnergyOffset returns the center of step q2 of the 2^bits steps
+// that split the unit between -1/2 and 1/2.
+func fineEnergyOffset(q2, bits int) float64 {
+	return (float64(q2)+0.5)/float64(int(1)<<bits) - 0.5
+}
+
+// decodeEnergyFinalise spends the bits left at the end of the frame on
+// one more bit of fine energy for the bands that can take it, first
+// those whose fine energy was rounded down, like
+// unquant_energy_finalise() (quant_bands.c).
+//
+// https://datatracker.ietf.org/doc/html/rfc6716#section-4.3.2.2
+func decodeEnergyFinalise(
+	decoder *rangecoding.Decoder,
+	energies *[2][bandCount]float64,
+	start, end int,
+	fineBits, finePriority *[bandCount]int,
+	bitsLeft, channels int,
+) {
+	for priority := 0; priority < 2; priority++ {
+		for i := start; i < end && bitsLeft >= channels; i++ {
+			if fineBits[i] >= maxFineBits || finePriority[i] != priority {
+				continue
+			}
+			for c := 0; c < channels; c++ {
+				q2 := decoder.DecodeRawBits(1)
+				energies[c][i] += finalFineEnergyOffset(int(q2), fineBits[i])
+				bitsLeft--
+			}
+		}
+	}
+}
+
+// encodeEnergyFinalise is the encoder side of decodeEnergyFinalise, like
+// quant_energy_finalise() (quant_bands.c).
+func encodeEnergyFinalise(
+	encoder *rangecoding.Encoder,
+	energies, residuals *[2][bandCount]float64,
+	start, end int,
+	fineBits, finePriority *[bandCount]int,
+	bitsLeft, channels int,
+) {
+	for priority := 0; priority < 2; priority++ {
+		for i := start; i < end && bitsLeft >= channels; i++ {
+			if fineBits[i] >= maxFineBits || finePriority[i] != priority {
+				continue
+			}
+			for c := 0; c < channels; c++ {
+				q2 := 0
+				if residuals[c][i] >= 0 {
+					q2 = 1
+				}
+				encoder.EncodeRawBits(uint32(q2), 1)
+
+				offset := finalFineEnergyOffset(q2, fineBits[i])
+				energies[c][i] += offset
+				residuals[c][i] -= offset
+				bitsLeft--
+			}
+		}
+	}
+}
+
+func finalFineEnergyOffset(q2, bits int) float64 {
+	return (float64(q2) - 0.5) / float64(int(1)<<(bits+1))
+}
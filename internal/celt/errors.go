@@ -0,0 +1,13 @@
+package celt
+
+import "errors"
+
+var (
+	errInvalidFrameSize       = errors.New("celt frames must be 2.5, 5, 10 or 20 ms at 48 kHz")
+	errInvalidChannelCount    = errors.New("celt supports one or two channels")
+	errPulseCodebookTooLarge  = errors.New("pvq codebook does not fit in 32 bits")
+	errInvalidPulseDimensions = errors.New("pvq needs at least two dimensions and one pulse")
+	errInvalidBandRange       = errors.New("celt coded bands must be a non-empty range of the 21 bands")
+	errOutBufferTooSmall      = errors.New("out isn't large enough")
+	errFrameTooSmall          = errors.New("celt frames need at least two bytes")
+)
@@ -0,0 +1,165 @@
+package celt
+
+import (
+	"math"
+	"math/cmplx"
+)
+
+// window is the rising half of the low-overlap window, which satisfies
+// the Princen-Bradley condition w[i]^2 + w[overlap-1-i]^2 = 1. The window
+// is flat between the overlaps, and zero outside of them.
+//
+// https://datatracker.ietf.org/doc/html/rfc6716#section-4.3.7
+var window = func() [overlap]float64 {
+	var w [overlap]float64
+	for i := range w {
+		s := math.Sin(0.5 * math.Pi * (float64(i) + 0.5) / overlap)
+		w[i] = math.Sin(0.5 * math.Pi * s * s)
+	}
+	return w
+}()
+
+// computeMDCT transforms the frameSize+overlap samples of in, of which
+// the first overlap belong to the previous frame, into frameSize
+// coefficients. A transient frame is split into 2^LM short blocks, whose
+// coefficients are interleaved so that each band holds the same
+// frequencies of every block.
+func computeMDCT(in []float64, frameSize int, shortBlocks bool) []float64 {
+	if !shortBlocks {
+		return mdct(in, frameSize)
+	}
+
+	blocks := frameSize / shortBlockSize
+	out := make([]float64, frameSize)
+	for b := 0; b < blocks; b++ {
+		coefficients := mdct(in[b*shortBlockSize:b*shortBlockSize+shortBlockSize+overlap], shortBlockSize)
+		for k, coefficient := range coefficients {
+			out[b+k*blocks] = coefficient
+		}
+	}
+	return out
+}
+
+// mdct computes
+//
+//	X[k] = sum z[n]*cos(pi/N*(n + 1/2 + N/2)*(k + 1/2))
+//
+// for the 2N samples z, the n+overlap samples of in windowed and centered
+// between zeros. The windowed samples are folded into a DCT-IV of N
+// samples, which is computed with a complex FFT of N/2 points.
+func mdct(in []float64, n int) []float64 {
+	z := make([]float64, 2*n)
+	offset := (n - overlap) / 2
+	for i, sample := range in {
+		switch {
+		case i < overlap:
+			sample *= window[i]
+		case i >= n:
+			sample *= window[n+overlap-1-i]
+		}
+		z[offset+i] = sample
+	}
+
+	// Fold the quarters a, b, c, d of z into (-c_r - d, a - b_r), where _r
+	// is the reverse
+	half := n / 2
+	u := make([]float64, n)
+	for m := 0; m < half; m++ {
+		u[m] = -z[3*half-1-m] - z[3*half+m]
+		u[half+m] = z[m] - z[n-1-m]
+	}
+
+	return dctIV(u)
+}
+
+// dctIV computes X[k] = sum u[n]*cos(pi/N*(n + 1/2)*(k + 1/2)) by pairing
+// even and reversed odd samples into N/2 complex values, so that
+//
+//	X[2k] - i*X[N-1-2k] = sum v[m]*exp(-i*pi/N*(2m + 1/2)*(2k + 1/2))
+//
+// which is a pre-twiddle, an FFT and a post-twiddle.
+func dctIV(u []float64) []float64 {
+	n := len(u)
+	v := make([]complex128, n/2)
+	for m := range v {
+		v[m] = complex(u[2*m], u[n-1-2*m]) * cmplx.Exp(complex(0, -math.Pi*(float64(m)+0.25)/float64(n)))
+	}
+
+	out := make([]float64, n)
+	for k, value := range fft(v) {
+		value *= cmplx.Exp(complex(0, -math.Pi*float64(k)/float64(n)))
+		out[2*k] = real(value)
+		out[n-1-2*k] = -imag(value)
+	}
+	return out
+}
+
+// fft is a recursive mixed radix FFT. CELT frame sizes only have the
+// factors 2, 3 and 5.
+func fft(x []complex128) []complex128 {
+	n := len(x)
+	if n == 1 {
+		return []complex128{x[0]}
+	}
+
+	radix := 2
+	for n%radix != 0 {
+		radix++
+	}
+
+	// Transform the radix decimated subsequences, then combine them
+	length := n / radix
+	subsequences := make([][]complex128, radix)
+	for r := range subsequences {
+		subsequence := make([]complex128, length)
+		for j := range subsequence {
+			subsequence[j] = x[r+radix*j]
+		}
+		subsequences[r] = fft(subsequence)
+	}
+
+	out := make([]complex128, n)
+	for k := range out {
+		for r, subsequence := range subsequences {
+			out[k] += subsequence[k%length] * cmplx.Exp(complex(0, -2*math.Pi*float64(r*k)/float64(n)))
+		}
+	}
+	return out
+}
+
+// imdct is the inverse of mdct. It returns the n+overlap windowed
+// samples of
+//
+//	y[i] = sum X[k]*cos(pi/N*(i + 1/2 + N/2)*(k + 1/2))
+//
+// that overlap-add with those of the neighbouring frames. The DCT-IV of
+// the coefficients gives y by symmetry, as it's its own inverse up to a
+// factor of 2/N.
+func imdct(coefficients []float64) []float64 {
+	n := len(coefficients)
+	half := n / 2
+	u := dctIV(coefficients)
+
+	out := make([]float64, n+overlap)
+	offset := (n - overlap) / 2
+	for t := range out {
+		var sample float64
+		switch i := offset + t; {
+		case i < half:
+			sample = u[i+half]
+		case i < 3*half:
+			sample = -u[3*half-1-i]
+		default:
+			sample = -u[i-3*half]
+		}
+
+		switch {
+		case t < overlap:
+			sample *= window[t]
+		case t >= n:
+			sample *= window[n+overlap-1-t]
+		}
+		out[t] = sample
+	}
+	return out
+}
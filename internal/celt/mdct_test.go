@@ -0,0 +1,131 @@
+package celt
+
+import (
+	"math"
+	"math/rand"
+	"testing"
+)
+
+// directMDCT windows in and computes the MDCT from its definition
+func directMDCT(in []float64, n int) []float64 {
+	z := make([]float64, 2*n)
+	for i, sample := range in {
+		switch {
+		case i < overlap:
+			sample *= window[i]
+		case i >= n:
+			sample *= window[n+overlap-1-i]
+		}
+		z[(n-overlap)/2+i] = sample
+	}
+
+	out := make([]float64, n)
+	for k := range out {
+		for i, sample := range z {
+			out[k] += sample * math.Cos(math.Pi/float64(n)*(float64(i)+0.5+float64(n)/2)*(float64(k)+0.5))
+		}
+	}
+	return out
+}
+
+// inverseMDCT returns the windowed aliased n+overlap samples of a frame,
+// that overlap-add with those of its neighbours to the input
+func inverseMDCT(coefficients []float64) []float64 {
+	n := len(coefficients)
+	out := make([]float64, n+overlap)
+	for i := range out {
+		position := (n-overlap)/2 + i
+		for k, coefficient := range coefficients {
+			out[i] += coefficient * math.Cos(math.Pi/float64(n)*(float64(position)+0.5+float64(n)/2)*(float64(k)+0.5))
+		}
+		out[i] *= 2 / float64(n)
+
+		switch {
+		case i < overlap:
+			out[i] *= window[i]
+		case i >= n:
+			out[i] *= window[n+overlap-1-i]
+		}
+	}
+	return out
+}
+
+func TestMDCT(t *testing.T) {
+	random := rand.New(rand.NewSource(1)) //nolint:gosec
+	for lm := 0; lm <= maxLM; lm++ {
+		n := shortBlockSize << lm
+		in := make([]float64, n+overlap)
+		for i := range in {
+			in[i] = random.NormFloat64()
+		}
+
+		expected := directMDCT(in, n)
+		for k, coefficient := range mdct(in, n) {
+			if math.Abs(coefficient-expected[k]) > 1e-9 {
+				t.Fatalf("N=%d: coefficient %d is %f, expected %f", n, k, coefficient, expected[k])
+			}
+		}
+	}
+}
+
+func TestMDCT_Reconstruction(t *testing.T) {
+	random := rand.New(rand.NewSource(1)) //nolint:gosec
+	const n, frames = 480, 4
+	signal := make([]float64, overlap+n*frames)
+	for i := range signal {
+		signal[i] = random.NormFloat64()
+	}
+
+	// Each sample past the first overlap is covered by two frames or by
+	// the flat part of one
+	output := make([]float64, len(signal))
+	for frame := 0; frame < frames; frame++ {
+		for i, sample := range inverseMDCT(mdct(signal[frame*n:frame*n+n+overlap], n)) {
+			output[frame*n+i] += sample
+		}
+	}
+
+	for i := overlap; i < frames*n; i++ {
+		if math.Abs(output[i]-signal[i]) > 1e-9 {
+			t.Fatalf("sample %d is %f, expected %f", i, output[i], signal[i])
+		}
+	}
+}
+
+func TestComputeMDCT_ShortBlocks(t *testing.T) {
+	random := rand.New(rand.NewSource(1)) //nolint:gosec
+	const frameSize = 960
+	in := make([]float64, frameSize+overlap)
+	for i := range in {
+		in[i] = random.NormFloat64()
+	}
+
+	blocks := frameSize / shortBlockSize
+	out := computeMDCT(in, frameSize, true)
+	for b := 0; b < blocks; b++ {
+		expected := mdct(in[b*shortBlockSize:b*shortBlockSize+shortBlockSize+overlap], shortBlockSize)
+		for k := range expected {
+			if out[b+k*blocks] != expected[k] {
+				t.Fatalf("block %d coefficient %d is %f, expected %f", b, k, out[b+k*blocks], expected[k])
+			}
+		}
+	}
+}
+
+func TestIMDCT(t *testing.T) {
+	random := rand.New(rand.NewSource(1)) //nolint:gosec
+	for lm := 0; lm <= maxLM; lm++ {
+		n := shortBlockSize << lm
+		coefficients := make([]float64, n)
+		for i := range coefficients {
+			coefficients[i] = random.NormFloat64()
+		}
+
+		expected := inverseMDCT(coefficients)
+		for i, sample := range imdct(coefficients) {
+			if expected := expected[i] * float64(n) / 2; math.Abs(sample-expected) > 1e-9 {
+				t.Fatalf("N=%d: sample %d is %f, expected %f", n, i, sample, expected)
+			}
+		}
+	}
+}
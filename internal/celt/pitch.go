@@ -0,0 +1,307 @@
+package celt
+
+import "math"
+
+// pitchDownsample low-passes the sum of the channels of a signal,
+// decimates it by 2 and whitens it with a 4th order LPC filter, for the
+// pitch search, like pitch_downsample() (pitch.c).
+func pitchDownsample(channels [][]float64, offset, length int) []float64 {
+	half := length >> 1
+	lowpassed := make([]float64, half)
+	for _, x := range channels {
+		x = x[offset : offset+length]
+		lowpassed[0] += 0.5 * (0.5*x[1] + x[0])
+		for i := 1; i < half; i++ {
+			lowpassed[i] += 0.5 * (0.5*(x[2*i-1]+x[2*i+1]) + x[2*i])
+		}
+	}
+
+	ac := autocorrelation(lowpassed, nil, 4)
+
+	// Noise floor -40 dB
+	ac[0] *= 1.0001
+
+	// Lag windowing
+	for i := 1; i <= 4; i++ {
+		ac[i] -= ac[i] * (0.008 * float64(i)) * (0.008 * float64(i))
+	}
+
+	lpc := levinsonDurbin(ac, 4)
+	g := 1.0
+	for i := range lpc {
+		g *= 0.9
+		lpc[i] *= g
+	}
+
+	// Add a zero
+	const c1 = 0.8
+	coefficients := [5]float64{
+		lpc[0] + c1,
+		lpc[1] + c1*lpc[0],
+		lpc[2] + c1*lpc[1],
+		lpc[3] + c1*lpc[2],
+		c1 * lpc[3],
+	}
+
+	var memory [5]float64
+	for i, sample := range lowpassed {
+		sum := sample
+		for j, coefficient := range coefficients {
+			sum += coefficient * memory[j]
+		}
+		copy(memory[1:], memory[:4])
+		memory[0] = sample
+		lowpassed[i] = sum
+	}
+	return lowpassed
+}
+
+// pitchSearch returns the lag, from 0 to maxPitch, at which y best
+// correlates with the length samples of x, searching at a quarter then
+// half of the rate of the downsampled signals, like pitch_search()
+// (pitch.c). y holds length+maxPitch samples.
+func pitchSearch(x, y []float64, length, maxPitch int) int {
+	// Coarse search with 4x decimation
+	x4 := make([]float64, length>>2)
+	for j := range x4 {
+		x4[j] = x[2*j]
+	}
+	y4 := make([]float64, (length+maxPitch)>>2)
+	for j := range y4 {
+		y4[j] = y[2*j]
+	}
+
+	xcorr := make([]float64, maxPitch>>1)
+	for i := 0; i < maxPitch>>2; i++ {
+		xcorr[i] = innerProduct(x4, y4[i:], length>>2)
+	}
+	best := findBestPitch(xcorr[:maxPitch>>2], y4, length>>2)
+
+	// Finer search with 2x decimation
+	for i := range xcorr {
+		xcorr[i] = 0
+		if iabs(i-2*best[0]) > 2 && iabs(i-2*best[1]) > 2 {
+			continue
+		}
+		xcorr[i] = math.Max(-1, innerProduct(x, y[i:], length>>1))
+	}
+	best = findBestPitch(xcorr, y, length>>1)
+
+	// Refine by pseudo-interpolation
+	offset := 0
+	if best[0] > 0 && best[0] < (maxPitch>>1)-1 {
+		a, b, c := xcorr[best[0]-1], xcorr[best[0]], xcorr[best[0]+1]
+		if c-a > 0.7*(b-a) {
+			offset = 1
+		} else if a-c > 0.7*(b-c) {
+			offset = -1
+		}
+	}
+	return 2*best[0] - offset
+}
+
+// findBestPitch returns the two lags with the highest normalized
+// correlation, like find_best_pitch() (pitch.c).
+func findBestPitch(xcorr, y []float64, length int) [2]int {
+	best := [2]int{0, 1}
+	bestNumerator := [2]float64{-1, -1}
+	bestDenominator := [2]float64{0, 0}
+
+	syy := 1.0
+	for j := 0; j < length; j++ {
+		syy += y[j] * y[j]
+	}
+
+	for i, correlation := range xcorr {
+		if correlation > 0 {
+			numerator := correlation * correlation
+			if numerator*bestDenominator[1] > bestNumerator[1]*syy {
+				if numerator*bestDenominator[0] > bestNumerator[0]*syy {
+					bestNumerator[1], bestDenominator[1], best[1] = bestNumerator[0], bestDenominator[0], best[0]
+					bestNumerator[0], bestDenominator[0], best[0] = numerator, syy, i
+				} else {
+					bestNumerator[1], bestDenominator[1], best[1] = numerator, syy, i
+				}
+			}
+		}
+		syy = math.Max(1, syy+y[i+length]*y[i+length]-y[i]*y[i])
+	}
+	return best
+}
+
+var secondCheck = [16]int{0, 0, 3, 2, 3, 2, 5, 2, 3, 2, 3, 2, 5, 2, 3, 2}
+
+// removeDoubling checks whether the period found by pitchSearch is a
+// multiple of the real one, by looking for a correlation as strong at
+// its submultiples, and returns the period and its gain, like
+// remove_doubling() (pitch.c). x is the downsampled signal, of
+// maxPeriod/2 samples of history before the n/2 samples analyzed.
+func removeDoubling(x []float64, maxPeriod, minPeriod, n, period, previousPeriod int, previousGain float64) (int, float64) {
+	minPeriod0 := minPeriod
+	maxPeriod /= 2
+	minPeriod /= 2
+	period /= 2
+	previousPeriod /= 2
+	n /= 2
+
+	if period >= maxPeriod {
+		period = maxPeriod - 1
+	}
+	t0 := period
+	t := t0
+
+	// The energy of the n samples ending i samples before the analysis
+	at := func(i int) []float64 { return x[maxPeriod-i:] }
+	xx := innerProduct(at(0), at(0), n)
+	xy := innerProduct(at(0), at(t0), n)
+	energies := make([]float64, maxPeriod+1)
+	energies[0] = xx
+	yy := xx
+	for i := 1; i <= maxPeriod; i++ {
+		yy += x[maxPeriod-i]*x[maxPeriod-i] - x[maxPeriod+n-i]*x[maxPeriod+n-i]
+		energies[i] = math.Max(0, yy)
+	}
+	yy = energies[t0]
+	bestXY, bestYY := xy, yy
+	g0 := pitchGain(xy, xx, yy)
+	g := g0
+
+	// Look for any pitch at T/k
+	for k := 2; k <= 15; k++ {
+		t1 := (2*t0 + k) / (2 * k)
+		if t1 < minPeriod {
+			break
+		}
+
+		// Look for another strong correlation at t1b
+		var t1b int
+		switch {
+		case k != 2:
+			t1b = (2*secondCheck[k]*t0 + k) / (2 * k)
+		case t1+t0 > maxPeriod:
+			t1b = t0
+		default:
+			t1b = t0 + t1
+		}
+
+		xy = 0.5 * (innerProduct(at(0), at(t1), n) + innerProduct(at(0), at(t1b), n))
+		yy = 0.5 * (energies[t1] + energies[t1b])
+		g1 := pitchGain(xy, xx, yy)
+
+		continuity := 0.0
+		if iabs(t1-previousPeriod) <= 1 {
+			continuity = previousGain
+		} else if iabs(t1-previousPeriod) <= 2 && 5*k*k < t0 {
+			continuity = 0.5 * previousGain
+		}
+
+		// Bias against very high pitch (very short period) to avoid
+		// false-positives due to short-term correlation
+		threshold := math.Max(0.3, 0.7*g0-continuity)
+		if t1 < 3*minPeriod {
+			threshold = math.Max(0.4, 0.85*g0-continuity)
+		} else if t1 < 2*minPeriod {
+			threshold = math.Max(0.5, 0.9*g0-continuity)
+		}
+
+		if g1 > threshold {
+			bestXY, bestYY = xy, yy
+			t = t1
+			g = g1
+		}
+	}
+
+	bestXY = math.Max(0, bestXY)
+	gain := 1.0
+	if bestYY > bestXY {
+		gain = bestXY / (bestYY + 1)
+	}
+
+	var xcorr [3]float64
+	for k := range xcorr {
+		xcorr[k] = innerProduct(at(0), at(t+k-1), n)
+	}
+	offset := 0
+	if xcorr[2]-xcorr[0] > 0.7*(xcorr[1]-xcorr[0]) {
+		offset = 1
+	} else if xcorr[0]-xcorr[2] > 0.7*(xcorr[1]-xcorr[2]) {
+		offset = -1
+	}
+
+	return imax(minPeriod0, 2*t+offset), math.Min(gain, g)
+}
+
+func pitchGain(xy, xx, yy float64) float64 {
+	return xy / math.Sqrt(1+xx*yy)
+}
+
+func innerProduct(x, y []float64, n int) float64 {
+	sum := 0.0
+	for i := 0; i < n; i++ {
+		sum += x[i] * y[i]
+	}
+	return sum
+}
+
+// autocorrelation returns the autocorrelation of x up to lag, after
+// windowing its ends with w, like _celt_autocorr() (celt_lpc.c).
+func autocorrelation(x, w []float64, lag int) []float64 {
+	if len(w) != 0 {
+		windowed := append([]float64(nil), x...)
+		for i, coefficient := range w {
+			windowed[i] *= coefficient
+			windowed[len(x)-i-1] *= coefficient
+		}
+		x = windowed
+	}
+
+	ac := make([]float64, lag+1)
+	for k := range ac {
+		for i := k; i < len(x); i++ {
+			ac[k] += x[i] * x[i-k]
+		}
+	}
+	return ac
+}
+
+// levinsonDurbin returns the coefficients a of the order p linear
+// predictor whose error e[i] = x[i] + sum a[j]*x[i-j-1] has the least
+// energy, from the autocorrelation of x, like _celt_lpc() (celt_lpc.c).
+func levinsonDurbin(ac []float64, p int) []float64 {
+	lpc := make([]float64, p)
+	predictionError := ac[0]
+	if predictionError == 0 {
+		return lpc
+	}
+
+	for i := 0; i < p; i++ {
+		// Sum up this iteration's reflection coefficient
+		rr := ac[i+1]
+		for j := 0; j < i; j++ {
+			rr += lpc[j] * ac[i-j]
+		}
+		r := -rr / predictionError
+
+		// Update LPC coefficients and total error
+		lpc[i] = r
+		for j := 0; j < (i+1)>>1; j++ {
+			tmp1, tmp2 := lpc[j], lpc[i-1-j]
+			lpc[j] = tmp1 + r*tmp2
+			lpc[i-1-j] = tmp2 + r*tmp1
+		}
+		predictionError -= r * r * predictionError
+
+		// Bail out once we get 30 dB gain
+		if predictionError < 0.001*ac[0] {
+			break
+		}
+	}
+	return lpc
+}
+
+func iabs(a int) int {
+	if a < 0 {
+		return -a
+	}
+	return a
+}
@@ -0,0 +1,207 @@
+package celt
+
+import "math"
+
+// Conceal synthesizes a frame of frameSize samples per channel for a
+// lost packet, like celt_decode_lost() (celt_decoder.c). The first
+// frames lost after two decoded ones extrapolate the last pitch period
+// of the output through an LPC filter, fading out. Later losses, and
+// hybrid frames, whose CELT layer starts at startBand, are filled with
+// noise at the decaying energy of the last frame, down to the
+// background noise. The band range may be empty, as it is for the CELT
+// layer of wideband hybrid frames, leaving only the overlap of the last
+// frame to fade out.
+//
+// https://datatracker.ietf.org/doc/html/rfc6716#section-4.4
+func (d *Decoder) Conceal(out []float32, frameSize, startBand, endBand int) error {
+	lm, err := d.validate(out, frameSize, 0, endBand)
+	if err != nil {
+		return err
+	} else if startBand < 0 || startBand > endBand {
+		return errInvalidBandRange
+	}
+
+	if d.lossCount >= maxPitchConcealments || startBand != 0 || d.skipConcealment {
+		d.concealWithNoise(startBand, endBand, lm)
+	} else {
+		d.concealWithPitch(frameSize)
+	}
+
+	d.deemphasize(out, frameSize)
+	d.lossCount++
+	return nil
+}
+
+func (d *Decoder) concealWithNoise(start, end, lm int) {
+	// Energy decay
+	decay := 0.5
+	if d.lossCount == 0 {
+		decay = 1.5
+	}
+
+	n := shortBlockSize << lm
+	shapes := make([][]float64, d.channels)
+	for c := range shapes {
+		for i := start; i < end; i++ {
+			d.energies[c][i] = math.Max(d.backgroundEnergy[c][i], d.energies[c][i]-decay)
+		}
+
+		shapes[c] = make([]float64, n)
+		for i := start; i < end; i++ {
+			band := shapes[c][bandEdges[i]<<lm : bandEdges[i+1]<<lm]
+			for j := range band {
+				d.seed = lcgRandom(d.seed)
+				band[j] = float64(int32(d.seed) >> 20)
+			}
+			renormaliseVector(band, 1)
+		}
+	}
+
+	d.synthesize(shapes, start, end, lm, false)
+}
+
+func (d *Decoder) concealWithPitch(n int) {
+	fade := 0.8
+	if d.lossCount == 0 {
+		downsampled := pitchDownsample(d.history[:d.channels], 0, decodeBufferSize)
+		d.concealmentPitch = maximumConcealmentPeriod - pitchSearch(
+			downsampled[maximumConcealmentPeriod>>1:],
+			downsampled,
+			decodeBufferSize-maximumConcealmentPeriod,
+			maximumConcealmentPeriod-minimumConcealmentPeriod,
+		)
+		fade = 1
+	}
+	period := d.concealmentPitch
+
+	// We want the excitation for 2 pitch periods in order to look for a
+	// decaying signal, but we can't get more than maximumPeriod
+	excitationLength := imin(2*period, maximumPeriod)
+
+	for c, history := range d.history[:d.channels] {
+		// The last maximumPeriod samples, after the lpcOrder that start
+		// the LPC filter
+		signal := history[decodeBufferSize-maximumPeriod-lpcOrder : decodeBufferSize]
+		if d.lossCount == 0 {
+			// Compute LPC coefficients for the last maximumPeriod samples
+			// before the first loss so we can work in the excitation-filter
+			// domain
+			ac := autocorrelation(signal[lpcOrder:], window[:], lpcOrder)
+
+			// Noise floor -40 dB
+			ac[0] *= 1.0001
+
+			// Lag windowing
+			for i := 1; i <= lpcOrder; i++ {
+				ac[i] -= ac[i] * (0.008 * float64(i)) * (0.008 * float64(i))
+			}
+			d.lpc[c] = levinsonDurbin(ac, lpcOrder)
+		}
+		lpc := d.lpc[c]
+
+		// The excitation of the region we extrapolate from
+		excitation := make([]float64, maximumPeriod)
+		for i := maximumPeriod - excitationLength; i < maximumPeriod; i++ {
+			sum := signal[lpcOrder+i]
+			for j, coefficient := range lpc {
+				sum += coefficient * signal[lpcOrder+i-j-1]
+			}
+			excitation[i] = sum
+		}
+
+		// Check if the waveform is decaying, and if so how fast. We do this
+		// to avoid adding energy when concealing in a segment with decaying
+		// energy.
+		e1, e2 := 1.0, 1.0
+		decayLength := excitationLength >> 1
+		for i := 0; i < decayLength; i++ {
+			e := excitation[maximumPeriod-decayLength+i]
+			e1 += e * e
+			e = excitation[maximumPeriod-2*decayLength+i]
+			e2 += e * e
+		}
+		decay := math.Sqrt(math.Min(e1, e2) / e2)
+
+		// Move the decoder memory one frame to the left to give us room to
+		// add the data for the new frame
+		copy(history, history[n:decodeBufferSize])
+
+		// Extrapolate from the end of the excitation with a period of
+		// "period", scaling down each period by an additional factor of
+		// "decay", over a complete MDCT window
+		extrapolationOffset := maximumPeriod - period
+		extrapolationLength := n + overlap
+		attenuation := fade * decay
+		extrapolated := history[decodeBufferSize-n:]
+		previousEnergy := 0.0
+		for i, j := 0, 0; i < extrapolationLength; i, j = i+1, j+1 {
+			if j >= period {
+				j -= period
+				attenuation *= decay
+			}
+			extrapolated[i] = attenuation * excitation[extrapolationOffset+j]
+
+			// The energy of the previously decoded signal whose excitation
+			// we're copying
+			sample := history[decodeBufferSize-maximumPeriod-n+extrapolationOffset+j]
+			previousEnergy += sample * sample
+		}
+
+		// Apply the synthesis filter to convert the excitation back into
+		// the signal domain
+		for i := range extrapolated {
+			sum := extrapolated[i]
+			for j, coefficient := range lpc {
+				sum -= coefficient * history[decodeBufferSize-n+i-j-1]
+			}
+			extrapolated[i] = sum
+		}
+
+		// Check if the synthesis energy is higher than expected, which can
+		// happen with the signal changes during our window. If so,
+		// attenuate.
+		energy := 0.0
+		for _, sample := range extrapolated {
+			energy += sample * sample
+		}
+		if !(previousEnergy > 0.2*energy) {
+			for i := range extrapolated {
+				extrapolated[i] = 0
+			}
+		} else if previousEnergy < energy {
+			ratio := math.Sqrt((previousEnergy + 1) / (energy + 1))
+			for i := range extrapolated {
+				gain := ratio
+				if i < overlap {
+					gain = 1 - window[i]*(1-ratio)
+				}
+				extrapolated[i] *= gain
+			}
+		}
+
+		// Apply the pre-filter to the MDCT overlap for the next frame
+		// because the post-filter will be re-applied in the decoder after
+		// the MDCT overlap
+		filter := postfilter{period: d.postfilter.period, gain: -d.postfilter.gain, tapset: d.postfilter.tapset}
+		filtered := make([]float64, decodeBufferSize+overlap)
+		copy(filtered, history)
+		combFilter(filtered, history, decodeBufferSize, overlap, filter, filter, 0)
+
+		// Simulate TDAC on the concealed audio so that it blends with the
+		// MDCT of the next frame
+		copy(history[decodeBufferSize:], aliasedOverlap(filtered[decodeBufferSize:]))
+	}
+}
+
+// aliasedOverlap returns what the inverse MDCT of a frame ending with
+// the overlap samples of in leaves for the next frame to overlap-add.
+func aliasedOverlap(in []float64) []float64 {
+	frame := make([]float64, shortBlockSize+overlap)
+	copy(frame[shortBlockSize:], in)
+
+	coefficients := mdct(frame, shortBlockSize)
+	for k := range coefficients {
+		coefficients[k] *= 2.0 / shortBlockSize
+	}
+	return imdct(coefficients)[shortBlockSize:]
+}
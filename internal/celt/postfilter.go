@@ -0,0 +1,119 @@
+package celt
+
+import (
+	"math/bits"
+
+	"github.com/pion/opus/internal/rangecoding"
+)
+
+const (
+	// Periods of the comb filter are at least minimumPeriod samples, and
+	// at most maximumPeriod-2, in 48 kHz samples
+	minimumPeriod = 15
+	maximumPeriod = 1024
+)
+
+// The three taps of the comb filter for each tapset, which are applied
+// at the period and symmetrically around it.
+//
+// https://datatracker.ietf.org/doc/html/rfc6716#section-4.3.7.1
+var combFilterTaps = [3][3]float64{
+	{0.3066406250, 0.2170410156, 0.1296386719},
+	{0.4638671875, 0.2680664062, 0},
+	{0.7998046875, 0.1000976562, 0},
+}
+
+var tapsetICDF = []uint{4, 2, 3, 4}
+
+// postfilter are the parameters of the pitch pre-filter of a frame, that
+// the decoder inverts with a post-filter.
+type postfilter struct {
+	period int
+	gain   float64
+	tapset int
+}
+
+// decodePostfilter decodes the period, gain and taps of the pitch
+// post-filter of a frame.
+//
+// https://datatracker.ietf.org/doc/html/rfc6716#section-4.3.7.1
+func decodePostfilter(decoder *rangecoding.Decoder, totalBits int) postfilter {
+	octave := int(decoder.DecodeUniform(6))
+	p := postfilter{
+		period: (16 << octave) + int(decoder.DecodeRawBits(uint(4+octave))) - 1,
+	}
+	p.gain = 0.09375 * float64(decoder.DecodeRawBits(3)+1)
+	if int(decoder.Tell())+2 <= totalBits {
+		p.tapset = int(decoder.DecodeSymbolWithICDF(tapsetICDF))
+	}
+	return p
+}
+
+// encodePostfilter is the encoder side of decodePostfilter. The gain is
+// coded as qg, from 0 to 7, for 0.09375*(qg+1).
+func encodePostfilter(encoder *rangecoding.Encoder, p postfilter, qg int) {
+	period := p.period + 1
+	octave := bits.Len(uint(period)) - 5
+	encoder.EncodeUniform(uint32(octave), 6)
+	encoder.EncodeRawBits(uint32(period-(16<<octave)), uint(4+octave))
+	encoder.EncodeRawBits(uint32(qg), 3)
+	encoder.EncodeSymbolWithICDF(tapsetICDF, uint32(p.tapset))
+}
+
+// combFilter computes the n samples of y from offset with
+//
+//	y[i] = x[i] + g*(t0*x[i-T] + t1*(x[i-T+1]+x[i-T-1]) + t2*(x[i-T+2]+x[i-T-2]))
+//
+// cross-fading over the first overlap samples from the filter of from to
+// that of to with the square of the window, like comb_filter()
+// (celt.c). x holds at least T+2 samples before offset. When x and y
+// are the same slice the filter is recursive, which is how the decoder
+// applies the post-filter, and the encoder applies the inverse pre-filter
+// with negated gains.
+//
+// https://datatracker.ietf.org/doc/html/rfc6716#section-4.3.7.1
+func combFilter(y, x []float64, offset, n int, from, to postfilter, overlap int) {
+	if from.gain == 0 && to.gain == 0 {
+		copy(y[offset:offset+n], x[offset:offset+n])
+		return
+	}
+
+	t0, t1 := imax(from.period, minimumPeriod), imax(to.period, minimumPeriod)
+	g00 := from.gain * combFilterTaps[from.tapset][0]
+	g01 := from.gain * combFilterTaps[from.tapset][1]
+	g02 := from.gain * combFilterTaps[from.tapset][2]
+	g10 := to.gain * combFilterTaps[to.tapset][0]
+	g11 := to.gain * combFilterTaps[to.tapset][1]
+	g12 := to.gain * combFilterTaps[to.tapset][2]
+
+	// Nothing to cross-fade if the filter didn't change
+	if from.gain == to.gain && t0 == t1 && from.tapset == to.tapset {
+		overlap = 0
+	}
+
+	i := 0
+	for ; i < overlap; i++ {
+		j := offset + i
+		f := window[i] * window[i]
+		y[j] = x[j] +
+			(1-f)*g00*x[j-t0] +
+			(1-f)*g01*(x[j-t0+1]+x[j-t0-1]) +
+			(1-f)*g02*(x[j-t0+2]+x[j-t0-2]) +
+			f*g10*x[j-t1] +
+			f*g11*(x[j-t1+1]+x[j-t1-1]) +
+			f*g12*(x[j-t1+2]+x[j-t1-2])
+	}
+
+	if to.gain == 0 {
+		copy(y[offset+i:offset+n], x[offset+i:offset+n])
+		return
+	}
+
+	for ; i < n; i++ {
+		j := offset + i
+		y[j] = x[j] +
+			g10*x[j-t1] +
+			g11*(x[j-t1+1]+x[j-t1-1]) +
+			g12*(x[j-t1+2]+x[j-t1-2])
+	}
+}
@@ -0,0 +1,403 @@
+package celt
+
+import (
+	"math"
+
+	"github.com/pion/opus/internal/rangecoding"
+)
+
+// Codebook sizes beyond 32 bits saturate at maxPulseCodebook while
+// counting, so that they can't overflow
+const maxPulseCodebook = uint64(1) << 40
+
+// pvqSearch finds the vector of k pulses, integers whose magnitudes sum
+// to k, closest in direction to x, like op_pvq_search_c() (vq.c). It
+// projects x on the pyramid to place most pulses, then adds the rest one
+// at a time where they most increase the correlation with x.
+//
+// https://datatracker.ietf.org/doc/html/rfc6716#section-4.3.4.1
+func pvqSearch(x []float64, k int) []int {
+	n := len(x)
+	pulses := make([]int, n)
+	magnitudes := make([]float64, n)
+	sum := 0.0
+	for i, value := range x {
+		magnitudes[i] = math.Abs(value)
+		sum += magnitudes[i]
+	}
+
+	// xy and yy are the correlation of the pulses with x and their energy
+	var xy, yy float64
+	pulsesLeft := k
+	if k > n/2 {
+		// A vector too small to project is replaced by a pulse at 0
+		if !(sum > transientEpsilon && sum < 64) {
+			for i := range magnitudes {
+				magnitudes[i] = 0
+			}
+			magnitudes[0], sum = 1, 1
+		}
+
+		// Projecting on k+0.8 rather than k+1 can't place more than k
+		// pulses
+		scale := (float64(k) + 0.8) / sum
+		for i, magnitude := range magnitudes {
+			pulses[i] = int(math.Floor(scale * magnitude))
+			xy += magnitude * float64(pulses[i])
+			yy += float64(pulses[i] * pulses[i])
+			pulsesLeft -= pulses[i]
+		}
+	}
+
+	// Only a silent x leaves this many pulses, which all go to the first
+	// bin
+	if pulsesLeft > n+3 {
+		yy += float64(pulsesLeft*pulsesLeft + 2*pulsesLeft*pulses[0])
+		pulses[0] += pulsesLeft
+		pulsesLeft = 0
+	}
+
+	for ; pulsesLeft > 0; pulsesLeft-- {
+		// Maximize xy/sqrt(yy) by comparing xy^2*bestYY with bestXY2*yy
+		best, bestXY2, bestYY := 0, -1.0, 1.0
+		for i, magnitude := range magnitudes {
+			candidateXY := xy + magnitude
+			candidateYY := yy + float64(2*pulses[i]+1)
+			if xy2 := candidateXY * candidateXY; xy2*bestYY > bestXY2*candidateYY {
+				best, bestXY2, bestYY = i, xy2, candidateYY
+			}
+		}
+
+		xy += magnitudes[best]
+		yy += float64(2*pulses[best] + 1)
+		pulses[best]++
+	}
+
+	for i, value := range x {
+		if value < 0 {
+			pulses[i] = -pulses[i]
+		}
+	}
+	return pulses
+}
+
+// encodePulses codes the pulses of a vector with k pulses by its index
+// among all V(N,K) such vectors, like encode_pulses() (cwrs.c).
+//
+// https://datatracker.ietf.org/doc/html/rfc6716#section-4.3.4.2
+func encodePulses(encoder *rangecoding.Encoder, pulses []int, k int) error {
+	u, err := pulseCodebookTable(len(pulses), k)
+	if err != nil {
+		return err
+	}
+
+	encoder.EncodeUniform(pulsesToIndex(u, pulses), uint32(u[len(pulses)][k]+u[len(pulses)][k+1]))
+	return nil
+}
+
+// pulsesToIndex enumerates a vector of pulses from its last dimension,
+// like icwrs() (cwrs.c).
+func pulsesToIndex(u [][]uint64, pulses []int) uint32 {
+	n := len(pulses)
+	j := n - 1
+	index := uint64(0)
+	if pulses[j] < 0 {
+		index = 1
+	}
+	k := abs(pulses[j])
+	for j > 0 {
+		j--
+		index += u[n-j][k]
+		k += abs(pulses[j])
+		if pulses[j] < 0 {
+			index += u[n-j][k+1]
+		}
+	}
+	return uint32(index)
+}
+
+// pulseCodebookTable returns U(n,k) for dimensions up to n and pulses up
+// to k+1, where
+//
+//	U(N,K) = U(N-1,K) + U(N,K-1) + U(N-1,K-1)
+//
+// with U(0,0) = 1 and U(N,0) = U(0,K) = 0 otherwise. The number of
+// vectors of N integers whose magnitudes sum to K is
+// V(N,K) = U(N,K) + U(N,K+1), which must fit in 32 bits.
+func pulseCodebookTable(n, k int) ([][]uint64, error) {
+	if n < 2 || k < 1 {
+		return nil, errInvalidPulseDimensions
+	}
+
+	u := make([][]uint64, n+1)
+	for i := range u {
+		u[i] = make([]uint64, k+2)
+		for j := range u[i] {
+			switch {
+			case i == 0 || j == 0:
+				if i == j {
+					u[i][j] = 1
+				}
+			default:
+				u[i][j] = u[i-1][j] + u[i][j-1] + u[i-1][j-1]
+				if u[i][j] > maxPulseCodebook {
+					u[i][j] = maxPulseCodebook
+				}
+			}
+		}
+	}
+
+	if u[n][k]+u[n][k+1] > math.MaxUint32 {
+		return nil, errPulseCodebookTooLarge
+	}
+	return u, nil
+}
+
+func abs(x int) int {
+	if x < 0 {
+		return -x
+	}
+	return x
+}
+
+// decodePulses decodes the pulses of a vector of n dimensions with k
+// pulses from its index, like decode_pulses() (cwrs.c). It returns the
+// pulses and their energy.
+//
+// https://datatracker.ietf.org/doc/html/rfc6716#section-4.3.4.2
+func decodePulses(decoder *rangecoding.Decoder, n, k int) ([]int, float64, error) {
+	table, err := pulseCodebookTable(n, k)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	// The table only holds U(a,b) for a <= n and b <= k+1, the others are
+	// found by symmetry
+	maxN, maxK := n, k+1
+	u := func(a, b int) uint64 {
+		if a <= maxN && b <= maxK {
+			return table[a][b]
+		}
+		return table[b][a]
+	}
+
+	i := uint64(decoder.DecodeUniform(uint32(table[n][k] + table[n][k+1])))
+	pulses := make([]int, 0, n)
+	energy := 0.0
+	add := func(negative bool, value int) {
+		if negative {
+			value = -value
+		}
+		pulses = append(pulses, value)
+		energy += float64(value * value)
+	}
+
+	// Decode one dimension at a time, like cwrsi() (cwrs.c)
+	for ; n > 2; n-- {
+		if k >= n {
+			// Lots of pulses
+			p := u(n, k+1)
+			negative := i >= p
+			if negative {
+				i -= p
+			}
+
+			k0 := k
+			if q := u(n, n); q > i {
+				for k = n - 1; u(k, n) > i; k-- {
+				}
+			} else {
+				for p = u(n, k); p > i; p = u(n, k) {
+					k--
+				}
+			}
+			i -= u(n, k)
+			add(negative, k0-k)
+			continue
+		}
+
+		// Lots of dimensions
+		p, q := u(k, n), u(k+1, n)
+		if p <= i && i < q {
+			i -= p
+			add(false, 0)
+			continue
+		}
+
+		negative := i >= q
+		if negative {
+			i -= q
+		}
+		k0 := k
+		for k--; u(k, n) > i; k-- {
+		}
+		i -= u(k, n)
+		add(negative, k0-k)
+	}
+
+	// n == 2
+	p := uint64(2*k + 1)
+	negative := i >= p
+	if negative {
+		i -= p
+	}
+	k0 := k
+	k = int((i + 1) >> 1)
+	if k > 0 {
+		i -= uint64(2*k - 1)
+	}
+	add(negative, k0-k)
+
+	// n == 1
+	add(i != 0, k)
+	return pulses, energy, nil
+}
+
+// spreadFactors controls the strength of the spreading rotation of the
+// light, normal and aggressive spread decisions.
+var spreadFactors = [3]int{15, 10, 5}
+
+const (
+	spreadNone = iota
+	spreadLight
+	spreadNormal
+	spreadAggressive
+)
+
+// expRotation spreads or, with a negative direction, gathers the energy
+// of a band with a few pulses over more bins, by a rotation that is
+// stronger for fewer pulses, like exp_rotation() (vq.c). This avoids
+// the tonal artifacts of sparse vectors.
+//
+// https://datatracker.ietf.org/doc/html/rfc6716#section-4.3.4.3
+func expRotation(x []float64, direction, stride, k, spread int) {
+	n := len(x)
+	if 2*k >= n || spread == spreadNone {
+		return
+	}
+
+	factor := spreadFactors[spread-1]
+	gain := float64(n) / float64(n+factor*k)
+	theta := 0.5 * gain * gain
+	c := math.Cos(0.5 * math.Pi * theta)
+	s := math.Cos(0.5 * math.Pi * (1 - theta))
+
+	// This is just a simple (equivalent) way of computing sqrt(len/stride)
+	stride2 := 0
+	if n >= 8*stride {
+		stride2 = 1
+		for (stride2*stride2+stride2)*stride+(stride>>2) < n {
+			stride2++
+		}
+	}
+
+	n /= stride
+	for i := 0; i < stride; i++ {
+		block := x[i*n : (i+1)*n]
+		if direction < 0 {
+			if stride2 != 0 {
+				expRotationPass(block, stride2, s, c)
+			}
+			expRotationPass(block, 1, c, s)
+		} else {
+			expRotationPass(block, 1, c, -s)
+			if stride2 != 0 {
+				expRotationPass(block, stride2, s, -c)
+			}
+		}
+	}
+}
+
+// expRotationPass rotates each pair of bins stride apart, forwards then
+// backwards, like exp_rotation1() (vq.c).
+func expRotationPass(x []float64, stride int, c, s float64) {
+	for i := 0; i < len(x)-stride; i++ {
+		x1, x2 := x[i], x[i+stride]
+		x[i+stride] = c*x2 + s*x1
+		x[i] = c*x1 - s*x2
+	}
+	for i := len(x) - 2*stride - 1; i >= 0; i-- {
+		x1, x2 := x[i], x[i+stride]
+		x[i+stride] = c*x2 + s*x1
+		x[i] = c*x1 - s*x2
+	}
+}
+
+// extractCollapseMask returns a bit for each of the blocks of a band
+// that received pulses, like extract_collapse_mask() (vq.c).
+func extractCollapseMask(pulses []int, blocks int) int {
+	if blocks <= 1 {
+		return 1
+	}
+
+	n := len(pulses) / blocks
+	mask := 0
+	for b := 0; b < blocks; b++ {
+		for _, pulse := range pulses[b*n : (b+1)*n] {
+			if pulse != 0 {
+				mask |= 1 << b
+				break
+			}
+		}
+	}
+	return mask
+}
+
+// algebraicQuantize codes the shape of a band with k pulses, like
+// alg_quant() (vq.c), and returns its collapse mask.
+func algebraicQuantize(encoder *rangecoding.Encoder, x []float64, k, spread, blocks int) (int, error) {
+	expRotation(x, 1, blocks, k, spread)
+
+	pulses := pvqSearch(x, k)
+	if err := encodePulses(encoder, pulses, k); err != nil {
+		return 0, err
+	}
+	return extractCollapseMask(pulses, blocks), nil
+}
+
+// algebraicUnquantize decodes the shape of a band with k pulses, scaled
+// to gain, like alg_unquant() (vq.c), and returns its collapse mask.
+func algebraicUnquantize(decoder *rangecoding.Decoder, x []float64, k, spread, blocks int, gain float64) (int, error) {
+	pulses, energy, err := decodePulses(decoder, len(x), k)
+	if err != nil {
+		return 0, err
+	}
+
+	gain /= math.Sqrt(energy)
+	for i, pulse := range pulses {
+		x[i] = gain * float64(pulse)
+	}
+	expRotation(x, -1, blocks, k, spread)
+	return extractCollapseMask(pulses, blocks), nil
+}
+
+// renormaliseVector scales x to a norm of gain.
+func renormaliseVector(x []float64, gain float64) {
+	energy := transientEpsilon
+	for _, value := range x {
+		energy += value * value
+	}
+
+	gain /= math.Sqrt(energy)
+	for i := range x {
+		x[i] *= gain
+	}
+}
+
+// stereoTheta returns the angle between the mid and side of a band, or
+// between its two halves, in Q14 of pi/2, like stereo_itheta() (vq.c).
+func stereoTheta(x, y []float64, stereo bool) int {
+	mid, side := transientEpsilon, transientEpsilon
+	for i := range x {
+		if stereo {
+			m, s := x[i]+y[i], x[i]-y[i]
+			mid += m * m
+			side += s * s
+		} else {
+			mid += x[i] * x[i]
+			side += y[i] * y[i]
+		}
+	}
+
+	return int(math.Floor(0.5 + 16384*0.63662*math.Atan2(math.Sqrt(side), math.Sqrt(mid))))
+}
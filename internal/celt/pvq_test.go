@@ -0,0 +1,264 @@
+package celt
+
+import (
+	"errors"
+	"math"
+	"math/rand"
+	"testing"
+
+	"github.com/pion/opus/internal/rangecoding"
+)
+
+// indexToPulses is cwrsi() (cwrs.c), the inverse of pulsesToIndex, with
+// U(a,b) taken from a table of both dimensions up to n+k+1
+func indexToPulses(n, k int, index uint32) []int {
+	size := n + k + 2
+	table := make([][]uint64, size)
+	for i := range table {
+		table[i] = make([]uint64, size)
+		for j := range table[i] {
+			switch {
+			case i == 0 || j == 0:
+				if i == j {
+					table[i][j] = 1
+				}
+			default:
+				table[i][j] = table[i-1][j] + table[i][j-1] + table[i-1][j-1]
+			}
+		}
+	}
+	u := func(a, b int) uint64 { return table[a][b] }
+
+	i := uint64(index)
+	pulses := make([]int, 0, n)
+	sign := func(negative bool, value int) int {
+		if negative {
+			return -value
+		}
+		return value
+	}
+
+	for ; n > 2; n-- {
+		if k >= n {
+			p := u(n, k+1)
+			negative := i >= p
+			if negative {
+				i -= p
+			}
+			k0 := k
+			if q := u(n, n); q > i {
+				k = n
+				for p = u(k-1, n); p > i; p = u(k-1, n) {
+					k--
+				}
+				k--
+			} else {
+				for p = u(n, k); p > i; p = u(n, k) {
+					k--
+				}
+			}
+			i -= p
+			pulses = append(pulses, sign(negative, k0-k))
+			continue
+		}
+
+		p, q := u(k, n), u(k+1, n)
+		if p <= i && i < q {
+			i -= p
+			pulses = append(pulses, 0)
+			continue
+		}
+
+		negative := i >= q
+		if negative {
+			i -= q
+		}
+		k0 := k
+		for p = u(k-1, n); p > i; p = u(k-1, n) {
+			k--
+		}
+		k--
+		i -= p
+		pulses = append(pulses, sign(negative, k0-k))
+	}
+
+	p := uint64(2*k + 1)
+	negative := i >= p
+	if negative {
+		i -= p
+	}
+	k0 := k
+	k = int((i + 1) >> 1)
+	if k > 0 {
+		i -= uint64(2*k - 1)
+	}
+	pulses = append(pulses, sign(negative, k0-k))
+	return append(pulses, sign(i != 0, k))
+}
+
+// allPulseVectors enumerates the vectors of n integers whose magnitudes
+// sum to k
+func allPulseVectors(n, k int) [][]int {
+	if n == 1 {
+		if k == 0 {
+			return [][]int{{0}}
+		}
+		return [][]int{{k}, {-k}}
+	}
+
+	var vectors [][]int
+	for first := -k; first <= k; first++ {
+		for _, rest := range allPulseVectors(n-1, k-abs(first)) {
+			vectors = append(vectors, append([]int{first}, rest...))
+		}
+	}
+	return vectors
+}
+
+func TestPulsesToIndex(t *testing.T) {
+	for n := 2; n <= 6; n++ {
+		for k := 1; k <= 6; k++ {
+			u, err := pulseCodebookTable(n, k)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			vectors := allPulseVectors(n, k)
+			if total := u[n][k] + u[n][k+1]; total != uint64(len(vectors)) {
+				t.Fatalf("V(%d,%d) = %d, expected %d", n, k, total, len(vectors))
+			}
+
+			seen := map[uint32]bool{}
+			for _, pulses := range vectors {
+				index := pulsesToIndex(u, pulses)
+				if index >= uint32(len(vectors)) || seen[index] {
+					t.Fatalf("%v has index %d of %d", pulses, index, len(vectors))
+				}
+				seen[index] = true
+
+				decoded := indexToPulses(n, k, index)
+				for i := range pulses {
+					if decoded[i] != pulses[i] {
+						t.Fatalf("index %d decoded to %v, expected %v", index, decoded, pulses)
+					}
+				}
+			}
+		}
+	}
+}
+
+func TestPVQSearch(t *testing.T) {
+	random := rand.New(rand.NewSource(1)) //nolint:gosec
+	for _, test := range []struct{ n, k int }{{2, 1}, {4, 1}, {8, 3}, {8, 10}, {16, 5}, {24, 40}, {176, 3}} {
+		x := make([]float64, test.n)
+		norm := 0.0
+		for i := range x {
+			x[i] = random.NormFloat64()
+			norm += x[i] * x[i]
+		}
+
+		pulses := pvqSearch(x, test.k)
+		sum, xy, yy := 0, 0.0, 0.0
+		for i, pulse := range pulses {
+			sum += abs(pulse)
+			xy += x[i] * float64(pulse)
+			yy += float64(pulse * pulse)
+		}
+		if sum != test.k {
+			t.Fatalf("N=%d K=%d: %d pulses in %v", test.n, test.k, sum, pulses)
+		}
+
+		// A single pulse must land on the largest magnitude with its sign,
+		if test.k == 1 {
+			largest := 0
+			for i := range x {
+				if math.Abs(x[i]) > math.Abs(x[largest]) {
+					largest = i
+				}
+			}
+			if pulses[largest] != int(math.Copysign(1, x[largest])) {
+				t.Fatalf("pulse at %v for %v", pulses, x)
+			}
+		}
+
+		// and more pulses must do at least as well
+		largest := 0.0
+		for i := range x {
+			largest = math.Max(largest, math.Abs(x[i]))
+		}
+		if correlation := xy / math.Sqrt(yy*norm); correlation < largest/math.Sqrt(norm) {
+			t.Fatalf("N=%d K=%d: correlation %f is below that of a single pulse", test.n, test.k, correlation)
+		}
+	}
+
+	// Silence puts every pulse in the first bin
+	if pulses := pvqSearch(make([]float64, 4), 10); pulses[0] != 10 {
+		t.Fatalf("silence quantized to %v", pulses)
+	}
+}
+
+func TestEncodePulses(t *testing.T) {
+	random := rand.New(rand.NewSource(1)) //nolint:gosec
+	type band struct {
+		k      int
+		pulses []int
+	}
+	var bands []band
+	for _, test := range []struct{ n, k int }{{2, 5}, {4, 1}, {8, 3}, {16, 7}, {32, 4}} {
+		x := make([]float64, test.n)
+		for i := range x {
+			x[i] = random.NormFloat64()
+		}
+		bands = append(bands, band{test.k, pvqSearch(x, test.k)})
+	}
+
+	encoder := &rangecoding.Encoder{}
+	encoder.Init(make([]byte, 64))
+	for _, b := range bands {
+		if err := encodePulses(encoder, b.pulses, b.k); err != nil {
+			t.Fatal(err)
+		}
+	}
+	data, err := encoder.Done()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	decoder := &rangecoding.Decoder{}
+	decoder.Init(data)
+	for _, b := range bands {
+		u, err := pulseCodebookTable(len(b.pulses), b.k)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		index := decoder.DecodeUniform(uint32(u[len(b.pulses)][b.k] + u[len(b.pulses)][b.k+1]))
+		decoded := indexToPulses(len(b.pulses), b.k, index)
+		for i := range decoded {
+			if decoded[i] != b.pulses[i] {
+				t.Fatalf("decoded %v, expected %v", decoded, b.pulses)
+			}
+		}
+	}
+}
+
+func TestEncodePulses_Errors(t *testing.T) {
+	encoder := &rangecoding.Encoder{}
+	encoder.Init(make([]byte, 64))
+	for _, test := range []struct {
+		name     string
+		n, k     int
+		expected error
+	}{
+		{"one dimension", 1, 1, errInvalidPulseDimensions},
+		{"no pulses", 4, 0, errInvalidPulseDimensions},
+		{"codebook size", 176, 100, errPulseCodebookTooLarge},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			pulses := make([]int, test.n)
+			if err := encodePulses(encoder, pulses, test.k); !errors.Is(err, test.expected) {
+				t.Fatalf("expected %v, got %v", test.expected, err)
+			}
+		})
+	}
+}
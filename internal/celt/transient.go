@@ -0,0 +1,99 @@
+package celt
+
+import "math"
+
+const (
+	// Forward masking decays by 6.7 dB/ms and backward masking by 13.9
+	// dB/ms, at 48 kHz with samples grouped by two
+	forwardMaskingDecay  = 0.0625
+	backwardMaskingDecay = 0.125
+
+	// A frame is transient when its energy is more than transientThreshold
+	// over the harmonic mean of its masked energy, in the units of the mask
+	// metric of the reference encoder
+	transientThreshold = 200
+
+	// The samples at both ends of the analysis aren't reliable, as the
+	// filter memories aren't carried between frames
+	transientStartMargin = 12
+	transientEndMargin   = 5
+
+	transientEpsilon = 1e-15
+)
+
+// detectTransient follows transient_analysis() (celt_encoder.c) of the
+// reference encoder. It compares the energy of each channel of the
+// high-passed input with the harmonic mean of its temporally masked
+// energy, which is high when a short burst of energy in the frame would
+// spread as pre-echo over a long MDCT. It returns whether the frame
+// should use short blocks, and tfEstimate, from 0 to 1, the strength of
+// the transient that guides the time-frequency resolution.
+//
+// https://datatracker.ietf.org/doc/html/rfc6716#section-5.3.2
+func detectTransient(channels [][]float64) (isTransient bool, tfEstimate float64) {
+	maskMetric := 0
+	for _, in := range channels {
+		if metric := maskingMetric(in); metric > maskMetric {
+			maskMetric = metric
+		}
+	}
+
+	tfMax := math.Max(0, math.Sqrt(27*float64(maskMetric))-42)
+	tfEstimate = math.Sqrt(math.Max(0, 0.0069*math.Min(163, tfMax)-0.139))
+	return maskMetric > transientThreshold, tfEstimate
+}
+
+func maskingMetric(in []float64) int {
+	// High-pass filter with (1 - 2*z^-1 + z^-2) / (1 - z^-1 + 0.5*z^-2)
+	filtered := make([]float64, len(in))
+	var mem0, mem1 float64
+	for i, x := range in {
+		y := mem0 + x
+		mem0 = mem1 + y - 2*x
+		mem1 = x - 0.5*y
+		filtered[i] = y
+	}
+	for i := 0; i < transientStartMargin && i < len(filtered); i++ {
+		filtered[i] = 0
+	}
+
+	// Forward pass over pairs of samples for the post-echo threshold
+	length := len(in) / 2
+	masked := make([]float64, length)
+	var mean, memory float64
+	for i := range masked {
+		x2 := filtered[2*i]*filtered[2*i] + filtered[2*i+1]*filtered[2*i+1]
+		mean += x2
+		memory += forwardMaskingDecay * (x2 - memory)
+		masked[i] = memory
+	}
+
+	// Backward pass for the pre-echo threshold
+	memory = 0
+	maxEnergy := 0.0
+	for i := length - 1; i >= 0; i-- {
+		memory += backwardMaskingDecay * (masked[i] - memory)
+		masked[i] = memory
+		maxEnergy = math.Max(maxEnergy, memory)
+	}
+
+	// The frame energy is the geometric mean of the energy and half the
+	// maximum, and the harmonic mean is taken over one sample in four
+	mean = math.Sqrt(mean * maxEnergy * 0.5 * float64(length))
+	norm := float64(length) / (transientEpsilon + mean)
+
+	unmask := 0
+	for i := transientStartMargin; i < length-transientEndMargin; i += 4 {
+		id := math.Max(0, math.Min(127, math.Floor(64*norm*(masked[i]+transientEpsilon))))
+		unmask += inverseTable(int(id))
+	}
+
+	// Compensate for the one sample in four and the factor of 6
+	return 64 * unmask * 4 / (6 * (length - 17))
+}
+
+// inverseTable approximates the table of 6*64/x the reference encoder
+// trained on real data, to compute the harmonic mean.
+func inverseTable(id int) int {
+	return int(math.Min(255, math.Round(6*64/(float64(id)+0.5))))
+}
@@ -0,0 +1,36 @@
+// Package oggcrc implements the checksum used by Ogg pages
+package oggcrc
+
+// The checksum is a 32 bit CRC with the generator polynomial 0x04c11db7,
+// computed over the whole page with the checksum field set to zero. The
+// initial value and final XOR are both zero.
+//
+// https://tools.ietf.org/html/rfc3533.html#section-6
+const poly = 0x04c11db7
+
+// GenerateTable returns the lookup table used by Update
+func GenerateTable() *[256]uint32 {
+	var table [256]uint32
+
+	for i := range table {
+		r := uint32(i) << 24
+		for j := 0; j < 8; j++ {
+			if (r & 0x80000000) != 0 {
+				r = (r << 1) ^ poly
+			} else {
+				r <<= 1
+			}
+			table[i] = (r & 0xffffffff)
+		}
+	}
+	return &table
+}
+
+// Update returns the checksum after adding data to it
+func Update(table *[256]uint32, checksum uint32, data []byte) uint32 {
+	for _, v := range data {
+		checksum = (checksum << 8) ^ table[byte(checksum>>24)^v]
+	}
+
+	return checksum
+}
@@ -2,6 +2,7 @@ package rangecoding
 
 import (
 	"math"
+	"math/bits"
 )
 
 // Decoder implements rfc6716#section-4.1
@@ -73,8 +74,18 @@ type Decoder struct {
 	data     []byte
 	bitsRead uint
 
+	endOffset    uint   // end_offs in libopus, raw bytes read from the back
+	endWindow    uint32 // raw bits read from the back but not yet consumed
+	endBitsCount uint   // number of valid bits in endWindow
+	bitsTotal    uint   // nbits_total in libopus
+
 	rangeSize              uint32 // rng in RFC 6716
 	highAndCodedDifference uint32 // val in RFC 6716
+
+	invalidUniformValue bool
+
+	// The scale of the last Decode, for Update
+	scale uint32
 }
 
 // Init sets the state of the Decoder
@@ -92,6 +103,12 @@ func (r *Decoder) Init(data []byte) {
 	r.data = data
 	r.bitsRead = 0
 
+	r.endOffset = 0
+	r.endWindow = 0
+	r.endBitsCount = 0
+	r.bitsTotal = codeBits + 1 - ((codeBits-7)/8)*8
+	r.invalidUniformValue = false
+
 	r.rangeSize = 128
 	r.highAndCodedDifference = 127 - r.getBits(7)
 	r.normalize()
@@ -107,9 +124,7 @@ func (r *Decoder) DecodeSymbolWithICDF(cumulativeDistributionTable []uint) uint3
 	total = uint32(cumulativeDistributionTable[0])
 	cumulativeDistributionTable = cumulativeDistributionTable[1:]
 
-	scale = r.rangeSize / total
-	symbol = r.highAndCodedDifference/scale + 1
-	symbol = total - uint32(min(uint(symbol), uint(total)))
+	symbol, scale = r.decode(total)
 
 	for k = 0; uint32(cumulativeDistributionTable[k]) <= symbol; k++ {
 	}
@@ -148,11 +163,229 @@ func (r *Decoder) DecodeSymbolLogP(logp uint) uint32 {
 	return k
 }
 
+// DecodeUniform decodes an integer in the range [0, total) that was
+// encoded with a uniform distribution. Values that need more than 8 bits
+// are split into a range coded most significant part and raw least
+// significant bits, implemented by ec_dec_uint() (entdec.c).
+//
+// https://datatracker.ietf.org/doc/html/rfc6716#section-4.1.5
+func (r *Decoder) DecodeUniform(total uint32) uint32 {
+	total--
+	totalBits := uint(bits.Len32(total))
+	if totalBits > uintBits {
+		totalBits -= uintBits
+		scaledTotal := (total >> totalBits) + 1
+		symbol, scale := r.decode(scaledTotal)
+		r.update(scale, symbol, symbol+1, scaledTotal)
+
+		value := (symbol << totalBits) | r.DecodeRawBits(totalBits)
+		if value > total {
+			r.invalidUniformValue = true
+			return total
+		}
+		return value
+	}
+
+	symbol, scale := r.decode(total + 1)
+	r.update(scale, symbol, symbol+1, total+1)
+	return symbol
+}
+
+// Decode returns the cumulative frequency of the next symbol of a
+// context of size total, for contexts that aren't described by a table,
+// like the split angles of CELT. Update must then be called with the
+// frequencies of the symbol it falls in.
+//
+// https://datatracker.ietf.org/doc/html/rfc6716#section-4.1.2
+func (r *Decoder) Decode(total uint32) uint32 {
+	var symbol uint32
+	symbol, r.scale = r.decode(total)
+	return symbol
+}
+
+// Update consumes the symbol occupying [low, high) of the context of the
+// last Decode.
+//
+// https://datatracker.ietf.org/doc/html/rfc6716#section-4.1.2
+func (r *Decoder) Update(low, high, total uint32) {
+	r.update(r.scale, low, high, total)
+}
+
+// DecodeRawBits reads n raw bits, implemented by ec_dec_bits()
+// (entdec.c). Raw bits are packed backwards starting at the end of the
+// frame and bypass the range coder.
+//
+// https://datatracker.ietf.org/doc/html/rfc6716#section-4.1.4
+func (r *Decoder) DecodeRawBits(n uint) uint32 {
+	window := r.endWindow
+	available := r.endBitsCount
+
+	if available < n {
+		for available <= windowLen-8 {
+			window |= uint32(r.getByteFromEnd()) << available
+			available += 8
+		}
+	}
+
+	value := window & ((1 << n) - 1)
+	window >>= n
+	available -= n
+
+	r.endWindow = window
+	r.endBitsCount = available
+	r.bitsTotal += n
+
+	return value
+}
+
+// The Laplace distribution is used by CELT to code the coarse energy of
+// each band, implemented by ec_laplace_decode() (laplace.c). fs is the
+// probability of a zero, and decay controls how fast the probability of
+// larger magnitudes decreases, both in Q15.
+//
+// https://datatracker.ietf.org/doc/html/rfc6716#section-4.3.2.1
+func (r *Decoder) DecodeLaplace(fs, decay uint32) int32 {
+	value := int32(0)
+	low := uint32(0)
+
+	scale := r.rangeSize >> 15
+	fm := (uint32(1) << 15) - uint32(min(uint(r.highAndCodedDifference/scale+1), 1<<15))
+
+	if fm >= fs {
+		value++
+		low = fs
+		fs = laplaceFrequencyOne(fs, decay) + laplaceMinimumProbability
+
+		// Search the decaying part of the PDF
+		for fs > laplaceMinimumProbability && fm >= low+2*fs {
+			fs *= 2
+			low += fs
+			fs = ((fs - 2*laplaceMinimumProbability) * decay) >> 15
+			fs += laplaceMinimumProbability
+			value++
+		}
+
+		// Everything beyond that has probability laplaceMinimumProbability
+		if fs <= laplaceMinimumProbability {
+			di := (fm - low) >> 1
+			value += int32(di)
+			low += 2 * di * laplaceMinimumProbability
+		}
+
+		if fm < low+fs {
+			value = -value
+		} else {
+			low += fs
+		}
+	}
+
+	high := low + fs
+	if high > 1<<15 {
+		high = 1 << 15
+	}
+	r.update(scale, low, high, 1<<15)
+
+	return value
+}
+
+// Tell returns the number of bits consumed so far, rounded up, as
+// computed by ec_tell() (entcode.h).
+//
+// https://datatracker.ietf.org/doc/html/rfc6716#section-4.1.6.1
+func (r *Decoder) Tell() uint {
+	return tell(r.bitsTotal, r.rangeSize)
+}
+
+// TellFrac returns the number of bits consumed so far in 1/8th bits, as
+// computed by ec_tell_frac() (entcode.c).
+//
+// https://datatracker.ietf.org/doc/html/rfc6716#section-4.1.6.2
+func (r *Decoder) TellFrac() uint {
+	return tellFrac(r.bitsTotal, r.rangeSize)
+}
+
+// SkipToEnd accounts for all the bits left in the frame as read, as the
+// CELT decoder does for a silent frame.
+func (r *Decoder) SkipToEnd() {
+	r.bitsTotal += uint(len(r.data))*8 - r.Tell()
+}
+
+// Shrink drops the end of the frame down to size bytes, like the Opus
+// decoder does to ec_dec.storage (opus_decoder.c) for the redundant CELT
+// frame at the end of a SILK or hybrid frame. Raw bits are read from the
+// new end.
+func (r *Decoder) Shrink(size int) {
+	r.data = r.data[:size]
+}
+
+// FinalRange returns the current value of rng. After the last symbol of a
+// frame is decoded it must match the final range reported by the
+// encoder, which is what the reference test vectors use to prove
+// bit-exactness.
+func (r *Decoder) FinalRange() uint32 {
+	return r.rangeSize
+}
+
+// Err returns an error if the frame is known to be corrupted, like
+// ec_get_error() (entcode.h). Reading past the end of the data is
+// allowed by the range decoder, which pads the input with zeros, but a
+// valid encoder never produces a CELT or hybrid frame that needs more
+// bits than it contains. Callers should check Err after decoding all
+// symbols of a frame.
+func (r *Decoder) Err() error {
+	return r.err(0)
+}
+
+// ErrZeroPadded is Err for SILK-only frames. opus_encode_native()
+// (opus_encoder.c) strips all their trailing zero bytes, which the range
+// decoder fills back in, so decoding them may read any number of bits
+// past the end of the data. Only a frame that needs more bits than the
+// largest Opus frame holds is known to be corrupted, a truncated frame
+// decodes as if its missing bytes were stripped zeros.
+func (r *Decoder) ErrZeroPadded() error {
+	return r.err(maxFrameBytes)
+}
+
+func (r *Decoder) err(minBytes uint) error {
+	size := uint(len(r.data))
+	if size < minBytes {
+		size = minBytes
+	}
+
+	switch {
+	case r.invalidUniformValue:
+		return ErrInvalidUniformValue
+	case r.Tell() > size*8:
+		return ErrBitBudgetExceeded
+	}
+
+	return nil
+}
+
+// decode implements ec_decode() (entdec.c), returning the cumulative
+// frequency of the next symbol for a context of size total, along with
+// the scale that must be passed to update.
+func (r *Decoder) decode(total uint32) (symbol, scale uint32) {
+	scale = r.rangeSize / total
+	symbol = r.highAndCodedDifference/scale + 1
+	symbol = total - uint32(min(uint(symbol), uint(total)))
+	return
+}
+
+func (r *Decoder) getByteFromEnd() byte {
+	if r.endOffset >= uint(len(r.data)) {
+		return 0
+	}
+
+	r.endOffset++
+	return r.data[uint(len(r.data))-r.endOffset]
+}
+
 func (r *Decoder) getBit() uint32 {
 	index := r.bitsRead / 8
 	offset := r.bitsRead % 8
 
-	if index > uint(len(r.data)-1) {
+	if index >= uint(len(r.data)) {
 		return 0
 	}
 
@@ -193,6 +426,7 @@ func (r *Decoder) getBits(n int) uint32 {
 func (r *Decoder) normalize() {
 	for float64(r.rangeSize) <= math.Pow(2, 23) {
 		r.rangeSize <<= 8
+		r.bitsTotal += 8
 		r.highAndCodedDifference = ((r.highAndCodedDifference << 8) + (255 - r.getBits(8))) & 0x7FFFFFFF
 	}
 }
@@ -1,6 +1,8 @@
 package rangecoding
 
 import (
+	"errors"
+	"math/rand"
 	"testing"
 )
 
@@ -242,3 +244,264 @@ func TestDecoder(t *testing.T) {
 		t.Fatal("")
 	}
 }
+
+func TestDecoder_Tell(t *testing.T) {
+	d := &Decoder{}
+	d.Init([]byte{0x0b, 0xe4, 0xc1, 0x36, 0xec, 0xc5, 0x80})
+
+	// A freshly initialized decoder has used one bit
+	if d.Tell() != 1 || d.TellFrac() != 8 {
+		t.Fatal(d.Tell(), d.TellFrac())
+	}
+
+	d.DecodeSymbolLogP(0x1)
+	d.DecodeSymbolLogP(0x1)
+	if d.Tell() != 3 || d.TellFrac() != 24 {
+		t.Fatal(d.Tell(), d.TellFrac())
+	}
+
+	d.DecodeRawBits(5)
+	if d.Tell() != 8 || d.TellFrac() != 64 {
+		t.Fatal(d.Tell(), d.TellFrac())
+	}
+}
+
+func TestDecoder_Uniform(t *testing.T) {
+	random := rand.New(rand.NewSource(0)) //nolint:gosec
+
+	totals := make([]uint32, 200)
+	values := make([]uint32, len(totals))
+	for i := range totals {
+		totals[i] = uint32(random.Int63n(1<<20)) + 2
+		values[i] = uint32(random.Int63n(int64(totals[i])))
+	}
+
+	e := &Encoder{}
+	e.Init(make([]byte, 1024))
+	for i := range totals {
+		e.EncodeUniform(values[i], totals[i])
+	}
+	encoded, err := e.Done()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	d := &Decoder{}
+	d.Init(encoded)
+	for i := range totals {
+		if result := d.DecodeUniform(totals[i]); result != values[i] {
+			t.Fatalf("value %d: expected %d, got %d", i, values[i], result)
+		}
+	}
+
+	if d.FinalRange() != e.FinalRange() {
+		t.Fatalf("final range mismatch %d != %d", d.FinalRange(), e.FinalRange())
+	}
+}
+
+func TestDecoder_RawBits(t *testing.T) {
+	random := rand.New(rand.NewSource(0)) //nolint:gosec
+
+	counts := make([]uint, 200)
+	values := make([]uint32, len(counts))
+	for i := range counts {
+		counts[i] = uint(random.Intn(24) + 1)
+		values[i] = uint32(random.Int63n(1 << counts[i]))
+	}
+
+	e := &Encoder{}
+	e.Init(make([]byte, 1024))
+	for i := range counts {
+		// Interleave range coded symbols to check the two don't collide
+		e.EncodeSymbolWithICDF(silkModelGainLowbits, uint32(i%8))
+		e.EncodeRawBits(values[i], counts[i])
+	}
+	encoded, err := e.Done()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	d := &Decoder{}
+	d.Init(encoded)
+	for i := range counts {
+		if result := d.DecodeSymbolWithICDF(silkModelGainLowbits); result != uint32(i%8) {
+			t.Fatalf("symbol %d: expected %d, got %d", i, i%8, result)
+		}
+		if result := d.DecodeRawBits(counts[i]); result != values[i] {
+			t.Fatalf("raw bits %d: expected %d, got %d", i, values[i], result)
+		}
+	}
+
+	if d.Tell() != e.Tell() {
+		t.Fatalf("tell mismatch %d != %d", d.Tell(), e.Tell())
+	}
+}
+
+func TestDecoder_Laplace(t *testing.T) {
+	random := rand.New(rand.NewSource(0)) //nolint:gosec
+
+	values := make([]int32, 1000)
+	fs := make([]uint32, len(values))
+	decay := make([]uint32, len(values))
+	for i := range values {
+		values[i] = int32(random.Intn(80) - 40)
+		fs[i] = uint32(random.Intn(20000)+1000) &^ 1
+		decay[i] = uint32(random.Intn(16000) + 100)
+	}
+
+	e := &Encoder{}
+	e.Init(make([]byte, 8192))
+	for i := range values {
+		// Values outside of the representable range are clamped
+		values[i] = e.EncodeLaplace(values[i], fs[i], decay[i])
+	}
+	encoded, err := e.Done()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	d := &Decoder{}
+	d.Init(encoded)
+	for i := range values {
+		if result := d.DecodeLaplace(fs[i], decay[i]); result != values[i] {
+			t.Fatalf("value %d: expected %d, got %d", i, values[i], result)
+		}
+	}
+
+	if d.FinalRange() != e.FinalRange() {
+		t.Fatalf("final range mismatch %d != %d", d.FinalRange(), e.FinalRange())
+	}
+}
+
+func TestDecoder_FinalRange(t *testing.T) {
+	d := &Decoder{}
+	d.Init([]byte{0x0b, 0xe4, 0xc1, 0x36, 0xec, 0xc5, 0x80})
+
+	if d.FinalRange() != 1<<31 {
+		t.Fatal(d.FinalRange())
+	}
+
+	d.DecodeSymbolLogP(0x1)
+	if d.FinalRange() != 1<<30 {
+		t.Fatal(d.FinalRange())
+	}
+}
+
+func TestDecoder_Err(t *testing.T) {
+	t.Run("Valid frame", func(t *testing.T) {
+		d := &Decoder{}
+		d.Init([]byte{0x0b, 0xe4, 0xc1, 0x36, 0xec, 0xc5, 0x80})
+		for i := 0; i < 8; i++ {
+			d.DecodeSymbolWithICDF(silkModelGainLowbits)
+		}
+
+		if err := d.Err(); err != nil {
+			t.Fatal(err)
+		}
+	})
+
+	t.Run("Empty frame", func(t *testing.T) {
+		d := &Decoder{}
+		d.Init([]byte{})
+
+		if err := d.Err(); !errors.Is(err, ErrBitBudgetExceeded) {
+			t.Fatal(err)
+		}
+	})
+
+	t.Run("Truncated frame", func(t *testing.T) {
+		d := &Decoder{}
+		d.Init([]byte{0x0b, 0xe4})
+		for i := 0; i < 8; i++ {
+			d.DecodeSymbolWithICDF(silkModelGainLowbits)
+		}
+
+		if err := d.Err(); !errors.Is(err, ErrBitBudgetExceeded) {
+			t.Fatal(err)
+		}
+	})
+
+	t.Run("Stripped zero bytes", func(t *testing.T) {
+		// SILK-only frames are stripped of all their trailing zero bytes,
+		// which decode the same as the zeros the decoder pads with
+		padded := append([]byte{0x0b, 0xe4, 0x5a}, make([]byte, 12)...)
+		full := &Decoder{}
+		full.Init(padded)
+		var symbols []uint32
+		for full.Tell() < 12*8 {
+			symbols = append(symbols, full.DecodeSymbolWithICDF(silkModelGainLowbits))
+		}
+
+		d := &Decoder{}
+		d.Init(padded[:3])
+		for i, symbol := range symbols {
+			if decoded := d.DecodeSymbolWithICDF(silkModelGainLowbits); decoded != symbol {
+				t.Fatalf("symbol %d: %d, expected %d", i, decoded, symbol)
+			}
+		}
+
+		switch {
+		case !errors.Is(d.Err(), ErrBitBudgetExceeded):
+			t.Fatalf("read %d bits of 3 bytes: %v", d.Tell(), d.Err())
+		case d.ErrZeroPadded() != nil:
+			t.Fatal(d.ErrZeroPadded())
+		case d.FinalRange() != full.FinalRange():
+			t.Fatalf("final range %08x, expected %08x", d.FinalRange(), full.FinalRange())
+		}
+
+		// No frame holds more than 1275 bytes
+		for d.Tell() <= maxFrameBytes*8 {
+			d.DecodeRawBits(16)
+		}
+		if err := d.ErrZeroPadded(); !errors.Is(err, ErrBitBudgetExceeded) {
+			t.Fatalf("read %d bits: %v", d.Tell(), err)
+		}
+	})
+
+	t.Run("Invalid uniform value", func(t *testing.T) {
+		e := &Encoder{}
+		e.Init(make([]byte, 8))
+		e.EncodeUniform(0x3ff, 0x400)
+		encoded, err := e.Done()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		// Decoding against a smaller total than was encoded produces a
+		// value outside of the range
+		d := &Decoder{}
+		d.Init(encoded)
+		if result := d.DecodeUniform(0x3f2); result != 0x3f1 {
+			t.Fatal(result)
+		}
+
+		if err := d.Err(); !errors.Is(err, ErrInvalidUniformValue) {
+			t.Fatal(err)
+		}
+	})
+}
+
+func TestDecoder_Shrink(t *testing.T) {
+	e := &Encoder{}
+	e.Init(make([]byte, 4))
+	e.EncodeSymbolLogP(1, 1)
+	e.EncodeRawBits(0x5A, 8)
+	encoded, err := e.Done()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// A redundant frame follows the first one
+	d := &Decoder{}
+	d.Init(append(encoded, 0xAA, 0xBB))
+	if symbol := d.DecodeSymbolLogP(1); symbol != 1 {
+		t.Fatalf("expected 1, got %d", symbol)
+	}
+	d.Shrink(len(encoded))
+	if value := d.DecodeRawBits(8); value != 0x5A {
+		t.Fatalf("expected 0x5A, got %#x", value)
+	}
+	if err := d.Err(); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,434 @@
+package rangecoding
+
+import (
+	"math/bits"
+)
+
+// Encoder implements rfc6716#section-5.1
+// The range coder also acts as the bit-packer for Opus.  It is used in
+// three different ways: to encode
+//
+// o  Entropy-coded symbols with a fixed probability model using
+//    ec_encode() (entenc.c),
+//
+// o  Integers from 0 to (2**M - 1) using ec_enc_uint() or ec_enc_bits()
+//    (entenc.c),
+//
+// o  Integers from 0 to (ft - 1) (where ft is not a power of two) using
+//    ec_enc_uint() (entenc.c).
+//
+// The range encoder maintains an internal state vector composed of the
+// four-tuple (val, rng, rem, ext) representing the low end of the
+// current range, the size of the current range, a single buffered
+// output byte, and a count of additional carry-propagating output
+// bytes.  Both val and rng are 32-bit unsigned integer values, rem is a
+// byte value or the special value -1, and ext is an integer with at
+// least 16 bits.  This state vector is initialized at the start of each
+// frame to the value (0, 2**31, -1, 0).  After encoding a sequence of
+// symbols, the value of rng in the encoder should exactly match the
+// value of rng in the decoder after decoding the same sequence of
+// symbols.  This is a powerful tool for detecting
+// errors in either an encoder or decoder implementation.  The value of
+// val, on the other hand, represents different things in the encoder
+// and decoder, and is not expected to match.
+//
+// https://datatracker.ietf.org/doc/html/rfc6716#section-5.1
+type Encoder struct {
+	data      []byte
+	offset    uint // offs in libopus, bytes written from the front
+	endOffset uint // end_offs in libopus, bytes written from the back
+
+	endWindow    uint32 // raw bits not yet flushed to the back of data
+	endBitsCount uint   // number of valid bits in endWindow
+	bitsTotal    uint   // nbits_total in libopus
+
+	rangeSize  uint32 // rng in RFC 6716
+	lowValue   uint32 // val in RFC 6716
+	remainder  int    // rem in RFC 6716, -1 when no byte is buffered
+	extension  uint   // ext in RFC 6716
+	overflowed bool
+}
+
+// Init sets the state of the Encoder. The encoded frame is written into
+// data, which must be sized to the number of bytes the frame may use.
+// Range coded symbols are packed from the front of data and raw bits
+// from the back.
+//
+// https://datatracker.ietf.org/doc/html/rfc6716#section-5.1
+func (r *Encoder) Init(data []byte) {
+	r.data = data
+	r.offset = 0
+	r.endOffset = 0
+	r.endWindow = 0
+	r.endBitsCount = 0
+	r.bitsTotal = codeBits + 1
+	r.rangeSize = codeTop
+	r.lowValue = 0
+	r.remainder = -1
+	r.extension = 0
+	r.overflowed = false
+}
+
+// EncodeSymbolWithICDF encodes a single symbol with a table-based
+// context of up to 8 bits. The table uses the same layout as
+// Decoder.DecodeSymbolWithICDF.
+//
+// https://datatracker.ietf.org/doc/html/rfc6716#section-5.1.1
+func (r *Encoder) EncodeSymbolWithICDF(cumulativeDistributionTable []uint, symbol uint32) {
+	total := uint32(cumulativeDistributionTable[0])
+	cumulativeDistributionTable = cumulativeDistributionTable[1:]
+
+	high := uint32(cumulativeDistributionTable[symbol])
+	low := uint32(0)
+	if symbol != 0 {
+		low = uint32(cumulativeDistributionTable[symbol-1])
+	}
+
+	r.encode(low, high, total)
+}
+
+// EncodeSymbolLogP encodes a single binary symbol. The context is
+// described by a single parameter, logp, which is the absolute value of
+// the base-2 logarithm of the probability of a "1".
+//
+// https://datatracker.ietf.org/doc/html/rfc6716#section-5.1.3
+func (r *Encoder) EncodeSymbolLogP(logp uint, symbol uint32) {
+	scale := r.rangeSize >> logp
+	remaining := r.rangeSize - scale
+
+	if symbol != 0 {
+		r.lowValue += remaining
+		r.rangeSize = scale
+	} else {
+		r.rangeSize = remaining
+	}
+	r.normalize()
+}
+
+// EncodeUniform encodes value, an integer in the range [0, total), with
+// a uniform distribution. Values that need more than 8 bits are split
+// into a range coded most significant part and raw least significant
+// bits.
+//
+// https://datatracker.ietf.org/doc/html/rfc6716#section-5.1.4
+func (r *Encoder) EncodeUniform(value, total uint32) {
+	total--
+	totalBits := uint(bits.Len32(total))
+	if totalBits > uintBits {
+		totalBits -= uintBits
+		scaledTotal := (total >> totalBits) + 1
+		scaledValue := value >> totalBits
+		r.encode(scaledValue, scaledValue+1, scaledTotal)
+		r.EncodeRawBits(value&((1<<totalBits)-1), totalBits)
+	} else {
+		r.encode(value, value+1, total+1)
+	}
+}
+
+// EncodeRawBits packs the n least significant bits of value as raw bits,
+// bypassing the range coder. Raw bits are packed backwards starting at
+// the end of the frame.
+//
+// https://datatracker.ietf.org/doc/html/rfc6716#section-5.1.2
+func (r *Encoder) EncodeRawBits(value uint32, n uint) {
+	window := r.endWindow
+	used := r.endBitsCount
+
+	if used+n > windowLen {
+		for used >= 8 {
+			r.writeByteAtEnd(byte(window))
+			window >>= 8
+			used -= 8
+		}
+	}
+
+	window |= value << used
+	used += n
+
+	r.endWindow = window
+	r.endBitsCount = used
+	r.bitsTotal += n
+}
+
+// Encode encodes the symbol occupying [low, high) of a context of size
+// total, for contexts that aren't described by a table, like the split
+// angles of CELT.
+//
+// https://datatracker.ietf.org/doc/html/rfc6716#section-5.1.1
+func (r *Encoder) Encode(low, high, total uint32) {
+	r.encode(low, high, total)
+}
+
+// EncodeLaplace encodes value with the Laplace distribution used by CELT
+// for coarse energy, implemented by ec_laplace_encode() (laplace.c). fs
+// is the probability of a zero and decay controls how fast the
+// probability of larger magnitudes decreases, both in Q15. Values too
+// large to be represented are clamped, the value actually coded is
+// returned.
+//
+// https://datatracker.ietf.org/doc/html/rfc6716#section-4.3.2.1
+func (r *Encoder) EncodeLaplace(value int32, fs, decay uint32) int32 {
+	low := uint32(0)
+
+	if value != 0 {
+		sign := int32(0)
+		if value < 0 {
+			sign = -1
+		}
+		magnitude := uint32((value + sign) ^ sign)
+
+		low = fs
+		fs = laplaceFrequencyOne(fs, decay)
+
+		// Search the decaying part of the PDF
+		i := uint32(1)
+		for ; fs > 0 && i < magnitude; i++ {
+			fs *= 2
+			low += fs + 2*laplaceMinimumProbability
+			fs = (fs * decay) >> 15
+		}
+
+		if fs == 0 {
+			// Everything beyond that has probability laplaceMinimumProbability
+			maxIndex := int32((1<<15)-low+laplaceMinimumProbability-1) / laplaceMinimumProbability
+			maxIndex = (maxIndex - sign) >> 1
+
+			di := int32(magnitude - i)
+			if di > maxIndex-1 {
+				di = maxIndex - 1
+			}
+
+			low += uint32(2*di+1+sign) * laplaceMinimumProbability
+			fs = laplaceMinimumProbability
+			if fs > (1<<15)-low {
+				fs = (1 << 15) - low
+			}
+			value = (int32(i) + di + sign) ^ sign
+		} else {
+			fs += laplaceMinimumProbability
+			if sign == 0 {
+				low += fs
+			}
+		}
+	}
+
+	r.encode(low, low+fs, 1<<15)
+
+	return value
+}
+
+// Tell returns the number of bits written so far, rounded up, as
+// computed by ec_tell() (entcode.h).
+//
+// https://datatracker.ietf.org/doc/html/rfc6716#section-4.1.6.1
+func (r *Encoder) Tell() uint {
+	return tell(r.bitsTotal, r.rangeSize)
+}
+
+// TellFrac returns the number of bits written so far in 1/8th bits, as
+// computed by ec_tell_frac() (entcode.c).
+//
+// https://datatracker.ietf.org/doc/html/rfc6716#section-4.1.6.2
+func (r *Encoder) TellFrac() uint {
+	return tellFrac(r.bitsTotal, r.rangeSize)
+}
+
+// Done finalizes the stream, flushing the buffered range coder state and
+// any pending raw bits. The returned slice is the data passed to Init.
+// errEncoderOverflow is returned if the symbols did not fit.
+//
+// After the last symbol, the encoder outputs the smallest number of
+// bits that still allows the decoder to correctly identify the value
+// of rng, flushing carries as needed. The unused space between the
+// range coder data and raw bits is filled with zeros.
+//
+// https://datatracker.ietf.org/doc/html/rfc6716#section-5.1.5
+func (r *Encoder) Done() ([]byte, error) {
+	// Output the minimum number of bits that ensures that the symbols
+	// encoded thus far will be decoded correctly regardless of the bits
+	// that follow.
+	l := codeBits - bits.Len32(r.rangeSize)
+	mask := (codeTop - 1) >> l
+	end := (r.lowValue + mask) &^ mask
+
+	if (end | mask) >= r.lowValue+r.rangeSize {
+		l++
+		mask >>= 1
+		end = (r.lowValue + mask) &^ mask
+	}
+
+	for l > 0 {
+		r.carryOut(end >> codeShift)
+		end = (end << 8) & (codeTop - 1)
+		l -= 8
+	}
+
+	// If we have a buffered byte flush it into the output buffer.
+	if r.remainder >= 0 || r.extension > 0 {
+		r.carryOut(0)
+	}
+
+	// If we have buffered extra bits, flush them as well.
+	window := r.endWindow
+	used := r.endBitsCount
+	for used >= 8 {
+		r.writeByteAtEnd(byte(window))
+		window >>= 8
+		used -= 8
+	}
+
+	if !r.overflowed {
+		// Clear any excess space and add any remaining extra bits to the
+		// last byte.
+		for i := r.offset; i < uint(len(r.data))-r.endOffset; i++ {
+			r.data[i] = 0
+		}
+
+		if used > 0 {
+			if r.endOffset >= uint(len(r.data)) {
+				r.overflowed = true
+			} else {
+				// The raw bits share the final byte with the range coder
+				// data, give up if they overlap.
+				free := uint(-l)
+				if r.offset+r.endOffset >= uint(len(r.data)) && free < used {
+					window &= (1 << free) - 1
+					r.overflowed = true
+				}
+				r.data[uint(len(r.data))-r.endOffset-1] |= byte(window)
+			}
+		}
+	}
+
+	if r.overflowed {
+		return nil, errEncoderOverflow
+	}
+
+	return r.data, nil
+}
+
+// SkipToEnd accounts for all the bits left in the frame as written, as
+// the CELT encoder does for a silent frame, whose remaining bits are
+// left zero.
+func (r *Encoder) SkipToEnd() {
+	r.bitsTotal += uint(len(r.data))*8 - r.Tell()
+}
+
+// Shrink reduces the size of the frame to size bytes, moving the raw
+// bits already written to its new end, like ec_enc_shrink() (entenc.c).
+// The VBR mode of CELT sizes its frame after coding the first symbols.
+func (r *Encoder) Shrink(size int) {
+	copy(r.data[uint(size)-r.endOffset:size], r.data[uint(len(r.data))-r.endOffset:])
+	r.data = r.data[:size]
+}
+
+// FinalRange returns the value of rng, which matches the decoder's final
+// range after decoding the same sequence of symbols.
+func (r *Encoder) FinalRange() uint32 {
+	return r.rangeSize
+}
+
+// ec_encode() (entenc.c) updates the state of the encoder as follows.
+// If fl[k] is greater than zero, then the encoder updates
+//
+//     val = val + rng - (rng/ft)*(ft - fl[k])
+//
+//     rng = (rng/ft)*(fh[k] - fl[k])
+//
+// Otherwise, it updates
+//
+//     rng = rng - (rng/ft)*(ft - fh[k])
+//
+// https://datatracker.ietf.org/doc/html/rfc6716#section-5.1.1
+func (r *Encoder) encode(low, high, total uint32) {
+	scale := r.rangeSize / total
+	if low > 0 {
+		r.lowValue += r.rangeSize - scale*(total-low)
+		r.rangeSize = scale * (high - low)
+	} else {
+		r.rangeSize -= scale * (total - high)
+	}
+
+	r.normalize()
+}
+
+// After this update, the range is normalized using a procedure very
+// similar to that of Section 4.1.2.1, implemented by
+// ec_enc_normalize() (entenc.c).  The following process is repeated
+// until rng > 2**23.  First, the top 9 bits of val, (val>>23), are sent
+// to the carry buffer, described in Section 5.1.1.2.  Then, the encoder
+// sets
+//
+//     val = (val<<8) & 0x7FFFFFFF
+//
+//     rng = rng<<8
+//
+// https://datatracker.ietf.org/doc/html/rfc6716#section-5.1.1.1
+func (r *Encoder) normalize() {
+	for r.rangeSize <= codeBot {
+		r.carryOut(r.lowValue >> codeShift)
+		r.lowValue = (r.lowValue << 8) & (codeTop - 1)
+		r.rangeSize <<= 8
+		r.bitsTotal += 8
+	}
+}
+
+// The function ec_enc_carry_out() (entenc.c) implements carry
+// propagation and output buffering.  It takes, as input, a 9-bit value,
+// c, consisting of 8 data bits and an additional carry bit.  If c is
+// equal to the value 255, then ext is simply incremented, and no other
+// state updates are performed.  Otherwise, let b = (c>>8) be the carry
+// bit.  Then,
+//
+// o  If the buffered byte rem contains a value other than -1, the
+//    encoder outputs the byte (rem + b).  Otherwise, if rem is -1, no
+//    byte is output.
+//
+// o  If ext is non-zero, then the encoder outputs ext bytes--all with a
+//    value of 0 if b is set, or 255 if b is unset--and sets ext to 0.
+//
+// o  rem is set to the 8 data bits:
+//
+//        rem = (c & 255)
+//
+// https://datatracker.ietf.org/doc/html/rfc6716#section-5.1.1.2
+func (r *Encoder) carryOut(c uint32) {
+	if c == symMax {
+		r.extension++
+		return
+	}
+
+	carry := c >> 8
+	if r.remainder >= 0 {
+		r.writeByte(byte(uint32(r.remainder) + carry))
+	}
+
+	if r.extension > 0 {
+		sym := byte((symMax + carry) & symMax)
+		for ; r.extension > 0; r.extension-- {
+			r.writeByte(sym)
+		}
+	}
+
+	r.remainder = int(c & symMax)
+}
+
+func (r *Encoder) writeByte(b byte) {
+	if r.offset+r.endOffset >= uint(len(r.data)) {
+		r.overflowed = true
+		return
+	}
+
+	r.data[r.offset] = b
+	r.offset++
+}
+
+func (r *Encoder) writeByteAtEnd(b byte) {
+	if r.offset+r.endOffset >= uint(len(r.data)) {
+		r.overflowed = true
+		return
+	}
+
+	r.endOffset++
+	r.data[uint(len(r.data))-r.endOffset] = b
+}
@@ -0,0 +1,249 @@
+package rangecoding
+
+import (
+	"errors"
+	"math/rand"
+	"reflect"
+	"testing"
+)
+
+type testSymbol struct {
+	cumulativeDistributionTable []uint
+	logp                        uint
+	value                       uint32
+}
+
+func randomTestSymbols(random *rand.Rand, count int) []testSymbol {
+	tables := [][]uint{
+		silkModelFrameTypeInactive,
+		silkModelGainLowbits,
+		silkModelGainDelta,
+		silkModelLsfInterpolationOffset,
+		silkModelLcgSeed,
+	}
+	tables = append(tables, silkModelGainHighbits...)
+	tables = append(tables, silkModelLsfS2...)
+	tables = append(tables, silkModelExcRate...)
+	tables = append(tables, silkModelPulseCount...)
+
+	symbols := make([]testSymbol, count)
+	for i := range symbols {
+		if random.Intn(4) == 0 {
+			symbols[i] = testSymbol{logp: uint(random.Intn(15) + 1), value: uint32(random.Intn(2))}
+			continue
+		}
+
+		table := tables[random.Intn(len(tables))]
+
+		// Only pick symbols with a non-zero probability
+		for {
+			value := uint32(random.Intn(len(table) - 1))
+			low := uint(0)
+			if value != 0 {
+				low = table[value]
+			}
+			if table[value+1] != low {
+				symbols[i] = testSymbol{cumulativeDistributionTable: table, value: value}
+				break
+			}
+		}
+	}
+
+	return symbols
+}
+
+func TestEncoder_RoundTrip(t *testing.T) {
+	random := rand.New(rand.NewSource(0)) //nolint:gosec
+
+	for run := 0; run < 100; run++ {
+		symbols := randomTestSymbols(random, random.Intn(500)+1)
+
+		e := &Encoder{}
+		e.Init(make([]byte, 1275))
+		for _, s := range symbols {
+			if s.cumulativeDistributionTable != nil {
+				e.EncodeSymbolWithICDF(s.cumulativeDistributionTable, s.value)
+			} else {
+				e.EncodeSymbolLogP(s.logp, s.value)
+			}
+		}
+
+		encoded, err := e.Done()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		d := &Decoder{}
+		d.Init(encoded)
+		for i, s := range symbols {
+			var result uint32
+			if s.cumulativeDistributionTable != nil {
+				result = d.DecodeSymbolWithICDF(s.cumulativeDistributionTable)
+			} else {
+				result = d.DecodeSymbolLogP(s.logp)
+			}
+
+			if result != s.value {
+				t.Fatalf("run %d symbol %d: expected %d, got %d", run, i, s.value, result)
+			}
+		}
+
+		if d.rangeSize != e.FinalRange() {
+			t.Fatalf("run %d: final range mismatch %d != %d", run, d.rangeSize, e.FinalRange())
+		}
+	}
+}
+
+func TestEncoder_CarryPropagation(t *testing.T) {
+	// Coding the most probable symbol of a very skewed distribution
+	// keeps val close to the top of the range, which produces long runs
+	// of 0xFF bytes that have to be resolved by a later carry.
+	e := &Encoder{}
+	e.Init(make([]byte, 64))
+	for i := 0; i < 200; i++ {
+		e.EncodeSymbolLogP(15, 0)
+	}
+	e.EncodeSymbolLogP(1, 1)
+	for i := 0; i < 200; i++ {
+		e.EncodeSymbolLogP(15, 0)
+	}
+
+	encoded, err := e.Done()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	d := &Decoder{}
+	d.Init(encoded)
+	for i := 0; i < 401; i++ {
+		expected := uint32(0)
+		logp := uint(15)
+		if i == 200 {
+			expected = 1
+			logp = 1
+		}
+
+		if result := d.DecodeSymbolLogP(logp); result != expected {
+			t.Fatalf("symbol %d: expected %d, got %d", i, expected, result)
+		}
+	}
+}
+
+func TestEncoder_Uniform(t *testing.T) {
+	uniform := []uint{5, 1, 2, 3, 4, 5}
+
+	e := &Encoder{}
+	e.Init(make([]byte, 16))
+	for _, v := range []uint32{0, 4, 2, 3, 1} {
+		e.EncodeUniform(v, 5)
+	}
+
+	encoded, err := e.Done()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	d := &Decoder{}
+	d.Init(encoded)
+	for _, v := range []uint32{0, 4, 2, 3, 1} {
+		if result := d.DecodeSymbolWithICDF(uniform); result != v {
+			t.Fatalf("expected %d, got %d", v, result)
+		}
+	}
+}
+
+func TestEncoder_RawBits(t *testing.T) {
+	e := &Encoder{}
+	e.Init(make([]byte, 8))
+	e.EncodeRawBits(0b101, 3)
+	e.EncodeRawBits(0b11110, 5)
+	e.EncodeRawBits(0x1234, 16)
+	e.EncodeRawBits(0b1, 1)
+
+	encoded, err := e.Done()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Raw bits are packed LSB to MSB starting at the last byte
+	if !reflect.DeepEqual(encoded, []byte{0x00, 0x00, 0x00, 0x00, 0x01, 0x12, 0x34, 0xf5}) {
+		t.Fatalf("unexpected raw bits %x", encoded)
+	}
+}
+
+func TestEncoder_Overflow(t *testing.T) {
+	e := &Encoder{}
+	e.Init(make([]byte, 2))
+	for i := 0; i < 64; i++ {
+		e.EncodeSymbolWithICDF(silkModelGainLowbits, uint32(i%8))
+	}
+
+	if _, err := e.Done(); !errors.Is(err, errEncoderOverflow) {
+		t.Fatal(err)
+	}
+}
+
+func TestEncoder_Encode(t *testing.T) {
+	// A context of 21 with symbols of frequency 1, 2, ..., 6
+	symbols := [][2]uint32{{0, 1}, {15, 21}, {6, 10}, {1, 3}, {3, 6}, {10, 15}}
+
+	e := &Encoder{}
+	e.Init(make([]byte, 8))
+	for _, s := range symbols {
+		e.Encode(s[0], s[1], 21)
+	}
+	e.SkipToEnd()
+	if e.Tell() != 64 {
+		t.Fatalf("expected all 64 bits to be used, got %d", e.Tell())
+	}
+
+	encoded, err := e.Done()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	d := &Decoder{}
+	d.Init(encoded)
+	for i, s := range symbols {
+		if value := d.Decode(21); value < s[0] || value >= s[1] {
+			t.Fatalf("symbol %d: %d is not in [%d, %d)", i, value, s[0], s[1])
+		}
+		d.Update(s[0], s[1], 21)
+	}
+	d.SkipToEnd()
+	if d.Tell() != 64 {
+		t.Fatalf("expected all 64 bits to be read, got %d", d.Tell())
+	}
+	if d.FinalRange() != e.FinalRange() {
+		t.Fatalf("final range mismatch %d != %d", d.FinalRange(), e.FinalRange())
+	}
+}
+
+func TestEncoder_Shrink(t *testing.T) {
+	e := &Encoder{}
+	e.Init(make([]byte, 32))
+	e.EncodeSymbolLogP(1, 1)
+	e.EncodeRawBits(0x5A, 8)
+	e.Shrink(4)
+	e.EncodeUniform(5, 7)
+
+	encoded, err := e.Done()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(encoded) != 4 {
+		t.Fatalf("expected 4 bytes, got %d", len(encoded))
+	}
+
+	d := &Decoder{}
+	d.Init(encoded)
+	if symbol := d.DecodeSymbolLogP(1); symbol != 1 {
+		t.Fatalf("expected 1, got %d", symbol)
+	}
+	if value := d.DecodeRawBits(8); value != 0x5A {
+		t.Fatalf("expected 0x5A, got %#x", value)
+	}
+	if value := d.DecodeUniform(7); value != 5 {
+		t.Fatalf("expected 5, got %d", value)
+	}
+}
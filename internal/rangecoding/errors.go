@@ -0,0 +1,15 @@
+package rangecoding
+
+import "errors"
+
+var (
+	// ErrBitBudgetExceeded is returned when more bits were decoded than
+	// the frame contains, which means it was truncated or corrupted
+	ErrBitBudgetExceeded = errors.New("range decoder read past the end of the frame")
+
+	// ErrInvalidUniformValue is returned when a uniformly coded integer
+	// was decoded outside of its range
+	ErrInvalidUniformValue = errors.New("range decoder decoded an out of range uniform integer")
+
+	errEncoderOverflow = errors.New("encoded symbols do not fit in the output buffer")
+)
@@ -0,0 +1,64 @@
+// Package rangecoding implements the range encoder and decoder used by
+// both the SILK and CELT layers of Opus.
+package rangecoding
+
+import "math/bits"
+
+const (
+	codeBits  = 32
+	codeShift = codeBits - 8 - 1
+	codeTop   = uint32(1) << (codeBits - 1)
+	codeBot   = codeTop >> 8
+	symMax    = 255
+	uintBits  = 8
+	windowLen = 32
+
+	// The minimum probability of an energy delta, and the number of
+	// deltas that are guaranteed to have it.
+	laplaceMinimumProbability = 1
+	laplaceMinimumCount       = 16
+
+	// An Opus frame is at most 1275 bytes, which bounds how many trailing
+	// zero bytes a frame may have been stripped of
+	//
+	// https://datatracker.ietf.org/doc/html/rfc6716#section-3.2.1
+	maxFrameBytes = 1275
+)
+
+// The number of bits used so far is the number of whole bits moved
+// through the range coder plus the raw bits, less the bits of rng that
+// have not yet been committed:
+//
+//     ec_tell() = nbits_total - ilog(rng)
+//
+// https://datatracker.ietf.org/doc/html/rfc6716#section-4.1.6.1
+func tell(bitsTotal uint, rangeSize uint32) uint {
+	return bitsTotal - uint(bits.Len32(rangeSize))
+}
+
+// ec_tell_frac() estimates the number of bits used to 1/8th bit
+// precision by repeatedly squaring rng to find its fractional
+// logarithm.
+//
+// https://datatracker.ietf.org/doc/html/rfc6716#section-4.1.6.2
+func tellFrac(bitsTotal uint, rangeSize uint32) uint {
+	nbits := bitsTotal << 3
+	l := uint(bits.Len32(rangeSize))
+	r := rangeSize >> (l - 16)
+
+	for i := 0; i < 3; i++ {
+		r = (r * r) >> 15
+		b := r >> 16
+		l = (l << 1) | uint(b)
+		r >>= b
+	}
+
+	return nbits - l
+}
+
+// ec_laplace_get_freq1() (laplace.c) returns the probability of a
+// magnitude of one given the probability of zero, fs0, and the decay.
+func laplaceFrequencyOne(fs0, decay uint32) uint32 {
+	ft := 32768 - laplaceMinimumProbability*(2*laplaceMinimumCount) - fs0
+	return (ft * (16384 - decay)) >> 15
+}
@@ -0,0 +1,95 @@
+// Package resample implements a windowed sinc sample rate converter
+package resample
+
+import "math"
+
+const (
+	// Half the length of the resampling filter, in samples at the lower
+	// of the two rates
+	halfTaps = 8
+
+	// The passband ends before the Nyquist frequency of the lower rate, so
+	// that the transition band is attenuated
+	cutoff = 0.9
+)
+
+// Resampler changes the sample rate of mono samples by a rational factor
+// with a Hann windowed sinc filter. Its output is delayed by the half
+// length of the filter, which Delay returns.
+type Resampler struct {
+	// The output is up/down times the input rate
+	up, down int
+	halfTaps int
+
+	// The last 2*halfTaps input samples
+	history []float32
+}
+
+// New returns a Resampler from inputRate to outputRate
+func New(inputRate, outputRate int) *Resampler {
+	divisor := gcd(inputRate, outputRate)
+	r := &Resampler{
+		up:   outputRate / divisor,
+		down: inputRate / divisor,
+	}
+	r.halfTaps = halfTaps
+	if r.down > r.up {
+		r.halfTaps = halfTaps * r.down / r.up
+	}
+	r.history = make([]float32, 2*r.halfTaps)
+	return r
+}
+
+// BlockSize returns the number of input samples the length of the input of
+// Process must be a multiple of
+func (r *Resampler) BlockSize() int {
+	return r.down
+}
+
+// Delay returns the delay of the output, in output samples
+func (r *Resampler) Delay() int {
+	if r.up == r.down {
+		return 0
+	}
+	return r.halfTaps * r.up / r.down
+}
+
+// Process resamples in, whose length must be a multiple of BlockSize
+func (r *Resampler) Process(in []float32) []float32 {
+	if r.up == r.down {
+		return in
+	}
+
+	buffer := append(r.history[:len(r.history):len(r.history)], in...)
+	cutoff := cutoff * math.Min(1, float64(r.up)/float64(r.down))
+
+	out := make([]float32, len(in)*r.up/r.down)
+	for j := range out {
+		center := float64(r.halfTaps) + float64(j*r.down)/float64(r.up)
+		first := int(math.Ceil(center)) - r.halfTaps
+		var sum float64
+		for i := first; i < first+2*r.halfTaps && i < len(buffer); i++ {
+			x := float64(i) - center
+			window := 0.5 + 0.5*math.Cos(math.Pi*x/float64(r.halfTaps))
+			sum += float64(buffer[i]) * cutoff * sinc(cutoff*x) * window
+		}
+		out[j] = float32(sum)
+	}
+
+	r.history = buffer[len(buffer)-len(r.history):]
+	return out
+}
+
+func sinc(x float64) float64 {
+	if x == 0 {
+		return 1
+	}
+	return math.Sin(math.Pi*x) / (math.Pi * x)
+}
+
+func gcd(a, b int) int {
+	for b != 0 {
+		a, b = b, a%b
+	}
+	return a
+}
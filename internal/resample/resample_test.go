@@ -0,0 +1,81 @@
+package resample
+
+import (
+	"math"
+	"testing"
+)
+
+func sine(frequency float64, sampleRate, count int) []float32 {
+	samples := make([]float32, sampleRate/50*count)
+	for i := range samples {
+		samples[i] = float32(0.5 * math.Sin(2*math.Pi*frequency*float64(i)/float64(sampleRate)))
+	}
+	return samples
+}
+
+func TestResampler(t *testing.T) {
+	for _, test := range []struct {
+		inputRate, outputRate int
+		frequency             float64
+		gain                  float64
+	}{
+		{48000, 16000, 1000, 1},
+		{24000, 16000, 1000, 1},
+		{16000, 12000, 1000, 1},
+		{48000, 8000, 1000, 1},
+		{48000, 16000, 12000, 0},
+		{16000, 48000, 1000, 1},
+	} {
+		r := New(test.inputRate, test.outputRate)
+		var out []float32
+		in := sine(test.frequency, test.inputRate, 10)
+		for i := 0; i < len(in); i += test.inputRate / 50 {
+			out = append(out, r.Process(in[i:i+test.inputRate/50])...)
+		}
+		if len(out) != len(in)*test.outputRate/test.inputRate {
+			t.Fatalf("%d to %d Hz: %d samples out of %d", test.inputRate, test.outputRate, len(out), len(in))
+		}
+
+		// Skip the first frame, where the filter starts from silence
+		var peak float64
+		for _, sample := range out[test.outputRate/50:] {
+			peak = math.Max(peak, math.Abs(float64(sample)))
+		}
+		if math.Abs(peak/0.5-test.gain) > 0.05 {
+			t.Fatalf("%d to %d Hz: %.0f Hz tone has gain %f, expected %f", test.inputRate, test.outputRate, test.frequency, peak/0.5, test.gain)
+		}
+	}
+}
+
+func TestResamplerDelay(t *testing.T) {
+	for _, test := range []struct {
+		inputRate, outputRate int
+		delay                 int
+	}{
+		{48000, 48000, 0},
+		{48000, 8000, 8},
+		{48000, 16000, 8},
+		{48000, 24000, 8},
+		{16000, 48000, 24},
+	} {
+		r := New(test.inputRate, test.outputRate)
+		if delay := r.Delay(); delay != test.delay {
+			t.Fatalf("%d to %d Hz: delay %d, expected %d", test.inputRate, test.outputRate, delay, test.delay)
+		}
+
+		// An impulse comes out Delay samples later
+		in := make([]float32, test.inputRate/50)
+		in[0] = 1
+		out := r.Process(in)
+
+		peak := 0
+		for i, sample := range out {
+			if math.Abs(float64(sample)) > math.Abs(float64(out[peak])) {
+				peak = i
+			}
+		}
+		if peak != test.delay {
+			t.Fatalf("%d to %d Hz: impulse at %d, expected %d", test.inputRate, test.outputRate, peak, test.delay)
+		}
+	}
+}
@@ -0,0 +1,556 @@
+package silk
+
+import (
+	"math"
+	"sort"
+)
+
+const (
+	// Pitch lags are searched from 2 to 18 ms, like PE_MIN_LAG_MS and
+	// PE_MAX_LAG_MS of the reference encoder
+	pitchMinLagMs = 2
+	pitchMaxLagMs = 18
+
+	// A frame with voice activity is voiced when it correlates with its
+	// past by more than voicingThreshold at the pitch lag. Longer lags are
+	// penalized by up to pitchShortLagBias, so that multiples of the
+	// pitch period aren't picked.
+	voicingThreshold  = 0.6
+	pitchShortLagBias = 0.2
+
+	// A frame has voice activity when its energy is vadSNRThreshold times
+	// (6 dB) above the background noise estimate. Frames below
+	// vadMinEnergy, about -70 dBFS, never have voice activity. The
+	// estimate starts at most at vadInitialNoise, about -50 dBFS, falls
+	// to the energy of quieter frames and rises by vadNoiseRise (0.25 dB)
+	// per louder frame.
+	vadSNRThreshold = 4
+	vadMinEnergy    = 1e-7
+	vadInitialNoise = 1e-5
+	vadNoiseRise    = 1.06
+
+	// White noise added to the autocorrelation before LPC analysis, like
+	// FIND_LPC_COND_FAC of the reference encoder, and the bandwidth
+	// expansion applied to the LPC coefficients. Both are stronger than
+	// the reference encoder's: without noise shaping, the quantization
+	// error is fed back through the predictor, and the excitation of very
+	// peaky spectra like pure tones would take too many bits.
+	lpcConditioning       = 1e-3
+	lpcBandwidthExpansion = 0.98
+
+	// The stereo prediction of a SILK frame is used when it removes at
+	// least minStereoPredictionGain of the energy of the side channel
+	minStereoPredictionGain = 0.5
+
+	// The roots of the LSF polynomials are searched on a grid of
+	// lsfSearchGridSize angles. When two roots fall between the same grid
+	// points, the LPC filter is bandwidth-expanded by lsfSearchExpansion
+	// and searched again, up to lsfSearchAttempts times.
+	lsfSearchGridSize  = 512
+	lsfSearchExpansion = 0.98
+	lsfSearchAttempts  = 10
+	lsfBisections      = 20
+
+	// Lags within pitchLagSearchRadius of the open-loop lag are searched
+	// for the primary lag of the pitch contour
+	pitchLagSearchRadius = 2
+
+	// The number of taps of the LTP filter
+	ltpOrder = 5
+)
+
+// detectVoiceActivity compares the energy of a frame with an estimate of
+// the background noise. It is much simpler than the VAD of the reference
+// encoder, which estimates the SNR of four frequency bands.
+//
+// https://datatracker.ietf.org/doc/html/rfc6716#section-5.2.3.2
+func (e *Encoder) detectVoiceActivity(frame []float32) bool {
+	energy := meanSquare(frame)
+	if !e.haveEncoded {
+		e.noiseEnergy = math.Min(math.Max(energy, vadMinEnergy), vadInitialNoise)
+	}
+
+	voiceActivityDetected := energy > vadMinEnergy && energy > e.noiseEnergy*vadSNRThreshold
+	if energy < e.noiseEnergy {
+		e.noiseEnergy = math.Max(energy, vadMinEnergy)
+	} else {
+		e.noiseEnergy = math.Min(e.noiseEnergy*vadNoiseRise, energy)
+	}
+
+	return voiceActivityDetected
+}
+
+// analyzePitch searches the lag, in samples, at which the frame starting
+// at frameStart of signal has the highest normalized correlation with
+// its past. signal must hold pitchMaxLagMs of samples before the frame.
+//
+// https://datatracker.ietf.org/doc/html/rfc6716#section-5.2.3.3
+func analyzePitch(signal []float32, frameStart, sampleRate int) (lag int, correlation float64) {
+	frame := signal[frameStart:]
+	minLag := pitchMinLagMs * sampleRate / 1000
+	maxLag := pitchMaxLagMs * sampleRate / 1000
+	frameEnergy := energy(frame)
+
+	bestScore := 0.0
+	for candidate := minLag; candidate <= maxLag; candidate++ {
+		past := signal[frameStart-candidate : len(signal)-candidate]
+
+		var crossCorrelation float64
+		for i := range frame {
+			crossCorrelation += float64(frame[i]) * float64(past[i])
+		}
+
+		normalization := math.Sqrt(frameEnergy * energy(past))
+		if normalization == 0 {
+			continue
+		}
+
+		c := crossCorrelation / normalization
+		score := c * (1 - pitchShortLagBias*float64(candidate-minLag)/float64(maxLag-minLag))
+		if score > bestScore {
+			bestScore, lag, correlation = score, candidate, c
+		}
+	}
+
+	return lag, correlation
+}
+
+// analyzeLPC computes the coefficients a of the short-term predictor
+//
+//	x[n] ~ a[0]*x[n-1] + a[1]*x[n-2] + ... + a[order-1]*x[n-order]
+//
+// of frame, with the autocorrelation method and the Levinson-Durbin
+// recursion. The reference encoder uses Burg's method instead.
+//
+// https://datatracker.ietf.org/doc/html/rfc6716#section-5.2.3.4
+func analyzeLPC(frame []float32, order int) []float64 {
+	windowed := make([]float64, len(frame))
+	for i, sample := range frame {
+		windowed[i] = float64(sample) * math.Sin(math.Pi*(float64(i)+0.5)/float64(len(frame)))
+	}
+
+	autocorrelation := make([]float64, order+1)
+	for lag := range autocorrelation {
+		for i := lag; i < len(windowed); i++ {
+			autocorrelation[lag] += windowed[i] * windowed[i-lag]
+		}
+	}
+
+	a := make([]float64, order)
+	if autocorrelation[0] == 0 {
+		return a
+	}
+
+	predictionError := autocorrelation[0] * (1 + lpcConditioning)
+	previous := make([]float64, order)
+	for i := 0; i < order; i++ {
+		reflection := autocorrelation[i+1]
+		for j := 0; j < i; j++ {
+			reflection -= a[j] * autocorrelation[i-j]
+		}
+		reflection /= predictionError
+
+		copy(previous, a)
+		a[i] = reflection
+		for j := 0; j < i; j++ {
+			a[j] = previous[j] - reflection*previous[i-1-j]
+		}
+
+		predictionError *= 1 - reflection*reflection
+	}
+
+	expansion := lpcBandwidthExpansion
+	for i := range a {
+		a[i] *= expansion
+		expansion *= lpcBandwidthExpansion
+	}
+
+	return a
+}
+
+// residualEnergies filters the frame starting at frameStart of signal
+// with the prediction error filter of a, and returns the mean square of
+// the residual of each of its subframes. signal must hold len(a) samples
+// before the frame.
+func residualEnergies(signal []float32, frameStart int, a []float64, subframes int) []float64 {
+	subframeLength := (len(signal) - frameStart) / subframes
+	energies := make([]float64, subframes)
+	for n := frameStart; n < len(signal); n++ {
+		residual := float64(signal[n])
+		for i, coefficient := range a {
+			residual -= coefficient * float64(signal[n-1-i])
+		}
+
+		energies[(n-frameStart)/subframeLength] += residual * residual
+	}
+
+	for i := range energies {
+		energies[i] /= float64(subframeLength)
+	}
+	return energies
+}
+
+func energy(samples []float32) float64 {
+	var sum float64
+	for _, sample := range samples {
+		sum += float64(sample) * float64(sample)
+	}
+	return sum
+}
+
+func meanSquare(samples []float32) float64 {
+	if len(samples) == 0 {
+		return 0
+	}
+	return energy(samples) / float64(len(samples))
+}
+
+// lpcToNormalizedLSF converts the coefficients a of analyzeLPC into
+// normalized LSFs in Q15, the inverse of
+// convertNormalizedLSFsToLPCCoefficients. The LSFs are the angles of the
+// roots of
+//
+//	P(z) = A(z) + z**-(d+1)*A(1/z)
+//	Q(z) = A(z) - z**-(d+1)*A(1/z)
+//
+// where A(z) = 1 - a[0]*z**-1 - ... - a[d-1]*z**-d. The roots interleave
+// on the unit circle when A(z) is minimum phase. They are found, like
+// silk_A2NLSF() (A2NLSF.c) does, at the sign changes of P and Q on a grid
+// of angles, and refined by bisection.
+//
+// https://datatracker.ietf.org/doc/html/rfc6716#section-4.2.7.5.6
+func lpcToNormalizedLSF(a []float64) []int16 {
+	expanded := append([]float64{}, a...)
+	for attempt := 0; attempt < lsfSearchAttempts; attempt++ {
+		if nlsfQ15, ok := findLineSpectralFrequencies(expanded); ok {
+			return nlsfQ15
+		}
+
+		expansion := lsfSearchExpansion
+		for i := range expanded {
+			expanded[i] *= expansion
+			expansion *= lsfSearchExpansion
+		}
+	}
+
+	// Evenly spaced LSFs, a flat spectrum
+	nlsfQ15 := make([]int16, len(a))
+	for i := range nlsfQ15 {
+		nlsfQ15[i] = int16(32768 * (i + 1) / (len(a) + 1))
+	}
+	return nlsfQ15
+}
+
+// findLineSpectralFrequencies searches the roots of the LSF polynomials of
+// a. ok is false when fewer than len(a) roots are found.
+func findLineSpectralFrequencies(a []float64) (nlsfQ15 []int16, ok bool) {
+	// P and Q have trivial roots at pi and 0, the grid skips both
+	angle := func(i int) float64 {
+		return math.Pi * (float64(i) + 0.5) / lsfSearchGridSize
+	}
+
+	roots := make([]float64, 0, len(a))
+	previous := lineSpectralPolynomials(a, angle(0))
+	for i := 1; i < lsfSearchGridSize; i++ {
+		current := lineSpectralPolynomials(a, angle(i))
+		for polynomial := range current {
+			if (previous[polynomial] < 0) == (current[polynomial] < 0) {
+				continue
+			}
+
+			// The root is between the two grid points
+			low, high := angle(i-1), angle(i)
+			for j := 0; j < lsfBisections; j++ {
+				middle := (low + high) / 2
+				if (lineSpectralPolynomials(a, middle)[polynomial] < 0) == (previous[polynomial] < 0) {
+					low = middle
+				} else {
+					high = middle
+				}
+			}
+			roots = append(roots, (low+high)/2)
+		}
+		previous = current
+	}
+
+	if len(roots) != len(a) {
+		return nil, false
+	}
+
+	sort.Float64s(roots)
+	nlsfQ15 = make([]int16, len(roots))
+	for i, root := range roots {
+		nlsfQ15[i] = int16(clamp(1, int32(math.Round(root/math.Pi*32768)), 32767))
+	}
+	return nlsfQ15, true
+}
+
+// lineSpectralPolynomials evaluates P and Q at the angle omega, multiplied
+// by exp(j*omega*(d+1)/2) so that they are real
+func lineSpectralPolynomials(a []float64, omega float64) [2]float64 {
+	half := float64(len(a)+1) / 2
+	p, q := math.Cos(half*omega), math.Sin(half*omega)
+	for k, coefficient := range a {
+		p -= coefficient * math.Cos((half-float64(k+1))*omega)
+		q -= coefficient * math.Sin((half-float64(k+1))*omega)
+	}
+	return [2]float64{p, q}
+}
+
+// lpcResidual filters signal with the prediction error filter of the
+// quantized a_Q12. The first len(aQ12) samples, which lack a history, are
+// left at zero.
+func lpcResidual(signal []float32, aQ12 []float32) []float64 {
+	residual := make([]float64, len(signal))
+	for n := len(aQ12); n < len(signal); n++ {
+		residual[n] = float64(signal[n])
+		for k, coefficient := range aQ12 {
+			residual[n] -= float64(coefficient) / 4096 * float64(signal[n-1-k])
+		}
+	}
+	return residual
+}
+
+// searchPitchContour refines the open-loop lag of analyzePitch into a
+// primary lag and a pitch contour, the per-subframe lags the decoder
+// assembles in decodePitchLags. The lags near the open-loop lag are tried
+// with every contour of the codebook, and the combination whose lags best
+// correlate each subframe of the LPC residual with its past is kept.
+//
+// https://datatracker.ietf.org/doc/html/rfc6716#section-4.2.7.6.1
+func searchPitchContour(
+	residual []float64,
+	frameStart, subframeLength, lag int,
+	bandwidth Bandwidth,
+	nanoseconds int,
+) (primaryLag int, contourIndex uint32, pitchLags []int) {
+	_, lagScale, lagMin, lagMax := pitchLagCodebooks(bandwidth)
+	lagCb, _ := pitchContourCodebooks(bandwidth, nanoseconds)
+	subframes := subframeCount(nanoseconds)
+
+	// The normalized correlation of each subframe at each lag, computed as
+	// the search needs it
+	correlations := make([][]float64, subframes)
+	for s := range correlations {
+		correlations[s] = make([]float64, lagMax+1)
+		for i := range correlations[s] {
+			correlations[s][i] = math.NaN()
+		}
+	}
+	correlation := func(s, lag int) float64 {
+		if math.IsNaN(correlations[s][lag]) {
+			start := frameStart + s*subframeLength
+			target := residual[start : start+subframeLength]
+			past := residual[start-lag : start-lag+subframeLength]
+
+			var crossCorrelation, targetEnergy, pastEnergy float64
+			for i := range target {
+				crossCorrelation += target[i] * past[i]
+				targetEnergy += target[i] * target[i]
+				pastEnergy += past[i] * past[i]
+			}
+
+			correlations[s][lag] = 0
+			if normalization := math.Sqrt(targetEnergy * pastEnergy); normalization > 0 {
+				correlations[s][lag] = crossCorrelation / normalization
+			}
+		}
+		return correlations[s][lag]
+	}
+
+	// The primary lag is coded in 32*lag_scale steps from lag_min
+	maxPrimaryLag := int(lagMin + 32*lagScale - 1)
+	bestScore := math.Inf(-1)
+	pitchLags = make([]int, subframes)
+	for candidate := lag - pitchLagSearchRadius; candidate <= lag+pitchLagSearchRadius; candidate++ {
+		if candidate < int(lagMin) || candidate > maxPrimaryLag {
+			continue
+		}
+
+		for contour := range lagCb {
+			var score float64
+			for s := 0; s < subframes; s++ {
+				score += correlation(s, int(clamp(int32(lagMin), int32(candidate+int(lagCb[contour][s])), int32(lagMax))))
+			}
+
+			if score > bestScore {
+				bestScore, primaryLag, contourIndex = score, candidate, uint32(contour)
+			}
+		}
+	}
+
+	for s := range pitchLags {
+		pitchLags[s] = int(clamp(int32(lagMin), int32(primaryLag+int(lagCb[contourIndex][s])), int32(lagMax)))
+	}
+	return primaryLag, contourIndex, pitchLags
+}
+
+// searchLTPFilters picks the 5-tap LTP filter of each subframe from the
+// codebook of each periodicity index, minimizing the energy of the LTP
+// residual of the LPC residual, and keeps the periodicity index with the
+// lowest total energy. It returns the mean square of the LTP residual of
+// each subframe.
+//
+// https://datatracker.ietf.org/doc/html/rfc6716#section-4.2.7.6.2
+func searchLTPFilters(
+	residual []float64,
+	frameStart, subframeLength int,
+	pitchLags []int,
+) (periodicityIndex uint32, filterIndices []uint32, energies []float64) {
+	codebooks := [][][]int8{
+		codebookLTPFilterPeriodicityIndex0,
+		codebookLTPFilterPeriodicityIndex1,
+		codebookLTPFilterPeriodicityIndex2,
+	}
+
+	// The correlations of the subframe with the lagged residual each tap
+	// filters, and of the lagged residuals with each other
+	type subframeCorrelations struct {
+		energy      float64
+		correlation [ltpOrder]float64
+		covariance  [ltpOrder][ltpOrder]float64
+	}
+	statistics := make([]subframeCorrelations, len(pitchLags))
+	for s, lag := range pitchLags {
+		start := frameStart + s*subframeLength
+		for i := start; i < start+subframeLength; i++ {
+			statistics[s].energy += residual[i] * residual[i]
+			for k := 0; k < ltpOrder; k++ {
+				tap := residual[i-lag+2-k]
+				statistics[s].correlation[k] += residual[i] * tap
+				for l := 0; l < ltpOrder; l++ {
+					statistics[s].covariance[k][l] += tap * residual[i-lag+2-l]
+				}
+			}
+		}
+	}
+
+	// The energy of the LTP residual of a filter b is
+	//
+	//     energy - 2*b'*correlation + b'*covariance*b
+	predictionError := func(s int, bQ7 []int8) float64 {
+		err := statistics[s].energy
+		for k := 0; k < ltpOrder; k++ {
+			b := float64(bQ7[k]) / 128
+			err -= 2 * b * statistics[s].correlation[k]
+			for l := 0; l < ltpOrder; l++ {
+				err += b * statistics[s].covariance[k][l] * float64(bQ7[l]) / 128
+			}
+		}
+		return math.Max(err, 0)
+	}
+
+	bestTotal := math.Inf(1)
+	for periodicity, codebook := range codebooks {
+		indices := make([]uint32, len(pitchLags))
+		subframeErrors := make([]float64, len(pitchLags))
+		var total float64
+		for s := range pitchLags {
+			subframeErrors[s] = math.Inf(1)
+			for index, bQ7 := range codebook {
+				if err := predictionError(s, bQ7); err < subframeErrors[s] {
+					subframeErrors[s], indices[s] = err, uint32(index)
+				}
+			}
+			total += subframeErrors[s]
+		}
+
+		if total < bestTotal {
+			bestTotal, periodicityIndex, filterIndices, energies = total, uint32(periodicity), indices, subframeErrors
+		}
+	}
+
+	for s := range energies {
+		energies[s] /= float64(subframeLength)
+	}
+	return periodicityIndex, filterIndices, energies
+}
+
+// stereoMix converts left and right to mid and side, like
+// silk_stereo_LR_to_MS() (stereo_LR_to_MS.c), and returns the mid channel
+// and the residual of the side channel after prediction from the mid
+// channel with the quantized weights of each SILK frame. The decoder
+// delays both channels by a sample, so the weights a sample is predicted
+// with are those the decoder interpolates for the next one. The mid
+// sample after the Opus frame isn't known yet, and is taken to be the
+// last one.
+//
+// https://datatracker.ietf.org/doc/html/rfc6716#section-4.2.8
+func (e *Encoder) stereoMix(in []float32, frameCount int, bandwidth Bandwidth) (mid, residual []float32, weights []stereoWeights) {
+	n := len(in) / 2
+	mid = make([]float32, n)
+	side := make([]float32, n)
+	for i := range mid {
+		mid[i] = (in[2*i] + in[2*i+1]) / 2
+		side[i] = (in[2*i] - in[2*i+1]) / 2
+	}
+
+	// The low-passed mid channel the first weight applies to
+	smoothed := make([]float32, n)
+	for i := range mid {
+		previous, next := e.previousMid, mid[n-1]
+		if i > 0 {
+			previous = mid[i-1]
+		}
+		if i+1 < n {
+			next = mid[i+1]
+		}
+		smoothed[i] = (previous + 2*mid[i] + next) / 4
+	}
+	e.previousMid = mid[n-1]
+
+	phaseOneSampleCount := e.decoder.stereoPhaseOneSampleCount(bandwidth)
+	frameLength := n / frameCount
+	weights = make([]stereoWeights, frameCount)
+	residual = make([]float32, n)
+	for f := range weights {
+		start, end := f*frameLength, (f+1)*frameLength
+		weights[f] = quantizeStereoWeights(fitStereoWeights(mid[start:end], smoothed[start:end], side[start:end]))
+
+		previous, current := e.previousStereoWeights, weights[f]
+		for i := start; i < end; i++ {
+			interpSample := minInt(i-start+1, phaseOneSampleCount)
+			w0 := float32(previous.w0Q13)/8192.0 +
+				float32(interpSample)*float32(current.w0Q13-previous.w0Q13)/(8192.0*float32(phaseOneSampleCount))
+			w1 := float32(previous.w1Q13)/8192.0 +
+				float32(interpSample)*float32(current.w1Q13-previous.w1Q13)/(8192.0*float32(phaseOneSampleCount))
+			residual[i] = side[i] - w1*mid[i] - w0*smoothed[i]
+		}
+		e.previousStereoWeights = current
+	}
+
+	return mid, residual, weights
+}
+
+// fitStereoWeights returns the least squares prediction of the side
+// channel from the low-passed mid channel and from the rest of it, the
+// two predictors silk_stereo_find_predictor() (stereo_find_predictor.c)
+// finds. Channels that are too different to predict the side channel
+// from the mid channel get no prediction, as the residual of a poor one
+// mixes both channels into a signal that codes worse than the side
+// channel itself.
+func fitStereoWeights(mid, smoothed, side []float32) (lowPass, highPass float64) {
+	var ll, lh, hh, ls, hs, ss float64
+	for i := range mid {
+		l, h, s := float64(smoothed[i]), float64(mid[i]-smoothed[i]), float64(side[i])
+		ll += l * l
+		lh += l * h
+		hh += h * h
+		ls += l * s
+		hs += h * s
+		ss += s * s
+	}
+
+	// A little regularization keeps silent and perfectly correlated
+	// frames from dividing by zero
+	ll += vadMinEnergy
+	hh += vadMinEnergy
+	determinant := ll*hh - lh*lh
+	lowPass, highPass = (ls*hh-hs*lh)/determinant, (hs*ll-ls*lh)/determinant
+
+	// The energy the prediction removes from the side channel
+	if lowPass*ls+highPass*hs < minStereoPredictionGain*ss {
+		return 0, 0
+	}
+	return lowPass, highPass
+}
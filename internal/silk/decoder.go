@@ -1,27 +1,202 @@
 package silk
 
 import (
+	"math"
+	"sort"
+
 	"github.com/pion/opus/internal/rangecoding"
 )
 
 // Decoder maintains the state needed to decode a stream
-// of Silk frames
+// of Silk frames. The zero value is ready to use.
 type Decoder struct {
 	rangeDecoder rangecoding.Decoder
 
+	// The side channel of a stereo stream is decoded with its own
+	// prediction state
+	sideDecoder *Decoder
+
+	// SILK resets its per-channel prediction state whenever the internal
+	// decoder rate changes between NB, MB, and WB.
+	previousBandwidth Bandwidth
+
 	// Have we decoded a frame yet?
 	haveDecoded bool
 
-	// TODO, should have dedicated frame state
-	logGain       uint32
-	subframeState [4]struct {
-		gain float64
-	}
+	// Is the previous frame a voiced frame?
+	isPreviousFrameVoiced bool
+	previousLag           int
+
+	previousLogGain int32
+
+	// The decoder saves the final d_LPC values, i.e., lpc[i] such that
+	// (j + n - d_LPC) <= i < (j + n), to feed into the LPC synthesis of the
+	// next subframe.  This requires storage for up to 16 values of lpc[i]
+	// (for WB frames).
+	previousFrameLPCValues []float32
+
+	// This requires storage to buffer up to 306 values of out[i] from
+	// previous subframes.
+	// https://www.rfc-editor.org/rfc/rfc6716#section-4.2.7.9.1
+	finalOutValues []float32
+
+	// n0Q15 are the LSF coefficients decoded for the prior frame
+	// see normalizeLSFInterpolation
+	n0Q15 []int16
+
+	previousStereoWeights [2]int32
+	previousMidValues     [2]float32
+	previousSideValue     float32
+	previousDecodeOnlyMid bool
+	wasStereo             bool
+
+	// The pitch lag of the last subframe, for concealment and
+	// PreviousPitchLag
+	pitchLag int
+
+	concealment concealmentState
 }
 
 // NewDecoder creates a new Silk Decoder
 func NewDecoder() *Decoder {
-	return &Decoder{}
+	d := &Decoder{}
+	d.Reset()
+
+	return d
+}
+
+// Reset discards all state carried between frames, as if the Decoder was
+// just created
+func (d *Decoder) Reset() {
+	*d = Decoder{
+		finalOutValues: make([]float32, finalOutValuesCount),
+	}
+	d.resetPredictionState()
+}
+
+func (d *Decoder) initialize() {
+	if d.finalOutValues == nil {
+		d.Reset()
+	}
+}
+
+func (d *Decoder) resetPredictionState() {
+	d.haveDecoded = false
+	d.isPreviousFrameVoiced = false
+	d.previousLag = 100
+	d.pitchLag = 100
+	d.previousLogGain = 10
+	d.previousFrameLPCValues = nil
+	for i := range d.finalOutValues {
+		d.finalOutValues[i] = 0
+	}
+	d.n0Q15 = nil
+}
+
+// RFC 6716 Sections 4.2.7.4, 4.2.7.5.5, and 4.2.7.6.1 require the side
+// channel to restart gain, LSF, and pitch prediction after an uncoded frame.
+func (d *Decoder) resetSideDecoderPrediction() {
+	if d.sideDecoder == nil {
+		d.sideDecoder = NewDecoder()
+	}
+
+	d.sideDecoder.resetPredictionState()
+}
+
+// silk_decoder_set_fs() in the RFC 6716 reference implementation resets the
+// predictor history whenever the internal SILK rate changes. The normative
+// predictor dependencies are described in Sections 4.2.7.4, 4.2.7.5.5, and
+// 4.2.7.6.1, so carrying them across NB/MB/WB switches changes later frames.
+func (d *Decoder) resetPredictionForBandwidthChange(bandwidth Bandwidth) {
+	if d.previousBandwidth != 0 && d.previousBandwidth != bandwidth {
+		d.resetPredictionState()
+	}
+	d.previousBandwidth = bandwidth
+}
+
+// The LP layer begins with two to eight header bits These consist of one
+// Voice Activity Detection (VAD) bit per frame (up to 3), followed by a
+// single flag indicating the presence of LBRR frames.
+//
+// https://datatracker.ietf.org/doc/html/rfc6716#section-4.2.3
+func (d *Decoder) decodeHeaderBits(frameCount int) (voiceActivityDetected []bool, lowBitRateRedundancy bool) {
+	voiceActivityDetected = make([]bool, frameCount)
+	for i := 0; i < frameCount; i++ {
+		voiceActivityDetected[i] = d.rangeDecoder.DecodeSymbolLogP(1) == 1
+	}
+	lowBitRateRedundancy = d.rangeDecoder.DecodeSymbolLogP(1) == 1
+
+	return
+}
+
+// For Opus frames longer than 20 ms, a set of LBRR flags is
+// decoded for each channel that has its LBRR flag set.  Each set
+// contains one flag per 20 ms SILK frame.  40 ms Opus frames use the
+// 2-frame LBRR flag PDF from Table 4, and 60 ms Opus frames use the
+// 3-frame LBRR flag PDF.  For each channel, the resulting 2- or 3-bit
+// integer contains the corresponding LBRR flag for each frame, packed
+// in order from the LSB to the MSB.
+//
+// https://datatracker.ietf.org/doc/html/rfc6716#section-4.2.4
+func (d *Decoder) decodeLowBitrateRedundancyFlags(frameCount int, present bool) []bool {
+	flags := make([]bool, frameCount)
+	if !present {
+		return flags
+	}
+
+	var icdf []uint
+	switch frameCount {
+	case 1:
+		flags[0] = true
+		return flags
+	case 2:
+		icdf = icdfLowBitrateRedundancyFlags40Ms
+	default:
+		icdf = icdfLowBitrateRedundancyFlags60Ms
+	}
+
+	symbol := d.rangeDecoder.DecodeSymbolWithICDF(icdf)
+	for i := range flags {
+		flags[i] = symbol&(1<<i) != 0
+	}
+
+	return flags
+}
+
+// RFC 6716 Table 7 contains the mid-side stereo prediction weights.
+var stereoWeightsQ13 = []int32{
+	-13732, -10050, -8266, -7526, -6500, -5000, -2950, -820,
+	820, 2950, 5000, 6500, 7526, 8266, 10050, 13732,
+}
+
+// RFC 6716 Section 4.2.7.1 decodes mid-side stereo prediction weights.
+func (d *Decoder) decodeStereoPredictionWeights() (w0Q13, w1Q13 int32) {
+	n := int32(d.rangeDecoder.DecodeSymbolWithICDF(icdfStereoWeightsStageOne))
+	i0 := int32(d.rangeDecoder.DecodeSymbolWithICDF(icdfStereoWeightsStageTwo))
+	i1 := int32(d.rangeDecoder.DecodeSymbolWithICDF(icdfStereoWeightsStageThree))
+	i2 := int32(d.rangeDecoder.DecodeSymbolWithICDF(icdfStereoWeightsStageTwo))
+	i3 := int32(d.rangeDecoder.DecodeSymbolWithICDF(icdfStereoWeightsStageThree))
+
+	return stereoPredictionWeights(n, i0, i1, i2, i3)
+}
+
+// https://datatracker.ietf.org/doc/html/rfc6716#section-4.2.7.1
+func stereoPredictionWeights(n, i0, i1, i2, i3 int32) (w0Q13, w1Q13 int32) {
+	wi0 := i0 + 3*(n/5)
+	wi1 := i2 + 3*(n%5)
+
+	w1Q13 = stereoWeightsQ13[wi1] +
+		(((stereoWeightsQ13[wi1+1]-stereoWeightsQ13[wi1])*6554)>>16)*(2*i3+1)
+	w0Q13 = stereoWeightsQ13[wi0] +
+		(((stereoWeightsQ13[wi0+1]-stereoWeightsQ13[wi0])*6554)>>16)*(2*i1+1) -
+		w1Q13
+
+	return w0Q13, w1Q13
+}
+
+// RFC 6716 Section 4.2.7.2 decodes the mid-only flag for side-channel skipping.
+func (d *Decoder) decodeMidOnlyFlag() bool {
+	return d.rangeDecoder.DecodeSymbolWithICDF(icdfStereoMidOnly) == 1
 }
 
 // Each SILK frame contains a single "frame type" symbol that jointly
@@ -32,7 +207,9 @@ func NewDecoder() *Decoder {
 func (d *Decoder) determineFrameType(voiceActivityDetected bool) (signalType frameSignalType, quantizationOffsetType frameQuantizationOffsetType) {
 	var frameTypeSymbol uint32
 	if voiceActivityDetected {
-		frameTypeSymbol = d.rangeDecoder.DecodeSymbolWithICDF(icdfFrameTypeVADActive)
+		// Frames with voice activity can't be inactive, their PDF starts at
+		// frame type 2
+		frameTypeSymbol = d.rangeDecoder.DecodeSymbolWithICDF(icdfFrameTypeVADActive) + 2
 	} else {
 		frameTypeSymbol = d.rangeDecoder.DecodeSymbolWithICDF(icdfFrameTypeVADInactive)
 	}
@@ -81,41 +258,37 @@ func (d *Decoder) determineFrameType(voiceActivityDetected bool) (signalType fra
 // A separate quantization gain is coded for each 5 ms subframe
 //
 // https://datatracker.ietf.org/doc/html/rfc6716#section-4.2.7.4
-func (d *Decoder) decodeSubframeQuantizations(signalType frameSignalType) {
-	var (
-		logGain        uint32
-		deltaGainIndex uint32
-		gainIndex      uint32
-	)
-
-	for subframeIndex := 0; subframeIndex < 4; subframeIndex++ {
+func (d *Decoder) decodeSubframeQuantizations(signalType frameSignalType, subframeCount int, coding frameCoding) (gainQ16 []float32) {
+	var logGain, deltaGainIndex, gainIndex int32
+	gainQ16 = make([]float32, subframeCount)
 
-		//The subframe gains are either coded independently, or relative to the
+	for subframeIndex := 0; subframeIndex < subframeCount; subframeIndex++ {
+		// The subframe gains are either coded independently, or relative to the
 		// gain from the most recent coded subframe in the same channel.
 		//
 		// https://datatracker.ietf.org/doc/html/rfc6716#section-4.2.7.4
-		if subframeIndex == 0 {
+		if subframeIndex == 0 && coding != frameCodingConditional {
 			// In an independently coded subframe gain, the 3 most significant bits
 			// of the quantization gain are decoded using a PDF selected from
 			// Table 11 based on the decoded signal type
 			switch signalType {
 			case frameSignalTypeInactive:
-				gainIndex = d.rangeDecoder.DecodeSymbolWithICDF(icdfIndependentQuantizationGainMSBInactive)
+				gainIndex = int32(d.rangeDecoder.DecodeSymbolWithICDF(icdfIndependentQuantizationGainMSBInactive))
 			case frameSignalTypeVoiced:
-				gainIndex = d.rangeDecoder.DecodeSymbolWithICDF(icdfIndependentQuantizationGainMSBVoiced)
+				gainIndex = int32(d.rangeDecoder.DecodeSymbolWithICDF(icdfIndependentQuantizationGainMSBVoiced))
 			case frameSignalTypeUnvoiced:
-				gainIndex = d.rangeDecoder.DecodeSymbolWithICDF(icdfIndependentQuantizationGainMSBUnvoiced)
+				gainIndex = int32(d.rangeDecoder.DecodeSymbolWithICDF(icdfIndependentQuantizationGainMSBUnvoiced))
 			}
 
 			// The 3 least significant bits are decoded using a uniform PDF:
 			// These 6 bits are combined to form a value, gain_index, between 0 and 63.
-			gainIndex = (gainIndex << 3) | d.rangeDecoder.DecodeSymbolWithICDF(icdfIndependentQuantizationGainLSB)
+			gainIndex = (gainIndex << 3) | int32(d.rangeDecoder.DecodeSymbolWithICDF(icdfIndependentQuantizationGainLSB))
 
 			// When the gain for the previous subframe is available, then the
 			// current gain is limited as follows:
 			//     log_gain = max(gain_index, previous_log_gain - 16)
 			if d.haveDecoded {
-				logGain = maxUint32(gainIndex, d.logGain-16)
+				logGain = maxInt32(gainIndex, d.previousLogGain-16)
 			} else {
 				logGain = gainIndex
 			}
@@ -124,39 +297,44 @@ func (d *Decoder) decodeSubframeQuantizations(signalType frameSignalType) {
 			// first subframe of frames not listed as using independent coding
 			// above), the quantization gain is coded relative to the gain from the
 			// previous subframe
-			deltaGainIndex = d.rangeDecoder.DecodeSymbolWithICDF(icdfDeltaQuantizationGain)
+			deltaGainIndex = int32(d.rangeDecoder.DecodeSymbolWithICDF(icdfDeltaQuantizationGain))
 
 			// The following formula translates this index into a quantization gain
 			// for the current subframe using the gain from the previous subframe:
 			//      log_gain = clamp(0, max(2*delta_gain_index - 16, previous_log_gain + delta_gain_index - 4), 63)
-			logGain = uint32(clamp(0, maxInt32(2*int32(deltaGainIndex)-16, int32(d.logGain+deltaGainIndex)-4), 63))
+			logGain = clamp(0, maxInt32(2*deltaGainIndex-16, d.previousLogGain+deltaGainIndex-4), 63)
 		}
 
-		d.logGain = logGain
+		d.previousLogGain = logGain
+		gainQ16[subframeIndex] = float32(dequantizeGain(logGain))
+	}
 
-		// silk_gains_dequant() (gain_quant.c) dequantizes log_gain for the k'th
-		// subframe and converts it into a linear Q16 scale factor via
-		//
-		//       gain_Q16[k] = silk_log2lin((0x1D1C71*log_gain>>16) + 2090)
-		//
-		inLogQ7 := (0x1D1C71 * int32(logGain) >> 16) + 2090
-		i := inLogQ7 >> 7
-		f := inLogQ7 & 127
-
-		// The function silk_log2lin() (log2lin.c) computes an approximation of
-		// 2**(inLog_Q7/128.0), where inLog_Q7 is its Q7 input.  Let i =
-		// inLog_Q7>>7 be the integer part of inLogQ7 and f = inLog_Q7&127 be
-		// the fractional part.  Then,
-		//
-		//             (1<<i) + ((-174*f*(128-f)>>16)+f)*((1<<i)>>7)
-		//
-		// yields the approximate exponential.  The final Q16 gain values lies
-		// between 81920 and 1686110208, inclusive (representing scale factors
-		// of 1.25 to 25728, respectively).
+	return gainQ16
+}
 
-		gainQ16 := (1 << i) + ((-174*f*(128-f)>>16)+f)*((1<<i)>>7)
-		d.subframeState[subframeIndex].gain = float64(gainQ16) / 65536
-	}
+// dequantizeGain converts a quantized log gain into a linear Q16 scale
+// factor
+func dequantizeGain(logGain int32) int32 {
+	// silk_gains_dequant() (gain_quant.c) dequantizes log_gain for the k'th
+	// subframe and converts it into a linear Q16 scale factor via
+	//
+	//       gain_Q16[k] = silk_log2lin((0x1D1C71*log_gain>>16) + 2090)
+	//
+	inLogQ7 := (0x1D1C71 * logGain >> 16) + 2090
+	i := inLogQ7 >> 7
+	f := inLogQ7 & 127
+
+	// The function silk_log2lin() (log2lin.c) computes an approximation of
+	// 2**(inLog_Q7/128.0), where inLog_Q7 is its Q7 input.  Let i =
+	// inLog_Q7>>7 be the integer part of inLogQ7 and f = inLog_Q7&127 be
+	// the fractional part.  Then,
+	//
+	//             (1<<i) + ((-174*f*(128-f)>>16)+f)*((1<<i)>>7)
+	//
+	// yields the approximate exponential.  The final Q16 gain values lies
+	// between 81920 and 1686110208, inclusive (representing scale factors
+	// of 1.25 to 25728, respectively).
+	return (1 << i) + ((-174*f*(128-f)>>16)+f)*((1<<i)>>7)
 }
 
 // A set of normalized Line Spectral Frequency (LSF) coefficients follow
@@ -164,7 +342,7 @@ func (d *Decoder) decodeSubframeQuantizations(signalType frameSignalType) {
 // Predictive Coding (LPC) coefficients for the current SILK frame.
 //
 // https://datatracker.ietf.org/doc/html/rfc6716#section-4.2.7.5.1
-func (d *Decoder) decodeNormalizedLineSpectralFrequencyStageOne(voiceActivityDetected bool, bandwidth Bandwidth) (I1 uint32) {
+func (d *Decoder) decodeNormalizedLineSpectralFrequencyStageOne(signalType frameSignalType, bandwidth Bandwidth) (I1 uint32) {
 	// The first VQ stage uses a 32-element codebook, coded with one of the
 	// PDFs in Table 14, depending on the audio bandwidth and the signal
 	// type of the current SILK frame.  This yields a single index, I1, for
@@ -176,18 +354,23 @@ func (d *Decoder) decodeNormalizedLineSpectralFrequencyStageOne(voiceActivityDet
 	//     redundancy from the second stage.
 	//
 	// https://datatracker.ietf.org/doc/html/rfc6716#section-4.2.7.5.1
+	return d.rangeDecoder.DecodeSymbolWithICDF(icdfNormalizedLSFStageOne(signalType, bandwidth))
+}
+
+// icdfNormalizedLSFStageOne returns the PDF of the stage-1 index, which
+// depends on whether the frame is voiced
+func icdfNormalizedLSFStageOne(signalType frameSignalType, bandwidth Bandwidth) []uint {
+	voiced := signalType == frameSignalTypeVoiced
 	switch {
-	case !voiceActivityDetected && (bandwidth == BandwidthNarrowband || bandwidth == BandwidthMediumband):
-		I1 = d.rangeDecoder.DecodeSymbolWithICDF(icdfNormalizedLSFStageOneIndexNarrowbandOrMediumbandUnvoiced)
-	case voiceActivityDetected && (bandwidth == BandwidthNarrowband || bandwidth == BandwidthMediumband):
-		I1 = d.rangeDecoder.DecodeSymbolWithICDF(icdfNormalizedLSFStageOneIndexNarrowbandOrMediumbandVoiced)
-	case !voiceActivityDetected && (bandwidth == BandwidthWideband):
-		I1 = d.rangeDecoder.DecodeSymbolWithICDF(icdfNormalizedLSFStageOneIndexWidebandUnvoiced)
-	case voiceActivityDetected && (bandwidth == BandwidthWideband):
-		I1 = d.rangeDecoder.DecodeSymbolWithICDF(icdfNormalizedLSFStageOneIndexWidebandVoiced)
+	case !voiced && (bandwidth == BandwidthNarrowband || bandwidth == BandwidthMediumband):
+		return icdfNormalizedLSFStageOneIndexNarrowbandOrMediumbandUnvoiced
+	case voiced && (bandwidth == BandwidthNarrowband || bandwidth == BandwidthMediumband):
+		return icdfNormalizedLSFStageOneIndexNarrowbandOrMediumbandVoiced
+	case !voiced:
+		return icdfNormalizedLSFStageOneIndexWidebandUnvoiced
+	default:
+		return icdfNormalizedLSFStageOneIndexWidebandVoiced
 	}
-
-	return
 }
 
 // A set of normalized Line Spectral Frequency (LSF) coefficients follow
@@ -195,17 +378,12 @@ func (d *Decoder) decodeNormalizedLineSpectralFrequencyStageOne(voiceActivityDet
 // Predictive Coding (LPC) coefficients for the current SILK frame.
 //
 // https://datatracker.ietf.org/doc/html/rfc6716#section-4.2.7.5.2
-func (d *Decoder) decodeNormalizedLineSpectralFrequencyStageTwo(voiceActivityDetected bool, bandwidth Bandwidth, I1 uint32) (resQ10 []int16) {
+func (d *Decoder) decodeNormalizedLineSpectralFrequencyStageTwo(bandwidth Bandwidth, I1 uint32) (resQ10 []int16) {
 	// Decoding the second stage residual proceeds as follows.  For each
 	// coefficient, the decoder reads a symbol using the PDF corresponding
 	// to I1 from either Table 17 or Table 18,
 	// https://datatracker.ietf.org/doc/html/rfc6716#section-4.2.7.5.2
-	var codebook [][]uint
-	if bandwidth == BandwidthWideband {
-		codebook = codebookNormalizedLSFStageTwoIndexWideband
-	} else {
-		codebook = codebookNormalizedLSFStageTwoIndexNarrowbandOrMediumband
-	}
+	codebook := codebookNormalizedLSFStageTwoIndex(bandwidth)
 
 	I2 := make([]int8, len(codebook[0]))
 	for i := 0; i < len(I2); i++ {
@@ -237,15 +415,7 @@ func (d *Decoder) decodeNormalizedLineSpectralFrequencyStageTwo(voiceActivityDet
 	// The decoder must undo this process.
 	//
 	// https://datatracker.ietf.org/doc/html/rfc6716#section-4.2.7.5.2
-
-	// qstep is the Q16 quantization step size, which is 11796 for NB and MB and 9830
-	// for WB (representing step sizes of approximately 0.18 and 0.15, respectively).
-	var qstep int
-	if bandwidth == BandwidthWideband {
-		qstep = 9830
-	} else {
-		qstep = 11796
-	}
+	qstep := normalizedLSFQuantizationStep(bandwidth)
 
 	// stage-2 residual
 	resQ10 = make([]int16, len(I2))
@@ -253,104 +423,2335 @@ func (d *Decoder) decodeNormalizedLineSpectralFrequencyStageTwo(voiceActivityDet
 	// Let d_LPC be the order of the codebook, i.e., 10 for NB and MB, and 16 for WB
 	dLPC := len(I2)
 
-	// for 0 <= k < d_LPC-1
-	for k := dLPC - 2; k >= 0; k-- {
+	// for 0 <= k < d_LPC
+	for k := dLPC - 1; k >= 0; k-- {
 		// The stage-2 residual for each coefficient is computed via
 		//
 		//     res_Q10[k] = (k+1 < d_LPC ? (res_Q10[k+1]*pred_Q8[k])>>8 : 0) + ((((I2[k]<<10) - sign(I2[k])*102)*qstep)>>16) ,
 		//
+		resQ10[k] = int16(predictNormalizedLSFResidual(bandwidth, I1, resQ10, k) + dequantizeNormalizedLSFResidual(I2[k], qstep))
+	}
+
+	return
+}
+
+// codebookNormalizedLSFStageTwoIndex returns, for each stage-1 index, the
+// PDF each coefficient's stage-2 index is coded with
+func codebookNormalizedLSFStageTwoIndex(bandwidth Bandwidth) [][]uint {
+	if bandwidth == BandwidthWideband {
+		return codebookNormalizedLSFStageTwoIndexWideband
+	}
+	return codebookNormalizedLSFStageTwoIndexNarrowbandOrMediumband
+}
+
+// qstep is the Q16 quantization step size, which is 11796 for NB and MB and 9830
+// for WB (representing step sizes of approximately 0.18 and 0.15, respectively).
+//
+// https://datatracker.ietf.org/doc/html/rfc6716#section-4.2.7.5.2
+func normalizedLSFQuantizationStep(bandwidth Bandwidth) int {
+	if bandwidth == BandwidthWideband {
+		return 9830
+	}
+	return 11796
+}
+
+// predictNormalizedLSFResidual computes the prediction of res_Q10[k] from
+// the coefficient that follows it
+//
+//	(k+1 < d_LPC ? (res_Q10[k+1]*pred_Q8[k])>>8 : 0)
+//
+// https://datatracker.ietf.org/doc/html/rfc6716#section-4.2.7.5.2
+func predictNormalizedLSFResidual(bandwidth Bandwidth, I1 uint32, resQ10 []int16, k int) int {
+	if k+1 >= len(resQ10) {
+		return 0
+	}
+
+	// Each coefficient selects its prediction weight from one of the two lists based on the stage-1 index, I1.
+	// let pred_Q8[k] be the weight for the k'th coefficient selected by this process for 0 <= k < d_LPC-1
+	var predQ8 int
+	if bandwidth == BandwidthWideband {
+		predQ8 = int(predictionWeightForWidebandNormalizedLSF[predictionWeightSelectionForWidebandNormalizedLSF[I1][k]][k])
+	} else {
+		predQ8 = int(predictionWeightForNarrowbandAndMediumbandNormalizedLSF[predictionWeightSelectionForNarrowbandAndMediumbandNormalizedLSF[I1][k]][k])
+	}
+
+	return (int(resQ10[k+1]) * predQ8) >> 8
+}
+
+// dequantizeNormalizedLSFResidual computes the part of res_Q10[k] coded by
+// the stage-2 index
+//
+//	(((I2[k]<<10) - sign(I2[k])*102)*qstep)>>16
+//
+// https://datatracker.ietf.org/doc/html/rfc6716#section-4.2.7.5.2
+func dequantizeNormalizedLSFResidual(I2 int8, qstep int) int {
+	return (((int(I2) << 10) - sign(int(I2))*102) * qstep) >> 16
+}
+
+// Once the stage-1 index I1 and the stage-2 residual res_Q10[] have
+// been decoded, the final normalized LSF coefficients can be
+// reconstructed.
+//
+// https://datatracker.ietf.org/doc/html/rfc6716#section-4.2.7.5.3
+func (d *Decoder) normalizeLineSpectralFrequencyCoefficients(
+	dLPC int,
+	bandwidth Bandwidth,
+	resQ10 []int16,
+	stageOneIndex uint32,
+) (nlsfQ15 []int16) {
+	nlsfQ15 = make([]int16, dLPC)
+	w2Q18 := make([]uint, dLPC)
+	wQ9 := make([]int16, dLPC)
+
+	cb1Q8 := codebookNormalizedLSFStageOneNarrowbandOrMediumband
+	if bandwidth == BandwidthWideband {
+		cb1Q8 = codebookNormalizedLSFStageOneWideband
+	}
+
+	// Let cb1_Q8[k] be the k'th entry of the stage-1 codebook vector from Table 23 or Table 24.
+	// Then, for 0 <= k < d_LPC, the following expression computes the
+	// square of the weight as a Q18 value:
+	//
+	//          w2_Q18[k] = (1024/(cb1_Q8[k] - cb1_Q8[k-1])
+	//                       + 1024/(cb1_Q8[k+1] - cb1_Q8[k])) << 16
+	//
+	// where cb1_Q8[-1] = 0 and cb1_Q8[d_LPC] = 256, and the division is
+	// integer division.  This is reduced to an unsquared, Q9 value using
+	// the following square-root approximation:
+	//
+	// https://datatracker.ietf.org/doc/html/rfc6716#section-4.2.7.5.3
+	for k := 0; k < dLPC; k++ {
+		previousCodebookValue, nextCodebookValue := uint(0), uint(256)
+		if k != 0 {
+			previousCodebookValue = cb1Q8[stageOneIndex][k-1]
+		}
+
+		if k+1 != dLPC {
+			nextCodebookValue = cb1Q8[stageOneIndex][k+1]
+		}
+
+		w2Q18[k] = (1024/(cb1Q8[stageOneIndex][k]-previousCodebookValue) +
+			1024/(nextCodebookValue-cb1Q8[stageOneIndex][k])) << 16
 
-		// The following computes
+		// This is reduced to an unsquared, Q9 value using
+		// the following square-root approximation:
 		//
-		// (k+1 < d_LPC ? (res_Q10[k+1]*pred_Q8[k])>>8 : 0)
+		//     i = ilog(w2_Q18[k])
+		//     f = (w2_Q18[k]>>(i-8)) & 127
+		//     y = ((i&1) ? 32768 : 46214) >> ((32-i)>>1)
+		//     w_Q9[k] = y + ((213*f*y)>>16)
 		//
-		firstOperand := int(0)
-		if k+1 < dLPC {
-			// Each coefficient selects its prediction weight from one of the two lists based on the stage-1 index, I1.
-			// let pred_Q8[k] be the weight for the k'th coefficient selected by this process for 0 <= k < d_LPC-1
-			predQ8 := int(0)
-			if bandwidth == BandwidthWideband {
-				predQ8 = int(predictionWeightForWidebandNormalizedLSF[predictionWeightSelectionForWidebandNormalizedLSF[I1][k]][k])
-			} else {
-				predQ8 = int(predictionWeightForNarrowbandAndMediumbandNormalizedLSF[predictionWeightSelectionForNarrowbandAndMediumbandNormalizedLSF[I1][k]][k])
+		// https://datatracker.ietf.org/doc/html/rfc6716#section-4.2.7.5.3
+		i := ilog(int(w2Q18[k]))
+		f := int((w2Q18[k] >> (i - 8)) & 127)
+
+		y := 46214
+		if (i & 1) != 0 {
+			y = 32768
+		}
+
+		y >>= ((32 - i) >> 1)
+		wQ9[k] = int16(y + ((213 * f * y) >> 16))
+
+		// Given the stage-1 codebook entry cb1_Q8[], the stage-2 residual
+		// res_Q10[], and their corresponding weights, w_Q9[], the reconstructed
+		// normalized LSF coefficients are
+		//
+		//    NLSF_Q15[k] = clamp(0,
+		//               (cb1_Q8[k]<<7) + (res_Q10[k]<<14)/w_Q9[k], 32767)
+		//
+		// https://datatracker.ietf.org/doc/html/rfc6716#section-4.2.7.5.3
+		nlsfQ15[k] = int16(clamp(0,
+			int32((int(cb1Q8[stageOneIndex][k])<<7)+(int(resQ10[k])<<14)/int(wQ9[k])), 32767))
+	}
+
+	return nlsfQ15
+}
+
+// The normalized LSF stabilization procedure ensures that
+// consecutive values of the normalized LSF coefficients, NLSF_Q15[],
+// are spaced some minimum distance apart (predetermined to be the 0.01
+// percentile of a large training set).
+//
+// https://datatracker.ietf.org/doc/html/rfc6716#section-4.2.7.5.4
+func (d *Decoder) normalizeLSFStabilization(nlsfQ15 []int16, dLPC int, bandwidth Bandwidth) {
+	// Let NDeltaMin_Q15[k] be the minimum required spacing for the current
+	// audio bandwidth from Table 25.
+	//
+	// https://datatracker.ietf.org/doc/html/rfc6716#section-4.2.7.5.4
+	NDeltaMinQ15 := codebookMinimumSpacingForNormalizedLSCoefficientsNarrowbandAndMediumband
+	if bandwidth == BandwidthWideband {
+		NDeltaMinQ15 = codebookMinimumSpacingForNormalizedLSCoefficientsWideband
+	}
+
+	// The procedure starts off by trying to make small adjustments that
+	// attempt to minimize the amount of distortion introduced.  After 20
+	// such adjustments, it falls back to a more direct method that
+	// guarantees the constraints are enforced but may require large
+	// adjustments.
+	//
+	// https://datatracker.ietf.org/doc/html/rfc6716#section-4.2.7.5.4
+	for adjustment := 0; adjustment <= 19; adjustment++ {
+		// First, the procedure finds the index
+		// i where NLSF_Q15[i] - NLSF_Q15[i-1] - NDeltaMin_Q15[i] is the
+		// smallest, breaking ties by using the lower value of i.
+		//
+		// https://datatracker.ietf.org/doc/html/rfc6716#section-4.2.7.5.4
+		i := 0
+		iValue := int(math.MaxInt)
+
+		for nlsfIndex := 0; nlsfIndex <= len(nlsfQ15); nlsfIndex++ {
+			// For the purposes of computing this spacing for the first and last coefficient,
+			// NLSF_Q15[-1] is taken to be 0 and NLSF_Q15[d_LPC] is taken to be 32768
+			//
+			// https://datatracker.ietf.org/doc/html/rfc6716#section-4.2.7.5.4
+			previousNLSF := 0
+			currentNLSF := 32768
+			if nlsfIndex != 0 {
+				previousNLSF = int(nlsfQ15[nlsfIndex-1])
+			}
+			if nlsfIndex != len(nlsfQ15) {
+				currentNLSF = int(nlsfQ15[nlsfIndex])
 			}
 
-			firstOperand = (int(resQ10[k+1]) * predQ8) >> 8
+			spacingValue := currentNLSF - previousNLSF - NDeltaMinQ15[nlsfIndex]
+			if spacingValue < iValue {
+				i = nlsfIndex
+				iValue = spacingValue
+			}
 		}
 
-		// The following computes
+		switch {
+		// If this value is non-negative, then the stabilization stops; the coefficients
+		// satisfy all the constraints.
+		//
+		// https://datatracker.ietf.org/doc/html/rfc6716#section-4.2.7.5.4
+		case iValue >= 0:
+			return
+		// if i == 0, it sets NLSF_Q15[0] to NDeltaMin_Q15[0]
+		//
+		// https://datatracker.ietf.org/doc/html/rfc6716#section-4.2.7.5.4
+		case i == 0:
+			nlsfQ15[0] = int16(NDeltaMinQ15[0])
+
+			continue
+		// if i == d_LPC, it sets
+		//  NLSF_Q15[d_LPC-1] to (32768 - NDeltaMin_Q15[d_LPC])
 		//
-		// (((I2[k]<<10) - sign(I2[k])*102)*qstep)>>16
+		// https://datatracker.ietf.org/doc/html/rfc6716#section-4.2.7.5.4
+		case i == dLPC:
+			nlsfQ15[dLPC-1] = int16(32768 - NDeltaMinQ15[dLPC])
+
+			continue
+		}
+
+		// 	For all other values of i, both NLSF_Q15[i-1] and NLSF_Q15[i] are updated as
+		// follows:
+		//                                              i-1
+		//                                              __
+		//     min_center_Q15 = (NDeltaMin_Q15[i]>>1) + \  NDeltaMin_Q15[k]
+		//                                              /_
+		//                                              k=0
 		//
-		secondOperand := (((int(I2[k]) << 10) - sign(int(I2[k]))*102) * qstep) >> 16
+		minCenterQ15 := NDeltaMinQ15[i] >> 1
+		for k := 0; k <= i-1; k++ {
+			minCenterQ15 += NDeltaMinQ15[k]
+		}
+
+		// 		                                                d_LPC
+		//                                                      __
+		//     max_center_Q15 = 32768 - (NDeltaMin_Q15[i]>>1) - \  NDeltaMin_Q15[k]
+		//                                                      /_
+		//                                                     k=i+1
+		maxCenterQ15 := 32768 - (NDeltaMinQ15[i] >> 1)
+		for k := i + 1; k <= dLPC; k++ {
+			maxCenterQ15 -= NDeltaMinQ15[k]
+		}
+
+		//     center_freq_Q15 = clamp(min_center_Q15[i],
+		//                     (NLSF_Q15[i-1] + NLSF_Q15[i] + 1)>>1
+		//                     max_center_Q15[i])
+		centerFreqQ15 := int(clamp(
+			int32(minCenterQ15),
+			int32((int(nlsfQ15[i-1])+int(nlsfQ15[i])+1)>>1),
+			int32(maxCenterQ15)),
+		)
+
+		//    NLSF_Q15[i-1] = center_freq_Q15 - (NDeltaMin_Q15[i]>>1)
+		//    NLSF_Q15[i] = NLSF_Q15[i-1] + NDeltaMin_Q15[i]
+		nlsfQ15[i-1] = int16(centerFreqQ15 - NDeltaMinQ15[i]>>1)
+		nlsfQ15[i] = nlsfQ15[i-1] + int16(NDeltaMinQ15[i])
+	}
+
+	// After the 20th repetition of the above procedure, the following
+	// fallback procedure executes once.  First, the values of NLSF_Q15[k]
+	// for 0 <= k < d_LPC are sorted in ascending order.  Then, for each
+	// value of k from 0 to d_LPC-1, NLSF_Q15[k] is set to
+	sort.Slice(nlsfQ15, func(i, j int) bool { return nlsfQ15[i] < nlsfQ15[j] })
+
+	// Then, for each value of k from 0 to d_LPC-1, NLSF_Q15[k] is set to
+	//
+	//   max(NLSF_Q15[k], NLSF_Q15[k-1] + NDeltaMin_Q15[k])
+	for k := 0; k <= dLPC-1; k++ {
+		prevNLSF := int16(0)
+		if k != 0 {
+			prevNLSF = nlsfQ15[k-1]
+		}
+
+		nlsfQ15[k] = maxInt16(nlsfQ15[k], saturatingAddInt16(prevNLSF, int16(NDeltaMinQ15[k])))
+	}
+
+	// Next, for each value of k from d_LPC-1 down to 0, NLSF_Q15[k] is set
+	// to
+	//
+	//   min(NLSF_Q15[k], NLSF_Q15[k+1] - NDeltaMin_Q15[k+1])
+	for k := dLPC - 1; k >= 0; k-- {
+		nextNLSF := 32768
+		if k != dLPC-1 {
+			nextNLSF = int(nlsfQ15[k+1])
+		}
+
+		nlsfQ15[k] = minInt16(nlsfQ15[k], int16(nextNLSF-NDeltaMinQ15[k+1]))
+	}
+}
+
+// https://datatracker.ietf.org/doc/html/rfc6716#section-4.2.7.5.5
+func (d *Decoder) normalizeLSFInterpolation(n2Q15 []int16, nanoseconds int) (n1Q15 []int16, wQ2 int16) {
+	// Let n2_Q15[k] be the normalized LSF coefficients decoded by the
+	// procedure in Section 4.2.7.5, n0_Q15[k] be the LSF coefficients
+	// decoded for the prior frame, and w_Q2 be the interpolation factor.
+	// Then, the normalized LSF coefficients used for the first half of a
+	// 20 ms frame, n1_Q15[k], are
+	//
+	//      n1_Q15[k] = n0_Q15[k] + (w_Q2*(n2_Q15[k] - n0_Q15[k]) >> 2)
+	if nanoseconds != nanoseconds20Ms {
+		return nil, 4
+	}
+
+	wQ2 = int16(d.rangeDecoder.DecodeSymbolWithICDF(icdfNormalizedLSFInterpolationIndex))
+	if wQ2 == 4 || !d.haveDecoded {
+		return nil, wQ2
+	}
+	if len(d.n0Q15) != len(n2Q15) {
+		return nil, wQ2
+	}
 
-		resQ10[k] = int16(firstOperand + secondOperand)
+	n1Q15 = make([]int16, len(n2Q15))
+	for k := range n1Q15 {
+		interpolated := int32(wQ2) * (int32(n2Q15[k]) - int32(d.n0Q15[k])) >> 2
+		n1Q15[k] = int16(int32(d.n0Q15[k]) + interpolated)
 	}
 
 	return
 }
 
-// Decode decodes many SILK subframes
-//   An overview of the decoder is given in Figure 14.
-//
-//        +---------+    +------------+
-//     -->| Range   |--->| Decode     |---------------------------+
-//      1 | Decoder | 2  | Parameters |----------+       5        |
-//        +---------+    +------------+     4    |                |
-//                            3 |                |                |
-//                             \/               \/               \/
-//                       +------------+   +------------+   +------------+
-//                       | Generate   |-->| LTP        |-->| LPC        |
-//                       | Excitation |   | Synthesis  |   | Synthesis  |
-//                       +------------+   +------------+   +------------+
-//                                               ^                |
-//                                               |                |
-//                           +-------------------+----------------+
-//                           |                                      6
-//                           |   +------------+   +-------------+
-//                           +-->| Stereo     |-->| Sample Rate |-->
-//                               | Unmixing   | 7 | Conversion  | 8
-//                               +------------+   +-------------+
-//
-//     1: Range encoded bitstream
-//     2: Coded parameters
-//     3: Pulses, LSBs, and signs
-//     4: Pitch lags, Long-Term Prediction (LTP) coefficients
-//     5: Linear Predictive Coding (LPC) coefficients and gains
-//     6: Decoded signal (mono or mid-side stereo)
-//     7: Unmixed signal (mono or left-right stereo)
-//     8: Resampled signal
+func (d *Decoder) generateAQ12(q15 []int16, bandwidth Bandwidth, aQ12 [][]float32) [][]float32 {
+	if q15 == nil {
+		return aQ12
+	}
+
+	// https://datatracker.ietf.org/doc/html/rfc6716#section-4.2.7.5.6
+	a32Q17 := d.convertNormalizedLSFsToLPCCoefficients(q15, bandwidth)
+
+	// https://www.rfc-editor.org/rfc/rfc6716.html#section-4.2.7.5.7
+	d.limitLPCCoefficientsRange(a32Q17)
+
+	// https://www.rfc-editor.org/rfc/rfc6716.html#section-4.2.7.5.8
+	aQ12 = append(aQ12, d.limitLPCFilterPredictionGain(a32Q17))
+
+	return aQ12
+}
+
+func (d *Decoder) convertNormalizedLSFsToLPCCoefficients(n1Q15 []int16, bandwidth Bandwidth) (a32Q17 []int32) {
+	cQ17 := make([]int32, len(n1Q15))
+	cosQ12 := q12CosineTableForLSFConverion
+
+	ordering := lsfOrderingForPolynomialEvaluationNarrowbandAndMediumband
+	if bandwidth == BandwidthWideband {
+		ordering = lsfOrderingForPolynomialEvaluationWideband
+	}
+
+	// The top 7 bits of each normalized LSF coefficient index a value in
+	// the table, and the next 8 bits interpolate between it and the next
+	// value.  Let i = (n[k] >> 8) be the integer index and f = (n[k] & 255)
+	// be the fractional part of a given coefficient.  Then, the re-ordered,
+	// approximated cosine, c_Q17[ordering[k]], is
+	//
+	//     c_Q17[ordering[k]] = (cos_Q12[i]*256
+	//                           + (cos_Q12[i+1]-cos_Q12[i])*f + 4) >> 3
+	//
+	// where ordering[k] is the k'th entry of the column of Table 27
+	// corresponding to the current audio bandwidth and cos_Q12[i] is the
+	// i'th entry of Table 28.
+	//
+	// https://datatracker.ietf.org/doc/html/rfc6716#section-4.2.7.5.6
+	for k := range n1Q15 {
+		i := int32(n1Q15[k] >> 8)
+		f := int32(n1Q15[k] & 255)
+
+		cQ17[ordering[k]] = (cosQ12[i]*256 +
+			(cosQ12[i+1]-cosQ12[i])*f + 4) >> 3
+	}
+
+	pQ16 := make([]int32, (len(n1Q15)/2)+1)
+	qQ16 := make([]int32, (len(n1Q15)/2)+1)
+
+	// Given the list of cosine values compute the coefficients of P and Q,
+	// described here via a simple recurrence.  Let p_Q16[k][j] and q_Q16[k][j]
+	// be the coefficients of the products of the first (k+1) root pairs for P and
+	// Q, with j indexing the coefficient number.  Only the first (k+2) coefficients
+	// are needed, as the products are symmetric.  Let
+	//
+	//      p_Q16[0][0] = q_Q16[0][0] = 1<<16
+	//      p_Q16[0][1] = -c_Q17[0]
+	//      q_Q16[0][1] = -c_Q17[1]
+	//      d2 = d_LPC/2
+	//
+	// https://datatracker.ietf.org/doc/html/rfc6716#section-4.2.7.5.6
+
+	pQ16[0] = 1 << 16
+	qQ16[0] = 1 << 16
+	pQ16[1] = -cQ17[0]
+	qQ16[1] = -cQ17[1]
+	dLPC := len(n1Q15)
+	d2 := dLPC / 2
+
+	// As boundary conditions, assume p_Q16[k][j] = q_Q16[k][j] = 0 for all j < 0.
+	// Also, assume (because of the symmetry)
+	//
+	//      p_Q16[k][k+2] = p_Q16[k][k]
+	//      q_Q16[k][k+2] = q_Q16[k][k]
+	//
+	// Then, for 0 < k < d2 and 0 <= j <= k+1,
+	//
+	//      p_Q16[k][j] = p_Q16[k-1][j] + p_Q16[k-1][j-2]
+	//                    - ((c_Q17[2*k]*p_Q16[k-1][j-1] + 32768)>>16)
+	//
+	//      q_Q16[k][j] = q_Q16[k-1][j] + q_Q16[k-1][j-2]
+	//                    - ((c_Q17[2*k+1]*q_Q16[k-1][j-1] + 32768)>>16)
+	//
+	// https://datatracker.ietf.org/doc/html/rfc6716#section-4.2.7.5.6
+
+	for k := 1; k < d2; k++ {
+		pQ16[k+1] = pQ16[k-1]*2 - int32(((int64(cQ17[2*k])*int64(pQ16[k]))+32768)>>16)
+		qQ16[k+1] = qQ16[k-1]*2 - int32(((int64(cQ17[(2*k)+1])*int64(qQ16[k]))+32768)>>16)
+
+		for j := k; j > 1; j-- {
+			pQ16[j] += pQ16[j-2] - int32(((int64(cQ17[2*k])*int64(pQ16[j-1]))+32768)>>16)
+			qQ16[j] += qQ16[j-2] - int32(((int64(cQ17[(2*k)+1])*int64(qQ16[j-1]))+32768)>>16)
+		}
+
+		pQ16[1] -= cQ17[2*k]
+		qQ16[1] -= cQ17[2*k+1]
+	}
+
+	// silk_NLSF2A() uses the values from the last row of this recurrence to
+	// reconstruct a 32-bit version of the LPC filter (without the leading
+	// 1.0 coefficient), a32_Q17[k], 0 <= k < d2:
+	//
+	//      a32_Q17[k]         = -(q_Q16[d2-1][k+1] - q_Q16[d2-1][k])
+	//                           - (p_Q16[d2-1][k+1] + p_Q16[d2-1][k]))
+	//
+	//      a32_Q17[d_LPC-k-1] =  (q_Q16[d2-1][k+1] - q_Q16[d2-1][k])
+	//                           - (p_Q16[d2-1][k+1] + p_Q16[d2-1][k]))
+	//
+	// The sum and difference of two terms from each of the p_Q16 and q_Q16
+	// coefficient lists reflect the (1 + z**-1) and (1 - z**-1) factors of
+	// P and Q, respectively.  The promotion of the expression from Q16 to
+	// Q17 implicitly scales the result by 1/2.
+	//
+	// https://datatracker.ietf.org/doc/html/rfc6716#section-4.2.7.5.6
+
+	a32Q17 = make([]int32, len(n1Q15))
+	for k := 0; k < d2; k++ {
+		a32Q17[k] = -(qQ16[k+1] - qQ16[k]) - (pQ16[k+1] + pQ16[k])
+		a32Q17[dLPC-k-1] = (qQ16[k+1] - qQ16[k]) - (pQ16[k+1] + pQ16[k])
+	}
+
+	return a32Q17
+}
+
+// The a32_Q17[] coefficients are too large to fit in a 16-bit value,
+// which significantly increases the cost of applying this filter in
+// fixed-point decoders.  Reducing them to Q12 precision doesn't incur
+// any significant quality loss, but still does not guarantee they will
+// fit.
 //
-// https://datatracker.ietf.org/doc/html/rfc6716#section-4.2.1
-func (d *Decoder) Decode(in []byte, isStereo bool, nanoseconds int, bandwidth Bandwidth) (decoded []byte, err error) {
-	if nanoseconds != nanoseconds20Ms {
-		return nil, errUnsupportedSilkFrameDuration
-	} else if isStereo {
-		return nil, errUnsupportedSilkStereo
+// https://datatracker.ietf.org/doc/html/rfc6716#section-4.2.7.5.7
+func (d *Decoder) limitLPCCoefficientsRange(a32Q17 []int32) {
+	bandwidthExpansionRound := 0
+	for ; bandwidthExpansionRound < 10; bandwidthExpansionRound++ {
+		// For each round, the process first finds the index k such that
+		// abs(a32_Q17[k]) is largest, breaking ties by choosing the lowest
+		// value of k.
+		//
+		// https://datatracker.ietf.org/doc/html/rfc6716#section-4.2.7.5.7
+		maxabsQ17K := uint(0)
+		maxabsQ17 := uint(0)
+
+		for k, val := range a32Q17 {
+			abs := int32(sign(int(val))) * val
+			if maxabsQ17 < uint(abs) {
+				maxabsQ17K = uint(k)
+				maxabsQ17 = uint(abs)
+			}
+		}
+
+		// Then, it computes the corresponding Q12 precision value,
+		// maxabs_Q12, subject to an upper bound to avoid overflow in subsequent
+		// computations:
+		//
+		//    maxabs_Q12 = min((maxabs_Q17 + 16) >> 5, 163838)
+		//
+		// https://datatracker.ietf.org/doc/html/rfc6716#section-4.2.7.5.7
+
+		maxabsQ12 := minUint((maxabsQ17+16)>>5, 163838)
+
+		// If this is larger than 32767, the procedure derives the chirp factor,
+		// sc_Q16[0], to use in the bandwidth expansion as
+		//
+		//                       (maxabs_Q12 - 32767) << 14
+		//   sc_Q16[0] = 65470 - --------------------------
+		//                       (maxabs_Q12 * (k+1)) >> 2
+		//
+		// https://datatracker.ietf.org/doc/html/rfc6716#section-4.2.7.5.7
+		if maxabsQ12 > 32767 {
+			scQ16 := uint(65470)
+			scQ16 -= ((maxabsQ12 - 32767) << 14) / ((maxabsQ12 * (maxabsQ17K + 1)) >> 2)
+
+			// RFC 6716 spells out the bandwidth expansion recurrence here as
+			// sc_Q16[k]. This branch keeps that recurrence as the shared Go
+			// implementation so the coefficient range limiter and the
+			// prediction-gain limiter use the same code path:
+			//
+			//            a32_Q17[k] = (a32_Q17[k]*sc_Q16[k]) >> 16
+			//
+			//           sc_Q16[k+1] = (sc_Q16[0]*sc_Q16[k] + 32768) >> 16
+			//
+			// https://datatracker.ietf.org/doc/html/rfc6716#section-4.2.7.5.7
+			expandLPCCoefficientsBandwidth(a32Q17, int32(scQ16))
+		} else {
+			break
+		}
 	}
 
-	d.rangeDecoder.Init(in)
+	// After 10 rounds of bandwidth expansion are performed, they are simply
+	// saturated to 16 bits:
+	//
+	//     a32_Q17[k] = clamp(-32768, (a32_Q17[k] + 16) >> 5, 32767) << 5
+	//
+	// RFC 6716 section 4.2.7.5.7 says the 10th bandwidth-expansion round is
+	// special: even if the coefficients would no longer overflow in Q12, the
+	// decoder still has to saturate them in Q12 and then convert them back to
+	// Q17 for the prediction-gain limiter. The extracted C reference does the
+	// same thing in silk_NLSF2A() (NLSF2A.c), so this branch follows that
+	// behavior exactly instead of stopping after the 9th expansion.
+	if bandwidthExpansionRound == 10 {
+		for k := range a32Q17 {
+			a32Q17[k] = clamp(-32768, (a32Q17[k]+16)>>5, 32767) << 5
+		}
+	}
+}
 
-	//The LP layer begins with two to eight header bits These consist of one
-	// Voice Activity Detection (VAD) bit per frame (up to 3), followed by a
-	// single flag indicating the presence of LBRR frames.
-	// https://datatracker.ietf.org/doc/html/rfc6716#section-4.2.3
-	voiceActivityDetected := d.rangeDecoder.DecodeSymbolLogP(1) == 1
-	lowBitRateRedundancy := d.rangeDecoder.DecodeSymbolLogP(1) == 1
-	if lowBitRateRedundancy {
-		return nil, errUnsupportedSilkLowBitrateRedundancy
+// The prediction gain of an LPC synthesis filter is the square root of
+// the output energy when the filter is excited by a unit-energy
+// impulse.  Even if the Q12 coefficients would fit, the resulting
+// filter may still have a significant gain (especially for voiced
+// sounds), making the filter unstable. silk_NLSF2A() applies up to 16
+// additional rounds of bandwidth expansion to limit the prediction
+// gain.
+//
+// https://datatracker.ietf.org/doc/html/rfc6716#section-4.2.7.5.8
+func (d *Decoder) limitLPCFilterPredictionGain(a32Q17 []int32) (aQ12 []float32) {
+	// However, silk_LPC_inverse_pred_gain_QA() approximates this using
+	// fixed-point arithmetic to guarantee reproducible results across
+	// platforms and implementations.  Since small changes in the
+	// coefficients can make a stable filter unstable, it takes the real Q12
+	// coefficients that will be used during reconstruction as input.  Thus,
+	// let
+	//
+	//     a32_Q12[n] = (a32_Q17[n] + 16) >> 5
+	//
+	// https://datatracker.ietf.org/doc/html/rfc6716#section-4.2.7.5.8
+	aQ12Int := make([]int16, len(a32Q17))
+	for n := range a32Q17 {
+		aQ12Int[n] = int16((a32Q17[n] + 16) >> 5)
 	}
+	for i := 0; i < 16; i++ {
+		if lpcInversePredictionGain(aQ12Int) >= 107374 {
+			break
+		}
 
-	signalType, _ := d.determineFrameType(voiceActivityDetected)
+		// RFC 6716 section 4.2.7.5.8 applies up to 16 more rounds of bandwidth
+		// expansion when the inverse prediction gain is too small. The chirp
+		// factor starts at 65534 and decreases as 65536 - (2 << i), which is
+		// the same sequence used by silk_NLSF2A() in NLSF2A.c. After each
+		// expansion we re-quantize to Q12 before checking stability again,
+		// because the C reference measures the gain on the exact coefficients
+		// used by reconstruction.
+		expandLPCCoefficientsBandwidth(a32Q17, int32(65536-(2<<i)))
+		for n := range a32Q17 {
+			aQ12Int[n] = int16((a32Q17[n] + 16) >> 5)
+		}
+	}
 
-	// https://datatracker.ietf.org/doc/html/rfc6716#section-4.2.7.4
-	d.decodeSubframeQuantizations(signalType)
+	aQ12 = make([]float32, len(aQ12Int))
+	for n := range aQ12Int {
+		aQ12[n] = float32(aQ12Int[n])
+	}
 
-	// https://datatracker.ietf.org/doc/html/rfc6716#section-4.2.7.5.1
-	I1 := d.decodeNormalizedLineSpectralFrequencyStageOne(voiceActivityDetected, bandwidth)
+	return aQ12
+}
 
-	// https://datatracker.ietf.org/doc/html/rfc6716#section-4.2.7.5.1
-	d.decodeNormalizedLineSpectralFrequencyStageTwo(voiceActivityDetected, bandwidth, I1)
+func lpcInversePredictionGain(aQ12 []int16) int32 {
+	const (
+		inversePredictionGainQA     = 24
+		inversePredictionGainALimit = 16773022
+	)
 
-	return
+	order := len(aQ12)
+	var atmpQA [2][16]int32
+	aNewQA := atmpQA[order&1][:]
+	dcResp := int32(0)
+	for k := 0; k < order; k++ {
+		dcResp += int32(aQ12[k])
+		aNewQA[k] = int32(aQ12[k]) << (inversePredictionGainQA - 12)
+	}
+	// RFC 6716 section 4.2.7.5.8 has two prose mismatches here: it spells
+	// the summation bound as d_PLC instead of d_LPC, and it says the filter is
+	// unstable when "DC_resp > 4096". The extracted C reference in
+	// silk_LPC_inverse_pred_gain() (LPC_inv_pred_gain.c) sums over the LPC
+	// order and rejects DC_resp >= 4096, and RFC 6716 section 6 says the
+	// reference source takes precedence for conformance.
+	if dcResp >= 4096 {
+		return 0
+	}
+
+	invGainQ30 := int32(1 << 30)
+	for coefIndex := order - 1; coefIndex > 0; coefIndex-- {
+		// This is the fixed-point Levinson recurrence from RFC 6716 section
+		// 4.2.7.5.8. The code intentionally mirrors
+		// silk_LPC_inverse_pred_gain_QA() in LPC_inv_pred_gain.c, including
+		// the Q24/Q30 scaling, the reflection-coefficient stability checks,
+		// and the saturating numerator update, because tiny arithmetic
+		// differences here can flip a filter from stable to unstable.
+		if aNewQA[coefIndex] > inversePredictionGainALimit || aNewQA[coefIndex] < -inversePredictionGainALimit {
+			return 0
+		}
+
+		rcQ31 := -(aNewQA[coefIndex] << (31 - inversePredictionGainQA))
+		rcMult1Q30 := int32(1<<30) - smmul(rcQ31, rcQ31)
+		mult2Q := 32 - clz32(absInt32(rcMult1Q30))
+		rcMult2 := inverse32VarQ(rcMult1Q30, mult2Q+30)
+		invGainQ30 = smmul(invGainQ30, rcMult1Q30) << 2
+
+		aOldQA := aNewQA
+		aNewQA = atmpQA[coefIndex&1][:]
+		for n := 0; n < coefIndex; n++ {
+			tmpQA := saturatingSubInt32(
+				aOldQA[n],
+				int32(rshiftRound64(int64(aOldQA[coefIndex-n-1])*int64(rcQ31), 31)),
+			)
+			tmp64 := rshiftRound64(int64(tmpQA)*int64(rcMult2), mult2Q)
+			if tmp64 > math.MaxInt32 || tmp64 < math.MinInt32 {
+				return 0
+			}
+			aNewQA[n] = int32(tmp64)
+		}
+	}
+
+	if aNewQA[0] > inversePredictionGainALimit || aNewQA[0] < -inversePredictionGainALimit {
+		return 0
+	}
+
+	rcQ31 := -(aNewQA[0] << (31 - inversePredictionGainQA))
+	rcMult1Q30 := int32(1<<30) - smmul(rcQ31, rcQ31)
+	invGainQ30 = smmul(invGainQ30, rcMult1Q30) << 2
+
+	return invGainQ30
+}
+
+// As described in Section 4.2.7.8.6, SILK uses a Linear Congruential
+// Generator (LCG) to inject pseudorandom noise into the quantized
+// excitation.  To ensure synchronization of this process between the
+// encoder and decoder, each SILK frame stores a 2-bit seed after the
+// LTP parameters (if any).
+//
+// https://datatracker.ietf.org/doc/html/rfc6716#section-4.2.7.7
+func (d *Decoder) decodeLinearCongruentialGeneratorSeed() uint32 {
+	return d.rangeDecoder.DecodeSymbolWithICDF(icdfLinearCongruentialGeneratorSeed)
+}
+
+// SILK fixes the dimension of the codebook to N = 16.  The excitation
+// is made up of a number of "shell blocks", each 16 samples in size.
+// Table 44 lists the number of shell blocks required for a SILK frame
+// for each possible audio bandwidth and frame size.
+//
+// +-----------------+------------+------------------------+
+// | Audio Bandwidth | Frame Size | Number of Shell Blocks |
+// +-----------------+------------+------------------------+
+// | NB              | 10 ms      |                      5 |
+// |                 |            |                        |
+// | MB              | 10 ms      |                      8 |
+// |                 |            |                        |
+// | WB              | 10 ms      |                     10 |
+// |                 |            |                        |
+// | NB              | 20 ms      |                     10 |
+// |                 |            |                        |
+// | MB              | 20 ms      |                     15 |
+// |                 |            |                        |
+// | WB              | 20 ms      |                     20 |
+// +-----------------+------------+------------------------+
+//
+//	Table 44: Number of Shell Blocks Per SILK Frame
+//
+// https://datatracker.ietf.org/doc/html/rfc6716#section-4.2.7.8
+func (d *Decoder) decodeShellblocks(nanoseconds int, bandwidth Bandwidth) (shellblocks int) {
+	switch {
+	case bandwidth == BandwidthNarrowband && nanoseconds == nanoseconds10Ms:
+		shellblocks = 5
+	case bandwidth == BandwidthMediumband && nanoseconds == nanoseconds10Ms:
+		shellblocks = 8
+	case bandwidth == BandwidthWideband && nanoseconds == nanoseconds10Ms:
+		fallthrough
+	case bandwidth == BandwidthNarrowband && nanoseconds == nanoseconds20Ms:
+		shellblocks = 10
+	case bandwidth == BandwidthMediumband && nanoseconds == nanoseconds20Ms:
+		shellblocks = 15
+	case bandwidth == BandwidthWideband && nanoseconds == nanoseconds20Ms:
+		shellblocks = 20
+	}
+
+	return
+}
+
+// The first symbol in the excitation is a "rate level", which is an
+// index from 0 to 8, inclusive, coded using the PDF in Table 45
+//
+// https://datatracker.ietf.org/doc/html/rfc6716#section-4.2.7.8.1
+func (d *Decoder) decodeRatelevel(voiceActivityDetected bool) uint32 {
+	if voiceActivityDetected {
+		return d.rangeDecoder.DecodeSymbolWithICDF(icdfRateLevelVoiced)
+	}
+
+	return d.rangeDecoder.DecodeSymbolWithICDF(icdfRateLevelUnvoiced)
+}
+
+// The total number of pulses in each of the shell blocks follows the
+// rate level.  The pulse counts for all of the shell blocks are coded
+// consecutively, before the content of any of the blocks.
+//
+// https://datatracker.ietf.org/doc/html/rfc6716#section-4.2.7.8.2
+func (d *Decoder) decodePulseAndLSBCounts(shellblocks int, rateLevel uint32) (pulsecounts []uint8, lsbcounts []uint8) {
+	pulsecounts = make([]uint8, shellblocks)
+	lsbcounts = make([]uint8, shellblocks)
+	for i := 0; i < shellblocks; i++ {
+		pulsecounts[i] = uint8(d.rangeDecoder.DecodeSymbolWithICDF(icdfPulseCount[rateLevel]))
+
+		// The special value 17 indicates that this block
+		// has one or more additional LSBs to decode for each coefficient.
+		if pulsecounts[i] == 17 {
+			// If the decoder encounters this value, it decodes another value for the
+			// actual pulse count of the block, but uses the PDF corresponding to
+			// the special rate level 9 instead of the normal rate level.
+			// This Process repeats until the decoder reads a value less than 17, and it
+			// Then sets the number of extra LSBs used to the number of 17's decoded
+			// For that block.
+			lsbcount := uint8(0)
+			for ; pulsecounts[i] == 17 && lsbcount < 10; lsbcount++ {
+				pulsecounts[i] = uint8(d.rangeDecoder.DecodeSymbolWithICDF(icdfPulseCount[9]))
+			}
+			lsbcounts[i] = lsbcount
+
+			// If it reads the value 17 ten times, then the next
+			// Iteration uses the special rate level 10 instead of 9.  The
+			// Probability of decoding a 17 when using the PDF for rate level 10 is
+			// Zero, ensuring that the number of LSBs for a block will not exceed
+			// 10.  The cumulative distribution for rate level 10 is just a shifted
+			// Version of that for 9 and thus does not require any additional
+			// Storage.
+			if lsbcount == 10 {
+				pulsecounts[i] = uint8(d.rangeDecoder.DecodeSymbolWithICDF(icdfPulseCount[10]))
+			}
+		}
+	}
+
+	return pulsecounts, lsbcounts
+}
+
+// The locations of the pulses in each shell block follow the pulse
+// counts. As with the pulse counts, these locations are coded for all the shell blocks
+// before any of the remaining information for each block.  Unlike many
+// other codecs, SILK places no restriction on the distribution of
+// pulses within a shell block.  All of the pulses may be placed in a
+// single location, or each one in a unique location, or anything in
+// between.
+//
+// https://datatracker.ietf.org/doc/html/rfc6716#section-4.2.7.8.3
+func (d *Decoder) decodePulseLocation(pulsecounts []uint8) (eRaw []int32) {
+	eRaw = make([]int32, len(pulsecounts)*pulsecountLargestPartitionSize)
+	for i := range pulsecounts {
+		// This process skips partitions without any pulses, i.e., where
+		// the initial pulse count from Section 4.2.7.8.2 was zero, or where the
+		// split in the prior level indicated that all of the pulses fell on the
+		// other side.  These partitions have nothing to code, so they require
+		// no PDF.
+		if pulsecounts[i] == 0 {
+			continue
+		}
+
+		eRawIndex := pulsecountLargestPartitionSize * i
+		var samplePartition16 [2]uint8
+		var samplePartition8 [2]uint8
+		var samplePartition4 [2]uint8
+		var samplePartition2 [2]uint8
+
+		// The location of pulses is coded by recursively partitioning each
+		// block into halves, and coding how many pulses fall on the left side
+		// of the split.  All remaining pulses must fall on the right side of
+		// the split.
+		d.partitionPulseCount(icdfPulseCountSplit16SamplePartitions, pulsecounts[i], samplePartition16[:])
+		for j := 0; j < 2; j++ {
+			d.partitionPulseCount(icdfPulseCountSplit8SamplePartitions, samplePartition16[j], samplePartition8[:])
+			for k := 0; k < 2; k++ {
+				d.partitionPulseCount(icdfPulseCountSplit4SamplePartitions, samplePartition8[k], samplePartition4[:])
+				for l := 0; l < 2; l++ {
+					d.partitionPulseCount(icdfPulseCountSplit2SamplePartitions, samplePartition4[l], samplePartition2[:])
+					eRaw[eRawIndex] = int32(samplePartition2[0])
+					eRawIndex++
+
+					eRaw[eRawIndex] = int32(samplePartition2[1])
+					eRawIndex++
+				}
+			}
+		}
+	}
+
+	return eRaw
+}
+
+// After the decoder reads the pulse locations for all blocks, it reads
+// the LSBs (if any) for each block in turn.  Inside each block, it
+// reads all the LSBs for each coefficient in turn, even those where no
+// pulses were allocated, before proceeding to the next one.
+//
+// https://datatracker.ietf.org/doc/html/rfc6716#section-4.2.7.8.4
+func (d *Decoder) decodeExcitationLSB(eRaw []int32, lsbcounts []uint8) {
+	for i := range eRaw {
+		for bit := uint8(0); bit < lsbcounts[i/pulsecountLargestPartitionSize]; bit++ {
+			eRaw[i] = (eRaw[i] << 1) | int32(d.rangeDecoder.DecodeSymbolWithICDF(icdfExcitationLSB))
+		}
+	}
+}
+
+// After decoding the pulse locations and the LSBs, the decoder knows
+// the magnitude of each coefficient in the excitation.
+//
+// https://datatracker.ietf.org/doc/html/rfc6716#section-4.2.7.8.5
+func (d *Decoder) decodeExcitationSign(
+	eRaw []int32,
+	signalType frameSignalType,
+	quantizationOffsetType frameQuantizationOffsetType,
+	pulsecounts []uint8,
+) {
+	for i := range eRaw {
+		// It then decodes a sign for all coefficients
+		// with a non-zero magnitude
+		//
+		// https://datatracker.ietf.org/doc/html/rfc6716#section-4.2.7.8.5
+		if eRaw[i] == 0 {
+			continue
+		}
+
+		// using one of the PDFs from Table 52.
+		//
+		// https://datatracker.ietf.org/doc/html/rfc6716#section-4.2.7.8.5
+		icdf := icdfExcitationSign(signalType, quantizationOffsetType, pulsecounts[i/pulsecountLargestPartitionSize])
+
+		// If the value decoded is 0, then the coefficient magnitude is negated.
+		// Otherwise, it remains positive.
+		if d.rangeDecoder.DecodeSymbolWithICDF(icdf) == 0 {
+			eRaw[i] *= -1
+		}
+	}
+}
+
+// icdfExcitationSign returns the PDF the sign of an excitation coefficient
+// is coded with, from Table 52. It depends on the signal type, the
+// quantization offset type and the number of pulses in the shell block,
+// not counting the LSBs.
+//
+// https://datatracker.ietf.org/doc/html/rfc6716#section-4.2.7.8.5
+func icdfExcitationSign(signalType frameSignalType, quantizationOffsetType frameQuantizationOffsetType, pulsecount uint8) []uint {
+	switch signalType {
+	case frameSignalTypeInactive:
+		switch quantizationOffsetType {
+		case frameQuantizationOffsetTypeLow:
+			switch pulsecount {
+			case 0:
+				return icdfExcitationSignInactiveSignalLowQuantization0Pulse
+			case 1:
+				return icdfExcitationSignInactiveSignalLowQuantization1Pulse
+			case 2:
+				return icdfExcitationSignInactiveSignalLowQuantization2Pulse
+			case 3:
+				return icdfExcitationSignInactiveSignalLowQuantization3Pulse
+			case 4:
+				return icdfExcitationSignInactiveSignalLowQuantization4Pulse
+			case 5:
+				return icdfExcitationSignInactiveSignalLowQuantization5Pulse
+			default:
+				return icdfExcitationSignInactiveSignalLowQuantization6PlusPulse
+			}
+		case frameQuantizationOffsetTypeHigh:
+			switch pulsecount {
+			case 0:
+				return icdfExcitationSignInactiveSignalHighQuantization0Pulse
+			case 1:
+				return icdfExcitationSignInactiveSignalHighQuantization1Pulse
+			case 2:
+				return icdfExcitationSignInactiveSignalHighQuantization2Pulse
+			case 3:
+				return icdfExcitationSignInactiveSignalHighQuantization3Pulse
+			case 4:
+				return icdfExcitationSignInactiveSignalHighQuantization4Pulse
+			case 5:
+				return icdfExcitationSignInactiveSignalHighQuantization5Pulse
+			default:
+				return icdfExcitationSignInactiveSignalHighQuantization6PlusPulse
+			}
+		}
+	case frameSignalTypeUnvoiced:
+		switch quantizationOffsetType {
+		case frameQuantizationOffsetTypeLow:
+			switch pulsecount {
+			case 0:
+				return icdfExcitationSignUnvoicedSignalLowQuantization0Pulse
+			case 1:
+				return icdfExcitationSignUnvoicedSignalLowQuantization1Pulse
+			case 2:
+				return icdfExcitationSignUnvoicedSignalLowQuantization2Pulse
+			case 3:
+				return icdfExcitationSignUnvoicedSignalLowQuantization3Pulse
+			case 4:
+				return icdfExcitationSignUnvoicedSignalLowQuantization4Pulse
+			case 5:
+				return icdfExcitationSignUnvoicedSignalLowQuantization5Pulse
+			default:
+				return icdfExcitationSignUnvoicedSignalLowQuantization6PlusPulse
+			}
+		case frameQuantizationOffsetTypeHigh:
+			switch pulsecount {
+			case 0:
+				return icdfExcitationSignUnvoicedSignalHighQuantization0Pulse
+			case 1:
+				return icdfExcitationSignUnvoicedSignalHighQuantization1Pulse
+			case 2:
+				return icdfExcitationSignUnvoicedSignalHighQuantization2Pulse
+			case 3:
+				return icdfExcitationSignUnvoicedSignalHighQuantization3Pulse
+			case 4:
+				return icdfExcitationSignUnvoicedSignalHighQuantization4Pulse
+			case 5:
+				return icdfExcitationSignUnvoicedSignalHighQuantization5Pulse
+			default:
+				return icdfExcitationSignUnvoicedSignalHighQuantization6PlusPulse
+			}
+		}
+
+	case frameSignalTypeVoiced:
+		switch quantizationOffsetType {
+		case frameQuantizationOffsetTypeLow:
+			switch pulsecount {
+			case 0:
+				return icdfExcitationSignVoicedSignalLowQuantization0Pulse
+			case 1:
+				return icdfExcitationSignVoicedSignalLowQuantization1Pulse
+			case 2:
+				return icdfExcitationSignVoicedSignalLowQuantization2Pulse
+			case 3:
+				return icdfExcitationSignVoicedSignalLowQuantization3Pulse
+			case 4:
+				return icdfExcitationSignVoicedSignalLowQuantization4Pulse
+			case 5:
+				return icdfExcitationSignVoicedSignalLowQuantization5Pulse
+			default:
+				return icdfExcitationSignVoicedSignalLowQuantization6PlusPulse
+			}
+		case frameQuantizationOffsetTypeHigh:
+			switch pulsecount {
+			case 0:
+				return icdfExcitationSignVoicedSignalHighQuantization0Pulse
+			case 1:
+				return icdfExcitationSignVoicedSignalHighQuantization1Pulse
+			case 2:
+				return icdfExcitationSignVoicedSignalHighQuantization2Pulse
+			case 3:
+				return icdfExcitationSignVoicedSignalHighQuantization3Pulse
+			case 4:
+				return icdfExcitationSignVoicedSignalHighQuantization4Pulse
+			case 5:
+				return icdfExcitationSignVoicedSignalHighQuantization5Pulse
+			default:
+				return icdfExcitationSignVoicedSignalHighQuantization6PlusPulse
+			}
+		}
+	}
+
+	return nil
+}
+
+// SILK codes the excitation using a modified version of the Pyramid
+// Vector Quantizer (PVQ) codebook [PVQ].  The PVQ codebook is designed
+// for Laplace-distributed values and consists of all sums of K signed,
+// unit pulses in a vector of dimension N, where two pulses at the same
+// position are required to have the same sign.
+//
+// https://datatracker.ietf.org/doc/html/rfc6716#section-4.2.7.8
+func (d *Decoder) decodeExcitation(
+	signalType frameSignalType,
+	quantizationOffsetType frameQuantizationOffsetType,
+	seed uint32,
+	pulsecounts, lsbcounts []uint8,
+) (eQ23 []int32) {
+	// After the signs have been read, there is enough information to
+	// reconstruct the complete excitation signal.  This requires adding a
+	// constant quantization offset to each non-zero sample and then
+	// pseudorandomly inverting and offsetting every sample.
+	//
+	// https://datatracker.ietf.org/doc/html/rfc6716#section-4.2.7.8.6
+
+	// The constant quantization offset varies depending on the signal type and
+	// quantization offset type
+
+	// +-------------+--------------------------+--------------------------+
+	// | Signal Type | Quantization Offset Type |      Quantization Offset |
+	// |             |                          |                    (Q23) |
+	// +-------------+--------------------------+--------------------------+
+	// | Inactive    | Low                      |                       25 |
+	// |             |                          |                          |
+	// | Inactive    | High                     |                       60 |
+	// |             |                          |                          |
+	// | Unvoiced    | Low                      |                       25 |
+	// |             |                          |                          |
+	// | Unvoiced    | High                     |                       60 |
+	// |             |                          |                          |
+	// | Voiced      | Low                      |                        8 |
+	// |             |                          |                          |
+	// | Voiced      | High                     |                       25 |
+	// +-------------+--------------------------+--------------------------+
+	// Table 53: Excitation Quantization Offsets
+	offsetQ23 := excitationQuantizationOffset(signalType, quantizationOffsetType)
+
+	// Let e_raw[i] be the raw excitation value at position i,
+	// with a magnitude composed of the pulses at that location (see Section 4.2.7.8.3)
+	eRaw := d.decodePulseLocation(pulsecounts)
+
+	// combined with any additional LSBs (see Section 4.2.7.8.4),
+	d.decodeExcitationLSB(eRaw, lsbcounts)
+
+	// and with the corresponding sign decoded in Section 4.2.7.8.5.
+	d.decodeExcitationSign(eRaw, signalType, quantizationOffsetType, pulsecounts)
+
+	eQ23 = make([]int32, len(eRaw))
+	for i := range eRaw {
+		// Additionally, let seed be the current pseudorandom seed, which is initialized to the
+		// value decoded from Section 4.2.7.7 for the first sample in the current SILK frame, and
+		// updated for each subsequent sample according to the procedure below.
+		// Finally, let offset_Q23 be the quantization offset from Table 53.
+		// Then the following procedure produces the final reconstructed
+		// excitation value, e_Q23[i]:
+
+		//      e_Q23[i] = (e_raw[i] << 8) - sign(e_raw[i])*20 + offset_Q23;
+		//          seed = (196314165*seed + 907633515) & 0xFFFFFFFF;
+		//      e_Q23[i] = (seed & 0x80000000) ? -e_Q23[i] : e_Q23[i];
+		//          seed = (seed + e_raw[i]) & 0xFFFFFFFF;
+
+		// When e_raw[i] is zero, sign() returns 0 by the definition in
+		// Section 1.1.4, so the factor of 20 does not get added.  The final
+		// e_Q23[i] value may require more than 16 bits per sample, but it will
+		// not require more than 23, including the sign.
+
+		eQ23[i] = (eRaw[i] << 8) - int32(sign(int(eRaw[i])))*20 + offsetQ23
+		seed = (196314165*seed + 907633515) & 0xFFFFFFFF
+		if seed&0x80000000 != 0 {
+			eQ23[i] *= -1
+		}
+		seed = (seed + uint32(eRaw[i])) & 0xFFFFFFFF
+	}
+
+	return eQ23
+}
+
+// excitationQuantizationOffset returns the offset_Q23 from Table 53 that
+// is added to each excitation sample
+func excitationQuantizationOffset(signalType frameSignalType, quantizationOffsetType frameQuantizationOffsetType) int32 {
+	switch {
+	case signalType == frameSignalTypeInactive && quantizationOffsetType == frameQuantizationOffsetTypeLow:
+		return 25
+	case signalType == frameSignalTypeInactive && quantizationOffsetType == frameQuantizationOffsetTypeHigh:
+		return 60
+	case signalType == frameSignalTypeUnvoiced && quantizationOffsetType == frameQuantizationOffsetTypeLow:
+		return 25
+	case signalType == frameSignalTypeUnvoiced && quantizationOffsetType == frameQuantizationOffsetTypeHigh:
+		return 60
+	case signalType == frameSignalTypeVoiced && quantizationOffsetType == frameQuantizationOffsetTypeLow:
+		return 8
+	case signalType == frameSignalTypeVoiced && quantizationOffsetType == frameQuantizationOffsetTypeHigh:
+		return 25
+	}
+
+	return 0
+}
+
+// The PDF to use is chosen by the size of the current partition (16, 8, 4, or 2) and the
+// number of pulses in the partition (1 to 16, inclusive)
+//
+// https://datatracker.ietf.org/doc/html/rfc6716#section-4.2.7.8.3
+func (d *Decoder) partitionPulseCount(icdf [][]uint, block uint8, halves []uint8) {
+	// This process skips partitions without any pulses, i.e., where
+	// the initial pulse count from Section 4.2.7.8.2 was zero, or where the
+	// split in the prior level indicated that all of the pulses fell on the
+	// other side.  These partitions have nothing to code, so they require
+	// no PDF.
+	if block == 0 {
+		halves[0] = 0
+		halves[1] = 0
+	} else {
+		halves[0] = uint8(d.rangeDecoder.DecodeSymbolWithICDF(icdf[block-1]))
+		halves[1] = block - halves[0]
+	}
+}
+
+func pitchLagCodebooks(bandwidth Bandwidth) (lowPartICDF []uint, lagScale, lagMin, lagMax uint32) {
+	switch bandwidth {
+	case BandwidthNarrowband:
+		return icdfPrimaryPitchLagLowPartNarrowband, 4, 16, 144
+	case BandwidthMediumband:
+		return icdfPrimaryPitchLagLowPartMediumband, 6, 24, 216
+	case BandwidthWideband:
+		return icdfPrimaryPitchLagLowPartWideband, 8, 32, 288
+	}
+
+	return nil, 0, 0, 0
+}
+
+func (d *Decoder) decodePrimaryPitchLag(lagAbsolute bool, lowPartICDF []uint, lagScale, lagMin uint32) int {
+	if lagAbsolute {
+		lagHigh := d.rangeDecoder.DecodeSymbolWithICDF(icdfPrimaryPitchLagHighPart)
+		lagLow := d.rangeDecoder.DecodeSymbolWithICDF(lowPartICDF)
+
+		return int(lagHigh*lagScale + lagLow + lagMin)
+	}
+
+	deltaLagIndex := d.rangeDecoder.DecodeSymbolWithICDF(icdfPrimaryPitchLagChange)
+	if deltaLagIndex == 0 {
+		lagHigh := d.rangeDecoder.DecodeSymbolWithICDF(icdfPrimaryPitchLagHighPart)
+		lagLow := d.rangeDecoder.DecodeSymbolWithICDF(lowPartICDF)
+
+		return int(lagHigh*lagScale + lagLow + lagMin)
+	}
+
+	return d.previousLag + int(deltaLagIndex) - 9
+}
+
+func pitchContourCodebooks(bandwidth Bandwidth, nanoseconds int) (lagCb [][]int8, lagIcdf []uint) {
+	switch bandwidth {
+	case BandwidthNarrowband:
+		if nanoseconds == nanoseconds10Ms {
+			return codebookSubframePitchCounterNarrowband10Ms, icdfSubframePitchContourNarrowband10Ms
+		}
+
+		return codebookSubframePitchCounterNarrowband20Ms, icdfSubframePitchContourNarrowband20Ms
+	case BandwidthMediumband, BandwidthWideband:
+		if nanoseconds == nanoseconds10Ms {
+			return codebookSubframePitchCounterMediumbandOrWideband10Ms, icdfSubframePitchContourMediumbandOrWideband10Ms
+		}
+
+		return codebookSubframePitchCounterMediumbandOrWideband20Ms, icdfSubframePitchContourMediumbandOrWideband20Ms
+	}
+
+	return nil, nil
+}
+
+// https://www.rfc-editor.org/rfc/rfc6716.html#section-4.2.7.6.1
+func (d *Decoder) decodePitchLags(
+	signalType frameSignalType,
+	bandwidth Bandwidth,
+	nanoseconds int,
+	coding frameCoding,
+) (lagMax uint32, pitchLags []int) {
+	if signalType != frameSignalTypeVoiced {
+		return 0, nil
+	}
+
+	// The primary lag index is coded either relative to the primary lag of
+	// the prior frame in the same channel or as an absolute index.
+	// Absolute coding is used if and only if
+	//
+	// *  This is the first SILK frame of its type (LBRR or regular) for
+	//    this channel in the current Opus frame,
+	//
+	// *  The previous SILK frame of the same type (LBRR or regular) for
+	//    this channel in the same Opus frame was not coded, or
+	//
+	// *  That previous SILK frame was coded, but was not voiced (see
+	//    Section 4.2.7.3).
+
+	lagAbsolute := coding != frameCodingConditional || !d.isPreviousFrameVoiced
+	lowPartICDF, lagScale, lagMin, lagMax := pitchLagCodebooks(bandwidth)
+
+	// With absolute coding, the primary pitch lag may range from 2 ms
+	// (inclusive) up to 18 ms (exclusive), corresponding to pitches from
+	// 500 Hz down to 55.6 Hz, respectively.  It is comprised of a high part
+	// and a low part, where the decoder first reads the high part using the
+	// 32-entry codebook in Table 29 and then the low part using the
+	// codebook corresponding to the current audio bandwidth from Table 30.
+	//
+	//  +------------+------------------------+-------+----------+----------+
+	//  | Audio      | PDF                    | Scale | Minimum  | Maximum  |
+	//  | Bandwidth  |                        |       | Lag      | Lag      |
+	//  +------------+------------------------+-------+----------+----------+
+	//  | NB         | {64, 64, 64, 64}/256   | 4     | 16       | 144      |
+	//  |            |                        |       |          |          |
+	//  | MB         | {43, 42, 43, 43, 42,   | 6     | 24       | 216      |
+	//  |            | 43}/256                |       |          |          |
+	//  |            |                        |       |          |          |
+	//  | WB         | {32, 32, 32, 32, 32,   | 8     | 32       | 288      |
+	//  |            | 32, 32, 32}/256        |       |          |          |
+	//  +------------+------------------------+-------+----------+----------+
+
+	// The final primary pitch lag is then
+	//
+	//              lag = lag_high*lag_scale + lag_low + lag_min
+	//
+	// where lag_high is the high part, lag_low is the low part, and
+	// lag_scale and lag_min are the values from the "Scale" and "Minimum
+	// Lag" columns of Table 30, respectively.
+	lag := d.decodePrimaryPitchLag(lagAbsolute, lowPartICDF, lagScale, lagMin)
+	d.previousLag = lag
+
+	// After the primary pitch lag, a "pitch contour", stored as a single
+	// entry from one of four small VQ codebooks, gives lag offsets for each
+	// subframe in the current SILK frame.  The codebook index is decoded
+	// using one of the PDFs in Table 32 depending on the current frame size
+	// and audio bandwidth.  Tables 33 through 36 give the corresponding
+	// offsets to apply to the primary pitch lag for each subframe given the
+	// decoded codebook index.
+	//
+	// +-----------+--------+----------+-----------------------------------+
+	// | Audio     | SILK   | Codebook | PDF                               |
+	// | Bandwidth | Frame  |     Size |                                   |
+	// |           | Size   |          |                                   |
+	// +-----------+--------+----------+-----------------------------------+
+	// | NB        | 10 ms  |        3 | {143, 50, 63}/256                 |
+	// |           |        |          |                                   |
+	// | NB        | 20 ms  |       11 | {68, 12, 21, 17, 19, 22, 30, 24,  |
+	// |           |        |          | 17, 16, 10}/256                   |
+	// |           |        |          |                                   |
+	// | MB or WB  | 10 ms  |       12 | {91, 46, 39, 19, 14, 12, 8, 7, 6, |
+	// |           |        |          | 5, 5, 4}/256                      |
+	// |           |        |          |                                   |
+	// | MB or WB  | 20 ms  |       34 | {33, 22, 18, 16, 15, 14, 14, 13,  |
+	// |           |        |          | 13, 10, 9, 9, 8, 6, 6, 6, 5, 4,   |
+	// |           |        |          | 4, 4, 3, 3, 3, 2, 2, 2, 2, 2, 2,  |
+	// |           |        |          | 2, 1, 1, 1, 1}/256                |
+	// +-----------+--------+----------+-----------------------------------+
+	//
+	// Table 32: PDFs for Subframe Pitch Contour
+
+	// The final pitch lag for each subframe is assembled in
+	// silk_decode_pitch() (decode_pitch.c).  Let lag be the primary pitch
+	// lag for the current SILK frame, contour_index be index of the VQ
+	// codebook, and lag_cb[contour_index][k] be the corresponding entry of
+	// the codebook from the appropriate table given above for the k'th
+	// subframe.
+
+	lagCb, lagIcdf := pitchContourCodebooks(bandwidth, nanoseconds)
+	contourIndex := d.rangeDecoder.DecodeSymbolWithICDF(lagIcdf)
+
+	// Then the final pitch lag for that subframe is
+	//
+	//     pitch_lags[k] = clamp(lag_min, lag + lag_cb[contour_index][k],
+	//                           lag_max)
+	pitchLags = make([]int, subframeCount(nanoseconds))
+	for i := range pitchLags {
+		pitchLags[i] = int(clamp(
+			int32(lagMin),
+			int32(lag+int(lagCb[contourIndex][i])),
+			int32(lagMax)),
+		)
+	}
+
+	return lagMax, pitchLags
+}
+
+// This allows the encoder to trade off the prediction gain between
+// packets against the recovery time after packet loss.
+//
+// https://www.rfc-editor.org/rfc/rfc6716.html#section-4.2.7.6.3
+func (d *Decoder) decodeLTPScalingParameter(
+	signalType frameSignalType,
+	coding frameCoding,
+) float32 {
+	// An LTP scaling parameter appears after the LTP filter coefficients if
+	// and only if
+	//
+	// o  This is a voiced frame (see Section 4.2.7.3), and
+	// o  Either
+	//    *  This SILK frame corresponds to the first time interval of the
+	//       current Opus frame for its type (LBRR or regular), or
+	//
+	//    *  This is an LBRR frame where the LBRR flags (see Section 4.2.4)
+	//       indicate the previous LBRR frame in the same channel is not
+	//       coded.
+
+	// Frames that do not code the scaling parameter
+	//    use the default factor of 15565 (approximately 0.95).
+	if signalType != frameSignalTypeVoiced || coding != frameCodingIndependent {
+		return 15565.0
+	}
+
+	// The three possible values represent Q14 scale factors of
+	// 15565, 12288, and 8192, respectively (corresponding to approximately
+	// 0.95, 0.75, and 0.5)
+	scaleFactorIndex := d.rangeDecoder.DecodeSymbolWithICDF(icdfLTPScalingParameter)
+	switch scaleFactorIndex {
+	case 0:
+		return 15565.0
+	case 1:
+		return 12288.0
+	case 2:
+		return 8192.0
+	}
+
+	return 0
+}
+
+// SILK uses a separate 5-tap pitch filter for each subframe, selected
+// from one of three codebooks.
+//
+// https://www.rfc-editor.org/rfc/rfc6716.html#section-4.2.7.6.2
+func (d *Decoder) decodeLTPFilterCoefficients(signalType frameSignalType, subframeCount int) (bQ7 [][]int8) {
+	if signalType != frameSignalTypeVoiced {
+		return bQ7
+	}
+
+	bQ7 = make([][]int8, subframeCount)
+	bQ7Data := make([]int8, subframeCount*5)
+	for i := range bQ7 {
+		start := i * 5
+		bQ7[i] = bQ7Data[start : start+5]
+	}
+
+	// This is signaled with an explicitly-coded "periodicity index".  This
+	// immediately follows the subframe pitch lags, and is coded using the
+	// 3-entry PDF from Table 37.
+	periodicityIndex := d.rangeDecoder.DecodeSymbolWithICDF(icdfPeriodicityIndex)
+
+	// The indices of the filters for each subframe follow.  They are all
+	// coded using the PDF from Table 38 corresponding to the periodicity
+	// index.  Tables 39 through 41 contain the corresponding filter taps as
+	// signed Q7 integers.
+	for i := 0; i < subframeCount; i++ {
+		var filterIndiceIcdf []uint
+		switch periodicityIndex {
+		case 0:
+			filterIndiceIcdf = icdfLTPFilterIndex0
+		case 1:
+			filterIndiceIcdf = icdfLTPFilterIndex1
+		case 2:
+			filterIndiceIcdf = icdfLTPFilterIndex2
+		}
+
+		filterIndex := d.rangeDecoder.DecodeSymbolWithICDF(filterIndiceIcdf)
+		var LTPFilterCodebook [][]int8
+
+		switch periodicityIndex {
+		case 0:
+			LTPFilterCodebook = codebookLTPFilterPeriodicityIndex0
+		case 1:
+			LTPFilterCodebook = codebookLTPFilterPeriodicityIndex1
+		case 2:
+			LTPFilterCodebook = codebookLTPFilterPeriodicityIndex2
+		}
+
+		copy(bQ7[i], LTPFilterCodebook[filterIndex])
+	}
+
+	return bQ7
+}
+
+// let n be the number of samples in a subframe (40 for NB, 60 for
+// MB, and 80 for WB)
+// https://www.rfc-editor.org/rfc/rfc6716.html#section-4.2.7.9
+func (d *Decoder) samplesInSubframe(bandwidth Bandwidth) int {
+	switch bandwidth {
+	case BandwidthNarrowband:
+		return 40
+	case BandwidthMediumband:
+		return 60
+	case BandwidthWideband:
+		return 80
+	}
+
+	return 0
+}
+
+// https://www.rfc-editor.org/rfc/rfc6716.html#section-4.2.7.9.1
+func (d *Decoder) ltpSynthesis(
+	out []float32,
+	bQ7 [][]int8,
+	pitchLags []int,
+	n, j, s, dLPC int,
+	ltpScaleQ14 float32,
+	wQ2 int16,
+	aQ12, gainQ16, res, resLag []float32,
+) {
+	// If this is the third or fourth subframe of a 20 ms SILK frame and the LSF
+	// interpolation factor, w_Q2 (see Section 4.2.7.5.5), is less than 4,
+	// then let out_end be set to (j - (s-2)*n) and let LTP_scale_Q14 be set
+	// to 16384.  Otherwise, set out_end to (j - s*n) and set LTP_scale_Q14
+	// to the Q14 LTP scaling value from Section 4.2.7.6.3.
+	var outEnd int
+	if s < 2 || wQ2 == 4 {
+		outEnd = -s * n
+	} else {
+		outEnd = -(s - 2) * n
+		ltpScaleQ14 = 16384.0
+	}
+
+	// out[i] and lpc[i] are initially cleared to all zeros. Then, for i
+	// such that (j - pitch_lags[s] - 2) <= i < out_end, out[i] is
+	// rewhitened into an LPC residual, res[i], via
+	//
+	//              4.0*LTP_scale_Q14
+	//     res[i] = ----------------- * clamp(-1.0,
+	//                 gain_Q16[s]
+	//                                        d_LPC-1
+	//                                          __              a_Q12[k]
+	//                                 out[i] - \  out[i-k-1] * --------, 1.0)
+	//                                          /_               4096.0
+	//                                          k=0
+	for i := (-pitchLags[s]) - 2; i < outEnd; i++ {
+		index := i + j
+
+		var (
+			resVal     float32
+			resIndex   int
+			writeToLag bool
+		)
+
+		switch {
+		case index >= len(res):
+			continue
+		case index >= 0:
+			resVal = out[index]
+			resIndex = index
+		default:
+			resIndex = len(resLag) + index
+			resVal = d.finalOutValues[len(d.finalOutValues)+index]
+			writeToLag = true
+		}
+
+		for k := 0; k < dLPC; k++ {
+			var outVal float32
+			if outIndex := index - k - 1; outIndex >= 0 {
+				outVal = out[outIndex]
+			} else {
+				outVal = d.finalOutValues[len(d.finalOutValues)+outIndex]
+			}
+
+			resVal -= outVal * (aQ12[k] / 4096.0)
+		}
+
+		resVal = clampNegativeOneToOne(resVal)
+		resVal *= (4.0 * ltpScaleQ14) / gainQ16[s]
+
+		if !writeToLag {
+			res[resIndex] = resVal
+		} else {
+			resLag[resIndex] = resVal
+		}
+	}
+
+	// Then, for i such that
+	// out_end <= i < j, lpc[i] is rewhitened into an LPC residual, res[i],
+	// via
+	//
+	//                                      d_LPC-1
+	//                  65536.0               __              a_Q12[k]
+	//       res[i] = ----------- * (lpc[i] - \  lpc[i-k-1] * --------)
+	//                gain_Q16[s]             /_               4096.0
+	//                                        k=0
+	//
+	// This requires storage to buffer up to 256 values of lpc[i] from
+	// previous subframes (240 from the current SILK frame and 16 from the
+	// previous SILK frame).  This corresponds to WB with up to three
+	// previous subframes in the current SILK frame, plus 16 samples for
+	// d_LPC.
+
+	// The astute reader will notice that, given the definition of
+	// lpc[i] in Section 4.2.7.9.2, the output of this latter equation is
+	// merely a scaled version of the values of res[i] from previous
+	// subframes.
+	if s > 0 {
+		scaledGain := gainQ16[s-1] / gainQ16[s]
+		for i := outEnd; i < 0; i++ {
+			index := j + i
+			if index < 0 {
+				resLag[len(resLag)+index] *= scaledGain
+			} else {
+				res[index] *= scaledGain
+			}
+		}
+	}
+
+	// Let e_Q23[i] for j <= i < (j + n) be the excitation for the current
+	// subframe, and b_Q7[k] for 0 <= k < 5 be the coefficients of the LTP
+	// filter taken from the codebook entry in one of Tables 39 through 41
+	// corresponding to the index decoded for the current subframe in
+	// Section 4.2.7.6.2.  Then for i such that j <= i < (j + n), the LPC
+	// residual is
+
+	//                          4
+	//              e_Q23[i]   __                                  b_Q7[k]
+	//    res[i] = --------- + \  res[i - pitch_lags[s] + 2 - k] * -------
+	//              2.0**23    /_                                   128.0
+	//                         k=0
+
+	var resSum, resVal float32
+	for i := j; i < (j + n); i++ {
+		resSum = res[i]
+		for k := 0; k <= 4; k++ {
+			if resIndex := i - pitchLags[s] + 2 - k; resIndex < 0 {
+				resVal = resLag[len(resLag)+resIndex]
+			} else {
+				resVal = res[resIndex]
+			}
+
+			resSum += resVal * (float32(bQ7[s][k]) / 128.0)
+		}
+
+		res[i] = resSum
+	}
+}
+
+// LPC synthesis uses the short-term LPC filter to predict the next
+// output coefficient.  For i such that (j - d_LPC) <= i < j, let lpc[i]
+// be the result of LPC synthesis from the last d_LPC samples of the
+// previous subframe or zeros in the first subframe for this channel
+// after either
+//
+// https://www.rfc-editor.org/rfc/rfc6716.html#section-4.2.7.9.2
+func (d *Decoder) lpcSynthesis(
+	out []float32,
+	n, s, dLPC int,
+	aQ12, res, gainQ16, lpc []float32,
+) {
+	// Then, for i such that j <= i < (j + n), the result of LPC synthesis
+	// for the current subframe is
+	//
+	//                                     d_LPC-1
+	//                gain_Q16[i]            __              a_Q12[k]
+	//       lpc[i] = ----------- * res[i] + \  lpc[i-k-1] * --------
+	//                  65536.0              /_               4096.0
+	//                                       k=0
+	//
+	normalizedAQ12, reversedAQ12 := normalizedLPCWeights(aQ12, dLPC)
+	gain := gainQ16[s] / 65536.0
+	subframeOffset := n * s
+	subframeOut := out[:n]
+	if s > 0 {
+		lpcSynthesisSteadyState(
+			subframeOut,
+			dLPC,
+			reversedAQ12,
+			res[subframeOffset:subframeOffset+n],
+			lpc[subframeOffset:subframeOffset+n],
+			lpc[subframeOffset-dLPC:subframeOffset+n],
+			gain,
+		)
+	} else {
+		d.lpcSynthesisFirstSubframe(subframeOut, dLPC, normalizedAQ12, res[:n], lpc[:n], gain)
+	}
+
+	d.savePreviousFrameLPCValues(lpc, out, n, dLPC)
+}
+
+func normalizedLPCWeights(aQ12 []float32, dLPC int) (normalizedAQ12, reversedAQ12 [16]float32) {
+	for coefficientIndex := 0; coefficientIndex < dLPC; coefficientIndex++ {
+		normalizedAQ12[coefficientIndex] = aQ12[coefficientIndex] / 4096.0
+	}
+	// The RFC recurrence applies a_Q12[0] to the newest LPC sample. The
+	// steady-state path walks a contiguous oldest-to-newest history slice.
+	for coefficientIndex := 0; coefficientIndex < dLPC; coefficientIndex++ {
+		reversedAQ12[coefficientIndex] = normalizedAQ12[dLPC-coefficientIndex-1]
+	}
+
+	return normalizedAQ12, reversedAQ12
+}
+
+func lpcSynthesisSteadyState(
+	out []float32,
+	dLPC int,
+	reversedAQ12 [16]float32,
+	subframeRes, subframeLPC, historyAndOutput []float32,
+	gain float32,
+) {
+	for sampleIndex := range out {
+		lpcVal := gain * subframeRes[sampleIndex]
+		history := historyAndOutput[sampleIndex : sampleIndex+dLPC]
+		for coefficientIndex := 0; coefficientIndex < dLPC; coefficientIndex++ {
+			lpcVal += history[coefficientIndex] * reversedAQ12[coefficientIndex]
+		}
+
+		subframeLPC[sampleIndex] = lpcVal
+		out[sampleIndex] = clampNegativeOneToOne(lpcVal)
+	}
+}
+
+func (d *Decoder) lpcSynthesisFirstSubframe(
+	out []float32,
+	dLPC int,
+	normalizedAQ12 [16]float32,
+	subframeRes, subframeLPC []float32,
+	gain float32,
+) {
+	var currentLPCVal float32
+	for sampleIndex := range out {
+		lpcVal := gain * subframeRes[sampleIndex]
+
+		for coefficientIndex := 0; coefficientIndex < dLPC; coefficientIndex++ {
+			if lpcIndex := sampleIndex - coefficientIndex - 1; lpcIndex >= 0 {
+				currentLPCVal = subframeLPC[lpcIndex]
+			} else if previousIndex := len(d.previousFrameLPCValues) - 1 + (sampleIndex - coefficientIndex); previousIndex >= 0 {
+				currentLPCVal = d.previousFrameLPCValues[previousIndex]
+			} else {
+				currentLPCVal = 0
+			}
+
+			lpcVal += currentLPCVal * normalizedAQ12[coefficientIndex]
+		}
+
+		subframeLPC[sampleIndex] = lpcVal
+		out[sampleIndex] = clampNegativeOneToOne(lpcVal)
+	}
+}
+
+func (d *Decoder) savePreviousFrameLPCValues(lpc, out []float32, n, dLPC int) {
+	//  The decoder saves the final d_LPC values, i.e., lpc[i] such that
+	// (j + n - d_LPC) <= i < (j + n), to feed into the LPC synthesis of the
+	// next subframe.  This requires storage for up to 16 values of lpc[i]
+	// (for WB frames).
+	// The final d_LPC synthesized samples become the history for the next
+	// subframe. RFC 6716 section 4.2.7.9 describes that continuity
+	// requirement, and decode_frame.c preserves this state even for the
+	// first decoded frame. The old haveDecoded guard skipped that initial
+	// handoff and left the next frame with an all-zero LPC history.
+	if len(out) != n {
+		return
+	}
+	if cap(d.previousFrameLPCValues) < dLPC {
+		d.previousFrameLPCValues = make([]float32, dLPC)
+	} else {
+		d.previousFrameLPCValues = d.previousFrameLPCValues[:dLPC]
+	}
+	copy(d.previousFrameLPCValues, lpc[len(lpc)-dLPC:])
+}
+
+// The remainder of the reconstruction process for the frame does not
+// need to be bit-exact, as small errors should only introduce
+// proportionally small distortions.  Although the reference
+// implementation only includes a fixed-point version of the remaining
+// steps, this section describes them in terms of a floating-point
+// version for simplicity.  This produces a signal with a nominal range
+// of -1.0 to 1.0.
+//
+// https://www.rfc-editor.org/rfc/rfc6716.html#section-4.2.7.9
+func (d *Decoder) silkFrameReconstruction(
+	signalType frameSignalType, bandwidth Bandwidth,
+	subframeCount int,
+	dLPC int,
+	lagMax uint32,
+	bQ7 [][]int8,
+	pitchLags []int,
+	eQ23 []int32,
+	ltpScaleQ14 float32,
+	wQ2 int16,
+	aQ12 [][]float32,
+	gainQ16, out []float32,
+) {
+	// let n be the number of samples in a subframe
+	//
+	// https://www.rfc-editor.org/rfc/rfc6716.html#section-4.2.7.9
+	n := d.samplesInSubframe(bandwidth)
+
+	// let lpc[i] be the result of LPC synthesis from the last d_LPC samples of the
+	//  previous subframe or zeros in the first subframe for this channel
+	lpc := make([]float32, n*subframeCount)
+
+	// For unvoiced frames (see Section 4.2.7.3), the LPC residual for i
+	// such that j <= i < (j + n) is simply a normalized copy of the
+	// excitation signal, i.e.,
+	//
+	//               e_Q23[i]
+	//     res[i] = ---------
+	//               2.0**23
+	res := make([]float32, len(eQ23))
+	for i := range res {
+		res[i] = float32(eQ23[i]) / 8388608.0
+	}
+
+	// silk_decode_core() (decode_core.c) eases the transition from a
+	// concealed voiced frame to an unvoiced one by running the first half of
+	// the frame through a weak LTP filter at the pitch lag of the
+	// concealment. The LTP scaling of unvoiced frames is 0, so only the
+	// residual of the frame itself is predicted.
+	voicedSubframeCount := 0
+	if signalType == frameSignalTypeVoiced {
+		voicedSubframeCount = subframeCount
+	} else if d.concealment.lossCount != 0 && d.concealment.voiced {
+		voicedSubframeCount = maxSubframeCount / 2
+		pitchLags = make([]int, voicedSubframeCount)
+		bQ7 = make([][]int8, voicedSubframeCount)
+		for s := range pitchLags {
+			pitchLags[s] = d.pitchLag
+			bQ7[s] = []int8{0, 0, 32, 0, 0}
+		}
+
+		if lag := uint32(d.pitchLag); lag > lagMax {
+			lagMax = lag
+		}
+		ltpScaleQ14 = 0
+	}
+	resLag := make([]float32, int(lagMax)+2)
+
+	// subFrame be the index of the current subframe in this SILK frame
+	// (0 or 1 for 10 ms frames, or 0 to 3 for 20 ms frames)
+	for subFrame := 0; subFrame < subframeCount; subFrame++ {
+		// For 20 ms SILK frames, the first half of the frame (i.e., the first
+		// two subframes) may use normalized LSF coefficients that are
+		// interpolated between the decoded LSFs for the most recent coded frame
+		// (in the same channel) and the current frame
+		//
+		// https://datatracker.ietf.org/doc/html/rfc6716#section-4.2.7.5.5
+		aQ12Index := 0
+		if subFrame > 1 && len(aQ12) > 1 {
+			aQ12Index = 1
+		}
+
+		// j be the index of the first sample in the residual corresponding to
+		// the current subframe.
+		//
+		// https://www.rfc-editor.org/rfc/rfc6716.html#section-4.2.7.9
+		j := n * subFrame
+
+		// Voiced SILK frames, on the other hand, pass the excitation through an
+		// LTP filter using the parameters decoded in Section 4.2.7.6 to produce
+		// an LPC residual.
+		//
+		// https://www.rfc-editor.org/rfc/rfc6716.html#section-4.2.7.9.1
+		if subFrame < voicedSubframeCount {
+			d.ltpSynthesis(
+				out,
+				bQ7, pitchLags,
+				n, j, subFrame, dLPC,
+				ltpScaleQ14,
+				wQ2,
+				aQ12[aQ12Index], gainQ16, res, resLag,
+			)
+		}
+
+		// https://www.rfc-editor.org/rfc/rfc6716.html#section-4.2.7.9.2
+		d.lpcSynthesis(out[n*subFrame:], n, subFrame, dLPC, aQ12[aQ12Index], res, gainQ16, lpc)
+	}
+}
+
+// stereoPhaseOneSampleCount is the length of the interpolation of the
+// stereo prediction weights at the start of each frame
+//
+// https://datatracker.ietf.org/doc/html/rfc6716#section-4.2.8
+func (d *Decoder) stereoPhaseOneSampleCount(bandwidth Bandwidth) int {
+	switch bandwidth {
+	case BandwidthNarrowband:
+		return 64
+	case BandwidthMediumband:
+		return 96
+	case BandwidthWideband:
+		return 128
+	}
+
+	return 0
+}
+
+func (d *Decoder) delayMid(out []float32) {
+	if len(out) == 0 {
+		return
+	}
+
+	previousSample := d.previousMidValues[1]
+	previousMidValues := d.previousMidValues
+	if len(out) == 1 {
+		previousMidValues[0] = previousMidValues[1]
+		previousMidValues[1] = out[0]
+	} else {
+		previousMidValues[0] = out[len(out)-2]
+		previousMidValues[1] = out[len(out)-1]
+	}
+
+	for i := range out {
+		out[i], previousSample = previousSample, out[i]
+	}
+
+	d.previousMidValues = previousMidValues
+}
+
+// RFC 6716 Section 4.2.8 applies a one-sample delay to mono output so mono
+// to stereo transitions remain seamless.
+func (d *Decoder) delayMono(out []float32) {
+	d.delayMid(out)
+	d.previousSideValue = 0
+	d.wasStereo = false
+}
+
+// RFC 6716 Section 4.2.8 converts mid-side stereo to left-right stereo.
+func (d *Decoder) stereoUnmix(mid, side, out []float32, w0Q13, w1Q13 int32, bandwidth Bandwidth) {
+	phaseOneSampleCount := d.stereoPhaseOneSampleCount(bandwidth)
+	previousW0Q13 := d.previousStereoWeights[0]
+	previousW1Q13 := d.previousStereoWeights[1]
+	midPrev2 := d.previousMidValues[0]
+	midPrev1 := d.previousMidValues[1]
+	sidePrev := d.previousSideValue
+
+	for i := range mid {
+		interpSample := minInt(i, phaseOneSampleCount)
+
+		w0 := float32(previousW0Q13)/8192.0 +
+			float32(interpSample)*float32(w0Q13-previousW0Q13)/(8192.0*float32(phaseOneSampleCount))
+		w1 := float32(previousW1Q13)/8192.0 +
+			float32(interpSample)*float32(w1Q13-previousW1Q13)/(8192.0*float32(phaseOneSampleCount))
+		p0 := (midPrev2 + 2*midPrev1 + mid[i]) / 4.0
+
+		out[i*2] = clampNegativeOneToOne((1+w1)*midPrev1 + sidePrev + w0*p0)
+		out[i*2+1] = clampNegativeOneToOne((1-w1)*midPrev1 - sidePrev - w0*p0)
+
+		midPrev2 = midPrev1
+		midPrev1 = mid[i]
+		sidePrev = side[i]
+	}
+
+	d.previousStereoWeights[0] = w0Q13
+	d.previousStereoWeights[1] = w1Q13
+	d.previousMidValues[0] = midPrev2
+	d.previousMidValues[1] = midPrev1
+	d.previousSideValue = sidePrev
+	d.wasStereo = true
+}
+
+// decodeFrame decodes one SILK frame of a single channel, updating the
+// state later frames and concealment depend on.
+func (d *Decoder) decodeFrame(
+	out []float32,
+	voiceActivityDetected bool,
+	nanoseconds int,
+	bandwidth Bandwidth,
+	coding frameCoding,
+) {
+	d.resetPredictionForBandwidthChange(bandwidth)
+
+	subframeCount := subframeCount(nanoseconds)
+
+	signalType, quantizationOffsetType := d.determineFrameType(voiceActivityDetected)
+
+	// https://datatracker.ietf.org/doc/html/rfc6716#section-4.2.7.4
+	gainQ16 := d.decodeSubframeQuantizations(signalType, subframeCount, coding)
+
+	// https://datatracker.ietf.org/doc/html/rfc6716#section-4.2.7.5.1
+	I1 := d.decodeNormalizedLineSpectralFrequencyStageOne(signalType, bandwidth)
+
+	// https://datatracker.ietf.org/doc/html/rfc6716#section-4.2.7.5.2
+	resQ10 := d.decodeNormalizedLineSpectralFrequencyStageTwo(bandwidth, I1)
+	dLPC := len(resQ10)
+
+	// https://datatracker.ietf.org/doc/html/rfc6716#section-4.2.7.5.3
+	nlsfQ15 := d.normalizeLineSpectralFrequencyCoefficients(dLPC, bandwidth, resQ10, I1)
+
+	// https://datatracker.ietf.org/doc/html/rfc6716#section-4.2.7.5.4
+	d.normalizeLSFStabilization(nlsfQ15, dLPC, bandwidth)
+
+	// https://datatracker.ietf.org/doc/html/rfc6716#section-4.2.7.5.5
+	n1Q15, wQ2 := d.normalizeLSFInterpolation(nlsfQ15, nanoseconds)
+
+	// For 20 ms SILK frames, the first half of the frame (i.e., the first
+	// two subframes) may use normalized LSF coefficients that are
+	// interpolated between the decoded LSFs for the most recent coded frame
+	// (in the same channel) and the current frame
+	//
+	// https://datatracker.ietf.org/doc/html/rfc6716#section-4.2.7.5.5
+	aQ12 := d.generateAQ12(n1Q15, bandwidth, nil)
+	aQ12 = d.generateAQ12(nlsfQ15, bandwidth, aQ12)
+
+	// silk_decode_parameters() (decode_parameters.c) widens the bandwidth
+	// of the LPC filter of the first frame after a loss, so a concealed
+	// signal that drifted away from the encoder's does not ring.
+	if d.concealment.lossCount != 0 {
+		for _, a := range aQ12 {
+			expandLPCBandwidth(a, bandwidthExpansionAfterLoss)
+		}
+	}
+
+	// https://www.rfc-editor.org/rfc/rfc6716.html#section-4.2.7.6.1
+	lagMax, pitchLags := d.decodePitchLags(signalType, bandwidth, nanoseconds, coding)
+
+	// https://www.rfc-editor.org/rfc/rfc6716.html#section-4.2.7.6.2
+	bQ7 := d.decodeLTPFilterCoefficients(signalType, subframeCount)
+
+	// https://www.rfc-editor.org/rfc/rfc6716.html#section-4.2.7.6.3
+	ltpScaleQ14 := d.decodeLTPScalingParameter(signalType, coding)
+
+	// https://www.rfc-editor.org/rfc/rfc6716.html#section-4.2.7.7
+	lcgSeed := d.decodeLinearCongruentialGeneratorSeed()
+
+	// https://www.rfc-editor.org/rfc/rfc6716.html#section-4.2.7.8
+	shellblocks := d.decodeShellblocks(nanoseconds, bandwidth)
+
+	// https://www.rfc-editor.org/rfc/rfc6716.html#section-4.2.7.8.1
+	rateLevel := d.decodeRatelevel(signalType == frameSignalTypeVoiced)
+
+	// https://www.rfc-editor.org/rfc/rfc6716.html#section-4.2.7.8.2
+	pulsecounts, lsbcounts := d.decodePulseAndLSBCounts(shellblocks, rateLevel)
+
+	// https://www.rfc-editor.org/rfc/rfc6716.html#section-4.2.7.8.6
+	eQ23 := d.decodeExcitation(signalType, quantizationOffsetType, lcgSeed, pulsecounts, lsbcounts)
+
+	// https://www.rfc-editor.org/rfc/rfc6716.html#section-4.2.7.9
+	d.silkFrameReconstruction(
+		signalType, bandwidth,
+		subframeCount,
+		dLPC,
+		lagMax,
+		bQ7,
+		pitchLags,
+		eQ23,
+		ltpScaleQ14,
+		wQ2,
+		aQ12,
+		gainQ16, out,
+	)
+
+	d.updateConcealment(signalType, bandwidth, pitchLags, bQ7, ltpScaleQ14, aQ12[len(aQ12)-1], gainQ16, eQ23)
+
+	d.isPreviousFrameVoiced = signalType == frameSignalTypeVoiced
+	if d.isPreviousFrameVoiced {
+		d.pitchLag = pitchLags[subframeCount-1]
+	} else {
+		d.pitchLag = 0
+	}
+
+	// n0Q15 is the LSF coefficients decoded for the prior frame
+	// see normalizeLSFInterpolation
+	if len(d.n0Q15) != len(nlsfQ15) {
+		d.n0Q15 = make([]int16, len(nlsfQ15))
+	}
+	copy(d.n0Q15, nlsfQ15)
+
+	d.updateComfortNoise(signalType, nlsfQ15, gainQ16, eQ23)
+
+	d.saveFinalOutValues(out)
+	d.haveDecoded = true
+
+	d.glueFrames(out)
+}
+
+func (d *Decoder) saveFinalOutValues(out []float32) {
+	if len(out) >= len(d.finalOutValues) {
+		copy(d.finalOutValues, out[len(out)-len(d.finalOutValues):])
+
+		return
+	}
+
+	copy(d.finalOutValues, d.finalOutValues[len(out):])
+	copy(d.finalOutValues[len(d.finalOutValues)-len(out):], out)
+}
+
+// frameCodingFor returns how the frameIndex'th SILK frame of a channel is
+// coded, following silk_Decode() (dec_API.c). Regular frames depend on
+// the previous frame of the Opus frame, unless it was a skipped side
+// frame, and LBRR frames depend on the previous LBRR frame when it is
+// coded.
+func frameCodingFor(frameIndex int, lowBitrateRedundancyFlags []bool, decodeLowBitrateRedundancy, afterMidOnly bool) frameCoding {
+	switch {
+	case frameIndex == 0:
+		return frameCodingIndependent
+	case decodeLowBitrateRedundancy:
+		if lowBitrateRedundancyFlags[frameIndex-1] {
+			return frameCodingConditional
+		}
+
+		return frameCodingIndependent
+	case afterMidOnly:
+		return frameCodingIndependentWithoutLTPScaling
+	}
+
+	return frameCodingConditional
+}
+
+// startStereo resets the state of the side channel on transitions from mono
+// to stereo.
+//
+// https://datatracker.ietf.org/doc/html/rfc6716#section-4.2.7.1
+func (d *Decoder) startStereo() {
+	if d.wasStereo {
+		return
+	}
+
+	d.previousStereoWeights = [2]int32{}
+	d.previousSideValue = 0
+	d.sideDecoder = NewDecoder()
+	d.previousDecodeOnlyMid = false
+}
+
+// writeFrame writes one frame of decoded mid and side samples to out. Mono
+// streams, and stereo streams decoded to mono, are delayed by one sample
+// to match the delay of stereo unmixing.
+//
+// https://datatracker.ietf.org/doc/html/rfc6716#section-4.2.8
+func (d *Decoder) writeFrame(out, mid, side []float32, isStereo, outputStereo bool, w0Q13, w1Q13 int32, bandwidth Bandwidth) {
+	switch {
+	case isStereo && outputStereo:
+		d.stereoUnmix(mid, side, out, w0Q13, w1Q13, bandwidth)
+	case isStereo:
+		copy(out, mid)
+		d.delayMid(out)
+		d.previousStereoWeights = [2]int32{w0Q13, w1Q13}
+		d.wasStereo = true
+	default:
+		copy(out, mid)
+		d.delayMono(out)
+	}
+}
+
+// skipLowBitrateRedundancy advances over the LBRR frames of RFC 6716
+// Sections 4.2.4 and 4.2.5 so the regular SILK frames that follow them can
+// be decoded. They are parsed with a throwaway decoder, as they only
+// depend on each other.
+func (d *Decoder) skipLowBitrateRedundancy(
+	midFlags, sideFlags []bool,
+	isStereo bool,
+	nanoseconds int,
+	bandwidth Bandwidth,
+) {
+	discard := NewDecoder()
+	discard.sideDecoder = NewDecoder()
+	discard.rangeDecoder = d.rangeDecoder
+
+	frameSampleCount := d.samplesInSubframe(bandwidth) * subframeCount(nanoseconds)
+	scratch := make([]float32, frameSampleCount)
+	for i := range midFlags {
+		if midFlags[i] {
+			if isStereo {
+				discard.decodeStereoPredictionWeights()
+				if !sideFlags[i] {
+					discard.decodeMidOnlyFlag()
+				}
+			}
+			discard.decodeFrame(scratch, true, nanoseconds, bandwidth, frameCodingFor(i, midFlags, true, false))
+		}
+
+		if isStereo && sideFlags[i] {
+			discard.sideDecoder.rangeDecoder = discard.rangeDecoder
+			discard.sideDecoder.decodeFrame(scratch, true, nanoseconds, bandwidth, frameCodingFor(i, sideFlags, true, false))
+			discard.rangeDecoder = discard.sideDecoder.rangeDecoder
+		}
+	}
+
+	d.rangeDecoder = discard.rangeDecoder
+}
+
+// decodeFrames decodes the regular or the LBRR frames of an Opus frame.
+// LBRR frames that are not coded are concealed.
+//
+// https://datatracker.ietf.org/doc/html/rfc6716#section-4.2.1
+func (d *Decoder) decodeFrames(
+	out []float32,
+	isStereo bool,
+	outputStereo bool,
+	nanoseconds int,
+	bandwidth Bandwidth,
+	decodeLowBitrateRedundancy bool,
+) error {
+	frameCount := silkFrameCount(nanoseconds)
+	silkFrameNanoseconds := nanoseconds
+	if frameCount > 1 {
+		silkFrameNanoseconds = nanoseconds20Ms
+	}
+
+	frameSampleCount := d.samplesInSubframe(bandwidth) * subframeCount(silkFrameNanoseconds)
+	channelCount := 1
+	if isStereo && outputStereo {
+		channelCount = 2
+	}
+
+	switch {
+	case frameCount == 0:
+		return errUnsupportedSilkFrameDuration
+	case frameSampleCount == 0:
+		return errUnsupportedSilkBandwidth
+	case frameSampleCount*frameCount*channelCount > len(out):
+		return errOutBufferTooSmall
+	}
+
+	if isStereo {
+		d.startStereo()
+	}
+
+	// https://datatracker.ietf.org/doc/html/rfc6716#section-4.2.3
+	midVoiceActivityDetected, midLowBitrateRedundancy := d.decodeHeaderBits(frameCount)
+	sideVoiceActivityDetected, sideLowBitrateRedundancy := make([]bool, frameCount), false
+	if isStereo {
+		sideVoiceActivityDetected, sideLowBitrateRedundancy = d.decodeHeaderBits(frameCount)
+	}
+
+	// https://datatracker.ietf.org/doc/html/rfc6716#section-4.2.4
+	midLowBitrateRedundancyFlags := d.decodeLowBitrateRedundancyFlags(frameCount, midLowBitrateRedundancy)
+	sideLowBitrateRedundancyFlags := d.decodeLowBitrateRedundancyFlags(frameCount, false)
+	if isStereo {
+		sideLowBitrateRedundancyFlags = d.decodeLowBitrateRedundancyFlags(frameCount, sideLowBitrateRedundancy)
+	}
+
+	// https://datatracker.ietf.org/doc/html/rfc6716#section-4.2.5
+	if !decodeLowBitrateRedundancy {
+		d.skipLowBitrateRedundancy(midLowBitrateRedundancyFlags, sideLowBitrateRedundancyFlags, isStereo, silkFrameNanoseconds, bandwidth)
+	}
+
+	mid := make([]float32, frameSampleCount)
+	side := make([]float32, frameSampleCount)
+	for i := 0; i < frameCount; i++ {
+		midCoded, sideCoded := true, true
+		midVoiceActivityDetected, sideVoiceActivityDetected := midVoiceActivityDetected[i], sideVoiceActivityDetected[i]
+		if decodeLowBitrateRedundancy {
+			midCoded, sideCoded = midLowBitrateRedundancyFlags[i], sideLowBitrateRedundancyFlags[i]
+			midVoiceActivityDetected, sideVoiceActivityDetected = true, true
+		}
+
+		// The stereo prediction weights of LBRR frames that are not coded
+		// are those of the previous frame.
+		//
+		// https://datatracker.ietf.org/doc/html/rfc6716#section-4.2.7.1
+		w0Q13, w1Q13 := d.previousStereoWeights[0], d.previousStereoWeights[1]
+		midOnly := false
+		if isStereo && midCoded {
+			w0Q13, w1Q13 = d.decodeStereoPredictionWeights()
+
+			// https://datatracker.ietf.org/doc/html/rfc6716#section-4.2.7.2
+			if (!decodeLowBitrateRedundancy && !sideVoiceActivityDetected) || (decodeLowBitrateRedundancy && !sideCoded) {
+				midOnly = d.decodeMidOnlyFlag()
+			}
+		}
+
+		// RFC 6716 Sections 4.2.7.2, 4.2.7.4, and 4.2.7.6.1 restart side
+		// prediction when the previous side frame was not coded.
+		if isStereo && !midOnly && d.previousDecodeOnlyMid {
+			d.resetSideDecoderPrediction()
+		}
+
+		midCoding := frameCodingFor(i, midLowBitrateRedundancyFlags, decodeLowBitrateRedundancy, false)
+		if midCoded {
+			d.decodeFrame(mid, midVoiceActivityDetected, silkFrameNanoseconds, bandwidth, midCoding)
+		} else {
+			d.concealFrame(mid, silkFrameNanoseconds)
+		}
+
+		// silk_Decode() (dec_API.c) also conceals the side channel of LBRR
+		// frames when the side channel of the frame before was coded.
+		hasSide := !midOnly
+		if decodeLowBitrateRedundancy {
+			hasSide = !d.previousDecodeOnlyMid || sideCoded
+		}
+
+		for j := range side {
+			side[j] = 0
+		}
+		if isStereo && hasSide {
+			sideCoding := frameCodingFor(i, sideLowBitrateRedundancyFlags, decodeLowBitrateRedundancy, d.previousDecodeOnlyMid)
+			if sideCoded {
+				d.sideDecoder.rangeDecoder = d.rangeDecoder
+				d.sideDecoder.decodeFrame(side, sideVoiceActivityDetected, silkFrameNanoseconds, bandwidth, sideCoding)
+				d.rangeDecoder = d.sideDecoder.rangeDecoder
+			} else {
+				d.sideDecoder.concealFrame(side, silkFrameNanoseconds)
+			}
+		}
+
+		d.writeFrame(out[i*frameSampleCount*channelCount:(i+1)*frameSampleCount*channelCount], mid, side, isStereo, outputStereo, w0Q13, w1Q13, bandwidth)
+		d.previousDecodeOnlyMid = midOnly
+	}
+
+	return d.rangeDecoder.ErrZeroPadded()
+}
+
+// Decode decodes a SILK-only Opus frame of mono or stereo audio. Stereo
+// frames are written to out interleaved.
+//
+// An overview of the decoder is given in Figure 14.
+//
+//	   +---------+    +------------+
+//	-->| Range   |--->| Decode     |---------------------------+
+//	 1 | Decoder | 2  | Parameters |----------+       5        |
+//	   +---------+    +------------+     4    |                |
+//	                       3 |                |                |
+//	                        \/               \/               \/
+//	                  +------------+   +------------+   +------------+
+//	                  | Generate   |-->| LTP        |-->| LPC        |
+//	                  | Excitation |   | Synthesis  |   | Synthesis  |
+//	                  +------------+   +------------+   +------------+
+//	                                          ^                |
+//	                                          |                |
+//	                      +-------------------+----------------+
+//	                      |                                      6
+//	                      |   +------------+   +-------------+
+//	                      +-->| Stereo     |-->| Sample Rate |-->
+//	                          | Unmixing   | 7 | Conversion  | 8
+//	                          +------------+   +-------------+
+//
+//	1: Range encoded bitstream
+//	2: Coded parameters
+//	3: Pulses, LSBs, and signs
+//	4: Pitch lags, Long-Term Prediction (LTP) coefficients
+//	5: Linear Predictive Coding (LPC) coefficients and gains
+//	6: Decoded signal (mono or mid-side stereo)
+//	7: Unmixed signal (mono or left-right stereo)
+//	8: Resampled signal
+//
+// https://datatracker.ietf.org/doc/html/rfc6716#section-4.2.1
+func (d *Decoder) Decode(in []byte, out []float32, isStereo bool, nanoseconds int, bandwidth Bandwidth) error {
+	d.initialize()
+	d.rangeDecoder.Init(in)
+
+	return d.decodeFrames(out, isStereo, isStereo, nanoseconds, bandwidth, false)
+}
+
+// DecodeWithRange decodes the SILK frames of an Opus frame from a range
+// decoder shared with the CELT layer, as hybrid frames require. Stereo
+// frames are downmixed to their mid channel unless outputChannelCount is
+// 2.
+func (d *Decoder) DecodeWithRange(
+	rangeDecoder *rangecoding.Decoder,
+	out []float32,
+	isStereo bool,
+	outputChannelCount int,
+	nanoseconds int,
+	bandwidth Bandwidth,
+) error {
+	d.initialize()
+	d.rangeDecoder = *rangeDecoder
+	err := d.decodeFrames(out, isStereo, outputChannelCount == 2, nanoseconds, bandwidth, false)
+	*rangeDecoder = d.rangeDecoder
+
+	return err
+}
+
+// DecodeLowBitrateRedundancy decodes the LBRR frames of an Opus frame, the
+// redundant lower bitrate copy of the previous Opus frame that is used for
+// forward error correction (FEC) when it was lost. Frames without LBRR data
+// are concealed.
+//
+// https://datatracker.ietf.org/doc/html/rfc6716#section-4.2.5
+func (d *Decoder) DecodeLowBitrateRedundancy(
+	rangeDecoder *rangecoding.Decoder,
+	out []float32,
+	isStereo bool,
+	outputChannelCount int,
+	nanoseconds int,
+	bandwidth Bandwidth,
+) error {
+	d.initialize()
+	d.rangeDecoder = *rangeDecoder
+	err := d.decodeFrames(out, isStereo, outputChannelCount == 2, nanoseconds, bandwidth, true)
+	*rangeDecoder = d.rangeDecoder
+
+	return err
+}
+
+// Conceal extrapolates nanoseconds of audio from the frames decoded before,
+// for an Opus frame that was lost.
+func (d *Decoder) Conceal(out []float32, outputChannelCount int, nanoseconds int) error {
+	d.initialize()
+
+	bandwidth := d.previousBandwidth
+	if bandwidth == 0 {
+		bandwidth = BandwidthNarrowband
+	}
+
+	// The reference decoder conceals frames of 10 ms and 20 ms with a
+	// single SILK frame, and longer ones with 20 ms frames
+	frameCount := silkFrameCount(nanoseconds)
+	silkFrameNanoseconds := nanoseconds
+	if frameCount > 1 {
+		silkFrameNanoseconds = nanoseconds20Ms
+	}
+
+	isStereo := d.wasStereo
+	frameSampleCount := d.samplesInSubframe(bandwidth) * subframeCount(silkFrameNanoseconds)
+	channelCount := 1
+	if isStereo && outputChannelCount == 2 {
+		channelCount = 2
+	}
+
+	switch {
+	case frameCount == 0:
+		return errUnsupportedSilkFrameDuration
+	case frameSampleCount*frameCount*channelCount > len(out):
+		return errOutBufferTooSmall
+	}
+
+	mid := make([]float32, frameSampleCount)
+	side := make([]float32, frameSampleCount)
+	for i := 0; i < frameCount; i++ {
+		d.concealFrame(mid, silkFrameNanoseconds)
+
+		for j := range side {
+			side[j] = 0
+		}
+		if isStereo && !d.previousDecodeOnlyMid {
+			d.sideDecoder.concealFrame(side, silkFrameNanoseconds)
+		}
+
+		d.writeFrame(out[i*frameSampleCount*channelCount:(i+1)*frameSampleCount*channelCount], mid, side, isStereo, outputChannelCount == 2, d.previousStereoWeights[0], d.previousStereoWeights[1], bandwidth)
+		d.previousDecodeOnlyMid = false
+	}
+
+	// silk_Decode() (dec_API.c) no longer limits how much the gain of the
+	// next frame may drop, so it does not bounce back after the loss
+	d.previousLogGain = 10
+	if d.sideDecoder != nil {
+		d.sideDecoder.previousLogGain = 10
+	}
+
+	return nil
+}
+
+// WasStereo returns whether the last frame decoded was stereo, which
+// Conceal continues
+func (d *Decoder) WasStereo() bool {
+	return d.wasStereo
+}
+
+// PreviousPitchLag returns the pitch lag of the last decoded or concealed
+// subframe at 48 kHz, or 0 if the last decoded frame was not voiced
+func (d *Decoder) PreviousPitchLag() int {
+	if !d.isPreviousFrameVoiced || d.previousBandwidth == 0 {
+		return 0
+	}
+
+	// 48 kHz is 6, 4, and 3 times the NB, MB, and WB internal sample rates
+	return d.pitchLag * 240 / d.samplesInSubframe(d.previousBandwidth)
+}
+
+// FinalRange returns the state of the range decoder after the last frame
+// decoded. It matches the encoder's when the frame was decoded
+// bit-exactly.
+func (d *Decoder) FinalRange() uint32 {
+	return d.rangeDecoder.FinalRange()
 }
@@ -1,23 +1,288 @@
 package silk
 
 import (
+	"encoding/binary"
+	"errors"
+	"math"
+	"os"
+	"path/filepath"
 	"testing"
+
+	"github.com/pion/opus/internal/rangecoding"
 )
 
 func TestDecodeSubframeQuantizations(t *testing.T) {
-	d := &Decoder{}
-	if _, err := d.Decode([]byte{0x0B, 0xE4, 0xC1, 0x36, 0xEC, 0xC5, 0x80}, false, nanoseconds20Ms, BandwidthNarrowband); err != nil {
-		t.Fatal(err)
-	}
+	d := NewDecoder()
+	d.rangeDecoder.Init([]byte{0x0B, 0xE4, 0xC1, 0x36, 0xEC, 0xC5, 0x80})
+
+	voiceActivityDetected, _ := d.decodeHeaderBits(1)
+	signalType, _ := d.determineFrameType(voiceActivityDetected[0])
+	gainQ16 := d.decodeSubframeQuantizations(signalType, maxSubframeCount, frameCodingIndependent)
 
 	switch {
-	case d.subframeState[0].gain != 3.21875:
+	case gainQ16[0] != 3.21875*65536:
 		t.Fatal()
-	case d.subframeState[1].gain != 1.71875:
+	case gainQ16[1] != 1.71875*65536:
 		t.Fatal()
-	case d.subframeState[2].gain != 1.46875:
+	case gainQ16[2] != 1.46875*65536:
 		t.Fatal()
-	case d.subframeState[3].gain != 1.46875:
+	case gainQ16[3] != 1.46875*65536:
 		t.Fatal()
 	}
 }
+
+func TestDecodeStrippedFrame(t *testing.T) {
+	// The encoder strips all trailing zero bytes, which decode the same as
+	// the zeros they were
+	padded, stripped := make([]float32, 160), make([]float32, 160)
+	if err := NewDecoder().Decode(append([]byte{0x0B, 0xE4}, make([]byte, 40)...), padded, false, nanoseconds20Ms, BandwidthNarrowband); err != nil {
+		t.Fatal(err)
+	}
+	if err := NewDecoder().Decode([]byte{0x0B, 0xE4}, stripped, false, nanoseconds20Ms, BandwidthNarrowband); err != nil {
+		t.Fatal(err)
+	}
+
+	for i := range padded {
+		if stripped[i] != padded[i] {
+			t.Fatalf("sample %d: %f, expected %f", i, stripped[i], padded[i])
+		}
+	}
+}
+
+func newTestDecoder(t *testing.T, encode func(e *rangecoding.Encoder)) *Decoder {
+	t.Helper()
+
+	e := &rangecoding.Encoder{}
+	e.Init(make([]byte, 64))
+	encode(e)
+
+	data, err := e.Done()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	d := &Decoder{}
+	d.rangeDecoder.Init(data)
+	return d
+}
+
+func TestDetermineFrameType(t *testing.T) {
+	for _, test := range []struct {
+		voiceActivityDetected  bool
+		symbol                 uint32
+		signalType             frameSignalType
+		quantizationOffsetType frameQuantizationOffsetType
+	}{
+		{false, 0, frameSignalTypeInactive, frameQuantizationOffsetTypeLow},
+		{false, 1, frameSignalTypeInactive, frameQuantizationOffsetTypeHigh},
+		// The PDF of frames with voice activity starts at frame type 2
+		{true, 0, frameSignalTypeUnvoiced, frameQuantizationOffsetTypeLow},
+		{true, 1, frameSignalTypeUnvoiced, frameQuantizationOffsetTypeHigh},
+		{true, 2, frameSignalTypeVoiced, frameQuantizationOffsetTypeLow},
+		{true, 3, frameSignalTypeVoiced, frameQuantizationOffsetTypeHigh},
+	} {
+		icdf := icdfFrameTypeVADInactive
+		if test.voiceActivityDetected {
+			icdf = icdfFrameTypeVADActive
+		}
+
+		d := newTestDecoder(t, func(e *rangecoding.Encoder) {
+			e.EncodeSymbolWithICDF(icdf, test.symbol)
+		})
+
+		signalType, quantizationOffsetType := d.determineFrameType(test.voiceActivityDetected)
+		if signalType != test.signalType || quantizationOffsetType != test.quantizationOffsetType {
+			t.Fatalf("VAD %t symbol %d: got %d/%d, want %d/%d", test.voiceActivityDetected, test.symbol, signalType, quantizationOffsetType, test.signalType, test.quantizationOffsetType)
+		}
+	}
+}
+
+func TestDecodeNormalizedLineSpectralFrequencyStageOne(t *testing.T) {
+	// The PDF is chosen by signal type, so unvoiced frames with voice
+	// activity use the unvoiced PDF
+	for _, test := range []struct {
+		signalType frameSignalType
+		bandwidth  Bandwidth
+		icdf       []uint
+	}{
+		{frameSignalTypeInactive, BandwidthNarrowband, icdfNormalizedLSFStageOneIndexNarrowbandOrMediumbandUnvoiced},
+		{frameSignalTypeUnvoiced, BandwidthMediumband, icdfNormalizedLSFStageOneIndexNarrowbandOrMediumbandUnvoiced},
+		{frameSignalTypeVoiced, BandwidthNarrowband, icdfNormalizedLSFStageOneIndexNarrowbandOrMediumbandVoiced},
+		{frameSignalTypeUnvoiced, BandwidthWideband, icdfNormalizedLSFStageOneIndexWidebandUnvoiced},
+		{frameSignalTypeVoiced, BandwidthWideband, icdfNormalizedLSFStageOneIndexWidebandVoiced},
+	} {
+		for _, I1 := range []uint32{0, 9, 31} {
+			d := newTestDecoder(t, func(e *rangecoding.Encoder) {
+				e.EncodeSymbolWithICDF(test.icdf, I1)
+			})
+
+			if got := d.decodeNormalizedLineSpectralFrequencyStageOne(test.signalType, test.bandwidth); got != I1 {
+				t.Fatalf("signal type %d bandwidth %d: got I1 %d, want %d", test.signalType, test.bandwidth, got, I1)
+			}
+		}
+	}
+}
+
+func TestDecodeNormalizedLineSpectralFrequencyStageTwo(t *testing.T) {
+	for _, bandwidth := range []Bandwidth{BandwidthNarrowband, BandwidthWideband} {
+		const I1 = 3
+		codebook := codebookNormalizedLSFStageTwoIndex(bandwidth)
+		dLPC := len(codebook[I1])
+
+		// Every index is zero but the last one, which is 1
+		d := newTestDecoder(t, func(e *rangecoding.Encoder) {
+			for k := 0; k < dLPC; k++ {
+				symbol := uint32(4)
+				if k == dLPC-1 {
+					symbol = 5
+				}
+				e.EncodeSymbolWithICDF(icdfNormalizedLSFStageTwoIndex[codebook[I1][k]], symbol)
+			}
+		})
+
+		resQ10 := d.decodeNormalizedLineSpectralFrequencyStageTwo(bandwidth, I1)
+		if len(resQ10) != dLPC {
+			t.Fatalf("bandwidth %d: got %d coefficients, want %d", bandwidth, len(resQ10), dLPC)
+		}
+
+		// The last coefficient has no prediction, and the others are
+		// predicted backwards from it
+		qstep := normalizedLSFQuantizationStep(bandwidth)
+		if want := dequantizeNormalizedLSFResidual(1, qstep); int(resQ10[dLPC-1]) != want || want == 0 {
+			t.Fatalf("bandwidth %d: got last residual %d, want %d", bandwidth, resQ10[dLPC-1], want)
+		}
+		for k := dLPC - 2; k >= 0; k-- {
+			if want := predictNormalizedLSFResidual(bandwidth, I1, resQ10, k); int(resQ10[k]) != want {
+				t.Fatalf("bandwidth %d: got residual %d for coefficient %d, want %d", bandwidth, resQ10[k], k, want)
+			}
+		}
+	}
+}
+
+func TestConceal(t *testing.T) {
+	d := &Decoder{}
+
+	out := []float32{1, 1, 1, 1}
+	if err := d.Conceal(out, 1, nanoseconds10Ms); !errors.Is(err, errOutBufferTooSmall) {
+		t.Fatal(err)
+	}
+
+	// Nothing was decoded yet, so there is nothing to extrapolate from
+	out = make([]float32, 80)
+	for i := range out {
+		out[i] = 1
+	}
+	if err := d.Conceal(out, 1, nanoseconds10Ms); err != nil {
+		t.Fatal(err)
+	}
+	for _, v := range out {
+		if v != 0 {
+			t.Fatal(out)
+		}
+	}
+
+	if err := d.Conceal(out, 1, nanoseconds20Ms/4); !errors.Is(err, errUnsupportedSilkFrameDuration) {
+		t.Fatal(err)
+	}
+}
+
+// The vectors in testdata are SILK-only packets that libopus 1.4 encoded
+// and decoded, written by testdata/generate.c, which documents how they
+// are generated and their format. Each record is a packet decoded
+// normally, or with FEC for the packet lost before it, or a lost packet
+// concealed.
+const (
+	vectorFrameDecoded = iota
+	vectorFrameLowBitrateRedundancy
+	vectorFrameConcealed
+)
+
+func TestDecodeReferenceVectors(t *testing.T) {
+	paths, err := filepath.Glob("testdata/*.bin")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(paths) == 0 {
+		t.Skip("no vectors in testdata, see testdata/generate.c to generate them")
+	}
+
+	// The minimal signal to noise ratio in dB of each kind of frame. The
+	// output is float, so it doesn't match the fixed-point reference
+	// exactly.
+	minSNR := [3]float64{45, 30, 35}
+
+	for _, path := range paths {
+		path := path
+		t.Run(filepath.Base(path), func(t *testing.T) {
+			data, err := os.ReadFile(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			d := NewDecoder()
+			var signal, noise [3]float64
+			var bandwidth Bandwidth
+			var nanoseconds, channelCount int
+			for record := 0; len(data) > 0; record++ {
+				if len(data) < 7 {
+					t.Fatalf("record %d is truncated", record)
+				}
+				kind := data[0]
+				finalRange := binary.LittleEndian.Uint32(data[1:])
+				packetLength := int(binary.LittleEndian.Uint16(data[5:]))
+				packet := data[7 : 7+packetLength]
+				data = data[7+packetLength:]
+
+				// The TOC byte of a SILK-only packet of one frame. Concealed
+				// records are as long as the packets before them.
+				if packetLength > 0 {
+					configuration := int(packet[0] >> 3)
+					bandwidth = Bandwidth(configuration/4 + 1)
+					nanoseconds = []int{nanoseconds10Ms, nanoseconds20Ms, nanoseconds40Ms, nanoseconds60Ms}[configuration%4]
+					channelCount = 1
+					if packet[0]&0b100 != 0 {
+						channelCount = 2
+					}
+				}
+				sampleRate := []int{8000, 12000, 16000}[bandwidth-1]
+				sampleCount := sampleRate / 1000 * nanoseconds / 1000000 * channelCount
+				reference := data[:2*sampleCount]
+				data = data[2*sampleCount:]
+
+				out := make([]float32, sampleCount)
+				switch kind {
+				case vectorFrameDecoded:
+					err = d.Decode(packet[1:], out, channelCount == 2, nanoseconds, bandwidth)
+				case vectorFrameLowBitrateRedundancy:
+					rangeDecoder := rangecoding.Decoder{}
+					rangeDecoder.Init(packet[1:])
+					err = d.DecodeLowBitrateRedundancy(&rangeDecoder, out, channelCount == 2, channelCount, nanoseconds, bandwidth)
+				case vectorFrameConcealed:
+					err = d.Conceal(out, channelCount, nanoseconds)
+				}
+				switch {
+				case err != nil:
+					t.Fatalf("record %d: %v", record, err)
+				case kind != vectorFrameConcealed && d.FinalRange() != finalRange:
+					t.Fatalf("record %d: final range %08x, expected %08x", record, d.FinalRange(), finalRange)
+				}
+
+				for i := range out {
+					expected := float64(int16(binary.LittleEndian.Uint16(reference[2*i:]))) / 32768
+					signal[kind] += expected * expected
+					noise[kind] += (expected - float64(out[i])) * (expected - float64(out[i]))
+				}
+			}
+
+			for kind := range signal {
+				if signal[kind] == 0 {
+					continue
+				}
+
+				if snr := 10 * math.Log10(signal[kind]/noise[kind]); snr < minSNR[kind] {
+					t.Fatalf("frames of kind %d have an SNR of %.1f dB, want at least %.0f dB", kind, snr, minSNR[kind])
+				}
+			}
+		})
+	}
+}
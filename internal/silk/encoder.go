@@ -0,0 +1,1492 @@
+package silk
+
+import (
+	"math"
+	"math/bits"
+	"sort"
+
+	"github.com/pion/opus/internal/rangecoding"
+)
+
+const (
+	// An Opus frame is at most 1275 bytes
+	maxFrameSize = 1275
+
+	// silk_gains_quant() (gain_quant.c) quantizes gains to 64 levels
+	// between 2 and 88 dB. The offset and scale map the log2 of a Q16
+	// gain to a level, and are the inverse of those silk_gains_dequant()
+	// uses.
+	quantizationGainLevels = 64
+	quantizationGainOffset = 2090
+	quantizationGainScale  = 2251
+
+	// Delta gain indices range from 0 to 40
+	deltaGainIndexCount = 41
+
+	// The bitrate of an Encoder that SetBitrate wasn't called on
+	defaultBitrate = 24000
+
+	// The excitation is coded with at most maxExcitationMagnitude pulses
+	// per sample, so that a shell block never needs more than 10 LSBs
+	maxExcitationMagnitude = 1023
+
+	// Rate control searches the excitation level, the log2 of the RMS of
+	// the excitation in quantization steps, between minExcitationLevel
+	// and maxExcitationLevel in steps of 1/excitationLevelResolution. The
+	// RMS is that of the residual of the analyzed filters, and the
+	// quantized filters can predict much worse, so levels down to
+	// lowestExcitationLevel are tried for frames that don't fit.
+	minExcitationLevel        = -3
+	maxExcitationLevel        = 9
+	lowestExcitationLevel     = -24
+	excitationLevelResolution = 4
+
+	// Like silk_control_SNR() (control_SNR.c), frames without voice
+	// activity are coded with a fraction of the bits
+	inactiveBitrateFraction = 0.5
+
+	// LBRR frames are coded with gains lowBitrateRedundancyGainIncrease
+	// levels above those of the regular frame, fewer for higher packet
+	// loss, like LBRR_GainIncreases of silk_setup_LBRR() (control_codec.c).
+	// A level is 86/63 dB, about 0.227 bits of excitation level.
+	lowBitrateRedundancyGainIncrease    = 7
+	minLowBitrateRedundancyGainIncrease = 2
+	gainLevelBits                       = 86.0 / 63 / 6.0206
+
+	// The LTP scaling of independently coded voiced frames drops as the
+	// expected packet loss of the frames in a packet rises past these
+	// percentages, so that the decoder recovers sooner from a loss
+	ltpScaleLossThreshold1 = 10
+	ltpScaleLossThreshold2 = 25
+)
+
+// The stage-1 NLSF vectors searched at complexities 0 to 9, of the 32 of
+// each codebook
+var normalizedLSFSurvivorsByComplexity = []int{2, 2, 4, 4, 6, 6, 8, 8, 16, 16}
+
+// The fraction of the bits left that each frame of a packet of one, two
+// or three frames may take, like silk_Encode() (enc_API.c)
+var frameShares = [3][3][2]int{
+	{{1, 1}},
+	{{3, 5}, {1, 1}},
+	{{2, 5}, {3, 4}, {1, 1}},
+}
+
+// Encoder maintains the state needed to encode a stream
+// of Silk frames. The zero value is ready to use.
+type Encoder struct {
+	rangeEncoder rangecoding.Encoder
+
+	// The side channel of a stereo stream is coded with its own analysis
+	// and prediction state
+	sideEncoder *Encoder
+
+	// Target bitrate in bits per second, whether LBRR frames are coded,
+	// the expected packet loss, and how many stage-1 NLSF vectors are
+	// searched, zero for all of them
+	bitrate                int
+	lowBitrateRedundancy   bool
+	packetLossPercentage   int
+	normalizedLSFSurvivors int
+
+	// The stereo prediction weights of the last frame, the last mid
+	// sample of the previous Opus frame and whether it was stereo
+	previousStereoWeights stereoWeights
+	previousMid           float32
+	wasStereo             bool
+
+	// Did any frame of the last Opus frame have voice activity?
+	voiceActivityDetected bool
+
+	// Have we encoded a frame yet?
+	haveEncoded bool
+
+	// Background noise energy, estimated by the VAD
+	noiseEnergy float64
+
+	// The input that precedes the current frame, for pitch and LPC
+	// analysis to look back into, and the bandwidth it was coded at
+	history          []float32
+	historyBandwidth Bandwidth
+
+	// decoder follows the state of a Decoder that received every frame,
+	// so that frames are quantized against what the decoder reconstructs
+	decoder Decoder
+
+	// Counts the frames encoded, for the excitation seed
+	frameCounter uint32
+
+	// The LBRR frames of the previous Opus frame, coded in the next one
+	// when it has the same duration, bandwidth and channels. Frames
+	// without LBRR are nil. Stereo LBRR frames keep the prediction
+	// weights of the frames they copy.
+	lowBitrateRedundancyFrames        []*encodedFrame
+	lowBitrateRedundancyNanoseconds   int
+	lowBitrateRedundancyBandwidth     Bandwidth
+	lowBitrateRedundancyStereo        bool
+	lowBitrateRedundancyStereoWeights []stereoWeights
+}
+
+// encodedFrame holds the parameters of a SILK frame, as the encoder
+// analyzed and quantized them
+type encodedFrame struct {
+	voiceActivityDetected  bool
+	signalType             frameSignalType
+	quantizationOffsetType frameQuantizationOffsetType
+	coding                 frameCoding
+
+	// The gain symbols: the independent gain index of the first subframe
+	// unless coding is conditional, followed by delta gain indices. logGain
+	// is the log gain of the last subframe.
+	gainIndices []uint32
+	logGain     int32
+
+	// Normalized LSF indices, and the LPC filter they give
+	stageOneIndex   uint32
+	stageTwoIndices []int8
+	aQ12            []float32
+
+	// Pitch lags and LTP filters, only for voiced frames
+	lagAbsolute      bool
+	primaryLag       int
+	contourIndex     uint32
+	pitchLags        []int
+	periodicityIndex uint32
+	filterIndices    []uint32
+	ltpScaleIndex    uint32
+
+	seed uint32
+	eRaw []int32
+
+	// The input samples and the RMS of their LPC and LTP residual in each
+	// subframe, and of their LPC residual alone for voiced frames
+	samples        []float32
+	residualRMS    []float64
+	lpcResidualRMS []float64
+
+	// The energy of the difference between the samples and their
+	// reconstruction
+	distortion float64
+}
+
+// NewEncoder creates a new Silk Encoder
+func NewEncoder() *Encoder {
+	return &Encoder{}
+}
+
+// Reset discards all state carried between frames, as if the Encoder was
+// just created, like the decoder does after CELT-only frames. The
+// settings are kept.
+func (e *Encoder) Reset() {
+	*e = Encoder{
+		bitrate:                e.bitrate,
+		lowBitrateRedundancy:   e.lowBitrateRedundancy,
+		packetLossPercentage:   e.packetLossPercentage,
+		normalizedLSFSurvivors: e.normalizedLSFSurvivors,
+	}
+}
+
+// SetBitrate sets the bitrate, in bits per second, the SILK frames are
+// coded at
+func (e *Encoder) SetBitrate(bitrate int) {
+	e.bitrate = bitrate
+}
+
+// SetLowBitrateRedundancy enables coding a low bit-rate redundant copy of
+// each frame with voice activity into the next Opus frame, the in-band FEC
+// of RFC 6716 Section 4.2.4
+func (e *Encoder) SetLowBitrateRedundancy(enabled bool) {
+	e.lowBitrateRedundancy = enabled
+	if !enabled {
+		e.lowBitrateRedundancyFrames = nil
+	}
+	if e.sideEncoder != nil {
+		e.sideEncoder.SetLowBitrateRedundancy(enabled)
+	}
+}
+
+// SetPacketLossPercentage sets the expected packet loss, from 0 to 100
+// percent. Higher loss lowers the LTP scaling of independently coded
+// frames, and raises the quality of LBRR frames.
+func (e *Encoder) SetPacketLossPercentage(percentage int) {
+	e.packetLossPercentage = percentage
+	if e.sideEncoder != nil {
+		e.sideEncoder.packetLossPercentage = percentage
+	}
+}
+
+// SetComplexity sets the complexity, from 0 to 10. Lower complexities
+// search fewer stage-1 NLSF vectors, like the NLSF_MSVQ_Survivors of
+// silk_setup_complexity() (control_codec.c), and 10 searches all of them.
+func (e *Encoder) SetComplexity(complexity int) {
+	e.normalizedLSFSurvivors = 0
+	if complexity >= 0 && complexity < len(normalizedLSFSurvivorsByComplexity) {
+		e.normalizedLSFSurvivors = normalizedLSFSurvivorsByComplexity[complexity]
+	}
+	if e.sideEncoder != nil {
+		e.sideEncoder.normalizedLSFSurvivors = e.normalizedLSFSurvivors
+	}
+}
+
+// startStereo starts the side channel over on a switch from mono to
+// stereo, like the decoder does
+//
+// https://datatracker.ietf.org/doc/html/rfc6716#section-4.2.7.1
+func (e *Encoder) startStereo() {
+	e.previousStereoWeights = stereoWeights{}
+	e.sideEncoder = &Encoder{
+		lowBitrateRedundancy:   e.lowBitrateRedundancy,
+		packetLossPercentage:   e.packetLossPercentage,
+		normalizedLSFSurvivors: e.normalizedLSFSurvivors,
+	}
+}
+
+// Encode encodes an Opus frame of 10, 20, 40 or 60 ms of mono or
+// interleaved stereo samples, in the range [-1, 1] and at the internal
+// sample rate of bandwidth: 8 kHz for NB, 12 kHz for MB and 16 kHz for
+// WB. 40 and 60 ms Opus frames hold two and three 20 ms SILK frames.
+//
+// Each SILK frame is analyzed for voice activity, its spectral envelope
+// and its pitch, and its parameters are quantized:
+//
+//  1. The LPC filter, as normalized LSFs
+//  2. For voiced frames, the pitch lags and the 5-tap LTP filters
+//  3. The gain of each subframe, from the energy of the LPC and LTP
+//     residual
+//  4. The excitation, in closed loop against the state of the decoder, so
+//     that the decoded frame follows the input
+//
+// The gains are searched for the frame to fit the bitrate. The encoder
+// doesn't shape the quantization noise like the reference encoder does,
+// so the noise is white. Stereo is coded as a mid channel, and the
+// residual of the side channel predicted from it.
+//
+// https://datatracker.ietf.org/doc/html/rfc6716#section-5.2
+func (e *Encoder) Encode(in []float32, isStereo bool, nanoseconds int, bandwidth Bandwidth) ([]byte, error) {
+	e.rangeEncoder.Init(make([]byte, maxFrameSize))
+	if err := e.encodeFrames(in, isStereo, nanoseconds, bandwidth, 8*maxFrameSize); err != nil {
+		return nil, err
+	}
+
+	// The frame is as long as the bits the decoder needs to read
+	size := (e.rangeEncoder.Tell() + 7) / 8
+	out, err := e.rangeEncoder.Done()
+	if err != nil {
+		return nil, err
+	}
+	return out[:size], nil
+}
+
+// EncodeWithRange encodes the SILK frames of an Opus frame with a range
+// encoder shared with the CELT layer, as hybrid frames require. The
+// frames are coded in at most maxBits bits, and the caller finishes the
+// range encoder.
+func (e *Encoder) EncodeWithRange(
+	rangeEncoder *rangecoding.Encoder,
+	in []float32,
+	isStereo bool,
+	nanoseconds int,
+	bandwidth Bandwidth,
+	maxBits int,
+) error {
+	e.rangeEncoder = *rangeEncoder
+	err := e.encodeFrames(in, isStereo, nanoseconds, bandwidth, maxBits)
+	*rangeEncoder = e.rangeEncoder
+
+	return err
+}
+
+// encodeFrames analyzes and codes the SILK frames of an Opus frame into
+// e.rangeEncoder, in the order decodeFrames reads them
+//
+// https://datatracker.ietf.org/doc/html/rfc6716#section-4.2.1
+func (e *Encoder) encodeFrames(in []float32, isStereo bool, nanoseconds int, bandwidth Bandwidth, maxBits int) error {
+	sampleRate, _, err := bandwidthParameters(bandwidth)
+	frameCount := silkFrameCount(nanoseconds)
+	channelCount := 1
+	if isStereo {
+		channelCount = 2
+	}
+	switch {
+	case err != nil:
+		return err
+	case frameCount == 0:
+		return errUnsupportedSilkFrameDuration
+	case len(in) != channelCount*sampleRate*(nanoseconds/nanoseconds10Ms)/100:
+		return errInvalidFrameSize
+	}
+
+	mid, side := in, []float32(nil)
+	var weights []stereoWeights
+	if isStereo {
+		if !e.wasStereo {
+			e.startStereo()
+		}
+		mid, side, weights = e.stereoMix(in, frameCount, bandwidth)
+	} else {
+		e.previousMid = in[len(in)-1]
+	}
+
+	// The LBRR frames of the previous Opus frame are only coded when they
+	// can be decoded in place of it
+	midRedundancy := e.pendingLowBitrateRedundancy(nanoseconds, bandwidth, isStereo)
+	var sideRedundancy []*encodedFrame
+	if isStereo {
+		sideRedundancy = e.sideEncoder.pendingLowBitrateRedundancy(nanoseconds, bandwidth, isStereo)
+	}
+
+	// The header bits, the LBRR frames and the stereo prediction weights
+	// come out of the budget of the regular frames
+	overhead := headerBits(midRedundancy, frameCount, nanoseconds, bandwidth)
+	if isStereo {
+		overhead += headerBits(sideRedundancy, frameCount, nanoseconds, bandwidth)
+		for i := range weights {
+			overhead += stereoWeightBits(weights[i])
+			if midRedundancy != nil && midRedundancy[i] != nil {
+				overhead += stereoWeightBits(e.lowBitrateRedundancyStereoWeights[i])
+			}
+		}
+	}
+
+	bitrate := e.bitrate
+	if bitrate <= 0 {
+		bitrate = defaultBitrate
+	}
+	budget := bitrate*(nanoseconds/nanoseconds10Ms)/100 - overhead
+	maxBits -= overhead
+
+	// The side channel is analyzed first, with the share of the bits of
+	// silk_stereo_LR_to_MS() (stereo_LR_to_MS.c), so that the mid channel
+	// gets the bits it leaves
+	var sideFrames []*encodedFrame
+	var sideBits int
+	if isStereo {
+		ratio := math.Min(math.Sqrt(meanSquare(side)/math.Max(meanSquare(mid), vadMinEnergy)), 1)
+		sideBudget := int(float64(budget) * (5 + 3*ratio) / (13 + 3*ratio))
+		sideFrames, sideBits = e.sideEncoder.analyzeFrames(side, nanoseconds, bandwidth, sideBudget, maxBits/2)
+	}
+	midFrames, _ := e.analyzeFrames(mid, nanoseconds, bandwidth, budget-sideBits, maxBits-sideBits)
+
+	// https://datatracker.ietf.org/doc/html/rfc6716#section-4.2.3
+	e.voiceActivityDetected = e.encodeHeaderBits(midFrames, midRedundancy)
+	if isStereo && e.encodeHeaderBits(sideFrames, sideRedundancy) {
+		e.voiceActivityDetected = true
+	}
+
+	// https://datatracker.ietf.org/doc/html/rfc6716#section-4.2.4
+	e.encodeLowBitrateRedundancyFlags(midRedundancy)
+	if isStereo {
+		e.encodeLowBitrateRedundancyFlags(sideRedundancy)
+	}
+
+	// The stereo prediction weights of an LBRR frame are those of the
+	// frame it is a copy of, and the side channel is never skipped
+	//
+	// https://datatracker.ietf.org/doc/html/rfc6716#section-4.2.5
+	silkFrameNanoseconds := nanoseconds / frameCount
+	for i := 0; i < frameCount; i++ {
+		midCoded := midRedundancy != nil && midRedundancy[i] != nil
+		sideCoded := sideRedundancy != nil && sideRedundancy[i] != nil
+		if midCoded {
+			if isStereo {
+				e.encodeStereoWeights(e.lowBitrateRedundancyStereoWeights[i])
+				if !sideCoded {
+					e.rangeEncoder.EncodeSymbolWithICDF(icdfStereoMidOnly, 0)
+				}
+			}
+			e.encodeFrame(midRedundancy[i], silkFrameNanoseconds, bandwidth)
+		}
+		if sideCoded {
+			e.encodeFrame(sideRedundancy[i], silkFrameNanoseconds, bandwidth)
+		}
+	}
+
+	// https://datatracker.ietf.org/doc/html/rfc6716#section-4.2.6
+	for i, frame := range midFrames {
+		if isStereo {
+			e.encodeStereoWeights(weights[i])
+			if !sideFrames[i].voiceActivityDetected {
+				e.rangeEncoder.EncodeSymbolWithICDF(icdfStereoMidOnly, 0)
+			}
+		}
+		e.encodeFrame(frame, silkFrameNanoseconds, bandwidth)
+		if isStereo {
+			e.encodeFrame(sideFrames[i], silkFrameNanoseconds, bandwidth)
+		}
+	}
+
+	e.wasStereo = isStereo
+	e.lowBitrateRedundancyStereo = isStereo
+	e.lowBitrateRedundancyStereoWeights = weights
+	if isStereo {
+		e.sideEncoder.lowBitrateRedundancyStereo = true
+	}
+	return nil
+}
+
+// analyzeFrames analyzes and quantizes the SILK frames of one channel of
+// an Opus frame, sharing budget bits between them, and keeps their LBRR
+// copies for the next Opus frame. It returns the frames and the bits
+// they take.
+func (e *Encoder) analyzeFrames(in []float32, nanoseconds int, bandwidth Bandwidth, budget, maxBits int) (frames []*encodedFrame, usedBits int) {
+	sampleRate, _, _ := bandwidthParameters(bandwidth)
+	frameCount := silkFrameCount(nanoseconds)
+	silkFrameNanoseconds := nanoseconds / frameCount
+	frameLength := len(in) / frameCount
+
+	// Pitch and LPC analysis look back into the previous frames, as far
+	// as the longest pitch lag plus the LTP taps and the LPC order
+	historyLength := (pitchMaxLagMs + 4) * sampleRate / 1000
+	if e.historyBandwidth != bandwidth {
+		e.history = make([]float32, historyLength)
+		e.historyBandwidth = bandwidth
+	}
+	signal := append(e.history[:historyLength:historyLength], in...)
+
+	e.decoder.initialize()
+	e.decoder.resetPredictionForBandwidthChange(bandwidth)
+
+	frames = make([]*encodedFrame, frameCount)
+	var nextLowBitrateRedundancyFrames []*encodedFrame
+	if e.lowBitrateRedundancy {
+		nextLowBitrateRedundancyFrames = make([]*encodedFrame, frameCount)
+	}
+	var lowBitrateRedundancyLogGain int32
+	for i := range frames {
+		frameStart := historyLength + i*frameLength
+		frame := e.analyzeFrame(signal[:frameStart+frameLength], frameStart, sampleRate, bandwidth, silkFrameNanoseconds)
+		frame.coding = frameCodingFor(i, nil, false, false)
+		frame.lagAbsolute = frame.coding != frameCodingConditional || !e.decoder.isPreviousFrameVoiced
+		frame.ltpScaleIndex = e.ltpScaleIndex(frameCount)
+		frame.seed = e.frameCounter & 3
+		e.frameCounter++
+
+		// The bits left are shared by the frames left
+		frameBudget := (budget - usedBits) / (frameCount - i)
+		if !frame.voiceActivityDetected {
+			frameBudget = int(float64(frameBudget) * inactiveBitrateFraction)
+		}
+
+		// The frames left are kept room to be coded at least without
+		// pulses, which this frame's cost without pulses estimates, and
+		// the first frames of a packet take at most the share of the bits
+		// left that silk_Encode() (enc_API.c) gives them
+		withoutPulses := e.quantizeFrameWithoutPulses(frame, bandwidth, silkFrameNanoseconds)
+		availableBits := maxBits - usedBits - (frameCount-i-1)*frameBits(withoutPulses, silkFrameNanoseconds, bandwidth)
+		if share := (maxBits - usedBits) * frameShares[frameCount-1][i][0] / frameShares[frameCount-1][i][1]; availableBits > share {
+			availableBits = share
+		}
+		if frameBudget > availableBits {
+			frameBudget = availableBits
+		}
+
+		level := e.searchExcitationLevel(frame, frameBudget, bandwidth, silkFrameNanoseconds)
+		frames[i] = e.quantizeFrame(frame, level, e.decoder.previousLogGain, e.decoder.haveDecoded, bandwidth, silkFrameNanoseconds)
+
+		// The LTP filter predicts from the quantized past, which for a
+		// frame that is only partly periodic adds more noise than it
+		// removes, so voiced frames are also tried unvoiced
+		if frame.signalType == frameSignalTypeVoiced {
+			unvoiced := *frame
+			unvoiced.signalType = frameSignalTypeUnvoiced
+			unvoiced.quantizationOffsetType = frameQuantizationOffsetTypeHigh
+			unvoiced.residualRMS = frame.lpcResidualRMS
+			unvoicedLevel := e.searchExcitationLevel(&unvoiced, frameBudget, bandwidth, silkFrameNanoseconds)
+			quantized := e.quantizeFrame(&unvoiced, unvoicedLevel, e.decoder.previousLogGain, e.decoder.haveDecoded, bandwidth, silkFrameNanoseconds)
+			if quantized.distortion < frames[i].distortion {
+				frame, level, frames[i] = &unvoiced, unvoicedLevel, quantized
+			}
+		}
+
+		// A frame that doesn't fit at any level is coded without pulses,
+		// which takes the fewest bits
+		if frameBits(frames[i], silkFrameNanoseconds, bandwidth) > availableBits {
+			frames[i] = e.quantizeFrameWithoutPulses(frame, bandwidth, silkFrameNanoseconds)
+		}
+		usedBits += frameBits(frames[i], silkFrameNanoseconds, bandwidth)
+
+		// https://datatracker.ietf.org/doc/html/rfc6716#section-4.2.4
+		if nextLowBitrateRedundancyFrames != nil && frame.voiceActivityDetected {
+			redundant := *frame
+			redundant.coding = frameCodingIndependent
+			if i > 0 && nextLowBitrateRedundancyFrames[i-1] != nil {
+				redundant.coding = frameCodingConditional
+			}
+
+			previousLogGain, haveDecoded := e.decoder.previousLogGain, e.decoder.haveDecoded
+			redundant.lagAbsolute = true
+			if redundant.coding == frameCodingConditional {
+				previousLogGain, haveDecoded = lowBitrateRedundancyLogGain, true
+				redundant.lagAbsolute = nextLowBitrateRedundancyFrames[i-1].signalType != frameSignalTypeVoiced
+			}
+
+			gainIncrease := lowBitrateRedundancyGainIncrease - e.packetLossPercentage*2/5
+			if gainIncrease < minLowBitrateRedundancyGainIncrease {
+				gainIncrease = minLowBitrateRedundancyGainIncrease
+			}
+			redundantLevel := level - float64(gainIncrease)*gainLevelBits
+			nextLowBitrateRedundancyFrames[i] = e.quantizeFrame(&redundant, redundantLevel, previousLogGain, haveDecoded, bandwidth, silkFrameNanoseconds)
+			lowBitrateRedundancyLogGain = nextLowBitrateRedundancyFrames[i].logGain
+		}
+
+		e.updateDecoder(frames[i], silkFrameNanoseconds, bandwidth)
+	}
+
+	e.history = signal[len(signal)-historyLength:]
+	e.haveEncoded = true
+	e.lowBitrateRedundancyFrames = nextLowBitrateRedundancyFrames
+	e.lowBitrateRedundancyNanoseconds = nanoseconds
+	e.lowBitrateRedundancyBandwidth = bandwidth
+	return frames, usedBits
+}
+
+// pendingLowBitrateRedundancy returns the LBRR frames of the previous
+// Opus frame, or nil when they can't be decoded in place of it
+func (e *Encoder) pendingLowBitrateRedundancy(nanoseconds int, bandwidth Bandwidth, isStereo bool) []*encodedFrame {
+	if e.lowBitrateRedundancyNanoseconds != nanoseconds ||
+		e.lowBitrateRedundancyBandwidth != bandwidth ||
+		e.lowBitrateRedundancyStereo != isStereo {
+		return nil
+	}
+	return e.lowBitrateRedundancyFrames
+}
+
+// headerBits returns the bits a channel takes for its VAD flags, its LBRR
+// flags and its LBRR frames
+//
+// https://datatracker.ietf.org/doc/html/rfc6716#section-4.2.3
+func headerBits(lowBitrateRedundancyFrames []*encodedFrame, frameCount, nanoseconds int, bandwidth Bandwidth) int {
+	bits := frameCount + 1
+	if lowBitrateRedundancyFrames != nil && frameCount > 1 {
+		bits += 2
+	}
+	for _, frame := range lowBitrateRedundancyFrames {
+		if frame != nil {
+			bits += frameBits(frame, nanoseconds/frameCount, bandwidth)
+		}
+	}
+	return bits
+}
+
+// encodeHeaderBits codes the VAD flags and the LBRR flag of a channel,
+// and returns whether any of its frames has voice activity
+//
+// https://datatracker.ietf.org/doc/html/rfc6716#section-4.2.3
+func (e *Encoder) encodeHeaderBits(frames, lowBitrateRedundancyFrames []*encodedFrame) bool {
+	voiceActivityDetected := false
+	for _, frame := range frames {
+		e.rangeEncoder.EncodeSymbolLogP(1, boolToUint32(frame.voiceActivityDetected))
+		voiceActivityDetected = voiceActivityDetected || frame.voiceActivityDetected
+	}
+	e.rangeEncoder.EncodeSymbolLogP(1, boolToUint32(lowBitrateRedundancyFlags(lowBitrateRedundancyFrames) != 0))
+	return voiceActivityDetected
+}
+
+// encodeLowBitrateRedundancyFlags codes which frames of a channel have an
+// LBRR frame, for Opus frames of 40 and 60 ms with any
+//
+// https://datatracker.ietf.org/doc/html/rfc6716#section-4.2.4
+func (e *Encoder) encodeLowBitrateRedundancyFlags(lowBitrateRedundancyFrames []*encodedFrame) {
+	flags := lowBitrateRedundancyFlags(lowBitrateRedundancyFrames)
+	if flags == 0 {
+		return
+	}
+
+	switch len(lowBitrateRedundancyFrames) {
+	case 2:
+		e.rangeEncoder.EncodeSymbolWithICDF(icdfLowBitrateRedundancyFlags40Ms, flags)
+	case 3:
+		e.rangeEncoder.EncodeSymbolWithICDF(icdfLowBitrateRedundancyFlags60Ms, flags)
+	}
+}
+
+// lowBitrateRedundancyFlags packs the frames with an LBRR frame from the
+// LSB
+func lowBitrateRedundancyFlags(lowBitrateRedundancyFrames []*encodedFrame) uint32 {
+	var flags uint32
+	for i, frame := range lowBitrateRedundancyFrames {
+		if frame != nil {
+			flags |= 1 << i
+		}
+	}
+	return flags
+}
+
+// VoiceActivityDetected returns whether the VAD found voice activity in
+// any SILK frame of the last Opus frame encoded
+func (e *Encoder) VoiceActivityDetected() bool {
+	return e.voiceActivityDetected
+}
+
+// FinalRange returns the state of the range encoder after the last frame
+// encoded. The decoder's final range matches it when the frame is decoded
+// bit-exactly.
+func (e *Encoder) FinalRange() uint32 {
+	return e.rangeEncoder.FinalRange()
+}
+
+// analyzeFrame analyzes the SILK frame that starts at frameStart and ends
+// signal, and quantizes its signal type, LPC filter, pitch lags and LTP
+// filters
+func (e *Encoder) analyzeFrame(signal []float32, frameStart, sampleRate int, bandwidth Bandwidth, nanoseconds int) *encodedFrame {
+	_, order, _ := bandwidthParameters(bandwidth)
+	samples := signal[frameStart:]
+	frame := &encodedFrame{
+		samples:                samples,
+		voiceActivityDetected:  e.detectVoiceActivity(samples),
+		signalType:             frameSignalTypeInactive,
+		quantizationOffsetType: frameQuantizationOffsetTypeHigh,
+	}
+
+	var lag int
+	var correlation float64
+	if frame.voiceActivityDetected {
+		frame.signalType = frameSignalTypeUnvoiced
+		lag, correlation = analyzePitch(signal, frameStart, sampleRate)
+		if correlation > voicingThreshold {
+			frame.signalType = frameSignalTypeVoiced
+			frame.quantizationOffsetType = frameQuantizationOffsetTypeLow
+		}
+	}
+
+	// https://datatracker.ietf.org/doc/html/rfc6716#section-4.2.7.5
+	nlsfQ15 := lpcToNormalizedLSF(analyzeLPC(samples, order))
+	var quantizedQ15 []int16
+	frame.stageOneIndex, frame.stageTwoIndices, quantizedQ15 = e.quantizeNormalizedLSF(nlsfQ15, frame.signalType, bandwidth)
+	frame.aQ12 = e.decoder.generateAQ12(quantizedQ15, bandwidth, nil)[0]
+
+	residual := lpcResidual(signal, frame.aQ12)
+	subframeLength := len(samples) / subframeCount(nanoseconds)
+	frame.lpcResidualRMS = make([]float64, subframeCount(nanoseconds))
+	for n := frameStart; n < len(signal); n++ {
+		frame.lpcResidualRMS[(n-frameStart)/subframeLength] += residual[n] * residual[n] / float64(subframeLength)
+	}
+	for i, energy := range frame.lpcResidualRMS {
+		frame.lpcResidualRMS[i] = math.Sqrt(energy)
+	}
+
+	frame.residualRMS = frame.lpcResidualRMS
+	if frame.signalType == frameSignalTypeVoiced {
+		// https://datatracker.ietf.org/doc/html/rfc6716#section-4.2.7.6
+		var energies []float64
+		frame.primaryLag, frame.contourIndex, frame.pitchLags = searchPitchContour(residual, frameStart, subframeLength, lag, bandwidth, nanoseconds)
+		frame.periodicityIndex, frame.filterIndices, energies = searchLTPFilters(residual, frameStart, subframeLength, frame.pitchLags)
+
+		frame.residualRMS = make([]float64, len(energies))
+		for i := range energies {
+			frame.residualRMS[i] = math.Sqrt(energies[i])
+		}
+	}
+	return frame
+}
+
+// ltpScaleIndex picks the LTP scaling of independently coded voiced
+// frames from the expected loss of the frames in a packet
+//
+// https://datatracker.ietf.org/doc/html/rfc6716#section-4.2.7.6.3
+func (e *Encoder) ltpScaleIndex(frameCount int) uint32 {
+	switch loss := e.packetLossPercentage * frameCount; {
+	case loss >= ltpScaleLossThreshold2:
+		return 2
+	case loss >= ltpScaleLossThreshold1:
+		return 1
+	}
+	return 0
+}
+
+// quantizeNormalizedLSF quantizes normalized LSFs with the two stage VQ of
+// RFC 6716 Section 4.2.7.5. The stage-1 vectors are tried with their best
+// stage-2 residual, and the one whose reconstruction, stabilized like the
+// decoder does, has the lowest error weighted by the LSF spacing is kept.
+//
+// https://datatracker.ietf.org/doc/html/rfc6716#section-4.2.7.5
+func (e *Encoder) quantizeNormalizedLSF(
+	nlsfQ15 []int16,
+	signalType frameSignalType,
+	bandwidth Bandwidth,
+) (I1 uint32, I2 []int8, quantizedQ15 []int16) {
+	dLPC := len(nlsfQ15)
+	cb1Q8 := codebookNormalizedLSFStageOneNarrowbandOrMediumband
+	if bandwidth == BandwidthWideband {
+		cb1Q8 = codebookNormalizedLSFStageOneWideband
+	}
+
+	// Errors are weighted like silk_NLSF_VQ_weights_laroia()
+	// (NLSF_VQ_weights_laroia.c), by the inverse of the distance to the
+	// neighbouring LSFs
+	weights := make([]float64, dLPC)
+	for k := range weights {
+		previous, next := 0.0, 32768.0
+		if k > 0 {
+			previous = float64(nlsfQ15[k-1])
+		}
+		if k+1 < dLPC {
+			next = float64(nlsfQ15[k+1])
+		}
+		weights[k] = 1/math.Max(float64(nlsfQ15[k])-previous, 1) + 1/math.Max(next-float64(nlsfQ15[k]), 1)
+	}
+
+	// Like silk_NLSF_encode() (NLSF_encode.c), only the stage-1 vectors
+	// closest to the LSFs are searched further at lower complexities
+	candidates := make([]int, len(cb1Q8))
+	distances := make([]float64, len(cb1Q8))
+	for stageOneIndex := range cb1Q8 {
+		candidates[stageOneIndex] = stageOneIndex
+		for k := range nlsfQ15 {
+			difference := float64(nlsfQ15[k]) - float64(cb1Q8[stageOneIndex][k]<<7)
+			distances[stageOneIndex] += weights[k] * difference * difference
+		}
+	}
+	if e.normalizedLSFSurvivors > 0 && e.normalizedLSFSurvivors < len(candidates) {
+		sort.SliceStable(candidates, func(i, j int) bool {
+			return distances[candidates[i]] < distances[candidates[j]]
+		})
+		candidates = candidates[:e.normalizedLSFSurvivors]
+	}
+
+	bestError := math.Inf(1)
+	for _, stageOneIndex := range candidates {
+		// The stage-2 residual that reconstructs the LSFs exactly, with the
+		// weights of normalizeLineSpectralFrequencyCoefficients
+		resQ10 := make([]int16, dLPC)
+		for k := range resQ10 {
+			previous, next := uint(0), uint(256)
+			if k > 0 {
+				previous = cb1Q8[stageOneIndex][k-1]
+			}
+			if k+1 < dLPC {
+				next = cb1Q8[stageOneIndex][k+1]
+			}
+			w2Q18 := (1024/(cb1Q8[stageOneIndex][k]-previous) + 1024/(next-cb1Q8[stageOneIndex][k])) << 16
+			wQ9 := math.Sqrt(float64(w2Q18))
+
+			res := (float64(nlsfQ15[k]) - float64(cb1Q8[stageOneIndex][k]<<7)) * wQ9 / (1 << 14)
+			resQ10[k] = int16(math.Max(math.Min(math.Round(res), math.MaxInt16), math.MinInt16))
+		}
+
+		stageTwoIndices, quantizedQ10 := quantizeNormalizedLSFResidual(bandwidth, uint32(stageOneIndex), resQ10)
+		reconstructedQ15 := e.decoder.normalizeLineSpectralFrequencyCoefficients(dLPC, bandwidth, quantizedQ10, uint32(stageOneIndex))
+		e.decoder.normalizeLSFStabilization(reconstructedQ15, dLPC, bandwidth)
+
+		var err float64
+		for k := range reconstructedQ15 {
+			difference := float64(reconstructedQ15[k]) - float64(nlsfQ15[k])
+			err += weights[k] * difference * difference
+		}
+
+		if err < bestError {
+			bestError, I1, I2, quantizedQ15 = err, uint32(stageOneIndex), stageTwoIndices, reconstructedQ15
+		}
+	}
+
+	return I1, I2, quantizedQ15
+}
+
+// searchExcitationLevel searches the highest excitation level at which
+// the frame is coded in at most budget bits. The bits a frame takes grow
+// with its level, so the levels are bisected.
+func (e *Encoder) searchExcitationLevel(frame *encodedFrame, budget int, bandwidth Bandwidth, nanoseconds int) float64 {
+	bitsAt := func(step int) int {
+		level := float64(step) / excitationLevelResolution
+		quantized := e.quantizeFrame(frame, level, e.decoder.previousLogGain, e.decoder.haveDecoded, bandwidth, nanoseconds)
+		return frameBits(quantized, nanoseconds, bandwidth)
+	}
+
+	low, high := minExcitationLevel*excitationLevelResolution, maxExcitationLevel*excitationLevelResolution
+	if bitsAt(high) <= budget {
+		return maxExcitationLevel
+	}
+
+	for bits := bitsAt(low); bits > budget; {
+		// Frames that don't fit at any level are coded at the level below
+		// which the gains only grow, as a frame of a resonant filter takes
+		// a minimum of bits, and the quantization offsets of larger gains
+		// are heard as noise
+		if low <= lowestExcitationLevel*excitationLevelResolution {
+			return float64(low) / excitationLevelResolution
+		}
+
+		lower := bitsAt(low - excitationLevelResolution)
+		if lower >= bits {
+			return float64(low) / excitationLevelResolution
+		}
+		high, low, bits = low, low-excitationLevelResolution, lower
+	}
+
+	for high-low > 1 {
+		middle := (low + high) / 2
+		if bitsAt(middle) <= budget {
+			low = middle
+		} else {
+			high = middle
+		}
+	}
+	return float64(low) / excitationLevelResolution
+}
+
+// quantizeFrame returns a copy of the analyzed frame with its gains and
+// excitation quantized. The gains make the RMS of the excitation of each
+// subframe 2**level quantization steps. previousLogGain and haveDecoded
+// are the state of the gain prediction of the decoder.
+func (e *Encoder) quantizeFrame(
+	analyzed *encodedFrame,
+	level float64,
+	previousLogGain int32,
+	haveDecoded bool,
+	bandwidth Bandwidth,
+	nanoseconds int,
+) *encodedFrame {
+	frame := *analyzed
+
+	// The gains are in the 16-bit range of the reference implementation
+	gains := make([]float64, len(frame.residualRMS))
+	for i, rms := range frame.residualRMS {
+		gains[i] = rms * 32768 / math.Exp2(level)
+	}
+
+	var gainQ16 []float32
+	frame.gainIndices, gainQ16, frame.logGain = quantizeGains(gains, frame.coding, previousLogGain, haveDecoded)
+
+	ltpScaleQ14 := float32(15565)
+	if frame.signalType == frameSignalTypeVoiced && frame.coding == frameCodingIndependent {
+		ltpScaleQ14 = []float32{15565, 12288, 8192}[frame.ltpScaleIndex]
+	}
+
+	frame.eRaw = make([]int32, e.decoder.decodeShellblocks(nanoseconds, bandwidth)*pulsecountLargestPartitionSize)
+	e.quantizeExcitation(&frame, gainQ16, ltpScaleQ14, bandwidth)
+	return &frame
+}
+
+// quantizeFrameWithoutPulses returns a copy of the analyzed frame coded
+// unvoiced, with its gains quantized to the RMS of its residual and no
+// pulses, so that the decoder fills it with the noise of the quantization
+// offsets. Without the pitch lags and LTP filter it takes the fewest bits.
+func (e *Encoder) quantizeFrameWithoutPulses(analyzed *encodedFrame, bandwidth Bandwidth, nanoseconds int) *encodedFrame {
+	unvoiced := *analyzed
+	if unvoiced.signalType == frameSignalTypeVoiced {
+		unvoiced.signalType = frameSignalTypeUnvoiced
+		unvoiced.quantizationOffsetType = frameQuantizationOffsetTypeHigh
+		unvoiced.residualRMS = analyzed.lpcResidualRMS
+	}
+	frame := e.quantizeFrame(&unvoiced, 0, e.decoder.previousLogGain, e.decoder.haveDecoded, bandwidth, nanoseconds)
+	for i := range frame.eRaw {
+		frame.eRaw[i] = 0
+	}
+	return frame
+}
+
+// quantizeGains quantizes the gain of each subframe, in the 16-bit range,
+// to the log gain levels of silk_gains_quant() (gain_quant.c). It returns
+// the symbols that code them and the gains the decoder reconstructs from
+// them. The symbols are picked by following decodeSubframeQuantizations,
+// so the limits of the decoder on how fast the gain can change are
+// accounted for.
+//
+// https://datatracker.ietf.org/doc/html/rfc6716#section-4.2.7.4
+func quantizeGains(
+	gains []float64,
+	coding frameCoding,
+	previousLogGain int32,
+	haveDecoded bool,
+) (gainIndices []uint32, gainQ16 []float32, logGain int32) {
+	gainIndices = make([]uint32, len(gains))
+	gainQ16 = make([]float32, len(gains))
+	for subframeIndex, gain := range gains {
+		linearQ16 := int32(math.Min(math.Max(gain*65536, 1), math.MaxInt32))
+		target := (quantizationGainScale*(linToLog(linearQ16)-quantizationGainOffset) + 1<<15) >> 16
+
+		if subframeIndex == 0 && coding != frameCodingConditional {
+			gainIndex := clamp(0, target, quantizationGainLevels-1)
+			logGain = gainIndex
+			if haveDecoded {
+				logGain = maxInt32(gainIndex, previousLogGain-16)
+			}
+			gainIndices[subframeIndex] = uint32(gainIndex)
+		} else {
+			// Deltas above 12 levels double their step size, so the delta
+			// closest to the target is searched
+			bestError := int32(math.MaxInt32)
+			for deltaGainIndex := int32(0); deltaGainIndex < deltaGainIndexCount; deltaGainIndex++ {
+				candidate := clamp(0, maxInt32(2*deltaGainIndex-16, previousLogGain+deltaGainIndex-4), quantizationGainLevels-1)
+				if err := absInt32(candidate - target); err < bestError {
+					bestError, logGain, gainIndices[subframeIndex] = err, candidate, uint32(deltaGainIndex)
+				}
+			}
+		}
+
+		previousLogGain = logGain
+		gainQ16[subframeIndex] = float32(dequantizeGain(logGain))
+	}
+
+	return gainIndices, gainQ16, logGain
+}
+
+// quantizeExcitation quantizes the excitation of a frame in closed loop.
+// It runs the LTP and LPC synthesis of the decoder from the state of
+// e.decoder, and picks each excitation sample, after the pseudorandom
+// inversion and the quantization offset, so that the synthesized sample
+// is closest to the input.
+//
+// https://datatracker.ietf.org/doc/html/rfc6716#section-4.2.7.9
+func (e *Encoder) quantizeExcitation(frame *encodedFrame, gainQ16 []float32, ltpScaleQ14 float32, bandwidth Bandwidth) {
+	d := &e.decoder
+	n := d.samplesInSubframe(bandwidth)
+	dLPC := len(frame.aQ12)
+	offsetQ23 := excitationQuantizationOffset(frame.signalType, frame.quantizationOffsetType)
+	voiced := frame.signalType == frameSignalTypeVoiced
+
+	res := make([]float32, len(frame.samples))
+	lpc := make([]float32, len(frame.samples))
+	var resLag []float32
+	var bQ7 [][]int8
+	if voiced {
+		_, _, _, lagMax := pitchLagCodebooks(bandwidth)
+		resLag = make([]float32, lagMax+2)
+
+		codebook := [][][]int8{
+			codebookLTPFilterPeriodicityIndex0,
+			codebookLTPFilterPeriodicityIndex1,
+			codebookLTPFilterPeriodicityIndex2,
+		}[frame.periodicityIndex]
+		bQ7 = make([][]int8, len(frame.filterIndices))
+		for s, index := range frame.filterIndices {
+			bQ7[s] = codebook[index]
+		}
+	}
+
+	seed := frame.seed
+	for s := range gainQ16 {
+		j := n * s
+
+		// The decoder rewhitens the output of the previous frames, and
+		// rescales the residual of the previous subframes, for the LTP
+		// filter. Its prediction of this subframe is recomputed below
+		// from the quantized residual.
+		if voiced {
+			d.ltpSynthesis(nil, bQ7, frame.pitchLags, n, j, s, dLPC, ltpScaleQ14, 4, frame.aQ12, gainQ16, res, resLag)
+		}
+
+		gain := gainQ16[s] / 65536
+		for i := j; i < j+n; i++ {
+			var ltpPrediction float32
+			if voiced {
+				for k := 0; k < ltpOrder; k++ {
+					index := i - frame.pitchLags[s] + 2 - k
+					var value float32
+					if index >= 0 {
+						value = res[index]
+					} else {
+						value = resLag[len(resLag)+index]
+					}
+					ltpPrediction += value * (float32(bQ7[s][k]) / 128)
+				}
+			}
+
+			var lpcPrediction float32
+			for k := 0; k < dLPC; k++ {
+				index := i - k - 1
+				switch previous := len(d.previousFrameLPCValues) + index; {
+				case index >= 0:
+					lpcPrediction += lpc[index] * (frame.aQ12[k] / 4096)
+				case previous >= 0:
+					lpcPrediction += d.previousFrameLPCValues[previous] * (frame.aQ12[k] / 4096)
+				}
+			}
+
+			// The excitation that would synthesize the input exactly, in
+			// Q23, before the pseudorandom inversion
+			target := float64(((frame.samples[i]-lpcPrediction)/gain - ltpPrediction) * 8388608)
+			seed = 196314165*seed + 907633515
+			inverted := seed&0x80000000 != 0
+			if inverted {
+				target = -target
+			}
+
+			eRaw := quantizeExcitationSample(target, offsetQ23)
+			eQ23 := (eRaw << 8) - int32(sign(int(eRaw)))*20 + offsetQ23
+			if inverted {
+				eQ23 = -eQ23
+			}
+			seed += uint32(eRaw)
+
+			frame.eRaw[i] = eRaw
+			res[i] = float32(eQ23)/8388608 + ltpPrediction
+			lpc[i] = gain*res[i] + lpcPrediction
+
+			difference := float64(frame.samples[i] - clampNegativeOneToOne(lpc[i]))
+			frame.distortion += difference * difference
+		}
+	}
+}
+
+// quantizeExcitationSample returns the e_raw whose e_Q23, before the
+// pseudorandom inversion, is closest to target
+func quantizeExcitationSample(target float64, offsetQ23 int32) int32 {
+	reconstruct := func(eRaw int32) float64 {
+		return float64((eRaw << 8) - int32(sign(int(eRaw)))*20 + offsetQ23)
+	}
+
+	guess := int32(math.Floor((target - float64(offsetQ23)) / 256))
+	best := guess
+	for eRaw := guess - 1; eRaw <= guess+1; eRaw++ {
+		if math.Abs(reconstruct(eRaw)-target) < math.Abs(reconstruct(best)-target) {
+			best = eRaw
+		}
+	}
+	return clamp(-maxExcitationMagnitude, best, maxExcitationMagnitude)
+}
+
+// updateDecoder decodes a quantized frame with e.decoder, so that its
+// state follows the decoder's
+func (e *Encoder) updateDecoder(frame *encodedFrame, nanoseconds int, bandwidth Bandwidth) {
+	coded := &Encoder{}
+	coded.rangeEncoder.Init(make([]byte, maxFrameSize))
+	coded.encodeFrame(frame, nanoseconds, bandwidth)
+	data, err := coded.rangeEncoder.Done()
+	if err != nil {
+		return
+	}
+
+	e.decoder.rangeDecoder.Init(data)
+	e.decoder.decodeFrame(make([]float32, len(frame.samples)), frame.voiceActivityDetected, nanoseconds, bandwidth, frame.coding)
+}
+
+// frameBits returns the number of bits a frame is coded in
+func frameBits(frame *encodedFrame, nanoseconds int, bandwidth Bandwidth) int {
+	counter := &Encoder{}
+	counter.rangeEncoder.Init(make([]byte, maxFrameSize))
+	counter.encodeFrame(frame, nanoseconds, bandwidth)
+	return int(counter.rangeEncoder.Tell())
+}
+
+// encodeFrame codes the parameters of a SILK frame in the order
+// decodeFrame reads them
+//
+// https://datatracker.ietf.org/doc/html/rfc6716#section-4.2.7
+func (e *Encoder) encodeFrame(frame *encodedFrame, nanoseconds int, bandwidth Bandwidth) {
+	// https://datatracker.ietf.org/doc/html/rfc6716#section-4.2.7.3
+	e.encodeFrameType(frame.voiceActivityDetected, frame.signalType, frame.quantizationOffsetType)
+
+	// https://datatracker.ietf.org/doc/html/rfc6716#section-4.2.7.4
+	e.encodeSubframeQuantizations(frame.signalType, frame.coding, frame.gainIndices)
+
+	// https://datatracker.ietf.org/doc/html/rfc6716#section-4.2.7.5.1
+	e.rangeEncoder.EncodeSymbolWithICDF(icdfNormalizedLSFStageOne(frame.signalType, bandwidth), frame.stageOneIndex)
+
+	// https://datatracker.ietf.org/doc/html/rfc6716#section-4.2.7.5.2
+	e.encodeNormalizedLineSpectralFrequencyStageTwo(bandwidth, frame.stageOneIndex, frame.stageTwoIndices)
+
+	// The LSFs of the whole frame are used from its first subframe, an
+	// interpolation factor of 4
+	//
+	// https://datatracker.ietf.org/doc/html/rfc6716#section-4.2.7.5.5
+	if nanoseconds == nanoseconds20Ms {
+		e.rangeEncoder.EncodeSymbolWithICDF(icdfNormalizedLSFInterpolationIndex, 4)
+	}
+
+	if frame.signalType == frameSignalTypeVoiced {
+		// https://datatracker.ietf.org/doc/html/rfc6716#section-4.2.7.6.1
+		e.encodePitchLags(frame, nanoseconds, bandwidth)
+
+		// https://datatracker.ietf.org/doc/html/rfc6716#section-4.2.7.6.2
+		e.rangeEncoder.EncodeSymbolWithICDF(icdfPeriodicityIndex, frame.periodicityIndex)
+		icdf := [][]uint{icdfLTPFilterIndex0, icdfLTPFilterIndex1, icdfLTPFilterIndex2}[frame.periodicityIndex]
+		for _, filterIndex := range frame.filterIndices {
+			e.rangeEncoder.EncodeSymbolWithICDF(icdf, filterIndex)
+		}
+
+		// https://datatracker.ietf.org/doc/html/rfc6716#section-4.2.7.6.3
+		if frame.coding == frameCodingIndependent {
+			e.rangeEncoder.EncodeSymbolWithICDF(icdfLTPScalingParameter, frame.ltpScaleIndex)
+		}
+	}
+
+	// https://datatracker.ietf.org/doc/html/rfc6716#section-4.2.7.7
+	e.rangeEncoder.EncodeSymbolWithICDF(icdfLinearCongruentialGeneratorSeed, frame.seed)
+
+	// https://datatracker.ietf.org/doc/html/rfc6716#section-4.2.7.8
+	e.encodeExcitation(frame.eRaw, frame.signalType, frame.quantizationOffsetType)
+}
+
+// encodeFrameType codes the frame type symbol, the inverse of
+// determineFrameType. Frames with voice activity can't be inactive.
+//
+// https://datatracker.ietf.org/doc/html/rfc6716#section-4.2.7.3
+func (e *Encoder) encodeFrameType(voiceActivityDetected bool, signalType frameSignalType, quantizationOffsetType frameQuantizationOffsetType) {
+	var frameType uint32
+	switch signalType {
+	case frameSignalTypeInactive:
+		frameType = 0
+	case frameSignalTypeUnvoiced:
+		frameType = 2
+	case frameSignalTypeVoiced:
+		frameType = 4
+	}
+	if quantizationOffsetType == frameQuantizationOffsetTypeHigh {
+		frameType++
+	}
+
+	if voiceActivityDetected {
+		e.rangeEncoder.EncodeSymbolWithICDF(icdfFrameTypeVADActive, frameType-2)
+	} else {
+		e.rangeEncoder.EncodeSymbolWithICDF(icdfFrameTypeVADInactive, frameType)
+	}
+}
+
+// encodeSubframeQuantizations codes the gain symbols of quantizeGains,
+// the inverse of decodeSubframeQuantizations
+//
+// https://datatracker.ietf.org/doc/html/rfc6716#section-4.2.7.4
+func (e *Encoder) encodeSubframeQuantizations(signalType frameSignalType, coding frameCoding, gainIndices []uint32) {
+	for subframeIndex, gainIndex := range gainIndices {
+		if subframeIndex != 0 || coding == frameCodingConditional {
+			e.rangeEncoder.EncodeSymbolWithICDF(icdfDeltaQuantizationGain, gainIndex)
+			continue
+		}
+
+		switch signalType {
+		case frameSignalTypeInactive:
+			e.rangeEncoder.EncodeSymbolWithICDF(icdfIndependentQuantizationGainMSBInactive, gainIndex>>3)
+		case frameSignalTypeVoiced:
+			e.rangeEncoder.EncodeSymbolWithICDF(icdfIndependentQuantizationGainMSBVoiced, gainIndex>>3)
+		case frameSignalTypeUnvoiced:
+			e.rangeEncoder.EncodeSymbolWithICDF(icdfIndependentQuantizationGainMSBUnvoiced, gainIndex>>3)
+		}
+		e.rangeEncoder.EncodeSymbolWithICDF(icdfIndependentQuantizationGainLSB, gainIndex&7)
+	}
+}
+
+// encodePitchLags codes the primary pitch lag and the pitch contour. The
+// lag is always coded absolutely, behind a delta lag index of 0 when the
+// decoder expects a relative lag.
+//
+// https://datatracker.ietf.org/doc/html/rfc6716#section-4.2.7.6.1
+func (e *Encoder) encodePitchLags(frame *encodedFrame, nanoseconds int, bandwidth Bandwidth) {
+	lowPartICDF, lagScale, lagMin, _ := pitchLagCodebooks(bandwidth)
+	if !frame.lagAbsolute {
+		e.rangeEncoder.EncodeSymbolWithICDF(icdfPrimaryPitchLagChange, 0)
+	}
+
+	lag := uint32(frame.primaryLag) - lagMin
+	e.rangeEncoder.EncodeSymbolWithICDF(icdfPrimaryPitchLagHighPart, lag/lagScale)
+	e.rangeEncoder.EncodeSymbolWithICDF(lowPartICDF, lag%lagScale)
+
+	_, lagIcdf := pitchContourCodebooks(bandwidth, nanoseconds)
+	e.rangeEncoder.EncodeSymbolWithICDF(lagIcdf, frame.contourIndex)
+}
+
+// encodeExcitation codes the excitation pulses, the inverse of
+// decodeExcitation. The magnitudes of each shell block are shifted right
+// by as many LSBs as it takes for the block to hold at most 16 pulses,
+// and the rate level with the fewest bits for the pulse counts is picked.
+//
+// https://datatracker.ietf.org/doc/html/rfc6716#section-4.2.7.8
+func (e *Encoder) encodeExcitation(eRaw []int32, signalType frameSignalType, quantizationOffsetType frameQuantizationOffsetType) {
+	shellblocks := len(eRaw) / pulsecountLargestPartitionSize
+	pulsecounts := make([]uint8, shellblocks)
+	lsbcounts := make([]uint8, shellblocks)
+	magnitudes := make([]int32, len(eRaw))
+	for i := range eRaw {
+		magnitudes[i] = absInt32(eRaw[i])
+	}
+
+	for block := range pulsecounts {
+		blockMagnitudes := magnitudes[block*pulsecountLargestPartitionSize : (block+1)*pulsecountLargestPartitionSize]
+		for {
+			var pulsecount int32
+			for _, magnitude := range blockMagnitudes {
+				pulsecount += magnitude >> lsbcounts[block]
+			}
+			if pulsecount <= pulsecountLargestPartitionSize {
+				pulsecounts[block] = uint8(pulsecount)
+				break
+			}
+			lsbcounts[block]++
+		}
+	}
+
+	// https://datatracker.ietf.org/doc/html/rfc6716#section-4.2.7.8.1
+	rateLevelICDF := icdfRateLevelUnvoiced
+	if signalType == frameSignalTypeVoiced {
+		rateLevelICDF = icdfRateLevelVoiced
+	}
+
+	var rateLevel uint32
+	bestBits := math.Inf(1)
+	for level := uint32(0); level < uint32(len(rateLevelICDF)-1); level++ {
+		bits := symbolBits(rateLevelICDF, level)
+		for block, pulsecount := range pulsecounts {
+			if lsbcounts[block] > 0 {
+				pulsecount = 17
+			}
+			bits += symbolBits(icdfPulseCount[level], uint32(pulsecount))
+		}
+
+		if bits < bestBits {
+			bestBits, rateLevel = bits, level
+		}
+	}
+	e.rangeEncoder.EncodeSymbolWithICDF(rateLevelICDF, rateLevel)
+
+	// A block with LSBs is coded as 17 at the rate level, then 17 at rate
+	// level 9 for each further LSB. The 10th LSB moves the pulse count to
+	// rate level 10, where 17 can't be coded.
+	//
+	// https://datatracker.ietf.org/doc/html/rfc6716#section-4.2.7.8.2
+	for block, pulsecount := range pulsecounts {
+		switch lsbcount := lsbcounts[block]; {
+		case lsbcount == 0:
+			e.rangeEncoder.EncodeSymbolWithICDF(icdfPulseCount[rateLevel], uint32(pulsecount))
+		default:
+			e.rangeEncoder.EncodeSymbolWithICDF(icdfPulseCount[rateLevel], 17)
+			for i := uint8(1); i < lsbcount; i++ {
+				e.rangeEncoder.EncodeSymbolWithICDF(icdfPulseCount[9], 17)
+			}
+
+			if lsbcount == 10 {
+				e.rangeEncoder.EncodeSymbolWithICDF(icdfPulseCount[9], 17)
+				e.rangeEncoder.EncodeSymbolWithICDF(icdfPulseCount[10], uint32(pulsecount))
+			} else {
+				e.rangeEncoder.EncodeSymbolWithICDF(icdfPulseCount[9], uint32(pulsecount))
+			}
+		}
+	}
+
+	// https://datatracker.ietf.org/doc/html/rfc6716#section-4.2.7.8.3
+	shifted := make([]uint8, pulsecountLargestPartitionSize)
+	for block, pulsecount := range pulsecounts {
+		if pulsecount == 0 {
+			continue
+		}
+
+		for i := range shifted {
+			shifted[i] = uint8(magnitudes[block*pulsecountLargestPartitionSize+i] >> lsbcounts[block])
+		}
+		e.encodePulseLocation(shifted)
+	}
+
+	// https://datatracker.ietf.org/doc/html/rfc6716#section-4.2.7.8.4
+	for i, magnitude := range magnitudes {
+		for bit := int(lsbcounts[i/pulsecountLargestPartitionSize]) - 1; bit >= 0; bit-- {
+			e.rangeEncoder.EncodeSymbolWithICDF(icdfExcitationLSB, uint32(magnitude>>bit)&1)
+		}
+	}
+
+	// https://datatracker.ietf.org/doc/html/rfc6716#section-4.2.7.8.5
+	for i := range eRaw {
+		if eRaw[i] == 0 {
+			continue
+		}
+
+		icdf := icdfExcitationSign(signalType, quantizationOffsetType, pulsecounts[i/pulsecountLargestPartitionSize])
+		e.rangeEncoder.EncodeSymbolWithICDF(icdf, boolToUint32(eRaw[i] > 0))
+	}
+}
+
+// encodePulseLocation codes how the pulses of a shell block split between
+// the halves of each partition, the inverse of decodePulseLocation
+//
+// https://datatracker.ietf.org/doc/html/rfc6716#section-4.2.7.8.3
+func (e *Encoder) encodePulseLocation(pulses []uint8) {
+	icdfs := [][][]uint{
+		icdfPulseCountSplit16SamplePartitions,
+		icdfPulseCountSplit8SamplePartitions,
+		icdfPulseCountSplit4SamplePartitions,
+		icdfPulseCountSplit2SamplePartitions,
+	}
+
+	var partition func(pulses []uint8, depth int)
+	partition = func(pulses []uint8, depth int) {
+		if depth == len(icdfs) {
+			return
+		}
+
+		half := len(pulses) / 2
+		var left, total uint8
+		for i, count := range pulses {
+			if i < half {
+				left += count
+			}
+			total += count
+		}
+
+		if total != 0 {
+			e.rangeEncoder.EncodeSymbolWithICDF(icdfs[depth][total-1], uint32(left))
+		}
+		partition(pulses[:half], depth+1)
+		partition(pulses[half:], depth+1)
+	}
+	partition(pulses, 0)
+}
+
+// stereoWeights are the quantized stereo prediction weights of a SILK
+// frame, and the five symbols that code them
+type stereoWeights struct {
+	symbols      [5]uint32
+	w0Q13, w1Q13 int32
+}
+
+// quantizeStereoWeights quantizes the predictors of the low-passed mid
+// channel and of the rest of it to the closest of the 5 steps within each
+// interval of Table 7. The decoder's w1 is the second predictor, and its
+// w0 the difference of the two.
+//
+// https://datatracker.ietf.org/doc/html/rfc6716#section-4.2.7.1
+func quantizeStereoWeights(lowPass, highPass float64) stereoWeights {
+	quantize := func(predictor float64) (interval, step int32) {
+		bestError := math.Inf(1)
+		for i := int32(0); i+1 < int32(len(stereoWeightsQ13)); i++ {
+			stepQ13 := ((stereoWeightsQ13[i+1] - stereoWeightsQ13[i]) * 6554) >> 16
+			for j := int32(0); j < 5; j++ {
+				if err := math.Abs(float64(stereoWeightsQ13[i]+stepQ13*(2*j+1)) - predictor*8192); err < bestError {
+					bestError, interval, step = err, i, j
+				}
+			}
+		}
+		return interval, step
+	}
+
+	wi0, i1 := quantize(lowPass)
+	wi1, i3 := quantize(highPass)
+	n, i0, i2 := 5*(wi0/3)+wi1/3, wi0%3, wi1%3
+
+	w0Q13, w1Q13 := stereoPredictionWeights(n, i0, i1, i2, i3)
+	return stereoWeights{
+		symbols: [5]uint32{uint32(n), uint32(i0), uint32(i1), uint32(i2), uint32(i3)},
+		w0Q13:   w0Q13,
+		w1Q13:   w1Q13,
+	}
+}
+
+// encodeStereoWeights codes the stereo prediction weights of a frame, the
+// inverse of decodeStereoPredictionWeights
+//
+// https://datatracker.ietf.org/doc/html/rfc6716#section-4.2.7.1
+func (e *Encoder) encodeStereoWeights(weights stereoWeights) {
+	for i, icdf := range stereoWeightsICDFs() {
+		e.rangeEncoder.EncodeSymbolWithICDF(icdf, weights.symbols[i])
+	}
+}
+
+// stereoWeightBits returns the bits the stereo prediction weights of a
+// frame and its mid-only flag take, rounded up
+func stereoWeightBits(weights stereoWeights) int {
+	bits := symbolBits(icdfStereoMidOnly, 0)
+	for i, icdf := range stereoWeightsICDFs() {
+		bits += symbolBits(icdf, weights.symbols[i])
+	}
+	return int(math.Ceil(bits))
+}
+
+// stereoWeightsICDFs returns the PDFs of the stereo prediction weight
+// symbols, in the order they are coded
+func stereoWeightsICDFs() [5][]uint {
+	return [5][]uint{
+		icdfStereoWeightsStageOne,
+		icdfStereoWeightsStageTwo,
+		icdfStereoWeightsStageThree,
+		icdfStereoWeightsStageTwo,
+		icdfStereoWeightsStageThree,
+	}
+}
+
+// symbolBits returns the number of bits a symbol takes when coded with a
+// PDF in the layout of icdf.go
+func symbolBits(icdf []uint, symbol uint32) float64 {
+	low := uint(0)
+	if symbol > 0 {
+		low = icdf[symbol]
+	}
+	if probability := icdf[symbol+1] - low; probability != 0 {
+		return math.Log2(float64(icdf[0]) / float64(probability))
+	}
+	return math.Inf(1)
+}
+
+// encodeNormalizedLineSpectralFrequencyStageTwo codes the stage-2 indices,
+// each between -10 and 10. Indices beyond -4 and 4 are coded as -4 or 4,
+// followed by the rest of their magnitude.
+//
+// https://datatracker.ietf.org/doc/html/rfc6716#section-4.2.7.5.2
+func (e *Encoder) encodeNormalizedLineSpectralFrequencyStageTwo(bandwidth Bandwidth, I1 uint32, I2 []int8) {
+	codebook := codebookNormalizedLSFStageTwoIndex(bandwidth)
+	for i, index := range I2 {
+		icdf := icdfNormalizedLSFStageTwoIndex[codebook[I1][i]]
+		switch {
+		case index <= -4:
+			e.rangeEncoder.EncodeSymbolWithICDF(icdf, 0)
+			e.rangeEncoder.EncodeSymbolWithICDF(icdfNormalizedLSFStageTwoIndexExtension, uint32(-4-index))
+		case index >= 4:
+			e.rangeEncoder.EncodeSymbolWithICDF(icdf, 8)
+			e.rangeEncoder.EncodeSymbolWithICDF(icdfNormalizedLSFStageTwoIndexExtension, uint32(index-4))
+		default:
+			e.rangeEncoder.EncodeSymbolWithICDF(icdf, uint32(index+4))
+		}
+	}
+}
+
+// quantizeNormalizedLSFResidual picks the stage-2 indices whose
+// reconstruction is closest to the stage-2 residual resQ10, and returns
+// them with that reconstruction. Each coefficient is predicted from the
+// one that follows it, so they are quantized from the last to the first.
+// The reference encoder searches the indices with a trellis instead.
+//
+// https://datatracker.ietf.org/doc/html/rfc6716#section-4.2.7.5.2
+func quantizeNormalizedLSFResidual(bandwidth Bandwidth, I1 uint32, resQ10 []int16) (I2 []int8, quantizedQ10 []int16) {
+	qstep := normalizedLSFQuantizationStep(bandwidth)
+	I2 = make([]int8, len(resQ10))
+	quantizedQ10 = make([]int16, len(resQ10))
+
+	for k := len(resQ10) - 1; k >= 0; k-- {
+		prediction := predictNormalizedLSFResidual(bandwidth, I1, quantizedQ10, k)
+
+		bestError := math.MaxInt32
+		for index := int8(-10); index <= 10; index++ {
+			quantized := prediction + dequantizeNormalizedLSFResidual(index, qstep)
+			if err := abs(int(resQ10[k]) - quantized); err < bestError {
+				bestError, I2[k], quantizedQ10[k] = err, index, int16(quantized)
+			}
+		}
+	}
+
+	return I2, quantizedQ10
+}
+
+// linToLog approximates the base-2 logarithm of a positive value in Q7,
+// like silk_lin2log() (lin2log.c)
+func linToLog(in int32) int32 {
+	leadingZeros := int32(bits.LeadingZeros32(uint32(in)))
+	fractionQ7 := int32(bits.RotateLeft32(uint32(in), int(leadingZeros-24)) & 0x7f)
+
+	// Piece-wise parabolic approximation
+	return fractionQ7 + ((fractionQ7*(128-fractionQ7))*179)>>16 + (31-leadingZeros)<<7
+}
+
+// bandwidthParameters returns the internal sample rate and the LPC order
+// of a bandwidth
+func bandwidthParameters(bandwidth Bandwidth) (sampleRate, order int, err error) {
+	switch bandwidth {
+	case BandwidthNarrowband:
+		return 8000, 10, nil
+	case BandwidthMediumband:
+		return 12000, 10, nil
+	case BandwidthWideband:
+		return 16000, 16, nil
+	default:
+		return 0, 0, errUnsupportedSilkBandwidth
+	}
+}
+
+func boolToUint32(b bool) uint32 {
+	if b {
+		return 1
+	}
+	return 0
+}
+
+func abs(x int) int {
+	if x < 0 {
+		return -x
+	}
+	return x
+}
@@ -0,0 +1,471 @@
+package silk
+
+import (
+	"errors"
+	"math"
+	"math/rand"
+	"testing"
+
+	"github.com/pion/opus/internal/rangecoding"
+)
+
+// testSignal returns count frames of 20 ms at sampleRate
+func testSignal(name string, sampleRate, count int) []float32 {
+	random := rand.New(rand.NewSource(1)) //nolint:gosec
+	samples := make([]float32, sampleRate/50*count)
+	for i := range samples {
+		switch name {
+		case "noise":
+			samples[i] = float32(random.NormFloat64() * 0.1)
+		case "sine":
+			samples[i] = float32(0.5 * math.Sin(2*math.Pi*440*float64(i)/float64(sampleRate)))
+		case "voiced":
+			// A 200 Hz pulse train through a decaying resonance
+			phase := i % (sampleRate / 200)
+			samples[i] = float32(0.5 * math.Exp(-float64(phase)/20) * math.Cos(2*math.Pi*700*float64(phase)/float64(sampleRate)))
+		}
+	}
+	return samples
+}
+
+// encodeSignal encodes signal in frames of nanoseconds at bandwidth, and
+// decodes them
+func encodeSignal(t *testing.T, encoder *Encoder, signal []float32, nanoseconds int, bandwidth Bandwidth) (packets [][]byte, decoded []float32) {
+	t.Helper()
+
+	sampleRate, _, err := bandwidthParameters(bandwidth)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	decoder := NewDecoder()
+	frameSize := sampleRate * (nanoseconds / nanoseconds10Ms) / 100
+	decoded = make([]float32, len(signal))
+	for i := 0; i+frameSize <= len(signal); i += frameSize {
+		packet, err := encoder.Encode(signal[i:i+frameSize], false, nanoseconds, bandwidth)
+		if err != nil {
+			t.Fatal(err)
+		}
+		packets = append(packets, packet)
+
+		if err := decoder.Decode(packet, decoded[i:i+frameSize], false, nanoseconds, bandwidth); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	return packets, decoded
+}
+
+// signalToNoiseRatio compares decoded with signal after the first skip
+// samples. Mono output is delayed by one sample.
+func signalToNoiseRatio(signal, decoded []float32, skip int) float64 {
+	var signalEnergy, noiseEnergy float64
+	for i := skip; i+1 < len(decoded); i++ {
+		noise := float64(decoded[i+1]) - float64(signal[i])
+		signalEnergy += float64(signal[i]) * float64(signal[i])
+		noiseEnergy += noise * noise
+	}
+	return 10 * math.Log10(signalEnergy/noiseEnergy)
+}
+
+func TestEncoderRoundTrip(t *testing.T) {
+	const bitrate = 32000
+	for _, bandwidth := range []Bandwidth{BandwidthNarrowband, BandwidthMediumband, BandwidthWideband} {
+		sampleRate, _, err := bandwidthParameters(bandwidth)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		for _, nanoseconds := range []int{nanoseconds10Ms, nanoseconds20Ms, nanoseconds40Ms, nanoseconds60Ms} {
+			for _, test := range []struct {
+				name   string
+				minSNR float64
+			}{
+				// White noise can't be predicted, so at 2 to 4 bits per
+				// sample only the coarse quantization of the excitation
+				// reproduces it
+				{"noise", 5},
+				{"sine", 60},
+				{"voiced", 30},
+			} {
+				encoder := NewEncoder()
+				encoder.SetBitrate(bitrate)
+				signal := testSignal(test.name, sampleRate, 30)
+				packets, decoded := encodeSignal(t, encoder, signal, nanoseconds, bandwidth)
+
+				if snr := signalToNoiseRatio(signal, decoded, sampleRate/10); snr < test.minSNR {
+					t.Errorf("%s at bandwidth %d and %d ms: SNR %.1f dB, expected at least %.0f dB",
+						test.name, bandwidth, nanoseconds/1e6, snr, test.minSNR)
+				}
+
+				var bits int
+				for _, packet := range packets {
+					bits += 8 * len(packet)
+				}
+				if measured := bits * sampleRate / len(signal); measured > bitrate*11/10 {
+					t.Errorf("%s at bandwidth %d and %d ms: %d bits per second, expected at most %d",
+						test.name, bandwidth, nanoseconds/1e6, measured, bitrate)
+				}
+			}
+		}
+	}
+}
+
+func TestEncoderLowBitrateRedundancy(t *testing.T) {
+	for _, bandwidth := range []Bandwidth{BandwidthNarrowband, BandwidthWideband} {
+		sampleRate, _, err := bandwidthParameters(bandwidth)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		for _, nanoseconds := range []int{nanoseconds20Ms, nanoseconds60Ms} {
+			encoder := NewEncoder()
+			encoder.SetBitrate(32000)
+			encoder.SetLowBitrateRedundancy(true)
+			signal := testSignal("voiced", sampleRate, 30)
+			packets, _ := encodeSignal(t, encoder, signal, nanoseconds, bandwidth)
+
+			// Every fourth packet is lost, and either recovered from the LBRR
+			// frames of the packet after it or concealed
+			frameSize := sampleRate * (nanoseconds / nanoseconds10Ms) / 100
+			recovering, concealing := NewDecoder(), NewDecoder()
+			recovered, concealed := make([]float32, len(signal)), make([]float32, len(signal))
+			for i, packet := range packets {
+				recoveredFrame := recovered[i*frameSize : (i+1)*frameSize]
+				concealedFrame := concealed[i*frameSize : (i+1)*frameSize]
+				if i%4 != 3 || i+1 == len(packets) {
+					if err := recovering.Decode(packet, recoveredFrame, false, nanoseconds, bandwidth); err != nil {
+						t.Fatal(err)
+					}
+					if err := concealing.Decode(packet, concealedFrame, false, nanoseconds, bandwidth); err != nil {
+						t.Fatal(err)
+					}
+					continue
+				}
+
+				rangeDecoder := rangecoding.Decoder{}
+				rangeDecoder.Init(packets[i+1])
+				if err := recovering.DecodeLowBitrateRedundancy(&rangeDecoder, recoveredFrame, false, 1, nanoseconds, bandwidth); err != nil {
+					t.Fatal(err)
+				}
+				if err := concealing.Conceal(concealedFrame, 1, nanoseconds); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			recoveredSNR := signalToNoiseRatio(signal, recovered, sampleRate/10)
+			concealedSNR := signalToNoiseRatio(signal, concealed, sampleRate/10)
+			if recoveredSNR < 15 || recoveredSNR < concealedSNR+10 {
+				t.Errorf("bandwidth %d and %d ms: SNR %.1f dB with LBRR, %.1f dB concealed",
+					bandwidth, nanoseconds/1e6, recoveredSNR, concealedSNR)
+			}
+		}
+	}
+}
+
+func TestQuantizeGains(t *testing.T) {
+	random := rand.New(rand.NewSource(1)) //nolint:gosec
+	for _, coding := range []frameCoding{frameCodingIndependent, frameCodingConditional} {
+		for i := 0; i < 100; i++ {
+			gains := make([]float64, maxSubframeCount)
+			for subframe := range gains {
+				gains[subframe] = math.Exp2(random.Float64() * 16)
+			}
+			previousLogGain := int32(random.Intn(quantizationGainLevels))
+
+			gainIndices, gainQ16, _ := quantizeGains(gains, coding, previousLogGain, true)
+			e := NewEncoder()
+			e.rangeEncoder.Init(make([]byte, 16))
+			e.encodeSubframeQuantizations(frameSignalTypeVoiced, coding, gainIndices)
+			data, err := e.rangeEncoder.Done()
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			d := NewDecoder()
+			d.rangeDecoder.Init(data)
+			d.haveDecoded = true
+			d.previousLogGain = previousLogGain
+			decoded := d.decodeSubframeQuantizations(frameSignalTypeVoiced, maxSubframeCount, coding)
+			for subframe := range decoded {
+				if decoded[subframe] != gainQ16[subframe] {
+					t.Fatalf("decoded gains %v, expected %v", decoded, gainQ16)
+				}
+			}
+
+			// Gains the previous gain and the table don't limit are
+			// quantized to within a level, 1.4 dB
+			lowest := float64(dequantizeGain(maxInt32(0, previousLogGain-15))) / 65536
+			highest := float64(dequantizeGain(quantizationGainLevels-1)) / 65536
+			if coding == frameCodingIndependent && gains[0] > lowest && gains[0] < highest {
+				if ratio := float64(gainQ16[0]) / 65536 / gains[0]; math.Abs(20*math.Log10(ratio)) > 1.4 {
+					t.Fatalf("gain %f quantized to %f", gains[0], gainQ16[0]/65536)
+				}
+			}
+		}
+	}
+}
+
+func TestLPCToNormalizedLSF(t *testing.T) {
+	for _, bandwidth := range []Bandwidth{BandwidthNarrowband, BandwidthWideband} {
+		sampleRate, order, err := bandwidthParameters(bandwidth)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		for _, name := range []string{"noise", "sine", "voiced"} {
+			a := analyzeLPC(testSignal(name, sampleRate, 1), order)
+			nlsfQ15 := lpcToNormalizedLSF(a)
+			for k := 1; k < len(nlsfQ15); k++ {
+				if nlsfQ15[k] <= nlsfQ15[k-1] {
+					t.Fatalf("%s: LSFs %v are not increasing", name, nlsfQ15)
+				}
+			}
+
+			// The LSFs convert back to the LPC coefficients
+			aQ12 := NewDecoder().generateAQ12(nlsfQ15, bandwidth, nil)[0]
+			for k := range a {
+				if math.Abs(float64(aQ12[k])/4096-a[k]) > 0.01 {
+					t.Fatalf("%s: LPC coefficients %v converted to %v", name, a, aQ12)
+				}
+			}
+		}
+	}
+}
+
+func TestEncodeExcitation(t *testing.T) {
+	random := rand.New(rand.NewSource(1)) //nolint:gosec
+	for _, maxMagnitude := range []int{1, 4, 40, maxExcitationMagnitude} {
+		eRaw := make([]int32, 20*pulsecountLargestPartitionSize)
+		for i := range eRaw {
+			if random.Intn(2) == 0 {
+				eRaw[i] = int32(random.Intn(2*maxMagnitude+1) - maxMagnitude)
+			}
+		}
+
+		e := NewEncoder()
+		e.rangeEncoder.Init(make([]byte, maxFrameSize))
+		e.encodeExcitation(eRaw, frameSignalTypeUnvoiced, frameQuantizationOffsetTypeHigh)
+		data, err := e.rangeEncoder.Done()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		d := NewDecoder()
+		d.rangeDecoder.Init(data)
+		rateLevel := d.decodeRatelevel(false)
+		pulsecounts, lsbcounts := d.decodePulseAndLSBCounts(len(eRaw)/pulsecountLargestPartitionSize, rateLevel)
+		eQ23 := d.decodeExcitation(frameSignalTypeUnvoiced, frameQuantizationOffsetTypeHigh, 0, pulsecounts, lsbcounts)
+
+		seed := uint32(0)
+		for i := range eRaw {
+			expected := (eRaw[i] << 8) - int32(sign(int(eRaw[i])))*20 + 60
+			seed = 196314165*seed + 907633515
+			if seed&0x80000000 != 0 {
+				expected = -expected
+			}
+			seed += uint32(eRaw[i])
+
+			if eQ23[i] != expected {
+				t.Fatalf("excitation of magnitude %d: sample %d decoded as %d, expected %d", maxMagnitude, i, eQ23[i], expected)
+			}
+		}
+	}
+}
+
+func TestEncodeFrameType(t *testing.T) {
+	for _, test := range []struct {
+		voiceActivityDetected  bool
+		signalType             frameSignalType
+		quantizationOffsetType frameQuantizationOffsetType
+	}{
+		{false, frameSignalTypeInactive, frameQuantizationOffsetTypeLow},
+		{false, frameSignalTypeInactive, frameQuantizationOffsetTypeHigh},
+		{true, frameSignalTypeUnvoiced, frameQuantizationOffsetTypeLow},
+		{true, frameSignalTypeUnvoiced, frameQuantizationOffsetTypeHigh},
+		{true, frameSignalTypeVoiced, frameQuantizationOffsetTypeLow},
+		{true, frameSignalTypeVoiced, frameQuantizationOffsetTypeHigh},
+	} {
+		e := NewEncoder()
+		e.rangeEncoder.Init(make([]byte, 4))
+		e.encodeFrameType(test.voiceActivityDetected, test.signalType, test.quantizationOffsetType)
+		data, err := e.rangeEncoder.Done()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		d := NewDecoder()
+		d.rangeDecoder.Init(data)
+		signalType, quantizationOffsetType := d.determineFrameType(test.voiceActivityDetected)
+		if signalType != test.signalType || quantizationOffsetType != test.quantizationOffsetType {
+			t.Fatalf("decoded %d/%d, expected %d/%d", signalType, quantizationOffsetType, test.signalType, test.quantizationOffsetType)
+		}
+	}
+}
+
+func TestQuantizeNormalizedLSFResidual(t *testing.T) {
+	random := rand.New(rand.NewSource(1)) //nolint:gosec
+	for _, bandwidth := range []Bandwidth{BandwidthNarrowband, BandwidthWideband} {
+		_, order, err := bandwidthParameters(bandwidth)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		// Half a step in Q10
+		maxError := normalizedLSFQuantizationStep(bandwidth) >> 7
+
+		for I1 := uint32(0); I1 < 32; I1++ {
+			resQ10 := make([]int16, order)
+			for i := range resQ10 {
+				resQ10[i] = int16(random.Intn(1024) - 512)
+			}
+
+			I2, quantizedQ10 := quantizeNormalizedLSFResidual(bandwidth, I1, resQ10)
+			for i := range resQ10 {
+				if abs(int(resQ10[i])-int(quantizedQ10[i])) > maxError {
+					t.Fatalf("coefficient %d of %v quantized to %v", i, resQ10, quantizedQ10)
+				}
+			}
+
+			e := NewEncoder()
+			e.rangeEncoder.Init(make([]byte, 64))
+			e.encodeNormalizedLineSpectralFrequencyStageTwo(bandwidth, I1, I2)
+			data, err := e.rangeEncoder.Done()
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			d := NewDecoder()
+			d.rangeDecoder.Init(data)
+			decodedQ10 := d.decodeNormalizedLineSpectralFrequencyStageTwo(bandwidth, I1)
+			for i := range decodedQ10 {
+				if decodedQ10[i] != quantizedQ10[i] {
+					t.Fatalf("decoded %v, expected %v", decodedQ10, quantizedQ10)
+				}
+			}
+		}
+	}
+}
+
+func TestAnalyzePitch(t *testing.T) {
+	signal := testSignal("voiced", 16000, 2)
+	lag, correlation := analyzePitch(signal, 320, 16000)
+	if lag != 80 || correlation < 0.99 {
+		t.Fatalf("lag %d with correlation %f, expected 80", lag, correlation)
+	}
+
+	if _, correlation = analyzePitch(testSignal("noise", 16000, 2), 320, 16000); correlation > voicingThreshold {
+		t.Fatalf("noise correlates by %f", correlation)
+	}
+}
+
+func TestDetectVoiceActivity(t *testing.T) {
+	e := NewEncoder()
+	for i, test := range []struct {
+		frame    []float32
+		expected bool
+	}{
+		{make([]float32, 160), false},
+		{testSignal("noise", 8000, 1), true},
+		{testSignal("voiced", 8000, 1), true},
+		{make([]float32, 160), false},
+	} {
+		if voiceActivityDetected := e.detectVoiceActivity(test.frame); voiceActivityDetected != test.expected {
+			t.Fatalf("frame %d: voice activity %t, expected %t", i, voiceActivityDetected, test.expected)
+		}
+		e.haveEncoded = true
+	}
+}
+
+func TestLinToLog(t *testing.T) {
+	for _, test := range []struct {
+		in       int32
+		expected int32
+	}{
+		{1, 0},
+		{65536, 16 << 7},
+		{1 << 20, 20 << 7},
+		{98304, 16<<7 + 75}, // log2(1.5) ~ 0.585
+	} {
+		if out := linToLog(test.in); out != test.expected {
+			t.Fatalf("linToLog(%d) = %d, expected %d", test.in, out, test.expected)
+		}
+	}
+
+	// Quantizing a dequantized gain gives back its level, or the level
+	// below as both approximate the logarithm
+	for logGain := int32(0); logGain < quantizationGainLevels; logGain++ {
+		gainQ16 := dequantizeGain(logGain)
+		if gainIndex := (quantizationGainScale * (linToLog(gainQ16) - quantizationGainOffset)) >> 16; gainIndex != logGain && gainIndex != logGain-1 {
+			t.Fatalf("gain %d quantized to %d", logGain, gainIndex)
+		}
+	}
+}
+
+func TestEncoder_Errors(t *testing.T) {
+	for _, test := range []struct {
+		name        string
+		samples     int
+		nanoseconds int
+		bandwidth   Bandwidth
+		expected    error
+	}{
+		{"bandwidth", 320, nanoseconds20Ms, 0, errUnsupportedSilkBandwidth},
+		{"duration", 80, nanoseconds10Ms / 2, BandwidthWideband, errUnsupportedSilkFrameDuration},
+		{"frame size", 320, nanoseconds20Ms, BandwidthNarrowband, errInvalidFrameSize},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			if _, err := NewEncoder().Encode(make([]float32, test.samples), false, test.nanoseconds, test.bandwidth); !errors.Is(err, test.expected) {
+				t.Fatalf("expected %v, got %v", test.expected, err)
+			}
+		})
+	}
+}
+
+func TestEncoderStereo(t *testing.T) {
+	const sampleRate = 16000
+	voiced, sine := testSignal("voiced", sampleRate, 30), testSignal("sine", sampleRate, 30)
+	for _, test := range []struct {
+		name   string
+		right  func(i int) float32
+		minSNR float64
+	}{
+		{"identical", func(i int) float32 { return voiced[i] }, 25},
+		{"panned", func(i int) float32 { return 0.5 * voiced[i] }, 25},
+		{"independent", func(i int) float32 { return 0.5 * sine[i] }, 12},
+	} {
+		for _, nanoseconds := range []int{nanoseconds10Ms, nanoseconds20Ms, nanoseconds60Ms} {
+			signal := make([]float32, 2*len(voiced))
+			for i := range voiced {
+				signal[2*i], signal[2*i+1] = voiced[i], test.right(i)
+			}
+
+			encoder, decoder := NewEncoder(), NewDecoder()
+			encoder.SetBitrate(48000)
+			frameSize := sampleRate * (nanoseconds / nanoseconds10Ms) / 100
+			decoded := make([]float32, len(signal))
+			for i := 0; i+2*frameSize <= len(signal); i += 2 * frameSize {
+				packet, err := encoder.Encode(signal[i:i+2*frameSize], true, nanoseconds, BandwidthWideband)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if err = decoder.Decode(packet, decoded[i:i+2*frameSize], true, nanoseconds, BandwidthWideband); err != nil {
+					t.Fatal(err)
+				} else if decoder.FinalRange() != encoder.FinalRange() {
+					t.Fatalf("%s: final range %08x, expected %08x", test.name, decoder.FinalRange(), encoder.FinalRange())
+				}
+			}
+
+			for c, channel := range []string{"left", "right"} {
+				in, out := make([]float32, len(voiced)), make([]float32, len(voiced))
+				for i := range in {
+					in[i], out[i] = signal[2*i+c], decoded[2*i+c]
+				}
+				if snr := signalToNoiseRatio(in, out, sampleRate/10); snr < test.minSNR {
+					t.Errorf("%s at %d ms: SNR of the %s channel %.1f dB, expected at least %.0f dB",
+						test.name, nanoseconds/1e6, channel, snr, test.minSNR)
+				}
+			}
+		}
+	}
+}
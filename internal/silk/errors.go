@@ -3,7 +3,8 @@ package silk
 import "errors"
 
 var (
-	errUnsupportedSilkFrameDuration        = errors.New("only silk frames with a duration of 20ms supported")
-	errUnsupportedSilkStereo               = errors.New("silk decoder does not support stereo")
-	errUnsupportedSilkLowBitrateRedundancy = errors.New("silk decoder does not low bit-rate redundancy")
+	errUnsupportedSilkFrameDuration = errors.New("silk frame duration must be 10, 20, 40 or 60 ms")
+	errUnsupportedSilkBandwidth     = errors.New("silk bandwidth must be narrowband, mediumband or wideband")
+	errOutBufferTooSmall            = errors.New("out isn't large enough")
+	errInvalidFrameSize             = errors.New("sample count does not match the frame duration at the internal sample rate")
 )
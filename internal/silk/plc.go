@@ -0,0 +1,446 @@
+package silk
+
+import (
+	"math"
+)
+
+const (
+	// silk_PLC_glue_frames() and silk_PLC_conceal() (PLC.c) pick their
+	// noise from a 128 sample window of the last excitation.
+	concealmentRandomBufferSize = 128
+
+	// The longest SILK frame is 20 ms at 16 kHz.
+	concealmentMaxFrameLength = 320
+
+	// The longest pitch lag concealment extrapolates, in milliseconds.
+	concealmentMaxPitchLagMs = 18
+
+	// BWE_COEF, the bandwidth expansion applied to the LPC filter of every
+	// concealed frame
+	concealmentBandwidthExpansion = 0.99
+
+	// BWE_AFTER_LOSS_Q16, the bandwidth expansion applied to the LPC filter
+	// of the first frame decoded after a loss
+	bandwidthExpansionAfterLoss = 63570.0 / 65536.0
+
+	// PITCH_DRIFT_FAC_Q16, how much the pitch lag grows per concealed
+	// subframe
+	concealmentPitchDrift = 655.0 / 65536.0
+
+	// The largest excitation sample silk_CNG_exc() can produce
+	comfortNoiseMaxExcitation = 32767.0 / 1024.0 / 32768.0
+)
+
+// HARM_ATT_Q15, PLC_RAND_ATTENUATE_V_Q15, and PLC_RAND_ATTENUATE_UV_Q15:
+// the per subframe attenuation of the periodic and noise parts of the
+// concealed signal, for the first and for later lost frames.
+var (
+	concealmentHarmonicAttenuation      = [2]float32{32440.0 / 32768.0, 31130.0 / 32768.0}
+	concealmentVoicedNoiseAttenuation   = [2]float32{31130.0 / 32768.0, 26214.0 / 32768.0}
+	concealmentUnvoicedNoiseAttenuation = [2]float32{32440.0 / 32768.0, 29491.0 / 32768.0}
+)
+
+// concealmentState is what the packet loss concealment of the reference
+// decoder (PLC.c) keeps about the last decoded frame of a channel. RFC 6716
+// leaves concealment to the implementation; this follows the reference so
+// lost frames sound like libopus's.
+type concealmentState struct {
+	bandwidth Bandwidth
+
+	// The pitch lag in samples, and the 5 LTP filter taps, extrapolated
+	// from the last voiced frame
+	pitchLag        float32
+	ltpCoefficients [5]float32
+	ltpScale        float32
+	voiced          bool
+
+	// The LPC filter (in Q12) and the gains (in Q16) of the last two
+	// subframes decoded
+	previousLPC  []float32
+	previousGain [2]float32
+
+	subframeLength int
+	subframeCount  int
+
+	// The excitation of the last decoded frame, the source of the noise
+	// added to concealed frames
+	excitation [concealmentMaxFrameLength]float32
+
+	randomScale float32
+	randomSeed  int32
+
+	// The number of frames concealed since the last decoded one
+	lossCount int
+
+	// The energy of the last concealed frame, for glueFrames
+	concealedEnergy float32
+	lastFrameLost   bool
+
+	comfortNoise comfortNoiseState
+}
+
+// comfortNoiseState is what the comfort noise generator of the reference
+// decoder (CNG.c) learns from frames without voice activity. It is added to
+// concealed frames so a long loss fades into the background noise of the
+// stream rather than into silence.
+type comfortNoiseState struct {
+	// The excitation of the loudest subframes of recent inactive frames
+	excitation [concealmentMaxFrameLength]float32
+
+	// The smoothed NLSFs (in Q15) and gain (in Q16) of inactive frames
+	nlsfQ15 []int16
+	gainQ16 float32
+
+	lpc        [16]float32
+	randomSeed int32
+}
+
+// resetConcealment mirrors silk_PLC_Reset(), run whenever the internal
+// sample rate changes.
+func (d *Decoder) resetConcealment(bandwidth Bandwidth) {
+	c := &d.concealment
+	if c.bandwidth == bandwidth {
+		return
+	}
+
+	frameLength := d.samplesInSubframe(bandwidth) * maxSubframeCount
+	c.bandwidth = bandwidth
+	c.pitchLag = float32(frameLength / 2)
+	c.previousGain = [2]float32{65536, 65536}
+	c.subframeLength = 20
+	c.subframeCount = 2
+
+	// silk_CNG_Reset() spreads the NLSFs evenly
+	dLPC := 10
+	if bandwidth == BandwidthWideband {
+		dLPC = 16
+	}
+	c.comfortNoise = comfortNoiseState{
+		nlsfQ15:    make([]int16, dLPC),
+		randomSeed: 3176576,
+	}
+	for i := range c.comfortNoise.nlsfQ15 {
+		c.comfortNoise.nlsfQ15[i] = int16((i + 1) * (math.MaxInt16 / (dLPC + 1)))
+	}
+}
+
+// updateConcealment remembers the parameters of a decoded frame to
+// extrapolate from if the next one is lost, following silk_PLC_update().
+func (d *Decoder) updateConcealment(
+	signalType frameSignalType,
+	bandwidth Bandwidth,
+	pitchLags []int,
+	bQ7 [][]int8,
+	ltpScaleQ14 float32,
+	aQ12 []float32,
+	gainQ16 []float32,
+	eQ23 []int32,
+) {
+	d.resetConcealment(bandwidth)
+
+	c := &d.concealment
+	subframeLength := d.samplesInSubframe(bandwidth)
+	subframeCount := len(gainQ16)
+
+	c.voiced = signalType == frameSignalTypeVoiced
+	c.ltpCoefficients = [5]float32{}
+	if c.voiced {
+		// Use the taps of the last subframe with the strongest periodicity
+		// within one pitch period of the end of the frame, as a single
+		// center tap limited to a gain between 0.7 and 0.95
+		var ltpGain float32
+		for j := 0; j*subframeLength < pitchLags[subframeCount-1] && j < subframeCount; j++ {
+			var sum float32
+			for _, b := range bQ7[subframeCount-1-j] {
+				sum += float32(b) / 128.0
+			}
+
+			if sum > ltpGain {
+				ltpGain = sum
+				c.pitchLag = float32(pitchLags[subframeCount-1-j])
+			}
+		}
+
+		if ltpGain > 0 {
+			c.ltpCoefficients[2] = float32(math.Min(math.Max(float64(ltpGain), 11469.0/16384.0), 15565.0/16384.0))
+		}
+	} else {
+		c.pitchLag = float32(concealmentMaxPitchLagMs * subframeLength / 5)
+	}
+
+	c.previousLPC = append(c.previousLPC[:0], aQ12...)
+	c.ltpScale = ltpScaleQ14 / 16384.0
+	copy(c.previousGain[:], gainQ16[subframeCount-2:])
+	c.subframeLength = subframeLength
+	c.subframeCount = subframeCount
+
+	for i := 0; i < len(eQ23) && i < subframeLength*subframeCount; i++ {
+		c.excitation[i] = float32(eQ23[i]) / 8388608.0
+	}
+
+	c.lossCount = 0
+}
+
+// concealFrame extrapolates a lost SILK frame from the last one decoded,
+// following silk_PLC_conceal(). The periodic part of voiced frames
+// continues at the last pitch lag and the rest is filled with noise taken
+// from the last excitation, both fading the longer the loss lasts.
+func (d *Decoder) concealFrame(out []float32, nanoseconds int) {
+	bandwidth := d.previousBandwidth
+	if bandwidth == 0 {
+		bandwidth = BandwidthNarrowband
+	}
+	d.resetConcealment(bandwidth)
+
+	c := &d.concealment
+	subframeLength := d.samplesInSubframe(bandwidth)
+	subframeCount := subframeCount(nanoseconds)
+	frameLength := subframeLength * subframeCount
+	fsKHz := subframeLength / 5
+
+	if !d.haveDecoded || len(c.previousLPC) == 0 {
+		dLPC := 10
+		if bandwidth == BandwidthWideband {
+			dLPC = 16
+		}
+		c.previousLPC = make([]float32, dLPC)
+	}
+	dLPC := len(c.previousLPC)
+
+	// Take the noise from the louder of the last two subframes
+	energy := [2]float32{}
+	for k := 0; k < 2; k++ {
+		for i := 0; i < c.subframeLength; i++ {
+			v := c.excitation[i+(k+c.subframeCount-2)*c.subframeLength] * c.previousGain[k]
+			energy[k] += v * v
+		}
+	}
+	randomOffset := c.subframeCount*c.subframeLength - concealmentRandomBufferSize
+	if energy[0] < energy[1] {
+		randomOffset = (c.subframeCount-1)*c.subframeLength - concealmentRandomBufferSize
+	}
+	if randomOffset < 0 {
+		randomOffset = 0
+	}
+
+	attenuation := minInt(c.lossCount, 1)
+	harmonicGain := concealmentHarmonicAttenuation[attenuation]
+	randomGain := concealmentUnvoicedNoiseAttenuation[attenuation]
+	if c.voiced {
+		randomGain = concealmentVoicedNoiseAttenuation[attenuation]
+	}
+
+	expandLPCBandwidth(c.previousLPC, concealmentBandwidthExpansion)
+
+	if c.lossCount == 0 {
+		c.randomScale = 1
+		if c.voiced {
+			var sum float32
+			for _, b := range c.ltpCoefficients {
+				sum += b
+			}
+
+			c.randomScale = float32(math.Max(0.2, float64(1-sum))) * c.ltpScale
+		} else {
+			// Scale the noise down by the prediction gain of the LPC filter
+			aQ12 := make([]int16, dLPC)
+			for i := range aQ12 {
+				aQ12[i] = int16(c.previousLPC[i])
+			}
+
+			inversePredictionGain := float64(lpcInversePredictionGain(aQ12)) / (1 << 30)
+			randomGain *= float32(math.Min(math.Max(inversePredictionGain, 1.0/256.0), 1.0/8.0) * 8)
+		}
+	}
+
+	// Rewhiten the last output into an LTP residual, as LTP synthesis
+	// does, and extend it by one frame. The history is 20 ms long, of which
+	// at most the last 306 samples are used.
+	historyLength := maxSubframeCount * subframeLength
+	ltp := make([]float32, historyLength+frameLength)
+	lag := int(c.pitchLag + 0.5)
+	start := historyLength - lag - dLPC - 2
+	historyOffset := len(d.finalOutValues) - historyLength
+	inverseGain := 65536.0 / c.previousGain[1]
+	for i := start + dLPC; i < historyLength; i++ {
+		residual := d.finalOutValues[historyOffset+i]
+		for k := 0; k < dLPC; k++ {
+			residual -= d.finalOutValues[historyOffset+i-k-1] * (c.previousLPC[k] / 4096.0)
+		}
+
+		ltp[i] = residual * inverseGain
+	}
+
+	seed := c.randomSeed
+	index := historyLength
+	for k := 0; k < subframeCount; k++ {
+		lagIndex := index - lag + 2
+		for i := 0; i < subframeLength; i++ {
+			var prediction float32
+			for j, b := range c.ltpCoefficients {
+				prediction += ltp[lagIndex-j] * b
+			}
+			lagIndex++
+
+			seed = 907633515 + seed*196314165
+			noise := c.excitation[randomOffset+int((seed>>25)&(concealmentRandomBufferSize-1))]
+			ltp[index] = prediction + noise*c.randomScale
+			index++
+		}
+
+		for j := range c.ltpCoefficients {
+			c.ltpCoefficients[j] *= harmonicGain
+		}
+		c.randomScale *= randomGain
+
+		c.pitchLag += c.pitchLag * concealmentPitchDrift
+		if maxLag := float32(concealmentMaxPitchLagMs * fsKHz); c.pitchLag > maxLag {
+			c.pitchLag = maxLag
+		}
+		lag = int(c.pitchLag + 0.5)
+	}
+
+	// LPC synthesis with the gain of the last subframe decoded
+	lpc := make([]float32, dLPC+frameLength)
+	if len(d.previousFrameLPCValues) == dLPC {
+		copy(lpc, d.previousFrameLPCValues)
+	}
+	gain := c.previousGain[1] / 65536.0
+	for i := 0; i < frameLength; i++ {
+		lpcVal := gain * ltp[historyLength+i]
+		for k := 0; k < dLPC; k++ {
+			lpcVal += lpc[dLPC+i-k-1] * (c.previousLPC[k] / 4096.0)
+		}
+
+		lpc[dLPC+i] = lpcVal
+		out[i] = clampNegativeOneToOne(lpcVal)
+	}
+
+	d.previousFrameLPCValues = append(d.previousFrameLPCValues[:0], lpc[frameLength:]...)
+	d.saveFinalOutValues(out[:frameLength])
+
+	c.randomSeed = seed
+	d.pitchLag = lag
+	c.lossCount++
+
+	d.addComfortNoise(out[:frameLength])
+
+	c.concealedEnergy = frameEnergy(out[:frameLength])
+	c.lastFrameLost = true
+}
+
+// glueFrames smooths the transition from concealed frames to the first
+// frame decoded after them, following silk_PLC_glue_frames(). A decoded
+// frame louder than the concealment is faded in from its level.
+func (d *Decoder) glueFrames(out []float32) {
+	c := &d.concealment
+	if !c.lastFrameLost {
+		return
+	}
+	c.lastFrameLost = false
+
+	energy := frameEnergy(out)
+	if energy <= c.concealedEnergy {
+		return
+	}
+
+	gain := float32(math.Sqrt(float64(c.concealedEnergy / energy)))
+	slope := (1 - gain) * 4 / float32(len(out))
+	for i := range out {
+		out[i] *= gain
+		gain += slope
+		if gain > 1 {
+			break
+		}
+	}
+}
+
+// updateComfortNoise learns the background noise from a decoded frame
+// without voice activity, following silk_CNG(). The NLSFs and the gain are
+// smoothed over such frames, and the excitation of the loudest subframe is
+// kept as the source of the noise.
+func (d *Decoder) updateComfortNoise(signalType frameSignalType, nlsfQ15 []int16, gainQ16 []float32, eQ23 []int32) {
+	cng := &d.concealment.comfortNoise
+	cng.lpc = [16]float32{}
+	if signalType != frameSignalTypeInactive || len(nlsfQ15) != len(cng.nlsfQ15) {
+		return
+	}
+
+	for i, n := range nlsfQ15 {
+		cng.nlsfQ15[i] += int16((int32(n) - int32(cng.nlsfQ15[i])) * 16348 >> 16)
+	}
+
+	loudest := 0
+	for i, g := range gainQ16 {
+		if g > gainQ16[loudest] {
+			loudest = i
+		}
+	}
+
+	subframeLength := len(eQ23) / len(gainQ16)
+	copy(cng.excitation[subframeLength:], cng.excitation[:(len(gainQ16)-1)*subframeLength])
+	for i, e := range eQ23[loudest*subframeLength : (loudest+1)*subframeLength] {
+		cng.excitation[i] = float32(e) / 8388608.0
+	}
+
+	for _, g := range gainQ16 {
+		cng.gainQ16 += (g - cng.gainQ16) * 4634.0 / 65536.0
+	}
+}
+
+// addComfortNoise adds the background noise learnt by updateComfortNoise to
+// a concealed frame, at the level the fading concealment no longer covers.
+func (d *Decoder) addComfortNoise(out []float32) {
+	c := &d.concealment
+	cng := &c.comfortNoise
+
+	concealedGain := c.randomScale * c.previousGain[1]
+	gainQ16 := float32(math.Sqrt(math.Max(0, float64(cng.gainQ16*cng.gainQ16-2*concealedGain*concealedGain))))
+	gain := gainQ16 / 65536.0
+
+	mask := 255
+	for mask > len(out) {
+		mask >>= 1
+	}
+
+	// silk_NLSF2A()
+	aQ12 := d.generateAQ12(cng.nlsfQ15, c.bandwidth, nil)[0]
+	dLPC := len(aQ12)
+
+	lpc := make([]float32, dLPC+len(out))
+	copy(lpc, cng.lpc[16-dLPC:])
+	seed := cng.randomSeed
+	for i := range out {
+		seed = 907633515 + seed*196314165
+		// silk_CNG_exc() saturates the excitation to 16 bits in Q10
+		lpcVal := cng.excitation[int(seed>>24)&mask] * gain
+		lpcVal = float32(math.Max(-comfortNoiseMaxExcitation, math.Min(comfortNoiseMaxExcitation, float64(lpcVal))))
+		for k := 0; k < dLPC; k++ {
+			lpcVal += lpc[dLPC+i-k-1] * (aQ12[k] / 4096.0)
+		}
+
+		lpc[dLPC+i] = lpcVal
+		out[i] = clampNegativeOneToOne(out[i] + lpcVal)
+	}
+	cng.randomSeed = seed
+	copy(cng.lpc[16-dLPC:], lpc[len(out):])
+}
+
+func frameEnergy(samples []float32) (energy float32) {
+	for _, v := range samples {
+		energy += v * v
+	}
+
+	return energy
+}
+
+// expandLPCBandwidth applies the bandwidth expansion of silk_bwexpander()
+// (bwexpander.c) to LPC coefficients: the k'th coefficient is scaled by
+// chirp**(k+1).
+func expandLPCBandwidth(aQ12 []float32, chirp float32) {
+	factor := chirp
+	for i := range aQ12 {
+		aQ12[i] *= factor
+		factor *= chirp
+	}
+}
@@ -0,0 +1,195 @@
+/*
+ * generate writes the SILK reference vectors of TestDecodeReferenceVectors
+ * (internal/silk/decoder_test.go) with libopus 1.4, the last release
+ * without the speech enhancement of the 1.5 decoder. From a checkout of
+ * https://github.com/xiph/opus at tag v1.4, configured and built with
+ *
+ *   ./autogen.sh && ./configure --disable-shared && make
+ *
+ * the vectors are generated from this directory with
+ *
+ *   cc -O2 -I$OPUS/include -o /tmp/generate generate.c $OPUS/.libs/libopus.a -lm
+ *   /tmp/generate
+ *
+ * Each vector is a synthetic voiced signal encoded by opus_encode() at the
+ * SILK internal sample rate, where the SILK decoder's resampler is a copy,
+ * and decoded by opus_decode(). The encoder settings only allow SILK-only
+ * packets, and the generator fails if it makes any other. A vector is a
+ * sequence of records of
+ *
+ *   1 byte   how the packet was decoded: 0 normally, 1 with FEC from the
+ *            packet of the record, for the packet before it that was
+ *            lost, 2 concealed without a packet
+ *   4 bytes  OPUS_GET_FINAL_RANGE after decoding, little endian
+ *   2 bytes  packet length, little endian, zero when concealed
+ *   packet   the Opus packet, a TOC byte and one SILK frame
+ *   samples  the decoded interleaved 16-bit little endian samples
+ */
+#include <math.h>
+#include <stdio.h>
+#include <stdlib.h>
+#include <string.h>
+
+#include <opus.h>
+
+#define DURATION_MS 1000
+#define MAX_PACKET 1275
+
+enum { DECODED, FEC, CONCEALED };
+
+struct vector {
+	const char *name;
+	int bandwidth;
+	int sample_rate;
+	int frame_ms;
+	int channels;
+	int bitrate;
+	/* Every loss_interval-th packet is lost, recovered with FEC or
+	 * concealed */
+	int loss_interval;
+	int fec;
+};
+
+static const struct vector vectors[] = {
+	{"nb_20ms_mono", OPUS_BANDWIDTH_NARROWBAND, 8000, 20, 1, 12000, 0, 0},
+	{"mb_20ms_mono", OPUS_BANDWIDTH_MEDIUMBAND, 12000, 20, 1, 16000, 0, 0},
+	{"wb_10ms_mono", OPUS_BANDWIDTH_WIDEBAND, 16000, 10, 1, 20000, 0, 0},
+	{"wb_40ms_mono", OPUS_BANDWIDTH_WIDEBAND, 16000, 40, 1, 20000, 0, 0},
+	{"wb_60ms_stereo", OPUS_BANDWIDTH_WIDEBAND, 16000, 60, 2, 32000, 0, 0},
+	{"wb_20ms_mono_fec", OPUS_BANDWIDTH_WIDEBAND, 16000, 20, 1, 20000, 7, 1},
+	{"wb_20ms_stereo_fec", OPUS_BANDWIDTH_WIDEBAND, 16000, 20, 2, 32000, 7, 1},
+	{"wb_20ms_mono_plc", OPUS_BANDWIDTH_WIDEBAND, 16000, 20, 1, 20000, 7, 0},
+};
+
+/* A voiced signal with a gliding pitch, syllable-like bursts and a little
+ * noise from a fixed LCG, so that every vector is reproducible */
+static void synthesize(opus_int16 *pcm, int samples, int sample_rate, int channels) {
+	unsigned int seed = 1;
+	double phase = 0;
+	int i, c, k;
+
+	for (i = 0; i < samples; i++) {
+		double t = (double)i / sample_rate;
+		double pitch = 140 + 30 * sin(2 * M_PI * 0.7 * t);
+		double envelope = 0.5 * (1 - cos(2 * M_PI * 2.5 * t));
+		double voiced = 0;
+
+		phase += 2 * M_PI * pitch / sample_rate;
+		for (k = 1; k * pitch < sample_rate / 2 && k <= 20; k++) {
+			voiced += sin(k * phase) / k;
+		}
+
+		for (c = 0; c < channels; c++) {
+			double noise;
+			seed = seed * 1664525 + 1013904223;
+			noise = (double)(seed >> 16) / 65536 - 0.5;
+			pcm[i * channels + c] = (opus_int16)(8000 * envelope * voiced * (c ? 0.6 : 1) + 300 * noise);
+		}
+	}
+}
+
+static void put16(FILE *out, int value) {
+	fputc(value & 0xff, out);
+	fputc((value >> 8) & 0xff, out);
+}
+
+static void put32(FILE *out, opus_uint32 value) {
+	put16(out, value & 0xffff);
+	put16(out, value >> 16);
+}
+
+static void write_record(FILE *out, int kind, OpusDecoder *decoder, const unsigned char *packet, int length,
+                         const opus_int16 *pcm, int samples) {
+	opus_uint32 final_range = 0;
+	int i;
+
+	opus_decoder_ctl(decoder, OPUS_GET_FINAL_RANGE(&final_range));
+	fputc(kind, out);
+	put32(out, final_range);
+	put16(out, length);
+	fwrite(packet, 1, length, out);
+	for (i = 0; i < samples; i++) {
+		put16(out, pcm[i]);
+	}
+}
+
+static int generate(const struct vector *v) {
+	int frame_size = v->sample_rate / 1000 * v->frame_ms;
+	int packet_count = DURATION_MS / v->frame_ms;
+	unsigned char (*packets)[MAX_PACKET] = malloc(packet_count * sizeof(*packets));
+	int *lengths = malloc(packet_count * sizeof(*lengths));
+	opus_int16 *in = malloc(sizeof(*in) * v->sample_rate * DURATION_MS / 1000 * v->channels);
+	opus_int16 *out = malloc(sizeof(*out) * frame_size * v->channels);
+	OpusEncoder *encoder;
+	OpusDecoder *decoder;
+	char path[64];
+	FILE *file;
+	int err, i;
+
+	encoder = opus_encoder_create(v->sample_rate, v->channels, OPUS_APPLICATION_VOIP, &err);
+	if (err != OPUS_OK) {
+		return err;
+	}
+	opus_encoder_ctl(encoder, OPUS_SET_BITRATE(v->bitrate));
+	opus_encoder_ctl(encoder, OPUS_SET_BANDWIDTH(v->bandwidth));
+	opus_encoder_ctl(encoder, OPUS_SET_SIGNAL(OPUS_SIGNAL_VOICE));
+	opus_encoder_ctl(encoder, OPUS_SET_FORCE_CHANNELS(v->channels));
+	opus_encoder_ctl(encoder, OPUS_SET_COMPLEXITY(10));
+	opus_encoder_ctl(encoder, OPUS_SET_INBAND_FEC(v->fec));
+	opus_encoder_ctl(encoder, OPUS_SET_PACKET_LOSS_PERC(v->fec ? 20 : 0));
+
+	decoder = opus_decoder_create(v->sample_rate, v->channels, &err);
+	if (err != OPUS_OK) {
+		return err;
+	}
+
+	synthesize(in, v->sample_rate * DURATION_MS / 1000, v->sample_rate, v->channels);
+	for (i = 0; i < packet_count; i++) {
+		lengths[i] = opus_encode(encoder, in + i * frame_size * v->channels, frame_size, packets[i], MAX_PACKET);
+		if (lengths[i] < 2 || (packets[i][0] >> 3) >= 12 || (packets[i][0] & 3) != 0) {
+			fprintf(stderr, "%s: packet %d isn't a single SILK-only frame\n", v->name, i);
+			return 1;
+		}
+	}
+
+	snprintf(path, sizeof(path), "%s.bin", v->name);
+	if ((file = fopen(path, "wb")) == NULL) {
+		perror(path);
+		return 1;
+	}
+	for (i = 0; i < packet_count; i++) {
+		int lost = v->loss_interval > 0 && i % v->loss_interval == v->loss_interval - 1 && i + 1 < packet_count;
+
+		if (lost && v->fec) {
+			opus_decode(decoder, packets[i + 1], lengths[i + 1], out, frame_size, 1);
+			write_record(file, FEC, decoder, packets[i + 1], lengths[i + 1], out, frame_size * v->channels);
+		} else if (lost) {
+			opus_decode(decoder, NULL, 0, out, frame_size, 0);
+			write_record(file, CONCEALED, decoder, NULL, 0, out, frame_size * v->channels);
+		} else {
+			opus_decode(decoder, packets[i], lengths[i], out, frame_size, 0);
+			write_record(file, DECODED, decoder, packets[i], lengths[i], out, frame_size * v->channels);
+		}
+	}
+	fclose(file);
+
+	opus_encoder_destroy(encoder);
+	opus_decoder_destroy(decoder);
+	free(packets);
+	free(lengths);
+	free(in);
+	free(out);
+	return 0;
+}
+
+int main(void) {
+	size_t i;
+
+	for (i = 0; i < sizeof(vectors) / sizeof(vectors[0]); i++) {
+		if (generate(&vectors[i]) != 0) {
+			fprintf(stderr, "%s: failed\n", vectors[i].name);
+			return 1;
+		}
+	}
+	return 0;
+}
@@ -0,0 +1,162 @@
+package opus
+
+import "fmt"
+
+const (
+	// Opus packets are at most 120 ms long, decoded at 48 kHz
+	maxPacketSamples = 120 * 48000 / 1000
+
+	// A mapping table entry of 255 marks a silent output channel
+	silentChannel = 255
+)
+
+// PCMDecoder decodes an Opus stream into interleaved float32 samples at 48
+// kHz. It returns the number of samples decoded per channel.
+type PCMDecoder interface {
+	DecodeFloat32(in []byte, out []float32) (int, error)
+}
+
+// Concealer conceals lost packets of an Opus stream, like
+// opus_decode_float without a packet. samples is the number of samples
+// per channel lost, at 48 kHz.
+type Concealer interface {
+	Conceal(out []float32, samples int) (int, error)
+}
+
+// MultistreamDecoder decodes packets made of several Opus streams into
+// multichannel audio, like opus_multistream_decoder. The first
+// coupledStreams streams are stereo and the rest are mono. Every output
+// channel is taken from one decoded channel, or is silent, according to
+// a mapping table.
+//
+// https://datatracker.ietf.org/doc/html/rfc7845#section-5.1.1
+type MultistreamDecoder struct {
+	channels       int
+	coupledStreams int
+	mapping        []uint8
+
+	decoders []PCMDecoder
+	buffers  [][]float32
+}
+
+// NewMultistreamDecoder creates a MultistreamDecoder with channels output
+// channels. The mapping table has one entry per output channel: entries
+// below 2*coupledStreams pick the left or right channel of a coupled
+// stream, the following ones the channel of an uncoupled stream, and 255
+// a silent channel. newDecoder is called once per stream with the number
+// of channels it decodes.
+func NewMultistreamDecoder(channels, streams, coupledStreams int, mapping []uint8, newDecoder func(channels int) PCMDecoder) (*MultistreamDecoder, error) {
+	switch {
+	case channels < 1 || channels > 255:
+		return nil, errInvalidChannelCount
+	case streams < 1 || coupledStreams < 0 || coupledStreams > streams || streams+coupledStreams > 255:
+		return nil, errInvalidStreamCount
+	case len(mapping) != channels:
+		return nil, errInvalidChannelMapping
+	}
+
+	for _, m := range mapping {
+		if m != silentChannel && int(m) >= streams+coupledStreams {
+			return nil, errInvalidChannelMapping
+		}
+	}
+
+	d := &MultistreamDecoder{
+		channels:       channels,
+		coupledStreams: coupledStreams,
+		mapping:        append([]uint8{}, mapping...),
+		decoders:       make([]PCMDecoder, streams),
+		buffers:        make([][]float32, streams),
+	}
+
+	for i := range d.decoders {
+		streamChannels := 1
+		if i < coupledStreams {
+			streamChannels = 2
+		}
+
+		d.decoders[i] = newDecoder(streamChannels)
+		d.buffers[i] = make([]float32, maxPacketSamples*streamChannels)
+	}
+
+	return d, nil
+}
+
+// DecodeFloat32 decodes a multistream packet into interleaved samples for
+// every output channel, and returns the number of samples per channel.
+//
+// All streams but the last one use the self-delimiting framing, so the
+// packet can be split into the packets of every stream. Each stream must
+// decode to the same duration.
+//
+// https://datatracker.ietf.org/doc/html/rfc6716#appendix-B
+func (d *MultistreamDecoder) DecodeFloat32(in []byte, out []float32) (int, error) {
+	packets := make([][]byte, len(d.decoders))
+	for i := range packets {
+		packets[i] = in
+		if i != len(d.decoders)-1 {
+			var err error
+			if packets[i], in, err = splitSelfDelimitedPacket(in); err != nil {
+				return 0, fmt.Errorf("%w: stream %d: %v", ErrCorruptedPacket, i, err)
+			}
+		}
+	}
+
+	return d.decode(out, func(i int, decoder PCMDecoder) (int, error) {
+		return decoder.DecodeFloat32(packets[i], d.buffers[i])
+	})
+}
+
+// Conceal conceals a lost multistream packet of samples samples per
+// channel in every stream, whose decoders must implement Concealer
+func (d *MultistreamDecoder) Conceal(out []float32, samples int) (int, error) {
+	if samples > maxPacketSamples {
+		return 0, errInvalidConcealmentDuration
+	}
+
+	return d.decode(out, func(i int, decoder PCMDecoder) (int, error) {
+		concealer, ok := decoder.(Concealer)
+		if !ok {
+			return 0, errConcealmentUnsupported
+		}
+		return concealer.Conceal(d.buffers[i], samples)
+	})
+}
+
+// decode runs decodeStream on every stream, then maps the decoded
+// channels to the output channels
+func (d *MultistreamDecoder) decode(out []float32, decodeStream func(i int, decoder PCMDecoder) (int, error)) (int, error) {
+	samples := -1
+	for i, decoder := range d.decoders {
+		streamSamples, err := decodeStream(i, decoder)
+		if err != nil {
+			return 0, err
+		} else if samples != -1 && streamSamples != samples {
+			return 0, fmt.Errorf("%w: stream %d has %d samples, expected %d", ErrCorruptedPacket, i, streamSamples, samples)
+		}
+		samples = streamSamples
+	}
+
+	if len(out) < samples*d.channels {
+		return 0, errOutputBufferTooShort
+	}
+
+	for channel, m := range d.mapping {
+		for i := 0; i < samples; i++ {
+			out[i*d.channels+channel] = d.decodedSample(m, i)
+		}
+	}
+
+	return samples, nil
+}
+
+func (d *MultistreamDecoder) decodedSample(m uint8, i int) float32 {
+	switch {
+	case m == silentChannel:
+		return 0
+	case int(m) < 2*d.coupledStreams:
+		return d.buffers[m/2][2*i+int(m%2)]
+	default:
+		return d.buffers[int(m)-d.coupledStreams][i]
+	}
+}
@@ -0,0 +1,135 @@
+package opus
+
+import (
+	"errors"
+	"testing"
+)
+
+// constantDecoder outputs the first byte after the TOC byte of each packet,
+// plus the channel index, on all of its channels
+type constantDecoder struct {
+	channels int
+}
+
+func (d *constantDecoder) DecodeFloat32(in []byte, out []float32) (int, error) {
+	samples, err := PacketSampleCount(in, 48000)
+	if err != nil {
+		return 0, err
+	}
+
+	for i := 0; i < samples*d.channels; i++ {
+		out[i] = float32(in[1]) + float32(i%d.channels)
+	}
+
+	return samples, nil
+}
+
+func newConstantDecoder(channels int) PCMDecoder {
+	return &constantDecoder{channels: channels}
+}
+
+func TestMultistreamDecoder(t *testing.T) {
+	// Two coupled streams and two mono ones for 5.1, with the channels
+	// reordered and the last output channel silent
+	decoder, err := NewMultistreamDecoder(7, 4, 2, []uint8{0, 4, 1, 2, 3, 5, 255}, newConstantDecoder)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	packet := []byte{
+		0x08, 1, 10, // Stream 0, self-delimited
+		0x08, 1, 20, // Stream 1, self-delimited
+		0x08, 1, 30, // Stream 2, self-delimited
+		0x08, 40, // Stream 3
+	}
+
+	out := make([]float32, 960*7)
+	samples, err := decoder.DecodeFloat32(packet, out)
+	switch {
+	case err != nil:
+		t.Fatal(err)
+	case samples != 960:
+		t.Fatal(samples)
+	}
+
+	expected := []float32{10, 30, 11, 20, 21, 40, 0}
+	for i, sample := range out {
+		if sample != expected[i%7] {
+			t.Fatalf("sample %d of channel %d: expected %f, got %f", i/7, i%7, expected[i%7], sample)
+		}
+	}
+}
+
+func TestMultistreamDecoder_Errors(t *testing.T) {
+	for _, test := range []struct {
+		name                              string
+		channels, streams, coupledStreams int
+		mapping                           []uint8
+		err                               error
+	}{
+		{"No channels", 0, 1, 0, []uint8{}, errInvalidChannelCount},
+		{"No streams", 1, 0, 0, []uint8{0}, errInvalidStreamCount},
+		{"Too many coupled streams", 2, 1, 2, []uint8{0, 1}, errInvalidStreamCount},
+		{"Mapping too short", 2, 1, 1, []uint8{0}, errInvalidChannelMapping},
+		{"Mapping out of range", 2, 1, 1, []uint8{0, 2}, errInvalidChannelMapping},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			_, err := NewMultistreamDecoder(test.channels, test.streams, test.coupledStreams, test.mapping, newConstantDecoder)
+			if !errors.Is(err, test.err) {
+				t.Fatalf("expected %v, got %v", test.err, err)
+			}
+		})
+	}
+
+	decoder, err := NewMultistreamDecoder(2, 2, 0, []uint8{0, 1}, newConstantDecoder)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	t.Run("Truncated stream", func(t *testing.T) {
+		if _, err := decoder.DecodeFloat32([]byte{0x08, 5, 0}, make([]float32, 1920)); !errors.Is(err, ErrCorruptedPacket) {
+			t.Fatal(err)
+		}
+	})
+
+	t.Run("Mismatched durations", func(t *testing.T) {
+		if _, err := decoder.DecodeFloat32([]byte{0x08, 1, 0, 0x10, 0}, make([]float32, 1920)); !errors.Is(err, ErrCorruptedPacket) {
+			t.Fatal(err)
+		}
+	})
+
+	t.Run("Output too short", func(t *testing.T) {
+		if _, err := decoder.DecodeFloat32([]byte{0x08, 1, 0, 0x08, 0}, make([]float32, 960)); !errors.Is(err, errOutputBufferTooShort) {
+			t.Fatal(err)
+		}
+	})
+}
+
+func TestMultistreamDecoder_Conceal(t *testing.T) {
+	decoder, err := NewMultistreamDecoder(3, 2, 1, []uint8{0, 1, 2}, NewStreamDecoder)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// A coupled stream then a mono one, both 20 ms CELT-only fullband
+	// silence frames
+	packet := []byte{0xfc, 2, 0xff, 0xff, 0xf8, 0xff, 0xff}
+	out := make([]float32, 960*3)
+	if _, err = decoder.DecodeFloat32(packet, out); err != nil {
+		t.Fatal(err)
+	}
+	if samples, err := decoder.Conceal(out, 480); err != nil || samples != 480 {
+		t.Fatalf("%d samples: %v", samples, err)
+	}
+	if _, err = decoder.Conceal(out, 2*maxPacketSamples); !errors.Is(err, errInvalidConcealmentDuration) {
+		t.Fatalf("expected %v, got %v", errInvalidConcealmentDuration, err)
+	}
+
+	constant, err := NewMultistreamDecoder(1, 1, 0, []uint8{0}, newConstantDecoder)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = constant.Conceal(out, 480); !errors.Is(err, errConcealmentUnsupported) {
+		t.Fatalf("expected %v, got %v", errConcealmentUnsupported, err)
+	}
+}
@@ -0,0 +1,542 @@
+package opus
+
+import (
+	"time"
+
+	"github.com/pion/opus/internal/rangecoding"
+)
+
+const (
+	maxPacketNanoseconds = 120000000
+
+	// SILK frames are 10 or 20 ms, an Opus frame of 40 or 60 ms holds
+	// several of them
+	silkFrameNanoseconds = 20000000
+
+	// No frame is longer than 1275 bytes [R2]
+	maxFrameLength = 1275
+)
+
+// PacketSampleCount returns the number of samples per channel an Opus
+// packet decodes to at the given sample rate, like
+// opus_packet_get_nb_samples. Only the TOC byte and, for code 3 packets,
+// the frame count byte are read.
+//
+// https://datatracker.ietf.org/doc/html/rfc6716#section-3.1
+func PacketSampleCount(in []byte, sampleRate int) (int, error) {
+	frameCount, err := packetFrameCount(in)
+	if err != nil {
+		return 0, err
+	}
+
+	nanoseconds := frameCount * tableOfContentsHeader(in[0]).configuration().frameDuration().nanoseconds()
+	if nanoseconds > maxPacketNanoseconds {
+		return 0, errPacketTooLong
+	}
+
+	return nanoseconds / 1000 * sampleRate / 1000000, nil
+}
+
+// PacketInfo is what the TOC byte and frame count of an Opus packet tell
+// about it
+type PacketInfo struct {
+	Configuration Configuration
+	Mode          Mode
+	Bandwidth     Bandwidth
+	IsStereo      bool
+	FrameDuration time.Duration
+	FrameCount    int
+}
+
+// ParsePacketInfo returns the mode, bandwidth, channels and framing of an
+// Opus packet without decoding it, like the opus_packet_get_* functions
+//
+// https://datatracker.ietf.org/doc/html/rfc6716#section-3.1
+func ParsePacketInfo(in []byte) (PacketInfo, error) {
+	frameCount, err := packetFrameCount(in)
+	if err != nil {
+		return PacketInfo{}, err
+	}
+
+	tocHeader := tableOfContentsHeader(in[0])
+	cfg := tocHeader.configuration()
+	info := PacketInfo{
+		Configuration: cfg,
+		Mode:          cfg.mode(),
+		Bandwidth:     cfg.bandwidth(),
+		IsStereo:      tocHeader.isStereo(),
+		FrameDuration: time.Duration(cfg.frameDuration().nanoseconds()),
+		FrameCount:    frameCount,
+	}
+
+	if time.Duration(frameCount)*info.FrameDuration > maxPacketNanoseconds {
+		return PacketInfo{}, errPacketTooLong
+	}
+
+	return info, nil
+}
+
+// The number of frames in a packet is signaled by the frame count code
+// of the TOC byte, or by the frame count byte that follows it for code 3
+// packets.
+//
+// https://datatracker.ietf.org/doc/html/rfc6716#section-3.2
+func packetFrameCount(in []byte) (int, error) {
+	if len(in) < 1 {
+		return 0, errTooShortForTableOfContentsHeader
+	}
+
+	switch tableOfContentsHeader(in[0]).frameCode() {
+	case frameCodeOneFrame:
+		return 1, nil
+	case frameCodeTwoEqualFrames, frameCodeTwoDifferentFrames:
+		return 2, nil
+	default:
+		if len(in) < 2 {
+			return 0, errTooShortForArbitraryLengthFrames
+		}
+
+		_, _, frameCount := parseFrameCountByte(in[1])
+		if frameCount == 0 {
+			return 0, errInvalidFrameCount
+		}
+
+		return int(frameCount), nil
+	}
+}
+
+// packetFrames splits an Opus packet into the compressed data of its
+// frames, like opus_packet_parse() (opus.c). Frames may be empty, for
+// DTX or a lost frame.
+//
+// https://datatracker.ietf.org/doc/html/rfc6716#section-3.2
+func packetFrames(in []byte) ([][]byte, error) {
+	frameCount, err := packetFrameCount(in)
+	if err != nil {
+		return nil, err
+	}
+	if frameCount*tableOfContentsHeader(in[0]).configuration().frameDuration().nanoseconds() > maxPacketNanoseconds {
+		return nil, errPacketTooLong
+	}
+
+	data := in[1:]
+	lengths := make([]int, frameCount)
+	switch tableOfContentsHeader(in[0]).frameCode() {
+	case frameCodeOneFrame:
+		lengths[0] = len(data)
+	case frameCodeTwoEqualFrames:
+		// Both frames have the same length [R3]
+		if len(data)%2 != 0 {
+			return nil, ErrCorruptedPacket
+		}
+		lengths[0], lengths[1] = len(data)/2, len(data)/2
+	case frameCodeTwoDifferentFrames:
+		length, size, err := parseFrameLength(data)
+		if err != nil || size+length > len(data) {
+			return nil, ErrCorruptedPacket
+		}
+		data = data[size:]
+		lengths[0], lengths[1] = length, len(data)-length
+	default:
+		isVBR, hasPadding, _ := parseFrameCountByte(data[0])
+		data = data[1:]
+
+		// The padding length is coded in bytes of which 255 means 254
+		// bytes and another length byte, and the padding is at the end
+		padding := 0
+		for hasPadding {
+			if len(data) == 0 {
+				return nil, ErrCorruptedPacket
+			}
+			hasPadding = data[0] == 255
+			if hasPadding {
+				padding += 254
+			} else {
+				padding += int(data[0])
+			}
+			data = data[1:]
+		}
+		if padding > len(data) {
+			return nil, ErrCorruptedPacket
+		}
+		data = data[:len(data)-padding]
+
+		if isVBR {
+			// All frames but the last have their length coded [R6]
+			total := 0
+			for i := 0; i < frameCount-1; i++ {
+				length, size, err := parseFrameLength(data)
+				if err != nil {
+					return nil, ErrCorruptedPacket
+				}
+				data = data[size:]
+				lengths[i] = length
+				total += length
+			}
+			if total > len(data) {
+				return nil, ErrCorruptedPacket
+			}
+			lengths[frameCount-1] = len(data) - total
+		} else {
+			// All frames have the same length [R6]
+			if len(data)%frameCount != 0 {
+				return nil, ErrCorruptedPacket
+			}
+			for i := range lengths {
+				lengths[i] = len(data) / frameCount
+			}
+		}
+	}
+
+	frames := make([][]byte, frameCount)
+	for i, length := range lengths {
+		if length > maxFrameLength {
+			return nil, ErrCorruptedPacket
+		}
+		frames[i], data = data[:length], data[length:]
+	}
+	return frames, nil
+}
+
+// padPacket pads the one frame code 0 packet in[:size] to length bytes,
+// like opus_packet_pad(). Longer packets are code 3 packets of one frame
+// with padding, whose length is coded in bytes of which 255 means 254
+// bytes and another length byte.
+//
+// https://datatracker.ietf.org/doc/html/rfc6716#section-3.2.5
+func padPacket(in []byte, size, length int) int {
+	if length <= size {
+		return size
+	}
+
+	frame := append([]byte{}, in[1:size]...)
+	in[0] = in[0]&^0b11 | byte(frameCodeArbitraryFrames)
+	in[1] = 1
+
+	i := 2
+	if padding := length - 2 - len(frame); padding > 0 {
+		in[1] |= 0b01000000
+		for ; padding > 255; padding -= 255 {
+			in[i] = 255
+			i++
+		}
+		in[i] = byte(padding - 1)
+		i++
+	}
+	i += copy(in[i:], frame)
+	for ; i < length; i++ {
+		in[i] = 0
+	}
+	return length
+}
+
+// packFrames writes the frames that share the TOC byte toc into out as a
+// packet padded to length bytes, like opus_repacketizer_out() does for
+// the frames of one encoder call, and returns its size. A single frame is
+// a code 0 packet, more are a code 3 packet, CBR when the frames are the
+// same size.
+//
+// https://datatracker.ietf.org/doc/html/rfc6716#section-3.2.5
+func packFrames(out []byte, toc byte, frames [][]byte, length int) (int, error) {
+	if len(frames) == 1 {
+		if len(out) < 1+len(frames[0]) {
+			return 0, errPacketBufferTooShort
+		}
+		out[0] = toc&^0b11 | byte(frameCodeOneFrame)
+		size := 1 + copy(out[1:], frames[0])
+		return padPacket(out, size, length), nil
+	}
+
+	isVBR := false
+	size := 2
+	for _, frame := range frames {
+		isVBR = isVBR || len(frame) != len(frames[0])
+		size += len(frame)
+	}
+	if isVBR {
+		for _, frame := range frames[:len(frames)-1] {
+			size += frameLengthSize(len(frame))
+		}
+	}
+
+	// The padding length is coded like that of padPacket, and its bytes
+	// count towards the padding
+	padding := length - size
+	if padding > 0 {
+		size = length
+	}
+	if len(out) < size {
+		return 0, errPacketBufferTooShort
+	}
+
+	out[0] = toc&^0b11 | byte(frameCodeArbitraryFrames)
+	out[1] = byte(len(frames))
+	if isVBR {
+		out[1] |= 0b10000000
+	}
+	i := 2
+	if padding > 0 {
+		out[1] |= 0b01000000
+		for ; padding > 255; padding -= 255 {
+			out[i] = 255
+			i++
+		}
+		out[i] = byte(padding - 1)
+		i++
+	}
+	if isVBR {
+		for _, frame := range frames[:len(frames)-1] {
+			i += writeFrameLength(out[i:], len(frame))
+		}
+	}
+	for _, frame := range frames {
+		i += copy(out[i:], frame)
+	}
+	for ; i < size; i++ {
+		out[i] = 0
+	}
+	return size, nil
+}
+
+// frameLengthSize returns the number of bytes a frame length is coded in
+func frameLengthSize(length int) int {
+	if length < 252 {
+		return 1
+	}
+	return 2
+}
+
+// writeFrameLength codes a frame length at the start of out, the inverse
+// of parseFrameLength, and returns the number of bytes written
+func writeFrameLength(out []byte, length int) int {
+	if length < 252 {
+		out[0] = byte(length)
+		return 1
+	}
+	out[0] = byte(252 + length&0b11)
+	out[1] = byte((length - int(out[0])) >> 2)
+	return 2
+}
+
+// Frame lengths are coded in one or two bytes. A first byte below 252
+// is the length itself, otherwise the length is the first byte plus four
+// times the second byte.
+//
+// https://datatracker.ietf.org/doc/html/rfc6716#section-3.2.1
+func parseFrameLength(in []byte) (length int, size int, err error) {
+	switch {
+	case len(in) < 1:
+		return 0, 0, errMalformedSelfDelimitedPacket
+	case in[0] < 252:
+		return int(in[0]), 1, nil
+	case len(in) < 2:
+		return 0, 0, errMalformedSelfDelimitedPacket
+	default:
+		return int(in[0]) + 4*int(in[1]), 2, nil
+	}
+}
+
+// splitSelfDelimitedPacket splits the self-delimited packet at the start
+// of in from what follows it, and returns it in the regular format.
+//
+// The self-delimiting format adds the length of one frame to the regular
+// format. For code 0 and 1 packets it is the length of every frame, and
+// it follows the TOC byte. For code 2 packets it is the length of the
+// second frame, and it follows the length of the first one. For code 3
+// packets it follows the padding and frame lengths, and is the length of
+// every frame for CBR packets or of the last frame for VBR packets.
+//
+// https://datatracker.ietf.org/doc/html/rfc6716#appendix-B
+func splitSelfDelimitedPacket(in []byte) (packet []byte, rest []byte, err error) {
+	if len(in) < 1 {
+		return nil, nil, errTooShortForTableOfContentsHeader
+	}
+
+	headerSize := 1
+	dataSize := 0
+	frameCount := 1
+	switch tableOfContentsHeader(in[0]).frameCode() {
+	case frameCodeOneFrame:
+	case frameCodeTwoEqualFrames:
+		frameCount = 2
+	case frameCodeTwoDifferentFrames:
+		length, size, err := parseFrameLength(in[headerSize:])
+		if err != nil {
+			return nil, nil, err
+		}
+
+		headerSize += size
+		dataSize += length
+	default:
+		if len(in) < 2 {
+			return nil, nil, errTooShortForArbitraryLengthFrames
+		}
+
+		isVBR, hasPadding, count := parseFrameCountByte(in[1])
+		if count == 0 {
+			return nil, nil, errInvalidFrameCount
+		}
+		headerSize++
+
+		// Padding is added after the frames, its length is coded in
+		// bytes of which 255 means 254 bytes and another length byte
+		for hasPadding {
+			if headerSize >= len(in) {
+				return nil, nil, errMalformedSelfDelimitedPacket
+			}
+
+			padding := int(in[headerSize])
+			headerSize++
+			hasPadding = padding == 255
+			if hasPadding {
+				padding = 254
+			}
+			dataSize += padding
+		}
+
+		if isVBR {
+			for i := 1; i < int(count); i++ {
+				length, size, err := parseFrameLength(in[headerSize:])
+				if err != nil {
+					return nil, nil, err
+				}
+
+				headerSize += size
+				dataSize += length
+			}
+		} else {
+			frameCount = int(count)
+		}
+	}
+
+	length, size, err := parseFrameLength(in[headerSize:])
+	if err != nil {
+		return nil, nil, err
+	}
+
+	dataSize += frameCount * length
+	end := headerSize + size + dataSize
+	if end > len(in) {
+		return nil, nil, errMalformedSelfDelimitedPacket
+	}
+
+	packet = make([]byte, 0, headerSize+dataSize)
+	packet = append(packet, in[:headerSize]...)
+	packet = append(packet, in[headerSize+size:end]...)
+	return packet, in[end:], nil
+}
+
+// PacketHasLBRR reports whether an Opus packet carries low bitrate
+// redundancy (LBRR), the in-band FEC of SILK and Hybrid modes that can
+// recover the packet before it, like opus_packet_has_lbrr. Only the LBRR
+// flags of the first frame are read.
+//
+// The SILK layer starts with one voice activity flag per SILK frame
+// followed by the LBRR flag, for the mid channel and then for the side
+// channel of stereo packets.
+//
+// https://datatracker.ietf.org/doc/html/rfc6716#section-4.2.3
+func PacketHasLBRR(in []byte) (bool, error) {
+	frame, err := packetFirstFrame(in)
+	if err != nil {
+		return false, err
+	}
+
+	tocHeader := tableOfContentsHeader(in[0])
+	cfg := tocHeader.configuration()
+	if cfg.mode() == ModeCELTOnly || len(frame) == 0 {
+		return false, nil
+	}
+
+	silkFrames := cfg.frameDuration().nanoseconds() / silkFrameNanoseconds
+	if silkFrames == 0 {
+		silkFrames = 1
+	}
+
+	channels := 1
+	if tocHeader.isStereo() {
+		channels = 2
+	}
+
+	rangeDecoder := rangecoding.Decoder{}
+	rangeDecoder.Init(frame)
+	for i := 0; i < channels; i++ {
+		for j := 0; j < silkFrames; j++ {
+			rangeDecoder.DecodeSymbolLogP(1)
+		}
+
+		if rangeDecoder.DecodeSymbolLogP(1) == 1 {
+			return true, nil
+		}
+	}
+
+	return false, nil
+}
+
+// packetFirstFrame returns the compressed data of the first frame of a
+// packet
+//
+// https://datatracker.ietf.org/doc/html/rfc6716#section-3.2
+func packetFirstFrame(in []byte) ([]byte, error) {
+	if len(in) < 1 {
+		return nil, errTooShortForTableOfContentsHeader
+	}
+
+	switch tableOfContentsHeader(in[0]).frameCode() {
+	case frameCodeOneFrame:
+		return in[1:], nil
+	case frameCodeTwoEqualFrames:
+		if len(in)%2 != 1 {
+			return nil, ErrCorruptedPacket
+		}
+
+		return in[1 : 1+len(in)/2], nil
+	case frameCodeTwoDifferentFrames:
+		length, size, err := parseFrameLength(in[1:])
+		if err != nil || 1+size+length > len(in) {
+			return nil, ErrCorruptedPacket
+		}
+
+		return in[1+size : 1+size+length], nil
+	default:
+		if len(in) < 2 {
+			return nil, errTooShortForArbitraryLengthFrames
+		}
+
+		isVBR, hasPadding, count := parseFrameCountByte(in[1])
+		if count == 0 {
+			return nil, errInvalidFrameCount
+		}
+
+		headerSize, padding := 2, 0
+		for hasPadding {
+			if headerSize >= len(in) {
+				return nil, ErrCorruptedPacket
+			}
+
+			hasPadding = in[headerSize] == 255
+			if hasPadding {
+				padding += 254
+			} else {
+				padding += int(in[headerSize])
+			}
+			headerSize++
+		}
+
+		if isVBR {
+			length, size, err := parseFrameLength(in[headerSize:])
+			if err != nil || headerSize+size+length > len(in)-padding {
+				return nil, ErrCorruptedPacket
+			}
+
+			return in[headerSize+size : headerSize+size+length], nil
+		}
+
+		dataSize := len(in) - headerSize - padding
+		if dataSize < 0 || dataSize%int(count) != 0 {
+			return nil, ErrCorruptedPacket
+		}
+
+		return in[headerSize : headerSize+dataSize/int(count)], nil
+	}
+}
@@ -0,0 +1,276 @@
+package opus
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/pion/opus/internal/rangecoding"
+)
+
+func TestPacketSampleCount(t *testing.T) {
+	for _, test := range []struct {
+		packet     []byte
+		sampleRate int
+		samples    int
+		err        error
+	}{
+		{[]byte{0x08}, 48000, 960, nil},                               // SILK NB 20ms, one frame
+		{[]byte{0x0a}, 48000, 1920, nil},                              // SILK NB 20ms, two different frames
+		{[]byte{0x18}, 16000, 960, nil},                               // SILK NB 60ms, one frame
+		{[]byte{0x50}, 48000, 1920, nil},                              // SILK WB 40ms, one frame
+		{[]byte{0x83, 0x05}, 48000, 600, nil},                         // CELT NB 2.5ms, five frames
+		{[]byte{0xfb, 0x06}, 48000, 5760, nil},                        // CELT FB 20ms, six frames
+		{[]byte{0xfb, 0x07}, 48000, 0, errPacketTooLong},              // CELT FB 20ms, seven frames
+		{[]byte{0xfb, 0x00}, 48000, 0, errInvalidFrameCount},          // Code 3 with no frames
+		{[]byte{0xfb}, 48000, 0, errTooShortForArbitraryLengthFrames}, // Missing frame count byte
+		{[]byte{}, 48000, 0, errTooShortForTableOfContentsHeader},     // Missing TOC byte
+	} {
+		samples, err := PacketSampleCount(test.packet, test.sampleRate)
+		switch {
+		case !errors.Is(err, test.err):
+			t.Fatalf("%x: expected error %v, got %v", test.packet, test.err, err)
+		case samples != test.samples:
+			t.Fatalf("%x: expected %d samples, got %d", test.packet, test.samples, samples)
+		}
+	}
+}
+
+func TestParsePacketInfo(t *testing.T) {
+	for _, test := range []struct {
+		packet []byte
+		info   PacketInfo
+		err    error
+	}{
+		{[]byte{0x08}, PacketInfo{1, ModeSilkOnly, BandwidthNarrowband, false, 20 * time.Millisecond, 1}, nil},
+		{[]byte{0x7d}, PacketInfo{15, ModeHybrid, BandwidthFullband, true, 20 * time.Millisecond, 2}, nil},
+		{[]byte{0x83, 0x05}, PacketInfo{16, ModeCELTOnly, BandwidthNarrowband, false, 2500 * time.Microsecond, 5}, nil},
+		{[]byte{0xfb, 0x07}, PacketInfo{}, errPacketTooLong},
+		{[]byte{}, PacketInfo{}, errTooShortForTableOfContentsHeader},
+	} {
+		info, err := ParsePacketInfo(test.packet)
+		switch {
+		case !errors.Is(err, test.err):
+			t.Fatalf("%x: expected error %v, got %v", test.packet, test.err, err)
+		case info != test.info:
+			t.Fatalf("%x: expected %+v, got %+v", test.packet, test.info, info)
+		}
+	}
+}
+
+func TestSplitSelfDelimitedPacket(t *testing.T) {
+	frame := func(size int, value byte) []byte {
+		return bytes.Repeat([]byte{value}, size)
+	}
+	concat := func(parts ...[]byte) []byte {
+		out := []byte{}
+		for _, part := range parts {
+			out = append(out, part...)
+		}
+		return out
+	}
+
+	for _, test := range []struct {
+		name   string
+		in     []byte
+		packet []byte
+		err    error
+	}{
+		{
+			"One frame",
+			concat([]byte{0x08, 3}, frame(3, 1)),
+			concat([]byte{0x08}, frame(3, 1)),
+			nil,
+		},
+		{
+			"One frame, two byte length",
+			concat([]byte{0x08, 252, 1}, frame(256, 1)),
+			concat([]byte{0x08}, frame(256, 1)),
+			nil,
+		},
+		{
+			"Two equal frames",
+			concat([]byte{0x09, 2}, frame(2, 1), frame(2, 2)),
+			concat([]byte{0x09}, frame(2, 1), frame(2, 2)),
+			nil,
+		},
+		{
+			"Two different frames",
+			concat([]byte{0x0a, 1, 3}, frame(1, 1), frame(3, 2)),
+			concat([]byte{0x0a, 1}, frame(1, 1), frame(3, 2)),
+			nil,
+		},
+		{
+			"CBR arbitrary frames with padding",
+			concat([]byte{0x0b, 0x43, 255, 1, 2}, frame(6, 1), frame(255, 0)),
+			concat([]byte{0x0b, 0x43, 255, 1}, frame(6, 1), frame(255, 0)),
+			nil,
+		},
+		{
+			"VBR arbitrary frames",
+			concat([]byte{0x0b, 0x83, 1, 2, 3}, frame(1, 1), frame(2, 2), frame(3, 3)),
+			concat([]byte{0x0b, 0x83, 1, 2}, frame(1, 1), frame(2, 2), frame(3, 3)),
+			nil,
+		},
+		{"Truncated frame", []byte{0x08, 3, 0}, nil, errMalformedSelfDelimitedPacket},
+		{"Missing length", []byte{0x08}, nil, errMalformedSelfDelimitedPacket},
+		{"Missing frame count", []byte{0x0b}, nil, errTooShortForArbitraryLengthFrames},
+		{"Empty", []byte{}, nil, errTooShortForTableOfContentsHeader},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			// The packet of the next stream follows valid packets
+			in, next := test.in, []byte{}
+			if test.err == nil {
+				next = []byte{0xf8, 0xff}
+				in = append(in, next...)
+			}
+
+			packet, rest, err := splitSelfDelimitedPacket(in)
+			switch {
+			case test.err != nil && errors.Is(err, test.err):
+			case err != nil:
+				t.Fatalf("expected error %v, got %v", test.err, err)
+			case !bytes.Equal(packet, test.packet):
+				t.Fatalf("expected packet %x, got %x", test.packet, packet)
+			case !bytes.Equal(rest, next):
+				t.Fatalf("expected the next packet %x, got %x", next, rest)
+			}
+		})
+	}
+}
+
+func TestPacketFrames(t *testing.T) {
+	frame := func(size int, value byte) []byte {
+		return bytes.Repeat([]byte{value}, size)
+	}
+	concat := func(parts ...[]byte) []byte {
+		out := []byte{}
+		for _, part := range parts {
+			out = append(out, part...)
+		}
+		return out
+	}
+
+	for _, test := range []struct {
+		name   string
+		in     []byte
+		frames [][]byte
+		err    error
+	}{
+		{"One frame", concat([]byte{0x08}, frame(3, 1)), [][]byte{frame(3, 1)}, nil},
+		{"DTX", []byte{0x08}, [][]byte{{}}, nil},
+		{"Two equal frames", concat([]byte{0x09}, frame(2, 1), frame(2, 2)), [][]byte{frame(2, 1), frame(2, 2)}, nil},
+		{"Two different frames", concat([]byte{0x0a, 1}, frame(1, 1), frame(3, 2)), [][]byte{frame(1, 1), frame(3, 2)}, nil},
+		{"Two different frames, the second lost", concat([]byte{0x0a, 2}, frame(2, 1)), [][]byte{frame(2, 1), {}}, nil},
+		{
+			"CBR arbitrary frames with padding",
+			concat([]byte{0x0b, 0x43, 255, 1}, frame(6, 1), frame(255, 0)),
+			[][]byte{frame(2, 1), frame(2, 1), frame(2, 1)},
+			nil,
+		},
+		{
+			"VBR arbitrary frames",
+			concat([]byte{0x0b, 0x83, 1, 2}, frame(1, 1), frame(2, 2), frame(3, 3)),
+			[][]byte{frame(1, 1), frame(2, 2), frame(3, 3)},
+			nil,
+		},
+		{"Unequal frames", concat([]byte{0x09}, frame(3, 1)), nil, ErrCorruptedPacket},
+		{"Truncated frame", []byte{0x0a, 3, 0}, nil, ErrCorruptedPacket},
+		{"Truncated padding", []byte{0x0b, 0x41, 10, 0}, nil, ErrCorruptedPacket},
+		{"Truncated frame lengths", []byte{0x0b, 0x83, 1}, nil, ErrCorruptedPacket},
+		{"Uneven CBR frames", concat([]byte{0x0b, 0x03}, frame(4, 1)), nil, ErrCorruptedPacket},
+		{"Frame too long", concat([]byte{0x08}, frame(1276, 1)), nil, ErrCorruptedPacket},
+		{"Too long", []byte{0xfb, 0x07}, nil, errPacketTooLong},
+		{"Empty", []byte{}, nil, errTooShortForTableOfContentsHeader},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			frames, err := packetFrames(test.in)
+			switch {
+			case !errors.Is(err, test.err):
+				t.Fatalf("expected error %v, got %v", test.err, err)
+			case len(frames) != len(test.frames):
+				t.Fatalf("expected %d frames, got %d", len(test.frames), len(frames))
+			}
+			for i := range frames {
+				if !bytes.Equal(frames[i], test.frames[i]) {
+					t.Fatalf("frame %d: expected %x, got %x", i, test.frames[i], frames[i])
+				}
+			}
+		})
+	}
+}
+
+func TestPadPacket(t *testing.T) {
+	frame := []byte{1, 2, 3, 4}
+	for _, length := range []int{5, 6, 7, 100, 262, 263, 600} {
+		packet := make([]byte, length)
+		packet[0] = 0x08
+		copy(packet[1:], frame)
+
+		if size := padPacket(packet, 1+len(frame), length); size != length {
+			t.Fatalf("padded to %d bytes, expected %d", size, length)
+		}
+		frames, err := packetFrames(packet)
+		switch {
+		case err != nil:
+			t.Fatalf("%d bytes: %v", length, err)
+		case len(frames) != 1 || !bytes.Equal(frames[0], frame):
+			t.Fatalf("%d bytes: frames %x", length, frames)
+		case packet[0]>>2 != 0x08>>2:
+			t.Fatalf("%d bytes: TOC byte %02x", length, packet[0])
+		}
+	}
+}
+
+// encodeSilkHeaderBits encodes the voice activity and LBRR flags that
+// start the SILK layer
+func encodeSilkHeaderBits(t *testing.T, flags ...uint32) []byte {
+	encoder := rangecoding.Encoder{}
+	encoder.Init(make([]byte, 8))
+	for _, flag := range flags {
+		encoder.EncodeSymbolLogP(1, flag)
+	}
+
+	frame, err := encoder.Done()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return frame
+}
+
+func TestPacketHasLBRR(t *testing.T) {
+	withTOC := func(toc byte, frame []byte) []byte {
+		return append([]byte{toc}, frame...)
+	}
+
+	for _, test := range []struct {
+		name   string
+		packet []byte
+		hasFEC bool
+		err    error
+	}{
+		{"SILK 20ms with LBRR", withTOC(0x08, encodeSilkHeaderBits(t, 1, 1)), true, nil},
+		{"SILK 20ms without LBRR", withTOC(0x08, encodeSilkHeaderBits(t, 1, 0)), false, nil},
+		{"SILK 60ms with LBRR", withTOC(0x18, encodeSilkHeaderBits(t, 0, 1, 0, 1)), true, nil},
+		{"SILK 60ms without LBRR", withTOC(0x18, encodeSilkHeaderBits(t, 1, 1, 1, 0)), false, nil},
+		{"Stereo with side LBRR", withTOC(0x0c, encodeSilkHeaderBits(t, 1, 0, 1, 1)), true, nil},
+		{"Hybrid with LBRR", withTOC(0x68, encodeSilkHeaderBits(t, 1, 1)), true, nil},
+		{"CELT", withTOC(0xf8, encodeSilkHeaderBits(t, 1, 1)), false, nil},
+		{"DTX", []byte{0x08}, false, nil},
+		{"Code 3 CBR", append([]byte{0x0b, 0x02}, append(encodeSilkHeaderBits(t, 1, 1), encodeSilkHeaderBits(t, 1, 0)...)...), true, nil},
+		{"Code 3 truncated", []byte{0x0b, 0x82, 10, 0}, false, ErrCorruptedPacket},
+		{"Empty", []byte{}, false, errTooShortForTableOfContentsHeader},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			hasFEC, err := PacketHasLBRR(test.packet)
+			switch {
+			case !errors.Is(err, test.err):
+				t.Fatalf("expected error %v, got %v", test.err, err)
+			case hasFEC != test.hasFEC:
+				t.Fatalf("expected %t, got %t", test.hasFEC, hasFEC)
+			}
+		})
+	}
+}
@@ -0,0 +1,154 @@
+package mp4reader
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+)
+
+const (
+	boxHeaderLen      = 8
+	largeBoxHeaderLen = 16
+
+	// Boxes are read into memory whole, except for the media data
+	maxBoxSize = 64 * 1024 * 1024
+)
+
+var (
+	errShortBox    = errors.New("box is too short for its content")
+	errBadBoxSize  = errors.New("box size is smaller than its header")
+	errBoxTooLarge = errors.New("box is too large")
+)
+
+// Every box starts with its size, including the header, and its type. A
+// size of 1 means a 64-bit size follows the type, and a size of 0 that
+// the box extends to the end of the file.
+//
+// ISO/IEC 14496-12 section 4.2
+type boxHeader struct {
+	boxType   string
+	headerLen int64
+	size      int64
+	toEnd     bool
+}
+
+func readBoxHeader(r io.Reader) (*boxHeader, error) {
+	buffer := make([]byte, largeBoxHeaderLen)
+	if _, err := io.ReadFull(r, buffer[:boxHeaderLen]); err != nil {
+		return nil, err
+	}
+
+	header := &boxHeader{
+		boxType:   string(buffer[4:8]),
+		headerLen: boxHeaderLen,
+		size:      int64(binary.BigEndian.Uint32(buffer)),
+	}
+
+	switch header.size {
+	case 0:
+		header.toEnd = true
+		return header, nil
+	case 1:
+		if _, err := io.ReadFull(r, buffer[boxHeaderLen:]); err != nil {
+			return nil, unexpectedEOF(err)
+		}
+		header.headerLen = largeBoxHeaderLen
+		header.size = int64(binary.BigEndian.Uint64(buffer[boxHeaderLen:]))
+	}
+
+	if header.size < header.headerLen {
+		return nil, errBadBoxSize
+	}
+
+	return header, nil
+}
+
+// boxChildren iterates over the boxes contained in a box read into memory
+func boxChildren(data []byte, fn func(boxType string, data []byte) error) error {
+	for len(data) != 0 {
+		header, err := readBoxHeader(bytes.NewReader(data))
+		if err != nil {
+			return unexpectedEOF(err)
+		}
+
+		size := int64(len(data))
+		if !header.toEnd {
+			if header.size > size {
+				return errShortBox
+			}
+			size = header.size
+		}
+
+		if err = fn(header.boxType, data[header.headerLen:size]); err != nil {
+			return err
+		}
+		data = data[size:]
+	}
+
+	return nil
+}
+
+// cursor reads the big endian fields of a box, and remembers when the box
+// was too short for them
+type cursor struct {
+	data  []byte
+	short bool
+}
+
+func (c *cursor) next(n int) []byte {
+	if c.short || len(c.data) < n {
+		c.short = true
+		return make([]byte, n)
+	}
+
+	out := c.data[:n]
+	c.data = c.data[n:]
+	return out
+}
+
+func (c *cursor) uint8() uint8 {
+	return c.next(1)[0]
+}
+
+func (c *cursor) uint16() uint16 {
+	return binary.BigEndian.Uint16(c.next(2))
+}
+
+func (c *cursor) uint32() uint32 {
+	return binary.BigEndian.Uint32(c.next(4))
+}
+
+func (c *cursor) uint64() uint64 {
+	return binary.BigEndian.Uint64(c.next(8))
+}
+
+// versioned reads a field that is 64 bits in version 1 of a full box and
+// 32 bits otherwise
+func (c *cursor) versioned(version uint8) uint64 {
+	if version == 1 {
+		return c.uint64()
+	}
+	return uint64(c.uint32())
+}
+
+// fullBox reads the version and flags that start full boxes
+func (c *cursor) fullBox() (version uint8, flags uint32) {
+	versionAndFlags := c.uint32()
+	return uint8(versionAndFlags >> 24), versionAndFlags & 0xffffff
+}
+
+func (c *cursor) err() error {
+	if c.short {
+		return errShortBox
+	}
+	return nil
+}
+
+func unexpectedEOF(err error) error {
+	if errors.Is(err, io.EOF) {
+		return io.ErrUnexpectedEOF
+	}
+
+	return err
+}
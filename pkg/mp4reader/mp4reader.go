@@ -0,0 +1,747 @@
+// Package mp4reader implements an MP4 (ISO base media file format) reader
+// for Opus tracks
+package mp4reader
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+	"time"
+
+	"github.com/pion/opus/pkg/oggreader"
+)
+
+const (
+	opusSampleRate = 48000
+
+	// The audio sample entry fields before the child boxes
+	//
+	// ISO/IEC 14496-12 section 12.2.3
+	audioSampleEntryLen = 28
+
+	dOpsMinLen = 11
+
+	// An edit list media time of -1 is an empty edit, which delays the
+	// presentation of the media
+	emptyEditMediaTime = -1
+
+	tfhdBaseDataOffset       = 0x000001
+	tfhdSampleDescription    = 0x000002
+	tfhdDefaultDuration      = 0x000008
+	tfhdDefaultSize          = 0x000010
+	tfhdDefaultFlags         = 0x000020
+	tfhdDefaultBaseIsMoof    = 0x020000
+	trunDataOffset           = 0x000001
+	trunFirstSampleFlags     = 0x000004
+	trunSampleDuration       = 0x000100
+	trunSampleSize           = 0x000200
+	trunSampleFlags          = 0x000400
+	trunSampleCompositionOff = 0x000800
+)
+
+var (
+	errNilStream           = errors.New("stream is nil")
+	errNoOpusTrack         = errors.New("no track with an Opus sample entry found")
+	errNoMovieBox          = errors.New("fragment found before the movie box")
+	errBadDOpsVersion      = errors.New("unsupported dOps version")
+	errNoDOps              = errors.New("Opus sample entry has no dOps box")
+	errBadTimescale        = errors.New("track timescale is zero")
+	errBadSampleTable      = errors.New("sample table boxes don't agree on the number of samples")
+	errSampleSizeTooLarge  = errors.New("sample is larger than the maximum size")
+	errUnknownSampleLength = errors.New("fragment sample has no size and the track no default")
+	errUnknownDataOffset   = errors.New("fragment data follows a track fragment that can't be sized")
+)
+
+// Track is the Opus track of an MP4 file
+type Track struct {
+	ID uint32
+
+	// Header is the dOps box, in the form of the Ogg Opus ID header it
+	// maps to
+	Header *oggreader.OggHeader
+
+	// Timescale is the number of media time units per second, which
+	// should be 48000 for Opus
+	Timescale uint32
+}
+
+// PacketHeader is the metadata of a packet returned by ReadPacket
+type PacketHeader struct {
+	// Timestamp is the presentation time of the packet, after the edit
+	// list. Packets decoded only to prime the decoder have negative
+	// timestamps.
+	Timestamp time.Duration
+
+	// Samples is the duration of the packet, and DiscardStart and
+	// DiscardEnd the number of samples to drop from the start and the end
+	// of its decoded audio, all at 48 kHz. They come from the edit list,
+	// or from the pre-skip of the dOps box when there is none.
+	Samples      int
+	DiscardStart int
+	DiscardEnd   int
+}
+
+type sample struct {
+	offset     int64
+	size       uint32
+	decodeTime int64
+	duration   uint32
+}
+
+type edit struct {
+	segmentDuration uint64
+	mediaTime       int64
+}
+
+// trackBox holds what is read from a trak box
+type trackBox struct {
+	track *Track
+	edits []edit
+
+	// fileSize bounds the number of samples the sample table can describe
+	fileSize int64
+
+	sampleSizes     []uint32
+	chunkOffsets    []int64
+	samplesPerChunk []sampleToChunk
+	sampleDurations []timeToSample
+}
+
+type sampleToChunk struct {
+	firstChunk      uint32
+	samplesPerChunk uint32
+}
+
+type timeToSample struct {
+	count    uint32
+	duration uint32
+}
+
+// trackDefaults are the trex defaults of the samples of fragments
+type trackDefaults struct {
+	duration uint32
+	size     uint32
+}
+
+// MP4Reader reads the packets of the Opus track of an MP4 file, as mapped
+// by the Encapsulation of Opus in ISO Base Media File Format
+// specification. Both files with a sample table and fragmented files are
+// supported.
+//
+// https://opus-codec.org/docs/opus_in_isobmff.html
+type MP4Reader struct {
+	stream   io.ReadSeeker
+	track    *Track
+	fileSize int64
+
+	movieTimescale uint32
+
+	// The trex defaults of the samples of fragments, per track ID
+	defaults map[uint32]trackDefaults
+
+	samples        []sample
+	next           int
+	nextDecodeTime int64
+
+	// Media times where presentation starts and ends, and the duration of
+	// empty edits before it
+	editStart  int64
+	editEnd    int64
+	hasEditEnd bool
+	emptyEdits int64
+}
+
+// NewWith returns a new MP4 reader and the Opus track. The whole box
+// structure is read up front, the media data is read by ReadPacket.
+func NewWith(in io.ReadSeeker) (*MP4Reader, *Track, error) {
+	if in == nil {
+		return nil, nil, errNilStream
+	}
+
+	fileSize, err := in.Seek(0, io.SeekEnd)
+	if err != nil {
+		return nil, nil, err
+	} else if _, err = in.Seek(0, io.SeekStart); err != nil {
+		return nil, nil, err
+	}
+
+	r := &MP4Reader{stream: in, fileSize: fileSize}
+	if err = r.readBoxes(); err != nil {
+		return nil, nil, err
+	} else if r.track == nil {
+		return nil, nil, errNoOpusTrack
+	}
+
+	if _, err = r.stream.Seek(0, io.SeekStart); err != nil {
+		return nil, nil, err
+	}
+
+	return r, r.track, nil
+}
+
+// ReadPacket returns the next packet of the Opus track, in decoding order
+func (r *MP4Reader) ReadPacket() ([]byte, *PacketHeader, error) {
+	if r.next >= len(r.samples) {
+		return nil, nil, io.EOF
+	}
+
+	s := r.samples[r.next]
+	if s.size > maxBoxSize {
+		return nil, nil, errSampleSizeTooLarge
+	}
+
+	if _, err := r.stream.Seek(s.offset, io.SeekStart); err != nil {
+		return nil, nil, err
+	}
+
+	packet := make([]byte, s.size)
+	if _, err := io.ReadFull(r.stream, packet); err != nil {
+		return nil, nil, unexpectedEOF(err)
+	}
+	r.next++
+
+	return packet, r.packetHeader(s), nil
+}
+
+// The edit list maps media time to presentation time. Media before the
+// start of the first edit is the encoder priming, and media after its end
+// the padding of the last packet.
+//
+// ISO/IEC 14496-12 section 8.6.6
+func (r *MP4Reader) packetHeader(s sample) *PacketHeader {
+	start := s.decodeTime - r.editStart
+	end := start + int64(s.duration)
+
+	header := &PacketHeader{
+		Timestamp: time.Duration(start+r.emptyEdits) * time.Second / time.Duration(r.track.Timescale),
+		Samples:   r.toSamples(int64(s.duration)),
+	}
+
+	if start < 0 {
+		header.DiscardStart = r.toSamples(minInt64(-start, int64(s.duration)))
+	}
+
+	if r.hasEditEnd {
+		if mediaEnd := r.editEnd - r.editStart; end > mediaEnd {
+			header.DiscardEnd = r.toSamples(minInt64(end-mediaEnd, int64(s.duration)))
+		}
+	}
+
+	return header
+}
+
+func (r *MP4Reader) toSamples(mediaTime int64) int {
+	return int(mediaTime * opusSampleRate / int64(r.track.Timescale))
+}
+
+// readBoxes walks the top level boxes. The movie box may follow the media
+// data, so this seeks over boxes that aren't needed.
+func (r *MP4Reader) readBoxes() error {
+	var offset int64
+	for {
+		header, err := readBoxHeader(r.stream)
+		if errors.Is(err, io.EOF) {
+			return nil
+		} else if err != nil {
+			return unexpectedEOF(err)
+		}
+
+		switch header.boxType {
+		case "moov", "moof":
+			if header.toEnd || header.size > maxBoxSize {
+				return errBoxTooLarge
+			}
+
+			data := make([]byte, header.size-header.headerLen)
+			if _, err = io.ReadFull(r.stream, data); err != nil {
+				return unexpectedEOF(err)
+			}
+
+			if header.boxType == "moov" {
+				err = r.parseMovie(data)
+			} else {
+				err = r.parseMovieFragment(data, offset)
+			}
+			if err != nil {
+				return err
+			}
+		default:
+			if header.toEnd {
+				return nil
+			}
+
+			if _, err = r.stream.Seek(offset+header.size, io.SeekStart); err != nil {
+				return err
+			}
+		}
+
+		offset += header.size
+	}
+}
+
+func (r *MP4Reader) parseMovie(data []byte) error {
+	var trackBoxes []*trackBox
+	err := boxChildren(data, func(boxType string, data []byte) error {
+		switch boxType {
+		case "mvhd":
+			c := &cursor{data: data}
+			version, _ := c.fullBox()
+			c.versioned(version)
+			c.versioned(version)
+			r.movieTimescale = c.uint32()
+			return c.err()
+		case "trak":
+			t, err := parseTrack(data, r.fileSize)
+			if err == nil && t.track.Header != nil {
+				trackBoxes = append(trackBoxes, t)
+			}
+			return err
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	} else if len(trackBoxes) == 0 {
+		return errNoOpusTrack
+	}
+
+	t := trackBoxes[0]
+	if t.track.Timescale == 0 {
+		return errBadTimescale
+	}
+
+	r.track = t.track
+	r.applyEdits(t)
+
+	// The trex boxes hold the defaults of fragments, per track
+	if r.defaults, err = parseTrackExtends(data); err != nil {
+		return err
+	}
+
+	return r.buildSamples(t)
+}
+
+// parseTrackExtends reads the trex defaults of every track in the movie
+// box. Track fragments of the other tracks are sized with them to find
+// where the data of the next track fragment starts.
+func parseTrackExtends(movie []byte) (map[uint32]trackDefaults, error) {
+	defaults := map[uint32]trackDefaults{}
+	err := boxChildren(movie, func(boxType string, data []byte) error {
+		if boxType != "mvex" {
+			return nil
+		}
+
+		return boxChildren(data, func(boxType string, data []byte) error {
+			if boxType != "trex" {
+				return nil
+			}
+
+			c := &cursor{data: data}
+			c.fullBox()
+			trackID := c.uint32()
+			c.uint32()
+			duration := c.uint32()
+			size := c.uint32()
+			defaults[trackID] = trackDefaults{duration: duration, size: size}
+			return c.err()
+		})
+	})
+
+	return defaults, err
+}
+
+func parseTrack(data []byte, fileSize int64) (*trackBox, error) {
+	t := &trackBox{track: &Track{}, fileSize: fileSize}
+	err := boxChildren(data, func(boxType string, data []byte) error {
+		switch boxType {
+		case "tkhd":
+			c := &cursor{data: data}
+			version, _ := c.fullBox()
+			c.versioned(version)
+			c.versioned(version)
+			t.track.ID = c.uint32()
+			return c.err()
+		case "edts":
+			return boxChildren(data, func(boxType string, data []byte) error {
+				if boxType == "elst" {
+					return t.parseEditList(data)
+				}
+				return nil
+			})
+		case "mdia":
+			return t.parseMedia(data)
+		}
+		return nil
+	})
+
+	return t, err
+}
+
+func (t *trackBox) parseMedia(data []byte) error {
+	return boxChildren(data, func(boxType string, data []byte) error {
+		switch boxType {
+		case "mdhd":
+			c := &cursor{data: data}
+			version, _ := c.fullBox()
+			c.versioned(version)
+			c.versioned(version)
+			t.track.Timescale = c.uint32()
+			return c.err()
+		case "minf":
+			return boxChildren(data, func(boxType string, data []byte) error {
+				if boxType == "stbl" {
+					return t.parseSampleTable(data)
+				}
+				return nil
+			})
+		}
+		return nil
+	})
+}
+
+func (t *trackBox) parseEditList(data []byte) error {
+	c := &cursor{data: data}
+	version, _ := c.fullBox()
+	count := c.uint32()
+	for i := uint32(0); i < count && !c.short; i++ {
+		e := edit{segmentDuration: c.versioned(version)}
+		if version == 1 {
+			e.mediaTime = int64(c.uint64())
+		} else {
+			e.mediaTime = int64(int32(c.uint32()))
+		}
+		c.uint32()
+
+		t.edits = append(t.edits, e)
+	}
+
+	return c.err()
+}
+
+func (t *trackBox) parseSampleTable(data []byte) error {
+	return boxChildren(data, func(boxType string, data []byte) error {
+		c := &cursor{data: data}
+		c.fullBox()
+
+		switch boxType {
+		case "stsd":
+			c.uint32()
+			return boxChildren(c.data, func(boxType string, data []byte) (err error) {
+				if boxType == "Opus" && t.track.Header == nil {
+					t.track.Header, err = parseOpusSampleEntry(data)
+				}
+				return err
+			})
+		case "stts":
+			count := c.uint32()
+			for i := uint32(0); i < count && !c.short; i++ {
+				t.sampleDurations = append(t.sampleDurations, timeToSample{c.uint32(), c.uint32()})
+			}
+		case "stsc":
+			count := c.uint32()
+			for i := uint32(0); i < count && !c.short; i++ {
+				t.samplesPerChunk = append(t.samplesPerChunk, sampleToChunk{c.uint32(), c.uint32()})
+				c.uint32()
+			}
+		case "stsz":
+			// With a constant size no bytes are read per sample, so the
+			// count is only bounded by the samples fitting in the file
+			size, count := c.uint32(), c.uint32()
+			if size != 0 && !fitsIn(count, size, t.fileSize) {
+				return errBadSampleTable
+			}
+			for i := uint32(0); i < count && !c.short; i++ {
+				if size != 0 {
+					t.sampleSizes = append(t.sampleSizes, size)
+				} else {
+					t.sampleSizes = append(t.sampleSizes, c.uint32())
+				}
+			}
+		case "stco", "co64":
+			count := c.uint32()
+			for i := uint32(0); i < count && !c.short; i++ {
+				if boxType == "stco" {
+					t.chunkOffsets = append(t.chunkOffsets, int64(c.uint32()))
+				} else {
+					t.chunkOffsets = append(t.chunkOffsets, int64(c.uint64()))
+				}
+			}
+		}
+
+		return c.err()
+	})
+}
+
+// The Opus sample entry is an audio sample entry holding a dOps box. dOps
+// has the fields of the Ogg Opus ID header in big endian, without its
+// magic signature, so it's turned into one and parsed as such.
+//
+// https://opus-codec.org/docs/opus_in_isobmff.html#4.3.2
+func parseOpusSampleEntry(data []byte) (*oggreader.OggHeader, error) {
+	if len(data) < audioSampleEntryLen {
+		return nil, errShortBox
+	}
+
+	var header *oggreader.OggHeader
+	err := boxChildren(data[audioSampleEntryLen:], func(boxType string, data []byte) (err error) {
+		if boxType == "dOps" {
+			header, err = parseDOps(data)
+		}
+		return err
+	})
+	if err == nil && header == nil {
+		err = errNoDOps
+	}
+
+	return header, err
+}
+
+func parseDOps(data []byte) (*oggreader.OggHeader, error) {
+	if len(data) < dOpsMinLen {
+		return nil, errShortBox
+	} else if data[0] != 0 {
+		return nil, errBadDOpsVersion
+	}
+
+	idHeader := make([]byte, 8+len(data))
+	copy(idHeader, "OpusHead")
+	idHeader[8] = 1
+	idHeader[9] = data[1]
+	binary.LittleEndian.PutUint16(idHeader[10:], binary.BigEndian.Uint16(data[2:]))
+	binary.LittleEndian.PutUint32(idHeader[12:], binary.BigEndian.Uint32(data[4:]))
+	binary.LittleEndian.PutUint16(idHeader[16:], binary.BigEndian.Uint16(data[8:]))
+	copy(idHeader[18:], data[10:])
+
+	return oggreader.ParseIDHeader(idHeader)
+}
+
+// applyEdits finds the presentation range from the edit list. Only the
+// first edit with media is used, which is how encoders signal priming and
+// padding. Without an edit list the pre-skip is the priming.
+func (r *MP4Reader) applyEdits(t *trackBox) {
+	timescale := int64(t.track.Timescale)
+	r.editStart = int64(t.track.Header.PreSkip) * timescale / opusSampleRate
+
+	for _, e := range t.edits {
+		duration := int64(e.segmentDuration)
+		if r.movieTimescale != 0 {
+			duration = duration * timescale / int64(r.movieTimescale)
+		}
+
+		if e.mediaTime == emptyEditMediaTime {
+			r.emptyEdits += duration
+			continue
+		}
+
+		r.editStart = e.mediaTime
+		if duration != 0 {
+			r.editEnd = e.mediaTime + duration
+			r.hasEditEnd = true
+		}
+		return
+	}
+}
+
+// Samples are stored in chunks. stsc gives the number of samples of runs
+// of chunks, stco their offsets, stsz the size of each sample and stts
+// their durations.
+//
+// ISO/IEC 14496-12 section 8.7
+func (r *MP4Reader) buildSamples(t *trackBox) error {
+	var durations []uint32
+	for _, entry := range t.sampleDurations {
+		for i := uint32(0); i < entry.count && len(durations) < len(t.sampleSizes); i++ {
+			durations = append(durations, entry.duration)
+		}
+	}
+	if len(durations) != len(t.sampleSizes) {
+		return errBadSampleTable
+	}
+
+	entry := 0
+	for chunk, offset := range t.chunkOffsets {
+		for entry+1 < len(t.samplesPerChunk) && int(t.samplesPerChunk[entry+1].firstChunk) <= chunk+1 {
+			entry++
+		}
+		if entry >= len(t.samplesPerChunk) {
+			return errBadSampleTable
+		}
+
+		for i := uint32(0); i < t.samplesPerChunk[entry].samplesPerChunk; i++ {
+			index := len(r.samples)
+			if index >= len(t.sampleSizes) {
+				return errBadSampleTable
+			}
+
+			r.samples = append(r.samples, sample{
+				offset:     offset,
+				size:       t.sampleSizes[index],
+				decodeTime: r.nextDecodeTime,
+				duration:   durations[index],
+			})
+			offset += int64(t.sampleSizes[index])
+			r.nextDecodeTime += int64(durations[index])
+		}
+	}
+
+	if len(r.samples) != len(t.sampleSizes) {
+		return errBadSampleTable
+	}
+
+	return nil
+}
+
+// Fragmented files describe the samples of each fragment in the track
+// fragment boxes of a movie fragment box, with a track run per run of
+// contiguous samples. The data offsets of a track fragment are relative
+// to its base data offset, which is given explicitly, or is the start of
+// the movie fragment box when default-base-is-moof is set. Otherwise the
+// data of the first track fragment starts at the movie fragment box, and
+// that of every other one where the data of the track fragment before
+// it, of any track, ended.
+//
+// ISO/IEC 14496-12 section 8.8.7
+func (r *MP4Reader) parseMovieFragment(data []byte, moofOffset int64) error {
+	if r.track == nil {
+		return errNoMovieBox
+	}
+
+	// The end of the data of the last track fragment, -1 when it was of
+	// another track and couldn't be sized
+	dataEnd := moofOffset
+
+	return boxChildren(data, func(boxType string, data []byte) error {
+		if boxType != "traf" {
+			return nil
+		}
+
+		var defaults trackDefaults
+		var runOffset int64 = -1
+		baseOffset := dataEnd
+		isTrack := false
+
+		err := boxChildren(data, func(boxType string, data []byte) error {
+			c := &cursor{data: data}
+			version, flags := c.fullBox()
+
+			switch boxType {
+			case "tfhd":
+				trackID := c.uint32()
+				isTrack = trackID == r.track.ID
+				defaults = r.defaults[trackID]
+				switch {
+				case flags&tfhdBaseDataOffset != 0:
+					baseOffset = int64(c.uint64())
+				case flags&tfhdDefaultBaseIsMoof != 0:
+					baseOffset = moofOffset
+				}
+				if flags&tfhdSampleDescription != 0 {
+					c.uint32()
+				}
+				if flags&tfhdDefaultDuration != 0 {
+					defaults.duration = c.uint32()
+				}
+				if flags&tfhdDefaultSize != 0 {
+					defaults.size = c.uint32()
+				}
+				if flags&tfhdDefaultFlags != 0 {
+					c.uint32()
+				}
+			case "tfdt":
+				if isTrack {
+					r.nextDecodeTime = int64(c.versioned(version))
+				}
+			case "trun":
+				if baseOffset < 0 {
+					if isTrack {
+						return errUnknownDataOffset
+					}
+					return nil
+				}
+				if runOffset < 0 {
+					runOffset = baseOffset
+				}
+				return r.parseTrackRun(c, flags, defaults, baseOffset, &runOffset, isTrack)
+			}
+
+			return c.err()
+		})
+
+		switch {
+		case err != nil && isTrack:
+			return err
+		case err != nil:
+			// Runs of other tracks that can't be read only leave the
+			// data of the next track fragment unknown
+			dataEnd = -1
+		case runOffset >= 0:
+			dataEnd = runOffset
+		default:
+			dataEnd = baseOffset
+		}
+		return nil
+	})
+}
+
+// The data offset of a track run is relative to the base data offset of
+// its track fragment. A run without one starts where the previous run of
+// the track fragment ended. The samples of runs of other tracks are only
+// counted to find where their data ends.
+//
+// ISO/IEC 14496-12 section 8.8.8
+func (r *MP4Reader) parseTrackRun(c *cursor, flags uint32, defaults trackDefaults, baseOffset int64, offset *int64, isTrack bool) error {
+	count := c.uint32()
+	if flags&trunDataOffset != 0 {
+		*offset = baseOffset + int64(int32(c.uint32()))
+	}
+	if flags&trunFirstSampleFlags != 0 {
+		c.uint32()
+	}
+	if flags&trunSampleSize == 0 && !fitsIn(count, defaults.size, r.fileSize) {
+		return errBadSampleTable
+	}
+
+	for i := uint32(0); i < count && !c.short; i++ {
+		s := sample{
+			offset:     *offset,
+			decodeTime: r.nextDecodeTime,
+			duration:   defaults.duration,
+			size:       defaults.size,
+		}
+
+		if flags&trunSampleDuration != 0 {
+			s.duration = c.uint32()
+		}
+		if flags&trunSampleSize != 0 {
+			s.size = c.uint32()
+		} else if defaults.size == 0 {
+			return errUnknownSampleLength
+		}
+		if flags&trunSampleFlags != 0 {
+			c.uint32()
+		}
+		if flags&trunSampleCompositionOff != 0 {
+			c.uint32()
+		}
+
+		*offset += int64(s.size)
+		if isTrack {
+			r.samples = append(r.samples, s)
+			r.nextDecodeTime += int64(s.duration)
+		}
+	}
+
+	return c.err()
+}
+
+// fitsIn reports whether count samples of size bytes fit in limit bytes
+func fitsIn(count, size uint32, limit int64) bool {
+	return uint64(count)*uint64(size) <= uint64(limit)
+}
+
+func minInt64(a, b int64) int64 {
+	if a < b {
+		return a
+	}
+	return b
+}
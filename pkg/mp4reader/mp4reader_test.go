@@ -0,0 +1,384 @@
+package mp4reader
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/pion/opus/pkg/oggreader"
+)
+
+func box(boxType string, children ...[]byte) []byte {
+	payload := bytes.Join(children, nil)
+	out := make([]byte, boxHeaderLen, boxHeaderLen+len(payload))
+	binary.BigEndian.PutUint32(out, uint32(boxHeaderLen+len(payload)))
+	copy(out[4:], boxType)
+	return append(out, payload...)
+}
+
+func fullBox(boxType string, version uint8, flags uint32, fields ...[]byte) []byte {
+	return box(boxType, append([][]byte{u32(uint32(version)<<24 | flags)}, fields...)...)
+}
+
+func u32(values ...uint32) []byte {
+	out := make([]byte, 4*len(values))
+	for i, v := range values {
+		binary.BigEndian.PutUint32(out[4*i:], v)
+	}
+	return out
+}
+
+// Stereo, 312 samples of pre-skip, 48 kHz input
+func buildDOps() []byte {
+	return box("dOps", []byte{0, 2, 0x01, 0x38, 0, 0, 0xbb, 0x80, 0, 0, 0})
+}
+
+func buildOpusHead() []byte {
+	return []byte{
+		'O', 'p', 'u', 's', 'H', 'e', 'a', 'd', 1, 2,
+		0x38, 0x01, 0x80, 0xbb, 0x00, 0x00, 0x00, 0x00, 0x00,
+	}
+}
+
+func buildOpusSampleEntry(dOps []byte) []byte {
+	entry := make([]byte, audioSampleEntryLen)
+	entry[7] = 1
+	entry[17] = 2
+	entry[19] = 16
+	binary.BigEndian.PutUint32(entry[24:], 48000<<16)
+	return box("Opus", entry, dOps)
+}
+
+func buildTrack(dOps []byte, edits []byte, sampleTable ...[]byte) []byte {
+	return box("trak",
+		fullBox("tkhd", 0, 0, u32(0, 0, 1, 0, 0)),
+		edits,
+		box("mdia",
+			fullBox("mdhd", 0, 0, u32(0, 0, 48000, 0, 0)),
+			box("minf",
+				box("stbl", append([][]byte{
+					fullBox("stsd", 0, 0, u32(1), buildOpusSampleEntry(dOps)),
+				}, sampleTable...)...),
+			),
+		),
+	)
+}
+
+func buildFrame(i, size int) []byte {
+	frame := make([]byte, size)
+	frame[0] = 0x08
+	frame[1] = byte(i)
+	return frame
+}
+
+func readAll(t *testing.T, file []byte) (*Track, [][]byte, []PacketHeader) {
+	reader, track, err := NewWith(bytes.NewReader(file))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var packets [][]byte
+	var headers []PacketHeader
+	for {
+		packet, header, err := reader.ReadPacket()
+		if errors.Is(err, io.EOF) {
+			return track, packets, headers
+		} else if err != nil {
+			t.Fatal(err)
+		}
+
+		packets = append(packets, packet)
+		headers = append(headers, *header)
+	}
+}
+
+func TestMP4Reader_SampleTable(t *testing.T) {
+	frames := [][]byte{buildFrame(0, 2), buildFrame(1, 3), buildFrame(2, 2), buildFrame(3, 3)}
+
+	ftyp := box("ftyp", []byte("isom"), u32(0))
+	mdatStart := uint32(len(ftyp) + boxHeaderLen)
+
+	// The movie box follows the media data, 60ms are presented after the
+	// 312 samples of priming
+	file := bytes.Join([][]byte{
+		ftyp,
+		box("mdat", frames...),
+		box("moov",
+			fullBox("mvhd", 0, 0, u32(0, 0, 1000, 0)),
+			buildTrack(buildDOps(),
+				box("edts", fullBox("elst", 0, 0, u32(1, 60, 312, 1<<16))),
+				fullBox("stts", 0, 0, u32(1, 4, 960)),
+				fullBox("stsc", 0, 0, u32(2, 1, 3, 1, 2, 1, 1)),
+				fullBox("stsz", 0, 0, u32(0, 4, 2, 3, 2, 3)),
+				fullBox("stco", 0, 0, u32(2, mdatStart, mdatStart+7)),
+			),
+		),
+	}, nil)
+
+	track, packets, headers := readAll(t, file)
+
+	header, err := oggreader.ParseIDHeader(buildOpusHead())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expected := (&Track{ID: 1, Header: header, Timescale: 48000}); !reflect.DeepEqual(track, expected) {
+		t.Fatalf("expected %+v, got %+v", expected, track)
+	}
+
+	if !reflect.DeepEqual(packets, frames) {
+		t.Fatalf("expected %v, got %v", frames, packets)
+	}
+
+	us := time.Microsecond
+	expected := []PacketHeader{
+		{Timestamp: -6500 * us, Samples: 960, DiscardStart: 312},
+		{Timestamp: 13500 * us, Samples: 960},
+		{Timestamp: 33500 * us, Samples: 960},
+		{Timestamp: 53500 * us, Samples: 960, DiscardEnd: 648},
+	}
+	if !reflect.DeepEqual(headers, expected) {
+		t.Fatalf("expected %+v, got %+v", expected, headers)
+	}
+}
+
+func TestMP4Reader_Fragmented(t *testing.T) {
+	frames := [][]byte{buildFrame(0, 2), buildFrame(1, 4), buildFrame(2, 3), buildFrame(3, 3)}
+
+	ftyp := box("ftyp", []byte("iso6"), u32(0))
+	moov := box("moov",
+		fullBox("mvhd", 0, 0, u32(0, 0, 1000, 0)),
+		buildTrack(buildDOps(), nil,
+			fullBox("stts", 0, 0, u32(0)),
+			fullBox("stsc", 0, 0, u32(0)),
+			fullBox("stsz", 0, 0, u32(0, 0)),
+			fullBox("stco", 0, 0, u32(0)),
+		),
+		box("mvex", fullBox("trex", 0, 0, u32(1, 1, 960, 0, 0))),
+	)
+
+	// The first fragment gives sample sizes in the track run, the second
+	// a default size in the track fragment header and continues the
+	// decode time of the first. Track 2 is skipped.
+	buildMoof := func(dataOffset uint32, first bool) []byte {
+		if first {
+			return box("moof",
+				fullBox("mfhd", 0, 0, u32(1)),
+				box("traf",
+					fullBox("tfhd", 0, 0x020000, u32(2)),
+					fullBox("trun", 0, 0x000201, u32(1, dataOffset, 100)),
+				),
+				box("traf",
+					fullBox("tfhd", 0, 0x020000, u32(1)),
+					fullBox("tfdt", 1, 0, u32(0, 0)),
+					fullBox("trun", 0, 0x000201, u32(2, dataOffset, 2, 4)),
+				),
+			)
+		}
+
+		return box("moof",
+			fullBox("mfhd", 0, 0, u32(2)),
+			box("traf",
+				fullBox("tfhd", 0, 0x020010, u32(1, 3)),
+				fullBox("trun", 0, 0x000001, u32(2, dataOffset)),
+			),
+		)
+	}
+
+	moofLen := uint32(len(buildMoof(0, true)))
+	secondMoofLen := uint32(len(buildMoof(0, false)))
+
+	file := bytes.Join([][]byte{
+		ftyp,
+		moov,
+		buildMoof(moofLen+boxHeaderLen, true),
+		box("mdat", frames[0], frames[1]),
+		buildMoof(secondMoofLen+boxHeaderLen, false),
+		box("mdat", frames[2], frames[3]),
+	}, nil)
+
+	_, packets, headers := readAll(t, file)
+	if !reflect.DeepEqual(packets, frames) {
+		t.Fatalf("expected %v, got %v", frames, packets)
+	}
+
+	// Without an edit list the pre-skip is the priming
+	us := time.Microsecond
+	expected := []PacketHeader{
+		{Timestamp: -6500 * us, Samples: 960, DiscardStart: 312},
+		{Timestamp: 13500 * us, Samples: 960},
+		{Timestamp: 33500 * us, Samples: 960},
+		{Timestamp: 53500 * us, Samples: 960},
+	}
+	if !reflect.DeepEqual(headers, expected) {
+		t.Fatalf("expected %+v, got %+v", expected, headers)
+	}
+}
+
+func TestMP4Reader_FragmentTrackRuns(t *testing.T) {
+	frames := [][]byte{buildFrame(0, 2), buildFrame(1, 4), buildFrame(2, 3), buildFrame(3, 3)}
+	junk := []byte{0xde, 0xad, 0xbe, 0xef, 0x00}
+
+	moov := box("moov",
+		fullBox("mvhd", 0, 0, u32(0, 0, 1000, 0)),
+		buildTrack(buildDOps(), nil,
+			fullBox("stts", 0, 0, u32(0)),
+			fullBox("stsc", 0, 0, u32(0)),
+			fullBox("stsz", 0, 0, u32(0, 0)),
+			fullBox("stco", 0, 0, u32(0)),
+		),
+		box("mvex", fullBox("trex", 0, 0, u32(1, 1, 960, 0, 0))),
+	)
+
+	// Each data offset is relative to the start of the movie fragment,
+	// not to the end of the previous run. The second run skips over junk,
+	// and the third run has no data offset so it follows the second.
+	buildMoof := func(dataOffset uint32) []byte {
+		return box("moof",
+			fullBox("mfhd", 0, 0, u32(1)),
+			box("traf",
+				fullBox("tfhd", 0, 0x020000, u32(1)),
+				fullBox("trun", 0, 0x000201, u32(1, dataOffset, 2)),
+				fullBox("trun", 0, 0x000201, u32(2, dataOffset+2+uint32(len(junk)), 4, 3)),
+				fullBox("trun", 0, 0x000200, u32(1, 3)),
+			),
+		)
+	}
+
+	moofLen := uint32(len(buildMoof(0)))
+	file := bytes.Join([][]byte{
+		box("ftyp", []byte("iso6"), u32(0)),
+		moov,
+		buildMoof(moofLen + boxHeaderLen),
+		box("mdat", frames[0], junk, frames[1], frames[2], frames[3]),
+	}, nil)
+
+	if _, packets, _ := readAll(t, file); !reflect.DeepEqual(packets, frames) {
+		t.Fatalf("expected %v, got %v", frames, packets)
+	}
+}
+
+func TestMP4Reader_FragmentBaseDataOffsets(t *testing.T) {
+	frames := [][]byte{buildFrame(0, 2), buildFrame(1, 4), buildFrame(2, 3), buildFrame(3, 3)}
+	other := []byte{0xde, 0xad, 0xbe, 0xef, 0x00, 0x01}
+
+	ftyp := box("ftyp", []byte("iso6"), u32(0))
+	moov := box("moov",
+		fullBox("mvhd", 0, 0, u32(0, 0, 1000, 0)),
+		buildTrack(buildDOps(), nil,
+			fullBox("stts", 0, 0, u32(0)),
+			fullBox("stsc", 0, 0, u32(0)),
+			fullBox("stsz", 0, 0, u32(0, 0)),
+			fullBox("stco", 0, 0, u32(0)),
+		),
+		box("mvex",
+			fullBox("trex", 0, 0, u32(1, 1, 960, 0, 0)),
+			fullBox("trex", 0, 0, u32(2, 1, 960, 3, 0)),
+		),
+	)
+
+	// Track 2 comes first, its base is the start of the movie fragment,
+	// and its two samples of the trex default size are skipped. The next
+	// track fragment has no base data offset, so its data follows that
+	// of track 2. The last one gives its base data offset explicitly.
+	buildMoof := func(dataOffset uint32, baseDataOffset uint64) []byte {
+		return box("moof",
+			fullBox("mfhd", 0, 0, u32(1)),
+			box("traf",
+				fullBox("tfhd", 0, 0, u32(2)),
+				fullBox("trun", 0, 0x000001, u32(2, dataOffset)),
+			),
+			box("traf",
+				fullBox("tfhd", 0, 0, u32(1)),
+				fullBox("trun", 0, 0x000200, u32(2, 2, 4)),
+			),
+			box("traf",
+				fullBox("tfhd", 0, 0x000001, u32(1, uint32(baseDataOffset>>32), uint32(baseDataOffset))),
+				fullBox("trun", 0, 0x000200, u32(2, 3, 3)),
+			),
+		)
+	}
+
+	moofLen := uint32(len(buildMoof(0, 0)))
+	dataStart := uint64(len(ftyp)+len(moov)) + uint64(moofLen) + boxHeaderLen
+	file := bytes.Join([][]byte{
+		ftyp,
+		moov,
+		buildMoof(moofLen+boxHeaderLen, dataStart+uint64(len(other))+2+4),
+		box("mdat", other, frames[0], frames[1], frames[2], frames[3]),
+	}, nil)
+
+	if _, packets, _ := readAll(t, file); !reflect.DeepEqual(packets, frames) {
+		t.Fatalf("expected %v, got %v", frames, packets)
+	}
+}
+
+func TestMP4Reader_Errors(t *testing.T) {
+	mvhd := fullBox("mvhd", 0, 0, u32(0, 0, 1000, 0))
+	emptyTable := [][]byte{
+		fullBox("stts", 0, 0, u32(0)),
+		fullBox("stsc", 0, 0, u32(0)),
+		fullBox("stsz", 0, 0, u32(0, 0)),
+		fullBox("stco", 0, 0, u32(0)),
+	}
+
+	for _, test := range []struct {
+		name string
+		file []byte
+		err  error
+	}{
+		{"No movie box", box("ftyp", []byte("isom")), errNoOpusTrack},
+		{"No track", box("moov", mvhd), errNoOpusTrack},
+		{"Fragment first", box("moof"), errNoMovieBox},
+		{"Bad dOps version", box("moov", mvhd, buildTrack(box("dOps", []byte{1, 2, 0, 0, 0, 0, 0, 0, 0, 0, 0}), nil, emptyTable...)), errBadDOpsVersion},
+		{"Short dOps", box("moov", mvhd, buildTrack(box("dOps", []byte{0, 2}), nil, emptyTable...)), errShortBox},
+		{"No dOps", box("moov", mvhd, buildTrack(nil, nil, emptyTable...)), errNoDOps},
+		{"Sample table mismatch", box("moov", mvhd, buildTrack(buildDOps(), nil,
+			fullBox("stts", 0, 0, u32(1, 2, 960)),
+			fullBox("stsc", 0, 0, u32(1, 1, 2, 1)),
+			fullBox("stsz", 0, 0, u32(2, 3)),
+			fullBox("stco", 0, 0, u32(1, 0)),
+		)), errBadSampleTable},
+		{"Constant sample size count too large", box("moov", mvhd, buildTrack(buildDOps(), nil,
+			fullBox("stts", 0, 0, u32(0)),
+			fullBox("stsc", 0, 0, u32(0)),
+			fullBox("stsz", 0, 0, u32(1, 0xFFFFFFFF)),
+			fullBox("stco", 0, 0, u32(0)),
+		)), errBadSampleTable},
+		{"Default sample size count too large", bytes.Join([][]byte{
+			box("moov", mvhd, buildTrack(buildDOps(), nil, emptyTable...)),
+			box("moof", box("traf",
+				fullBox("tfhd", 0, 0x020010, u32(1, 1)),
+				fullBox("trun", 0, 0, u32(0xFFFFFFFF)),
+			)),
+		}, nil), errBadSampleTable},
+		{"Data after a track fragment of unknown size", bytes.Join([][]byte{
+			box("moov", mvhd, buildTrack(buildDOps(), nil, emptyTable...)),
+			box("moof",
+				box("traf",
+					fullBox("tfhd", 0, 0, u32(2)),
+					fullBox("trun", 0, 0, u32(1)),
+				),
+				box("traf",
+					fullBox("tfhd", 0, 0x000010, u32(1, 3)),
+					fullBox("trun", 0, 0, u32(1)),
+				),
+			),
+		}, nil), errUnknownDataOffset},
+		{"Bad box size", []byte{0, 0, 0, 4, 'm', 'o', 'o', 'v'}, errBadBoxSize},
+		{"Truncated", box("moov", mvhd)[:12], io.ErrUnexpectedEOF},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			if _, _, err := NewWith(bytes.NewReader(test.file)); !errors.Is(err, test.err) {
+				t.Fatalf("expected %v, got %v", test.err, err)
+			}
+		})
+	}
+
+	if _, _, err := NewWith(nil); !errors.Is(err, errNilStream) {
+		t.Fatalf("expected %v, got %v", errNilStream, err)
+	}
+}
@@ -0,0 +1,281 @@
+// Package oggopusreader implements Ogg Opus playback on top of the Ogg
+// container reader, returning the PCM a player should output
+package oggopusreader
+
+import (
+	"errors"
+	"io"
+	"math"
+
+	"github.com/pion/opus"
+	"github.com/pion/opus/pkg/oggreader"
+)
+
+const (
+	// Opus packets are at most 120 ms long, decoded at 48 kHz
+	maxPacketSamples = 120 * 48000 / 1000
+
+	// Gains are in Q7.8 dB
+	gainFractionalBits = 8
+)
+
+var (
+	errNilDecoder     = errors.New("decoder is nil")
+	errNoHeader       = errors.New("stream has no ID header")
+	errBadSampleCount = errors.New("decoder returned more samples than a packet can hold")
+	errEarlyGranule   = errors.New("granule position ends before its packets on a page that isn't the last")
+)
+
+// PCMDecoder decodes an Opus packet into interleaved float32 samples at
+// 48 kHz, with as many channels as the ID header of the stream has. It
+// returns the number of samples decoded per channel.
+type PCMDecoder = opus.PCMDecoder
+
+// NewDecoder returns a decoder for the channel mapping family of header.
+// Families 0, 1 and 2 and undefined families decode the streams to output
+// channels through the mapping table, family 2 being ambisonics with
+// optional non-diegetic stereo channels. Family 3 applies the demixing
+// matrix to the decoded streams. newDecoder is called once per stream with
+// the number of channels it decodes.
+//
+// https://tools.ietf.org/html/rfc8486.html#section-3
+func NewDecoder(header *oggreader.OggHeader, newDecoder func(channels int) opus.PCMDecoder) (PCMDecoder, error) {
+	if header.ChannelMap == oggreader.ChannelMappingFamilyProjection {
+		return opus.NewProjectionDecoder(int(header.Channels), int(header.StreamCount), int(header.CoupledCount), header.DemixingMatrix, newDecoder)
+	}
+
+	return opus.NewMultistreamDecoder(int(header.Channels), int(header.StreamCount), int(header.CoupledCount), header.ChannelMapping, newDecoder)
+}
+
+// Option configures an OggOpusReader
+type Option func(*OggOpusReader)
+
+// WithDecoder decodes each chain link with the decoder newDecoder returns
+// for its ID header, instead of one from NewDecoder with an opus.Decoder
+// per stream
+func WithDecoder(newDecoder func(header *oggreader.OggHeader) (PCMDecoder, error)) Option {
+	return func(r *OggOpusReader) {
+		r.newDecoder = newDecoder
+	}
+}
+
+// WithTrackGain applies the R128_TRACK_GAIN tag, if present, in addition
+// to the output gain of the ID header
+func WithTrackGain() Option {
+	return func(r *OggOpusReader) {
+		r.gainTag = oggreader.TagTrackGain
+	}
+}
+
+// WithAlbumGain applies the R128_ALBUM_GAIN tag, if present, in addition
+// to the output gain of the ID header
+func WithAlbumGain() Option {
+	return func(r *OggOpusReader) {
+		r.gainTag = oggreader.TagAlbumGain
+	}
+}
+
+// OggOpusReader decodes an Ogg Opus stream into exactly the PCM described
+// by its headers and granule positions. The pre-skip samples at the start
+// of the stream are dropped, the end of the final page is trimmed to its
+// granule position and the output gain is applied. Every chain link is
+// decoded by a new decoder, as the channel layout can change between links
+// and no decoder state carries over.
+//
+// https://tools.ietf.org/html/rfc7845.html#section-4
+type OggOpusReader struct {
+	ogg        *oggreader.OggReader
+	newDecoder func(header *oggreader.OggHeader) (PCMDecoder, error)
+	decoder    PCMDecoder
+	gainTag    string
+
+	header *oggreader.OggHeader
+	tags   *oggreader.OggTags
+	scale  float32
+
+	// Samples per channel decoded in the current chain link, which the
+	// pre-skip is counted against, and the position of the end of the
+	// last packet counted like granule positions, which starts above zero
+	// when the stream does
+	decoded  uint64
+	position uint64
+
+	buffer []float32
+}
+
+// NewWith returns a new OggOpusReader that reads the Ogg Opus stream in
+func NewWith(in io.Reader, opts ...Option) (*OggOpusReader, error) {
+	r := &OggOpusReader{
+		newDecoder: func(header *oggreader.OggHeader) (PCMDecoder, error) {
+			return NewDecoder(header, opus.NewStreamDecoder)
+		},
+	}
+	for _, opt := range opts {
+		opt(r)
+	}
+	if r.newDecoder == nil {
+		return nil, errNilDecoder
+	}
+
+	ogg, header, err := oggreader.NewWith(in)
+	if err != nil {
+		return nil, err
+	}
+
+	tags, err := ogg.ReadTags()
+	if err != nil {
+		return nil, err
+	}
+
+	r.ogg = ogg
+	if err = r.startChainLink(header, tags); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// Header returns the ID header of the chain link the last returned samples
+// belong to
+func (r *OggOpusReader) Header() *oggreader.OggHeader {
+	return r.header
+}
+
+// Tags returns the comment header of the chain link the last returned
+// samples belong to
+func (r *OggOpusReader) Tags() *oggreader.OggTags {
+	return r.tags
+}
+
+// Read decodes the next packet and returns its interleaved samples, with
+// the samples that must not be played removed and the gain applied. The
+// number of channels is that of Header, which changes when a new chain
+// link starts. Packets that are trimmed entirely are skipped.
+func (r *OggOpusReader) Read() ([]float32, error) {
+	for {
+		packet, packetHeader, err := r.ogg.ReadPacket()
+		if err != nil {
+			return nil, err
+		}
+
+		if packetHeader.NewHeader != nil {
+			tags, err := oggreader.ParseTags(packet)
+			if err != nil {
+				return nil, err
+			}
+
+			if err = r.startChainLink(packetHeader.NewHeader, tags); err != nil {
+				return nil, err
+			}
+			continue
+		}
+
+		pcm, err := r.decode(packet, packetHeader)
+		if err != nil {
+			return nil, err
+		} else if len(pcm) != 0 {
+			return pcm, nil
+		}
+	}
+}
+
+func (r *OggOpusReader) decode(packet []byte, packetHeader *oggreader.OggPacketHeader) ([]float32, error) {
+	channels := int(r.header.Channels)
+	if channels == 0 {
+		return nil, errNoHeader
+	}
+
+	if len(r.buffer) < maxPacketSamples*channels {
+		r.buffer = make([]float32, maxPacketSamples*channels)
+	}
+
+	samples, err := r.decoder.DecodeFloat32(packet, r.buffer)
+	if err != nil {
+		return nil, err
+	} else if samples < 0 || samples > maxPacketSamples {
+		return nil, errBadSampleCount
+	}
+
+	// The first pre-skip samples are only there to let the decoder
+	// converge
+	//
+	// https://tools.ietf.org/html/rfc7845.html#section-4.2
+	first, last := 0, samples
+	if preSkip := uint64(r.header.PreSkip); r.decoded < preSkip {
+		first = int(minUint64(preSkip-r.decoded, uint64(samples)))
+	}
+	r.decoded += uint64(samples)
+
+	start := r.position
+	end := start + uint64(samples)
+	r.position = end
+
+	if packetHeader.HasGranulePosition {
+		switch granulePosition := packetHeader.GranulePosition; {
+		case granulePosition < end:
+			// Only the granule position of the final page is allowed to
+			// end before its last packet, the rest is trimmed
+			//
+			// https://tools.ietf.org/html/rfc7845.html#section-4.5
+			if !packetHeader.PageHeader.EndOfStream() {
+				return nil, errEarlyGranule
+			}
+			last -= int(minUint64(end-granulePosition, uint64(samples)))
+		case granulePosition > end:
+			// Packets were lost, or the stream didn't start at zero.
+			// Follow the granule position to keep the end trimming exact.
+			r.position = granulePosition
+		}
+	}
+
+	if first >= last {
+		return nil, nil
+	}
+
+	pcm := make([]float32, (last-first)*channels)
+	copy(pcm, r.buffer[first*channels:last*channels])
+	if r.scale != 1 {
+		for i := range pcm {
+			pcm[i] *= r.scale
+		}
+	}
+
+	return pcm, nil
+}
+
+// The output gain of the ID header, and the R128 gain tag if requested,
+// are applied to the decoded samples
+//
+// https://tools.ietf.org/html/rfc7845.html#section-5.1
+func (r *OggOpusReader) startChainLink(header *oggreader.OggHeader, tags *oggreader.OggTags) error {
+	decoder, err := r.newDecoder(header)
+	if err != nil {
+		return err
+	} else if decoder == nil {
+		return errNilDecoder
+	}
+
+	r.decoder = decoder
+	r.header = header
+	r.tags = tags
+	r.decoded = 0
+	r.position = 0
+
+	var tagGain int16
+	switch r.gainTag {
+	case oggreader.TagTrackGain:
+		tagGain, _ = tags.TrackGain()
+	case oggreader.TagAlbumGain:
+		tagGain, _ = tags.AlbumGain()
+	}
+
+	gain := int(int16(header.OutputGain)) + int(tagGain)
+	r.scale = float32(math.Pow(10, float64(gain)/(20*(1<<gainFractionalBits))))
+	return nil
+}
+
+func minUint64(a, b uint64) uint64 {
+	if a < b {
+		return a
+	}
+	return b
+}
@@ -0,0 +1,376 @@
+package oggopusreader
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"math"
+	"testing"
+
+	"github.com/pion/opus"
+	"github.com/pion/opus/internal/oggcrc"
+	"github.com/pion/opus/pkg/oggreader"
+	"github.com/pion/opus/pkg/oggwriter"
+)
+
+// countingDecoder outputs the index of every sample it decoded, so the
+// samples left after trimming can be identified
+type countingDecoder struct {
+	channels int
+	samples  int
+}
+
+func (d *countingDecoder) DecodeFloat32(in []byte, out []float32) (int, error) {
+	samples, err := opus.PacketSampleCount(in, 48000)
+	if err != nil {
+		return 0, err
+	}
+
+	for i := 0; i < samples*d.channels; i++ {
+		out[i] = float32(d.samples + i/d.channels)
+	}
+	d.samples += samples
+
+	return samples, nil
+}
+
+// withCountingDecoder decodes each chain link with a new countingDecoder
+func withCountingDecoder() Option {
+	return WithDecoder(func(header *oggreader.OggHeader) (PCMDecoder, error) {
+		return &countingDecoder{channels: int(header.Channels)}, nil
+	})
+}
+
+func buildStream(t *testing.T, header *oggreader.OggHeader, tags *oggreader.OggTags, packets int, endTrim uint64) []byte {
+	buffer := &bytes.Buffer{}
+	writer, err := oggwriter.NewWith(buffer, header, tags, oggwriter.WithMaxPageSize(16))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// 20ms SILK packets
+	for i := 0; i < packets; i++ {
+		if err = writer.WritePacket([]byte{0x08, byte(i), 0, 0, 0, 0, 0, 0}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	writer.SetEndTrim(endTrim)
+	if err = writer.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	return buffer.Bytes()
+}
+
+// rewriteGranules replaces the granule position of every audio page of ogg
+// with the one rewrite returns for its page index, and updates the checksum
+func rewriteGranules(ogg []byte, rewrite func(page int, granulePosition uint64) uint64) []byte {
+	ogg = append([]byte{}, ogg...)
+	table := oggcrc.GenerateTable()
+
+	for offset, page := 0, 0; offset < len(ogg); page++ {
+		segments := int(ogg[offset+26])
+		end := offset + 27 + segments
+		for _, segment := range ogg[offset+27 : offset+27+segments] {
+			end += int(segment)
+		}
+
+		// The first two pages are the ID and comment headers
+		if page >= 2 {
+			granulePosition := binary.LittleEndian.Uint64(ogg[offset+6:])
+			binary.LittleEndian.PutUint64(ogg[offset+6:], rewrite(page, granulePosition))
+			binary.LittleEndian.PutUint32(ogg[offset+22:], 0)
+			binary.LittleEndian.PutUint32(ogg[offset+22:], oggcrc.Update(table, 0, ogg[offset:end]))
+		}
+		offset = end
+	}
+
+	return ogg
+}
+
+func readAll(t *testing.T, reader *OggOpusReader) []float32 {
+	var pcm []float32
+	for {
+		samples, err := reader.Read()
+		if errors.Is(err, io.EOF) {
+			return pcm
+		} else if err != nil {
+			t.Fatal(err)
+		}
+
+		pcm = append(pcm, samples...)
+	}
+}
+
+func TestOggOpusReader_Trimming(t *testing.T) {
+	header := &oggreader.OggHeader{Channels: 2, PreSkip: 1000, SampleRate: 48000, Version: 1}
+	ogg := buildStream(t, header, nil, 10, 500)
+
+	reader, err := NewWith(bytes.NewReader(ogg), withCountingDecoder())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The pre-skip spans more than a packet, and the end trimming removes
+	// part of the last packet
+	pcm := readAll(t, reader)
+	if expected := 2 * (10*960 - 1000 - 500); len(pcm) != expected {
+		t.Fatalf("expected %d samples, got %d", expected, len(pcm))
+	}
+
+	for i, sample := range pcm {
+		if expected := float32(1000 + i/2); sample != expected {
+			t.Fatalf("sample %d: expected %f, got %f", i, expected, sample)
+		}
+	}
+}
+
+func TestOggOpusReader_NonzeroStart(t *testing.T) {
+	// The pre-skip is longer than the first page, which holds two packets
+	header := &oggreader.OggHeader{Channels: 1, PreSkip: 3000, SampleRate: 48000, Version: 1}
+	ogg := rewriteGranules(buildStream(t, header, nil, 10, 0), func(_ int, granulePosition uint64) uint64 {
+		return granulePosition + 48000
+	})
+
+	reader, err := NewWith(bytes.NewReader(ogg), withCountingDecoder())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	pcm := readAll(t, reader)
+	if expected := 10*960 - 3000; len(pcm) != expected {
+		t.Fatalf("expected %d samples, got %d", expected, len(pcm))
+	}
+
+	for i, sample := range pcm {
+		if expected := float32(3000 + i); sample != expected {
+			t.Fatalf("sample %d: expected %f, got %f", i, expected, sample)
+		}
+	}
+}
+
+func TestOggOpusReader_EarlyGranule(t *testing.T) {
+	header := &oggreader.OggHeader{Channels: 1, SampleRate: 48000, Version: 1}
+	ogg := rewriteGranules(buildStream(t, header, nil, 10, 0), func(page int, granulePosition uint64) uint64 {
+		if page == 3 {
+			return granulePosition - 100
+		}
+		return granulePosition
+	})
+
+	reader, err := NewWith(bytes.NewReader(ogg), withCountingDecoder())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for {
+		if _, err = reader.Read(); err != nil {
+			break
+		}
+	}
+	if !errors.Is(err, errEarlyGranule) {
+		t.Fatalf("expected %v, got %v", errEarlyGranule, err)
+	}
+}
+
+func TestOggOpusReader_Gain(t *testing.T) {
+	// -6 dB of output gain, and +12 dB of track gain
+	header := &oggreader.OggHeader{Channels: 1, OutputGain: uint16(0xffff - 6*256 + 1), SampleRate: 48000, Version: 1}
+	tags := &oggreader.OggTags{UserComments: map[string][]string{oggreader.TagTrackGain: {"3072"}}}
+	ogg := buildStream(t, header, tags, 2, 0)
+
+	for _, test := range []struct {
+		name string
+		opts []Option
+		gain float64
+	}{
+		{"Output gain", nil, -6},
+		{"Track gain", []Option{WithTrackGain()}, 6},
+		{"Missing album gain", []Option{WithAlbumGain()}, -6},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			reader, err := NewWith(bytes.NewReader(ogg), append(test.opts, withCountingDecoder())...)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			pcm := readAll(t, reader)
+			scale := math.Pow(10, test.gain/20)
+			for i, sample := range pcm {
+				if math.Abs(float64(sample)-float64(i)*scale) > 1e-3*float64(i) {
+					t.Fatalf("sample %d: expected %f, got %f", i, float64(i)*scale, sample)
+				}
+			}
+		})
+	}
+}
+
+func TestOggOpusReader_Chained(t *testing.T) {
+	first := buildStream(t, &oggreader.OggHeader{Channels: 1, PreSkip: 100, SampleRate: 48000, Version: 1}, nil, 2, 60)
+
+	// The second link needs a different serial number
+	buffer := &bytes.Buffer{}
+	writer, err := oggwriter.NewWith(buffer, &oggreader.OggHeader{Channels: 1, PreSkip: 200, SampleRate: 48000, Version: 1},
+		&oggreader.OggTags{Vendor: "second"}, oggwriter.WithSerial(2))
+	if err != nil {
+		t.Fatal(err)
+	} else if err = writer.WritePacket([]byte{0x08, 0}); err != nil {
+		t.Fatal(err)
+	} else if err = writer.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	reader, err := NewWith(bytes.NewReader(append(first, buffer.Bytes()...)), withCountingDecoder())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	pcm := readAll(t, reader)
+	switch {
+	case len(pcm) != 2*960-100-60+960-200:
+		t.Fatal(len(pcm))
+	case pcm[0] != 100:
+		t.Fatal(pcm[0])
+	case pcm[2*960-100-60] != 200:
+		t.Fatalf("second link should start after its pre-skip with a new decoder, got %f", pcm[2*960-100-60])
+	case reader.Tags().Vendor != "second" || reader.Header().PreSkip != 200:
+		t.Fatal("header and tags should be those of the second link")
+	}
+}
+
+func TestOggOpusReader_OpusDecoder(t *testing.T) {
+	// A mono link followed by a stereo one, of 5 packets each
+	buffer := &bytes.Buffer{}
+	for channels := 1; channels <= 2; channels++ {
+		encoder, err := opus.NewEncoder(48000, channels, opus.ApplicationVoIP)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		header := &oggreader.OggHeader{Channels: uint8(channels), PreSkip: 312, SampleRate: 48000, Version: 1}
+		writer, err := oggwriter.NewWith(buffer, header, nil, oggwriter.WithSerial(uint32(channels)))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		for i := 0; i < 5; i++ {
+			samples := make([]float32, 960*channels)
+			for j := range samples {
+				samples[j] = float32(0.5 * math.Sin(2*math.Pi*440*float64(960*i+j/channels)/48000))
+			}
+
+			packet := make([]byte, 1500)
+			size, err := encoder.EncodeFloat32(samples, packet)
+			if err != nil {
+				t.Fatal(err)
+			} else if err = writer.WritePacket(packet[:size]); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err = writer.Close(); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	reader, err := NewWith(bytes.NewReader(buffer.Bytes()))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	pcm := map[uint8][]float32{}
+	for {
+		samples, err := reader.Read()
+		if errors.Is(err, io.EOF) {
+			break
+		} else if err != nil {
+			t.Fatal(err)
+		}
+		pcm[reader.Header().Channels] = append(pcm[reader.Header().Channels], samples...)
+	}
+
+	for channels := uint8(1); channels <= 2; channels++ {
+		energy := 0.0
+		for _, sample := range pcm[channels] {
+			energy += float64(sample) * float64(sample)
+		}
+		switch {
+		case len(pcm[channels]) != (5*960-312)*int(channels):
+			t.Fatalf("%d channels: %d samples", channels, len(pcm[channels]))
+		case energy/float64(len(pcm[channels])) < 0.05:
+			t.Fatalf("%d channels: mean energy %f", channels, energy/float64(len(pcm[channels])))
+		}
+	}
+}
+
+func TestOggOpusReader_Errors(t *testing.T) {
+	if _, err := NewWith(bytes.NewReader(nil), WithDecoder(nil)); !errors.Is(err, errNilDecoder) {
+		t.Fatal(err)
+	}
+}
+
+func TestNewDecoder(t *testing.T) {
+	newDecoder := func(channels int) opus.PCMDecoder {
+		return &countingDecoder{channels: channels}
+	}
+
+	for _, test := range []struct {
+		name     string
+		header   *oggreader.OggHeader
+		expected []float32
+	}{
+		{
+			"Family 0",
+			&oggreader.OggHeader{ChannelMap: oggreader.ChannelMappingFamilyRTP, Channels: 2, StreamCount: 1, CoupledCount: 1, ChannelMapping: []uint8{0, 1}},
+			[]float32{1, 1},
+		},
+		{
+			"Family 2 with non-diegetic stereo",
+			&oggreader.OggHeader{
+				ChannelMap: oggreader.ChannelMappingFamilyAmbisonics, Channels: 3, StreamCount: 2, CoupledCount: 1,
+				ChannelMapping: []uint8{2, 0, 255},
+			},
+			[]float32{1, 1, 0},
+		},
+		{
+			"Family 3",
+			&oggreader.OggHeader{
+				ChannelMap: oggreader.ChannelMappingFamilyProjection, Channels: 1, StreamCount: 1, CoupledCount: 0,
+				DemixingMatrix: []int16{16384},
+			},
+			[]float32{0.5},
+		},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			decoder, err := NewDecoder(test.header, newDecoder)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			// Each stream is a 20ms packet, all but the last self-delimited
+			packet := []byte{}
+			for i := 1; i < int(test.header.StreamCount); i++ {
+				packet = append(packet, 0x08, 1, 0)
+			}
+			packet = append(packet, 0x08, 0)
+
+			out := make([]float32, 960*int(test.header.Channels))
+			samples, err := decoder.DecodeFloat32(packet, out)
+			switch {
+			case err != nil:
+				t.Fatal(err)
+			case samples != 960:
+				t.Fatal(samples)
+			}
+
+			// The second sample has a value of 1, scaled by the matrix
+			channels := int(test.header.Channels)
+			for channel, expected := range test.expected {
+				if out[channels+channel] != expected {
+					t.Fatalf("channel %d: expected %f, got %f", channel, expected, out[channels+channel])
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,142 @@
+package oggreader
+
+import (
+	"encoding/binary"
+	"errors"
+)
+
+// Channel mapping families
+//
+// https://tools.ietf.org/html/rfc7845.html#section-5.1.1
+const (
+	ChannelMappingFamilyRTP        = 0
+	ChannelMappingFamilyVorbis     = 1
+	ChannelMappingFamilyAmbisonics = 2
+	ChannelMappingFamilyProjection = 3
+	ChannelMappingFamilyUndefined  = 255
+)
+
+const (
+	channelMappingSilent               = 255
+	channelMappingTableHeaderLength    = 2
+	maxVorbisChannels                  = 8
+	maxAmbisonicsOrder                 = 14
+	ambisonicsNonDiegeticChannelsCount = 2
+)
+
+var (
+	errBadChannelCount   = errors.New("channel count is invalid for the channel mapping family")
+	errBadStreamCount    = errors.New("stream and coupled stream counts are invalid")
+	errBadChannelMapping = errors.New("channel mapping references a channel that is not decoded")
+)
+
+// The channel mapping table is present for every family but 0. It
+// contains the number of streams, the number of coupled (stereo) streams
+// and which decoded channel each output channel maps to. A header can be
+// longer than its table, the bytes that follow are ignored.
+//
+//      0                   1                   2                   3
+//      0 1 2 3 4 5 6 7 8 9 0 1 2 3 4 5 6 7 8 9 0 1 2 3 4 5 6 7 8 9 0 1
+//                                                     +-+-+-+-+-+-+-+-+
+//                                                     | Stream Count  |
+//     +-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+
+//     | Coupled Count |              Channel Mapping...               :
+//     +-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+
+//
+// https://tools.ietf.org/html/rfc7845.html#section-5.1.1
+func (h *OggHeader) parseChannelMappingTable(table []byte) error {
+	if h.ChannelMap == ChannelMappingFamilyRTP {
+		// Family 0 has no table, it is a single mono or stereo stream
+		if h.Channels != 1 && h.Channels != 2 {
+			return errBadChannelCount
+		}
+
+		h.StreamCount = 1
+		h.CoupledCount = h.Channels - 1
+		h.ChannelMapping = []uint8{0, 1}[:h.Channels]
+		return nil
+	}
+
+	if err := h.validateChannelCount(); err != nil {
+		return err
+	}
+
+	if len(table) < channelMappingTableHeaderLength {
+		return errBadIDPageLength
+	}
+
+	// The stream count MUST be larger than zero, the coupled count MUST
+	// be no larger than the stream count and the total number of decoded
+	// channels MUST be no larger than 255.
+	h.StreamCount = table[0]
+	h.CoupledCount = table[1]
+	decodedChannels := int(h.StreamCount) + int(h.CoupledCount)
+	if h.StreamCount == 0 || h.CoupledCount > h.StreamCount || decodedChannels > 255 {
+		return errBadStreamCount
+	}
+	table = table[channelMappingTableHeaderLength:]
+
+	// Family 3 replaces the mapping with a demixing matrix of 16-bit
+	// signed little endian values
+	//
+	// https://tools.ietf.org/html/rfc8486.html#section-3.2
+	if h.ChannelMap == ChannelMappingFamilyProjection {
+		if len(table) < 2*int(h.Channels)*decodedChannels {
+			return errBadIDPageLength
+		}
+
+		h.DemixingMatrix = make([]int16, int(h.Channels)*decodedChannels)
+		for i := range h.DemixingMatrix {
+			h.DemixingMatrix[i] = int16(binary.LittleEndian.Uint16(table[2*i:]))
+		}
+		return nil
+	}
+
+	if len(table) < int(h.Channels) {
+		return errBadIDPageLength
+	}
+
+	h.ChannelMapping = append([]uint8{}, table[:h.Channels]...)
+	for _, index := range h.ChannelMapping {
+		if index != channelMappingSilent && int(index) >= decodedChannels {
+			return errBadChannelMapping
+		}
+	}
+
+	return nil
+}
+
+func (h *OggHeader) validateChannelCount() error {
+	switch h.ChannelMap {
+	case ChannelMappingFamilyVorbis:
+		// Family 1 covers 1 to 8 channels in Vorbis channel order
+		if h.Channels < 1 || h.Channels > maxVorbisChannels {
+			return errBadChannelCount
+		}
+	case ChannelMappingFamilyAmbisonics, ChannelMappingFamilyProjection:
+		// Ambisonics carries (1 + n)^2 channels for an order n of 0 to
+		// 14, optionally followed by two non-diegetic stereo channels
+		//
+		// https://tools.ietf.org/html/rfc8486.html#section-3.1
+		if !isValidAmbisonicsChannelCount(int(h.Channels)) {
+			return errBadChannelCount
+		}
+	default:
+		if h.Channels == 0 {
+			return errBadChannelCount
+		}
+	}
+
+	return nil
+}
+
+func isValidAmbisonicsChannelCount(channels int) bool {
+	for order := 0; order <= maxAmbisonicsOrder; order++ {
+		ambisonicChannels := (order + 1) * (order + 1)
+		if channels == ambisonicChannels || channels == ambisonicChannels+ambisonicsNonDiegeticChannelsCount {
+			return true
+		}
+	}
+
+	return false
+}
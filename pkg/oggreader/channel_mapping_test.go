@@ -0,0 +1,138 @@
+package oggreader
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"reflect"
+	"testing"
+)
+
+func buildIDPage(channels, family uint8, table []byte) []byte {
+	payload := []byte(idPageSignature)
+	payload = append(payload, 1, channels, 0x38, 0x01, 0x80, 0xbb, 0x00, 0x00, 0x00, 0x00, family)
+	payload = append(payload, table...)
+
+	return buildOggPage(pageHeaderTypeBeginningOfStream, 0, 0, []byte{byte(len(payload))}, payload)
+}
+
+func TestOggReader_ChannelMappingTable(t *testing.T) {
+	t.Run("Family 0", func(t *testing.T) {
+		_, header, err := NewWith(bytes.NewReader(buildIDPage(2, ChannelMappingFamilyRTP, nil)))
+		switch {
+		case err != nil:
+			t.Fatal(err)
+		case header.StreamCount != 1 || header.CoupledCount != 1:
+			t.Fatal(header)
+		case !reflect.DeepEqual(header.ChannelMapping, []uint8{0, 1}):
+			t.Fatal(header.ChannelMapping)
+		}
+	})
+
+	t.Run("Family 1 5.1 surround", func(t *testing.T) {
+		_, header, err := NewWith(bytes.NewReader(buildIDPage(6, ChannelMappingFamilyVorbis, []byte{4, 2, 0, 4, 1, 2, 3, 5})))
+		switch {
+		case err != nil:
+			t.Fatal(err)
+		case header.StreamCount != 4 || header.CoupledCount != 2:
+			t.Fatal(header)
+		case !reflect.DeepEqual(header.ChannelMapping, []uint8{0, 4, 1, 2, 3, 5}):
+			t.Fatal(header.ChannelMapping)
+		}
+	})
+
+	t.Run("Family 2 first order with non-diegetic stereo", func(t *testing.T) {
+		_, header, err := NewWith(bytes.NewReader(buildIDPage(6, ChannelMappingFamilyAmbisonics, []byte{5, 1, 1, 2, 3, 4, 0, 5})))
+		switch {
+		case err != nil:
+			t.Fatal(err)
+		case !reflect.DeepEqual(header.ChannelMapping, []uint8{1, 2, 3, 4, 0, 5}):
+			t.Fatal(header.ChannelMapping)
+		}
+	})
+
+	t.Run("Family 3 first order", func(t *testing.T) {
+		table := []byte{2, 2}
+		for i := 0; i < 4*4; i++ {
+			table = append(table, 0, 0)
+			binary.LittleEndian.PutUint16(table[len(table)-2:], uint16(int16(i-8)))
+		}
+
+		_, header, err := NewWith(bytes.NewReader(buildIDPage(4, ChannelMappingFamilyProjection, table)))
+		switch {
+		case err != nil:
+			t.Fatal(err)
+		case header.ChannelMapping != nil:
+			t.Fatal(header.ChannelMapping)
+		case len(header.DemixingMatrix) != 16 || header.DemixingMatrix[0] != -8 || header.DemixingMatrix[15] != 7:
+			t.Fatal(header.DemixingMatrix)
+		}
+	})
+
+	t.Run("Trailing bytes", func(t *testing.T) {
+		// Headers may be longer than their channel mapping table
+		//
+		// https://tools.ietf.org/html/rfc7845.html#section-5.1
+		_, header, err := NewWith(bytes.NewReader(buildIDPage(2, ChannelMappingFamilyRTP, []byte{1, 1})))
+		switch {
+		case err != nil:
+			t.Fatal(err)
+		case !reflect.DeepEqual(header.ChannelMapping, []uint8{0, 1}):
+			t.Fatal(header.ChannelMapping)
+		}
+
+		_, header, err = NewWith(bytes.NewReader(buildIDPage(2, ChannelMappingFamilyVorbis, []byte{1, 1, 0, 1, 0xde, 0xad})))
+		switch {
+		case err != nil:
+			t.Fatal(err)
+		case !reflect.DeepEqual(header.ChannelMapping, []uint8{0, 1}):
+			t.Fatal(header.ChannelMapping)
+		}
+
+		_, header, err = NewWith(bytes.NewReader(buildIDPage(1, ChannelMappingFamilyProjection, []byte{1, 0, 0xff, 0x7f, 0xde, 0xad})))
+		switch {
+		case err != nil:
+			t.Fatal(err)
+		case !reflect.DeepEqual(header.DemixingMatrix, []int16{32767}):
+			t.Fatal(header.DemixingMatrix)
+		}
+	})
+
+	t.Run("Family 255 with silent channel", func(t *testing.T) {
+		_, header, err := NewWith(bytes.NewReader(buildIDPage(3, ChannelMappingFamilyUndefined, []byte{2, 0, 1, 255, 0})))
+		switch {
+		case err != nil:
+			t.Fatal(err)
+		case !reflect.DeepEqual(header.ChannelMapping, []uint8{1, 255, 0}):
+			t.Fatal(header.ChannelMapping)
+		}
+	})
+}
+
+func TestOggReader_ChannelMappingTableErrors(t *testing.T) {
+	for _, test := range []struct {
+		name     string
+		channels uint8
+		family   uint8
+		table    []byte
+		err      error
+	}{
+		{"Family 0 surround", 3, ChannelMappingFamilyRTP, nil, errBadChannelCount},
+		{"Family 1 missing table", 2, ChannelMappingFamilyVorbis, nil, errBadIDPageLength},
+		{"Family 1 too many channels", 9, ChannelMappingFamilyVorbis, []byte{9, 0, 0, 1, 2, 3, 4, 5, 6, 7, 8}, errBadChannelCount},
+		{"Zero streams", 1, ChannelMappingFamilyVorbis, []byte{0, 0, 0}, errBadStreamCount},
+		{"More coupled than streams", 2, ChannelMappingFamilyVorbis, []byte{1, 2, 0, 1}, errBadStreamCount},
+		{"Short mapping", 2, ChannelMappingFamilyVorbis, []byte{2, 0, 0}, errBadIDPageLength},
+		{"Mapping out of range", 2, ChannelMappingFamilyVorbis, []byte{1, 0, 0, 1}, errBadChannelMapping},
+		{"Family 2 invalid channel count", 5, ChannelMappingFamilyAmbisonics, []byte{5, 0, 0, 1, 2, 3, 4}, errBadChannelCount},
+		{"Family 3 invalid channel count", 7, ChannelMappingFamilyProjection, []byte{4, 3}, errBadChannelCount},
+		{"Family 3 short matrix", 4, ChannelMappingFamilyProjection, []byte{2, 2, 0, 0}, errBadIDPageLength},
+	} {
+		test := test
+		t.Run(test.name, func(t *testing.T) {
+			if _, _, err := NewWith(bytes.NewReader(buildIDPage(test.channels, test.family, test.table))); !errors.Is(err, test.err) {
+				t.Fatal(err)
+			}
+		})
+	}
+}
@@ -2,29 +2,45 @@
 package oggreader
 
 import (
+	"bytes"
 	"encoding/binary"
 	"errors"
 	"io"
+
+	"github.com/pion/opus/internal/oggcrc"
 )
 
 const (
+	pageHeaderTypeContinuedPacket   = 0x01
 	pageHeaderTypeBeginningOfStream = 0x02
+	pageHeaderTypeEndOfStream       = 0x04
 	pageHeaderSignature             = "OggS"
 
-	idPageSignature = "OpusHead"
+	idPageSignature   = "OpusHead"
+	tagsPageSignature = "OpusTags"
 
 	pageHeaderLen       = 27
 	idPagePayloadLength = 19
+
+	// A lacing value of 255 means the packet continues in the next segment
+	maxSegmentSize = 255
+
+	// How much is read at a time when scanning for a capture pattern
+	resyncChunkSize = 4096
 )
 
 var (
 	errNilStream                 = errors.New("stream is nil")
 	errBadIDPageSignature        = errors.New("bad header signature")
 	errBadIDPageType             = errors.New("wrong header, expected beginning of stream")
-	errBadIDPageLength           = errors.New("payload for id page must be 19 bytes")
+	errBadIDPageLength           = errors.New("payload for id page has an invalid length")
 	errBadIDPagePayloadSignature = errors.New("bad payload signature")
+	errSerialNotFound            = errors.New("no Opus stream with the requested serial number")
 	errShortPageHeader           = errors.New("not enough data for payload header")
 	errChecksumMismatch          = errors.New("expected and actual checksum do not match")
+	errBadTagsPayloadSignature   = errors.New("bad comment header signature")
+	errBadTagsLength             = errors.New("comment header length field exceeds the payload")
+	errBadTagsUserComment        = errors.New("comment header user comment is missing a field name")
 )
 
 // OggReader is used to read Ogg files and return page payloads
@@ -33,10 +49,55 @@ type OggReader struct {
 	bytesReadSuccesfully int64
 	checksumTable        *[256]uint32
 	doChecksum           bool
+
+	// Resynchronize on the next valid page instead of failing, and do so
+	// before reading the first page
+	doRecovery bool
+	needsSync  bool
+
+	// Sequence number of the last page read of each logical stream, to
+	// detect lost pages
+	pageIndexes map[uint32]uint32
+
+	// Serial number of the logical stream ReadPacket returns packets of,
+	// and whether any of its pages after the ID header were read. The
+	// first chain link's serial number is kept for seeking.
+	serial      uint32
+	hasSerial   bool
+	pastHeaders bool
+	firstSerial uint32
+
+	// Serial number of the multiplexed Opus stream to follow, set by
+	// WithSerial
+	wantSerial    uint32
+	hasWantSerial bool
+
+	// Bytes read from stream while scanning for a capture pattern that
+	// haven't been consumed yet, and how many bytes were read from stream
+	unread       []byte
+	streamOffset int64
+
+	header *OggHeader
+
+	// Offsets of the end of the ID header page and the start of the first
+	// audio data page, and the granule position the audio data starts at,
+	// used by seeking. dataOffset is -1 until known.
+	idPageEndOffset int64
+	dataOffset      int64
+	baseGranule     uint64
+
+	// Packets completed on the most recently read page, and the start
+	// of a packet that continues on the next page
+	packets           [][]byte
+	packetsPageHeader *OggPageHeader
+	partialPacket     []byte
 }
 
-// OggHeader is the metadata from the first two pages
-// in the file (ID and Comment)
+// OggHeader is the metadata of the ID header, the first page of an Opus
+// stream: its version, channel count, pre-skip, input sample rate, output
+// gain and channel mapping family, and for mapping families other than 0
+// the stream counts and the channel mapping or demixing matrix. The
+// comment header is read separately by ReadTags.
 //
 // https://tools.ietf.org/html/rfc7845.html#section-3
 type OggHeader struct {
@@ -46,6 +107,22 @@ type OggHeader struct {
 	PreSkip    uint16
 	SampleRate uint32
 	Version    uint8
+
+	// StreamCount is the number of Opus streams in each packet, and
+	// CoupledCount how many of them are stereo
+	StreamCount  uint8
+	CoupledCount uint8
+
+	// ChannelMapping holds, for each output channel, the index of the
+	// decoded channel it is taken from or 255 for a silent channel.
+	// Unset for channel mapping family 3.
+	ChannelMapping []uint8
+
+	// DemixingMatrix is the matrix of channel mapping family 3 that
+	// turns the decoded channels into the output channels. It has
+	// Channels rows and StreamCount+CoupledCount columns and is stored
+	// in column-major order.
+	DemixingMatrix []int16
 }
 
 // OggPageHeader is the metadata for a Page
@@ -55,6 +132,24 @@ type OggHeader struct {
 type OggPageHeader struct {
 	GranulePosition uint64
 
+	// PagesLost is the number of pages missing between this page and the
+	// previous one, found from the gap in their sequence numbers
+	PagesLost uint32
+
+	// OutOfSequence is set when the sequence number of the page doesn't
+	// move forward from the previous page of its stream, for a duplicated
+	// page or one that arrived out of order. Such pages don't count as
+	// lost pages, and ReadPacket skips them.
+	OutOfSequence bool
+
+	// PagesSkipped is the number of out of sequence pages ReadPacket
+	// skipped just before this page
+	PagesSkipped uint32
+
+	// ChecksumMismatch is set when, with WithRecovery, the page read just
+	// before this one failed its checksum and was skipped
+	ChecksumMismatch bool
+
 	sig           [4]byte
 	version       uint8
 	headerType    uint8
@@ -63,21 +158,110 @@ type OggPageHeader struct {
 	segmentsCount uint8
 }
 
+// Serial returns the serial number of the logical stream the page belongs
+// to
+func (h *OggPageHeader) Serial() uint32 {
+	return h.serial
+}
+
+// BeginningOfStream reports whether the page is the first of its logical
+// stream
+func (h *OggPageHeader) BeginningOfStream() bool {
+	return h.headerType&pageHeaderTypeBeginningOfStream != 0
+}
+
+// EndOfStream reports whether the page is the last of its logical stream
+func (h *OggPageHeader) EndOfStream() bool {
+	return h.headerType&pageHeaderTypeEndOfStream != 0
+}
+
+// SequenceNumber returns the page sequence number, which increases by one
+// with each page of a logical stream
+func (h *OggPageHeader) SequenceNumber() uint32 {
+	return h.index
+}
+
+// OggPacketHeader is the metadata for a Packet reassembled from the
+// lacing values of one or more pages
+//
+// https://tools.ietf.org/html/rfc7845.html#section-3
+type OggPacketHeader struct {
+	// GranulePosition is the granule position of the page the packet
+	// ended on. Only the last packet completed on a page has a granule
+	// position, for all others HasGranulePosition is false.
+	GranulePosition    uint64
+	HasGranulePosition bool
+
+	// PageHeader is the header of the page the packet ended on
+	PageHeader *OggPageHeader
+
+	// NewHeader is set on the first packet of every chain link after the
+	// first one, to the ID header of the link. That packet is the link's
+	// comment header, which can be read with ParseTags.
+	NewHeader *OggHeader
+}
+
+// Option configures an OggReader
+type Option func(*OggReader)
+
+// WithRecovery makes the reader skip over corrupted data. When a page
+// fails its checksum or doesn't start with a capture pattern, the stream
+// is scanned for the next valid page and reading carries on from there.
+// Skipped pages are reported by OggPageHeader.PagesLost.
+func WithRecovery() Option {
+	return func(o *OggReader) {
+		o.doRecovery = true
+	}
+}
+
+// WithMidStreamStart allows reading a stream that doesn't start at its
+// beginning, like a live stream joined late. The reader synchronizes on
+// the first valid page and the headers are not read, so NewWith returns a
+// nil OggHeader. It implies WithRecovery.
+func WithMidStreamStart() Option {
+	return func(o *OggReader) {
+		o.doRecovery = true
+		o.needsSync = true
+	}
+}
+
+// WithSerial makes the reader follow the Opus stream with the given serial
+// number, instead of the first one, when several are multiplexed. NewWith
+// fails if none of the beginning of stream pages has it. The serial number
+// only picks the stream of the first chain link: each link of a chained
+// file starts new streams with new serial numbers, and ReadPacket follows
+// the first Opus stream of every later link.
+func WithSerial(serial uint32) Option {
+	return func(o *OggReader) {
+		o.wantSerial = serial
+		o.hasWantSerial = true
+	}
+}
+
 // NewWith returns a new Ogg reader and Ogg header
 // with an io.Reader input
-func NewWith(in io.Reader) (*OggReader, *OggHeader, error) {
-	return newWith(in /* doChecksum */, true)
+func NewWith(in io.Reader, opts ...Option) (*OggReader, *OggHeader, error) {
+	return newWith(in /* doChecksum */, true, opts...)
 }
 
-func newWith(in io.Reader, doChecksum bool) (*OggReader, *OggHeader, error) {
+func newWith(in io.Reader, doChecksum bool, opts ...Option) (*OggReader, *OggHeader, error) {
 	if in == nil {
 		return nil, nil, errNilStream
 	}
 
 	reader := &OggReader{
 		stream:        in,
-		checksumTable: generateChecksumTable(),
+		checksumTable: oggcrc.GenerateTable(),
 		doChecksum:    doChecksum,
+		dataOffset:    -1,
+	}
+
+	for _, opt := range opts {
+		opt(reader)
+	}
+
+	if reader.needsSync {
+		return reader, nil, nil
 	}
 
 	header, err := reader.readHeaders()
@@ -85,25 +269,61 @@ func newWith(in io.Reader, doChecksum bool) (*OggReader, *OggHeader, error) {
 		return nil, nil, err
 	}
 
+	reader.header = header
+	reader.firstSerial = reader.serial
+	reader.idPageEndOffset = reader.bytesReadSuccesfully
+
 	return reader, header, nil
 }
 
+// A multiplexed stream starts with the beginning of stream pages of all
+// its logical streams, the first Opus one is read unless WithSerial picks
+// another.
+//
+// https://tools.ietf.org/html/rfc3533.html#section-4
 func (o *OggReader) readHeaders() (*OggHeader, error) {
-	payload, pageHeader, err := o.ParseNextPage()
-	if err != nil {
-		return nil, err
-	}
+	var skipErr error
+	for {
+		payload, pageHeader, err := o.ParseNextPage()
+		switch {
+		case errors.Is(err, io.EOF) && skipErr != nil:
+			return nil, skipErr
+		case err != nil:
+			return nil, err
+		case string(pageHeader.sig[:]) != pageHeaderSignature:
+			return nil, errBadIDPageSignature
+		case pageHeader.headerType != pageHeaderTypeBeginningOfStream && skipErr != nil:
+			return nil, skipErr
+		case pageHeader.headerType != pageHeaderTypeBeginningOfStream:
+			return nil, errBadIDPageType
+		case len(payload) < idPagePayloadLength:
+			return nil, errBadIDPageLength
+		}
 
-	header := &OggHeader{}
-	if string(pageHeader.sig[:]) != pageHeaderSignature {
-		return nil, errBadIDPageSignature
-	}
+		header, err := ParseIDHeader(payload)
+		if errors.Is(err, errBadIDPagePayloadSignature) {
+			// Not an Opus stream
+			skipErr = err
+			continue
+		} else if err != nil {
+			return nil, err
+		} else if o.hasWantSerial && pageHeader.serial != o.wantSerial {
+			skipErr = errSerialNotFound
+			continue
+		}
 
-	if pageHeader.headerType != pageHeaderTypeBeginningOfStream {
-		return nil, errBadIDPageType
+		o.serial = pageHeader.serial
+		o.hasSerial = true
+		return header, nil
 	}
+}
 
-	if len(payload) != idPagePayloadLength {
+// ParseIDHeader parses an OpusHead ID header packet, which other
+// containers also carry, like the CodecPrivate of Matroska
+//
+// https://tools.ietf.org/html/rfc7845.html#section-5.1
+func ParseIDHeader(payload []byte) (*OggHeader, error) {
+	if len(payload) < idPagePayloadLength {
 		return nil, errBadIDPageLength
 	}
 
@@ -111,6 +331,7 @@ func (o *OggReader) readHeaders() (*OggHeader, error) {
 		return nil, errBadIDPagePayloadSignature
 	}
 
+	header := &OggHeader{}
 	header.Version = payload[8]
 	header.Channels = payload[9]
 	header.PreSkip = binary.LittleEndian.Uint16(payload[10:12])
@@ -118,19 +339,207 @@ func (o *OggReader) readHeaders() (*OggHeader, error) {
 	header.OutputGain = binary.LittleEndian.Uint16(payload[16:18])
 	header.ChannelMap = payload[18]
 
+	if err := header.parseChannelMappingTable(payload[idPagePayloadLength:]); err != nil {
+		return nil, err
+	}
+
 	return header, nil
 }
 
 // ParseNextPage reads from stream and returns Ogg page payload, header,
 // and an error if there is incomplete page data.
 func (o *OggReader) ParseNextPage() ([]byte, *OggPageHeader, error) {
+	payload, pageHeader, _, err := o.parseNextPage()
+	return payload, pageHeader, err
+}
+
+// ReadPacket reads from stream and returns the next Opus packet, split
+// from the page payloads by their lacing values. Packets that span pages
+// are joined, and a partial packet whose start or end was lost is
+// dropped. ReadPacket and ParseNextPage should not be mixed, packets
+// already buffered by ReadPacket are not returned by ParseNextPage.
+// Duplicated pages and pages that arrive out of order are skipped.
+//
+// Only the packets of one logical Opus stream are returned, pages of
+// other streams multiplexed with it are skipped. When an Opus stream
+// starts after the current one, as in chained files, ReadPacket carries on
+// with the new stream and reports its ID header through
+// OggPacketHeader.NewHeader, whatever the serial number WithSerial picked.
+//
+// https://tools.ietf.org/html/rfc3533.html#section-6
+func (o *OggReader) ReadPacket() ([]byte, *OggPacketHeader, error) {
+	var newHeader *OggHeader
+	pagesSkipped := uint32(0)
+	for len(o.packets) == 0 {
+		payload, pageHeader, segments, err := o.parseNextPage()
+		if err != nil {
+			return nil, nil, err
+		}
+
+		if pageHeader.headerType&pageHeaderTypeBeginningOfStream != 0 {
+			// The beginning of stream pages of multiplexed streams all come
+			// before any other page, a later one starts a chain link
+			header, err := ParseIDHeader(payload)
+			if err == nil && (o.pastHeaders || !o.hasSerial) {
+				o.serial = pageHeader.serial
+				o.hasSerial = true
+				o.pastHeaders = false
+				o.partialPacket = nil
+				newHeader = header
+			}
+			continue
+		}
+
+		if !o.hasSerial {
+			// Started in the middle of a stream, follow the first one seen
+			o.serial = pageHeader.serial
+			o.hasSerial = true
+		} else if pageHeader.serial != o.serial {
+			continue
+		}
+		o.pastHeaders = true
+
+		if pageHeader.OutOfSequence {
+			pagesSkipped++
+			continue
+		}
+		pageHeader.PagesSkipped = pagesSkipped
+		pagesSkipped = 0
+
+		o.splitPackets(payload, pageHeader, segments)
+	}
+
+	packet := o.packets[0]
+	o.packets = o.packets[1:]
+
+	packetHeader := &OggPacketHeader{PageHeader: o.packetsPageHeader, NewHeader: newHeader}
+	if len(o.packets) == 0 {
+		packetHeader.GranulePosition = o.packetsPageHeader.GranulePosition
+		packetHeader.HasGranulePosition = true
+	}
+
+	return packet, packetHeader, nil
+}
+
+// Each page's segment table holds one lacing value per segment. A packet
+// is made of the segments up to and including the first one with a
+// lacing value below 255. If the last lacing value of a page is 255 the
+// packet continues on the next page, which has the continued packet
+// flag set.
+//
+// https://tools.ietf.org/html/rfc3533.html#section-6
+func (o *OggReader) splitPackets(payload []byte, pageHeader *OggPageHeader, segments []byte) {
+	o.packets = o.packets[:0]
+	o.packetsPageHeader = pageHeader
+
+	// Whatever continued the partial packet was lost with the pages
+	if pageHeader.PagesLost != 0 {
+		o.partialPacket = nil
+	}
+
+	isContinued := pageHeader.headerType&pageHeaderTypeContinuedPacket != 0
+	switch {
+	case isContinued && o.partialPacket == nil:
+		// The start of the packet was lost, skip to the first packet
+		// that begins on this page
+		for len(segments) != 0 {
+			size := segments[0]
+			payload, segments = payload[size:], segments[1:]
+			if size < maxSegmentSize {
+				break
+			}
+		}
+	case !isContinued && o.partialPacket != nil:
+		// The end of the packet was lost
+		o.partialPacket = nil
+	}
+
+	packet := o.partialPacket
+	o.partialPacket = nil
+	for i, size := range segments {
+		packet = append(packet, payload[:size]...)
+		payload = payload[size:]
+
+		if size < maxSegmentSize {
+			o.packets = append(o.packets, packet)
+			packet = nil
+		} else if i == len(segments)-1 {
+			o.partialPacket = packet
+		}
+	}
+}
+
+// oggPage is a single parsed page, along with its location in the stream
+type oggPage struct {
+	header   *OggPageHeader
+	segments []byte
+	payload  []byte
+	offset   int64
+}
+
+func (o *OggReader) parseNextPage() ([]byte, *OggPageHeader, []byte, error) {
+	var (
+		page *oggPage
+		raw  []byte
+		err  error
+	)
+
+	if o.needsSync {
+		page, err = o.resync()
+		o.needsSync = false
+	} else {
+		page, raw, err = o.readPage()
+		if o.doRecovery && isCorruptedPage(page, err) {
+			// Continue scanning right after the corrupted page's first byte
+			checksumMismatch := errors.Is(err, errChecksumMismatch)
+			o.unread = append(raw[1:], o.unread...)
+			if page, err = o.resync(); err == nil {
+				page.header.ChecksumMismatch = checksumMismatch
+			}
+		}
+	}
+	if err != nil {
+		return nil, nil, nil, err
+	}
+
+	if o.pageIndexes == nil {
+		o.pageIndexes = map[uint32]uint32{}
+	}
+	// Pages are only lost when the sequence number moves forward, the
+	// last sequence number stays that of the furthest page read
+	if pageIndex, ok := o.pageIndexes[page.header.serial]; ok && page.header.index <= pageIndex {
+		page.header.OutOfSequence = true
+	} else {
+		if ok {
+			page.header.PagesLost = page.header.index - pageIndex - 1
+		}
+		o.pageIndexes[page.header.serial] = page.header.index
+	}
+
+	o.bytesReadSuccesfully = o.offset()
+	return page.payload, page.header, page.segments, nil
+}
+
+func isCorruptedPage(page *oggPage, err error) bool {
+	if err != nil {
+		return errors.Is(err, errChecksumMismatch)
+	}
+
+	return string(page.header.sig[:]) != pageHeaderSignature || page.header.version != 0
+}
+
+// readPage reads a single page from the current position. Everything that
+// was read is returned, even on error, so it can be scanned again when
+// resynchronizing.
+func (o *OggReader) readPage() (*oggPage, []byte, error) {
+	page := &oggPage{offset: o.offset()}
 	h := make([]byte, pageHeaderLen)
 
-	n, err := io.ReadFull(o.stream, h)
+	n, err := o.read(h)
 	if err != nil {
-		return nil, nil, err
+		return nil, h[:n], err
 	} else if n < len(h) {
-		return nil, nil, errShortPageHeader
+		return nil, h[:n], errShortPageHeader
 	}
 
 	pageHeader := &OggPageHeader{
@@ -145,8 +554,10 @@ func (o *OggReader) ParseNextPage() ([]byte, *OggPageHeader, error) {
 	pageHeader.segmentsCount = h[26]
 
 	sizeBuffer := make([]byte, pageHeader.segmentsCount)
-	if _, err = io.ReadFull(o.stream, sizeBuffer); err != nil {
-		return nil, nil, err
+	n, err = o.read(sizeBuffer)
+	raw := append(h, sizeBuffer[:n]...)
+	if err != nil {
+		return nil, raw, err
 	}
 
 	payloadSize := 0
@@ -155,38 +566,103 @@ func (o *OggReader) ParseNextPage() ([]byte, *OggPageHeader, error) {
 	}
 
 	payload := make([]byte, payloadSize)
-	if _, err = io.ReadFull(o.stream, payload); err != nil {
-		return nil, nil, err
+	n, err = o.read(payload)
+	raw = append(raw, payload[:n]...)
+	if err != nil {
+		return nil, raw, err
 	}
 
 	if o.doChecksum {
-		var checksum uint32
-		updateChecksum := func(v byte) {
-			checksum = (checksum << 8) ^ o.checksumTable[byte(checksum>>24)^v]
+		// Don't include expected checksum in our generation
+		var emptyChecksum [4]byte
+		checksum := oggcrc.Update(o.checksumTable, 0, h[:22])
+		checksum = oggcrc.Update(o.checksumTable, checksum, emptyChecksum[:])
+		checksum = oggcrc.Update(o.checksumTable, checksum, h[26:])
+		checksum = oggcrc.Update(o.checksumTable, checksum, sizeBuffer)
+		checksum = oggcrc.Update(o.checksumTable, checksum, payload)
+
+		if binary.LittleEndian.Uint32(h[22:22+4]) != checksum {
+			return nil, raw, errChecksumMismatch
 		}
+	}
 
-		for index := range h {
-			// Don't include expected checksum in our generation
-			if index > 21 && index < 26 {
-				updateChecksum(0)
-				continue
-			}
+	page.header = pageHeader
+	page.segments = sizeBuffer
+	page.payload = payload
+	return page, raw, nil
+}
 
-			updateChecksum(h[index])
+// resync scans forward from the current position for the next capture
+// pattern that starts a valid page. A capture pattern can also appear
+// inside of page data, so candidates are only accepted if their checksum
+// matches.
+//
+// https://tools.ietf.org/html/rfc3533.html#section-6
+func (o *OggReader) resync() (*oggPage, error) {
+	for {
+		if err := o.syncCapturePattern(); err != nil {
+			return nil, err
 		}
-		for _, s := range sizeBuffer {
-			updateChecksum(s)
+
+		page, raw, err := o.readPage()
+		if err == nil && page.header.version == 0 {
+			o.bytesReadSuccesfully = o.offset()
+			return page, nil
 		}
-		for index := range payload {
-			updateChecksum(payload[index])
+
+		// Not a page, continue scanning right after its capture pattern
+		o.unread = append(raw[1:], o.unread...)
+	}
+}
+
+// syncCapturePattern discards bytes until the stream is positioned on the
+// "OggS" capture pattern
+func (o *OggReader) syncCapturePattern() error {
+	for {
+		if index := bytes.Index(o.unread, []byte(pageHeaderSignature)); index >= 0 {
+			o.unread = o.unread[index:]
+			return nil
 		}
 
-		if binary.LittleEndian.Uint32(h[22:22+4]) != checksum {
-			return nil, nil, errChecksumMismatch
+		// The last bytes may be the start of a capture pattern split
+		// across reads
+		keep := len(pageHeaderSignature) - 1
+		if len(o.unread) < keep {
+			keep = len(o.unread)
 		}
+
+		chunk := make([]byte, resyncChunkSize)
+		n, err := o.stream.Read(chunk)
+		o.streamOffset += int64(n)
+		o.unread = append(append([]byte{}, o.unread[len(o.unread)-keep:]...), chunk[:n]...)
+
+		if n == 0 && err != nil {
+			return err
+		}
+	}
+}
+
+// read fills p, first from bytes left over by syncCapturePattern
+func (o *OggReader) read(p []byte) (int, error) {
+	n := copy(p, o.unread)
+	o.unread = o.unread[n:]
+	if n == len(p) {
+		return n, nil
+	}
+
+	m, err := io.ReadFull(o.stream, p[n:])
+	o.streamOffset += int64(m)
+	if errors.Is(err, io.EOF) && n != 0 {
+		err = io.ErrUnexpectedEOF
 	}
 
-	return payload, pageHeader, nil
+	return n + m, err
+}
+
+// offset returns the position in the stream of the next byte to be
+// consumed
+func (o *OggReader) offset() int64 {
+	return o.streamOffset - int64(len(o.unread))
 }
 
 // ResetReader resets the internal stream of OggReader. This is useful
@@ -194,22 +670,6 @@ func (o *OggReader) ParseNextPage() ([]byte, *OggPageHeader, error) {
 // data being finished.
 func (o *OggReader) ResetReader(reset func(bytesRead int64) io.Reader) {
 	o.stream = reset(o.bytesReadSuccesfully)
-}
-
-func generateChecksumTable() *[256]uint32 {
-	var table [256]uint32
-	const poly = 0x04c11db7
-
-	for i := range table {
-		r := uint32(i) << 24
-		for j := 0; j < 8; j++ {
-			if (r & 0x80000000) != 0 {
-				r = (r << 1) ^ poly
-			} else {
-				r <<= 1
-			}
-			table[i] = (r & 0xffffffff)
-		}
-	}
-	return &table
+	o.streamOffset = o.bytesReadSuccesfully
+	o.unread = nil
 }
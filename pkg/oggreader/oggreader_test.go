@@ -2,10 +2,13 @@ package oggreader
 
 import (
 	"bytes"
+	"encoding/binary"
 	"errors"
 	"io"
 	"reflect"
 	"testing"
+
+	"github.com/pion/opus/internal/oggcrc"
 )
 
 // buildOggFile generates a valid oggfile that can
@@ -23,6 +26,24 @@ func buildOggContainer() []byte {
 	}
 }
 
+// buildOggPage generates a single page with a valid checksum from
+// its lacing values and payload
+func buildOggPage(headerType uint8, granulePosition uint64, index uint32, segments []byte, payload []byte) []byte {
+	page := make([]byte, pageHeaderLen, pageHeaderLen+len(segments)+len(payload))
+	copy(page, pageHeaderSignature)
+	page[5] = headerType
+	binary.LittleEndian.PutUint64(page[6:], granulePosition)
+	binary.LittleEndian.PutUint32(page[14:], 0xaa209b8e)
+	binary.LittleEndian.PutUint32(page[18:], index)
+	page[26] = uint8(len(segments))
+	page = append(page, segments...)
+	page = append(page, payload...)
+
+	binary.LittleEndian.PutUint32(page[22:], oggcrc.Update(oggcrc.GenerateTable(), 0, page))
+
+	return page
+}
+
 func TestOggReader_ParseValidHeader(t *testing.T) {
 	reader, header, err := NewWith(bytes.NewReader(buildOggContainer()))
 	switch {
@@ -129,3 +150,479 @@ func TestOggReader_ParseErrors(t *testing.T) {
 		}
 	})
 }
+
+func TestOggReader_ReadPacket(t *testing.T) {
+	idPage := buildOggContainer()[:47]
+
+	t.Run("Multiple packets per page", func(t *testing.T) {
+		ogg := append([]byte{}, idPage...)
+		ogg = append(ogg, buildOggPage(0, 960, 1, []byte{2, 3, 0, 1}, []byte{0xa, 0xa, 0xb, 0xb, 0xb, 0xc})...)
+
+		reader, _, err := NewWith(bytes.NewReader(ogg))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		expected := [][]byte{{0xa, 0xa}, {0xb, 0xb, 0xb}, nil, {0xc}}
+		for i, e := range expected {
+			packet, packetHeader, err := reader.ReadPacket()
+			switch {
+			case err != nil:
+				t.Fatal(err)
+			case !bytes.Equal(packet, e):
+				t.Fatalf("packet %d: expected %v, got %v", i, e, packet)
+			case packetHeader.HasGranulePosition != (i == len(expected)-1):
+				t.Fatalf("packet %d: unexpected granule position", i)
+			}
+		}
+
+		if _, _, err = reader.ReadPacket(); !errors.Is(err, io.EOF) {
+			t.Fatal(err)
+		}
+	})
+
+	t.Run("Packet spanning pages", func(t *testing.T) {
+		segments := bytes.Repeat([]byte{255}, 255)
+		spanning := bytes.Repeat([]byte{0xd}, 255*255+300)
+
+		ogg := append([]byte{}, idPage...)
+		ogg = append(ogg, buildOggPage(0, 0xffffffffffffffff, 1, segments, spanning[:255*255])...)
+		ogg = append(ogg, buildOggPage(pageHeaderTypeContinuedPacket, 1920, 2, []byte{255, 45, 2}, append(spanning[255*255:], 0xe, 0xe))...)
+
+		reader, _, err := NewWith(bytes.NewReader(ogg))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		packet, packetHeader, err := reader.ReadPacket()
+		switch {
+		case err != nil:
+			t.Fatal(err)
+		case !bytes.Equal(packet, spanning):
+			t.Fatal("spanning packet mismatch")
+		case packetHeader.HasGranulePosition:
+			t.Fatal("only the last packet on a page has a granule position")
+		}
+
+		packet, packetHeader, err = reader.ReadPacket()
+		switch {
+		case err != nil:
+			t.Fatal(err)
+		case !bytes.Equal(packet, []byte{0xe, 0xe}):
+			t.Fatal(packet)
+		case !packetHeader.HasGranulePosition || packetHeader.GranulePosition != 1920:
+			t.Fatal(packetHeader)
+		}
+	})
+
+	t.Run("Lost start of continued packet", func(t *testing.T) {
+		ogg := append([]byte{}, idPage...)
+		ogg = append(ogg, buildOggPage(pageHeaderTypeContinuedPacket, 960, 2, []byte{255, 1, 1}, append(bytes.Repeat([]byte{0xd}, 256), 0xf))...)
+
+		reader, _, err := NewWith(bytes.NewReader(ogg))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		packet, _, err := reader.ReadPacket()
+		switch {
+		case err != nil:
+			t.Fatal(err)
+		case !bytes.Equal(packet, []byte{0xf}):
+			t.Fatal(packet)
+		}
+	})
+
+	t.Run("Lost end of continued packet", func(t *testing.T) {
+		ogg := append([]byte{}, idPage...)
+		ogg = append(ogg, buildOggPage(0, 0xffffffffffffffff, 1, []byte{255}, bytes.Repeat([]byte{0xd}, 255))...)
+		ogg = append(ogg, buildOggPage(0, 960, 3, []byte{1}, []byte{0xf})...)
+
+		reader, _, err := NewWith(bytes.NewReader(ogg))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		packet, _, err := reader.ReadPacket()
+		switch {
+		case err != nil:
+			t.Fatal(err)
+		case !bytes.Equal(packet, []byte{0xf}):
+			t.Fatal(packet)
+		}
+	})
+}
+
+// buildRecoveryTestStream returns a stream whose third audio page is
+// corrupted, along with the offset of that page. Packet 2 continues onto
+// the corrupted page.
+func buildRecoveryTestStream() ([]byte, int) {
+	ogg := buildOggContainer()[:47]
+	ogg = append(ogg, buildOggPage(0, 0, 1, []byte{0}, nil)...)
+	ogg = append(ogg, buildOggPage(0, 960, 2, []byte{3}, []byte{0x08, 0, 0})...)
+	ogg = append(ogg, buildOggPage(0, noGranulePosition, 3, []byte{3, 255}, append([]byte{0x08, 0, 1}, make([]byte, 255)...))...)
+
+	corruptedOffset := len(ogg)
+	ogg = append(ogg, buildOggPage(pageHeaderTypeContinuedPacket, 2880, 4, []byte{10, 3}, append(make([]byte, 10), 0x08, 0, 3))...)
+	ogg[corruptedOffset+pageHeaderLen+5] ^= 0xff
+
+	// Garbage between pages, including a partial capture pattern
+	ogg = append(ogg, []byte("OgOggjunk")...)
+	ogg = append(ogg, buildOggPage(0, 3840, 5, []byte{3}, []byte{0x08, 0, 4})...)
+
+	return ogg, corruptedOffset
+}
+
+func TestOggReader_Recovery(t *testing.T) {
+	ogg, _ := buildRecoveryTestStream()
+
+	t.Run("Without recovery", func(t *testing.T) {
+		reader, _, err := NewWith(bytes.NewReader(ogg))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		for err == nil {
+			_, _, err = reader.ReadPacket()
+		}
+		if !errors.Is(err, errChecksumMismatch) {
+			t.Fatal(err)
+		}
+	})
+
+	t.Run("With recovery", func(t *testing.T) {
+		reader, _, err := NewWith(bytes.NewReader(ogg), WithRecovery())
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		// The comment header, then packets 0 and 1. Packets 2 and 3 were
+		// lost with the corrupted page, and packet 4 follows the garbage.
+		for _, expected := range []struct {
+			index            byte
+			pagesLost        uint32
+			checksumMismatch bool
+		}{{0xff, 0, false}, {0, 0, false}, {1, 0, false}, {4, 1, true}} {
+			packet, packetHeader, err := reader.ReadPacket()
+			switch {
+			case err != nil:
+				t.Fatal(err)
+			case packetHeader.PageHeader.PagesLost != expected.pagesLost:
+				t.Fatalf("expected %d pages lost, got %d", expected.pagesLost, packetHeader.PageHeader.PagesLost)
+			case packetHeader.PageHeader.ChecksumMismatch != expected.checksumMismatch:
+				t.Fatalf("expected checksum mismatch %t, got %t", expected.checksumMismatch, packetHeader.PageHeader.ChecksumMismatch)
+			case expected.index != 0xff && (len(packet) != 3 || packet[2] != expected.index):
+				t.Fatalf("expected packet %d, got %v", expected.index, packet)
+			}
+		}
+
+		if _, _, err = reader.ReadPacket(); !errors.Is(err, io.EOF) {
+			t.Fatal(err)
+		}
+	})
+}
+
+func TestOggReader_OutOfSequencePages(t *testing.T) {
+	// Page 3 is duplicated and page 2 arrives again after it, neither
+	// counts as lost or returns its packet twice
+	ogg := buildOggContainer()[:47]
+	ogg = append(ogg, buildOggPage(0, 0, 1, []byte{0}, nil)...)
+	ogg = append(ogg, buildOggPage(0, 960, 2, []byte{3}, []byte{0x08, 0, 0})...)
+	ogg = append(ogg, buildOggPage(0, 1920, 3, []byte{3}, []byte{0x08, 0, 1})...)
+	ogg = append(ogg, buildOggPage(0, 1920, 3, []byte{3}, []byte{0x08, 0, 1})...)
+	ogg = append(ogg, buildOggPage(0, 960, 2, []byte{3}, []byte{0x08, 0, 0})...)
+	ogg = append(ogg, buildOggPage(0, 3840, 5, []byte{3}, []byte{0x08, 0, 3})...)
+
+	reader, _, err := NewWith(bytes.NewReader(ogg))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, expected := range []struct {
+		index        byte
+		pagesLost    uint32
+		pagesSkipped uint32
+	}{{0xff, 0, 0}, {0, 0, 0}, {1, 0, 0}, {3, 1, 2}} {
+		packet, packetHeader, err := reader.ReadPacket()
+		switch {
+		case err != nil:
+			t.Fatal(err)
+		case packetHeader.PageHeader.PagesLost != expected.pagesLost:
+			t.Fatalf("expected %d pages lost, got %d", expected.pagesLost, packetHeader.PageHeader.PagesLost)
+		case packetHeader.PageHeader.PagesSkipped != expected.pagesSkipped:
+			t.Fatalf("expected %d pages skipped, got %d", expected.pagesSkipped, packetHeader.PageHeader.PagesSkipped)
+		case expected.index != 0xff && (len(packet) != 3 || packet[2] != expected.index):
+			t.Fatalf("expected packet %d, got %v", expected.index, packet)
+		}
+	}
+
+	if _, _, err = reader.ReadPacket(); !errors.Is(err, io.EOF) {
+		t.Fatal(err)
+	}
+
+	// Reading pages directly reports them as out of sequence
+	reader, _, err = NewWith(bytes.NewReader(ogg))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var outOfSequence []bool
+	for {
+		_, pageHeader, err := reader.ParseNextPage()
+		if errors.Is(err, io.EOF) {
+			break
+		} else if err != nil {
+			t.Fatal(err)
+		} else if pageHeader.PagesLost != 0 && pageHeader.OutOfSequence {
+			t.Fatal(pageHeader)
+		}
+		outOfSequence = append(outOfSequence, pageHeader.OutOfSequence)
+	}
+	if !reflect.DeepEqual(outOfSequence, []bool{false, false, false, true, true, false}) {
+		t.Fatal(outOfSequence)
+	}
+}
+
+func TestOggReader_MidStreamStart(t *testing.T) {
+	ogg, corruptedOffset := buildRecoveryTestStream()
+
+	// Join the stream in the middle of the page holding packets 1 and 2
+	reader, header, err := NewWith(bytes.NewReader(ogg[corruptedOffset-270:]), WithMidStreamStart())
+	switch {
+	case err != nil:
+		t.Fatal(err)
+	case header != nil:
+		t.Fatal("headers should not be read")
+	}
+
+	packet, packetHeader, err := reader.ReadPacket()
+	switch {
+	case err != nil:
+		t.Fatal(err)
+	case packetHeader.PageHeader.PagesLost != 0:
+		t.Fatal(packetHeader.PageHeader.PagesLost)
+	case packetHeader.PageHeader.SequenceNumber() != 5:
+		t.Fatal(packetHeader.PageHeader.SequenceNumber())
+	case !bytes.Equal(packet, []byte{0x08, 0, 4}):
+		t.Fatalf("expected packet 4, got %v", packet)
+	}
+
+	if _, err = reader.SeekGranule(0); !errors.Is(err, errNoHeader) {
+		t.Fatal(err)
+	}
+}
+
+// setPageSerial changes the serial number of a page built by buildOggPage
+func setPageSerial(page []byte, serial uint32) []byte {
+	binary.LittleEndian.PutUint32(page[14:], serial)
+	binary.LittleEndian.PutUint32(page[22:], 0)
+
+	binary.LittleEndian.PutUint32(page[22:], oggcrc.Update(oggcrc.GenerateTable(), 0, page))
+
+	return page
+}
+
+func TestOggReader_Chained(t *testing.T) {
+	idPayload := buildOggContainer()[28:47]
+	tags := buildTagsPayload("second")
+
+	ogg := buildOggContainer()[:47]
+	ogg = append(ogg, buildOggPage(0, 0, 1, []byte{byte(len(buildTagsPayload("first")))}, buildTagsPayload("first"))...)
+	ogg = append(ogg, buildOggPage(0x04, 960, 2, []byte{3}, []byte{0x08, 0, 0})...)
+
+	// The second link is mono
+	secondIDPayload := append([]byte{}, idPayload...)
+	secondIDPayload[9] = 1
+	ogg = append(ogg, setPageSerial(buildOggPage(pageHeaderTypeBeginningOfStream, 0, 0, []byte{19}, secondIDPayload), 2)...)
+	ogg = append(ogg, setPageSerial(buildOggPage(0, 0, 1, []byte{byte(len(tags))}, tags), 2)...)
+	ogg = append(ogg, setPageSerial(buildOggPage(0, 960, 2, []byte{3}, []byte{0x08, 0, 1}), 2)...)
+
+	reader, header, err := NewWith(bytes.NewReader(ogg))
+	if err != nil {
+		t.Fatal(err)
+	} else if header.Channels != 2 {
+		t.Fatal(header.Channels)
+	} else if _, err = reader.ReadTags(); err != nil {
+		t.Fatal(err)
+	}
+
+	packet, packetHeader, err := reader.ReadPacket()
+	switch {
+	case err != nil:
+		t.Fatal(err)
+	case packetHeader.NewHeader != nil:
+		t.Fatal("first link has no new header")
+	case !bytes.Equal(packet, []byte{0x08, 0, 0}):
+		t.Fatal(packet)
+	}
+
+	packet, packetHeader, err = reader.ReadPacket()
+	switch {
+	case err != nil:
+		t.Fatal(err)
+	case packetHeader.NewHeader == nil || packetHeader.NewHeader.Channels != 1:
+		t.Fatalf("expected mono header, got %v", packetHeader.NewHeader)
+	case packetHeader.PageHeader.Serial() != 2:
+		t.Fatal(packetHeader.PageHeader.Serial())
+	}
+
+	secondTags, err := ParseTags(packet)
+	if err != nil {
+		t.Fatal(err)
+	} else if secondTags.Vendor != "second" {
+		t.Fatal(secondTags.Vendor)
+	}
+
+	packet, packetHeader, err = reader.ReadPacket()
+	switch {
+	case err != nil:
+		t.Fatal(err)
+	case packetHeader.NewHeader != nil:
+		t.Fatal("only the first packet of a link has a new header")
+	case !bytes.Equal(packet, []byte{0x08, 0, 1}):
+		t.Fatal(packet)
+	}
+
+	if _, _, err = reader.ReadPacket(); !errors.Is(err, io.EOF) {
+		t.Fatal(err)
+	}
+}
+
+func TestOggReader_Multiplexed(t *testing.T) {
+	const videoSerial = 7
+	tags := buildTagsPayload("vendor")
+	video := func(headerType uint8, index uint32, payload []byte) []byte {
+		return setPageSerial(buildOggPage(headerType, 0, index, []byte{byte(len(payload))}, payload), videoSerial)
+	}
+
+	// The video stream's beginning of stream page comes first, and its
+	// pages are interleaved with the audio ones
+	ogg := video(pageHeaderTypeBeginningOfStream, 0, []byte("\x80theora-header-of-some-length"))
+	ogg = append(ogg, buildOggContainer()[:47]...)
+	ogg = append(ogg, buildOggPage(0, 0, 1, []byte{byte(len(tags))}, tags)...)
+	ogg = append(ogg, video(0, 1, []byte{1, 2, 3})...)
+	ogg = append(ogg, buildOggPage(0, 960, 2, []byte{3}, []byte{0x08, 0, 0})...)
+	ogg = append(ogg, video(0, 2, []byte{4, 5, 6})...)
+	ogg = append(ogg, buildOggPage(0, 1920, 3, []byte{3}, []byte{0x08, 0, 1})...)
+
+	reader, header, err := NewWith(bytes.NewReader(ogg))
+	if err != nil {
+		t.Fatal(err)
+	} else if header.Channels != 2 {
+		t.Fatal(header.Channels)
+	} else if _, err = reader.ReadTags(); err != nil {
+		t.Fatal(err)
+	}
+
+	for i := byte(0); i < 2; i++ {
+		packet, packetHeader, err := reader.ReadPacket()
+		switch {
+		case err != nil:
+			t.Fatal(err)
+		case packetHeader.PageHeader.PagesLost != 0:
+			t.Fatalf("packet %d: %d pages lost", i, packetHeader.PageHeader.PagesLost)
+		case !bytes.Equal(packet, []byte{0x08, 0, i}):
+			t.Fatalf("expected packet %d, got %v", i, packet)
+		}
+	}
+
+	if _, _, err = reader.ReadPacket(); !errors.Is(err, io.EOF) {
+		t.Fatal(err)
+	}
+}
+
+func TestOggReader_WithSerial(t *testing.T) {
+	const secondSerial = 9
+	tags := buildTagsPayload("vendor")
+	second := func(page []byte) []byte {
+		return setPageSerial(page, secondSerial)
+	}
+
+	// Two Opus streams, the second one mono
+	secondID := append([]byte{}, buildOggContainer()[:47]...)
+	secondID[37] = 1
+	ogg := append([]byte{}, buildOggContainer()[:47]...)
+	ogg = append(ogg, second(secondID)...)
+	ogg = append(ogg, buildOggPage(0, 0, 1, []byte{byte(len(tags))}, tags)...)
+	ogg = append(ogg, second(buildOggPage(0, 0, 1, []byte{byte(len(tags))}, tags))...)
+	ogg = append(ogg, buildOggPage(0, 960, 2, []byte{3}, []byte{0x08, 0, 0})...)
+	ogg = append(ogg, second(buildOggPage(0, 960, 2, []byte{3}, []byte{0x08, 1, 0}))...)
+
+	reader, header, err := NewWith(bytes.NewReader(ogg), WithSerial(secondSerial))
+	if err != nil {
+		t.Fatal(err)
+	} else if header.Channels != 1 {
+		t.Fatal(header.Channels)
+	} else if _, err = reader.ReadTags(); err != nil {
+		t.Fatal(err)
+	}
+
+	packet, packetHeader, err := reader.ReadPacket()
+	switch {
+	case err != nil:
+		t.Fatal(err)
+	case packetHeader.PageHeader.Serial() != secondSerial:
+		t.Fatalf("packet of stream %d", packetHeader.PageHeader.Serial())
+	case !bytes.Equal(packet, []byte{0x08, 1, 0}):
+		t.Fatalf("expected the packet of the second stream, got %v", packet)
+	}
+
+	if _, _, err = reader.ReadPacket(); !errors.Is(err, io.EOF) {
+		t.Fatal(err)
+	}
+
+	if _, _, err = NewWith(bytes.NewReader(ogg), WithSerial(1)); !errors.Is(err, errSerialNotFound) {
+		t.Fatalf("expected %v, got %v", errSerialNotFound, err)
+	}
+}
+
+func TestOggReader_WithSerialChained(t *testing.T) {
+	const secondSerial, nextLinkSerial = 9, 11
+	tags := buildTagsPayload("vendor")
+
+	// The first link multiplexes two Opus streams, the second link has one
+	// mono stream with a new serial number
+	ogg := append([]byte{}, buildOggContainer()[:47]...)
+	ogg = append(ogg, setPageSerial(append([]byte{}, buildOggContainer()[:47]...), secondSerial)...)
+	ogg = append(ogg, buildOggPage(0, 0, 1, []byte{byte(len(tags))}, tags)...)
+	ogg = append(ogg, setPageSerial(buildOggPage(0, 0, 1, []byte{byte(len(tags))}, tags), secondSerial)...)
+	ogg = append(ogg, buildOggPage(0x04, 960, 2, []byte{3}, []byte{0x08, 0, 0})...)
+	ogg = append(ogg, setPageSerial(buildOggPage(0x04, 960, 2, []byte{3}, []byte{0x08, 1, 0}), secondSerial)...)
+
+	nextID := append([]byte{}, buildOggContainer()[:47]...)
+	nextID[37] = 1
+	ogg = append(ogg, setPageSerial(nextID, nextLinkSerial)...)
+	ogg = append(ogg, setPageSerial(buildOggPage(0, 960, 1, []byte{3}, []byte{0x08, 2, 0}), nextLinkSerial)...)
+
+	reader, _, err := NewWith(bytes.NewReader(ogg), WithSerial(secondSerial))
+	if err != nil {
+		t.Fatal(err)
+	} else if _, err = reader.ReadTags(); err != nil {
+		t.Fatal(err)
+	}
+
+	packet, _, err := reader.ReadPacket()
+	if err != nil {
+		t.Fatal(err)
+	} else if !bytes.Equal(packet, []byte{0x08, 1, 0}) {
+		t.Fatalf("expected the packet of the second stream, got %v", packet)
+	}
+
+	// The next link is followed although its serial number isn't the one
+	// asked for
+	packet, packetHeader, err := reader.ReadPacket()
+	switch {
+	case err != nil:
+		t.Fatal(err)
+	case packetHeader.NewHeader == nil || packetHeader.NewHeader.Channels != 1:
+		t.Fatalf("expected mono header, got %v", packetHeader.NewHeader)
+	case packetHeader.PageHeader.Serial() != nextLinkSerial:
+		t.Fatalf("packet of stream %d", packetHeader.PageHeader.Serial())
+	case !bytes.Equal(packet, []byte{0x08, 2, 0}):
+		t.Fatalf("expected the packet of the next link, got %v", packet)
+	}
+
+	if _, _, err = reader.ReadPacket(); !errors.Is(err, io.EOF) {
+		t.Fatal(err)
+	}
+}
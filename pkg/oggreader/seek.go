@@ -0,0 +1,307 @@
+package oggreader
+
+import (
+	"errors"
+	"io"
+	"time"
+
+	"github.com/pion/opus"
+)
+
+const (
+	// Granule positions are always in 48 kHz samples
+	granuleSampleRate = 48000
+
+	// A granule position of -1 marks a page on which no packet ends
+	noGranulePosition = 0xFFFFFFFFFFFFFFFF
+
+	// The decoder needs at least 80 ms of audio before its output
+	// converges after a seek
+	seekPreRollSamples = 80 * granuleSampleRate / 1000
+
+	// Once the bisection narrows down to this many bytes the remaining
+	// pages are scanned linearly
+	seekLinearScanSize = 64 * 1024
+)
+
+var (
+	errNotSeekable    = errors.New("stream does not implement io.Seeker")
+	errNegativeSeek   = errors.New("cannot seek to a negative time")
+	errNoAudioPackets = errors.New("stream ended before the comment header")
+	errNoHeader       = errors.New("seeking requires the stream headers")
+)
+
+// SeekTime positions the reader so that decoding the packets returned by
+// ReadPacket converges before t, where t is the time in the decoded output
+// after pre-skip has been removed, counted from the start of the stream
+// even when its first granule position isn't zero. It returns the number of 48 kHz samples
+// that must be decoded and discarded to reach t. The stream passed to
+// NewWith must implement io.Seeker.
+//
+// https://tools.ietf.org/html/rfc7845.html#section-4.6
+func (o *OggReader) SeekTime(t time.Duration) (uint64, error) {
+	if t < 0 {
+		return 0, errNegativeSeek
+	} else if o.header == nil {
+		return 0, errNoHeader
+	}
+
+	seeker, ok := o.stream.(io.Seeker)
+	if !ok {
+		return 0, errNotSeekable
+	}
+
+	// The granule position the stream starts at is only known once the
+	// audio data has been found
+	if _, err := o.findDataOffset(seeker); err != nil {
+		return 0, err
+	}
+
+	samples := uint64(t / time.Second * granuleSampleRate)
+	samples += uint64(t%time.Second) * granuleSampleRate / uint64(time.Second)
+
+	return o.SeekGranule(o.baseGranule + samples + uint64(o.header.PreSkip))
+}
+
+// SeekGranule positions the reader so that decoding the packets returned
+// by ReadPacket converges before granulePosition, which counts pre-skip
+// samples like the granule position of pages. It returns the number of 48
+// kHz samples that must be decoded and discarded to reach
+// granulePosition. The stream passed to NewWith must implement io.Seeker.
+//
+// Seeking bisects over the pages of the stream to find the last page that
+// ends at least 80 ms before granulePosition, decoding starts with the
+// packet that continues from it. Only the first link of a chained stream
+// can be seeked in, and pages of multiplexed streams are skipped.
+//
+// https://tools.ietf.org/html/rfc7845.html#section-4.6
+func (o *OggReader) SeekGranule(granulePosition uint64) (uint64, error) {
+	seeker, ok := o.stream.(io.Seeker)
+	if !ok {
+		return 0, errNotSeekable
+	} else if o.header == nil {
+		return 0, errNoHeader
+	}
+
+	dataOffset, err := o.findDataOffset(seeker)
+	if err != nil {
+		return 0, err
+	}
+
+	// Decoding from the start of the audio data is the only option when
+	// there is less than the pre-roll to work with
+	if granulePosition < o.baseGranule+seekPreRollSamples {
+		return o.samplesFromStart(granulePosition), o.seekToData(seeker, dataOffset)
+	}
+	target := granulePosition - seekPreRollSamples
+
+	end, err := seeker.Seek(0, io.SeekEnd)
+	if err != nil {
+		return 0, err
+	}
+
+	best := (*oggPage)(nil)
+	low, high := dataOffset, end
+	for high-low > seekLinearScanSize {
+		middle := low + (high-low)/2
+
+		page, err := o.nextGranulePage(seeker, middle, high)
+		if err != nil {
+			return 0, err
+		}
+
+		if page != nil && page.header.GranulePosition <= target {
+			best = page
+			low = o.offset()
+		} else {
+			high = middle
+		}
+	}
+
+	if err = o.seekTo(seeker, low); err != nil {
+		return 0, err
+	}
+	for {
+		page, err := o.resync()
+		if errors.Is(err, io.EOF) {
+			break
+		} else if err != nil {
+			return 0, err
+		}
+
+		if page.header.GranulePosition == noGranulePosition || page.header.serial != o.firstSerial {
+			continue
+		} else if page.header.GranulePosition > target {
+			break
+		}
+		best = page
+	}
+
+	if best == nil {
+		return o.samplesFromStart(granulePosition), o.seekToData(seeker, dataOffset)
+	}
+
+	// Packets completed on the best page end before the target, only
+	// keep a packet that continues on the following page
+	if err = o.seekTo(seeker, best.offset); err != nil {
+		return 0, err
+	}
+
+	payload, pageHeader, segments, err := o.parseNextPage()
+	if err != nil {
+		return 0, err
+	}
+	o.splitPackets(payload, pageHeader, segments)
+	o.packets = o.packets[:0]
+	o.followFirstSerial()
+
+	return granulePosition - pageHeader.GranulePosition, nil
+}
+
+// nextGranulePage returns the first page starting between offset and limit
+// that has a granule position, or nil if there is none
+func (o *OggReader) nextGranulePage(seeker io.Seeker, offset, limit int64) (*oggPage, error) {
+	if err := o.seekTo(seeker, offset); err != nil {
+		return nil, err
+	}
+
+	for {
+		page, err := o.resync()
+		if errors.Is(err, io.EOF) {
+			return nil, nil
+		} else if err != nil {
+			return nil, err
+		}
+
+		if page.offset >= limit {
+			return nil, nil
+		} else if page.header.GranulePosition != noGranulePosition && page.header.serial == o.firstSerial {
+			return page, nil
+		}
+	}
+}
+
+// The audio data begins on the page after the one the comment header
+// ends on
+//
+// https://tools.ietf.org/html/rfc7845.html#section-3
+func (o *OggReader) findDataOffset(seeker io.Seeker) (int64, error) {
+	if o.dataOffset >= 0 {
+		return o.dataOffset, nil
+	}
+
+	if err := o.seekTo(seeker, o.idPageEndOffset); err != nil {
+		return 0, err
+	}
+
+	for {
+		_, pageHeader, segments, err := o.parseNextPage()
+		if errors.Is(err, io.EOF) {
+			return 0, errNoAudioPackets
+		} else if err != nil {
+			return 0, err
+		} else if pageHeader.serial != o.firstSerial {
+			continue
+		}
+
+		for _, size := range segments {
+			if size < maxSegmentSize {
+				o.dataOffset = o.offset()
+				o.baseGranule, err = o.findBaseGranule()
+				return o.dataOffset, err
+			}
+		}
+	}
+}
+
+// A stream doesn't have to start at granule position zero. The granule
+// position of the first audio data page on which a packet completes, less
+// the samples of the packets completed on it, is that of the start of the
+// stream.
+//
+// https://tools.ietf.org/html/rfc7845.html#section-4.5
+func (o *OggReader) findBaseGranule() (uint64, error) {
+	var (
+		samples uint64
+		packet  []byte
+	)
+
+	for {
+		payload, pageHeader, segments, err := o.parseNextPage()
+		if errors.Is(err, io.EOF) {
+			return 0, nil
+		} else if err != nil {
+			return 0, err
+		} else if pageHeader.serial != o.firstSerial {
+			continue
+		}
+
+		// Only the TOC byte and frame count byte of a packet are needed to
+		// know how many samples it holds
+		for _, size := range segments {
+			if len(packet) < 2 {
+				packet = append(packet, payload[:int(size)]...)
+			}
+			payload = payload[size:]
+
+			if size < maxSegmentSize {
+				if count, err := opus.PacketSampleCount(packet, granuleSampleRate); err == nil {
+					samples += uint64(count)
+				}
+				packet = packet[:0]
+			}
+		}
+
+		if granulePosition := pageHeader.GranulePosition; granulePosition != noGranulePosition {
+			// The granule position of a final page can be smaller than
+			// its samples because of end trimming, such a stream starts
+			// at zero
+			if granulePosition < samples {
+				return 0, nil
+			}
+
+			return granulePosition - samples, nil
+		}
+	}
+}
+
+// samplesFromStart returns how many samples decoding from the start of the
+// audio data takes to reach granulePosition
+func (o *OggReader) samplesFromStart(granulePosition uint64) uint64 {
+	if granulePosition < o.baseGranule {
+		return 0
+	}
+
+	return granulePosition - o.baseGranule
+}
+
+func (o *OggReader) seekToData(seeker io.Seeker, dataOffset int64) error {
+	if err := o.seekTo(seeker, dataOffset); err != nil {
+		return err
+	}
+
+	o.packets = o.packets[:0]
+	o.partialPacket = nil
+	o.followFirstSerial()
+	return nil
+}
+
+// followFirstSerial makes ReadPacket return the packets of the first chain
+// link after a seek
+func (o *OggReader) followFirstSerial() {
+	o.serial = o.firstSerial
+	o.hasSerial = true
+	o.pastHeaders = true
+}
+
+func (o *OggReader) seekTo(seeker io.Seeker, offset int64) error {
+	if _, err := seeker.Seek(offset, io.SeekStart); err != nil {
+		return err
+	}
+
+	o.streamOffset = offset
+	o.bytesReadSuccesfully = offset
+	o.unread = nil
+	o.pageIndexes = nil
+	return nil
+}
@@ -0,0 +1,245 @@
+package oggreader
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"math/rand"
+	"testing"
+	"time"
+)
+
+// buildOggStream lays out 20 ms packets after the ID and comment header
+// pages, starting a new page once maxPagePayload is reached. Packets are
+// split across pages when they don't fit.
+func buildOggStream(packets [][]byte, maxPagePayload int) []byte {
+	return buildOggStreamFrom(packets, maxPagePayload, 0)
+}
+
+// buildOggStreamFrom is buildOggStream for a stream that starts at
+// startGranule
+func buildOggStreamFrom(packets [][]byte, maxPagePayload int, startGranule uint64) []byte {
+	tags := buildTagsPayload("vendor")
+	ogg := buildOggContainer()[:47]
+	ogg = append(ogg, buildOggPage(0, 0, 1, []byte{byte(len(tags))}, tags)...)
+
+	var (
+		segments, payload []byte
+		pageIndex         = uint32(2)
+		headerType        = uint8(0)
+		granulePosition   = startGranule
+		pageGranule       = uint64(noGranulePosition)
+	)
+
+	flush := func() {
+		ogg = append(ogg, buildOggPage(headerType, pageGranule, pageIndex, segments, payload)...)
+		headerType = 0
+		if segments[len(segments)-1] == maxSegmentSize {
+			headerType = pageHeaderTypeContinuedPacket
+		}
+
+		pageIndex++
+		pageGranule = noGranulePosition
+		segments, payload = nil, nil
+	}
+
+	for _, packet := range packets {
+		granulePosition += 960
+		for {
+			size := len(packet)
+			if size > maxSegmentSize {
+				size = maxSegmentSize
+			}
+
+			if len(segments) == 255 || (len(payload) != 0 && len(payload)+size > maxPagePayload) {
+				flush()
+			}
+
+			segments = append(segments, byte(size))
+			payload = append(payload, packet[:size]...)
+			packet = packet[size:]
+			if size < maxSegmentSize {
+				break
+			}
+		}
+
+		pageGranule = granulePosition
+	}
+	flush()
+
+	return ogg
+}
+
+func buildSeekTestPackets(count int) [][]byte {
+	random := rand.New(rand.NewSource(0)) //nolint:gosec
+
+	packets := make([][]byte, count)
+	for i := range packets {
+		packets[i] = make([]byte, random.Intn(600)+3)
+		packets[i][0] = 0x08
+		binary.BigEndian.PutUint16(packets[i][1:], uint16(i))
+	}
+
+	return packets
+}
+
+func TestOggReader_SeekGranule(t *testing.T) {
+	packets := buildSeekTestPackets(2000)
+	reader, header, err := NewWith(bytes.NewReader(buildOggStream(packets, 1000)))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, target := range []uint64{0, 100, 3839, 3840, 3841, 4800, 960 * 1000, 960*1000 + 17, 960 * 1999, 960*1000 - 1, 960 * 20, 960 * 1500} {
+		discard, err := reader.SeekGranule(target)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		packet, _, err := reader.ReadPacket()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		index := int(binary.BigEndian.Uint16(packet[1:]))
+		switch {
+		case !bytes.Equal(packet, packets[index]):
+			t.Fatalf("target %d: packet %d mismatch", target, index)
+		case uint64(index*960)+discard != target:
+			t.Fatalf("target %d: packet %d starts at %d, expected to discard %d", target, index, index*960, discard)
+		case target >= seekPreRollSamples && discard < seekPreRollSamples:
+			t.Fatalf("target %d: only %d samples of pre-roll", target, discard)
+		case discard > seekPreRollSamples+960*10:
+			t.Fatalf("target %d: %d samples of pre-roll is more than a page", target, discard)
+		}
+	}
+
+	// Seeking by time removes the pre-skip
+	discard, err := reader.SeekTime(10 * time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	packet, _, err := reader.ReadPacket()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	index := uint64(binary.BigEndian.Uint16(packet[1:]))
+	if index*960+discard != 480000+uint64(header.PreSkip) {
+		t.Fatalf("packet %d, discard %d", index, discard)
+	}
+}
+
+func TestOggReader_SeekGranuleNonzeroStart(t *testing.T) {
+	const startGranule = 5 * 48000
+
+	packets := buildSeekTestPackets(2000)
+	reader, header, err := NewWith(bytes.NewReader(buildOggStreamFrom(packets, 1000, startGranule)))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, test := range []struct {
+		target  uint64
+		index   int
+		discard uint64
+	}{
+		{0, 0, 0},
+		{startGranule - 1, 0, 0},
+		{startGranule, 0, 0},
+		{startGranule + 100, 0, 100},
+		{startGranule + seekPreRollSamples + 960, 0, seekPreRollSamples + 960},
+	} {
+		discard, err := reader.SeekGranule(test.target)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		packet, _, err := reader.ReadPacket()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if index := int(binary.BigEndian.Uint16(packet[1:])); index != test.index || discard != test.discard {
+			t.Fatalf("target %d: got packet %d and discard %d, want packet %d and discard %d", test.target, index, discard, test.index, test.discard)
+		}
+	}
+
+	// Past the first pages the bisection finds pages by their granule
+	// position, relative to the start of the stream
+	for _, target := range []uint64{startGranule + 960*1000, startGranule + 960*1500 + 17} {
+		discard, err := reader.SeekGranule(target)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		packet, _, err := reader.ReadPacket()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if index := uint64(binary.BigEndian.Uint16(packet[1:])); startGranule+index*960+discard != target {
+			t.Fatalf("target %d: packet %d starts at %d, expected to discard %d", target, index, startGranule+index*960, discard)
+		}
+	}
+
+	// Seeking by time counts from the start of the stream, also when it's
+	// the first seek
+	reader, _, err = NewWith(bytes.NewReader(buildOggStreamFrom(packets, 1000, startGranule)))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	discard, err := reader.SeekTime(10 * time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	packet, _, err := reader.ReadPacket()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if index := uint64(binary.BigEndian.Uint16(packet[1:])); index*960+discard != 480000+uint64(header.PreSkip) {
+		t.Fatalf("packet %d, discard %d", index, discard)
+	}
+}
+
+func TestOggReader_SeekErrors(t *testing.T) {
+	ogg := buildOggStream(buildSeekTestPackets(10), 1000)
+
+	t.Run("Not seekable", func(t *testing.T) {
+		reader, _, err := NewWith(struct{ io.Reader }{bytes.NewReader(ogg)})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if _, err = reader.SeekGranule(0); !errors.Is(err, errNotSeekable) {
+			t.Fatal(err)
+		}
+	})
+
+	t.Run("Negative time", func(t *testing.T) {
+		reader, _, err := NewWith(bytes.NewReader(ogg))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if _, err = reader.SeekTime(-time.Second); !errors.Is(err, errNegativeSeek) {
+			t.Fatal(err)
+		}
+	})
+
+	t.Run("No comment header", func(t *testing.T) {
+		reader, _, err := NewWith(bytes.NewReader(ogg[:47]))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if _, err = reader.SeekGranule(0); !errors.Is(err, errNoAudioPackets) {
+			t.Fatal(err)
+		}
+	})
+}
@@ -0,0 +1,182 @@
+package oggreader
+
+import (
+	"encoding/binary"
+	"strconv"
+	"strings"
+)
+
+const (
+	tagsLengthFieldSize = 4
+
+	// TagTrackGain is the comment field storing the track gain relative to
+	// the output gain of the ID header, in Q7.8 dB.
+	TagTrackGain = "R128_TRACK_GAIN"
+	// TagAlbumGain is the comment field storing the album gain relative
+	// to the output gain of the ID header, in Q7.8 dB.
+	TagAlbumGain = "R128_ALBUM_GAIN"
+)
+
+// OggTags is the metadata from the comment header, the second packet of
+// an Ogg Opus stream
+//
+//      0                   1                   2                   3
+//      0 1 2 3 4 5 6 7 8 9 0 1 2 3 4 5 6 7 8 9 0 1 2 3 4 5 6 7 8 9 0 1
+//     +-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+
+//     |      'O'      |      'p'      |      'u'      |      's'      |
+//     +-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+
+//     |      'T'      |      'a'      |      'g'      |      's'      |
+//     +-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+
+//     |                     Vendor String Length                      |
+//     +-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+
+//     |                                                               |
+//     :                        Vendor String...                       :
+//     |                                                               |
+//     +-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+
+//     |                   User Comment List Length                    |
+//     +-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+
+//     |                 User Comment #0 String Length                 |
+//     +-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+
+//     |                                                               |
+//     :                   User Comment #0 String...                   :
+//     |                                                               |
+//     +-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+
+//     |                 User Comment #1 String Length                 |
+//     +-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+
+//     :                                                               :
+//
+// https://tools.ietf.org/html/rfc7845.html#section-5.2
+type OggTags struct {
+	Vendor string
+
+	// UserComments maps each field name, converted to upper case, to
+	// all of the values it was given. Field names are case-insensitive
+	// and may be repeated.
+	UserComments map[string][]string
+}
+
+// ReadTags reads the comment header packet, which follows the ID header.
+// The comment header may span several pages.
+//
+// https://tools.ietf.org/html/rfc7845.html#section-5.2
+func (o *OggReader) ReadTags() (*OggTags, error) {
+	packet, _, err := o.ReadPacket()
+	if err != nil {
+		return nil, err
+	}
+
+	return ParseTags(packet)
+}
+
+// ParseTags parses a comment header packet, like the first packet of a
+// chain link returned by ReadPacket
+//
+// https://tools.ietf.org/html/rfc7845.html#section-5.2
+func ParseTags(payload []byte) (*OggTags, error) {
+	if len(payload) < len(tagsPageSignature) || string(payload[:len(tagsPageSignature)]) != tagsPageSignature {
+		return nil, errBadTagsPayloadSignature
+	}
+	payload = payload[len(tagsPageSignature):]
+
+	vendor, payload, err := readTagsString(payload)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(payload) < tagsLengthFieldSize {
+		return nil, errBadTagsLength
+	}
+	commentsCount := binary.LittleEndian.Uint32(payload)
+	payload = payload[tagsLengthFieldSize:]
+
+	// Every comment has at least a length field, reject counts that
+	// can't fit before allocating anything for them
+	if uint64(commentsCount)*tagsLengthFieldSize > uint64(len(payload)) {
+		return nil, errBadTagsLength
+	}
+
+	tags := &OggTags{
+		Vendor:       vendor,
+		UserComments: map[string][]string{},
+	}
+
+	for i := uint32(0); i < commentsCount; i++ {
+		var comment string
+		if comment, payload, err = readTagsString(payload); err != nil {
+			return nil, err
+		}
+
+		// Each comment is a field name and value separated by '='
+		separator := strings.IndexByte(comment, '=')
+		if separator <= 0 {
+			return nil, errBadTagsUserComment
+		}
+
+		field := strings.ToUpper(comment[:separator])
+		tags.UserComments[field] = append(tags.UserComments[field], comment[separator+1:])
+	}
+
+	// Anything that remains is binary data, which is ignored
+
+	return tags, nil
+}
+
+func readTagsString(payload []byte) (string, []byte, error) {
+	if len(payload) < tagsLengthFieldSize {
+		return "", nil, errBadTagsLength
+	}
+
+	length := binary.LittleEndian.Uint32(payload)
+	payload = payload[tagsLengthFieldSize:]
+	if uint64(length) > uint64(len(payload)) {
+		return "", nil, errBadTagsLength
+	}
+
+	return string(payload[:length]), payload[length:], nil
+}
+
+// Get returns the first value of a field, field names are
+// case-insensitive
+func (t *OggTags) Get(field string) (string, bool) {
+	values := t.UserComments[strings.ToUpper(field)]
+	if len(values) == 0 {
+		return "", false
+	}
+
+	return values[0], true
+}
+
+// TrackGain returns the R128_TRACK_GAIN tag in Q7.8 dB. It is applied in
+// addition to the output gain of the ID header to normalize the track to
+// a reference level of -23 LUFS.
+//
+// https://tools.ietf.org/html/rfc7845.html#section-5.2.1
+func (t *OggTags) TrackGain() (int16, bool) {
+	return t.gain(TagTrackGain)
+}
+
+// AlbumGain returns the R128_ALBUM_GAIN tag in Q7.8 dB. It is applied in
+// addition to the output gain of the ID header to normalize the album to
+// a reference level of -23 LUFS.
+//
+// https://tools.ietf.org/html/rfc7845.html#section-5.2.1
+func (t *OggTags) AlbumGain() (int16, bool) {
+	return t.gain(TagAlbumGain)
+}
+
+// The gain values are stored as a signed decimal integer in Q7.8 format
+// in the range -32768 to 32767, matching the regular expression
+// "-?[0-9]+"
+func (t *OggTags) gain(field string) (int16, bool) {
+	value, ok := t.Get(field)
+	if !ok || strings.HasPrefix(value, "+") {
+		return 0, false
+	}
+
+	gain, err := strconv.ParseInt(value, 10, 16)
+	if err != nil {
+		return 0, false
+	}
+
+	return int16(gain), true
+}
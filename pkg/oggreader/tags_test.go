@@ -0,0 +1,146 @@
+package oggreader
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"reflect"
+	"testing"
+)
+
+func buildTagsPayload(vendor string, comments ...string) []byte {
+	appendLength := func(payload []byte, length int) []byte {
+		l := make([]byte, tagsLengthFieldSize)
+		binary.LittleEndian.PutUint32(l, uint32(length))
+		return append(payload, l...)
+	}
+
+	payload := []byte(tagsPageSignature)
+	payload = appendLength(payload, len(vendor))
+	payload = append(payload, vendor...)
+	payload = appendLength(payload, len(comments))
+	for _, c := range comments {
+		payload = appendLength(payload, len(c))
+		payload = append(payload, c...)
+	}
+
+	return payload
+}
+
+func TestOggTags_Parse(t *testing.T) {
+	tags, err := ParseTags(buildTagsPayload("libopus 1.3.1", "ARTIST=Foo", "title=Bar", "artist=Baz", "R128_TRACK_GAIN=-512", "r128_album_gain=256", "EMPTY="))
+	switch {
+	case err != nil:
+		t.Fatal(err)
+	case tags.Vendor != "libopus 1.3.1":
+		t.Fatal(tags.Vendor)
+	case !reflect.DeepEqual(tags.UserComments["ARTIST"], []string{"Foo", "Baz"}):
+		t.Fatal(tags.UserComments)
+	case !reflect.DeepEqual(tags.UserComments["EMPTY"], []string{""}):
+		t.Fatal(tags.UserComments)
+	}
+
+	if title, ok := tags.Get("Title"); !ok || title != "Bar" {
+		t.Fatal(title)
+	}
+
+	if gain, ok := tags.TrackGain(); !ok || gain != -512 {
+		t.Fatal(gain)
+	}
+
+	if gain, ok := tags.AlbumGain(); !ok || gain != 256 {
+		t.Fatal(gain)
+	}
+}
+
+func TestOggTags_InvalidGain(t *testing.T) {
+	for _, value := range []string{"+5", "1.5", "40000", ""} {
+		tags, err := ParseTags(buildTagsPayload("", "R128_TRACK_GAIN="+value))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if _, ok := tags.TrackGain(); ok {
+			t.Fatalf("%q should not be a valid gain", value)
+		}
+	}
+}
+
+func TestOggTags_ParseErrors(t *testing.T) {
+	t.Run("Invalid signature", func(t *testing.T) {
+		payload := buildTagsPayload("vendor")
+		payload[0] = 0
+
+		if _, err := ParseTags(payload); !errors.Is(err, errBadTagsPayloadSignature) {
+			t.Fatal(err)
+		}
+	})
+
+	t.Run("Oversized vendor length", func(t *testing.T) {
+		payload := buildTagsPayload("vendor")
+		binary.LittleEndian.PutUint32(payload[8:], 0xffffffff)
+
+		if _, err := ParseTags(payload); !errors.Is(err, errBadTagsLength) {
+			t.Fatal(err)
+		}
+	})
+
+	t.Run("Oversized comment count", func(t *testing.T) {
+		payload := buildTagsPayload("vendor", "A=B")
+		binary.LittleEndian.PutUint32(payload[18:], 0xffffffff)
+
+		if _, err := ParseTags(payload); !errors.Is(err, errBadTagsLength) {
+			t.Fatal(err)
+		}
+	})
+
+	t.Run("Oversized comment length", func(t *testing.T) {
+		payload := buildTagsPayload("vendor", "A=B")
+		binary.LittleEndian.PutUint32(payload[22:], 0xfffffff0)
+
+		if _, err := ParseTags(payload); !errors.Is(err, errBadTagsLength) {
+			t.Fatal(err)
+		}
+	})
+
+	t.Run("Truncated", func(t *testing.T) {
+		payload := buildTagsPayload("vendor", "A=B")
+
+		if _, err := ParseTags(payload[:len(payload)-1]); !errors.Is(err, errBadTagsLength) {
+			t.Fatal(err)
+		}
+	})
+
+	t.Run("Missing field name", func(t *testing.T) {
+		if _, err := ParseTags(buildTagsPayload("vendor", "=B")); !errors.Is(err, errBadTagsUserComment) {
+			t.Fatal(err)
+		}
+	})
+}
+
+func TestOggReader_ReadTags(t *testing.T) {
+	// A comment header large enough to span two pages
+	payload := buildTagsPayload("vendor", "COVER="+string(bytes.Repeat([]byte{'a'}, 255*255)))
+
+	segments := bytes.Repeat([]byte{255}, 255)
+	remaining := len(payload) - 255*255
+
+	ogg := buildOggContainer()[:47]
+	ogg = append(ogg, buildOggPage(0, 0, 1, segments, payload[:255*255])...)
+	ogg = append(ogg, buildOggPage(pageHeaderTypeContinuedPacket, 0, 2, []byte{byte(remaining)}, payload[255*255:])...)
+
+	reader, _, err := NewWith(bytes.NewReader(ogg))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tags, err := reader.ReadTags()
+	switch {
+	case err != nil:
+		t.Fatal(err)
+	case tags.Vendor != "vendor":
+		t.Fatal(tags.Vendor)
+	case len(tags.UserComments["COVER"]) != 1 || len(tags.UserComments["COVER"][0]) != 255*255:
+		t.Fatal("comment spanning pages mismatch")
+	}
+}
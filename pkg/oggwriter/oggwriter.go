@@ -0,0 +1,470 @@
+// Package oggwriter implements the Ogg media container writer
+package oggwriter
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand"
+	"os"
+	"sort"
+	"time"
+
+	"github.com/pion/opus"
+	"github.com/pion/opus/internal/oggcrc"
+	"github.com/pion/opus/pkg/oggreader"
+)
+
+const (
+	pageHeaderTypeContinuedPacket   = 0x01
+	pageHeaderTypeBeginningOfStream = 0x02
+	pageHeaderTypeEndOfStream       = 0x04
+	pageHeaderSignature             = "OggS"
+
+	idPageSignature   = "OpusHead"
+	tagsPageSignature = "OpusTags"
+	idPageVersion     = 1
+
+	pageHeaderLen    = 27
+	maxSegmentSize   = 255
+	maxSegmentsCount = 255
+
+	// Granule positions are always in 48 kHz samples, regardless of the
+	// input sample rate in the ID header
+	granuleSampleRate = 48000
+
+	// A granule position of -1 marks a page on which no packet ends
+	noGranulePosition = 0xFFFFFFFFFFFFFFFF
+
+	defaultMaxPageSize     = 4096
+	defaultMaxPageDuration = time.Second
+	defaultVendor          = "pion/opus"
+)
+
+var (
+	errNilStream       = errors.New("stream is nil")
+	errNilHeader       = errors.New("header is nil")
+	errWriterClosed    = errors.New("writer is closed")
+	errBadMaxPageSize  = errors.New("maximum page size must be between 1 and 65025 bytes")
+	errBadPageDuration = errors.New("maximum page duration must be positive")
+	errBadEndTrim      = errors.New("end trimming exceeds the duration of the final page")
+	errBadHeader       = errors.New("invalid ID header")
+)
+
+// OggWriter is used to write Ogg Opus files from Opus packets
+type OggWriter struct {
+	stream        io.Writer
+	fd            *os.File
+	checksumTable *[256]uint32
+
+	serial          uint32
+	pageIndex       uint32
+	granulePosition uint64
+	endTrim         uint64
+	closed          bool
+
+	maxPageSize    int
+	maxPageSamples uint64
+
+	// The page being filled, flushed once it exceeds a limit
+	pageSegments        []byte
+	pagePayload         []byte
+	pageGranulePosition uint64
+	pagePacketsEnded    bool
+	pageSamples         uint64
+	pageIsContinued     bool
+}
+
+// Option configures an OggWriter
+type Option func(*OggWriter) error
+
+// WithSerial sets the serial number of the logical stream, by default a
+// random serial is used
+func WithSerial(serial uint32) Option {
+	return func(w *OggWriter) error {
+		w.serial = serial
+		return nil
+	}
+}
+
+// WithMaxPageSize sets the payload size in bytes after which a page is
+// written. Packets are never split early, so a page can exceed it by up to
+// one packet.
+func WithMaxPageSize(size int) Option {
+	return func(w *OggWriter) error {
+		if size < 1 || size > maxSegmentSize*maxSegmentsCount {
+			return errBadMaxPageSize
+		}
+
+		w.maxPageSize = size
+		return nil
+	}
+}
+
+// WithMaxPageDuration sets the audio duration after which a page is
+// written. This bounds the latency added by buffering packets when the
+// file is streamed while it is being written.
+func WithMaxPageDuration(duration time.Duration) Option {
+	return func(w *OggWriter) error {
+		if duration <= 0 {
+			return errBadPageDuration
+		}
+
+		w.maxPageSamples = uint64(duration * granuleSampleRate / time.Second)
+		return nil
+	}
+}
+
+// New builds a new Ogg Opus writer that writes to the file fileName
+func New(fileName string, header *oggreader.OggHeader, tags *oggreader.OggTags, opts ...Option) (*OggWriter, error) {
+	f, err := os.Create(fileName) //nolint:gosec
+	if err != nil {
+		return nil, err
+	}
+
+	writer, err := NewWith(f, header, tags, opts...)
+	if err != nil {
+		_ = f.Close()
+		return nil, err
+	}
+
+	writer.fd = f
+	return writer, nil
+}
+
+// NewWith returns a new Ogg Opus writer that writes to out. The ID header
+// is written from header and the comment header from tags, a nil tags
+// writes a comment header with no user comments.
+func NewWith(out io.Writer, header *oggreader.OggHeader, tags *oggreader.OggTags, opts ...Option) (*OggWriter, error) {
+	if out == nil {
+		return nil, errNilStream
+	} else if header == nil {
+		return nil, errNilHeader
+	} else if err := validateHeader(header); err != nil {
+		return nil, err
+	}
+
+	writer := &OggWriter{
+		stream:         out,
+		checksumTable:  oggcrc.GenerateTable(),
+		serial:         rand.Uint32(), //nolint:gosec
+		maxPageSize:    defaultMaxPageSize,
+		maxPageSamples: uint64(defaultMaxPageDuration * granuleSampleRate / time.Second),
+	}
+
+	for _, opt := range opts {
+		if err := opt(writer); err != nil {
+			return nil, err
+		}
+	}
+
+	if err := writer.writeHeaders(header, tags); err != nil {
+		return nil, err
+	}
+
+	return writer, nil
+}
+
+// validateHeader checks that header is one readers accept: its channel
+// count must suit the channel mapping family, the stream and coupled
+// counts must be consistent and the channel mapping table must hold an
+// entry per channel.
+//
+// https://tools.ietf.org/html/rfc7845.html#section-5.1.1
+func validateHeader(header *oggreader.OggHeader) error {
+	if _, err := oggreader.ParseIDHeader(marshalIDHeader(header)); err != nil {
+		return fmt.Errorf("%w: %v", errBadHeader, err)
+	}
+
+	decodedChannels := int(header.StreamCount) + int(header.CoupledCount)
+	switch header.ChannelMap {
+	case oggreader.ChannelMappingFamilyRTP:
+	case oggreader.ChannelMappingFamilyProjection:
+		if len(header.DemixingMatrix) != int(header.Channels)*decodedChannels {
+			return fmt.Errorf("%w: demixing matrix must have %d entries", errBadHeader, int(header.Channels)*decodedChannels)
+		}
+	default:
+		if len(header.ChannelMapping) != int(header.Channels) {
+			return fmt.Errorf("%w: channel mapping must have an entry per channel", errBadHeader)
+		}
+	}
+
+	return nil
+}
+
+// The ID header must be alone on the first page of the stream, and the
+// comment header must end its last page so that audio data begins on a
+// fresh page.
+//
+// https://tools.ietf.org/html/rfc7845.html#section-3
+func (w *OggWriter) writeHeaders(header *oggreader.OggHeader, tags *oggreader.OggTags) error {
+	if err := w.appendPacket(marshalIDHeader(header)); err != nil {
+		return err
+	} else if err := w.writePage(pageHeaderTypeBeginningOfStream); err != nil {
+		return err
+	}
+
+	if err := w.appendPacket(marshalTags(tags)); err != nil {
+		return err
+	}
+	return w.Flush()
+}
+
+// WritePacket adds a single Opus packet to the stream. The granule
+// position is advanced by the duration read from the packet's TOC byte.
+//
+// https://tools.ietf.org/html/rfc7845.html#section-4
+func (w *OggWriter) WritePacket(packet []byte) error {
+	if w.closed {
+		return errWriterClosed
+	}
+
+	samples, err := opus.PacketSampleCount(packet, granuleSampleRate)
+	if err != nil {
+		return err
+	}
+
+	// The final page is held back so it can still be end trimmed on Close
+	if len(w.pagePayload) >= w.maxPageSize || w.pageSamples >= w.maxPageSamples {
+		if err = w.Flush(); err != nil {
+			return err
+		}
+	}
+
+	w.granulePosition += uint64(samples)
+	if err = w.appendPacket(packet); err != nil {
+		return err
+	}
+
+	w.pageSamples += uint64(samples)
+	return nil
+}
+
+// SetEndTrim sets the number of 48 kHz samples to discard from the end of
+// the stream. It is applied to the granule position of the final page
+// when the writer is closed, and must not exceed the duration of that
+// page.
+//
+// https://tools.ietf.org/html/rfc7845.html#section-4.4
+func (w *OggWriter) SetEndTrim(samples uint64) {
+	w.endTrim = samples
+}
+
+// Flush writes the page being filled, even if it is below the page size
+// and duration limits. Flushing before Close prevents end trimming.
+func (w *OggWriter) Flush() error {
+	if len(w.pageSegments) == 0 {
+		return nil
+	}
+
+	return w.writePage(0)
+}
+
+// Close writes the final page, marking the end of the stream, and closes
+// the file if the writer was created with New
+func (w *OggWriter) Close() (err error) {
+	if w.closed {
+		return errWriterClosed
+	}
+	w.closed = true
+
+	defer func() {
+		if w.fd == nil {
+			return
+		}
+
+		if closeErr := w.fd.Close(); err == nil {
+			err = closeErr
+		}
+	}()
+
+	if w.endTrim > 0 {
+		if w.endTrim > w.pageSamples || len(w.pageSegments) == 0 {
+			return errBadEndTrim
+		}
+
+		w.pageGranulePosition -= w.endTrim
+	}
+
+	return w.writePage(pageHeaderTypeEndOfStream)
+}
+
+// appendPacket splits a packet into lacing values, writing out pages
+// whenever the segment table is full. A packet that is a multiple of 255
+// bytes ends with a lacing value of 0.
+//
+// https://tools.ietf.org/html/rfc3533.html#section-6
+func (w *OggWriter) appendPacket(packet []byte) error {
+	for {
+		if len(w.pageSegments) == maxSegmentsCount {
+			if err := w.writePage(0); err != nil {
+				return err
+			}
+		}
+
+		size := len(packet)
+		if size > maxSegmentSize {
+			size = maxSegmentSize
+		}
+
+		w.pageSegments = append(w.pageSegments, byte(size))
+		w.pagePayload = append(w.pagePayload, packet[:size]...)
+		packet = packet[size:]
+
+		if size < maxSegmentSize {
+			break
+		}
+	}
+
+	w.pageGranulePosition = w.granulePosition
+	w.pagePacketsEnded = true
+	return nil
+}
+
+//  0                   1                   2                   3
+//  0 1 2 3 4 5 6 7 8 9 0 1 2 3 4 5 6 7 8 9 0 1 2 3 4 5 6 7 8 9 0 1| Byte
+// +-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+
+// | capture_pattern: Magic number for page start "OggS"           | 0-3
+// +-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+
+// | version       | header_type   | granule_position              | 4-7
+// +-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+
+// |                                                               | 8-11
+// +                               +-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+
+// |                               | bitstream_serial_number       | 12-15
+// +-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+
+// |                               | page_sequence_number          | 16-19
+// +-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+
+// |                               | CRC_checksum                  | 20-23
+// +-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+
+// |                               |page_segments  | segment_table | 24-27
+// +-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+
+// | ...                                                           | 28-
+// +-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+
+//
+// https://tools.ietf.org/html/rfc3533.html#section-6
+func (w *OggWriter) writePage(headerType uint8) error {
+	if w.pageIsContinued {
+		headerType |= pageHeaderTypeContinuedPacket
+	}
+
+	// The end of stream page has a granule position even when it carries
+	// no packet, as it's where readers find the length of the stream
+	granulePosition := uint64(noGranulePosition)
+	if w.pagePacketsEnded {
+		granulePosition = w.pageGranulePosition
+	} else if headerType&pageHeaderTypeEndOfStream != 0 {
+		granulePosition = w.granulePosition
+	}
+
+	page := make([]byte, pageHeaderLen, pageHeaderLen+len(w.pageSegments)+len(w.pagePayload))
+	copy(page, pageHeaderSignature)
+	page[5] = headerType
+	binary.LittleEndian.PutUint64(page[6:], granulePosition)
+	binary.LittleEndian.PutUint32(page[14:], w.serial)
+	binary.LittleEndian.PutUint32(page[18:], w.pageIndex)
+	page[26] = uint8(len(w.pageSegments))
+	page = append(page, w.pageSegments...)
+	page = append(page, w.pagePayload...)
+
+	checksum := oggcrc.Update(w.checksumTable, 0, page)
+	binary.LittleEndian.PutUint32(page[22:], checksum)
+
+	if _, err := w.stream.Write(page); err != nil {
+		return err
+	}
+
+	// A page ending on a full segment leaves its packet unfinished
+	w.pageIsContinued = len(w.pageSegments) != 0 && w.pageSegments[len(w.pageSegments)-1] == maxSegmentSize
+	w.pageIndex++
+	w.pageSegments = w.pageSegments[:0]
+	w.pagePayload = w.pagePayload[:0]
+	w.pagePacketsEnded = false
+	w.pageSamples = 0
+
+	return nil
+}
+
+//  0                   1                   2                   3
+//  0 1 2 3 4 5 6 7 8 9 0 1 2 3 4 5 6 7 8 9 0 1 2 3 4 5 6 7 8 9 0 1
+// +-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+
+// |      'O'      |      'p'      |      'u'      |      's'      |
+// +-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+
+// |      'H'      |      'e'      |      'a'      |      'd'      |
+// +-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+
+// |  Version = 1  | Channel Count |           Pre-skip            |
+// +-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+
+// |                     Input Sample Rate (Hz)                    |
+// +-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+
+// |   Output Gain (Q7.8 in dB)    | Mapping Family|               |
+// +-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+               :
+// |                                                               |
+// :               Optional Channel Mapping Table...               :
+// |                                                               |
+// +-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+
+//
+// https://tools.ietf.org/html/rfc7845.html#section-5.1
+func marshalIDHeader(header *oggreader.OggHeader) []byte {
+	payload := make([]byte, 19)
+	copy(payload, idPageSignature)
+	payload[8] = idPageVersion
+	payload[9] = header.Channels
+	binary.LittleEndian.PutUint16(payload[10:], header.PreSkip)
+	binary.LittleEndian.PutUint32(payload[12:], header.SampleRate)
+	binary.LittleEndian.PutUint16(payload[16:], header.OutputGain)
+	payload[18] = header.ChannelMap
+
+	if header.ChannelMap == oggreader.ChannelMappingFamilyRTP {
+		return payload
+	}
+
+	payload = append(payload, header.StreamCount, header.CoupledCount)
+	if header.ChannelMap == oggreader.ChannelMappingFamilyProjection {
+		for _, v := range header.DemixingMatrix {
+			payload = append(payload, byte(v), byte(uint16(v)>>8))
+		}
+		return payload
+	}
+
+	return append(payload, header.ChannelMapping...)
+}
+
+// https://tools.ietf.org/html/rfc7845.html#section-5.2
+func marshalTags(tags *oggreader.OggTags) []byte {
+	if tags == nil {
+		tags = &oggreader.OggTags{Vendor: defaultVendor}
+	}
+
+	appendString := func(payload []byte, s string) []byte {
+		length := make([]byte, 4)
+		binary.LittleEndian.PutUint32(length, uint32(len(s)))
+		return append(append(payload, length...), s...)
+	}
+
+	commentsCount := 0
+	for _, values := range tags.UserComments {
+		commentsCount += len(values)
+	}
+
+	payload := appendString([]byte(tagsPageSignature), tags.Vendor)
+	payload = append(payload, make([]byte, 4)...)
+	binary.LittleEndian.PutUint32(payload[len(payload)-4:], uint32(commentsCount))
+
+	for _, field := range sortedFields(tags.UserComments) {
+		for _, value := range tags.UserComments[field] {
+			payload = appendString(payload, field+"="+value)
+		}
+	}
+
+	return payload
+}
+
+func sortedFields(userComments map[string][]string) []string {
+	fields := make([]string, 0, len(userComments))
+	for field := range userComments {
+		fields = append(fields, field)
+	}
+	sort.Strings(fields)
+
+	return fields
+}
@@ -0,0 +1,327 @@
+package oggwriter
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/pion/opus/pkg/oggreader"
+)
+
+func testHeader() *oggreader.OggHeader {
+	return &oggreader.OggHeader{
+		Channels:   2,
+		PreSkip:    312,
+		SampleRate: 48000,
+		Version:    1,
+	}
+}
+
+func TestOggWriter_Headers(t *testing.T) {
+	buffer := &bytes.Buffer{}
+	tags := &oggreader.OggTags{
+		Vendor:       "test",
+		UserComments: map[string][]string{"ARTIST": {"Foo", "Bar"}, "TITLE": {"Baz"}},
+	}
+
+	header := &oggreader.OggHeader{
+		ChannelMap:     oggreader.ChannelMappingFamilyVorbis,
+		Channels:       3,
+		OutputGain:     0xff00,
+		PreSkip:        312,
+		SampleRate:     44100,
+		Version:        1,
+		StreamCount:    2,
+		CoupledCount:   1,
+		ChannelMapping: []uint8{0, 2, 1},
+	}
+
+	writer, err := NewWith(buffer, header, tags, WithSerial(1234))
+	if err != nil {
+		t.Fatal(err)
+	} else if err = writer.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	reader, readHeader, err := oggreader.NewWith(buffer)
+	switch {
+	case err != nil:
+		t.Fatal(err)
+	case !reflect.DeepEqual(readHeader, header):
+		t.Fatalf("expected %v, got %v", header, readHeader)
+	}
+
+	readTags, err := reader.ReadTags()
+	switch {
+	case err != nil:
+		t.Fatal(err)
+	case !reflect.DeepEqual(readTags, tags):
+		t.Fatalf("expected %v, got %v", tags, readTags)
+	}
+}
+
+func TestOggWriter_Packets(t *testing.T) {
+	buffer := &bytes.Buffer{}
+	writer, err := NewWith(buffer, testHeader(), nil, WithMaxPageSize(1024))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// 20ms SILK packets of various sizes, including ones spanning pages
+	// and ones that are a multiple of the segment size
+	packets := [][]byte{}
+	for _, size := range []int{10, 255, 510, 300, 70000, 1, 254, 1000} {
+		packet := bytes.Repeat([]byte{byte(size)}, size)
+		packet[0] = 0x08
+		packets = append(packets, packet)
+
+		if err = writer.WritePacket(packet); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err = writer.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	reader, _, err := oggreader.NewWith(buffer)
+	if err != nil {
+		t.Fatal(err)
+	} else if _, err = reader.ReadTags(); err != nil {
+		t.Fatal(err)
+	}
+
+	lastGranulePosition := uint64(0)
+	for i, expected := range packets {
+		packet, packetHeader, err := reader.ReadPacket()
+		switch {
+		case err != nil:
+			t.Fatal(err)
+		case !bytes.Equal(packet, expected):
+			t.Fatalf("packet %d mismatch", i)
+		case packetHeader.HasGranulePosition && packetHeader.GranulePosition < lastGranulePosition:
+			t.Fatalf("packet %d granule position decreased", i)
+		case packetHeader.HasGranulePosition && packetHeader.GranulePosition%960 != 0:
+			t.Fatalf("packet %d granule position %d is not on a packet boundary", i, packetHeader.GranulePosition)
+		}
+
+		if packetHeader.HasGranulePosition {
+			lastGranulePosition = packetHeader.GranulePosition
+		}
+	}
+
+	if lastGranulePosition != 960*uint64(len(packets)) {
+		t.Fatal(lastGranulePosition)
+	}
+
+	if _, _, err = reader.ReadPacket(); !errors.Is(err, io.EOF) {
+		t.Fatal(err)
+	}
+}
+
+func TestOggWriter_PageLimits(t *testing.T) {
+	countPages := func(opts ...Option) int {
+		buffer := &bytes.Buffer{}
+		writer, err := NewWith(buffer, testHeader(), nil, opts...)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		for i := 0; i < 50; i++ {
+			if err = writer.WritePacket([]byte{0x08, 0, 0, 0, 0, 0, 0, 0, 0, 0}); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err = writer.Close(); err != nil {
+			t.Fatal(err)
+		}
+
+		reader, _, err := oggreader.NewWith(buffer)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		pages := 0
+		for ; ; pages++ {
+			if _, _, err = reader.ParseNextPage(); errors.Is(err, io.EOF) {
+				return pages
+			} else if err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+
+	// Comment header page and one page holding every packet
+	if pages := countPages(); pages != 2 {
+		t.Fatal(pages)
+	}
+
+	// 200ms per page
+	if pages := countPages(WithMaxPageDuration(200 * time.Millisecond)); pages != 6 {
+		t.Fatal(pages)
+	}
+
+	// 100 bytes per page
+	if pages := countPages(WithMaxPageSize(100)); pages != 6 {
+		t.Fatal(pages)
+	}
+}
+
+func TestOggWriter_EndTrim(t *testing.T) {
+	buffer := &bytes.Buffer{}
+	writer, err := NewWith(buffer, testHeader(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < 3; i++ {
+		if err = writer.WritePacket([]byte{0x08, 0}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	writer.SetEndTrim(100)
+	if err = writer.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	reader, _, err := oggreader.NewWith(buffer)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var pageHeader *oggreader.OggPageHeader
+	for {
+		_, h, err := reader.ParseNextPage()
+		if errors.Is(err, io.EOF) {
+			break
+		} else if err != nil {
+			t.Fatal(err)
+		}
+		pageHeader = h
+	}
+
+	if pageHeader.GranulePosition != 3*960-100 {
+		t.Fatal(pageHeader.GranulePosition)
+	}
+}
+
+func TestOggWriter_CloseAfterFlush(t *testing.T) {
+	buffer := &bytes.Buffer{}
+	writer, err := NewWith(buffer, testHeader(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < 3; i++ {
+		if err = writer.WritePacket([]byte{0x08, 0}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err = writer.Flush(); err != nil {
+		t.Fatal(err)
+	} else if err = writer.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	reader, _, err := oggreader.NewWith(buffer)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The empty end of stream page carries the last granule position
+	var pageHeader *oggreader.OggPageHeader
+	for {
+		_, h, err := reader.ParseNextPage()
+		if errors.Is(err, io.EOF) {
+			break
+		} else if err != nil {
+			t.Fatal(err)
+		}
+		pageHeader = h
+	}
+
+	if pageHeader.GranulePosition != 3*960 {
+		t.Fatal(pageHeader.GranulePosition)
+	}
+}
+
+func TestOggWriter_Errors(t *testing.T) {
+	t.Run("Nil stream", func(t *testing.T) {
+		if _, err := NewWith(nil, testHeader(), nil); !errors.Is(err, errNilStream) {
+			t.Fatal(err)
+		}
+	})
+
+	t.Run("Nil header", func(t *testing.T) {
+		if _, err := NewWith(&bytes.Buffer{}, nil, nil); !errors.Is(err, errNilHeader) {
+			t.Fatal(err)
+		}
+	})
+
+	t.Run("Invalid header", func(t *testing.T) {
+		for _, header := range []*oggreader.OggHeader{
+			{ChannelMap: oggreader.ChannelMappingFamilyRTP, Channels: 3},
+			{ChannelMap: oggreader.ChannelMappingFamilyRTP, Channels: 0},
+			{ChannelMap: oggreader.ChannelMappingFamilyVorbis, Channels: 9, StreamCount: 9, ChannelMapping: make([]uint8, 9)},
+			{ChannelMap: oggreader.ChannelMappingFamilyVorbis, Channels: 2, StreamCount: 0, ChannelMapping: []uint8{0, 1}},
+			{ChannelMap: oggreader.ChannelMappingFamilyVorbis, Channels: 2, StreamCount: 1, CoupledCount: 2, ChannelMapping: []uint8{0, 1}},
+			{ChannelMap: oggreader.ChannelMappingFamilyVorbis, Channels: 2, StreamCount: 1, ChannelMapping: []uint8{0, 1}},
+			{ChannelMap: oggreader.ChannelMappingFamilyVorbis, Channels: 2, StreamCount: 1, CoupledCount: 1, ChannelMapping: []uint8{0, 1, 0}},
+			{ChannelMap: oggreader.ChannelMappingFamilyAmbisonics, Channels: 5, StreamCount: 5, ChannelMapping: []uint8{0, 1, 2, 3, 4}},
+			{ChannelMap: oggreader.ChannelMappingFamilyProjection, Channels: 4, StreamCount: 2, CoupledCount: 2, DemixingMatrix: make([]int16, 15)},
+		} {
+			if _, err := NewWith(&bytes.Buffer{}, header, nil); !errors.Is(err, errBadHeader) {
+				t.Fatalf("%+v: %v", header, err)
+			}
+		}
+	})
+
+	t.Run("Invalid options", func(t *testing.T) {
+		if _, err := NewWith(&bytes.Buffer{}, testHeader(), nil, WithMaxPageSize(0)); !errors.Is(err, errBadMaxPageSize) {
+			t.Fatal(err)
+		}
+		if _, err := NewWith(&bytes.Buffer{}, testHeader(), nil, WithMaxPageDuration(0)); !errors.Is(err, errBadPageDuration) {
+			t.Fatal(err)
+		}
+	})
+
+	t.Run("Invalid packet", func(t *testing.T) {
+		writer, err := NewWith(&bytes.Buffer{}, testHeader(), nil)
+		if err != nil {
+			t.Fatal(err)
+		} else if err = writer.WritePacket(nil); err == nil {
+			t.Fatal("empty packet should be rejected")
+		}
+	})
+
+	t.Run("End trim too long", func(t *testing.T) {
+		writer, err := NewWith(&bytes.Buffer{}, testHeader(), nil)
+		if err != nil {
+			t.Fatal(err)
+		} else if err = writer.WritePacket([]byte{0x08}); err != nil {
+			t.Fatal(err)
+		}
+
+		writer.SetEndTrim(961)
+		if err = writer.Close(); !errors.Is(err, errBadEndTrim) {
+			t.Fatal(err)
+		}
+	})
+
+	t.Run("Write after close", func(t *testing.T) {
+		writer, err := NewWith(&bytes.Buffer{}, testHeader(), nil)
+		if err != nil {
+			t.Fatal(err)
+		} else if err = writer.Close(); err != nil {
+			t.Fatal(err)
+		}
+
+		if err = writer.WritePacket([]byte{0x08}); !errors.Is(err, errWriterClosed) {
+			t.Fatal(err)
+		}
+	})
+}
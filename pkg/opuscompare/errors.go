@@ -0,0 +1,10 @@
+package opuscompare
+
+import "errors"
+
+var (
+	errUnsupportedSampleRate   = errors.New("sample rate must be 8000, 12000, 16000, 24000 or 48000")
+	errUnsupportedChannelCount = errors.New("channel count must be 1 or 2")
+	errSampleCountMismatch     = errors.New("sample counts do not match")
+	errInsufficientSamples     = errors.New("insufficient sample data")
+)
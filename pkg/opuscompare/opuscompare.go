@@ -0,0 +1,283 @@
+// Package opuscompare implements the quality metric of opus_compare, the
+// tool the Opus test vectors are checked with. It compares the spectra of
+// a reference and a decoded signal, with masking so that differences the
+// ear wouldn't notice are tolerated. Beyond test vectors it can check that
+// processing like resampling or gain stages doesn't degrade audio beyond
+// what the Opus conformance tests allow.
+//
+// https://datatracker.ietf.org/doc/html/rfc6716#appendix-A.3
+package opuscompare
+
+import "math"
+
+const (
+	bandCount      = 21
+	frequencyCount = 240
+
+	// Windows of 10 ms every 2.5 ms, at 48 kHz
+	windowSize = 480
+	windowStep = 120
+
+	referenceSampleRate = 48000
+)
+
+// Edges of the bands the spectrum is grouped in, in frequency bins of
+// 100 Hz
+var bands = [bandCount + 1]int{
+	0, 2, 4, 6, 8, 10, 12, 14, 16, 20, 24, 28, 32, 40, 48, 56, 68, 80, 96, 120, 156, 200,
+}
+
+// Result is the outcome of a comparison
+type Result struct {
+	// Quality is the Opus quality metric in percent, 100% for identical
+	// signals. It's negative when the signals differ more than the Opus
+	// conformance tests allow.
+	Quality float64
+
+	// WeightedError is the internal weighted error Quality is derived
+	// from, 0 for identical signals
+	WeightedError float64
+}
+
+// Passed returns whether the decoded signal is close enough to the
+// reference to pass the Opus conformance tests
+func (r Result) Passed() bool {
+	return r.Quality >= 0
+}
+
+// Compare compares decoded with reference, both interleaved samples in the
+// range [-1, 1] with the given number of channels, 1 or 2. reference is at
+// 48 kHz, and decoded is the same signal at sampleRate, which is one of
+// the Opus sample rates. At lower sample rates the bands above their
+// Nyquist frequency are ignored.
+func Compare(reference, decoded []float32, channels, sampleRate int) (Result, error) {
+	return compare(scale(reference, 32768), scale(decoded, 32768), channels, sampleRate)
+}
+
+// CompareInt16 is Compare for 16-bit samples, like the .dec files of the
+// test vectors
+func CompareInt16(reference, decoded []int16, channels, sampleRate int) (Result, error) {
+	return compare(int16ToFloat32(reference), int16ToFloat32(decoded), channels, sampleRate)
+}
+
+// compare implements Compare for samples in 16-bit range, which is what
+// the power floor of the spectra is tuned for
+func compare(reference, decoded []float32, channels, sampleRate int) (result Result, err error) {
+	if channels != 1 && channels != 2 {
+		return result, errUnsupportedChannelCount
+	}
+
+	var decodedBandCount int
+	switch sampleRate {
+	case 8000:
+		decodedBandCount = 13
+	case 12000:
+		decodedBandCount = 15
+	case 16000:
+		decodedBandCount = 17
+	case 24000:
+		decodedBandCount = 19
+	case 48000:
+		decodedBandCount = 21
+	default:
+		return result, errUnsupportedSampleRate
+	}
+
+	downsample := referenceSampleRate / sampleRate
+	decodedFrequencyCount := frequencyCount / downsample
+
+	length := len(reference) / channels
+	if len(reference)%channels != 0 || len(decoded)%channels != 0 || length != len(decoded)/channels*downsample {
+		return result, errSampleCountMismatch
+	} else if length < windowSize {
+		return result, errInsufficientSamples
+	}
+
+	// Per-band energy of the reference, and power spectra of both signals
+	frames := (length - windowSize + windowStep) / windowStep
+	referenceBands := make([]float32, frames*bandCount*channels)
+	referenceSpectrum := make([]float32, frames*frequencyCount*channels)
+	decodedSpectrum := make([]float32, frames*decodedFrequencyCount*channels)
+	bandEnergy(referenceBands, referenceSpectrum, bandCount, reference, channels, frames, windowSize, windowStep, 1)
+	bandEnergy(nil, decodedSpectrum, decodedBandCount, decoded, channels, frames, windowSize/downsample, windowStep/downsample, downsample)
+
+	for i := 0; i < frames; i++ {
+		xb := referenceBands[i*bandCount*channels : (i+1)*bandCount*channels]
+
+		// Frequency masking, low to high: 10 dB/Bark slope
+		for b := 1; b < bandCount; b++ {
+			for c := 0; c < channels; c++ {
+				xb[b*channels+c] += 0.1 * xb[(b-1)*channels+c]
+			}
+		}
+
+		// Frequency masking, high to low: 15 dB/Bark slope
+		for b := bandCount - 2; b >= 0; b-- {
+			for c := 0; c < channels; c++ {
+				xb[b*channels+c] += 0.03 * xb[(b+1)*channels+c]
+			}
+		}
+
+		// Temporal masking: -3 dB/2.5 ms slope
+		if i > 0 {
+			previous := referenceBands[(i-1)*bandCount*channels:]
+			for b := 0; b < bandCount; b++ {
+				for c := 0; c < channels; c++ {
+					xb[b*channels+c] += 0.5 * previous[b*channels+c]
+				}
+			}
+		}
+
+		// Allow some cross-talk
+		if channels == 2 {
+			for b := 0; b < bandCount; b++ {
+				l, r := xb[2*b], xb[2*b+1]
+				xb[2*b] += 0.01 * r
+				xb[2*b+1] += 0.01 * l
+			}
+		}
+
+		// Apply the masking to the spectra
+		for b := 0; b < decodedBandCount; b++ {
+			for j := bands[b]; j < bands[b+1]; j++ {
+				for c := 0; c < channels; c++ {
+					referenceSpectrum[(i*frequencyCount+j)*channels+c] += 0.1 * xb[b*channels+c]
+					decodedSpectrum[(i*decodedFrequencyCount+j)*channels+c] += 0.1 * xb[b*channels+c]
+				}
+			}
+		}
+	}
+
+	// Add each frame to the next, to make the comparison slightly less
+	// sensitive
+	for j := 0; j < bands[decodedBandCount]; j++ {
+		for c := 0; c < channels; c++ {
+			referencePrevious := referenceSpectrum[j*channels+c]
+			decodedPrevious := decodedSpectrum[j*channels+c]
+			for i := 1; i < frames; i++ {
+				r := &referenceSpectrum[(i*frequencyCount+j)*channels+c]
+				d := &decodedSpectrum[(i*decodedFrequencyCount+j)*channels+c]
+				referencePrevious, *r = *r, *r+referencePrevious
+				decodedPrevious, *d = *d, *d+decodedPrevious
+			}
+		}
+	}
+
+	// At lower sample rates the last 300 Hz are ignored, to allow for
+	// different transition bands. The last band at 12 kHz already skips
+	// 400 Hz.
+	maxCompare := bands[decodedBandCount]
+	if sampleRate != 48000 && sampleRate != 12000 {
+		maxCompare -= 3
+	}
+
+	var weightedError float64
+	for i := 0; i < frames; i++ {
+		var frameError float64
+		for b := 0; b < decodedBandCount; b++ {
+			var bandError float64
+			for j := bands[b]; j < bands[b+1] && j < maxCompare; j++ {
+				for c := 0; c < channels; c++ {
+					ratio := decodedSpectrum[(i*decodedFrequencyCount+j)*channels+c] /
+						referenceSpectrum[(i*frequencyCount+j)*channels+c]
+					e := float32(float64(ratio) - math.Log(float64(ratio)) - 1)
+
+					// Be less sensitive around the SILK/CELT cross-over,
+					// to allow for mode freedom in the filters
+					if j >= 79 && j <= 81 {
+						e *= 0.1
+					}
+					if j == 80 {
+						e *= 0.1
+					}
+					bandError += float64(e)
+				}
+			}
+
+			bandError /= float64((bands[b+1] - bands[b]) * channels)
+			frameError += bandError * bandError
+		}
+
+		// A fixed normalization means slightly lower quality is accepted
+		// at lower sample rates
+		frameError /= bandCount
+		frameError *= frameError
+		weightedError += frameError * frameError
+	}
+
+	result.WeightedError = math.Pow(weightedError/float64(frames), 1.0/16)
+	result.Quality = 100 * (1 - 0.5*math.Log(1+result.WeightedError)/math.Log(1.13))
+	return result, nil
+}
+
+// bandEnergy computes the power spectrum of each window of in, and the
+// average power of each band if out isn't nil. Each window is weighted
+// with a Hann window and transformed with a DFT. The power of the bins of
+// signals at lower sample rates is scaled up by downsample to match 48
+// kHz.
+func bandEnergy(out, spectrum []float32, bandCount int, in []float32, channels, frames, windowSize, step, downsample int) {
+	window := make([]float32, windowSize)
+	cos := make([]float32, windowSize)
+	sin := make([]float32, windowSize)
+	for k := range window {
+		window[k] = 0.5 - 0.5*float32(math.Cos(2*math.Pi/float64(windowSize-1)*float64(k)))
+		cos[k] = float32(math.Cos(2 * math.Pi / float64(windowSize) * float64(k)))
+		sin[k] = float32(math.Sin(2 * math.Pi / float64(windowSize) * float64(k)))
+	}
+
+	spectrumSize := windowSize / 2
+	x := make([]float32, channels*windowSize)
+	for i := 0; i < frames; i++ {
+		for c := 0; c < channels; c++ {
+			for k := 0; k < windowSize; k++ {
+				x[c*windowSize+k] = window[k] * in[(i*step+k)*channels+c]
+			}
+		}
+
+		j := 0
+		for b := 0; b < bandCount; b++ {
+			var power [2]float32
+			for ; j < bands[b+1]; j++ {
+				for c := 0; c < channels; c++ {
+					var re, im float32
+					t := 0
+					for k := 0; k < windowSize; k++ {
+						re += cos[t] * x[c*windowSize+k]
+						im -= sin[t] * x[c*windowSize+k]
+						if t += j; t >= windowSize {
+							t -= windowSize
+						}
+					}
+
+					re *= float32(downsample)
+					im *= float32(downsample)
+					p := re*re + im*im + 100000
+					spectrum[(i*spectrumSize+j)*channels+c] = p
+					power[c] += p
+				}
+			}
+
+			if out != nil {
+				for c := 0; c < channels; c++ {
+					out[(i*bandCount+b)*channels+c] = power[c] / float32(bands[b+1]-bands[b])
+				}
+			}
+		}
+	}
+}
+
+func scale(in []float32, factor float32) []float32 {
+	out := make([]float32, len(in))
+	for i, sample := range in {
+		out[i] = sample * factor
+	}
+	return out
+}
+
+func int16ToFloat32(in []int16) []float32 {
+	out := make([]float32, len(in))
+	for i, sample := range in {
+		out[i] = float32(sample)
+	}
+	return out
+}
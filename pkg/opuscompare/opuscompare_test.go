@@ -0,0 +1,141 @@
+package opuscompare
+
+import (
+	"errors"
+	"math"
+	"testing"
+)
+
+// tone returns a sine wave of frequency Hz at sampleRate, in every channel
+func tone(frequency float64, samples, channels, sampleRate int) []float32 {
+	pcm := make([]float32, samples*channels)
+	for i := 0; i < samples; i++ {
+		sample := float32(0.25 * math.Sin(2*math.Pi*frequency*float64(i)/float64(sampleRate)))
+		for c := 0; c < channels; c++ {
+			pcm[i*channels+c] = sample
+		}
+	}
+	return pcm
+}
+
+func gain(pcm []float32, factor float32) []float32 {
+	out := make([]float32, len(pcm))
+	for i := range out {
+		out[i] = pcm[i] * factor
+	}
+	return out
+}
+
+func TestCompare(t *testing.T) {
+	for _, test := range []struct {
+		name       string
+		channels   int
+		sampleRate int
+		decoded    func(reference []float32) []float32
+		passes     bool
+	}{
+		{
+			"identical", 2, 48000,
+			func(reference []float32) []float32 { return reference },
+			true,
+		},
+		{
+			"0.1 dB gain", 1, 48000,
+			func(reference []float32) []float32 { return gain(reference, 1.0116) },
+			true,
+		},
+		{
+			"6 dB gain", 1, 48000,
+			func(reference []float32) []float32 { return gain(reference, 2) },
+			false,
+		},
+		{
+			"decimated", 1, 16000,
+			func(reference []float32) []float32 {
+				decoded := make([]float32, len(reference)/3)
+				for i := range decoded {
+					decoded[i] = reference[3*i]
+				}
+				return decoded
+			},
+			true,
+		},
+		{
+			"silence", 2, 48000,
+			func(reference []float32) []float32 { return make([]float32, len(reference)) },
+			false,
+		},
+		{
+			"wrong tone", 1, 48000,
+			func(reference []float32) []float32 { return tone(1000, len(reference), 1, 48000) },
+			false,
+		},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			reference := tone(440, 4800, test.channels, 48000)
+			result, err := Compare(reference, test.decoded(reference), test.channels, test.sampleRate)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if result.Passed() != test.passes {
+				t.Fatalf("quality %.1f%% (weighted error %f), expected passing to be %t", result.Quality, result.WeightedError, test.passes)
+			}
+		})
+	}
+
+	result, err := Compare(tone(440, 4800, 1, 48000), tone(440, 4800, 1, 48000), 1, 48000)
+	if err != nil {
+		t.Fatal(err)
+	} else if result.Quality != 100 || result.WeightedError != 0 {
+		t.Fatalf("quality %.1f%% (weighted error %f) for identical signals, expected 100%%", result.Quality, result.WeightedError)
+	}
+}
+
+func TestCompareInt16(t *testing.T) {
+	reference := tone(440, 4800, 2, 48000)
+	decoded := tone(440, 4800, 2, 48000)
+	decoded[1000] += 0.01
+
+	referenceInt16 := make([]int16, len(reference))
+	decodedInt16 := make([]int16, len(decoded))
+	for i := range reference {
+		referenceInt16[i] = int16(reference[i] * 32768)
+		decodedInt16[i] = int16(decoded[i] * 32768)
+	}
+
+	expected, err := Compare(reference, decoded, 2, 48000)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	result, err := CompareInt16(referenceInt16, decodedInt16, 2, 48000)
+	if err != nil {
+		t.Fatal(err)
+	} else if math.Abs(result.Quality-expected.Quality) > 0.1 {
+		t.Fatalf("quality %.1f%% for 16-bit samples, expected %.1f%%", result.Quality, expected.Quality)
+	}
+}
+
+func TestCompare_Errors(t *testing.T) {
+	for _, test := range []struct {
+		name       string
+		reference  []float32
+		decoded    []float32
+		channels   int
+		sampleRate int
+		expected   error
+	}{
+		{"channels", make([]float32, 960), make([]float32, 960), 3, 48000, errUnsupportedChannelCount},
+		{"sample rate", make([]float32, 960), make([]float32, 960), 1, 44100, errUnsupportedSampleRate},
+		{"length", make([]float32, 960), make([]float32, 959), 1, 48000, errSampleCountMismatch},
+		{"decimated length", make([]float32, 960), make([]float32, 960), 1, 8000, errSampleCountMismatch},
+		{"too short", make([]float32, 478), make([]float32, 478), 2, 48000, errInsufficientSamples},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			if _, err := Compare(test.reference, test.decoded, test.channels, test.sampleRate); !errors.Is(err, test.expected) {
+				t.Fatalf("expected %v, got %v", test.expected, err)
+			}
+		})
+	}
+}
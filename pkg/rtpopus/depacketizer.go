@@ -0,0 +1,373 @@
+// Package rtpopus turns Opus RTP packets into the sequence of decoder
+// calls that plays them out, including for lost, reordered and
+// discontinuous transmission packets
+package rtpopus
+
+import (
+	"fmt"
+	"sort"
+
+	"github.com/pion/opus"
+)
+
+// The RTP clock of Opus is always 48 kHz
+//
+// https://tools.ietf.org/html/rfc7587#section-4.1
+const clockRate = 48000
+
+// ActionType is the kind of decoder call an Action stands for
+type ActionType int
+
+// ActionType enums
+const (
+	// ActionDecode decodes Packet normally
+	ActionDecode ActionType = iota + 1
+	// ActionDecodeFEC decodes the low bitrate redundancy of Packet, which
+	// recovers the audio just before it. Samples is at most the duration
+	// of Packet.
+	ActionDecodeFEC
+	// ActionConceal runs packet loss concealment for Samples, in place of
+	// lost packets
+	ActionConceal
+	// ActionDTX covers Samples that the sender didn't transmit because of
+	// discontinuous transmission. Packet loss concealment produces the
+	// comfort noise for them.
+	ActionDTX
+)
+
+func (a ActionType) String() string {
+	switch a {
+	case ActionDecode:
+		return "Decode"
+	case ActionDecodeFEC:
+		return "DecodeFEC"
+	case ActionConceal:
+		return "Conceal"
+	case ActionDTX:
+		return "DTX"
+	}
+
+	return "Invalid"
+}
+
+// Action is a single decoder call
+type Action struct {
+	Type ActionType
+
+	// Packet is the Opus packet of ActionDecode and ActionDecodeFEC
+	Packet []byte
+
+	// Samples is the number of 48 kHz samples per channel the call
+	// produces, and Timestamp the RTP timestamp of the first one
+	Samples   int
+	Timestamp uint32
+}
+
+// Decoder is the Opus decoder the decoder calls of an Action are made on,
+// such as opus.Decoder. Samples are interleaved with Channels channels at
+// 48 kHz.
+type Decoder interface {
+	Channels() int
+	DecodeFloat32(in []byte, out []float32) (int, error)
+	DecodeFEC(in []byte, out []float32, samples int) (int, error)
+	Conceal(out []float32, samples int) (int, error)
+}
+
+// Decode makes the decoder call of the Action on decoder, into out. It
+// returns the number of samples per channel decoded.
+func (a Action) Decode(decoder Decoder, out []float32) (int, error) {
+	switch a.Type {
+	case ActionDecode:
+		return decoder.DecodeFloat32(a.Packet, out)
+	case ActionDecodeFEC:
+		return decoder.DecodeFEC(a.Packet, out, a.Samples)
+	case ActionConceal, ActionDTX:
+		return conceal(decoder, out, a.Samples)
+	}
+
+	return 0, errInvalidAction
+}
+
+// conceal runs packet loss concealment for samples. The decoder conceals
+// whole multiples of 2.5 ms, so a gap that isn't one, such as a timestamp
+// jump of an odd size, is rounded up and the extra samples dropped.
+func conceal(decoder Decoder, out []float32, samples int) (int, error) {
+	rounded := (samples + samples2500us - 1) / samples2500us * samples2500us
+	if rounded == samples {
+		return decoder.Conceal(out, samples)
+	}
+
+	channels := decoder.Channels()
+	pcm := make([]float32, rounded*channels)
+	if _, err := decoder.Conceal(pcm, rounded); err != nil {
+		return 0, err
+	}
+	return copy(out, pcm[:samples*channels]) / channels, nil
+}
+
+// Stats are the packet counts of a Depacketizer
+type Stats struct {
+	PacketsReceived uint64
+	PacketsLost     uint64
+
+	// PacketsLate counts packets that arrived after their audio was
+	// played out, duplicates, and stray packets far off the sequence
+	PacketsLate      uint64
+	PacketsRecovered uint64
+	SamplesConcealed uint64
+	SamplesDTX       uint64
+
+	// Resyncs counts the restarts of the sequence numbers after a jump
+	// too large to be loss or reordering
+	Resyncs uint64
+}
+
+const (
+	// Packets that arrive out of order are held until the packets before
+	// them arrive, for at most this many packets
+	defaultReorderWindow = 3
+
+	// Sequence numbers that jump more than maxDropout ahead or
+	// maxMisorder behind are a restart of the sequence rather than loss
+	// or reordering. The sequence is resynchronized once two packets in a
+	// row follow the jump.
+	//
+	// https://tools.ietf.org/html/rfc3550#appendix-A.1
+	maxDropout  = 3000
+	maxMisorder = 100
+)
+
+// DepacketizerOption configures a Depacketizer
+type DepacketizerOption func(*Depacketizer)
+
+// WithReorderWindow sets how many packets that arrive ahead of a missing
+// one are held back waiting for it, 3 by default. While packets are held
+// the decoder calls returned by Push lag behind. With a window of zero a
+// gap is concealed as soon as it is seen and packets that fill it later
+// are late.
+func WithReorderWindow(packets int) DepacketizerOption {
+	return func(d *Depacketizer) {
+		d.reorderWindow = packets
+	}
+}
+
+// Depacketizer follows the sequence numbers and timestamps of an Opus RTP
+// stream and turns each packet into decoder calls. Packets that arrive
+// out of order are put back in order, within a reorder window. Gaps in
+// sequence numbers that the window doesn't fill are lost packets, which
+// are concealed or recovered with the in-band FEC of the next packet.
+// Gaps in timestamps without lost packets are discontinuous transmission.
+// Packets that arrive after their place was concealed are late, and
+// dropped.
+//
+// Only RTP packets are needed, so recorded captures can be replayed
+// offline.
+//
+// https://tools.ietf.org/html/rfc7587#section-4
+type Depacketizer struct {
+	reorderWindow int
+
+	started            bool
+	ssrc               uint32
+	lastSequenceNumber uint16
+
+	// RTP timestamp of the sample after the last decoded one
+	nextTimestamp uint32
+
+	// Packets received ahead of a missing one, in sequence order
+	pending []*depacketizerPacket
+
+	// Packet that jumped too far from the sequence, which starts a new
+	// sequence if the next packet follows it
+	probation *depacketizerPacket
+
+	stats Stats
+}
+
+type depacketizerPacket struct {
+	*rtpPacket
+	samples int
+}
+
+// NewDepacketizer creates a new Depacketizer
+func NewDepacketizer(opts ...DepacketizerOption) *Depacketizer {
+	d := &Depacketizer{reorderWindow: defaultReorderWindow}
+	for _, opt := range opts {
+		opt(d)
+	}
+
+	return d
+}
+
+// Stats returns the packet counts so far
+func (d *Depacketizer) Stats() Stats {
+	return d.stats
+}
+
+// Push takes the next RTP packet received and returns the decoder calls
+// that play out the audio it completes. Those end with the packet itself
+// unless it is held in the reorder window. A new SSRC restarts the stream.
+// The payload is copied, so in can be reused for the next packet while the
+// packet is held or its actions are still to be decoded.
+func (d *Depacketizer) Push(in []byte) ([]Action, error) {
+	rtp, err := parseRTPPacket(in)
+	if err != nil {
+		return nil, err
+	}
+
+	samples, err := opus.PacketSampleCount(rtp.payload, clockRate)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", opus.ErrCorruptedPacket, err)
+	}
+	rtp.payload = append([]byte(nil), rtp.payload...)
+	packet := &depacketizerPacket{rtpPacket: rtp, samples: samples}
+
+	if !d.started || packet.ssrc != d.ssrc {
+		// The packet the old source jumped to can't start the sequence
+		// of the new one
+		actions := d.Flush()
+		d.dropProbation()
+		d.started = true
+		d.ssrc = packet.ssrc
+		return d.decode(packet, actions), nil
+	}
+
+	// Sequence numbers and timestamps wrap around, differences are
+	// computed modulo their size
+	switch delta := packet.sequenceNumber - d.lastSequenceNumber; {
+	case delta == 0 || delta >= 1<<16-maxMisorder:
+		// Already played out, or concealed
+		d.stats.PacketsLate++
+		return nil, nil
+	case delta > maxDropout:
+		return d.resync(packet), nil
+	}
+
+	d.dropProbation()
+	if !d.hold(packet) {
+		d.stats.PacketsLate++
+		return nil, nil
+	}
+
+	return d.release(false), nil
+}
+
+// dropProbation gives up on the packet that jumped off the sequence, it
+// was a stray one
+func (d *Depacketizer) dropProbation() {
+	if d.probation != nil {
+		d.stats.PacketsLate++
+		d.probation = nil
+	}
+}
+
+// Flush returns the decoder calls for the packets held in the reorder
+// window, concealing the gaps before them. It is called at the end of the
+// stream.
+func (d *Depacketizer) Flush() []Action {
+	return d.release(true)
+}
+
+// A jump of the sequence number could be a single stray packet. When the
+// packet after it follows on, the sender restarted its sequence and
+// playout carries on from the jump.
+//
+// https://tools.ietf.org/html/rfc3550#appendix-A.1
+func (d *Depacketizer) resync(packet *depacketizerPacket) []Action {
+	if d.probation == nil || packet.sequenceNumber != d.probation.sequenceNumber+1 {
+		d.dropProbation()
+		d.probation = packet
+		return nil
+	}
+
+	d.stats.Resyncs++
+	actions := d.Flush()
+	actions = d.decode(d.probation, actions)
+	d.probation = nil
+
+	if !d.hold(packet) {
+		return actions
+	}
+	return append(actions, d.release(false)...)
+}
+
+// hold inserts packet in the reorder window in sequence order. It returns
+// false if the packet is already there.
+func (d *Depacketizer) hold(packet *depacketizerPacket) bool {
+	delta := packet.sequenceNumber - d.lastSequenceNumber
+	index := sort.Search(len(d.pending), func(i int) bool {
+		return d.pending[i].sequenceNumber-d.lastSequenceNumber >= delta
+	})
+	if index < len(d.pending) && d.pending[index].sequenceNumber == packet.sequenceNumber {
+		return false
+	}
+
+	d.pending = append(d.pending, nil)
+	copy(d.pending[index+1:], d.pending[index:])
+	d.pending[index] = packet
+	return true
+}
+
+// release decodes the packets of the reorder window that follow the last
+// decoded one. Once the window is full, or when flushing, the gap before
+// the next packet is given up on.
+func (d *Depacketizer) release(flush bool) []Action {
+	var actions []Action
+	for len(d.pending) != 0 {
+		packet := d.pending[0]
+		lost := lostBetween(d.lastSequenceNumber, packet.sequenceNumber)
+		if lost > 0 && !flush && len(d.pending) <= d.reorderWindow {
+			break
+		}
+		d.pending = d.pending[1:]
+		d.stats.PacketsLost += uint64(lost)
+
+		if gap := int(int32(packet.timestamp - d.nextTimestamp)); gap > 0 {
+			actions = append(actions, d.fill(packet, gap, lost)...)
+		}
+
+		actions = d.decode(packet, actions)
+	}
+
+	return actions
+}
+
+// fill returns the decoder calls for the gap before packet
+func (d *Depacketizer) fill(packet *depacketizerPacket, gap, lost int) []Action {
+	fill := fillGap(gap, lost, packet.payload, packet.samples)
+	if fill.dtx {
+		d.stats.SamplesDTX += uint64(gap)
+		return []Action{{Type: ActionDTX, Samples: gap, Timestamp: d.nextTimestamp}}
+	}
+
+	var actions []Action
+	if fill.conceal > 0 {
+		d.stats.SamplesConcealed += uint64(fill.conceal)
+		actions = append(actions, Action{Type: ActionConceal, Samples: fill.conceal, Timestamp: d.nextTimestamp})
+	}
+
+	if fill.fec > 0 {
+		d.stats.PacketsRecovered++
+		actions = append(actions, Action{
+			Type:      ActionDecodeFEC,
+			Packet:    packet.payload,
+			Samples:   fill.fec,
+			Timestamp: packet.timestamp - uint32(fill.fec),
+		})
+	}
+
+	return actions
+}
+
+func (d *Depacketizer) decode(packet *depacketizerPacket, actions []Action) []Action {
+	d.stats.PacketsReceived++
+	d.lastSequenceNumber = packet.sequenceNumber
+	d.nextTimestamp = packet.timestamp + uint32(packet.samples)
+
+	return append(actions, Action{
+		Type:      ActionDecode,
+		Packet:    packet.payload,
+		Samples:   packet.samples,
+		Timestamp: packet.timestamp,
+	})
+}
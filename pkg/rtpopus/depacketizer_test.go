@@ -0,0 +1,355 @@
+package rtpopus
+
+import (
+	"encoding/binary"
+	"errors"
+	"reflect"
+	"testing"
+
+	"github.com/pion/opus"
+	"github.com/pion/opus/internal/rangecoding"
+)
+
+func buildRTPPacket(sequenceNumber uint16, timestamp, ssrc uint32, payload []byte) []byte {
+	packet := make([]byte, rtpHeaderLen, rtpHeaderLen+len(payload))
+	packet[0] = rtpVersion << 6
+	packet[1] = 111
+	binary.BigEndian.PutUint16(packet[2:], sequenceNumber)
+	binary.BigEndian.PutUint32(packet[4:], timestamp)
+	binary.BigEndian.PutUint32(packet[8:], ssrc)
+	return append(packet, payload...)
+}
+
+// 20ms SILK packet with the voice activity and LBRR flags set
+func buildLBRRPayload(t *testing.T) []byte {
+	encoder := rangecoding.Encoder{}
+	encoder.Init(make([]byte, 4))
+	encoder.EncodeSymbolLogP(1, 1)
+	encoder.EncodeSymbolLogP(1, 1)
+
+	frame, err := encoder.Done()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return append([]byte{0x08}, frame...)
+}
+
+func TestDepacketizer(t *testing.T) {
+	plain := []byte{0x08, 0, 0}
+	lbrr := buildLBRRPayload(t)
+
+	for _, test := range []struct {
+		name    string
+		packets [][]byte
+		actions []Action
+		stats   Stats
+	}{
+		{
+			"In order",
+			[][]byte{
+				buildRTPPacket(65535, 4294966336, 1, plain),
+				buildRTPPacket(0, 0, 1, plain),
+			},
+			[]Action{
+				{ActionDecode, plain, 960, 4294966336},
+				{ActionDecode, plain, 960, 0},
+			},
+			Stats{PacketsReceived: 2},
+		},
+		{
+			"Loss concealed",
+			[][]byte{
+				buildRTPPacket(1, 0, 1, plain),
+				buildRTPPacket(4, 2880, 1, plain),
+			},
+			[]Action{
+				{ActionDecode, plain, 960, 0},
+				{ActionConceal, nil, 1920, 960},
+				{ActionDecode, plain, 960, 2880},
+			},
+			Stats{PacketsReceived: 2, PacketsLost: 2, SamplesConcealed: 1920},
+		},
+		{
+			"Loss recovered with FEC",
+			[][]byte{
+				buildRTPPacket(1, 0, 1, plain),
+				buildRTPPacket(4, 2880, 1, lbrr),
+			},
+			[]Action{
+				{ActionDecode, plain, 960, 0},
+				{ActionConceal, nil, 960, 960},
+				{ActionDecodeFEC, lbrr, 960, 1920},
+				{ActionDecode, lbrr, 960, 2880},
+			},
+			Stats{PacketsReceived: 2, PacketsLost: 2, PacketsRecovered: 1, SamplesConcealed: 960},
+		},
+		{
+			"FEC can't fill a gap that isn't a multiple of 2.5 ms",
+			[][]byte{
+				buildRTPPacket(1, 0, 1, plain),
+				buildRTPPacket(4, 2900, 1, lbrr),
+			},
+			[]Action{
+				{ActionDecode, plain, 960, 0},
+				{ActionConceal, nil, 1940, 960},
+				{ActionDecode, lbrr, 960, 2900},
+			},
+			Stats{PacketsReceived: 2, PacketsLost: 2, SamplesConcealed: 1940},
+		},
+		{
+			"FEC can't fill a gap shorter than its frame",
+			[][]byte{
+				buildRTPPacket(1, 0, 1, plain),
+				buildRTPPacket(3, 1440, 1, lbrr),
+			},
+			[]Action{
+				{ActionDecode, plain, 960, 0},
+				{ActionConceal, nil, 480, 960},
+				{ActionDecode, lbrr, 960, 1440},
+			},
+			Stats{PacketsReceived: 2, PacketsLost: 1, SamplesConcealed: 480},
+		},
+		{
+			"DTX",
+			[][]byte{
+				buildRTPPacket(1, 0, 1, plain),
+				buildRTPPacket(2, 19200, 1, plain),
+			},
+			[]Action{
+				{ActionDecode, plain, 960, 0},
+				{ActionDTX, nil, 18240, 960},
+				{ActionDecode, plain, 960, 19200},
+			},
+			Stats{PacketsReceived: 2, SamplesDTX: 18240},
+		},
+		{
+			"Reordered and duplicate",
+			[][]byte{
+				buildRTPPacket(1, 0, 1, plain),
+				buildRTPPacket(3, 1920, 1, plain),
+				buildRTPPacket(2, 960, 1, plain),
+				buildRTPPacket(3, 1920, 1, plain),
+			},
+			[]Action{
+				{ActionDecode, plain, 960, 0},
+				{ActionDecode, plain, 960, 960},
+				{ActionDecode, plain, 960, 1920},
+			},
+			Stats{PacketsReceived: 3, PacketsLate: 1},
+		},
+		{
+			"Reordered beyond the window",
+			[][]byte{
+				buildRTPPacket(1, 0, 1, plain),
+				buildRTPPacket(3, 1920, 1, plain),
+				buildRTPPacket(4, 2880, 1, plain),
+				buildRTPPacket(5, 3840, 1, plain),
+				buildRTPPacket(6, 4800, 1, plain),
+				buildRTPPacket(2, 960, 1, plain),
+			},
+			[]Action{
+				{ActionDecode, plain, 960, 0},
+				{ActionConceal, nil, 960, 960},
+				{ActionDecode, plain, 960, 1920},
+				{ActionDecode, plain, 960, 2880},
+				{ActionDecode, plain, 960, 3840},
+				{ActionDecode, plain, 960, 4800},
+			},
+			Stats{PacketsReceived: 5, PacketsLost: 1, PacketsLate: 1, SamplesConcealed: 960},
+		},
+		{
+			"Sequence number wraps while reordered",
+			[][]byte{
+				buildRTPPacket(65534, 0, 1, plain),
+				buildRTPPacket(0, 1920, 1, plain),
+				buildRTPPacket(65535, 960, 1, plain),
+			},
+			[]Action{
+				{ActionDecode, plain, 960, 0},
+				{ActionDecode, plain, 960, 960},
+				{ActionDecode, plain, 960, 1920},
+			},
+			Stats{PacketsReceived: 3},
+		},
+		{
+			"Resync after a large jump",
+			[][]byte{
+				buildRTPPacket(1, 0, 1, plain),
+				buildRTPPacket(40000, 960, 1, plain),
+				buildRTPPacket(40001, 1920, 1, plain),
+				buildRTPPacket(40002, 2880, 1, plain),
+			},
+			[]Action{
+				{ActionDecode, plain, 960, 0},
+				{ActionDecode, plain, 960, 960},
+				{ActionDecode, plain, 960, 1920},
+				{ActionDecode, plain, 960, 2880},
+			},
+			Stats{PacketsReceived: 4, Resyncs: 1},
+		},
+		{
+			"Stray packet",
+			[][]byte{
+				buildRTPPacket(1, 0, 1, plain),
+				buildRTPPacket(20000, 960, 1, plain),
+				buildRTPPacket(2, 960, 1, plain),
+			},
+			[]Action{
+				{ActionDecode, plain, 960, 0},
+				{ActionDecode, plain, 960, 960},
+			},
+			Stats{PacketsReceived: 2, PacketsLate: 1},
+		},
+		{
+			"New SSRC",
+			[][]byte{
+				buildRTPPacket(1, 0, 1, plain),
+				buildRTPPacket(1000, 123456, 2, plain),
+			},
+			[]Action{
+				{ActionDecode, plain, 960, 0},
+				{ActionDecode, plain, 960, 123456},
+			},
+			Stats{PacketsReceived: 2},
+		},
+		{
+			"New SSRC during probation",
+			[][]byte{
+				buildRTPPacket(1, 0, 1, plain),
+				buildRTPPacket(20000, 960, 1, plain),
+				buildRTPPacket(500, 48000, 2, plain),
+				buildRTPPacket(20001, 1920, 2, plain),
+				buildRTPPacket(501, 48960, 2, plain),
+			},
+			[]Action{
+				{ActionDecode, plain, 960, 0},
+				{ActionDecode, plain, 960, 48000},
+				{ActionDecode, plain, 960, 48960},
+			},
+			Stats{PacketsReceived: 3, PacketsLate: 2},
+		},
+		{
+			"Resync after a new SSRC",
+			[][]byte{
+				buildRTPPacket(1, 0, 1, plain),
+				buildRTPPacket(20000, 960, 1, plain),
+				buildRTPPacket(500, 48000, 2, plain),
+				buildRTPPacket(40000, 48960, 2, plain),
+				buildRTPPacket(40001, 49920, 2, plain),
+			},
+			[]Action{
+				{ActionDecode, plain, 960, 0},
+				{ActionDecode, plain, 960, 48000},
+				{ActionDecode, plain, 960, 48960},
+				{ActionDecode, plain, 960, 49920},
+			},
+			Stats{PacketsReceived: 4, PacketsLate: 1, Resyncs: 1},
+		},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			depacketizer := NewDepacketizer()
+
+			var actions []Action
+			for _, packet := range test.packets {
+				packetActions, err := depacketizer.Push(packet)
+				if err != nil {
+					t.Fatal(err)
+				}
+				actions = append(actions, packetActions...)
+			}
+			actions = append(actions, depacketizer.Flush()...)
+
+			if !reflect.DeepEqual(actions, test.actions) {
+				t.Fatalf("expected %v, got %v", test.actions, actions)
+			} else if stats := depacketizer.Stats(); stats != test.stats {
+				t.Fatalf("expected %+v, got %+v", test.stats, stats)
+			}
+		})
+	}
+}
+
+func TestDepacketizer_ReusedBuffer(t *testing.T) {
+	depacketizer := NewDepacketizer()
+
+	// Every packet is read into the same buffer, like from a UDP socket,
+	// and packet 3 is held until packet 2 arrives
+	buffer := make([]byte, 1500)
+	var actions []Action
+	for _, sequenceNumber := range []uint16{1, 3, 2} {
+		payload := []byte{0x08, byte(sequenceNumber)}
+		n := copy(buffer, buildRTPPacket(sequenceNumber, uint32(sequenceNumber-1)*960, 1, payload))
+		packetActions, err := depacketizer.Push(buffer[:n])
+		if err != nil {
+			t.Fatal(err)
+		}
+		actions = append(actions, packetActions...)
+	}
+
+	expected := []Action{
+		{ActionDecode, []byte{0x08, 1}, 960, 0},
+		{ActionDecode, []byte{0x08, 2}, 960, 960},
+		{ActionDecode, []byte{0x08, 3}, 960, 1920},
+	}
+	if !reflect.DeepEqual(actions, expected) {
+		t.Fatalf("expected %v, got %v", expected, actions)
+	}
+}
+
+func TestDepacketizer_NoReorderWindow(t *testing.T) {
+	plain := []byte{0x08, 0, 0}
+	depacketizer := NewDepacketizer(WithReorderWindow(0))
+
+	// A gap is concealed right away, and the packet filling it is late
+	var actions []Action
+	for _, packet := range [][]byte{
+		buildRTPPacket(1, 0, 1, plain),
+		buildRTPPacket(3, 1920, 1, plain),
+		buildRTPPacket(2, 960, 1, plain),
+	} {
+		packetActions, err := depacketizer.Push(packet)
+		if err != nil {
+			t.Fatal(err)
+		}
+		actions = append(actions, packetActions...)
+	}
+
+	expected := []Action{
+		{ActionDecode, plain, 960, 0},
+		{ActionConceal, nil, 960, 960},
+		{ActionDecode, plain, 960, 1920},
+	}
+	if !reflect.DeepEqual(actions, expected) {
+		t.Fatalf("expected %v, got %v", expected, actions)
+	} else if stats := depacketizer.Stats(); stats != (Stats{PacketsReceived: 2, PacketsLost: 1, PacketsLate: 1, SamplesConcealed: 960}) {
+		t.Fatalf("got %+v", stats)
+	}
+}
+
+func TestDepacketizer_Errors(t *testing.T) {
+	padded := buildRTPPacket(1, 0, 1, []byte{0x08, 0, 0, 3})
+	padded[0] |= 0x20
+
+	extended := buildRTPPacket(1, 0, 1, []byte{0xbe, 0xde, 0, 1, 0, 0, 0, 0, 0x08})
+	extended[0] |= 0x10
+
+	for _, test := range []struct {
+		name   string
+		packet []byte
+		err    error
+	}{
+		{"Too short", []byte{0x80, 0}, errShortRTPPacket},
+		{"Bad version", append([]byte{0x40}, make([]byte, 12)...), errBadRTPVersion},
+		{"Padding covers the payload", padded[:len(padded)-2], errBadRTPPadding},
+		{"Empty payload", buildRTPPacket(1, 0, 1, nil), errEmptyRTPPayload},
+		{"Invalid Opus packet", buildRTPPacket(1, 0, 1, []byte{0x0b, 0}), opus.ErrCorruptedPacket},
+		{"Padding", padded, nil},
+		{"Header extension", extended, nil},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			if _, err := NewDepacketizer().Push(test.packet); !errors.Is(err, test.err) {
+				t.Fatalf("expected %v, got %v", test.err, err)
+			}
+		})
+	}
+}
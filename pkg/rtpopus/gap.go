@@ -0,0 +1,65 @@
+package rtpopus
+
+import (
+	"time"
+
+	"github.com/pion/opus"
+)
+
+// The decoder produces audio in multiples of 2.5 ms
+const samples2500us = clockRate / 400
+
+// gapFill is how the samples missing before a packet are played out
+type gapFill struct {
+	// dtx is set when no packet is missing, the sender stopped
+	// transmitting and the whole gap is comfort noise
+	dtx bool
+
+	// conceal samples are concealed, and the fec samples after them are
+	// recovered from the in-band FEC of the packet
+	conceal int
+	fec     int
+}
+
+// lostBetween returns the number of sequence numbers missing between the
+// last packet played out and the next one, modulo wrap-around
+func lostBetween(last, next uint16) int {
+	return int(int16(next-last)) - 1
+}
+
+// fillGap decides how to play out the gap samples before packet, when
+// lost packets are missing from the sequence before it. It is shared by
+// the Depacketizer and the JitterBuffer.
+//
+// The packet after a loss may carry the previous packet as LBRR, which
+// can recover up to its own duration of audio. The rest of the gap is
+// concealed. The decoder only recovers a whole number of 2.5 ms that
+// covers at least one frame of the packet, any other gap is concealed
+// entirely.
+//
+// https://tools.ietf.org/html/rfc6716#section-2.1.7
+func fillGap(gap, lost int, payload []byte, samples int) gapFill {
+	if lost == 0 {
+		return gapFill{dtx: true}
+	}
+
+	fecSamples := recoverableSamples(gap, payload, samples)
+	return gapFill{conceal: gap - fecSamples, fec: fecSamples}
+}
+
+// recoverableSamples returns how many samples at the end of the gap the
+// LBRR of a packet recovers, or zero if it has none or can't be decoded
+// into the gap
+func recoverableSamples(gap int, payload []byte, samples int) int {
+	if gap%samples2500us != 0 {
+		return 0
+	} else if hasLBRR, err := opus.PacketHasLBRR(payload); err != nil || !hasLBRR {
+		return 0
+	}
+
+	info, err := opus.ParsePacketInfo(payload)
+	if fecSamples := minInt(samples, gap); err == nil && fecSamples >= int(info.FrameDuration*clockRate/time.Second) {
+		return fecSamples
+	}
+	return 0
+}
@@ -0,0 +1,395 @@
+package rtpopus
+
+import (
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/pion/opus"
+)
+
+const (
+	defaultMinDelay = 20 * time.Millisecond
+	defaultMaxDelay = 500 * time.Millisecond
+
+	// The interarrival jitter estimate is smoothed over 16 packets
+	//
+	// https://tools.ietf.org/html/rfc3550#appendix-A.8
+	jitterSmoothing = 16
+
+	// The target delay covers this many times the jitter estimate
+	jitterDelayFactor = 3
+
+	// When more than this many times the target delay is buffered the
+	// oldest packets are dropped to bring the delay back down
+	maxBufferedFactor = 2
+)
+
+// Clock tells the JitterBuffer the arrival time of packets
+type Clock interface {
+	Now() time.Time
+}
+
+type systemClock struct{}
+
+func (systemClock) Now() time.Time {
+	return time.Now()
+}
+
+// JitterBufferOption configures a JitterBuffer
+type JitterBufferOption func(*JitterBuffer)
+
+// WithClock sets the clock arrival times are taken from, by default the
+// system clock
+func WithClock(clock Clock) JitterBufferOption {
+	return func(j *JitterBuffer) {
+		j.clock = clock
+	}
+}
+
+// WithDelayRange bounds the target delay, by default between 20 ms and
+// 500 ms. Negative bounds are taken as zero, and bounds given in the wrong
+// order are swapped.
+func WithDelayRange(minDelay, maxDelay time.Duration) JitterBufferOption {
+	return func(j *JitterBuffer) {
+		if minDelay < 0 {
+			minDelay = 0
+		}
+		if maxDelay < 0 {
+			maxDelay = 0
+		}
+		if minDelay > maxDelay {
+			minDelay, maxDelay = maxDelay, minDelay
+		}
+
+		j.minDelay = durationToSamples(minDelay)
+		j.maxDelay = durationToSamples(maxDelay)
+	}
+}
+
+// JitterBufferStats are the packet counts of a JitterBuffer
+type JitterBufferStats struct {
+	PacketsReceived  uint64
+	PacketsLate      uint64
+	PacketsLost      uint64
+	PacketsRecovered uint64
+	PacketsDropped   uint64
+	SamplesConcealed uint64
+	Underruns        uint64
+
+	// PacketsCorrupted counts the packets PullFloat32 concealed because
+	// the decoder rejected them
+	PacketsCorrupted uint64
+
+	// TargetDelay is the current target delay, from the jitter observed
+	TargetDelay time.Duration
+}
+
+type bufferedPacket struct {
+	sequenceNumber uint16
+	timestamp      int64
+	samples        int
+	payload        []byte
+}
+
+// JitterBuffer reorders Opus RTP packets and plays them out after a delay
+// that adapts to the observed jitter. Every Pull returns the decoder calls
+// for a fixed amount of audio: packets are decoded normally when they are
+// on time, recovered from the in-band FEC of the next packet or concealed
+// when they are lost, and the gaps of discontinuous transmission are
+// filled.
+//
+// The target delay covers the interarrival jitter estimate of RFC 3550.
+// Playout starts once that much audio is buffered. When the buffer runs
+// dry audio is concealed without moving the playout position, which
+// grows the delay, and when it holds too much the oldest packets are
+// dropped.
+type JitterBuffer struct {
+	clock              Clock
+	minDelay, maxDelay int
+
+	packets []*bufferedPacket
+
+	// Timestamps are unwrapped to 64 bits relative to the first packet
+	hasTimestamp  bool
+	lastTimestamp int64
+
+	playing bool
+	playout int64
+
+	// Samples the last Pull produced beyond what it was asked for, and
+	// their PCM when PullFloat32 decoded them
+	surplus int
+	decoded []float32
+
+	hasSequenceNumber    bool
+	lastSequenceNumber   uint16
+	lastArrival          time.Time
+	lastArrivalTimestamp int64
+	jitter               float64
+
+	stats JitterBufferStats
+}
+
+// NewJitterBuffer creates a new JitterBuffer
+func NewJitterBuffer(opts ...JitterBufferOption) *JitterBuffer {
+	j := &JitterBuffer{
+		clock:    systemClock{},
+		minDelay: durationToSamples(defaultMinDelay),
+		maxDelay: durationToSamples(defaultMaxDelay),
+	}
+
+	for _, opt := range opts {
+		opt(j)
+	}
+
+	return j
+}
+
+// Stats returns the packet counts so far
+func (j *JitterBuffer) Stats() JitterBufferStats {
+	stats := j.stats
+	stats.TargetDelay = time.Duration(j.targetDelay()) * time.Second / clockRate
+	return stats
+}
+
+// Push adds a received RTP packet to the buffer. Packets that arrive after
+// their audio was played out are dropped. The payload is copied, so in can
+// be reused for the next packet.
+func (j *JitterBuffer) Push(in []byte) error {
+	rtp, err := parseRTPPacket(in)
+	if err != nil {
+		return err
+	}
+
+	samples, err := opus.PacketSampleCount(rtp.payload, clockRate)
+	if err != nil {
+		return fmt.Errorf("%w: %v", opus.ErrCorruptedPacket, err)
+	}
+
+	timestamp := int64(rtp.timestamp)
+	if j.hasTimestamp {
+		timestamp = j.lastTimestamp + int64(int32(rtp.timestamp-uint32(j.lastTimestamp)))
+	}
+	j.hasTimestamp = true
+	j.lastTimestamp = timestamp
+
+	j.stats.PacketsReceived++
+	j.updateJitter(timestamp)
+
+	if j.playing && timestamp < j.playout {
+		j.stats.PacketsLate++
+		return nil
+	}
+
+	index := sort.Search(len(j.packets), func(i int) bool {
+		return j.packets[i].timestamp >= timestamp
+	})
+	if index < len(j.packets) && j.packets[index].timestamp == timestamp {
+		// Duplicate
+		j.stats.PacketsLate++
+		return nil
+	}
+
+	j.packets = append(j.packets, nil)
+	copy(j.packets[index+1:], j.packets[index:])
+	j.packets[index] = &bufferedPacket{
+		sequenceNumber: rtp.sequenceNumber,
+		timestamp:      timestamp,
+		samples:        samples,
+		payload:        append([]byte(nil), rtp.payload...),
+	}
+
+	return nil
+}
+
+// The interarrival jitter is the smoothed difference between the spacing
+// of arrival times and the spacing of RTP timestamps
+//
+// https://tools.ietf.org/html/rfc3550#section-6.4.1
+func (j *JitterBuffer) updateJitter(timestamp int64) {
+	arrival := j.clock.Now()
+	if !j.lastArrival.IsZero() {
+		transit := int64(durationToSamples(arrival.Sub(j.lastArrival))) - (timestamp - j.lastArrivalTimestamp)
+		if transit < 0 {
+			transit = -transit
+		}
+		j.jitter += (float64(transit) - j.jitter) / jitterSmoothing
+	}
+
+	j.lastArrival = arrival
+	j.lastArrivalTimestamp = timestamp
+}
+
+// targetDelay is the delay in samples that covers the jitter, and at least
+// one packet
+func (j *JitterBuffer) targetDelay() int {
+	delay := int(jitterDelayFactor * j.jitter)
+	if len(j.packets) != 0 {
+		delay += j.packets[0].samples
+	}
+
+	if delay < j.minDelay {
+		delay = j.minDelay
+	} else if delay > j.maxDelay {
+		delay = j.maxDelay
+	}
+
+	return delay
+}
+
+// bufferedSamples is the duration of the audio in the buffer
+func (j *JitterBuffer) bufferedSamples() int {
+	samples := 0
+	for _, packet := range j.packets {
+		samples += packet.samples
+	}
+
+	return samples
+}
+
+// Pull returns the decoder calls for the next samples of audio, in 48 kHz
+// samples per channel. It should be called at a fixed interval. Nothing
+// is returned until enough audio is buffered to start playout.
+//
+// Packets are decoded whole, as is the in-band FEC that recovers the
+// packet before one, so the calls can produce more audio than asked for.
+// The surplus is counted towards the next Pull, which returns nothing
+// when the surplus already covers it. Concealment and discontinuous
+// transmission are split to end where the samples asked for do.
+func (j *JitterBuffer) Pull(samples int) []Action {
+	if !j.playing {
+		if len(j.packets) == 0 || j.bufferedSamples() < j.targetDelay() {
+			return nil
+		}
+
+		j.playing = true
+		j.playout = j.packets[0].timestamp
+	}
+
+	if j.surplus >= samples {
+		j.surplus -= samples
+		return nil
+	}
+	samples -= j.surplus
+	j.surplus = 0
+
+	for len(j.packets) > 1 && j.bufferedSamples() > maxBufferedFactor*j.targetDelay() {
+		j.stats.PacketsDropped++
+		j.hasSequenceNumber = true
+		j.lastSequenceNumber = j.packets[0].sequenceNumber
+		j.playout = j.packets[1].timestamp
+		j.packets = j.packets[1:]
+	}
+
+	var actions []Action
+	produced := 0
+	for produced < samples {
+		remaining := samples - produced
+
+		if len(j.packets) == 0 {
+			// Underrun, the playout position stays put so the delay grows
+			j.stats.Underruns++
+			j.stats.SamplesConcealed += uint64(remaining)
+			actions = append(actions, Action{Type: ActionConceal, Samples: remaining, Timestamp: uint32(j.playout)})
+			produced += remaining
+			break
+		}
+
+		packet := j.packets[0]
+		gap := int(packet.timestamp - j.playout)
+		if gap <= 0 {
+			actions = append(actions, j.decode(packet))
+			produced += packet.samples
+			continue
+		}
+
+		// Without a previous packet to go by, the gap is a loss
+		lost := 1
+		if j.hasSequenceNumber {
+			lost = lostBetween(j.lastSequenceNumber, packet.sequenceNumber)
+		}
+
+		var action Action
+		switch fill := fillGap(gap, lost, packet.payload, packet.samples); {
+		case fill.dtx:
+			// Discontinuous transmission, the timestamps jump without loss
+			action = Action{Type: ActionDTX, Samples: minInt(gap, remaining)}
+		case fill.conceal == 0:
+			// The next packet carries what was lost
+			j.stats.PacketsRecovered++
+			action = Action{Type: ActionDecodeFEC, Packet: packet.payload, Samples: fill.fec}
+		default:
+			// Conceal up to where FEC could take over
+			action = Action{Type: ActionConceal, Samples: minInt(fill.conceal, remaining)}
+			j.stats.SamplesConcealed += uint64(action.Samples)
+		}
+
+		action.Timestamp = uint32(j.playout)
+		actions = append(actions, action)
+		j.playout += int64(action.Samples)
+		produced += action.Samples
+	}
+	j.surplus = produced - samples
+
+	return actions
+}
+
+// PullFloat32 makes the decoder calls of Pull for the next len(out)
+// interleaved samples on decoder, and writes their PCM to out. It returns
+// the number of samples per channel written, which is zero until playout
+// starts. Audio decoded beyond out is returned by the next PullFloat32. A
+// packet the decoder rejects is concealed instead. Use either Pull or
+// PullFloat32 on a JitterBuffer, and pull multiples of 2.5 ms so that
+// concealment can be split to the pull interval.
+func (j *JitterBuffer) PullFloat32(decoder Decoder, out []float32) (int, error) {
+	channels := decoder.Channels()
+	for _, action := range j.Pull(len(out) / channels) {
+		pcm := make([]float32, action.Samples*channels)
+		samples, err := action.Decode(decoder, pcm)
+		if err != nil && (action.Type == ActionDecode || action.Type == ActionDecodeFEC) {
+			j.stats.PacketsCorrupted++
+			j.stats.SamplesConcealed += uint64(action.Samples)
+			samples, err = conceal(decoder, pcm, action.Samples)
+		}
+		if err != nil {
+			return 0, err
+		}
+		j.decoded = append(j.decoded, pcm[:samples*channels]...)
+	}
+
+	n := copy(out, j.decoded)
+	j.decoded = j.decoded[:copy(j.decoded, j.decoded[n:])]
+	return n / channels, nil
+}
+
+func (j *JitterBuffer) decode(packet *bufferedPacket) Action {
+	if j.hasSequenceNumber {
+		if lost := lostBetween(j.lastSequenceNumber, packet.sequenceNumber); lost > 0 {
+			j.stats.PacketsLost += uint64(lost)
+		}
+	}
+
+	j.hasSequenceNumber = true
+	j.lastSequenceNumber = packet.sequenceNumber
+	j.packets = j.packets[1:]
+	j.playout = packet.timestamp + int64(packet.samples)
+
+	return Action{
+		Type:      ActionDecode,
+		Packet:    packet.payload,
+		Samples:   packet.samples,
+		Timestamp: uint32(packet.timestamp),
+	}
+}
+
+func durationToSamples(d time.Duration) int {
+	return int(d * clockRate / time.Second)
+}
+
+func minInt(a, b int) int {
+	if a < b {
+		return a
+	}
+	return b
+}
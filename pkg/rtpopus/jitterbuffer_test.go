@@ -0,0 +1,468 @@
+package rtpopus
+
+import (
+	"fmt"
+	"math"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/pion/opus"
+)
+
+type fakeClock struct {
+	now time.Time
+}
+
+func (c *fakeClock) Now() time.Time {
+	return c.now
+}
+
+func TestJitterBuffer_Reordering(t *testing.T) {
+	clock := &fakeClock{now: time.Unix(0, 0)}
+	jitterBuffer := NewJitterBuffer(WithClock(clock), WithDelayRange(40*time.Millisecond, time.Second))
+	plain := []byte{0x08, 0, 0}
+	lbrr := buildLBRRPayload(t)
+
+	push := func(sequenceNumber uint16, timestamp uint32, payload []byte) {
+		if err := jitterBuffer.Push(buildRTPPacket(sequenceNumber, timestamp, 1, payload)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	pull := func(expected ...Action) {
+		clock.now = clock.now.Add(20 * time.Millisecond)
+		if actions := jitterBuffer.Pull(960); !reflect.DeepEqual(actions, expected) {
+			t.Fatalf("expected %v, got %v", expected, actions)
+		}
+	}
+
+	// Nothing plays until the target delay is buffered
+	push(65534, 4294965376, plain)
+	pull()
+
+	// Packets arrive out of order, and the timestamps wrap around
+	push(0, 0, plain)
+	push(65535, 4294966336, plain)
+	pull(Action{ActionDecode, plain, 960, 4294965376})
+	pull(Action{ActionDecode, plain, 960, 4294966336})
+	pull(Action{ActionDecode, plain, 960, 0})
+
+	// Packet 1 is lost, packet 3 is recovered with the FEC of packet 4
+	push(2, 1920, plain)
+	push(4, 3840, lbrr)
+	pull(Action{ActionConceal, nil, 960, 960})
+	pull(Action{ActionDecode, plain, 960, 1920})
+	pull(Action{ActionDecodeFEC, lbrr, 960, 2880})
+	pull(Action{ActionDecode, lbrr, 960, 3840})
+
+	// Discontinuous transmission
+	push(5, 9600, plain)
+	pull(Action{ActionDTX, nil, 960, 4800})
+
+	// Packet 1 arrives after it was concealed, and packet 5 is a duplicate
+	push(1, 960, plain)
+	push(5, 9600, plain)
+
+	// The buffer runs dry after the DTX gap and packet 5
+	for timestamp := uint32(5760); timestamp < 9600; timestamp += 960 {
+		pull(Action{ActionDTX, nil, 960, timestamp})
+	}
+	pull(Action{ActionDecode, plain, 960, 9600})
+	pull(Action{ActionConceal, nil, 960, 10560})
+	pull(Action{ActionConceal, nil, 960, 10560})
+
+	expected := JitterBufferStats{
+		PacketsReceived:  8,
+		PacketsLate:      2,
+		PacketsLost:      2,
+		PacketsRecovered: 1,
+		SamplesConcealed: 2880,
+		Underruns:        2,
+	}
+	stats := jitterBuffer.Stats()
+	stats.TargetDelay = 0
+	if stats != expected {
+		t.Fatalf("expected %+v, got %+v", expected, stats)
+	}
+}
+
+func TestJitterBuffer_TargetDelay(t *testing.T) {
+	targetDelay := func(arrivalJitter time.Duration) time.Duration {
+		clock := &fakeClock{now: time.Unix(0, 0)}
+		jitterBuffer := NewJitterBuffer(WithClock(clock))
+
+		for i := 0; i < 100; i++ {
+			arrival := time.Duration(i) * 20 * time.Millisecond
+			if i%2 == 1 {
+				arrival += arrivalJitter
+			}
+			clock.now = time.Unix(0, 0).Add(arrival)
+
+			if err := jitterBuffer.Push(buildRTPPacket(uint16(i), uint32(i*960), 1, []byte{0x08})); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		return jitterBuffer.Stats().TargetDelay
+	}
+
+	if delay := targetDelay(0); delay != defaultMinDelay {
+		t.Fatalf("expected the minimum delay without jitter, got %v", delay)
+	}
+
+	if delay := targetDelay(30 * time.Millisecond); delay < 90*time.Millisecond || delay > defaultMaxDelay {
+		t.Fatalf("expected the delay to cover the jitter, got %v", delay)
+	}
+}
+
+func TestJitterBuffer_DelayRange(t *testing.T) {
+	for _, test := range []struct {
+		name               string
+		minDelay, maxDelay time.Duration
+		expected           time.Duration
+	}{
+		{"In order", 40 * time.Millisecond, 100 * time.Millisecond, 40 * time.Millisecond},
+		{"Swapped", 100 * time.Millisecond, 40 * time.Millisecond, 40 * time.Millisecond},
+		{"Negative minimum", -time.Second, 100 * time.Millisecond, 20 * time.Millisecond},
+		{"Both negative", -time.Second, -time.Millisecond, 0},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			// Without jitter the target delay is one packet, within the
+			// range
+			jitterBuffer := NewJitterBuffer(WithClock(&fakeClock{}), WithDelayRange(test.minDelay, test.maxDelay))
+			if err := jitterBuffer.Push(buildRTPPacket(0, 0, 1, []byte{0x08})); err != nil {
+				t.Fatal(err)
+			}
+
+			if delay := jitterBuffer.Stats().TargetDelay; delay != test.expected {
+				t.Fatalf("expected %v, got %v", test.expected, delay)
+			}
+		})
+	}
+}
+
+func TestJitterBuffer_ReusedBuffer(t *testing.T) {
+	clock := &fakeClock{now: time.Unix(0, 0)}
+	jitterBuffer := NewJitterBuffer(WithClock(clock), WithDelayRange(60*time.Millisecond, time.Second))
+
+	// Every packet is read into the same buffer, like from a UDP socket
+	buffer := make([]byte, 1500)
+	for i := 0; i < 3; i++ {
+		n := copy(buffer, buildRTPPacket(uint16(i), uint32(i*960), 1, []byte{0x08, byte(i)}))
+		if err := jitterBuffer.Push(buffer[:n]); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var actions []Action
+	for i := 0; i < 3; i++ {
+		clock.now = clock.now.Add(20 * time.Millisecond)
+		actions = append(actions, jitterBuffer.Pull(960)...)
+	}
+	expected := []Action{
+		{ActionDecode, []byte{0x08, 0}, 960, 0},
+		{ActionDecode, []byte{0x08, 1}, 960, 960},
+		{ActionDecode, []byte{0x08, 2}, 960, 1920},
+	}
+	if !reflect.DeepEqual(actions, expected) {
+		t.Fatalf("expected %v, got %v", expected, actions)
+	}
+}
+
+func TestJitterBuffer_Overflow(t *testing.T) {
+	clock := &fakeClock{now: time.Unix(0, 0)}
+	jitterBuffer := NewJitterBuffer(WithClock(clock), WithDelayRange(20*time.Millisecond, 20*time.Millisecond))
+
+	// A burst of packets after playout started
+	if err := jitterBuffer.Push(buildRTPPacket(0, 0, 1, []byte{0x08})); err != nil {
+		t.Fatal(err)
+	}
+	jitterBuffer.Pull(960)
+	for i := 1; i < 5; i++ {
+		if err := jitterBuffer.Push(buildRTPPacket(uint16(i), uint32(i*960), 1, []byte{0x08})); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Only two packets are kept
+	actions := jitterBuffer.Pull(960)
+	switch {
+	case len(actions) != 1 || actions[0].Timestamp != 3*960:
+		t.Fatalf("expected packet 3 to be decoded, got %v", actions)
+	case jitterBuffer.Stats().PacketsDropped != 2:
+		t.Fatal(jitterBuffer.Stats().PacketsDropped)
+	case jitterBuffer.Stats().PacketsLost != 0:
+		t.Fatal(jitterBuffer.Stats().PacketsLost)
+	}
+}
+
+func TestJitterBuffer_PullInterval(t *testing.T) {
+	plain := []byte{0x08, 0, 0}
+	lbrr := buildLBRRPayload(t)
+
+	t.Run("Shorter than packets", func(t *testing.T) {
+		clock := &fakeClock{now: time.Unix(0, 0)}
+		jitterBuffer := NewJitterBuffer(WithClock(clock), WithDelayRange(40*time.Millisecond, time.Second))
+
+		push := func(sequenceNumber uint16, payload []byte) {
+			if err := jitterBuffer.Push(buildRTPPacket(sequenceNumber, uint32(sequenceNumber)*960, 1, payload)); err != nil {
+				t.Fatal(err)
+			}
+		}
+		pull := func(expected ...Action) {
+			clock.now = clock.now.Add(10 * time.Millisecond)
+			if actions := jitterBuffer.Pull(480); !reflect.DeepEqual(actions, expected) {
+				t.Fatalf("expected %v, got %v", expected, actions)
+			}
+		}
+
+		// Every other 10 ms pull decodes a 20 ms packet, the other one is
+		// covered by the surplus
+		push(0, plain)
+		push(1, plain)
+		pull(Action{ActionDecode, plain, 960, 0})
+		pull()
+		push(2, plain)
+		pull(Action{ActionDecode, plain, 960, 960})
+		pull()
+
+		// Packet 3 is recovered with the FEC of packet 4, which decodes a
+		// whole packet too
+		push(4, lbrr)
+		pull(Action{ActionDecode, plain, 960, 1920})
+		pull()
+		pull(Action{ActionDecodeFEC, lbrr, 960, 2880})
+		pull()
+		pull(Action{ActionDecode, lbrr, 960, 3840})
+		pull()
+
+		// Concealment is split to the pull interval
+		pull(Action{ActionConceal, nil, 480, 4800})
+		pull(Action{ActionConceal, nil, 480, 4800})
+
+		expected := JitterBufferStats{
+			PacketsReceived:  4,
+			PacketsLost:      1,
+			PacketsRecovered: 1,
+			SamplesConcealed: 960,
+			Underruns:        2,
+		}
+		stats := jitterBuffer.Stats()
+		stats.TargetDelay = 0
+		if stats != expected {
+			t.Fatalf("expected %+v, got %+v", expected, stats)
+		}
+	})
+
+	t.Run("Longer than packets", func(t *testing.T) {
+		clock := &fakeClock{now: time.Unix(0, 0)}
+		jitterBuffer := NewJitterBuffer(WithClock(clock), WithDelayRange(20*time.Millisecond, time.Second))
+
+		// 10 ms packets, with packet 2 lost and 60 ms of DTX after packet 5
+		tenMs := []byte{0x00, 0, 0}
+		for _, packet := range []struct {
+			sequenceNumber uint16
+			timestamp      uint32
+		}{{0, 0}, {1, 480}, {3, 1440}, {4, 1920}, {5, 2400}, {6, 5760}} {
+			if err := jitterBuffer.Push(buildRTPPacket(packet.sequenceNumber, packet.timestamp, 1, tenMs)); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		for _, expected := range [][]Action{
+			{{ActionDecode, tenMs, 480, 0}, {ActionDecode, tenMs, 480, 480}},
+			{{ActionConceal, nil, 480, 960}, {ActionDecode, tenMs, 480, 1440}},
+			{{ActionDecode, tenMs, 480, 1920}, {ActionDecode, tenMs, 480, 2400}},
+			{{ActionDTX, nil, 960, 2880}},
+			{{ActionDTX, nil, 960, 3840}},
+			{{ActionDTX, nil, 960, 4800}},
+			{{ActionDecode, tenMs, 480, 5760}, {ActionConceal, nil, 480, 6240}},
+		} {
+			clock.now = clock.now.Add(20 * time.Millisecond)
+			if actions := jitterBuffer.Pull(960); !reflect.DeepEqual(actions, expected) {
+				t.Fatalf("expected %v, got %v", expected, actions)
+			}
+		}
+	})
+}
+
+// recordingDecoder records the decoder calls made on it, and outputs the
+// number of the call for every sample
+type recordingDecoder struct {
+	calls []string
+}
+
+func (d *recordingDecoder) Channels() int {
+	return 2
+}
+
+func (d *recordingDecoder) output(call string, out []float32, samples int) (int, error) {
+	d.calls = append(d.calls, call)
+	for i := range out[:2*samples] {
+		out[i] = float32(len(d.calls))
+	}
+	return samples, nil
+}
+
+func (d *recordingDecoder) DecodeFloat32(in []byte, out []float32) (int, error) {
+	if len(in) < 2 {
+		return 0, opus.ErrCorruptedPacket
+	}
+
+	samples, err := opus.PacketSampleCount(in, clockRate)
+	if err != nil {
+		return 0, err
+	}
+	return d.output("Decode", out, samples)
+}
+
+func (d *recordingDecoder) DecodeFEC(in []byte, out []float32, samples int) (int, error) {
+	return d.output("DecodeFEC", out, samples)
+}
+
+func (d *recordingDecoder) Conceal(out []float32, samples int) (int, error) {
+	return d.output(fmt.Sprintf("Conceal %d", samples), out, samples)
+}
+
+func TestJitterBuffer_PullFloat32(t *testing.T) {
+	clock := &fakeClock{now: time.Unix(0, 0)}
+	jitterBuffer := NewJitterBuffer(WithClock(clock), WithDelayRange(40*time.Millisecond, time.Second))
+	plain := []byte{0x08, 0, 0}
+
+	// Packet 2 is lost and recovered from packet 3, packet 4 is rejected
+	// by the decoder
+	for _, packet := range []struct {
+		sequenceNumber uint16
+		payload        []byte
+	}{{0, plain}, {1, plain}, {3, buildLBRRPayload(t)}, {4, []byte{0x08}}} {
+		if err := jitterBuffer.Push(buildRTPPacket(packet.sequenceNumber, uint32(packet.sequenceNumber)*960, 1, packet.payload)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Pulls of 10 ms return the second half of packets from the surplus
+	decoder := &recordingDecoder{}
+	var out []float32
+	for i := 0; i < 12; i++ {
+		pcm := make([]float32, 2*480)
+		samples, err := jitterBuffer.PullFloat32(decoder, pcm)
+		if err != nil {
+			t.Fatal(err)
+		} else if samples != 480 {
+			t.Fatalf("pull %d: %d samples", i, samples)
+		}
+		out = append(out, pcm...)
+	}
+
+	expectedCalls := []string{"Decode", "Decode", "DecodeFEC", "Decode", "Conceal 960", "Conceal 480", "Conceal 480"}
+	if !reflect.DeepEqual(decoder.calls, expectedCalls) {
+		t.Fatalf("expected %v, got %v", expectedCalls, decoder.calls)
+	}
+	for i, sample := range out {
+		expected := float32(i/1920 + 1)
+		if i >= 5*1920 {
+			expected = float32(6 + (i-5*1920)/960)
+		}
+		if sample != expected {
+			t.Fatalf("sample %d: expected %f, got %f", i, expected, sample)
+		}
+	}
+	if stats := jitterBuffer.Stats(); stats.PacketsCorrupted != 1 || stats.PacketsRecovered != 1 {
+		t.Fatalf("%+v", stats)
+	}
+}
+
+func TestJitterBuffer_UndecodableFECGap(t *testing.T) {
+	clock := &fakeClock{now: time.Unix(0, 0)}
+	jitterBuffer := NewJitterBuffer(WithClock(clock), WithDelayRange(20*time.Millisecond, time.Second))
+	plain := []byte{0x08, 0, 0}
+
+	// Packet 1 is lost and packet 2 carries its LBRR, but starts 100
+	// samples late so the gap isn't a multiple of 2.5 ms
+	for _, packet := range []struct {
+		sequenceNumber uint16
+		timestamp      uint32
+		payload        []byte
+	}{{0, 0, plain}, {2, 2020, buildLBRRPayload(t)}} {
+		if err := jitterBuffer.Push(buildRTPPacket(packet.sequenceNumber, packet.timestamp, 1, packet.payload)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	decoder := &recordingDecoder{}
+	for i := 0; i < 3; i++ {
+		if _, err := jitterBuffer.PullFloat32(decoder, make([]float32, 2*960)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// The gap is concealed, rounded up to what the decoder can conceal
+	expectedCalls := []string{"Decode", "Conceal 960", "Conceal 120", "Decode"}
+	if !reflect.DeepEqual(decoder.calls, expectedCalls) {
+		t.Fatalf("expected %v, got %v", expectedCalls, decoder.calls)
+	}
+	if stats := jitterBuffer.Stats(); stats.PacketsRecovered != 0 || stats.PacketsCorrupted != 0 || stats.SamplesConcealed != 1060 {
+		t.Fatalf("%+v", stats)
+	}
+}
+
+func TestJitterBuffer_OpusDecoder(t *testing.T) {
+	encoder, err := opus.NewEncoder(48000, 1, opus.ApplicationVoIP)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var packets [][]byte
+	for i := 0; i < 10; i++ {
+		samples := make([]float32, 960)
+		for j := range samples {
+			samples[j] = float32(0.5 * math.Sin(2*math.Pi*440*float64(960*i+j)/clockRate))
+		}
+
+		payload := make([]byte, 1500)
+		size, err := encoder.EncodeFloat32(samples, payload)
+		if err != nil {
+			t.Fatal(err)
+		}
+		packets = append(packets, buildRTPPacket(uint16(i), uint32(i*960), 1, payload[:size]))
+	}
+
+	var decoder Decoder
+	decoder, err = opus.NewDecoderWithChannels(1)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Every packet arrives one pull ahead of its playout, and packet 4 is
+	// lost
+	clock := &fakeClock{now: time.Unix(0, 0)}
+	jitterBuffer := NewJitterBuffer(WithClock(clock))
+	if err = jitterBuffer.Push(packets[0]); err != nil {
+		t.Fatal(err)
+	}
+	energy := 0.0
+	for i := 0; i < 10; i++ {
+		if i+1 < len(packets) && i+1 != 4 {
+			if err = jitterBuffer.Push(packets[i+1]); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		clock.now = clock.now.Add(20 * time.Millisecond)
+		pcm := make([]float32, 960)
+		if samples, err := jitterBuffer.PullFloat32(decoder, pcm); err != nil {
+			t.Fatal(err)
+		} else if samples != 960 {
+			t.Fatalf("pull %d: %d samples", i, samples)
+		}
+		for _, sample := range pcm {
+			energy += float64(sample) * float64(sample)
+		}
+	}
+
+	if stats := jitterBuffer.Stats(); stats.PacketsLost != 1 || stats.SamplesConcealed != 960 {
+		t.Fatalf("%+v", stats)
+	} else if energy/9600 < 0.05 {
+		t.Fatalf("mean energy %f", energy/9600)
+	}
+}
@@ -0,0 +1,101 @@
+package rtpopus
+
+import (
+	"encoding/binary"
+	"errors"
+)
+
+const (
+	rtpVersion          = 2
+	rtpHeaderLen        = 12
+	rtpCSRCLen          = 4
+	rtpExtensionHeadLen = 4
+)
+
+var (
+	errShortRTPPacket    = errors.New("RTP packet is too short for its header")
+	errBadRTPVersion     = errors.New("RTP version must be 2")
+	errBadRTPPadding     = errors.New("RTP padding exceeds the payload")
+	errEmptyRTPPayload   = errors.New("RTP packet has no payload")
+	errNotEnoughForCSRCs = errors.New("RTP packet is too short for its CSRC list")
+	errInvalidAction     = errors.New("invalid action type")
+)
+
+// The fixed RTP header, followed by the CSRC list and an optional header
+// extension. When the padding bit is set the last byte of the packet is
+// the number of padding bytes at its end.
+//
+//      0                   1                   2                   3
+//      0 1 2 3 4 5 6 7 8 9 0 1 2 3 4 5 6 7 8 9 0 1 2 3 4 5 6 7 8 9 0 1
+//     +-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+
+//     |V=2|P|X|  CC   |M|     PT      |       sequence number         |
+//     +-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+
+//     |                           timestamp                           |
+//     +-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+
+//     |           synchronization source (SSRC) identifier            |
+//     +=+=+=+=+=+=+=+=+=+=+=+=+=+=+=+=+=+=+=+=+=+=+=+=+=+=+=+=+=+=+=+=+
+//     |            contributing source (CSRC) identifiers             |
+//     |                             ....                              |
+//     +-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+
+//
+// https://tools.ietf.org/html/rfc3550#section-5.1
+type rtpPacket struct {
+	sequenceNumber uint16
+	timestamp      uint32
+	ssrc           uint32
+	payload        []byte
+}
+
+func parseRTPPacket(in []byte) (*rtpPacket, error) {
+	if len(in) < rtpHeaderLen {
+		return nil, errShortRTPPacket
+	} else if in[0]>>6 != rtpVersion {
+		return nil, errBadRTPVersion
+	}
+
+	hasPadding := in[0]&0x20 != 0
+	hasExtension := in[0]&0x10 != 0
+	csrcCount := int(in[0] & 0x0f)
+
+	packet := &rtpPacket{
+		sequenceNumber: binary.BigEndian.Uint16(in[2:]),
+		timestamp:      binary.BigEndian.Uint32(in[4:]),
+		ssrc:           binary.BigEndian.Uint32(in[8:]),
+	}
+
+	offset := rtpHeaderLen + csrcCount*rtpCSRCLen
+	if offset > len(in) {
+		return nil, errNotEnoughForCSRCs
+	}
+
+	// https://tools.ietf.org/html/rfc3550#section-5.3.1
+	if hasExtension {
+		if offset+rtpExtensionHeadLen > len(in) {
+			return nil, errShortRTPPacket
+		}
+
+		offset += rtpExtensionHeadLen + 4*int(binary.BigEndian.Uint16(in[offset+2:]))
+		if offset > len(in) {
+			return nil, errShortRTPPacket
+		}
+	}
+
+	end := len(in)
+	if hasPadding {
+		padding := int(in[end-1])
+		if padding == 0 || end-padding < offset {
+			return nil, errBadRTPPadding
+		}
+		end -= padding
+	}
+
+	// An Opus payload always has at least the TOC byte
+	//
+	// https://tools.ietf.org/html/rfc7587#section-4.2
+	if offset == end {
+		return nil, errEmptyRTPPayload
+	}
+
+	packet.payload = in[offset:end]
+	return packet, nil
+}
@@ -0,0 +1,97 @@
+// Package testvector implements a reader for the Opus test vectors of RFC
+// 6716 and RFC 8251. Each testvector*.bit file holds packets in the format
+// written by opus_demo, and the matching .dec file the reference decoder's
+// output for them.
+package testvector
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+)
+
+// Each packet is preceded by its length and the final range of the
+// encoder after coding it, both 32-bit big endian
+const packetHeaderLen = 8
+
+// Opus packets are at most 1275 bytes per frame, with up to 48 frames
+const maxPacketLen = 1275 * 48
+
+var (
+	errNilStream       = errors.New("stream is nil")
+	errShortHeader     = errors.New("not enough data for packet header")
+	errPacketTooLong   = errors.New("packet length exceeds the maximum Opus packet length")
+	errShortPacket     = errors.New("not enough data for packet")
+	errOddPCMByteCount = errors.New("PCM data ends in the middle of a sample")
+)
+
+// Reader reads the packets of a testvector*.bit file
+type Reader struct {
+	stream io.Reader
+	header [packetHeaderLen]byte
+}
+
+// PacketHeader is the metadata stored with each packet
+type PacketHeader struct {
+	// FinalRange is the state of the range encoder after coding the
+	// packet. A decoder is bit-exact when its range decoder ends the
+	// packet in the same state.
+	FinalRange uint32
+}
+
+// NewWith returns a new test vector reader reading from in
+func NewWith(in io.Reader) (*Reader, error) {
+	if in == nil {
+		return nil, errNilStream
+	}
+
+	return &Reader{stream: in}, nil
+}
+
+// ReadPacket returns the next packet. A packet of length zero was lost,
+// and should be concealed by the decoder. io.EOF is returned after the
+// last packet.
+func (r *Reader) ReadPacket() ([]byte, *PacketHeader, error) {
+	if _, err := io.ReadFull(r.stream, r.header[:]); errors.Is(err, io.ErrUnexpectedEOF) {
+		return nil, nil, errShortHeader
+	} else if err != nil {
+		return nil, nil, err
+	}
+
+	length := binary.BigEndian.Uint32(r.header[0:])
+	if length > maxPacketLen {
+		return nil, nil, errPacketTooLong
+	}
+
+	packet := make([]byte, length)
+	if _, err := io.ReadFull(r.stream, packet); errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+		return nil, nil, errShortPacket
+	} else if err != nil {
+		return nil, nil, err
+	}
+
+	return packet, &PacketHeader{FinalRange: binary.BigEndian.Uint32(r.header[4:])}, nil
+}
+
+// ReadPCM reads the samples of a .dec file, which are 16-bit little
+// endian and interleaved. The reference decoder's output is at 48 kHz and
+// stereo, or mono for the testvector*m.dec files of RFC 8251.
+func ReadPCM(in io.Reader) ([]int16, error) {
+	if in == nil {
+		return nil, errNilStream
+	}
+
+	data, err := io.ReadAll(in)
+	if err != nil {
+		return nil, err
+	} else if len(data)%2 != 0 {
+		return nil, errOddPCMByteCount
+	}
+
+	pcm := make([]int16, len(data)/2)
+	for i := range pcm {
+		pcm[i] = int16(binary.LittleEndian.Uint16(data[2*i:]))
+	}
+
+	return pcm, nil
+}
@@ -0,0 +1,90 @@
+package testvector
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"testing"
+)
+
+func TestReader(t *testing.T) {
+	reader, err := NewWith(bytes.NewReader([]byte{
+		0x00, 0x00, 0x00, 0x02, 0xDE, 0xAD, 0xBE, 0xEF, 0x08, 0x0B,
+		0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00,
+		0x00, 0x00, 0x00, 0x01, 0x01, 0x02, 0x03, 0x04, 0x48,
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, expected := range []struct {
+		packet     []byte
+		finalRange uint32
+	}{
+		{[]byte{0x08, 0x0B}, 0xDEADBEEF},
+		{[]byte{}, 0},
+		{[]byte{0x48}, 0x01020304},
+	} {
+		packet, header, err := reader.ReadPacket()
+		if err != nil {
+			t.Fatal(err)
+		} else if !bytes.Equal(packet, expected.packet) {
+			t.Fatalf("packet %v, expected %v", packet, expected.packet)
+		} else if header.FinalRange != expected.finalRange {
+			t.Fatalf("final range %08x, expected %08x", header.FinalRange, expected.finalRange)
+		}
+	}
+
+	if _, _, err = reader.ReadPacket(); !errors.Is(err, io.EOF) {
+		t.Fatalf("expected io.EOF, got %v", err)
+	}
+}
+
+func TestReader_Errors(t *testing.T) {
+	if _, err := NewWith(nil); !errors.Is(err, errNilStream) {
+		t.Fatalf("expected errNilStream, got %v", err)
+	}
+
+	for _, test := range []struct {
+		name     string
+		data     []byte
+		expected error
+	}{
+		{"short header", []byte{0x00, 0x00, 0x00, 0x01, 0x00}, errShortHeader},
+		{"short packet", []byte{0x00, 0x00, 0x00, 0x02, 0x00, 0x00, 0x00, 0x00, 0x48}, errShortPacket},
+		{"missing packet", []byte{0x00, 0x00, 0x00, 0x02, 0x00, 0x00, 0x00, 0x00}, errShortPacket},
+		{"packet too long", []byte{0x00, 0x01, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00}, errPacketTooLong},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			reader, err := NewWith(bytes.NewReader(test.data))
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if _, _, err = reader.ReadPacket(); !errors.Is(err, test.expected) {
+				t.Fatalf("expected %v, got %v", test.expected, err)
+			}
+		})
+	}
+}
+
+func TestReadPCM(t *testing.T) {
+	pcm, err := ReadPCM(bytes.NewReader([]byte{0x01, 0x00, 0xFF, 0xFF, 0x00, 0x80}))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := []int16{1, -1, -32768}
+	if len(pcm) != len(expected) {
+		t.Fatalf("pcm %v, expected %v", pcm, expected)
+	}
+	for i := range expected {
+		if pcm[i] != expected[i] {
+			t.Fatalf("pcm %v, expected %v", pcm, expected)
+		}
+	}
+
+	if _, err = ReadPCM(bytes.NewReader([]byte{0x01})); !errors.Is(err, errOddPCMByteCount) {
+		t.Fatalf("expected errOddPCMByteCount, got %v", err)
+	}
+}
@@ -0,0 +1,252 @@
+// Package wav implements a RIFF WAVE file writer for decoded audio
+package wav
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+	"math"
+	"os"
+)
+
+const (
+	formatPCM   = 1
+	formatFloat = 3
+
+	riffHeaderLen  = 12
+	chunkHeaderLen = 8
+	fmtPCMLen      = 16
+
+	// Formats other than PCM have a cbSize field, and a fact chunk with
+	// the number of sample frames
+	fmtFloatLen = 18
+	factLen     = 4
+
+	maxDataSize = math.MaxUint32 - 64
+)
+
+var (
+	errNilStream       = errors.New("stream is nil")
+	errBadSampleRate   = errors.New("sample rate must be positive")
+	errBadChannelCount = errors.New("channel count must be between 1 and 65535")
+	errBadSampleCount  = errors.New("sample count is not a multiple of the channel count")
+	errWriterClosed    = errors.New("writer is closed")
+	errFileTooLarge    = errors.New("WAVE data exceeds 4 GiB")
+)
+
+// Option configures a WAVWriter
+type Option func(*WAVWriter) error
+
+// WithFloat32 writes 32-bit IEEE float samples instead of 16-bit PCM
+func WithFloat32() Option {
+	return func(w *WAVWriter) error {
+		w.float = true
+		return nil
+	}
+}
+
+// WAVWriter writes interleaved float32 samples to a WAVE file. The chunk
+// sizes are written when the writer is closed, so the output must be
+// seekable.
+//
+// http://www-mmsp.ece.mcgill.ca/Documents/AudioFormats/WAVE/WAVE.html
+type WAVWriter struct {
+	stream io.WriteSeeker
+	fd     *os.File
+
+	channels   int
+	float      bool
+	headerLen  int64
+	dataSize   uint32
+	closed     bool
+	sampleBuf  []byte
+	sampleSize int
+}
+
+// New builds a new WAVE writer that writes to the file fileName
+func New(fileName string, sampleRate, channels int, opts ...Option) (*WAVWriter, error) {
+	f, err := os.Create(fileName) //nolint:gosec
+	if err != nil {
+		return nil, err
+	}
+
+	writer, err := NewWith(f, sampleRate, channels, opts...)
+	if err != nil {
+		_ = f.Close()
+		return nil, err
+	}
+
+	writer.fd = f
+	return writer, nil
+}
+
+// NewWith returns a new WAVE writer that writes to out, starting with the
+// header
+func NewWith(out io.WriteSeeker, sampleRate, channels int, opts ...Option) (*WAVWriter, error) {
+	switch {
+	case out == nil:
+		return nil, errNilStream
+	case sampleRate <= 0 || sampleRate > math.MaxInt32:
+		return nil, errBadSampleRate
+	case channels < 1 || channels > math.MaxUint16:
+		return nil, errBadChannelCount
+	}
+
+	w := &WAVWriter{
+		stream:     out,
+		channels:   channels,
+		sampleSize: 2,
+	}
+	for _, opt := range opts {
+		if err := opt(w); err != nil {
+			return nil, err
+		}
+	}
+	if w.float {
+		w.sampleSize = 4
+	}
+
+	header := w.marshalHeader(uint32(sampleRate))
+	w.headerLen = int64(len(header))
+	if _, err := w.stream.Write(header); err != nil {
+		return nil, err
+	}
+
+	return w, nil
+}
+
+// The header is a RIFF chunk of form WAVE holding a fmt chunk, a fact
+// chunk for float samples, and the header of the data chunk. The sizes are
+// written again by Close.
+func (w *WAVWriter) marshalHeader(sampleRate uint32) []byte {
+	formatTag, fmtLen := uint16(formatPCM), uint32(fmtPCMLen)
+	if w.float {
+		formatTag, fmtLen = formatFloat, fmtFloatLen
+	}
+
+	blockAlign := uint16(w.channels * w.sampleSize)
+
+	header := make([]byte, 0, riffHeaderLen+3*chunkHeaderLen+fmtFloatLen+factLen)
+	header = append(header, "RIFF\x00\x00\x00\x00WAVE"...)
+	header = appendChunkHeader(header, "fmt ", fmtLen)
+	header = appendUint16(header, formatTag)
+	header = appendUint16(header, uint16(w.channels))
+	header = appendUint32(header, sampleRate)
+	header = appendUint32(header, sampleRate*uint32(blockAlign))
+	header = appendUint16(header, blockAlign)
+	header = appendUint16(header, uint16(8*w.sampleSize))
+	if w.float {
+		header = appendUint16(header, 0)
+		header = appendChunkHeader(header, "fact", factLen)
+		header = appendUint32(header, 0)
+	}
+
+	return appendChunkHeader(header, "data", 0)
+}
+
+// WriteFloat32 writes interleaved samples, with as many channels as the
+// writer. 16-bit samples are rounded and clipped to the range of int16.
+func (w *WAVWriter) WriteFloat32(samples []float32) error {
+	if w.closed {
+		return errWriterClosed
+	} else if len(samples)%w.channels != 0 {
+		return errBadSampleCount
+	}
+
+	size := len(samples) * w.sampleSize
+	if uint64(w.dataSize)+uint64(size) > maxDataSize {
+		return errFileTooLarge
+	}
+
+	if cap(w.sampleBuf) < size {
+		w.sampleBuf = make([]byte, size)
+	}
+	buf := w.sampleBuf[:size]
+
+	for i, sample := range samples {
+		if w.float {
+			binary.LittleEndian.PutUint32(buf[4*i:], math.Float32bits(sample))
+		} else {
+			binary.LittleEndian.PutUint16(buf[2*i:], uint16(floatToInt16(sample)))
+		}
+	}
+
+	if _, err := w.stream.Write(buf); err != nil {
+		return err
+	}
+
+	w.dataSize += uint32(size)
+	return nil
+}
+
+// Close writes the chunk sizes into the header, and closes the file if
+// the writer was created with New
+func (w *WAVWriter) Close() (err error) {
+	if w.closed {
+		return errWriterClosed
+	}
+	w.closed = true
+
+	defer func() {
+		if w.fd == nil {
+			return
+		}
+
+		if closeErr := w.fd.Close(); err == nil {
+			err = closeErr
+		}
+	}()
+
+	// Samples are 2 or 4 bytes, so the data chunk never needs padding to
+	// an even size
+	riffSize := uint32(w.headerLen) - chunkHeaderLen + w.dataSize
+	if err = w.writeUint32At(4, riffSize); err != nil {
+		return err
+	}
+
+	if w.float {
+		frames := w.dataSize / uint32(w.channels*w.sampleSize)
+		if err = w.writeUint32At(w.headerLen-chunkHeaderLen-factLen, frames); err != nil {
+			return err
+		}
+	}
+
+	if err = w.writeUint32At(w.headerLen-4, w.dataSize); err != nil {
+		return err
+	}
+
+	_, err = w.stream.Seek(0, io.SeekEnd)
+	return err
+}
+
+func (w *WAVWriter) writeUint32At(offset int64, v uint32) error {
+	if _, err := w.stream.Seek(offset, io.SeekStart); err != nil {
+		return err
+	}
+
+	_, err := w.stream.Write(appendUint32(nil, v))
+	return err
+}
+
+func floatToInt16(sample float32) int16 {
+	scaled := math.Floor(0.5 + float64(sample)*32768)
+	if scaled > math.MaxInt16 {
+		return math.MaxInt16
+	} else if scaled < math.MinInt16 {
+		return math.MinInt16
+	}
+
+	return int16(scaled)
+}
+
+func appendChunkHeader(b []byte, id string, size uint32) []byte {
+	return appendUint32(append(b, id...), size)
+}
+
+func appendUint16(b []byte, v uint16) []byte {
+	return append(b, byte(v), byte(v>>8))
+}
+
+func appendUint32(b []byte, v uint32) []byte {
+	return append(b, byte(v), byte(v>>8), byte(v>>16), byte(v>>24))
+}
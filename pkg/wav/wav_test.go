@@ -0,0 +1,121 @@
+package wav
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"testing"
+)
+
+// seekBuffer is an in-memory io.WriteSeeker
+type seekBuffer struct {
+	data   []byte
+	offset int64
+}
+
+func (s *seekBuffer) Write(p []byte) (int, error) {
+	if end := s.offset + int64(len(p)); end > int64(len(s.data)) {
+		s.data = append(s.data, make([]byte, end-int64(len(s.data)))...)
+	}
+
+	copy(s.data[s.offset:], p)
+	s.offset += int64(len(p))
+	return len(p), nil
+}
+
+func (s *seekBuffer) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekStart:
+		s.offset = offset
+	case io.SeekCurrent:
+		s.offset += offset
+	case io.SeekEnd:
+		s.offset = int64(len(s.data)) + offset
+	}
+
+	return s.offset, nil
+}
+
+func TestWAVWriter(t *testing.T) {
+	for _, test := range []struct {
+		name     string
+		opts     []Option
+		channels int
+		samples  []float32
+		expected []byte
+	}{
+		{
+			"16-bit stereo",
+			nil,
+			2,
+			[]float32{0, 0.5, -1, 1.5},
+			[]byte{
+				'R', 'I', 'F', 'F', 44, 0, 0, 0, 'W', 'A', 'V', 'E',
+				'f', 'm', 't', ' ', 16, 0, 0, 0,
+				1, 0, 2, 0, 0x80, 0xbb, 0, 0, 0x00, 0xee, 0x02, 0, 4, 0, 16, 0,
+				'd', 'a', 't', 'a', 8, 0, 0, 0,
+				0, 0, 0x00, 0x40, 0x00, 0x80, 0xff, 0x7f,
+			},
+		},
+		{
+			"Float mono",
+			[]Option{WithFloat32()},
+			1,
+			[]float32{1, -0.5},
+			[]byte{
+				'R', 'I', 'F', 'F', 58, 0, 0, 0, 'W', 'A', 'V', 'E',
+				'f', 'm', 't', ' ', 18, 0, 0, 0,
+				3, 0, 1, 0, 0x80, 0xbb, 0, 0, 0x00, 0xee, 0x02, 0, 4, 0, 32, 0, 0, 0,
+				'f', 'a', 'c', 't', 4, 0, 0, 0, 2, 0, 0, 0,
+				'd', 'a', 't', 'a', 8, 0, 0, 0,
+				0x00, 0x00, 0x80, 0x3f, 0x00, 0x00, 0x00, 0xbf,
+			},
+		},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			out := &seekBuffer{}
+			writer, err := NewWith(out, 48000, test.channels, test.opts...)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			// Written in two calls to check that sizes add up
+			if err = writer.WriteFloat32(test.samples[:test.channels]); err != nil {
+				t.Fatal(err)
+			} else if err = writer.WriteFloat32(test.samples[test.channels:]); err != nil {
+				t.Fatal(err)
+			} else if err = writer.Close(); err != nil {
+				t.Fatal(err)
+			}
+
+			if !bytes.Equal(out.data, test.expected) {
+				t.Fatalf("expected %v, got %v", test.expected, out.data)
+			}
+		})
+	}
+}
+
+func TestWAVWriter_Errors(t *testing.T) {
+	if _, err := NewWith(nil, 48000, 1); !errors.Is(err, errNilStream) {
+		t.Fatalf("expected %v, got %v", errNilStream, err)
+	} else if _, err = NewWith(&seekBuffer{}, 0, 1); !errors.Is(err, errBadSampleRate) {
+		t.Fatalf("expected %v, got %v", errBadSampleRate, err)
+	} else if _, err = NewWith(&seekBuffer{}, 48000, 0); !errors.Is(err, errBadChannelCount) {
+		t.Fatalf("expected %v, got %v", errBadChannelCount, err)
+	}
+
+	writer, err := NewWith(&seekBuffer{}, 48000, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err = writer.WriteFloat32([]float32{0, 0, 0}); !errors.Is(err, errBadSampleCount) {
+		t.Fatalf("expected %v, got %v", errBadSampleCount, err)
+	} else if err = writer.Close(); err != nil {
+		t.Fatal(err)
+	} else if err = writer.WriteFloat32([]float32{0, 0}); !errors.Is(err, errWriterClosed) {
+		t.Fatalf("expected %v, got %v", errWriterClosed, err)
+	} else if err = writer.Close(); !errors.Is(err, errWriterClosed) {
+		t.Fatalf("expected %v, got %v", errWriterClosed, err)
+	}
+}
@@ -0,0 +1,192 @@
+package webmreader
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+)
+
+const (
+	maxVINTLength = 8
+
+	// Elements are read into memory whole, unless they are skipped
+	maxElementSize = 16 * 1024 * 1024
+)
+
+var (
+	errBadVINT            = errors.New("invalid EBML variable size integer")
+	errElementTooLarge    = errors.New("EBML element is too large")
+	errUnknownElementSize = errors.New("EBML element of unknown size can't be read whole")
+	errBadIntegerSize     = errors.New("EBML integer element is longer than 8 bytes")
+)
+
+// EBML encodes element IDs and sizes as variable size integers. The number
+// of leading zero bits of the first byte, plus one, is the length of the
+// integer in bytes. The length marker is part of element IDs, and is
+// removed from sizes. A size with all of its value bits set is unknown.
+//
+// https://www.rfc-editor.org/rfc/rfc8794.html#section-4
+func readVINT(r io.Reader, keepMarker bool) (value uint64, length int, err error) {
+	buffer := make([]byte, 1, maxVINTLength)
+	if _, err = io.ReadFull(r, buffer); err != nil {
+		return 0, 0, err
+	}
+
+	if length, err = vintLength(buffer[0]); err != nil {
+		return 0, 0, err
+	}
+
+	buffer = buffer[:length]
+	if _, err = io.ReadFull(r, buffer[1:]); err != nil {
+		return 0, 0, unexpectedEOF(err)
+	}
+
+	if !keepMarker {
+		return readVINTFromBytes(buffer)
+	}
+
+	for _, b := range buffer {
+		value = value<<8 | uint64(b)
+	}
+	return value, length, nil
+}
+
+// readVINTFromBytes reads a variable size integer without its length
+// marker at the start of in, as used by sizes, block headers and lacing
+func readVINTFromBytes(in []byte) (value uint64, length int, err error) {
+	if len(in) == 0 {
+		return 0, 0, errBadVINT
+	}
+
+	if length, err = vintLength(in[0]); err != nil {
+		return 0, 0, err
+	} else if length > len(in) {
+		return 0, 0, errBadVINT
+	}
+
+	value = uint64(in[0] & (0xff >> length))
+	for _, b := range in[1:length] {
+		value = value<<8 | uint64(b)
+	}
+
+	return value, length, nil
+}
+
+func vintLength(first byte) (int, error) {
+	length := 1
+	for mask := byte(0x80); first&mask == 0; mask >>= 1 {
+		length++
+		if length > maxVINTLength {
+			return 0, errBadVINT
+		}
+	}
+
+	return length, nil
+}
+
+type elementHeader struct {
+	id          uint32
+	size        uint64
+	unknownSize bool
+}
+
+func readElementHeader(r io.Reader) (*elementHeader, error) {
+	id, _, err := readVINT(r, true)
+	if err != nil {
+		return nil, err
+	}
+
+	size, length, err := readVINT(r, false)
+	if err != nil {
+		return nil, unexpectedEOF(err)
+	}
+
+	return &elementHeader{
+		id:          uint32(id),
+		size:        size,
+		unknownSize: size == 1<<(7*length)-1,
+	}, nil
+}
+
+func readElementData(r io.Reader, header *elementHeader) ([]byte, error) {
+	if header.unknownSize {
+		return nil, errUnknownElementSize
+	} else if header.size > maxElementSize {
+		return nil, errElementTooLarge
+	}
+
+	data := make([]byte, header.size)
+	if _, err := io.ReadFull(r, data); err != nil {
+		return nil, unexpectedEOF(err)
+	}
+
+	return data, nil
+}
+
+func skipElementData(r io.Reader, header *elementHeader) error {
+	if header.unknownSize {
+		return errUnknownElementSize
+	}
+
+	if _, err := io.CopyN(io.Discard, r, int64(header.size)); err != nil {
+		return unexpectedEOF(err)
+	}
+
+	return nil
+}
+
+// elementChildren iterates over the child elements of a master element
+// read into memory
+func elementChildren(data []byte, fn func(id uint32, data []byte) error) error {
+	r := bytes.NewReader(data)
+	for r.Len() != 0 {
+		header, err := readElementHeader(r)
+		if err != nil {
+			return unexpectedEOF(err)
+		}
+
+		childData, err := readElementData(r, header)
+		if err != nil {
+			return err
+		}
+
+		if err = fn(header.id, childData); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Integers are big endian and 0 to 8 bytes long
+//
+// https://www.rfc-editor.org/rfc/rfc8794.html#section-7
+func parseUnsigned(data []byte) (uint64, error) {
+	if len(data) > 8 {
+		return 0, errBadIntegerSize
+	}
+
+	buffer := make([]byte, 8)
+	copy(buffer[8-len(data):], data)
+	return binary.BigEndian.Uint64(buffer), nil
+}
+
+func parseSigned(data []byte) (int64, error) {
+	value, err := parseUnsigned(data)
+	if err != nil || len(data) == 0 {
+		return 0, err
+	}
+
+	// Sign extend
+	shift := 64 - 8*uint(len(data))
+	return int64(value<<shift) >> shift, nil
+}
+
+func unexpectedEOF(err error) error {
+	if errors.Is(err, io.EOF) {
+		return io.ErrUnexpectedEOF
+	}
+
+	return err
+}
@@ -0,0 +1,383 @@
+// Package webmreader implements a WebM/Matroska reader for Opus tracks
+package webmreader
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+	"time"
+
+	"github.com/pion/opus"
+	"github.com/pion/opus/pkg/oggreader"
+)
+
+// Element IDs, including their length marker
+//
+// https://www.matroska.org/technical/elements.html
+const (
+	idSegment        = 0x18538067
+	idInfo           = 0x1549A966
+	idTimestampScale = 0x2AD7B1
+	idTracks         = 0x1654AE6B
+	idTrackEntry     = 0xAE
+	idTrackNumber    = 0xD7
+	idCodecID        = 0x86
+	idCodecPrivate   = 0x63A2
+	idCodecDelay     = 0x56AA
+	idSeekPreRoll    = 0x56BB
+	idCluster        = 0x1F43B675
+	idTimestamp      = 0xE7
+	idSimpleBlock    = 0xA3
+	idBlockGroup     = 0xA0
+	idBlock          = 0xA1
+	idDiscardPadding = 0x75A2
+)
+
+const (
+	opusCodecID = "A_OPUS"
+
+	defaultTimestampScale = 1000000
+
+	blockHeaderLen = 3
+
+	lacingMask  = 0x06
+	lacingNone  = 0x00
+	lacingXiph  = 0x02
+	lacingFixed = 0x04
+	lacingEBML  = 0x06
+)
+
+var (
+	errNilStream       = errors.New("stream is nil")
+	errNoOpusTrack     = errors.New("no A_OPUS track found before the first cluster")
+	errShortBlock      = errors.New("block is too short for its header")
+	errBadLacing       = errors.New("block lacing sizes exceed the block")
+	errNoCodecPrivate  = errors.New("A_OPUS track has no CodecPrivate")
+	errBlockOutOfOrder = errors.New("block found before the first cluster timestamp")
+)
+
+// Track is the Opus track of a WebM file
+type Track struct {
+	Number uint64
+
+	// Header is the OpusHead ID header stored as CodecPrivate
+	Header *oggreader.OggHeader
+
+	// CodecDelay is the duration to discard from the start of the decoded
+	// audio, and SeekPreRoll the duration to decode before the target of
+	// a seek for the output to converge
+	CodecDelay  time.Duration
+	SeekPreRoll time.Duration
+}
+
+// PacketHeader is the metadata of a packet returned by ReadPacket
+type PacketHeader struct {
+	// Timestamp is the presentation time of the packet
+	Timestamp time.Duration
+
+	// DiscardPadding is the duration to discard from the end of the
+	// decoded packet, set on the last packet of a BlockGroup
+	DiscardPadding time.Duration
+}
+
+// WebMReader reads the packets of the Opus track of a WebM or Matroska
+// file. Live files, where the Segment and Clusters have an unknown size,
+// are supported.
+//
+// https://www.matroska.org/technical/codec_specs.html
+type WebMReader struct {
+	stream io.Reader
+	track  *Track
+
+	timestampScale   uint64
+	clusterTimestamp int64
+	hasCluster       bool
+
+	packets       [][]byte
+	packetHeaders []*PacketHeader
+}
+
+// NewWith returns a new WebM reader and the Opus track, reading up to the
+// track list
+func NewWith(in io.Reader) (*WebMReader, *Track, error) {
+	if in == nil {
+		return nil, nil, errNilStream
+	}
+
+	r := &WebMReader{
+		stream:         in,
+		timestampScale: defaultTimestampScale,
+	}
+
+	for r.track == nil {
+		header, err := readElementHeader(r.stream)
+		if errors.Is(err, io.EOF) {
+			return nil, nil, errNoOpusTrack
+		} else if err != nil {
+			return nil, nil, err
+		}
+
+		if header.id == idCluster {
+			return nil, nil, errNoOpusTrack
+		} else if err = r.handleElement(header); err != nil {
+			return nil, nil, err
+		}
+	}
+
+	return r, r.track, nil
+}
+
+// ReadPacket returns the next packet of the Opus track. The frames of
+// laced blocks are returned one by one.
+func (r *WebMReader) ReadPacket() ([]byte, *PacketHeader, error) {
+	for len(r.packets) == 0 {
+		header, err := readElementHeader(r.stream)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		if err = r.handleElement(header); err != nil {
+			return nil, nil, err
+		}
+	}
+
+	packet, packetHeader := r.packets[0], r.packetHeaders[0]
+	r.packets, r.packetHeaders = r.packets[1:], r.packetHeaders[1:]
+	return packet, packetHeader, nil
+}
+
+// The Segment and Clusters are entered instead of read whole, so their
+// children are read as if they were at the top level. Other elements are
+// read whole or skipped.
+func (r *WebMReader) handleElement(header *elementHeader) error {
+	switch header.id {
+	case idSegment:
+		return nil
+	case idCluster:
+		r.hasCluster = false
+		return nil
+	case idInfo, idTracks, idTimestamp, idSimpleBlock, idBlockGroup:
+	default:
+		return skipElementData(r.stream, header)
+	}
+
+	data, err := readElementData(r.stream, header)
+	if err != nil {
+		return err
+	}
+
+	switch header.id {
+	case idInfo:
+		return elementChildren(data, func(id uint32, data []byte) (err error) {
+			if id == idTimestampScale {
+				r.timestampScale, err = parseUnsigned(data)
+			}
+			return err
+		})
+	case idTracks:
+		return elementChildren(data, func(id uint32, data []byte) error {
+			if id != idTrackEntry || r.track != nil {
+				return nil
+			}
+			return r.parseTrackEntry(data)
+		})
+	case idTimestamp:
+		timestamp, err := parseUnsigned(data)
+		r.clusterTimestamp = int64(timestamp)
+		r.hasCluster = true
+		return err
+	case idSimpleBlock:
+		return r.parseBlock(data, 0)
+	default:
+		return r.parseBlockGroup(data)
+	}
+}
+
+func (r *WebMReader) parseTrackEntry(data []byte) error {
+	track := &Track{}
+	var codecID string
+	var codecPrivate []byte
+
+	err := elementChildren(data, func(id uint32, data []byte) (err error) {
+		switch id {
+		case idTrackNumber:
+			track.Number, err = parseUnsigned(data)
+		case idCodecID:
+			codecID = string(data)
+		case idCodecPrivate:
+			codecPrivate = data
+		case idCodecDelay:
+			var delay uint64
+			delay, err = parseUnsigned(data)
+			track.CodecDelay = time.Duration(delay)
+		case idSeekPreRoll:
+			var preRoll uint64
+			preRoll, err = parseUnsigned(data)
+			track.SeekPreRoll = time.Duration(preRoll)
+		}
+		return err
+	})
+	if err != nil || codecID != opusCodecID {
+		return err
+	} else if codecPrivate == nil {
+		return errNoCodecPrivate
+	}
+
+	if track.Header, err = oggreader.ParseIDHeader(codecPrivate); err != nil {
+		return err
+	}
+
+	r.track = track
+	return nil
+}
+
+func (r *WebMReader) parseBlockGroup(data []byte) error {
+	var block []byte
+	var discardPadding int64
+
+	err := elementChildren(data, func(id uint32, data []byte) (err error) {
+		switch id {
+		case idBlock:
+			block = data
+		case idDiscardPadding:
+			discardPadding, err = parseSigned(data)
+		}
+		return err
+	})
+	if err != nil || block == nil {
+		return err
+	}
+
+	return r.parseBlock(block, time.Duration(discardPadding))
+}
+
+// A block starts with the track number, the timestamp relative to the
+// cluster and flags, of which two bits give the lacing used to store
+// several frames in the block
+//
+// https://www.matroska.org/technical/basics.html#block-structure
+func (r *WebMReader) parseBlock(data []byte, discardPadding time.Duration) error {
+	trackNumber, size, err := readVINTFromBytes(data)
+	if err != nil {
+		return err
+	} else if len(data) < size+blockHeaderLen {
+		return errShortBlock
+	} else if r.track == nil || trackNumber != r.track.Number {
+		return nil
+	} else if !r.hasCluster {
+		return errBlockOutOfOrder
+	}
+
+	relativeTimestamp := int64(int16(binary.BigEndian.Uint16(data[size:])))
+	flags := data[size+2]
+
+	frames, err := splitLacedFrames(data[size+blockHeaderLen:], flags&lacingMask)
+	if err != nil {
+		return err
+	}
+
+	timestamp := time.Duration((r.clusterTimestamp + relativeTimestamp) * int64(r.timestampScale))
+	for i, frame := range frames {
+		packetHeader := &PacketHeader{Timestamp: timestamp}
+		if i == len(frames)-1 {
+			packetHeader.DiscardPadding = discardPadding
+		}
+
+		r.packets = append(r.packets, frame)
+		r.packetHeaders = append(r.packetHeaders, packetHeader)
+
+		// Laced frames have no timestamps of their own, they follow each
+		// other
+		if samples, err := opus.PacketSampleCount(frame, 48000); err == nil {
+			timestamp += time.Duration(samples) * time.Second / 48000
+		}
+	}
+
+	return nil
+}
+
+// Lacing stores the number of frames minus one, then the sizes of all
+// frames but the last. Xiph lacing codes sizes like Ogg, as a run of 255
+// bytes ended by a smaller one. EBML lacing codes the first size as a
+// variable size integer and the following ones as signed differences
+// with the previous size. Fixed-size lacing stores no sizes.
+//
+// https://www.matroska.org/technical/notes.html#block-lacing
+func splitLacedFrames(data []byte, lacing byte) ([][]byte, error) {
+	if lacing == lacingNone {
+		return [][]byte{data}, nil
+	} else if len(data) < 1 {
+		return nil, errShortBlock
+	}
+
+	count := int(data[0]) + 1
+	data = data[1:]
+
+	sizes := make([]int, count)
+	switch lacing {
+	case lacingFixed:
+		if len(data)%count != 0 {
+			return nil, errBadLacing
+		}
+		for i := range sizes {
+			sizes[i] = len(data) / count
+		}
+		return sliceFrames(data, sizes)
+	case lacingXiph:
+		for i := 0; i < count-1; i++ {
+			for {
+				if len(data) == 0 {
+					return nil, errBadLacing
+				}
+
+				b := data[0]
+				sizes[i] += int(b)
+				data = data[1:]
+				if b != 255 {
+					break
+				}
+			}
+		}
+	case lacingEBML:
+		for i := 0; i < count-1; i++ {
+			value, length, err := readVINTFromBytes(data)
+			if err != nil {
+				return nil, err
+			}
+			data = data[length:]
+
+			if i == 0 {
+				sizes[i] = int(value)
+				continue
+			}
+
+			// Differences are stored with a bias of half the range
+			bias := int64(1)<<(7*uint(length)-1) - 1
+			sizes[i] = sizes[i-1] + int(int64(value)-bias)
+		}
+	}
+
+	last := len(data)
+	for _, size := range sizes[:count-1] {
+		if size < 0 {
+			return nil, errBadLacing
+		}
+		last -= size
+	}
+	sizes[count-1] = last
+
+	return sliceFrames(data, sizes)
+}
+
+func sliceFrames(data []byte, sizes []int) ([][]byte, error) {
+	frames := make([][]byte, len(sizes))
+	for i, size := range sizes {
+		if size < 0 || size > len(data) {
+			return nil, errBadLacing
+		}
+
+		frames[i], data = data[:size], data[size:]
+	}
+
+	return frames, nil
+}
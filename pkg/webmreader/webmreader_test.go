@@ -0,0 +1,187 @@
+package webmreader
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/pion/opus/pkg/oggreader"
+)
+
+var unknownSize = []byte{0x01, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff}
+
+// element encodes an EBML element, with its size always on 8 bytes
+func element(id uint32, children ...[]byte) []byte {
+	var out []byte
+	for shift := 24; shift >= 0; shift -= 8 {
+		if b := byte(id >> shift); b != 0 || len(out) != 0 {
+			out = append(out, b)
+		}
+	}
+
+	payload := bytes.Join(children, nil)
+	size := uint64(len(payload))
+	out = append(out, 0x01)
+	for shift := 48; shift >= 0; shift -= 8 {
+		out = append(out, byte(size>>shift))
+	}
+
+	return append(out, payload...)
+}
+
+func unsignedElement(id uint32, value uint64) []byte {
+	return element(id, []byte{byte(value >> 24), byte(value >> 16), byte(value >> 8), byte(value)})
+}
+
+func buildOpusHead() []byte {
+	return []byte{
+		'O', 'p', 'u', 's', 'H', 'e', 'a', 'd', 1, 2,
+		0x38, 0x01, 0x80, 0xbb, 0x00, 0x00, 0x00, 0x00, 0x00,
+	}
+}
+
+func buildTracks(codecID string, codecPrivate []byte) []byte {
+	return element(idTracks,
+		element(idTrackEntry,
+			unsignedElement(idTrackNumber, 1),
+			element(idCodecID, []byte(codecID)),
+			element(idCodecPrivate, codecPrivate),
+			unsignedElement(idCodecDelay, 6500000),
+			unsignedElement(idSeekPreRoll, 80000000),
+		),
+	)
+}
+
+// 20ms SILK frame padded to size
+func buildFrame(size int) []byte {
+	frame := make([]byte, size)
+	frame[0] = 0x08
+	return frame
+}
+
+func TestWebMReader(t *testing.T) {
+	xiphFrames := [][]byte{buildFrame(300), buildFrame(2), buildFrame(4)}
+	ebmlFrames := [][]byte{buildFrame(3), buildFrame(5), buildFrame(2)}
+	fixedFrames := [][]byte{buildFrame(2), buildFrame(2)}
+
+	xiphBlock := append([]byte{0x81, 0x00, 0x14, 0x82, 2, 255, 45, 2}, bytes.Join(xiphFrames, nil)...)
+	ebmlBlock := append([]byte{0x81, 0x00, 0x64, 0x06, 2, 0x83, 0xc1}, bytes.Join(ebmlFrames, nil)...)
+	fixedBlock := append([]byte{0x81, 0xff, 0xec, 0x84, 1}, bytes.Join(fixedFrames, nil)...)
+
+	var file []byte
+	file = append(file, element(0x1A45DFA3, element(0x4282, []byte("webm")))...)
+	file = append(file, 0x18, 0x53, 0x80, 0x67)
+	file = append(file, unknownSize...)
+	file = append(file, element(idInfo, unsignedElement(idTimestampScale, 1000000))...)
+	file = append(file, buildTracks(opusCodecID, buildOpusHead())...)
+	file = append(file, 0x1F, 0x43, 0xB6, 0x75)
+	file = append(file, unknownSize...)
+	file = append(file, unsignedElement(idTimestamp, 1000)...)
+	file = append(file, element(idSimpleBlock, []byte{0x81, 0x00, 0x00, 0x80}, buildFrame(2))...)
+	file = append(file, element(idSimpleBlock, []byte{0x82, 0x00, 0x00, 0x80}, buildFrame(2))...)
+	file = append(file, element(idSimpleBlock, xiphBlock)...)
+	file = append(file, element(idBlockGroup,
+		element(idBlock, ebmlBlock),
+		element(idDiscardPadding, []byte{0x0f, 0x42, 0x40}),
+	)...)
+	file = append(file, element(idCluster,
+		unsignedElement(idTimestamp, 2000),
+		element(idSimpleBlock, fixedBlock),
+	)...)
+
+	reader, track, err := NewWith(bytes.NewReader(file))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	header, err := oggreader.ParseIDHeader(buildOpusHead())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expectedTrack := &Track{
+		Number:      1,
+		Header:      header,
+		CodecDelay:  6500 * time.Microsecond,
+		SeekPreRoll: 80 * time.Millisecond,
+	}
+	if !reflect.DeepEqual(track, expectedTrack) {
+		t.Fatalf("expected %+v, got %+v", expectedTrack, track)
+	}
+
+	ms := time.Millisecond
+	expected := []struct {
+		packet []byte
+		header PacketHeader
+	}{
+		{buildFrame(2), PacketHeader{Timestamp: 1000 * ms}},
+		{xiphFrames[0], PacketHeader{Timestamp: 1020 * ms}},
+		{xiphFrames[1], PacketHeader{Timestamp: 1040 * ms}},
+		{xiphFrames[2], PacketHeader{Timestamp: 1060 * ms}},
+		{ebmlFrames[0], PacketHeader{Timestamp: 1100 * ms}},
+		{ebmlFrames[1], PacketHeader{Timestamp: 1120 * ms}},
+		{ebmlFrames[2], PacketHeader{Timestamp: 1140 * ms, DiscardPadding: ms}},
+		{fixedFrames[0], PacketHeader{Timestamp: 1980 * ms}},
+		{fixedFrames[1], PacketHeader{Timestamp: 2000 * ms}},
+	}
+
+	for i, e := range expected {
+		packet, header, err := reader.ReadPacket()
+		if err != nil {
+			t.Fatal(err)
+		} else if !bytes.Equal(packet, e.packet) {
+			t.Fatalf("packet %d: expected %v, got %v", i, e.packet, packet)
+		} else if *header != e.header {
+			t.Fatalf("packet %d: expected %+v, got %+v", i, e.header, *header)
+		}
+	}
+
+	if _, _, err = reader.ReadPacket(); !errors.Is(err, io.EOF) {
+		t.Fatalf("expected io.EOF, got %v", err)
+	}
+}
+
+func TestWebMReader_Errors(t *testing.T) {
+	tracks := buildTracks(opusCodecID, buildOpusHead())
+	cluster := unsignedElement(idTimestamp, 0)
+
+	for _, test := range []struct {
+		name string
+		file []byte
+		err  error
+	}{
+		{"Nil stream", nil, errNilStream},
+		{"Empty", []byte{}, errNoOpusTrack},
+		{"Not Opus", buildTracks("A_VORBIS", buildOpusHead()), errNoOpusTrack},
+		{"Cluster before tracks", element(idCluster), errNoOpusTrack},
+		{"Bad OpusHead", buildTracks(opusCodecID, []byte("OpusHead")), nil},
+		{"Truncated", tracks[:len(tracks)-1], io.ErrUnexpectedEOF},
+		{"Bad VINT", []byte{0x00}, errBadVINT},
+		{"Bad lacing", bytes.Join([][]byte{tracks, cluster, element(idSimpleBlock, []byte{0x81, 0, 0, 0x84, 1, 0x08})}, nil), errBadLacing},
+		{"Short block", bytes.Join([][]byte{tracks, cluster, element(idSimpleBlock, []byte{0x81, 0})}, nil), errShortBlock},
+		{"Block before timestamp", bytes.Join([][]byte{tracks, element(idSimpleBlock, []byte{0x81, 0, 0, 0, 0x08})}, nil), errBlockOutOfOrder},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			var in io.Reader
+			if test.file != nil {
+				in = bytes.NewReader(test.file)
+			}
+
+			reader, _, err := NewWith(in)
+			if err == nil {
+				_, _, err = reader.ReadPacket()
+			}
+
+			if test.err == nil {
+				if err == nil {
+					t.Fatal("expected an error")
+				}
+			} else if !errors.Is(err, test.err) {
+				t.Fatalf("expected %v, got %v", test.err, err)
+			}
+		})
+	}
+}
@@ -0,0 +1,97 @@
+package opus
+
+// Demixing matrix coefficients are in Q15
+const demixingMatrixScale = 1.0 / 32768
+
+// ProjectionDecoder decodes ambisonics packets of channel mapping family
+// 3, like opus_projection_decoder. The packet is decoded by a
+// MultistreamDecoder, then the output channels are computed by
+// multiplying the decoded channels with a demixing matrix.
+//
+// https://tools.ietf.org/html/rfc8486.html#section-3.2
+type ProjectionDecoder struct {
+	channels        int
+	decodedChannels int
+	demixingMatrix  []float32
+
+	multistreamDecoder *MultistreamDecoder
+	buffer             []float32
+}
+
+// NewProjectionDecoder creates a ProjectionDecoder with channels output
+// channels. The demixing matrix has channels rows and
+// streams+coupledStreams columns, stored in column-major order like in the
+// channel mapping table of family 3. newDecoder is called once per stream
+// with the number of channels it decodes.
+func NewProjectionDecoder(channels, streams, coupledStreams int, demixingMatrix []int16, newDecoder func(channels int) PCMDecoder) (*ProjectionDecoder, error) {
+	decodedChannels := streams + coupledStreams
+	switch {
+	case channels < 1 || channels > 255:
+		return nil, errInvalidChannelCount
+	case len(demixingMatrix) != channels*decodedChannels:
+		return nil, errInvalidDemixingMatrix
+	}
+
+	// Every decoded channel is kept, the matrix does the mapping
+	mapping := make([]uint8, decodedChannels)
+	for i := range mapping {
+		mapping[i] = uint8(i)
+	}
+
+	multistreamDecoder, err := NewMultistreamDecoder(decodedChannels, streams, coupledStreams, mapping, newDecoder)
+	if err != nil {
+		return nil, err
+	}
+
+	d := &ProjectionDecoder{
+		channels:           channels,
+		decodedChannels:    decodedChannels,
+		demixingMatrix:     make([]float32, len(demixingMatrix)),
+		multistreamDecoder: multistreamDecoder,
+		buffer:             make([]float32, maxPacketSamples*decodedChannels),
+	}
+	for i, coefficient := range demixingMatrix {
+		d.demixingMatrix[i] = float32(coefficient) * demixingMatrixScale
+	}
+
+	return d, nil
+}
+
+// DecodeFloat32 decodes a multistream packet into interleaved samples for
+// every output channel, and returns the number of samples per channel
+func (d *ProjectionDecoder) DecodeFloat32(in []byte, out []float32) (int, error) {
+	samples, err := d.multistreamDecoder.DecodeFloat32(in, d.buffer)
+	if err != nil {
+		return 0, err
+	}
+	return d.demix(out, samples)
+}
+
+// Conceal conceals a lost multistream packet of samples samples per
+// channel in every stream, whose decoders must implement Concealer
+func (d *ProjectionDecoder) Conceal(out []float32, samples int) (int, error) {
+	samples, err := d.multistreamDecoder.Conceal(d.buffer, samples)
+	if err != nil {
+		return 0, err
+	}
+	return d.demix(out, samples)
+}
+
+func (d *ProjectionDecoder) demix(out []float32, samples int) (int, error) {
+	if len(out) < samples*d.channels {
+		return 0, errOutputBufferTooShort
+	}
+
+	for i := 0; i < samples; i++ {
+		decoded := d.buffer[i*d.decodedChannels : (i+1)*d.decodedChannels]
+		for channel := 0; channel < d.channels; channel++ {
+			sample := float32(0)
+			for j, value := range decoded {
+				sample += d.demixingMatrix[j*d.channels+channel] * value
+			}
+			out[i*d.channels+channel] = sample
+		}
+	}
+
+	return samples, nil
+}
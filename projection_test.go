@@ -0,0 +1,53 @@
+package opus
+
+import (
+	"errors"
+	"math"
+	"testing"
+)
+
+func TestProjectionDecoder(t *testing.T) {
+	// First order ambisonics from one coupled and two mono streams. The
+	// decoded channels are 10, 11, 20 and 30. The matrix swaps the first
+	// two channels, halves the third and mixes the last two into the
+	// fourth.
+	demixingMatrix := []int16{
+		0, 32767, 0, 0, // Decoded channel 0
+		32767, 0, 0, 0, // Decoded channel 1
+		0, 0, 16384, 16384, // Decoded channel 2
+		0, 0, 0, -16384, // Decoded channel 3
+	}
+
+	decoder, err := NewProjectionDecoder(4, 3, 1, demixingMatrix, newConstantDecoder)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	out := make([]float32, 960*4)
+	samples, err := decoder.DecodeFloat32([]byte{0x08, 1, 10, 0x08, 1, 20, 0x08, 30}, out)
+	switch {
+	case err != nil:
+		t.Fatal(err)
+	case samples != 960:
+		t.Fatal(samples)
+	}
+
+	expected := []float32{11, 10, 10, -5}
+	for i, sample := range out {
+		if math.Abs(float64(sample-expected[i%4])) > 1e-2 {
+			t.Fatalf("sample %d of channel %d: expected %f, got %f", i/4, i%4, expected[i%4], sample)
+		}
+	}
+}
+
+func TestProjectionDecoder_Errors(t *testing.T) {
+	if _, err := NewProjectionDecoder(4, 3, 1, make([]int16, 15), newConstantDecoder); !errors.Is(err, errInvalidDemixingMatrix) {
+		t.Fatal(err)
+	}
+	if _, err := NewProjectionDecoder(0, 3, 1, nil, newConstantDecoder); !errors.Is(err, errInvalidChannelCount) {
+		t.Fatal(err)
+	}
+	if _, err := NewProjectionDecoder(4, 1, 3, make([]int16, 16), newConstantDecoder); !errors.Is(err, errInvalidStreamCount) {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,159 @@
+package opus
+
+import "math"
+
+// The SILK decoder output is resampled to 48 kHz like silk_resampler of
+// libopus, so that the output matches the reference decoder: the input is
+// upsampled by two with an allpass based filter, then interpolated with a
+// 12 phase FIR filter.
+//
+// https://datatracker.ietf.org/doc/html/rfc6716#section-4.2.9
+const (
+	upsamplerOrder  = 8
+	upsamplerPhases = 12
+)
+
+var (
+	upsamplerAllpass = [2][3]int32{
+		{1746, 14986, 39083 - 65536},
+		{6854, 25769, 55542 - 65536},
+	}
+
+	upsamplerFIR = [upsamplerPhases][upsamplerOrder / 2]int32{
+		{189, -600, 617, 30567},
+		{117, -159, -1070, 29704},
+		{52, 221, -2392, 28276},
+		{-4, 529, -3350, 26341},
+		{-48, 758, -3956, 23973},
+		{-80, 905, -4235, 21254},
+		{-99, 972, -4222, 18278},
+		{-107, 967, -3957, 15143},
+		{-103, 896, -3487, 11950},
+		{-91, 773, -2865, 8798},
+		{-71, 611, -2143, 5784},
+		{-46, 425, -1375, 2996},
+	}
+)
+
+// upsampler resamples the mono output of the SILK decoder from 8, 12 or 16
+// kHz to 48 kHz, with the delay libopus adds to line up with the CELT
+// layer of hybrid frames
+type upsampler struct {
+	inputRate int
+
+	// Input samples held back, and the state of the allpass and FIR
+	// filters
+	delay       []int16
+	allpass     [6]int32
+	fir         [upsamplerOrder]int16
+	invRatioQ16 int32
+}
+
+func newUpsampler(inputRate int) *upsampler {
+	// The input delay at 8, 12 and 16 kHz
+	delay := 0
+	switch inputRate {
+	case 12000:
+		delay = 4
+	case 16000:
+		delay = 7
+	}
+
+	u := &upsampler{
+		inputRate:   inputRate,
+		delay:       make([]int16, delay),
+		invRatioQ16: int32(inputRate<<15/decodeSampleRate) << 2,
+	}
+	for int64(u.invRatioQ16)*decodeSampleRate>>16 < int64(inputRate<<1) {
+		u.invRatioQ16++
+	}
+	return u
+}
+
+// process resamples in, which must hold at least 1 ms of samples. The
+// first millisecond, which starts with the delayed samples, is filtered
+// on its own and the rest in batches of 10 ms, as the interpolation
+// restarts at every batch.
+func (u *upsampler) process(in []float32) []float32 {
+	samples := make([]int16, 0, len(u.delay)+len(in))
+	samples = append(samples, u.delay...)
+	for _, sample := range in {
+		samples = append(samples, int16(math.Max(math.MinInt16, math.Min(math.MaxInt16, math.Round(float64(sample)*32768)))))
+	}
+	copy(u.delay, samples[len(in):])
+	samples = samples[:len(in)]
+
+	out := make([]float32, len(in)*decodeSampleRate/u.inputRate)
+	written := u.interpolate(out, samples[:u.inputRate/1000])
+	samples = samples[u.inputRate/1000:]
+	for batch := u.inputRate / 100; len(samples) != 0; samples = samples[minInt(batch, len(samples)):] {
+		written += u.interpolate(out[written:], samples[:minInt(batch, len(samples))])
+	}
+	return out
+}
+
+// interpolate upsamples in by two into a buffer after the FIR history,
+// then interpolates the output from it
+func (u *upsampler) interpolate(out []float32, in []int16) int {
+	buffer := make([]int16, upsamplerOrder+2*len(in))
+	copy(buffer, u.fir[:])
+	u.upsampleByTwo(buffer[upsamplerOrder:], in)
+
+	written := 0
+	maxIndexQ16 := int32(len(in)) << 17
+	for indexQ16 := int32(0); indexQ16 < maxIndexQ16; indexQ16 += u.invRatioQ16 {
+		phase := ((indexQ16 & 0xffff) * upsamplerPhases) >> 16
+		taps := buffer[indexQ16>>16:]
+
+		var sumQ15 int32
+		for i := 0; i < upsamplerOrder/2; i++ {
+			sumQ15 += int32(taps[i]) * upsamplerFIR[phase][i]
+			sumQ15 += int32(taps[upsamplerOrder-1-i]) * upsamplerFIR[upsamplerPhases-1-phase][i]
+		}
+		out[written] = float32(saturate16(roundShift(sumQ15, 15))) / 32768
+		written++
+	}
+
+	copy(u.fir[:], buffer[2*len(in):])
+	return written
+}
+
+// upsampleByTwo runs in through two chains of three first order allpass
+// filters, whose outputs are the even and odd output samples
+func (u *upsampler) upsampleByTwo(out []int16, in []int16) {
+	for k, sample := range in {
+		in32 := int32(sample) << 10
+		for phase, coefficients := range upsamplerAllpass {
+			state := u.allpass[3*phase:]
+			value := in32
+			for i, coefficient := range coefficients {
+				y := value - state[i]
+				x := mulWB(y, coefficient)
+				if coefficient < 0 {
+					x += y
+				}
+				value, state[i] = state[i]+x, value+x
+			}
+			out[2*k+phase] = saturate16(roundShift(value, 10))
+		}
+	}
+}
+
+// mulWB multiplies a by the 16-bit b, keeping the top 32 bits of the 48-bit
+// product
+func mulWB(a, b int32) int32 {
+	return int32(int64(a) * int64(int16(b)) >> 16)
+}
+
+func roundShift(a int32, shift uint) int32 {
+	return ((a >> (shift - 1)) + 1) >> 1
+}
+
+func saturate16(a int32) int16 {
+	if a > math.MaxInt16 {
+		return math.MaxInt16
+	} else if a < math.MinInt16 {
+		return math.MinInt16
+	}
+	return int16(a)
+}
@@ -56,7 +56,7 @@ type (
 	//     as music transmission (NB to FB).
 	//
 	// https://datatracker.ietf.org/doc/html/rfc6716#section-3.1
-	configurationMode byte
+	Mode byte
 
 	// Opus can encode frames of 2.5, 5, 10, 20, 40, or 60 ms.  It can also
 	// combine multiple frames into packets of up to 120 ms.  For real-time
@@ -130,19 +130,20 @@ func (t tableOfContentsHeader) frameCode() frameCode {
 	return frameCode(t & 0b00000011)
 }
 
+// Mode constants
 const (
-	configurationModeSilkOnly configurationMode = iota + 1
-	configurationModeCELTOnly
-	configurationModeHybrid
+	ModeSilkOnly Mode = iota + 1
+	ModeCELTOnly
+	ModeHybrid
 )
 
-func (c configurationMode) String() string {
+func (c Mode) String() string {
 	switch c {
-	case configurationModeSilkOnly:
+	case ModeSilkOnly:
 		return "Silk-only"
-	case configurationModeCELTOnly:
+	case ModeCELTOnly:
 		return "CELT-only"
-	case configurationModeHybrid:
+	case ModeHybrid:
 		return "Hybrid"
 	}
 	return "Invalid"
@@ -150,14 +151,14 @@ func (c configurationMode) String() string {
 
 // See Configuration for mapping of mode to configuration numbers
 // https://datatracker.ietf.org/doc/html/rfc6716#section-3.1
-func (c Configuration) mode() configurationMode {
+func (c Configuration) mode() Mode {
 	switch {
 	case c >= 0 && c <= 11:
-		return configurationModeSilkOnly
+		return ModeSilkOnly
 	case c >= 12 && c <= 15:
-		return configurationModeHybrid
+		return ModeHybrid
 	case c >= 16 && c <= 31:
-		return configurationModeCELTOnly
+		return ModeCELTOnly
 	default:
 		return 0
 	}
@@ -194,7 +195,7 @@ func (f frameDuration) String() string {
 func (f frameDuration) nanoseconds() int {
 	switch f {
 	case frameDuration2500us:
-		return 2500
+		return 2500000
 	case frameDuration5ms:
 		return 5000000
 	case frameDuration10ms:
@@ -222,7 +223,7 @@ func (c Configuration) frameDuration() frameDuration {
 		return frameDuration10ms
 	case 1, 5, 9, 13, 15, 19, 23, 27, 31:
 		return frameDuration20ms
-	case 2, 6:
+	case 2, 6, 10:
 		return frameDuration40ms
 	case 3, 7, 11:
 		return frameDuration60ms
@@ -317,8 +318,8 @@ func (b Bandwidth) SampleRate() int {
 //
 //                  Figure 5: The frame count byte
 func parseFrameCountByte(in byte) (isVBR bool, hasPadding bool, frameCount byte) {
-	isVBR = (in & 0b10000000) == 1
-	hasPadding = (in & 0b01000000) == 1
+	isVBR = (in & 0b10000000) != 0
+	hasPadding = (in & 0b01000000) != 0
 	frameCount = byte(in & 0b00111111)
 	return
 }